@@ -217,6 +217,10 @@ func main() {
 		}
 	}
 
+	if err := overlayRoot(); err != nil {
+		log.Printf("Cannot mount the overlay root, booting without it: %v", err)
+	}
+
 	// exec /sbin/init
 	if err := syscall.Exec("/sbin/init", []string{"/sbin/init"}, os.Environ()); err != nil {
 		log.Fatalf("Cannot exec /sbin/init")
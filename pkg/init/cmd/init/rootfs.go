@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootfsConfig is written by linuxkit build from the rootfs section, with
+// a key=value line for each field
+const rootfsConfig = "/etc/linuxkit/rootfs"
+
+// overlayFSTypes are the filesystems tried on an upper disk
+var overlayFSTypes = []string{"ext4", "xfs", "btrfs"}
+
+func readRootfsConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(kv) == 2 {
+			config[kv[0]] = kv[1]
+		}
+	}
+	return config, s.Err()
+}
+
+// mountUpper mounts the upper filesystem of the overlay, a tmpfs or the
+// disk device upper, on target
+func mountUpper(upper, target, scratch string) error {
+	if upper == "tmpfs" {
+		return unix.Mount("overlay-upper", target, "tmpfs", 0, "")
+	}
+	if !strings.HasPrefix(upper, "/dev/") {
+		return fmt.Errorf("invalid upper %s", upper)
+	}
+	// /dev is only mounted by rc.init, so look for the disk on a devtmpfs
+	// of our own, waiting for it to be probed
+	dev := filepath.Join(scratch, "dev")
+	if err := os.Mkdir(dev, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("devtmpfs", dev, "devtmpfs", 0, ""); err != nil {
+		return err
+	}
+	defer unix.Unmount(dev, unix.MNT_DETACH)
+	disk := filepath.Join(dev, strings.TrimPrefix(upper, "/dev/"))
+	for i := 0; ; i++ {
+		if _, err := os.Stat(disk); err == nil {
+			break
+		}
+		if i == 100 {
+			return fmt.Errorf("disk %s not found", upper)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, fstype := range overlayFSTypes {
+		if err := unix.Mount(disk, target, fstype, 0, ""); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot mount %s as any of %s", upper, strings.Join(overlayFSTypes, ", "))
+}
+
+// overlayRoot makes the root filesystem a writable overlay on it, as
+// configured in rootfsConfig, with the writes going to a tmpfs or a disk,
+// so that services start on it
+func overlayRoot() error {
+	config, err := readRootfsConfig(rootfsConfig)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if config["type"] != "overlay" {
+		return fmt.Errorf("unknown rootfs type %s", config["type"])
+	}
+
+	// the root may be read only, so work on a tmpfs on /mnt
+	const scratch = "/mnt"
+	if err := unix.Mount("overlay-scratch", scratch, "tmpfs", 0, ""); err != nil {
+		return err
+	}
+	upperFS, newRoot := filepath.Join(scratch, "upperfs"), filepath.Join(scratch, "root")
+	for _, d := range []string{upperFS, newRoot} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+	}
+	if err := mountUpper(config["upper"], upperFS, scratch); err != nil {
+		return err
+	}
+	upper, work := filepath.Join(upperFS, "upper"), filepath.Join(upperFS, "work")
+	for _, d := range []string{upper, work} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	data := fmt.Sprintf("lowerdir=/,upperdir=%s,workdir=%s", upper, work)
+	if err := unix.Mount("overlay", newRoot, "overlay", 0, data); err != nil {
+		return err
+	}
+
+	// switch to the overlay as copyFS does
+	if err := os.Chdir(newRoot); err != nil {
+		return err
+	}
+	if err := unix.Mount(".", "/", "", unix.MS_MOVE, ""); err != nil {
+		return err
+	}
+	if err := unix.Chroot("."); err != nil {
+		return err
+	}
+	return os.Chdir("/")
+}
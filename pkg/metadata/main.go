@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -14,9 +15,6 @@ import (
 )
 
 const (
-	// ConfigPath is where the data is extracted to
-	ConfigPath = "/run/config"
-
 	// Hostname is the filename in configPath where the hostname is stored
 	Hostname = "hostname"
 
@@ -30,6 +28,20 @@ const (
 
 var (
 	defaultLogFormatter = &log.TextFormatter{}
+
+	// ConfigPath is where the data is extracted to, /run/config unless
+	// -dir is given
+	ConfigPath = "/run/config"
+)
+
+const (
+	// SSHKeys is the filename in ConfigPath where the SSH keys are stored
+	// with -split
+	SSHKeys = "ssh-keys"
+
+	// UserData is the filename in ConfigPath where the user-data is stored
+	// with -split
+	UserData = "user-data"
 )
 
 // infoFormatter overrides the default format for Info() log events to
@@ -70,6 +82,8 @@ func main() {
 	log.SetFormatter(new(infoFormatter))
 	log.SetLevel(log.InfoLevel)
 	flagVerbose := flag.Bool("v", false, "Verbose execution")
+	flagDir := flag.String("dir", ConfigPath, "Directory to write the metadata and user-data to")
+	flagSplit := flag.Bool("split", false, "Write the hostname, SSH keys and user-data each to a file of its own, "+Hostname+", "+SSHKeys+" and "+UserData+", rather than extracting the user-data into the directory")
 
 	flag.Parse()
 	if *flagVerbose {
@@ -77,38 +91,26 @@ func main() {
 		log.SetFormatter(defaultLogFormatter)
 		log.SetLevel(log.DebugLevel)
 	}
+	ConfigPath = *flagDir
 
 	providers := []string{"aws", "gcp", "hetzner", "openstack", "scaleway", "vultr", "digitalocean", "packet", "metaldata", "cdrom"}
 	args := flag.Args()
 	if len(args) > 0 {
 		providers = args
 	}
+	forced := false
+	if cmdline, err := ioutil.ReadFile("/proc/cmdline"); err == nil {
+		if p, ok := cmdlineProvider(string(cmdline)); ok {
+			log.Printf("Using metadata provider %s from the kernel command line", p)
+			providers, forced = []string{p}, true
+		}
+	}
 	for _, p := range providers {
-		switch {
-		case p == "aws":
-			netProviders = append(netProviders, NewAWS())
-		case p == "gcp":
-			netProviders = append(netProviders, NewGCP())
-		case p == "hetzner":
-			netProviders = append(netProviders, NewHetzner())
-		case p == "openstack":
-			netProviders = append(netProviders, NewOpenstack())
-		case p == "packet":
-			netProviders = append(netProviders, NewPacket())
-		case p == "scaleway":
-			netProviders = append(netProviders, NewScaleway())
-		case p == "vultr":
-			netProviders = append(netProviders, NewVultr())
-		case p == "digitalocean":
-			netProviders = append(netProviders, NewDigitalOcean())
-		case p == "metaldata":
-			netProviders = append(netProviders, NewMetalData())
-		case p == "cdrom":
-			cdromProviders = ListCDROMs()
-		case strings.HasPrefix(p, "file="):
-			fileProviders = append(fileProviders, fileProvider(p[5:]))
-		default:
-			log.Fatalf("Unrecognised metadata provider: %s", p)
+		if err := addProvider(p); err != nil {
+			if forced {
+				log.Fatalf("%s, set by %s on the kernel command line", err, cmdlineProviderKey)
+			}
+			log.Fatal(err)
 		}
 	}
 
@@ -165,7 +167,11 @@ func main() {
 		log.Printf("Error writing metadata provider: %s", err)
 	}
 
-	if userdata != nil {
+	if *flagSplit {
+		if err := splitMetadata(ConfigPath, userdata); err != nil {
+			log.Printf("Could not write metadata: %s", err)
+		}
+	} else if userdata != nil {
 		if err := processUserData(ConfigPath, userdata); err != nil {
 			log.Printf("Could not extract user data: %s", err)
 		}
@@ -184,6 +190,75 @@ func main() {
 	}
 }
 
+// cmdlineProviderKey is the kernel command line parameter which selects the
+// provider to use, rather than probing them all
+const cmdlineProviderKey = "linuxkit.metadata"
+
+// cmdlineProvider returns the provider selected by cmdline, a kernel command
+// line, if any. As for other parameters, the last one wins.
+func cmdlineProvider(cmdline string) (string, bool) {
+	var provider string
+	found := false
+	for _, f := range strings.Fields(cmdline) {
+		if strings.HasPrefix(f, cmdlineProviderKey+"=") {
+			provider, found = strings.TrimPrefix(f, cmdlineProviderKey+"="), true
+		}
+	}
+	return provider, found
+}
+
+// addProvider adds the providers of name p to those to probe
+func addProvider(p string) error {
+	switch {
+	case p == "aws":
+		netProviders = append(netProviders, NewAWS())
+	case p == "gcp":
+		netProviders = append(netProviders, NewGCP())
+	case p == "hetzner":
+		netProviders = append(netProviders, NewHetzner())
+	case p == "openstack":
+		netProviders = append(netProviders, NewOpenstack())
+	case p == "packet":
+		netProviders = append(netProviders, NewPacket())
+	case p == "scaleway":
+		netProviders = append(netProviders, NewScaleway())
+	case p == "vultr":
+		netProviders = append(netProviders, NewVultr())
+	case p == "digitalocean":
+		netProviders = append(netProviders, NewDigitalOcean())
+	case p == "metaldata":
+		netProviders = append(netProviders, NewMetalData())
+	case p == "cdrom":
+		cdromProviders = ListCDROMs()
+	case strings.HasPrefix(p, "file="):
+		fileProviders = append(fileProviders, fileProvider(p[5:]))
+	default:
+		return fmt.Errorf("Unrecognised metadata provider: %s", p)
+	}
+	return nil
+}
+
+// splitMetadata writes the user-data, if any, as it is to the UserData file
+// of basePath, and moves the SSH keys the provider extracted to the SSHKeys
+// file, so that each can be used on its own. The hostname already is.
+func splitMetadata(basePath string, userdata []byte) error {
+	if userdata != nil {
+		if err := ioutil.WriteFile(path.Join(basePath, UserData), userdata, 0644); err != nil {
+			return err
+		}
+	}
+	keys := path.Join(basePath, SSH, "authorized_keys")
+	if _, err := os.Stat(keys); err != nil {
+		return nil
+	}
+	if err := os.Rename(keys, path.Join(basePath, SSHKeys)); err != nil {
+		return err
+	}
+	// leave the ssh directory if the provider wrote anything else there
+	_ = os.Remove(path.Join(basePath, SSH))
+	return nil
+}
+
 // If the userdata is a json file, create a directory/file hierarchy.
 // Example:
 // {
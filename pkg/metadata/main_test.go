@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -186,6 +188,123 @@ func TestDeepTree(t *testing.T) {
 	assertContent(t, path.Join(basePath, "level1", "level2", "file2"), "depth2")
 }
 
+func TestCmdlineProvider(t *testing.T) {
+	for _, tc := range []struct {
+		cmdline  string
+		provider string
+		found    bool
+	}{
+		{"console=ttyS0 page_poison=1\n", "", false},
+		{"console=ttyS0 linuxkit.metadata=aws root=/dev/sda\n", "aws", true},
+		{"linuxkit.metadata=file=/var/config linuxkit.metadata=hetzner", "hetzner", true},
+		{"linuxkit.metadata=file=/var/config\n", "file=/var/config", true},
+		{"linuxkit.metadatax=aws", "", false},
+	} {
+		provider, found := cmdlineProvider(tc.cmdline)
+		if provider != tc.provider || found != tc.found {
+			t.Fatalf("Expected %q, %v for %q but has %q, %v", tc.provider, tc.found, tc.cmdline, provider, found)
+		}
+	}
+}
+
+func TestAddProvider(t *testing.T) {
+	defer func() { netProviders, fileProviders = nil, nil }()
+	provider, _ := cmdlineProvider("console=ttyS0 linuxkit.metadata=hetzner")
+	if err := addProvider(provider); err != nil {
+		t.Fatalf("Cannot add %s: %v", provider, err)
+	}
+	if len(netProviders) != 1 || netProviders[0].String() != "Hetzner" {
+		t.Fatalf("Expected the Hetzner provider but has %v", netProviders)
+	}
+
+	provider, _ = cmdlineProvider("console=ttyS0 linuxkit.metadata=hetzner-cloud")
+	err := addProvider(provider)
+	if err == nil || err.Error() != "Unrecognised metadata provider: hetzner-cloud" {
+		t.Fatalf("Expected an unrecognised provider error but has %v", err)
+	}
+}
+
+// extracted returns basePath with what a provider extracts to it
+func extracted(t *testing.T) string {
+	basePath, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(basePath, Hostname), []byte("linuxkit-1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(basePath, SSH), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(basePath, SSH, "authorized_keys"), []byte("ssh-ed25519 AAAA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return basePath
+}
+
+// layout returns the files under basePath
+func layout(t *testing.T, basePath string) []string {
+	var files []string
+	err := filepath.Walk(basePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == basePath {
+			return err
+		}
+		rel, _ := filepath.Rel(basePath, p)
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+const layoutUserData = `{"foo":{"entries":{"bar":{"content":"foobar"}}}}`
+
+func TestCombinedLayout(t *testing.T) {
+	basePath := extracted(t)
+	defer os.RemoveAll(basePath)
+
+	process(t, basePath, layoutUserData)
+
+	files := strings.Join(layout(t, basePath), " ")
+	if files != "foo foo/bar hostname ssh ssh/authorized_keys userdata" {
+		t.Fatalf("Unexpected layout %s", files)
+	}
+	assertContent(t, path.Join(basePath, "foo", "bar"), "foobar")
+}
+
+func TestSplitLayout(t *testing.T) {
+	basePath := extracted(t)
+	defer os.RemoveAll(basePath)
+
+	if err := splitMetadata(basePath, []byte(layoutUserData)); err != nil {
+		t.Fatalf("fail to split metadata %v", err)
+	}
+
+	files := strings.Join(layout(t, basePath), " ")
+	if files != "hostname ssh-keys user-data" {
+		t.Fatalf("Unexpected layout %s", files)
+	}
+	assertContent(t, path.Join(basePath, Hostname), "linuxkit-1")
+	assertContent(t, path.Join(basePath, SSHKeys), "ssh-ed25519 AAAA\n")
+	assertPermission(t, path.Join(basePath, SSHKeys), 0600)
+	assertContent(t, path.Join(basePath, UserData), layoutUserData)
+
+	// without keys or user-data there is nothing to split
+	basePath2, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	defer os.RemoveAll(basePath2)
+	if err := splitMetadata(basePath2, nil); err != nil {
+		t.Fatalf("fail to split metadata %v", err)
+	}
+	if files := layout(t, basePath2); len(files) != 0 {
+		t.Fatalf("Unexpected layout %v", files)
+	}
+}
+
 func str(input string) *string {
 	return &input
 }
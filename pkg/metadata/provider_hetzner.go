@@ -11,13 +11,22 @@ import (
 	"time"
 )
 
+const (
+	// hetznerURL is the root of the Hetzner Cloud metadata service
+	hetznerURL = "http://169.254.169.254/hetzner/v1/"
+)
+
 // ProviderHetzner is the type implementing the Provider interface for Hetzner
 type ProviderHetzner struct {
+	// url is the root of the metadata service
+	url string
+	// configPath is where the metadata is written to
+	configPath string
 }
 
 // NewHetzner returns a new ProviderHetzner
 func NewHetzner() *ProviderHetzner {
-	return &ProviderHetzner{}
+	return &ProviderHetzner{url: hetznerURL, configPath: ConfigPath}
 }
 
 func (p *ProviderHetzner) String() string {
@@ -26,34 +35,29 @@ func (p *ProviderHetzner) String() string {
 
 // Probe checks if we are running on Hetzner
 func (p *ProviderHetzner) Probe() bool {
-	// Getting the hostname should always work...
-	_, err := hetznerGet(metaDataURL + "hostname")
+	// Getting the hostname should always work, and only does on Hetzner
+	// as other clouds do not have the hetzner path
+	_, err := hetznerGet(p.url + "metadata/hostname")
 	return (err == nil)
 }
 
 // Extract gets both the Hetzner specific and generic userdata
 func (p *ProviderHetzner) Extract() ([]byte, error) {
 	// Get host name. This must not fail
-	hostname, err := hetznerGet(metaDataURL + "hostname")
+	hostname, err := hetznerGet(p.url + "metadata/hostname")
 	if err != nil {
 		return nil, err
 	}
-	err = ioutil.WriteFile(path.Join(ConfigPath, Hostname), hostname, 0644)
+	err = ioutil.WriteFile(path.Join(p.configPath, Hostname), hostname, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("Hetzner: Failed to write hostname: %s", err)
 	}
 
 	// public ipv4
-	hetznerMetaGet("public-ipv4", "public_ipv4", 0644)
-
-	// private ipv4
-	hetznerMetaGet("local-ipv4", "local_ipv4", 0644)
+	p.metaGet("public-ipv4", "public_ipv4", 0644)
 
 	// instance-id
-	hetznerMetaGet("instance-id", "instance_id", 0644)
-
-	// // local-hostname
-	// hetznerMetaGet("local-hostname", "local_hostname", 0644)
+	p.metaGet("instance-id", "instance_id", 0644)
 
 	// ssh
 	if err := p.handleSSH(); err != nil {
@@ -61,7 +65,7 @@ func (p *ProviderHetzner) Extract() ([]byte, error) {
 	}
 
 	// Generic userdata
-	userData, err := hetznerGet(userDataURL)
+	userData, err := hetznerGet(p.url + "userdata")
 	if err != nil {
 		log.Printf("Hetzner: Failed to get user-data: %s", err)
 		// This is not an error
@@ -71,10 +75,10 @@ func (p *ProviderHetzner) Extract() ([]byte, error) {
 }
 
 // lookup a value (lookupName) in hetzner metaservice and store in given fileName
-func hetznerMetaGet(lookupName string, fileName string, fileMode os.FileMode) {
-	if lookupValue, err := hetznerGet(metaDataURL + lookupName); err == nil {
+func (p *ProviderHetzner) metaGet(lookupName string, fileName string, fileMode os.FileMode) {
+	if lookupValue, err := hetznerGet(p.url + "metadata/" + lookupName); err == nil {
 		// we got a value from the metadata server, now save to filesystem
-		err = ioutil.WriteFile(path.Join(ConfigPath, fileName), lookupValue, fileMode)
+		err = ioutil.WriteFile(path.Join(p.configPath, fileName), lookupValue, fileMode)
 		if err != nil {
 			// we couldn't save the file for some reason
 			log.Printf("Hetzner: Failed to write %s:%s %s", fileName, lookupValue, err)
@@ -112,7 +116,7 @@ func hetznerGet(url string) ([]byte, error) {
 
 // SSH keys:
 func (p *ProviderHetzner) handleSSH() error {
-	sshKeysJSON, err := hetznerGet(metaDataURL + "public-keys")
+	sshKeysJSON, err := hetznerGet(p.url + "metadata/public-keys")
 	if err != nil {
 		return fmt.Errorf("Failed to get sshKeys: %s", err)
 	}
@@ -123,11 +127,11 @@ func (p *ProviderHetzner) handleSSH() error {
 		return fmt.Errorf("Failed to get sshKeys: %s", err)
 	}
 
-	if err := os.Mkdir(path.Join(ConfigPath, SSH), 0755); err != nil {
+	if err := os.Mkdir(path.Join(p.configPath, SSH), 0755); err != nil {
 		return fmt.Errorf("Failed to create %s: %s", SSH, err)
 	}
 
-	fileHandle, _ := os.OpenFile(path.Join(ConfigPath, SSH, "authorized_keys"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	fileHandle, _ := os.OpenFile(path.Join(p.configPath, SSH, "authorized_keys"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	defer fileHandle.Close()
 
 	for _, sshKey := range sshKeys {
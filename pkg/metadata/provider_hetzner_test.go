@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// hetznerServer serves the paths of the Hetzner metadata service in
+// responses
+func hetznerServer(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+}
+
+func TestHetzner(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	defer os.RemoveAll(basePath)
+
+	server := hetznerServer(map[string]string{
+		"/hetzner/v1/metadata/hostname":    "linuxkit-1",
+		"/hetzner/v1/metadata/instance-id": "1234567",
+		"/hetzner/v1/metadata/public-ipv4": "192.0.2.1",
+		"/hetzner/v1/metadata/public-keys": `["ssh-ed25519 AAAA one@example.com","ssh-rsa BBBB two@example.com"]`,
+		"/hetzner/v1/userdata":             `{"foo":{"content":"bar"}}`,
+	})
+	defer server.Close()
+
+	p := &ProviderHetzner{url: server.URL + "/hetzner/v1/", configPath: basePath}
+	if !p.Probe() {
+		t.Fatalf("Hetzner metadata service not detected")
+	}
+	userData, err := p.Extract()
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if string(userData) != `{"foo":{"content":"bar"}}` {
+		t.Fatalf("Expected the user-data but has %s", userData)
+	}
+	assertContent(t, path.Join(basePath, Hostname), "linuxkit-1")
+	assertContent(t, path.Join(basePath, "instance_id"), "1234567")
+	assertContent(t, path.Join(basePath, "public_ipv4"), "192.0.2.1")
+	authorizedKeys := path.Join(basePath, SSH, "authorized_keys")
+	assertContent(t, authorizedKeys, "ssh-ed25519 AAAA one@example.com\nssh-rsa BBBB two@example.com\n")
+	assertPermission(t, authorizedKeys, 0600)
+}
+
+func TestHetznerProbe(t *testing.T) {
+	// an AWS compatible service without the hetzner paths
+	server := hetznerServer(map[string]string{
+		"/latest/meta-data/hostname": "ip-10-0-0-1",
+	})
+	defer server.Close()
+
+	p := &ProviderHetzner{url: server.URL + "/hetzner/v1/"}
+	if p.Probe() {
+		t.Fatalf("Hetzner detected on another cloud")
+	}
+}
@@ -27,11 +27,17 @@ const (
 
 // ProviderScaleway is the type implementing the Provider interface for Scaleway
 type ProviderScaleway struct {
+	// metadataURL is the root of the metadata service
+	metadataURL string
+	// userdataAddr is the address of the user-data service
+	userdataAddr string
+	// configPath is where the metadata is written to
+	configPath string
 }
 
 // NewScaleway returns a new ProviderScaleway
 func NewScaleway() *ProviderScaleway {
-	return &ProviderScaleway{}
+	return &ProviderScaleway{metadataURL: scalewayMetadataURL, userdataAddr: scalewayUserdataURL, configPath: ConfigPath}
 }
 
 func (p *ProviderScaleway) String() string {
@@ -41,9 +47,14 @@ func (p *ProviderScaleway) String() string {
 // Probe checks if we are running on Scaleway
 func (p *ProviderScaleway) Probe() bool {
 	// Getting the conf should always work...
-	_, err := scalewayGet(scalewayMetadataURL + "conf")
+	metadata, err := scalewayGet(p.metadataURL + "conf")
 	if err != nil {
-		log.Printf(err.Error())
+		log.Print(err)
+		return false
+	}
+	// ...and have the ID of the server, unlike whatever else may answer
+	if _, err := p.extractInformation(metadata, "id"); err != nil {
+		log.Printf("Scaleway: Not a Scaleway conf: %s", err)
 		return false
 	}
 
@@ -52,7 +63,7 @@ func (p *ProviderScaleway) Probe() bool {
 
 // Extract gets both the Scaleway specific and generic userdata
 func (p *ProviderScaleway) Extract() ([]byte, error) {
-	metadata, err := scalewayGet(scalewayMetadataURL + "conf")
+	metadata, err := scalewayGet(p.metadataURL + "conf")
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to get conf: %s", err)
 	}
@@ -62,7 +73,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		return nil, fmt.Errorf("Scaleway: Failed to get hostname: %s", err)
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, Hostname), hostname, 0644)
+	err = ioutil.WriteFile(path.Join(p.configPath, Hostname), hostname, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to write hostname: %s", err)
 	}
@@ -72,7 +83,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		return nil, fmt.Errorf("Scaleway: Failed to get instanceID: %s", err)
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, instanceIDFile), instanceID, 0644)
+	err = ioutil.WriteFile(path.Join(p.configPath, instanceIDFile), instanceID, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to write instance_id: %s", err)
 	}
@@ -82,7 +93,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		return nil, fmt.Errorf("Scaleway: Failed to get instanceLocation: %s", err)
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, instanceLocationFile), instanceLocation, 0644)
+	err = ioutil.WriteFile(path.Join(p.configPath, instanceLocationFile), instanceLocation, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to write instance_location: %s", err)
 	}
@@ -92,7 +103,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		// not an error
 		log.Printf("Scaleway: Failed to get publicIP: %s", err)
 	} else {
-		err = ioutil.WriteFile(path.Join(ConfigPath, publicIPFile), publicIP, 0644)
+		err = ioutil.WriteFile(path.Join(p.configPath, publicIPFile), publicIP, 0644)
 		if err != nil {
 			return nil, fmt.Errorf("Scaleway: Failed to write public_ip: %s", err)
 		}
@@ -104,7 +115,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 		return nil, fmt.Errorf("Scaleway: Failed to get privateIP: %s", err)
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, privateIPFile), privateIP, 0644)
+	err = ioutil.WriteFile(path.Join(p.configPath, privateIPFile), privateIP, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("Scaleway: Failed to write private_ip: %s", err)
 	}
@@ -114,7 +125,7 @@ func (p *ProviderScaleway) Extract() ([]byte, error) {
 	}
 
 	// Generic userdata
-	userData, err := scalewayGetUserdata()
+	userData, err := scalewayGetUserdata(p.userdataAddr)
 	if err != nil {
 		log.Printf("Scaleway: Failed to get user-data: %s", err)
 		// This is not an error
@@ -160,8 +171,8 @@ func scalewayGet(url string) ([]byte, error) {
 }
 
 // scalewayGetUserdata returns the userdata of the server, differs from scalewayGet since the source port has to be below 1024 in order to work
-func scalewayGetUserdata() ([]byte, error) {
-	server, err := net.ResolveTCPAddr("tcp", scalewayUserdataURL)
+func scalewayGetUserdata(addr string) ([]byte, error) {
+	server, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -187,10 +198,14 @@ func scalewayGetUserdata() ([]byte, error) {
 
 	reader := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(reader, nil)
-	if err != nil || resp.StatusCode == 404 {
+	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		// there is no user-data
+		return nil, nil
+	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -221,11 +236,11 @@ func (p *ProviderScaleway) handleSSH(metadata []byte) error {
 		rootKeys = rootKeys + line + "\n"
 	}
 
-	if err := os.Mkdir(path.Join(ConfigPath, SSH), 0755); err != nil {
+	if err := os.Mkdir(path.Join(p.configPath, SSH), 0755); err != nil {
 		return fmt.Errorf("Failed to create %s: %s", SSH, err)
 	}
 
-	err = ioutil.WriteFile(path.Join(ConfigPath, SSH, "authorized_keys"), []byte(rootKeys), 0600)
+	err = ioutil.WriteFile(path.Join(p.configPath, SSH, "authorized_keys"), []byte(rootKeys), 0600)
 	if err != nil {
 		return fmt.Errorf("Failed to write ssh keys: %s", err)
 	}
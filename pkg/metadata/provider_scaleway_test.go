@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const scalewayConf = `ID=b7ec5484-9c76-4f71-a450-8c4eaf0e6e10
+HOSTNAME=linuxkit-1
+LOCATION_ZONE_ID=fr-par-1
+PUBLIC_IP_ADDRESS=192.0.2.1
+PRIVATE_IP=10.0.0.1
+SSH_PUBLIC_KEYS=2
+SSH_PUBLIC_KEYS_0_KEY='ssh-ed25519 AAAA one@example.com'
+SSH_PUBLIC_KEYS_1_KEY='ssh-rsa BBBB two@example.com'
+`
+
+// scalewayServer serves the paths of the Scaleway metadata service in
+// responses
+func scalewayServer(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+}
+
+func testScaleway(t *testing.T, responses map[string]string) (*ProviderScaleway, string) {
+	if os.Geteuid() != 0 {
+		t.Skip("user-data can only be fetched from a port below 1024, as root")
+	}
+	basePath, err := ioutil.TempDir("", "metadata")
+	if err != nil {
+		t.Fatalf("can't make a temp rootdir %v", err)
+	}
+	server := scalewayServer(responses)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(basePath)
+	})
+	p := &ProviderScaleway{
+		metadataURL:  server.URL + "/",
+		userdataAddr: strings.TrimPrefix(server.URL, "http://"),
+		configPath:   basePath,
+	}
+	return p, basePath
+}
+
+func TestScaleway(t *testing.T) {
+	p, basePath := testScaleway(t, map[string]string{
+		"/conf":                 scalewayConf,
+		"/user_data/cloud-init": `{"foo":{"content":"bar"}}`,
+	})
+	if !p.Probe() {
+		t.Fatalf("Scaleway metadata service not detected")
+	}
+	userData, err := p.Extract()
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if string(userData) != `{"foo":{"content":"bar"}}` {
+		t.Fatalf("Expected the user-data but has %s", userData)
+	}
+	assertContent(t, path.Join(basePath, Hostname), "linuxkit-1")
+	assertContent(t, path.Join(basePath, instanceIDFile), "b7ec5484-9c76-4f71-a450-8c4eaf0e6e10")
+	assertContent(t, path.Join(basePath, instanceLocationFile), "fr-par-1")
+	assertContent(t, path.Join(basePath, publicIPFile), "192.0.2.1")
+	assertContent(t, path.Join(basePath, privateIPFile), "10.0.0.1")
+	authorizedKeys := path.Join(basePath, SSH, "authorized_keys")
+	assertContent(t, authorizedKeys, "ssh-ed25519 AAAA one@example.com\nssh-rsa BBBB two@example.com\n")
+	assertPermission(t, authorizedKeys, 0600)
+}
+
+func TestScalewayNoUserData(t *testing.T) {
+	p, basePath := testScaleway(t, map[string]string{
+		"/conf": scalewayConf,
+	})
+	userData, err := p.Extract()
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if userData != nil {
+		t.Fatalf("Expected no user-data but has %s", userData)
+	}
+	assertContent(t, path.Join(basePath, Hostname), "linuxkit-1")
+}
+
+func TestScalewayProbe(t *testing.T) {
+	// something else answering on the metadata address
+	server := scalewayServer(map[string]string{
+		"/conf": "<html>Welcome</html>",
+	})
+	defer server.Close()
+
+	p := &ProviderScaleway{metadataURL: server.URL + "/"}
+	if p.Probe() {
+		t.Fatalf("Scaleway detected on another cloud")
+	}
+}
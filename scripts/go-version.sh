@@ -0,0 +1,43 @@
+#!/bin/sh
+# Print the version of the commit HEAD, or the one given, as a go module
+# version, in the same way as linuxkit pkg versions packages:
+#   vX.Y.Z                           at a release tag vX.Y.Z
+#   vX.Y.(Z+1)-0.<date>-<commit>     after a release tag vX.Y.Z
+#   vX.Y.Z-<pre>.0.<date>-<commit>   after a pre-release tag vX.Y.Z-<pre>
+#   v0.0.0-<date>-<commit>           without a tag
+# <date> is the UTC commit time as YYYYMMDDhhmmss and <commit> the first
+# 12 characters of the commit hash.
+set -e
+
+commit=${1:-HEAD}
+hash=$(git rev-parse --verify "$commit^{commit}")
+date=$(TZ=UTC git show -s --date=format-local:%Y%m%d%H%M%S --format=%cd "$commit")
+pseudo="$date-$(echo "$hash" | cut -c1-12)"
+
+desc=$(git describe --tags --long --match='v[0-9]*.[0-9]*.[0-9]*' "$commit" 2>/dev/null) || {
+	echo "v0.0.0-$pseudo"
+	exit 0
+}
+# <tag>-<commits since tag>-g<abbreviated commit>
+tag=${desc%-*-g*}
+count=${desc#"$tag"-}
+count=${count%%-*}
+
+semver='^v\(0\|[1-9][0-9]*\)\.\(0\|[1-9][0-9]*\)\.\(0\|[1-9][0-9]*\)\(-[0-9A-Za-z.-]*\)\?\(+[0-9A-Za-z.-]*\)\?$'
+if ! echo "$tag" | grep -q "$semver"; then
+	echo "v0.0.0-$pseudo"
+	exit 0
+fi
+# build metadata is not part of a go module version
+tag=${tag%%+*}
+release=${tag%%-*}
+pre=${tag#"$release"}
+
+if [ "$count" = 0 ]; then
+	echo "$tag"
+elif [ -n "$pre" ]; then
+	echo "$tag.0.$pseudo"
+else
+	patch=${release##*.}
+	echo "${release%.*}.$((patch + 1))-0.$pseudo"
+fi
@@ -55,6 +55,7 @@ var (
 	publicIPAddressesClient network.PublicIPAddressesClient
 	interfacesClient        network.InterfacesClient
 	virtualMachinesClient   compute.VirtualMachinesClient
+	imagesClient            compute.ImagesClient
 
 	defaultActiveDirectoryEndpoint = azure.PublicCloud.ActiveDirectoryEndpoint
 	defaultResourceManagerEndpoint = azure.PublicCloud.ResourceManagerEndpoint
@@ -92,6 +93,8 @@ func initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret str
 	virtualMachinesClient = compute.NewVirtualMachinesClient(subscriptionID)
 	virtualMachinesClient.Authorizer = autorest.NewBearerAuthorizer(token)
 
+	imagesClient = compute.NewImagesClient(subscriptionID)
+	imagesClient.Authorizer = autorest.NewBearerAuthorizer(token)
 }
 
 func createResourceGroup(resourceGroupName, location string) *resources.Group {
@@ -222,6 +225,51 @@ func uploadVMImage(resourceGroupName string, accountName string, imagePath strin
 
 }
 
+// azureBlobURI is the URI of the blob that uploadVMImage uploads to the
+// storage account
+func azureBlobURI(accountName string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", accountName, defaultStorageContainerName, defaultStorageBlobName)
+}
+
+// createImage creates the managed image imageName, of a generalized Linux OS
+// disk from the VHD at blobURI, and returns its resource ID
+func createImage(ctx context.Context, resourceGroupName, location, imageName, blobURI string) (string, error) {
+	imageParameters := compute.Image{
+		Location: to.StringPtr(location),
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{
+				OsDisk: &compute.ImageOSDisk{
+					OsType:  compute.Linux,
+					OsState: compute.Generalized,
+					BlobURI: to.StringPtr(blobURI),
+				},
+			},
+		},
+	}
+	future, err := imagesClient.CreateOrUpdate(ctx, resourceGroupName, imageName, imageParameters)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create image: %v", err)
+	}
+	if err := future.WaitForCompletionRef(ctx, imagesClient.Client); err != nil {
+		return "", fmt.Errorf("Failed to finish creating image: %v", err)
+	}
+	image, err := future.Result(imagesClient)
+	if err != nil {
+		return "", fmt.Errorf("Error creating image: %v", err)
+	}
+	return *image.ID, nil
+}
+
+// resourceGroupLocation is the location of the resource group
+// resourceGroupName
+func resourceGroupLocation(ctx context.Context, resourceGroupName string) (string, error) {
+	group, err := groupsClient.Get(ctx, resourceGroupName)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get resource group %s: %v", resourceGroupName, err)
+	}
+	return *group.Location, nil
+}
+
 func createVirtualNetwork(resourceGroup resources.Group, virtualNetworkName string, location string) *network.VirtualNetwork {
 	fmt.Printf("Creating virtual network in resource group %s, in %s", *resourceGroup.Name, location)
 
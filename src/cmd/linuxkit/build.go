@@ -8,11 +8,16 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/initrd"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -43,23 +48,91 @@ func build(args []string) {
 		fmt.Printf("USAGE: %s build [options] <file>[.yml] | -\n\n", os.Args[0])
 		fmt.Printf("Options:\n")
 		buildCmd.PrintDefaults()
+		fmt.Printf("\n")
+		fmt.Printf("The qcow2-compressed format is the qcow2-bios image compressed with qemu-img, which must\n")
+		fmt.Printf("be installed. It is much smaller to distribute, but slower to build and a little slower\n")
+		fmt.Printf("to read from when booted.\n")
 	}
 	buildName := buildCmd.String("name", "", "Name to use for output files")
 	buildDir := buildCmd.String("dir", "", "Directory for output files, default current directory")
 	buildOutputFile := buildCmd.String("o", "", "File to use for a single output, or '-' for stdout")
-	buildSize := buildCmd.String("size", "1024M", "Size for output image, if supported and fixed size")
+	buildSize := buildCmd.String("size", "", "Size of disk image outputs, such as 4G, 512M or 1.5GiB, with the last partition extended to fill it. Defaults to 1024M for aws, qcow2-bios and qcow2-compressed, and the size of the contents for the others")
 	buildPull := buildCmd.Bool("pull", false, "Always pull images")
 	buildDocker := buildCmd.Bool("docker", false, "Check for images in docker before linuxkit cache")
-	buildDecompressKernel := buildCmd.Bool("decompress-kernel", false, "Decompress the Linux kernel (default false)")
+	buildDecompressKernel := buildCmd.Bool("decompress-kernel", false, "Output the Linux kernel uncompressed, a bzImage as its ELF vmlinux")
 	buildCacheDir := buildCmd.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
 	buildCmd.Var(&buildFormats, "format", "Formats to create [ "+strings.Join(outputTypes, " ")+" ]")
 	buildArch := buildCmd.String("arch", runtime.GOARCH, "target architecture for which to build")
+	buildOCIEntrypoint := buildCmd.String("oci-entrypoint", "/bin/rc.init", "Entrypoint of the image built by the oci format, split on spaces")
+	var buildOCIEnv multipleFlag
+	buildCmd.Var(&buildOCIEnv, "oci-env", "Environment variable, as NAME=value, to set in the image built by the oci format. May be repeated")
+	buildZstdLevel := buildCmd.Int("zstd-level", initrd.DefaultZstdLevel, "Compression level for the kernel+initrd-zstd format, from 1 to "+strconv.Itoa(initrd.MaxZstdLevel))
+	buildQcow2ClusterSize := buildCmd.Int("qcow2-cluster-size", 0, "Cluster size in bytes of the qcow2-compressed format, a power of two from 512 to 2M. Larger clusters compress better but make reads of scattered blocks slower. Defaults to the qemu-img default of 64K")
+	buildSquashfsCompression := buildCmd.String("squashfs-compression", "", "Compression of the squashfs and kernel+squashfs formats, gzip, xz or zstd, defaults to the mksquashfs default of gzip")
+	buildStrict := buildCmd.Bool("strict", false, "Reject unknown keys in the configs, with the line they are on. This will become the default")
+	buildAllowUnset := buildCmd.Bool("allow-unset", false, "Replace ${VAR} in the configs with an empty string if VAR is not set, rather than failing")
+	buildVerifySignatures := buildCmd.Bool("verify-signatures", false, "Refuse to build unless every image is signed by a key or identity of the -trust-policy, verified with cosign, which must be installed")
+	buildTrustPolicy := buildCmd.String("trust-policy", "", "Trust policy file of -verify-signatures, listing the trusted cosign keys and keyless identities")
+	buildLock := buildCmd.String("lock", "", "Lockfile recording the digest of each image given by tag. Images are pulled by the digest locked for them, a tag pointing to another digest fails the build, and images not in it yet are added to it")
+	buildUpdateLock := buildCmd.Bool("update-lock", false, "With -lock, lock tags pointing to another digest than the locked one to it, rather than fail")
+	var buildInputTars multipleFlag
+	buildCmd.Var(&buildInputTars, "input-tar", "Tarball, which may be gzip compressed, to extract over the rootfs after the images and files of the config, keeping the modes and ownership of its entries. May be repeated, later tarballs replacing the files of earlier ones")
+	var buildCreatedFromPkgs multipleFlag
+	buildCmd.Var(&buildCreatedFromPkgs, "created-from-pkgs", "Package directory, of a package of the images of the config, to set the creation time of the image built by the oci format to the latest commit date of, for it to be reproducible. $SOURCE_DATE_EPOCH is used if git is not installed or a package is dirty. May be repeated")
+	buildRegistryPrefix := buildCmd.String("registry-prefix", "", "Namespace of a registry mirroring the images, such as registry.example.com/mirror, to get every image from, as <prefix>/linuxkit/init for linuxkit/init on the hub and <prefix>/quay.io/org/image for quay.io/org/image")
 
 	if err := buildCmd.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
 	remArgs := buildCmd.Args()
 
+	if err := moby.SetInitrdZstdLevel(*buildZstdLevel); err != nil {
+		log.Fatalf("Invalid -zstd-level: %v", err)
+	}
+	if err := moby.SetQcow2ClusterSize(*buildQcow2ClusterSize); err != nil {
+		log.Fatalf("Invalid -qcow2-cluster-size: %v", err)
+	}
+	if err := moby.SetSquashfsCompression(*buildSquashfsCompression); err != nil {
+		log.Fatalf("Invalid -squashfs-compression: %v", err)
+	}
+	for _, e := range buildOCIEnv {
+		if !strings.Contains(e, "=") {
+			log.Fatalf("Invalid -oci-env %q, must be NAME=value", e)
+		}
+	}
+	ociConfig := moby.OCIConfig{
+		Architecture: *buildArch,
+		Entrypoint:   strings.Fields(*buildOCIEntrypoint),
+		Env:          buildOCIEnv,
+	}
+	if len(buildCreatedFromPkgs) != 0 {
+		created, err := imageCreated(buildCreatedFromPkgs)
+		if err != nil {
+			log.Fatalf("Invalid -created-from-pkgs: %v", err)
+		}
+		log.Infof("Image created at %s", created.Format(time.RFC3339))
+		ociConfig.Created = &created
+	}
+	moby.SetOCIConfig(ociConfig)
+	moby.SetAllowUnset(*buildAllowUnset)
+
+	var verifier moby.SignatureVerifier
+	if *buildVerifySignatures {
+		if *buildTrustPolicy == "" {
+			log.Fatal("-verify-signatures requires a -trust-policy")
+		}
+		policy, err := moby.LoadTrustPolicy(*buildTrustPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifier = moby.NewCosignVerifier(policy)
+	} else if *buildTrustPolicy != "" {
+		log.Fatal("-trust-policy requires -verify-signatures")
+	}
+	if *buildUpdateLock && *buildLock == "" {
+		log.Fatal("-update-lock requires -lock")
+	}
+
 	if len(remArgs) == 0 {
 		fmt.Println("Please specify a configuration file")
 		buildCmd.Usage()
@@ -147,43 +220,38 @@ func build(args []string) {
 		log.Fatalf("Unable to parse disk size: %v", err)
 	}
 
-	var m moby.Moby
-	for _, arg := range remArgs {
-		var config []byte
-		if conf := arg; conf == "-" {
-			var err error
-			config, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				log.Fatalf("Cannot read stdin: %v", err)
-			}
-		} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
-			buffer := new(bytes.Buffer)
-			response, err := http.Get(arg)
-			if err != nil {
-				log.Fatalf("Cannot fetch remote yaml file: %v", err)
-			}
-			defer response.Body.Close()
-			_, err = io.Copy(buffer, response.Body)
-			if err != nil {
-				log.Fatalf("Error reading http body: %v", err)
-			}
-			config = buffer.Bytes()
-		} else {
-			var err error
-			config, err = ioutil.ReadFile(conf)
-			if err != nil {
-				log.Fatalf("Cannot open config file: %v", err)
-			}
+	m, err := loadConfigs(remArgs, *buildArch, os.Stdin, configOptions{strict: *buildStrict})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m.InputTars = buildInputTars
+
+	if *buildRegistryPrefix != "" {
+		if err := moby.PrefixImages(&m, *buildRegistryPrefix); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		c, err := moby.NewConfig(config)
+	if *buildLock != "" {
+		lock, err := moby.LoadLock(*buildLock)
 		if err != nil {
-			log.Fatalf("Invalid config: %v", err)
+			log.Fatal(err)
 		}
-		c.Architecture = *buildArch
-		m, err = moby.AppendConfig(m, c)
+		changed, err := moby.LockImages(&m, lock, moby.RegistryDigest, *buildUpdateLock)
 		if err != nil {
-			log.Fatalf("Cannot append config files: %v", err)
+			log.Fatal(err)
+		}
+		if changed {
+			if err := lock.Save(*buildLock); err != nil {
+				log.Fatalf("Cannot write lockfile: %v", err)
+			}
+		}
+	}
+
+	if verifier != nil {
+		if err := moby.VerifySignatures(m, verifier); err != nil {
+			log.Fatal(err)
 		}
 	}
 
@@ -217,9 +285,133 @@ func build(args []string) {
 		}
 
 		log.Infof("Create outputs:")
-		err = moby.Formats(filepath.Join(*buildDir, name), image, buildFormats, size, cacheDir)
+		err = moby.Formats(filepath.Join(*buildDir, name), image, buildFormats, size, cacheDir, m)
 		if err != nil {
 			log.Fatalf("Error writing outputs: %v", err)
 		}
 	}
 }
+
+// readBuildConfig reads the config arg, a file, an http(s) URL, or "-" to read
+// it from stdin
+func readBuildConfig(arg string, stdin io.Reader) ([]byte, error) {
+	if arg == "-" {
+		config, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read stdin: %v", err)
+		}
+		return config, nil
+	}
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		response, err := http.Get(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot fetch remote yaml file: %v", err)
+		}
+		defer response.Body.Close()
+		buffer := new(bytes.Buffer)
+		if _, err := io.Copy(buffer, response.Body); err != nil {
+			return nil, fmt.Errorf("Error reading http body: %v", err)
+		}
+		return buffer.Bytes(), nil
+	}
+	config, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open config file: %v", err)
+	}
+	return config, nil
+}
+
+// configOptions are how loadConfigs reads the configs
+type configOptions struct {
+	// strict checks each config with moby.CheckStrict
+	strict bool
+}
+
+// readConfig reads the config arg as readBuildConfig does, checking it if
+// opts are strict
+func (opts configOptions) readConfig(arg string, stdin io.Reader) ([]byte, error) {
+	config, err := readBuildConfig(arg, stdin)
+	if err != nil || !opts.strict {
+		return config, err
+	}
+	name := arg
+	if arg == "-" {
+		name = "<stdin>"
+	}
+	return config, moby.CheckStrict(name, config)
+}
+
+// loadConfigs reads the configs args for arch, with the configs they
+// include, and merges them, in order. Relative paths in a config, such as
+// the source of a file, are relative to the current directory, wherever
+// the config came from, but includes are relative to the config.
+func loadConfigs(args []string, arch string, stdin io.Reader, opts configOptions) (moby.Moby, error) {
+	var m moby.Moby
+	var readStdin bool
+	for _, arg := range args {
+		if arg == "-" {
+			if readStdin {
+				return m, fmt.Errorf("The config can only be read from stdin once")
+			}
+			readStdin = true
+		}
+		config, err := opts.readConfig(arg, stdin)
+		if err != nil {
+			return m, err
+		}
+		c, err := moby.NewConfig(config)
+		if err != nil {
+			return m, fmt.Errorf("Invalid config: %v", err)
+		}
+		location := arg
+		if arg == "-" {
+			location = ""
+		} else if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+			if location, err = filepath.Abs(arg); err != nil {
+				return m, err
+			}
+		}
+		c, err = moby.ResolveIncludes(c, location, func(l string) ([]byte, error) { return opts.readConfig(l, nil) })
+		if err != nil {
+			return m, err
+		}
+		c.Architecture = arch
+		m, err = moby.AppendConfig(m, c)
+		if err != nil {
+			return m, fmt.Errorf("Cannot append config files: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// imageCreated returns the creation time of -created-from-pkgs, the latest
+// date of the commits the packages in dirs are built from, as their images
+// are given, or $SOURCE_DATE_EPOCH if git is not installed or one of them
+// is dirty or not in git
+func imageCreated(dirs []string) (time.Time, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		log.Warnf("git is not installed, using $SOURCE_DATE_EPOCH as the creation time")
+	} else {
+		pkgs, err := pkglib.NewFromCLI(flag.NewFlagSet("created-from-pkgs", flag.ContinueOnError), dirs...)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t, ok, err := pkglib.LatestCommitTime(pkgs)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ok {
+			return t, nil
+		}
+		log.Warnf("A package is dirty or not in git, using $SOURCE_DATE_EPOCH as the creation time")
+	}
+	epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH")
+	if !ok {
+		return time.Time{}, fmt.Errorf("SOURCE_DATE_EPOCH is not set")
+	}
+	ts, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil || ts < 0 {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", epoch)
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigsStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "motd"), []byte("hello\n"), 0644))
+
+	// relative sources are found from the current directory
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+	defer func(d string) { moby.MobyDir = d }(moby.MobyDir)
+	moby.MobyDir = dir
+
+	stdin := strings.NewReader(`
+files:
+  - path: etc/motd
+    source: motd
+  - path: etc/hostname
+    contents: linuxkit
+`)
+	m, err := loadConfigs([]string{"-"}, "amd64", stdin, configOptions{})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, moby.Build(m, &buf, false, "", false, filepath.Join(dir, "cache"), false))
+	files := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"etc":          "",
+		"etc/motd":     "hello\n",
+		"etc/hostname": "linuxkit",
+	}, files)
+
+	_, err = loadConfigs([]string{"-", "-"}, "amd64", strings.NewReader("{}"), configOptions{})
+	assert.EqualError(t, err, "The config can only be read from stdin once")
+}
+
+func TestLoadConfigsStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-build")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	common := filepath.Join(dir, "common.yml")
+	require.NoError(t, ioutil.WriteFile(common, []byte("services:\n  - name: rngd\n    image: linuxkit/rngd:v1\n    comamnd: [/sbin/rngd]\n"), 0644))
+	config := "include:\n  - " + common + "\n"
+
+	// the schema rejects the typo too, but only strict checks say where it is
+	_, err = loadConfigs([]string{"-"}, "amd64", strings.NewReader(config), configOptions{})
+	require.Error(t, err)
+	_, err = loadConfigs([]string{"-"}, "amd64", strings.NewReader(config), configOptions{strict: true})
+	assert.EqualError(t, err, "Cannot include "+common+": "+common+":4: field comamnd not found in image")
+
+	_, err = loadConfigs([]string{"-"}, "amd64", strings.NewReader("onboot:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:v1\n    nett: host\n"), configOptions{strict: true})
+	assert.EqualError(t, err, "<stdin>:4: field nett not found in image")
+}
+
+func TestImageCreated(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	repo, err := ioutil.TempDir("", "linuxkit-build-created")
+	require.NoError(t, err)
+	defer os.RemoveAll(repo)
+	a, b := filepath.Join(repo, "pkg", "a"), filepath.Join(repo, "pkg", "b")
+	gitCommand(t, repo, "init", "-q")
+	defer os.Unsetenv("GIT_COMMITTER_DATE")
+	for i, dir := range []string{a, b} {
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "build.yml"), []byte("image: "+filepath.Base(dir)+"\norg: test\n"), 0644))
+		os.Setenv("GIT_COMMITTER_DATE", time.Date(2020+i, 6, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339))
+		gitCommand(t, repo, "add", ".")
+		gitCommand(t, repo, "commit", "-q", "-m", filepath.Base(dir))
+	}
+	os.Unsetenv("GIT_COMMITTER_DATE")
+
+	// the latest commit, however often a clean tree is built
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	os.Setenv("SOURCE_DATE_EPOCH", "1234")
+	for i := 0; i < 2; i++ {
+		created, err := imageCreated([]string{a, b})
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), created)
+	}
+
+	// $SOURCE_DATE_EPOCH for a dirty package
+	require.NoError(t, ioutil.WriteFile(filepath.Join(b, "build.yml"), []byte("image: b\norg: test\nnetwork: true\n"), 0644))
+	created, err := imageCreated([]string{a, b})
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1234, 0).UTC(), created)
+	os.Setenv("SOURCE_DATE_EPOCH", "soon")
+	_, err = imageCreated([]string{a, b})
+	assert.EqualError(t, err, `invalid SOURCE_DATE_EPOCH "soon"`)
+	os.Unsetenv("SOURCE_DATE_EPOCH")
+	_, err = imageCreated([]string{a, b})
+	assert.EqualError(t, err, "SOURCE_DATE_EPOCH is not set")
+}
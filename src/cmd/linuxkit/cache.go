@@ -16,6 +16,7 @@ func cacheUsage() {
 	// Please keep these in alphabetical order
 	fmt.Printf("  clean\n")
 	fmt.Printf("  export\n")
+	fmt.Printf("  gc\n")
 	fmt.Printf("  ls\n")
 	fmt.Printf("\n")
 	fmt.Printf("'options' are the backend specific options.\n")
@@ -36,6 +37,8 @@ func cache(args []string) {
 		cacheList(args[1:])
 	case "export":
 		cacheExport(args[1:])
+	case "gc":
+		cacheGC(args[1:])
 	case "help", "-h", "-help", "--help":
 		cacheUsage()
 		os.Exit(0)
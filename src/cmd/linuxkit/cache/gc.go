@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// GCOptions selects the entries of the cache index kept by GC. With
+// neither set every entry is kept and only unreferenced blobs are removed.
+type GCOptions struct {
+	// Keep lists image names whose entries are always kept. A name
+	// without a tag keeps every tag of the image.
+	Keep []string
+	// Until keeps the entries used since then, if not zero
+	Until time.Time
+}
+
+// GCResult reports what GC removed
+type GCResult struct {
+	// Entries are the names of the entries removed from the index
+	Entries []string
+	// Blobs is the number of blobs removed
+	Blobs int
+	// Bytes is the total size of the blobs removed
+	Bytes int64
+}
+
+// manifestRefs holds the references of an image manifest or index
+type manifestRefs struct {
+	Manifests []v1.Descriptor `json:"manifests"`
+	Config    v1.Descriptor   `json:"config"`
+	Layers    []v1.Descriptor `json:"layers"`
+}
+
+// GC removes the entries of the cache index not selected by opts, then
+// deletes every blob no longer reachable from the remaining entries. It
+// takes the cache lock exclusively, so it waits for writers in progress
+// and blocks new ones until it is done.
+func (p *Provider) GC(opts GCOptions) (GCResult, error) {
+	var res GCResult
+
+	unlock, err := p.lock(true)
+	if err != nil {
+		return res, err
+	}
+	defer unlock()
+
+	ii, err := p.cache.ImageIndex()
+	if err != nil {
+		return res, fmt.Errorf("invalid image cache: %v", err)
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return res, fmt.Errorf("invalid image cache: %v", err)
+	}
+
+	var keep []v1.Descriptor
+	remove := map[string]bool{}
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[imagespec.AnnotationRefName]
+		if opts.keeps(name, p.lastUsed(desc.Digest)) {
+			keep = append(keep, desc)
+			continue
+		}
+		remove[name+"@"+desc.Digest.String()] = true
+		res.Entries = append(res.Entries, name)
+	}
+	if len(remove) > 0 {
+		if err := p.cache.RemoveDescriptors(func(desc v1.Descriptor) bool {
+			return remove[desc.Annotations[imagespec.AnnotationRefName]+"@"+desc.Digest.String()]
+		}); err != nil {
+			return res, fmt.Errorf("unable to remove entries from the cache index: %v", err)
+		}
+	}
+
+	referenced := map[v1.Hash]bool{}
+	for _, desc := range keep {
+		if err := p.markReferenced(desc, referenced); err != nil {
+			return res, err
+		}
+	}
+
+	blobs := filepath.Join(string(p.cache), "blobs")
+	algs, err := ioutil.ReadDir(blobs)
+	if err != nil && !os.IsNotExist(err) {
+		return res, err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(blobs, alg.Name()))
+		if err != nil {
+			return res, err
+		}
+		for _, f := range files {
+			if isTmp(f.Name()) && !f.IsDir() {
+				// left by an interrupted write, as writers hold the lock
+				log.Debugf("removing partial blob %s", f.Name())
+				if err := os.Remove(filepath.Join(blobs, alg.Name(), f.Name())); err != nil {
+					return res, err
+				}
+				res.Blobs++
+				res.Bytes += f.Size()
+				continue
+			}
+			h, err := v1.NewHash(alg.Name() + ":" + f.Name())
+			if err != nil || f.IsDir() || referenced[h] {
+				// only remove what is certainly an unreferenced blob
+				continue
+			}
+			log.Debugf("removing unreferenced blob %s", h)
+			if err := p.cache.RemoveBlob(h); err != nil {
+				return res, fmt.Errorf("unable to remove blob %s: %v", h, err)
+			}
+			res.Blobs++
+			res.Bytes += f.Size()
+		}
+	}
+	return res, nil
+}
+
+// keeps reports whether opts keeps the entry named name, last used at used
+func (opts GCOptions) keeps(name string, used time.Time) bool {
+	if len(opts.Keep) == 0 && opts.Until.IsZero() {
+		return true
+	}
+	if !opts.Until.IsZero() && !used.Before(opts.Until) {
+		return true
+	}
+	for _, k := range opts.Keep {
+		k = util.ReferenceExpand(k)
+		if name == k || strings.HasPrefix(name, k+":") || strings.HasPrefix(name, k+"@") {
+			return true
+		}
+		// the per architecture images a package index is built from
+		for _, arch := range []string{"amd64", "arm64", "s390x"} {
+			if name == k+"-"+arch {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markReferenced adds the blob of desc, and those it refers to if it is an
+// image or index, to referenced. Blobs missing from the cache, such as the
+// images of platforms which were not pulled, are skipped.
+func (p *Provider) markReferenced(desc v1.Descriptor, referenced map[v1.Hash]bool) error {
+	if desc.Digest.Hex == "" || referenced[desc.Digest] {
+		return nil
+	}
+	referenced[desc.Digest] = true
+	if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+		return nil
+	}
+	b, err := p.cache.Bytes(desc.Digest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", desc.Digest, err)
+	}
+	var m manifestRefs
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("unable to parse %s %s: %v", desc.MediaType, desc.Digest, err)
+	}
+	for _, d := range append(append(m.Manifests, m.Config), m.Layers...) {
+		if err := p.markReferenced(d, referenced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastUsed is when the blob h was last used, as recorded by touch, or the
+// zero time if it is missing
+func (p *Provider) lastUsed(h v1.Hash) time.Time {
+	fi, err := os.Stat(blobPath(p.cache, h))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// touch records that the blob h, the root of an entry, was used now, for
+// GC to keep recently used entries
+func (p *Provider) touch(h v1.Hash) {
+	now := time.Now()
+	if err := os.Chtimes(blobPath(p.cache, h), now, now); err != nil {
+		log.Debugf("unable to record use of %s: %v", h, err)
+	}
+}
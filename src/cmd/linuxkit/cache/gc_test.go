@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testProvider(t *testing.T) *Provider {
+	dir, err := ioutil.TempDir("", "linuxkit-cache")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p, err := NewProvider(dir)
+	require.NoError(t, err)
+	return p
+}
+
+// writeBlob writes b to the cache and returns its descriptor
+func writeBlob(t *testing.T, p *Provider, mediaType types.MediaType, b []byte) v1.Descriptor {
+	h, size, err := v1.SHA256(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.NoError(t, p.writeBlob(h, bytes.NewReader(b)))
+	return v1.Descriptor{MediaType: mediaType, Digest: h, Size: size}
+}
+
+func writeJSON(t *testing.T, p *Provider, mediaType types.MediaType, v interface{}) v1.Descriptor {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return writeBlob(t, p, mediaType, b)
+}
+
+// writeImage writes an image with the given layers to the cache
+func writeImage(t *testing.T, p *Provider, config string, layers ...v1.Descriptor) v1.Descriptor {
+	return writeJSON(t, p, types.OCIManifestSchema1, v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        writeBlob(t, p, types.OCIConfigJSON, []byte(config)),
+		Layers:        layers,
+	})
+}
+
+func addEntry(t *testing.T, p *Provider, name string, desc v1.Descriptor) {
+	desc.Annotations = map[string]string{imagespec.AnnotationRefName: name}
+	require.NoError(t, p.replaceEntry(desc))
+}
+
+func blobExists(p *Provider, desc v1.Descriptor) bool {
+	_, err := os.Stat(filepath.Join(string(p.cache), "blobs", desc.Digest.Algorithm, desc.Digest.Hex))
+	return err == nil
+}
+
+func entryNames(t *testing.T, p *Provider) []string {
+	images, err := ListImages(p.cache)
+	require.NoError(t, err)
+	var names []string
+	for name := range images {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestGC(t *testing.T) {
+	p := testProvider(t)
+
+	shared := writeBlob(t, p, types.OCILayer, []byte("shared layer"))
+	image := writeImage(t, p, `{"image":1}`, shared)
+	addEntry(t, p, "docker.io/linuxkit/image:v1", image)
+
+	amd64 := writeImage(t, p, `{"arch":"amd64"}`, writeBlob(t, p, types.OCILayer, []byte("amd64 layer")))
+	amd64.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	// only amd64 was pulled
+	arm64 := v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}, Size: 1, Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}
+	index := writeJSON(t, p, types.OCIImageIndex, v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{amd64, arm64},
+	})
+	addEntry(t, p, "docker.io/linuxkit/index:v1", index)
+
+	// an image replaced by a newer one, and a blob left by an interrupted pull
+	oldLayer := writeBlob(t, p, types.OCILayer, []byte("old layer"))
+	old := writeImage(t, p, `{"image":0}`, oldLayer, shared)
+	orphan := writeBlob(t, p, types.OCILayer, []byte("orphan"))
+	partial := filepath.Join(string(p.cache), "blobs", "sha256", orphan.Digest.Hex+tmpSuffix+"1234")
+	require.NoError(t, ioutil.WriteFile(partial, []byte("orph"), 0644))
+	var oldManifest manifestRefs
+	b, err := p.cache.Bytes(old.Digest)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &oldManifest))
+	orphans := []v1.Descriptor{old, oldLayer, oldManifest.Config, orphan}
+
+	res, err := p.GC(GCOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, res.Entries)
+	assert.Equal(t, len(orphans)+1, res.Blobs)
+	assert.NoFileExists(t, partial)
+	size := int64(4)
+	for _, desc := range orphans {
+		assert.False(t, blobExists(p, desc), "orphan %s", desc.Digest)
+		size += desc.Size
+	}
+	assert.Equal(t, size, res.Bytes)
+	for _, desc := range []v1.Descriptor{shared, image, index, amd64} {
+		assert.True(t, blobExists(p, desc), "referenced %s", desc.Digest)
+	}
+	assert.ElementsMatch(t, []string{"docker.io/linuxkit/image:v1", "docker.io/linuxkit/index:v1"}, entryNames(t, p))
+
+	// nothing is left to remove
+	res, err = p.GC(GCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, GCResult{}, res)
+}
+
+func TestGCKeepUntil(t *testing.T) {
+	p := testProvider(t)
+
+	shared := writeBlob(t, p, types.OCILayer, []byte("shared layer"))
+	recentLayer := writeBlob(t, p, types.OCILayer, []byte("recent layer"))
+	oldLayer := writeBlob(t, p, types.OCILayer, []byte("old layer"))
+	recent := writeImage(t, p, `{"image":"recent"}`, recentLayer, shared)
+	old := writeImage(t, p, `{"image":"old"}`, oldLayer, shared)
+	addEntry(t, p, "docker.io/linuxkit/recent:v1", recent)
+	addEntry(t, p, "docker.io/linuxkit/old:v1", old)
+	addEntry(t, p, "docker.io/linuxkit/old:v1-amd64", old)
+	addEntry(t, p, "docker.io/linuxkit/pinned:v1", old)
+
+	then := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(string(p.cache), "blobs", "sha256", old.Digest.Hex), then, then))
+
+	// old is kept as pinned still refers to it
+	res, err := p.GC(GCOptions{Keep: []string{"linuxkit/pinned"}, Until: time.Now().Add(-24 * time.Hour)})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"docker.io/linuxkit/old:v1", "docker.io/linuxkit/old:v1-amd64"}, res.Entries)
+	assert.Equal(t, 0, res.Blobs)
+	assert.ElementsMatch(t, []string{"docker.io/linuxkit/recent:v1", "docker.io/linuxkit/pinned:v1"}, entryNames(t, p))
+
+	// keeping only recent removes the blobs only old used
+	res, err = p.GC(GCOptions{Keep: []string{"linuxkit/recent:v1"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/linuxkit/pinned:v1"}, res.Entries)
+	assert.Equal(t, 3, res.Blobs)
+	assert.False(t, blobExists(p, old))
+	assert.False(t, blobExists(p, oldLayer))
+	assert.True(t, blobExists(p, shared))
+	assert.True(t, blobExists(p, recentLayer))
+	assert.Equal(t, []string{"docker.io/linuxkit/recent:v1"}, entryNames(t, p))
+}
+
+func TestGCLock(t *testing.T) {
+	p := testProvider(t)
+	writeBlob(t, p, types.OCILayer, []byte("being written"))
+
+	unlock, err := p.lock(false)
+	require.NoError(t, err)
+	done := make(chan GCResult)
+	go func() {
+		res, err := p.GC(GCOptions{})
+		assert.NoError(t, err)
+		done <- res
+	}()
+	select {
+	case <-done:
+		t.Fatal("gc ran while the cache was being written")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case res := <-done:
+		assert.Equal(t, 1, res.Blobs)
+	case <-time.After(10 * time.Second):
+		t.Fatal("gc did not run once the cache was written")
+	}
+}
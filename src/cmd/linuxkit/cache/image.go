@@ -1,6 +1,14 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -26,3 +34,168 @@ func ListImages(p layout.Path) (map[string]string, error) {
 	}
 	return names, nil
 }
+
+// ImageInfo describes an image in the cache, as listed by cache ls
+type ImageInfo struct {
+	// Tag is the name of the image
+	Tag string `json:"tag" yaml:"tag"`
+	// Digest is the digest of the image manifest, or of the index of a
+	// multi-platform image
+	Digest string `json:"digest" yaml:"digest"`
+	// Platforms are the os/arch[/variant] of the image, or of each image of
+	// the index which is in the cache
+	Platforms []string `json:"platforms" yaml:"platforms"`
+	// Size is the total size in bytes of the blobs of the image in the cache
+	Size int64 `json:"size" yaml:"size"`
+	// Children are the images of each platform of a multi-platform image
+	Children []ChildInfo `json:"children,omitempty" yaml:"children,omitempty"`
+}
+
+// ChildInfo describes the image of one platform of a multi-platform image
+type ChildInfo struct {
+	// Platform is the os/arch[/variant] of the image
+	Platform string `json:"platform" yaml:"platform"`
+	// Digest is the digest of the image manifest
+	Digest string `json:"digest" yaml:"digest"`
+	// Size is the total size in bytes of the blobs of the image in the cache
+	Size int64 `json:"size" yaml:"size"`
+	// Cached is set if the image was pulled into the cache
+	Cached bool `json:"cached" yaml:"cached"`
+}
+
+// ListImageInfo describes the named images in a layout.Path, sorted by tag
+func ListImageInfo(p layout.Path) ([]ImageInfo, error) {
+	ii, err := p.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	images := []ImageInfo{}
+	for _, desc := range index.Manifests {
+		name, ok := desc.Annotations[imagespec.AnnotationRefName]
+		if !ok {
+			continue
+		}
+		info := ImageInfo{Tag: name, Digest: desc.Digest.String(), Platforms: []string{}}
+		if err := info.add(p, desc, map[v1.Hash]bool{}); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", name, err)
+		}
+		if desc.MediaType.IsIndex() {
+			if info.Children, err = listChildren(p, desc); err != nil {
+				return nil, fmt.Errorf("unable to read %s: %v", name, err)
+			}
+		}
+		images = append(images, info)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Tag < images[j].Tag })
+	return images, nil
+}
+
+// listChildren describes the image of each platform of the index desc,
+// leaving out attestations and other artifacts
+func listChildren(p layout.Path, desc v1.Descriptor) ([]ChildInfo, error) {
+	b, err := p.Bytes(desc.Digest)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m manifestRefs
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	var children []ChildInfo
+	for _, d := range m.Manifests {
+		info := ImageInfo{Platforms: []string{}}
+		if err := info.add(p, d, map[v1.Hash]bool{}); err != nil {
+			return nil, err
+		}
+		child := ChildInfo{Platform: platformString(d.Platform), Digest: d.Digest.String(), Size: info.Size}
+		if _, err := os.Stat(blobPath(p, d.Digest)); err == nil {
+			child.Cached = true
+		}
+		if child.Platform == "" && len(info.Platforms) > 0 {
+			child.Platform = info.Platforms[0]
+		}
+		if child.Platform == "" {
+			continue
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// add adds the size of the blob of desc and of those it refers to which are
+// in the cache, and the platform of each image, to info
+func (info *ImageInfo) add(p layout.Path, desc v1.Descriptor, seen map[v1.Hash]bool) error {
+	if desc.Digest.Hex == "" || seen[desc.Digest] {
+		return nil
+	}
+	seen[desc.Digest] = true
+	if _, err := os.Stat(blobPath(p, desc.Digest)); err != nil {
+		return nil
+	}
+	info.Size += desc.Size
+	if !desc.MediaType.IsIndex() && !desc.MediaType.IsImage() {
+		return nil
+	}
+	b, err := p.Bytes(desc.Digest)
+	if err != nil {
+		return err
+	}
+	var m manifestRefs
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if desc.MediaType.IsImage() {
+		if platform := imagePlatform(p, desc, m.Config); platform != "" {
+			info.Platforms = append(info.Platforms, platform)
+		}
+	}
+	for _, d := range append(append(m.Manifests, m.Config), m.Layers...) {
+		if err := info.add(p, d, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imagePlatform is the os/arch[/variant] of the image desc, from its
+// descriptor or its config, or "" for an attestation or other artifact
+func imagePlatform(p layout.Path, desc, config v1.Descriptor) string {
+	platform := desc.Platform
+	if platform == nil {
+		b, err := p.Bytes(config.Digest)
+		if err != nil {
+			return ""
+		}
+		cfg, err := v1.ParseConfigFile(bytes.NewReader(b))
+		if err != nil {
+			return ""
+		}
+		platform = &v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture}
+	}
+	return platformString(platform)
+}
+
+// platformString formats platform as os/arch[/variant], or "" if it is
+// not a real platform
+func platformString(platform *v1.Platform) string {
+	if platform == nil || platform.OS == "" || platform.OS == "unknown" {
+		return ""
+	}
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// blobPath is the file holding the blob h in p
+func blobPath(p layout.Path, h v1.Hash) string {
+	return filepath.Join(string(p), "blobs", h.Algorithm, h.Hex)
+}
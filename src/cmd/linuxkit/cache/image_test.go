@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListImageInfo(t *testing.T) {
+	p := testProvider(t)
+
+	shared := writeBlob(t, p, types.OCILayer, []byte("shared layer"))
+	image := writeImage(t, p, `{"os":"linux","architecture":"amd64"}`, shared)
+	addEntry(t, p, "docker.io/linuxkit/image:v1", image)
+
+	arm64 := writeImage(t, p, `{"os":"linux","architecture":"arm64"}`, shared)
+	arm64.Platform = &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	// only arm64 was pulled
+	amd64 := v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: v1.Hash{Algorithm: "sha256", Hex: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}, Size: 100, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}
+	statement := writeBlob(t, p, "application/vnd.in-toto+json", []byte(`{"predicate":{}}`))
+	attestation := writeImage(t, p, `{}`, statement)
+	attestation.Platform = &v1.Platform{OS: "unknown", Architecture: "unknown"}
+	index := writeJSON(t, p, types.OCIImageIndex, v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     []v1.Descriptor{arm64, amd64, attestation},
+	})
+	addEntry(t, p, "docker.io/linuxkit/index:v1", index)
+
+	configSize := func(d v1.Descriptor) int64 {
+		var m manifestRefs
+		b, err := p.cache.Bytes(d.Digest)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(b, &m))
+		return m.Config.Size
+	}
+
+	images, err := ListImageInfo(p.cache)
+	require.NoError(t, err)
+	assert.Equal(t, []ImageInfo{
+		{
+			Tag:       "docker.io/linuxkit/image:v1",
+			Digest:    image.Digest.String(),
+			Platforms: []string{"linux/amd64"},
+			Size:      image.Size + configSize(image) + shared.Size,
+		},
+		{
+			Tag:       "docker.io/linuxkit/index:v1",
+			Digest:    index.Digest.String(),
+			Platforms: []string{"linux/arm64/v8"},
+			Size:      index.Size + arm64.Size + configSize(arm64) + shared.Size + attestation.Size + configSize(attestation) + statement.Size,
+			Children: []ChildInfo{
+				{Platform: "linux/arm64/v8", Digest: arm64.Digest.String(), Size: arm64.Size + configSize(arm64) + shared.Size, Cached: true},
+				{Platform: "linux/amd64", Digest: amd64.Digest.String()},
+			},
+		},
+	}, images)
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// lockName is the file in the cache directory used to serialise gc
+	// with writers to the cache
+	lockName = ".lock"
+	// indexLockName is the file in the cache directory used to serialise
+	// the updates of index.json by writers, which share lockName
+	indexLockName = ".index.lock"
+)
+
+// lock takes a lock on the cache, shared by writers adding blobs and
+// entries, or exclusive for gc, which must not delete a blob a writer has
+// just added but not yet referenced. It blocks until the lock is free and
+// returns a function to release it.
+func (p *Provider) lock(exclusive bool) (func(), error) {
+	return p.lockFile(lockName, exclusive)
+}
+
+// lockIndex takes the exclusive lock on index.json of writers, which
+// read, modify and replace it whole, so that concurrent updates, from
+// this or other processes, do not undo each other.
+func (p *Provider) lockIndex() (func(), error) {
+	return p.lockFile(indexLockName, true)
+}
+
+func (p *Provider) lockFile(lock string, exclusive bool) (func(), error) {
+	name := filepath.Join(string(p.cache), lock)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cache lock %s: %v", name, err)
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock cache %s: %v", p.cache, err)
+	}
+	return func() {
+		_ = unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -3,7 +3,6 @@ package cache
 import (
 	"fmt"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	namepkg "github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
@@ -28,20 +27,20 @@ func (p *Provider) Push(name string) error {
 	if err != nil {
 		return err
 	}
-	options = append(options, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	options = append(options, remote.WithAuthFromKeychain(registry.Keychain))
 	img, err1 := root.Image()
 	ii, err2 := root.ImageIndex()
 	switch {
 	case err1 == nil:
 		log.Debugf("pushing image %s", name)
-		if err := remote.Write(ref, img, options...); err != nil {
+		if err := registry.RetryPush(name, func() error { return remote.Write(ref, img, options...) }); err != nil {
 			return err
 		}
 		fmt.Printf("Pushed image %s\n", name)
 	case err2 == nil:
 		log.Debugf("pushing index %s", name)
 		// this is an index, so we not only want to write the index, but tags for each arch-specific image in it
-		if err := remote.WriteIndex(ref, ii, options...); err != nil {
+		if err := registry.RetryPush(name, func() error { return remote.WriteIndex(ref, ii, options...) }); err != nil {
 			return err
 		}
 		fmt.Printf("Pushed index %s\n", name)
@@ -68,7 +67,13 @@ func (p *Provider) Push(name string) error {
 					desc.Annotations = map[string]string{}
 				}
 				desc.Annotations[imagespec.AnnotationRefName] = archTag
-				if err := p.cache.AppendDescriptor(*desc); err != nil {
+				unlock, err := p.lock(false)
+				if err != nil {
+					return err
+				}
+				err = p.replaceEntry(*desc)
+				unlock()
+				if err != nil {
 					return fmt.Errorf("error appending descriptor for %s to layout index: %v", archTag, err)
 				}
 				img, err = p.cache.Image(m.Digest)
@@ -77,7 +82,7 @@ func (p *Provider) Push(name string) error {
 				}
 			}
 			log.Debugf("pushing image %s", tag)
-			if err := remote.Tag(tag, img, options...); err != nil {
+			if err := registry.RetryPush(archTag, func() error { return remote.Tag(tag, img, options...) }); err != nil {
 				return fmt.Errorf("error creating tag %s: %v", archTag, err)
 			}
 		}
@@ -87,13 +92,16 @@ func (p *Provider) Push(name string) error {
 
 	// Even though we may have pushed the index, we want to be sure that we have an index that includes every architecture on the registry,
 	// not just those that were in our local cache. So we use manifest-tool library to build a broad index
-	auth, err := registry.GetDockerAuth()
+	auth, err := registry.GetDockerAuth(name)
 	if err != nil {
 		return fmt.Errorf("failed to get auth: %v", err)
 	}
 
 	fmt.Printf("Pushing index based on all arch-specific images in registry %s\n", name)
-	_, _, err = registry.PushManifest(name, auth)
+	err = registry.RetryPush(name, func() error {
+		_, _, err := registry.PushManifest(name, auth)
+		return err
+	})
 	if err != nil {
 		return err
 	}
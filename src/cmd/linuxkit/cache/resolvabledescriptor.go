@@ -54,11 +54,17 @@ func (p *Provider) FindRoot(imageName string) (ResolvableDescriptor, error) {
 	images, err := partial.FindImages(rootIndex, matcher)
 	if err == nil && len(images) > 0 {
 		// if we found the root tag as an image, just use it
+		if h, err := images[0].Digest(); err == nil {
+			p.touch(h)
+		}
 		return layoutImage{img: images[0]}, nil
 	}
 	// we did not find the root tag as an image, it is an index, get the index
 	indexes, err := partial.FindIndexes(rootIndex, matcher)
 	if err == nil && len(indexes) >= 1 {
+		if h, err := indexes[0].Digest(); err == nil {
+			p.touch(h)
+		}
 		return layoutIndex{idx: indexes[0]}, nil
 	}
 	return nil, fmt.Errorf("could not find image or index for %s", imageName)
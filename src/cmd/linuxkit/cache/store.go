@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/v1"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+/*
+ All writes to the cache go through the functions below, rather than the
+ layout.Path ones, so that whether a blob comes from a pull, a build or an
+ index written by linuxkit, it is stored once, under its digest, and only
+ once it is complete and verified.
+*/
+
+// tmpSuffix marks the temporary files blobs are written to, which gc
+// removes if a write was interrupted
+const tmpSuffix = ".tmp-"
+
+// writeBlob adds the blob h read from r to the cache, unless it is already
+// there. The blob is written to a temporary file and checked against h
+// before it is renamed into place, so a blob in the cache is always
+// complete and matches its digest.
+func (p *Provider) writeBlob(h v1.Hash, r io.Reader) error {
+	file := blobPath(p.cache, h)
+	if _, err := os.Stat(file); err == nil {
+		log.Debugf("blob %s already in cache", h)
+		return nil
+	}
+	if h.Algorithm != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s of blob %s", h.Algorithm, h)
+	}
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, h.Hex+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	digest := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, digest), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write blob %s: %v", h, err)
+	}
+	if got := fmt.Sprintf("%x", digest.Sum(nil)); got != h.Hex {
+		return fmt.Errorf("blob %s has digest sha256:%s", h, got)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// writeImage adds the layers, config and manifest of img to the cache
+func (p *Provider) writeImage(img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	var g errgroup.Group
+	for _, layer := range layers {
+		layer := layer
+		g.Go(func() error {
+			h, err := layer.Digest()
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stat(blobPath(p.cache, h)); err == nil {
+				return nil
+			}
+			r, err := layer.Compressed()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			return p.writeBlob(h, r)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	config, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	b, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := p.writeBlob(config, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	return p.writeManifest(img)
+}
+
+// writeIndex adds ii, and the images and indexes it refers to, to the cache
+func (p *Provider) writeIndex(ii v1.ImageIndex) error {
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := ii.ImageIndex(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := p.writeIndex(child); err != nil {
+				return err
+			}
+		case desc.MediaType.IsImage():
+			img, err := ii.Image(desc.Digest)
+			if err != nil {
+				return err
+			}
+			if err := p.writeImage(img); err != nil {
+				return err
+			}
+		default:
+			log.Debugf("not caching %s %s of index", desc.MediaType, desc.Digest)
+		}
+	}
+	return p.writeManifest(ii)
+}
+
+// writeManifest adds the manifest of an image or index to the cache
+func (p *Provider) writeManifest(m interface {
+	Digest() (v1.Hash, error)
+	RawManifest() ([]byte, error)
+}) error {
+	h, err := m.Digest()
+	if err != nil {
+		return err
+	}
+	b, err := m.RawManifest()
+	if err != nil {
+		return err
+	}
+	return p.writeBlob(h, bytes.NewReader(b))
+}
+
+// replaceEntry makes desc the entry of the cache index for its name,
+// replacing any existing one. Callers hold the shared cache lock, so it
+// takes the index lock too.
+func (p *Provider) replaceEntry(desc v1.Descriptor) error {
+	unlock, err := p.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	name := desc.Annotations[imagespec.AnnotationRefName]
+	ii, err := p.cache.ImageIndex()
+	if err != nil {
+		return err
+	}
+	index, err := ii.IndexManifest()
+	if err != nil {
+		return err
+	}
+	var manifests []v1.Descriptor
+	for _, d := range index.Manifests {
+		if d.Annotations[imagespec.AnnotationRefName] != name {
+			manifests = append(manifests, d)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+	return p.writeIndexJSON(index)
+}
+
+// writeIndexJSON replaces the index.json of the cache with index, through a
+// temporary file so readers never see a partial index
+func (p *Provider) writeIndexJSON(index *v1.IndexManifest) error {
+	b, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(string(p.cache), "index.json"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(p.cache), "index.json"))
+}
+
+// isTmp reports whether name is a temporary file of writeBlob or
+// writeIndexJSON
+func isTmp(name string) bool {
+	return strings.Contains(name, tmpSuffix)
+}
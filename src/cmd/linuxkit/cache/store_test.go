@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ociTar is an OCI layout tarball, as written by a build
+type ociTar struct {
+	buf   bytes.Buffer
+	tw    *tar.Writer
+	blobs map[v1.Hash]bool
+}
+
+func newOCITar() *ociTar {
+	o := &ociTar{blobs: map[v1.Hash]bool{}}
+	o.tw = tar.NewWriter(&o.buf)
+	return o
+}
+
+func (o *ociTar) add(t *testing.T, name string, b []byte) {
+	require.NoError(t, o.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}))
+	_, err := o.tw.Write(b)
+	require.NoError(t, err)
+}
+
+func (o *ociTar) blob(t *testing.T, mediaType types.MediaType, b []byte) v1.Descriptor {
+	h, size, err := v1.SHA256(bytes.NewReader(b))
+	require.NoError(t, err)
+	if !o.blobs[h] {
+		o.add(t, "blobs/sha256/"+h.Hex, b)
+		o.blobs[h] = true
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: h, Size: size}
+}
+
+func (o *ociTar) json(t *testing.T, mediaType types.MediaType, v interface{}) v1.Descriptor {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return o.blob(t, mediaType, b)
+}
+
+// buildPkg returns the OCI tarball of an image of base with a layer of its own
+func buildPkg(t *testing.T, base []byte, own string) []byte {
+	o := newOCITar()
+	manifest := o.json(t, types.OCIManifestSchema1, v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config:        o.blob(t, types.OCIConfigJSON, []byte(`{"os":"linux","architecture":"amd64","pkg":"`+own+`"}`)),
+		Layers: []v1.Descriptor{
+			o.blob(t, types.OCILayer, base),
+			o.blob(t, types.OCILayer, []byte(own)),
+		},
+	})
+	b, err := json.Marshal(v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: []v1.Descriptor{manifest}})
+	require.NoError(t, err)
+	o.add(t, "index.json", b)
+	o.add(t, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	require.NoError(t, o.tw.Close())
+	return o.buf.Bytes()
+}
+
+func loadPkg(t *testing.T, p *Provider, name string, r []byte) {
+	ref, err := reference.Parse(name)
+	require.NoError(t, err)
+	src, err := p.ImageLoad(&ref, "amd64", bytes.NewReader(r))
+	require.NoError(t, err)
+	_, err = p.IndexWrite(&ref, *src.Descriptor())
+	require.NoError(t, err)
+}
+
+func TestWriteDeduplicates(t *testing.T) {
+	p := testProvider(t)
+
+	base := bytes.Repeat([]byte("base layer "), 1000)
+	baseDigest, _, err := v1.SHA256(bytes.NewReader(base))
+	require.NoError(t, err)
+
+	loadPkg(t, p, "docker.io/linuxkit/a:v1", buildPkg(t, base, "a"))
+	loadPkg(t, p, "docker.io/linuxkit/b:v1", buildPkg(t, base, "b"))
+	// rebuilding writes nothing new
+	loadPkg(t, p, "docker.io/linuxkit/a:v1", buildPkg(t, base, "a"))
+
+	files, err := ioutil.ReadDir(filepath.Join(string(p.cache), "blobs", "sha256"))
+	require.NoError(t, err)
+	var shared int
+	for _, f := range files {
+		assert.False(t, isTmp(f.Name()), "temporary file %s left", f.Name())
+		if strings.HasPrefix(f.Name(), baseDigest.Hex) {
+			shared++
+		}
+	}
+	assert.Equal(t, 1, shared)
+	// for each package an index, manifest, config and layer, and the base
+	assert.Len(t, files, 9)
+
+	images, err := ListImageInfo(p.cache)
+	require.NoError(t, err)
+	require.Len(t, images, 4)
+	for _, image := range images {
+		assert.Equal(t, []string{"linux/amd64"}, image.Platforms, image.Tag)
+	}
+
+	// nothing is unreferenced
+	res, err := p.GC(GCOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Blobs)
+}
+
+func TestWriteBlobVerifies(t *testing.T) {
+	p := testProvider(t)
+
+	h, _, err := v1.SHA256(strings.NewReader("expected"))
+	require.NoError(t, err)
+	err = p.writeBlob(h, strings.NewReader("corrupted"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "has digest sha256:")
+	assert.False(t, blobExists(p, v1.Descriptor{Digest: h}))
+	files, err := ioutil.ReadDir(filepath.Join(string(p.cache), "blobs", "sha256"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	require.NoError(t, p.writeBlob(h, strings.NewReader("expected")))
+	assert.True(t, blobExists(p, v1.Descriptor{Digest: h}))
+}
+
+func TestReplaceEntryLock(t *testing.T) {
+	p := testProvider(t)
+	desc := writeBlob(t, p, types.OCILayer, []byte("entry"))
+
+	// the index lock is a file lock, so it is held against another
+	// provider as it is against another process
+	other, err := NewProvider(string(p.cache))
+	require.NoError(t, err)
+	unlock, err := other.lockIndex()
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		addEntry(t, p, "docker.io/linuxkit/a:v1", desc)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the index was updated while locked")
+	case <-time.After(200 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the index was not updated once unlocked")
+	}
+
+	// concurrent updates each keep those of the others
+	var wg sync.WaitGroup
+	names := []string{"docker.io/linuxkit/a:v1"}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("docker.io/linuxkit/b:v%d", i)
+		names = append(names, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := NewProvider(string(other.cache))
+			assert.NoError(t, err)
+			desc := desc
+			desc.Annotations = map[string]string{imagespec.AnnotationRefName: name}
+			assert.NoError(t, p.replaceEntry(desc))
+		}()
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, names, entryNames(t, p))
+}
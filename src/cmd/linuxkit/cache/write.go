@@ -7,18 +7,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"sort"
 	"strings"
 
 	"github.com/containerd/containerd/reference"
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/match"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
 	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
@@ -34,11 +33,16 @@ const (
 func (p *Provider) ImagePull(ref *reference.Spec, trustedRef, architecture string, alwaysPull bool) (lktspec.ImageSource, error) {
 	image := ref.String()
 	pullImageName := image
-	remoteOptions := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+	remoteOptions := []remote.Option{remote.WithAuthFromKeychain(registry.Keychain)}
 	if trustedRef != "" {
 		pullImageName = trustedRef
 	}
 	log.Debugf("ImagePull to cache %s trusted reference %s", image, pullImageName)
+	unlock, err := p.lock(false)
+	if err != nil {
+		return ImageSource{}, err
+	}
+	defer unlock()
 
 	// unless alwaysPull is set to true, check locally first
 	if !alwaysPull {
@@ -60,16 +64,14 @@ func (p *Provider) ImagePull(ref *reference.Spec, trustedRef, architecture strin
 		return ImageSource{}, fmt.Errorf("error getting manifest for trusted image %s: %v", pullImageName, err)
 	}
 
-	// use the original image name in the annotation
-	annotations := map[string]string{
-		imagespec.AnnotationRefName: image,
-	}
-
 	// first attempt as an index
+	var root *v1.Descriptor
 	ii, err := desc.ImageIndex()
 	if err == nil {
 		log.Debugf("ImageWrite retrieved %s is index, saving", pullImageName)
-		err = p.cache.ReplaceIndex(ii, match.Name(image), layout.WithAnnotations(annotations))
+		if err = p.writeIndex(ii); err == nil {
+			root, err = partial.Descriptor(ii)
+		}
 	} else {
 		var im v1.Image
 		// try an image
@@ -78,7 +80,16 @@ func (p *Provider) ImagePull(ref *reference.Spec, trustedRef, architecture strin
 			return ImageSource{}, fmt.Errorf("provided image is neither an image nor an index: %s", image)
 		}
 		log.Debugf("ImageWrite retrieved %s is image, saving", pullImageName)
-		err = p.cache.ReplaceImage(im, match.Name(image), layout.WithAnnotations(annotations))
+		if err = p.writeImage(im); err == nil {
+			root, err = partial.Descriptor(im)
+		}
+	}
+	if err == nil {
+		// use the original image name in the annotation
+		root.Annotations = map[string]string{
+			imagespec.AnnotationRefName: image,
+		}
+		err = p.replaceEntry(*root)
 	}
 	if err != nil {
 		return ImageSource{}, fmt.Errorf("unable to save image to cache: %v", err)
@@ -103,6 +114,11 @@ func (p *Provider) ImageLoad(ref *reference.Spec, architecture string, r io.Read
 	}
 	imageName := ref.String() + suffix
 	log.Debugf("ImageWriteTar to cache %s", imageName)
+	unlock, err := p.lock(false)
+	if err != nil {
+		return ImageSource{}, err
+	}
+	defer unlock()
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -146,7 +162,7 @@ func (p *Provider) ImageLoad(ref *reference.Spec, architecture string, r io.Read
 				return ImageSource{}, fmt.Errorf("invalid hash filename for %s: %v", filename, err)
 			}
 			log.Debugf("writing %s as hash %s", filename, hash)
-			if err := p.cache.WriteBlob(hash, ioutil.NopCloser(tr)); err != nil {
+			if err := p.writeBlob(hash, tr); err != nil {
 				return ImageSource{}, fmt.Errorf("error reading data for file %s : %v", filename, err)
 			}
 		}
@@ -163,9 +179,6 @@ func (p *Provider) ImageLoad(ref *reference.Spec, architecture string, r io.Read
 		if len(im.Manifests) != 1 {
 			return ImageSource{}, fmt.Errorf("currently only support OCI tar stream that has a single image")
 		}
-		if err := p.cache.RemoveDescriptors(match.Name(imageName)); err != nil {
-			return ImageSource{}, fmt.Errorf("unable to remove old descriptors for %s: %v", imageName, err)
-		}
 		for _, desc := range im.Manifests {
 			// make sure that we have the correct image name annotation
 			if desc.Annotations == nil {
@@ -174,9 +187,9 @@ func (p *Provider) ImageLoad(ref *reference.Spec, architecture string, r io.Read
 			desc.Annotations[imagespec.AnnotationRefName] = imageName
 			descriptor = &desc
 
-			log.Debugf("appending descriptor %#v", descriptor)
-			if err := p.cache.AppendDescriptor(desc); err != nil {
-				return ImageSource{}, fmt.Errorf("error appending descriptor to layout index: %v", err)
+			log.Debugf("replacing descriptor %#v", descriptor)
+			if err := p.replaceEntry(desc); err != nil {
+				return ImageSource{}, fmt.Errorf("error replacing descriptor in layout index: %v", err)
 			}
 		}
 	}
@@ -200,6 +213,11 @@ func (p *Provider) ImageLoad(ref *reference.Spec, architecture string, r io.Read
 func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor) (lktspec.ImageSource, error) {
 	image := ref.String()
 	log.Debugf("writing an index for %s", image)
+	unlock, err := p.lock(false)
+	if err != nil {
+		return ImageSource{}, err
+	}
+	defer unlock()
 
 	ii, err := p.cache.ImageIndex()
 	if err != nil {
@@ -224,10 +242,6 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 		if err != nil {
 			return ImageSource{}, fmt.Errorf("unable to convert index for %s into its manifest: %v", image, err)
 		}
-		oldhash, err := indexes[0].Digest()
-		if err != nil {
-			return ImageSource{}, fmt.Errorf("unable to get hash of existing index: %v", err)
-		}
 		// we only care about avoiding duplicate arch/OS/Variant
 		descReplace := map[string]v1.Descriptor{}
 		for _, desc := range descriptors {
@@ -253,10 +267,7 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 		}
 		manifest.Manifests = manifests
 		im = *manifest
-		// remove the old index
-		if err := p.cache.RemoveBlob(oldhash); err != nil {
-			return ImageSource{}, fmt.Errorf("unable to remove old index file: %v", err)
-		}
+		// the old index is left for cache gc, as other images may refer to it
 
 	} else {
 		// we did not have one, so create an index, store it, update the root index.json, and return
@@ -267,6 +278,10 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 		}
 	}
 
+	// the order of the platforms is that they were built in, so sort them
+	// for the digest to only depend on the contents
+	sortManifests(im.Manifests)
+
 	// write the updated index, remove the old one
 	b, err := json.Marshal(im)
 	if err != nil {
@@ -276,13 +291,10 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 	if err != nil {
 		return ImageSource{}, fmt.Errorf("error calculating hash of index json: %v", err)
 	}
-	if err := p.cache.WriteBlob(hash, ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+	if err := p.writeBlob(hash, bytes.NewReader(b)); err != nil {
 		return ImageSource{}, fmt.Errorf("error writing new index to json: %v", err)
 	}
 	// finally update the descriptor in the root
-	if err := p.cache.RemoveDescriptors(match.Name(image)); err != nil {
-		return ImageSource{}, fmt.Errorf("unable to remove old descriptor from index.json: %v", err)
-	}
 	desc := v1.Descriptor{
 		MediaType: types.OCIImageIndex,
 		Size:      size,
@@ -291,9 +303,10 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 			imagespec.AnnotationRefName: image,
 		},
 	}
-	if err := p.cache.AppendDescriptor(desc); err != nil {
-		return ImageSource{}, fmt.Errorf("unable to append new descriptor to index.json: %v", err)
+	if err := p.replaceEntry(desc); err != nil {
+		return ImageSource{}, fmt.Errorf("unable to replace descriptor in index.json: %v", err)
 	}
+	p.touch(desc.Digest)
 
 	return p.NewSource(
 		ref,
@@ -302,6 +315,29 @@ func (p *Provider) IndexWrite(ref *reference.Spec, descriptors ...v1.Descriptor)
 	), nil
 }
 
+// sortManifests sorts the entries of an index by platform, os, then
+// architecture and variant, followed by those without a platform, such
+// as attestations, in the order they are in
+func sortManifests(manifests []v1.Descriptor) {
+	key := func(d v1.Descriptor) []string {
+		p := d.Platform
+		return []string{p.OS, p.Architecture, p.Variant, p.OSVersion}
+	}
+	sort.SliceStable(manifests, func(i, j int) bool {
+		a, b := manifests[i], manifests[j]
+		if a.Platform == nil || b.Platform == nil {
+			return a.Platform != nil && b.Platform == nil
+		}
+		ka, kb := key(a), key(b)
+		for n := range ka {
+			if ka[n] != kb[n] {
+				return ka[n] < kb[n]
+			}
+		}
+		return false
+	})
+}
+
 // DescriptorWrite writes a descriptor to the cache index; it validates that it has a name
 // and replaces any existing one
 func (p *Provider) DescriptorWrite(ref *reference.Spec, desc v1.Descriptor) (lktspec.ImageSource, error) {
@@ -314,15 +350,17 @@ func (p *Provider) DescriptorWrite(ref *reference.Spec, desc v1.Descriptor) (lkt
 	}
 	desc.Annotations[imagespec.AnnotationRefName] = image
 	log.Debugf("writing descriptor for image %s", image)
-
-	// do we update an existing one? Or create a new one?
-	if err := p.cache.RemoveDescriptors(match.Name(image)); err != nil {
-		return ImageSource{}, fmt.Errorf("unable to remove old descriptors for %s: %v", image, err)
+	unlock, err := p.lock(false)
+	if err != nil {
+		return ImageSource{}, err
 	}
+	defer unlock()
 
-	if err := p.cache.AppendDescriptor(desc); err != nil {
-		return ImageSource{}, fmt.Errorf("unable to append new descriptor for %s: %v", image, err)
+	// replaces any existing one
+	if err := p.replaceEntry(desc); err != nil {
+		return ImageSource{}, fmt.Errorf("unable to replace descriptor for %s: %v", image, err)
 	}
+	p.touch(desc.Digest)
 
 	return p.NewSource(
 		ref,
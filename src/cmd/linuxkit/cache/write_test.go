@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// platformManifest is the descriptor of the manifest built for arch
+func platformManifest(t *testing.T, p *Provider, arch, variant string) v1.Descriptor {
+	desc := writeBlob(t, p, types.OCIManifestSchema1, []byte(`{"schemaVersion":2,"arch":"`+arch+variant+`"}`))
+	desc.Platform = &v1.Platform{OS: "linux", Architecture: arch, Variant: variant}
+	return desc
+}
+
+// indexDigest writes an index of manifests of the arches of each batch, in
+// order, to a new cache, and returns its digest
+func indexDigest(t *testing.T, batches ...[]string) v1.Hash {
+	p := testProvider(t)
+	ref, err := reference.Parse("docker.io/linuxkit/foo:abc")
+	require.NoError(t, err)
+	var src ImageSource
+	for _, batch := range batches {
+		var descs []v1.Descriptor
+		for _, arch := range batch {
+			variant := ""
+			if arch == "arm" {
+				variant = "v7"
+			}
+			descs = append(descs, platformManifest(t, p, arch, variant))
+		}
+		s, err := p.IndexWrite(&ref, descs...)
+		require.NoError(t, err)
+		src = s.(ImageSource)
+	}
+	return src.Descriptor().Digest
+}
+
+func TestIndexWriteSorted(t *testing.T) {
+	d := indexDigest(t, []string{"amd64", "arm64"})
+	assert.Equal(t, d, indexDigest(t, []string{"arm64", "amd64"}))
+	// the same when adding to an existing index
+	assert.Equal(t, d, indexDigest(t, []string{"arm64"}, []string{"amd64"}))
+
+	all := indexDigest(t, []string{"s390x", "arm", "arm64", "amd64"})
+	assert.Equal(t, all, indexDigest(t, []string{"amd64", "arm64", "arm", "s390x"}))
+	assert.Equal(t, all, indexDigest(t, []string{"arm64", "s390x"}, []string{"arm", "amd64"}))
+	assert.NotEqual(t, d, all)
+}
+
+func TestSortManifests(t *testing.T) {
+	platform := func(os, arch, variant string) v1.Descriptor {
+		return v1.Descriptor{Platform: &v1.Platform{OS: os, Architecture: arch, Variant: variant}}
+	}
+	attestation := v1.Descriptor{Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"}}
+	manifests := []v1.Descriptor{
+		attestation,
+		platform("linux", "arm64", ""),
+		platform("windows", "amd64", ""),
+		platform("linux", "arm", "v7"),
+		platform("linux", "arm", "v6"),
+		platform("linux", "amd64", ""),
+	}
+	sortManifests(manifests)
+	assert.Equal(t, []v1.Descriptor{
+		platform("linux", "amd64", ""),
+		platform("linux", "arm", "v6"),
+		platform("linux", "arm", "v7"),
+		platform("linux", "arm64", ""),
+		platform("windows", "amd64", ""),
+		attestation,
+	}, manifests)
+}
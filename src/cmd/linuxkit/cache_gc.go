@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	log "github.com/sirupsen/logrus"
+)
+
+func cacheGC(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	var keep multipleFlag
+	flags.Var(&keep, "keep", "Keep the image with this name, or every tag of it if no tag is given, and remove the images not kept. Can be repeated")
+	until := flags.String("until", "", "Keep the images used since this time, a duration such as 168h or an RFC 3339 timestamp, and remove the images not kept. Without -keep or -until every image is kept and only unreferenced blobs are removed")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	opts := cachepkg.GCOptions{Keep: keep}
+	if *until != "" {
+		t, err := parseUntil(*until, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Until = t
+	}
+
+	p, err := cachepkg.NewProvider(*cacheDir)
+	if err != nil {
+		log.Fatalf("unable to read a local cache: %v", err)
+	}
+	res, err := p.GC(opts)
+	if err != nil {
+		log.Fatalf("Unable to gc cache %s: %v", *cacheDir, err)
+	}
+	for _, name := range res.Entries {
+		log.Infof("Removed %s", name)
+	}
+	log.Infof("Removed %d blobs, freed %d bytes from %s", res.Blobs, res.Bytes, *cacheDir)
+}
+
+// parseUntil parses the -until of cache gc, relative to now if it is a
+// duration
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -until %q, must be a duration such as 168h or an RFC 3339 timestamp", s)
+	}
+	return t, nil
+}
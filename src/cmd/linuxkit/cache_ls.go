@@ -1,16 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
 
 	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 func cacheList(args []string) {
 	flags := flag.NewFlagSet("list", flag.ExitOnError)
 
 	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding cached image")
+	format := flags.String("format", "", "Output format, json, yaml or a Go template executed for each image, instead of a table. "+
+		"json and yaml print a list of images, each with the fields tag (string, the image name), digest (string, of the manifest or index), "+
+		"platforms (list of os/arch[/variant] strings of the images in the cache) and size (integer, bytes of its blobs in the cache). "+
+		"A multi-platform image also has children, a list of its images, each with the fields platform, digest, size and cached (boolean, if it is in the cache). "+
+		"A template sees the same fields as .Tag, .Digest, .Platforms, .Size and .Children")
+	platforms := flags.String("platform", "", "Only list the images for these comma separated os/arch[/variant] platforms, an omitted variant matching any")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -21,12 +34,93 @@ func cacheList(args []string) {
 	if err != nil {
 		log.Fatalf("unable to read a local cache: %v", err)
 	}
-	images, err := cachepkg.ListImages(p)
+	images, err := cachepkg.ListImageInfo(p)
 	if err != nil {
 		log.Fatalf("error reading image names: %v", err)
 	}
-	log.Printf("%-80s %s", "image name", "root manifest hash")
-	for name, hash := range images {
-		log.Printf("%-80s %s", name, hash)
+	if *platforms != "" {
+		images = filterPlatforms(images, strings.Split(*platforms, ","))
 	}
+	if *format == "" {
+		log.Printf("%-80s %s", "image name", "root manifest hash")
+		for _, image := range images {
+			log.Printf("%-80s %s", image.Tag, image.Digest)
+			for _, child := range image.Children {
+				size := "not in cache"
+				if child.Cached {
+					size = fmt.Sprintf("%d bytes", child.Size)
+				}
+				log.Printf("  %-78s %s %s", child.Platform, child.Digest, size)
+			}
+		}
+		return
+	}
+	if err := printCacheList(os.Stdout, images, *format); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// filterPlatforms returns the images, and children of multi-platform
+// images, for one of platforms
+func filterPlatforms(images []cachepkg.ImageInfo, platforms []string) []cachepkg.ImageInfo {
+	matches := func(platform string) bool {
+		for _, p := range platforms {
+			if platform == p || strings.HasPrefix(platform, p+"/") && strings.Count(p, "/") == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	filtered := []cachepkg.ImageInfo{}
+	for _, image := range images {
+		var plats []string
+		for _, platform := range image.Platforms {
+			if matches(platform) {
+				plats = append(plats, platform)
+			}
+		}
+		var children []cachepkg.ChildInfo
+		for _, child := range image.Children {
+			if matches(child.Platform) {
+				children = append(children, child)
+			}
+		}
+		if len(plats) == 0 && len(children) == 0 {
+			continue
+		}
+		image.Platforms = append([]string{}, plats...)
+		image.Children = children
+		filtered = append(filtered, image)
+	}
+	return filtered
+}
+
+// printCacheList writes images to w in format, json, yaml or a template
+func printCacheList(w io.Writer, images []cachepkg.ImageInfo, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(images)
+	case "yaml":
+		b, err := yaml.Marshal(images)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid -format template: %v", err)
+	}
+	for _, image := range images {
+		if err := tmpl.Execute(w, image); err != nil {
+			return fmt.Errorf("unable to format %s: %v", image.Tag, err)
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	cachepkg "github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPrintCacheList(t *testing.T) {
+	images := []cachepkg.ImageInfo{
+		{Tag: "docker.io/linuxkit/init:v1", Digest: "sha256:1234", Platforms: []string{"linux/amd64", "linux/arm64/v8"}, Size: 4096},
+		{Tag: "docker.io/linuxkit/runc:v1", Digest: "sha256:5678", Platforms: []string{}, Size: 0},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, printCacheList(&buf, images, "json"))
+	var got []cachepkg.ImageInfo
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, images, got)
+	// the field names are part of the documented output
+	var fields []map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, map[string]interface{}{
+		"tag":       "docker.io/linuxkit/init:v1",
+		"digest":    "sha256:1234",
+		"platforms": []interface{}{"linux/amd64", "linux/arm64/v8"},
+		"size":      float64(4096),
+	}, fields[0])
+
+	buf.Reset()
+	require.NoError(t, printCacheList(&buf, images, "yaml"))
+	got = nil
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, images, got)
+
+	buf.Reset()
+	require.NoError(t, printCacheList(&buf, images, "{{.Tag}} {{.Size}}"))
+	assert.Equal(t, "docker.io/linuxkit/init:v1 4096\ndocker.io/linuxkit/runc:v1 0\n", buf.String())
+
+	assert.Error(t, printCacheList(&buf, images, "{{.Tag"))
+}
+
+func TestFilterPlatforms(t *testing.T) {
+	images := []cachepkg.ImageInfo{
+		{Tag: "docker.io/linuxkit/single:v1", Platforms: []string{"linux/amd64"}},
+		{Tag: "docker.io/linuxkit/index:v1", Platforms: []string{"linux/amd64", "linux/arm64/v8"}, Children: []cachepkg.ChildInfo{
+			{Platform: "linux/amd64", Digest: "sha256:1234", Cached: true},
+			{Platform: "linux/arm64/v8", Digest: "sha256:5678", Cached: true},
+			{Platform: "linux/s390x", Digest: "sha256:9abc"},
+		}},
+	}
+
+	assert.Equal(t, []cachepkg.ImageInfo{
+		{Tag: "docker.io/linuxkit/index:v1", Platforms: []string{"linux/arm64/v8"}, Children: []cachepkg.ChildInfo{
+			{Platform: "linux/arm64/v8", Digest: "sha256:5678", Cached: true},
+		}},
+	}, filterPlatforms(images, []string{"linux/arm64"}))
+
+	assert.Equal(t, []cachepkg.ImageInfo{
+		{Tag: "docker.io/linuxkit/single:v1", Platforms: []string{"linux/amd64"}},
+		{Tag: "docker.io/linuxkit/index:v1", Platforms: []string{"linux/amd64"}, Children: []cachepkg.ChildInfo{
+			{Platform: "linux/amd64", Digest: "sha256:1234", Cached: true},
+			{Platform: "linux/s390x", Digest: "sha256:9abc"},
+		}},
+	}, filterPlatforms(images, []string{"linux/amd64", "linux/s390x"}))
+
+	assert.Empty(t, filterPlatforms(images, []string{"linux/arm64/v7"}))
+}
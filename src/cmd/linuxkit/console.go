@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// consoleLog is the file the serial console of a VM is copied to, as well
+// as to stdout. Its writes are not buffered, so that the output up to a
+// signal or a crash is in the file.
+type consoleLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	closed bool
+	// done closes the log when linuxkit is interrupted or terminated
+	done func()
+}
+
+// openConsoleLog creates the console log path, replacing any previous one,
+// closed when linuxkit is interrupted or terminated if it is not closed
+// before
+func openConsoleLog(path string) (*consoleLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &consoleLog{f: f}
+	c.done = cleanupOnSignal(func() { c.close() })
+	return c, nil
+}
+
+func (c *consoleLog) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return len(b), nil
+	}
+	return c.f.Write(b)
+}
+
+// tee is w copying what is written to it to the console log
+func (c *consoleLog) tee(w io.Writer) io.Writer {
+	return io.MultiWriter(w, c)
+}
+
+func (c *consoleLog) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.f.Sync()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close flushes the console log to disk and closes it
+func (c *consoleLog) Close() error {
+	c.done()
+	return c.close()
+}
+
+// relayConsole relays the console on the tty path of a VM, once the VM has
+// created it, to stdout and the console log l, and stdin to it, until the
+// VM exits with the result sent on exited, which it returns
+func relayConsole(path string, l *consoleLog, stdin io.Reader, stdout io.Writer, exited <-chan error) error {
+	var tty *os.File
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			tty = f
+			break
+		}
+		select {
+		case err := <-exited:
+			return err
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if f, ok := stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		state, err := terminal.MakeRaw(int(f.Fd()))
+		if err != nil {
+			tty.Close()
+			return fmt.Errorf("Cannot make the terminal raw: %v", err)
+		}
+		defer terminal.Restore(int(f.Fd()), state)
+	}
+	if stdin != nil {
+		go io.Copy(tty, stdin)
+	}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(l.tee(stdout), tty)
+		close(copied)
+	}()
+	err := <-exited
+	// the console output left in the tty, up to its end or for a moment
+	// if the VM keeps it open
+	select {
+	case <-copied:
+	case <-time.After(100 * time.Millisecond):
+	}
+	tty.Close()
+	<-copied
+	return err
+}
+
+// maxConsoleLine is the length of the console lines a consoleMatch keeps
+// to match, longer lines being cut
+const maxConsoleLine = 64 * 1024
+
+// consoleMatch is a writer of the console of a VM, sending the submatches
+// of the first line matching its regexp on matched
+type consoleMatch struct {
+	re      *regexp.Regexp
+	line    []byte
+	found   bool
+	matched chan []string
+}
+
+func newConsoleMatch(re *regexp.Regexp) *consoleMatch {
+	return &consoleMatch{re: re, matched: make(chan []string, 1)}
+}
+
+func (m *consoleMatch) Write(b []byte) (int, error) {
+	n := len(b)
+	for !m.found && len(b) != 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			if room := maxConsoleLine - len(m.line); room > 0 {
+				if len(b) > room {
+					b = b[:room]
+				}
+				m.line = append(m.line, b...)
+			}
+			break
+		}
+		if room := maxConsoleLine - len(m.line); room > 0 {
+			if i < room {
+				room = i
+			}
+			m.line = append(m.line, b[:room]...)
+		}
+		b = b[i+1:]
+		if sub := m.re.FindStringSubmatch(string(bytes.TrimSuffix(m.line, []byte("\r")))); sub != nil {
+			m.found = true
+			m.matched <- sub
+		}
+		m.line = m.line[:0]
+	}
+	return n, nil
+}
+
+// exitStatusError is the exit status of the guest, in the line matched by
+// -exit-on-match
+type exitStatusError int
+
+func (e exitStatusError) Error() string {
+	return fmt.Sprintf("the guest exited with status %d", int(e))
+}
+
+// matchStatus is the result of the line matched by -exit-on-match re, with
+// the submatches sub: the exit status of the guest in its status group if
+// it has one, as an exitStatusError unless it is 0
+func matchStatus(re *regexp.Regexp, sub []string) error {
+	for i, name := range re.SubexpNames() {
+		if name != "status" || i >= len(sub) {
+			continue
+		}
+		status, err := strconv.Atoi(sub[i])
+		if err != nil || status < 0 || status > 255 {
+			return fmt.Errorf("%q matched by -exit-on-match is not an exit status", sub[i])
+		}
+		if status != 0 {
+			return exitStatusError(status)
+		}
+	}
+	return nil
+}
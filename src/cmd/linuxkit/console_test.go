@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "console.log")
+	require.NoError(t, ioutil.WriteFile(path, []byte("previous run\n"), 0644))
+
+	l, err := openConsoleLog(path)
+	require.NoError(t, err)
+	var stdout bytes.Buffer
+	w := l.tee(&stdout)
+	_, err = w.Write([]byte("Linux version 5.10\n"))
+	require.NoError(t, err)
+	// written through to the file before it is closed
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Linux version 5.10\n", string(b))
+	require.NoError(t, l.Close())
+	require.NoError(t, l.Close())
+	_, err = w.Write([]byte("after exit\n"))
+	require.NoError(t, err)
+
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Linux version 5.10\n", string(b))
+	assert.Equal(t, "Linux version 5.10\nafter exit\n", stdout.String())
+}
+
+func TestRelayConsole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tty := filepath.Join(dir, "tty")
+	l, err := openConsoleLog(filepath.Join(dir, "console.log"))
+	require.NoError(t, err)
+
+	// the VM creates its tty after starting
+	exited := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(tty, []byte("Welcome to LinuxKit\n"), 0644)
+		time.Sleep(50 * time.Millisecond)
+		exited <- errors.New("exit status 1")
+	}()
+	var stdout bytes.Buffer
+	assert.EqualError(t, relayConsole(tty, l, nil, &stdout, exited), "exit status 1")
+	require.NoError(t, l.Close())
+	assert.Equal(t, "Welcome to LinuxKit\n", stdout.String())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "console.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "Welcome to LinuxKit\n", string(b))
+
+	// a VM failing before it has a tty
+	exited <- errors.New("no such file")
+	assert.EqualError(t, relayConsole(filepath.Join(dir, "missing"), l, nil, &stdout, exited), "no such file")
+}
+
+func TestConsoleMatch(t *testing.T) {
+	m := newConsoleMatch(regexp.MustCompile(`^smoke test exit (?P<status>\d+)$`))
+	// lines split across writes, with the \r of a serial console
+	for _, w := range []string{"Welcome to LinuxKit\r\nsmoke ", "test exit 3", "\r\nsmoke test exit 4\n"} {
+		n, err := m.Write([]byte(w))
+		require.NoError(t, err)
+		assert.Equal(t, len(w), n)
+	}
+	require.Len(t, m.matched, 1)
+	sub := <-m.matched
+	assert.Equal(t, []string{"smoke test exit 3", "3"}, sub)
+	assert.Equal(t, exitStatusError(3), matchStatus(m.re, sub))
+	assert.EqualError(t, matchStatus(m.re, sub), "the guest exited with status 3")
+	assert.NoError(t, matchStatus(m.re, []string{"smoke test exit 0", "0"}))
+	assert.EqualError(t, matchStatus(m.re, []string{"smoke test exit 256", "256"}), `"256" matched by -exit-on-match is not an exit status`)
+	// without a status group, a match is a success
+	assert.NoError(t, matchStatus(regexp.MustCompile("smoke test ok"), []string{"smoke test ok"}))
+
+	// a long line is cut rather than kept whole
+	m = newConsoleMatch(regexp.MustCompile("^x+$"))
+	_, err := m.Write([]byte(strings.Repeat("x", 2*maxConsoleLine) + "\n"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("x", maxConsoleLine), (<-m.matched)[0])
+}
+
+// fakeQemu writes a qemu running script to dir, returning the config to
+// run it with
+func fakeQemu(t *testing.T, dir, script string) QemuConfig {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake qemu is a shell script")
+	}
+	qemu := filepath.Join(dir, "qemu-system-x86_64")
+	require.NoError(t, ioutil.WriteFile(qemu, []byte("#!/bin/sh\n"+script), 0755))
+	return QemuConfig{
+		Path:        filepath.Join(dir, "linuxkit"),
+		StatePath:   dir,
+		Arch:        "x86_64",
+		CPUs:        "1",
+		Memory:      "512",
+		QemuBinPath: qemu,
+	}
+}
+
+// TestQemuExitOnMatch runs a qemu printing a marker and then running on,
+// which is stopped once the marker is printed
+func TestQemuExitOnMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+	config := fakeQemu(t, dir, "echo $$ > "+pidFile+"\necho 'Welcome to LinuxKit'\nprintf 'smoke test '\nsleep 0.1\nprintf 'exit 3\\r\\n'\nwhile :; do sleep 0.1; done\n")
+	config.ExitOnMatch = regexp.MustCompile(`^smoke test exit (?P<status>\d+)$`)
+	config.Timeout = time.Minute
+
+	assert.Equal(t, exitStatusError(3), runQemuLocal(config))
+	pid, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	assert.Error(t, exec.Command("kill", "-0", strings.TrimSpace(string(pid))).Run(), "qemu is still running")
+
+	// matched as qemu exits
+	config = fakeQemu(t, dir, "echo 'smoke test exit 0'\n")
+	config.ExitOnMatch = regexp.MustCompile(`^smoke test exit (?P<status>\d+)$`)
+	assert.NoError(t, runQemuLocal(config))
+
+	// qemu exiting without a match
+	config = fakeQemu(t, dir, "echo 'Welcome to LinuxKit'\n")
+	config.ExitOnMatch = regexp.MustCompile(`^smoke test exit (?P<status>\d+)$`)
+	assert.EqualError(t, runQemuLocal(config), `The VM stopped before its console matched -exit-on-match "^smoke test exit (?P<status>\\d+)$"`)
+}
+
+func TestQemuTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := fakeQemu(t, dir, "while :; do sleep 0.1; done\n")
+	config.ExitOnMatch = regexp.MustCompile("smoke test ok")
+	config.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	assert.EqualError(t, runQemuLocal(config), "Timed out after 200ms")
+	assert.True(t, time.Since(start) < 5*time.Second, "qemu is not stopped at the timeout")
+
+	// without watching the console
+	config.ExitOnMatch = nil
+	assert.EqualError(t, runQemuLocal(config), "Timed out after 200ms")
+}
+
+func TestQemuExitOnPoweroff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := fakeQemu(t, dir, "echo 'reboot: Power down'\n")
+	config.ExitOnPoweroff = true
+	assert.NoError(t, runQemuLocal(config))
+	_, args := buildQemuCmdline(config)
+	assert.Contains(t, args, "-no-reboot")
+
+	// qemu exits as the VM restarts with -no-reboot
+	config = fakeQemu(t, dir, "echo 'Kernel panic - not syncing: VFS: Unable to mount root fs'\n")
+	config.ExitOnPoweroff = true
+	assert.EqualError(t, runQemuLocal(config), "The VM restarted rather than powering off: Kernel panic - not syncing")
+}
+
+// TestQemuConsoleLog runs a qemu that writes to its console, and checks
+// the output reaches the console log as well as stdout
+func TestQemuConsoleLog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake qemu is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	qemu := filepath.Join(dir, "qemu-system-x86_64")
+	require.NoError(t, ioutil.WriteFile(qemu, []byte("#!/bin/sh\necho 'Linux version 5.10'\necho \"args $*\"\n"), 0755))
+	logPath := filepath.Join(dir, "console.log")
+
+	config := QemuConfig{
+		Path:        filepath.Join(dir, "linuxkit"),
+		StatePath:   dir,
+		Arch:        "x86_64",
+		CPUs:        "1",
+		Memory:      "512",
+		QemuBinPath: qemu,
+		ConsoleLog:  logPath,
+	}
+	require.NoError(t, runQemuLocal(config))
+	b, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "Linux version 5.10\nargs -smp 1 -m 512")
+	assert.Contains(t, string(b), "-nographic")
+
+	// with a window, qemu writes the serial console to the file itself
+	config.GUI = true
+	_, args := buildQemuCmdline(config)
+	containsArgs(t, args, "-serial", "file:"+logPath)
+}
+
+// TestQemuBootConsoleLog boots a kernel under OVMF with its console logged
+func TestQemuBootConsoleLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	imagePath, qemu, fw := efiTestImage(t, dir)
+
+	m, err := moby.NewConfig([]byte("outputs:\n  raw-efi:\n    esp:\n      bootloader: stub\n"))
+	require.NoError(t, err)
+	base := filepath.Join(dir, "linuxkit")
+	require.NoError(t, moby.Formats(base, imagePath, []string{"raw-efi"}, 0, "", m))
+
+	logPath := filepath.Join(dir, "console.log")
+	config := QemuConfig{
+		Path:        base + "-efi.img",
+		Disks:       Disks{{Path: base + "-efi.img", Format: "raw"}},
+		UEFI:        true,
+		FWPath:      fw,
+		StatePath:   dir,
+		Arch:        "x86_64",
+		CPUs:        "1",
+		Memory:      "512",
+		QemuBinPath: qemu,
+		ConsoleLog:  logPath,
+		// the kernel panics without a root filesystem, and qemu exits
+		ExtraArgs: []string{"-no-reboot"},
+	}
+	runQemuLocal(config)
+	b, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "Kernel command line: initrd=\\initrd.img console=ttyS0 panic=-1")
+}
+
+// TestQemuBootExitOnMatch boots a kernel under OVMF, stopping it once it
+// prints its command line
+func TestQemuBootExitOnMatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-console")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	imagePath, qemu, fw := efiTestImage(t, dir)
+
+	m, err := moby.NewConfig([]byte("outputs:\n  raw-efi:\n    esp:\n      bootloader: stub\n"))
+	require.NoError(t, err)
+	base := filepath.Join(dir, "linuxkit")
+	require.NoError(t, moby.Formats(base, imagePath, []string{"raw-efi"}, 0, "", m))
+
+	config := QemuConfig{
+		Path:        base + "-efi.img",
+		Disks:       Disks{{Path: base + "-efi.img", Format: "raw"}},
+		UEFI:        true,
+		FWPath:      fw,
+		StatePath:   dir,
+		Arch:        "x86_64",
+		CPUs:        "1",
+		Memory:      "512",
+		QemuBinPath: qemu,
+		ExitOnMatch: regexp.MustCompile(`Kernel command line: .*console=ttyS0`),
+		Timeout:     5 * time.Minute,
+	}
+	assert.NoError(t, runQemuLocal(config))
+}
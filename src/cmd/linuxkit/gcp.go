@@ -125,11 +125,12 @@ func (g GCPClient) UploadFile(src, dst, bucketName string, public bool) error {
 	return nil
 }
 
-// CreateImage creates a GCP image using the a source from Google Storage
-func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace bool) error {
+// CreateImage creates a GCP image using the a source from Google Storage,
+// and returns its self link
+func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace bool) (string, error) {
 	if replace {
 		if err := g.DeleteImage(name); err != nil {
-			return err
+			return "", err
 		}
 	}
 
@@ -151,14 +152,26 @@ func (g GCPClient) CreateImage(name, storageURL, family string, nested, replace
 
 	op, err := g.compute.Images.Insert(g.projectName, imgObj).Do()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if err := g.pollOperationStatus(op.Name); err != nil {
-		return err
+		return "", err
 	}
 	log.Infof("Image %s created", name)
-	return nil
+	return op.TargetLink, nil
+}
+
+// ImageExists checks if there is an image called name
+func (g GCPClient) ImageExists(name string) (bool, error) {
+	_, err := g.compute.Images.Get(g.projectName, name).Do()
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
 // DeleteImage deletes and image
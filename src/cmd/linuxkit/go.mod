@@ -18,6 +18,7 @@ require (
 	github.com/creack/goselect v0.0.0-20180501195510-58854f77ee8d // indirect
 	github.com/dchest/bcrypt_pbkdf v0.0.0-20150205184540-83f37f9c154a // indirect
 	github.com/docker/cli v20.10.0-beta1+incompatible
+	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/docker v17.12.0-ce-rc1.0.20200116195852-71e07f91307a+incompatible
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7 // indirect
 	github.com/estesp/manifest-tool v1.0.4-0.20210209183109-dd311423107e
@@ -32,6 +33,7 @@ require (
 	github.com/moby/hyperkit v0.0.0-20180416161519-d65b09c1c28a
 	github.com/moby/vpnkit v0.4.1-0.20200311130018-2ffc1dd8a84e
 	github.com/moul/gotty-client v1.7.1-0.20180526075433-e5589f6df359
+	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.1
 	github.com/opencontainers/runc v1.0.0-rc90.0.20200409211037-ccbb3364d49d // indirect
 	github.com/opencontainers/runtime-spec v1.0.2
@@ -55,4 +57,5 @@ require (
 	google.golang.org/grpc v1.30.0-dev.0.20200410230105-27096e8260a4 // indirect
 	gopkg.in/check.v1 v1.0.0-20200902074654-038fdea0a05b // indirect
 	gopkg.in/yaml.v2 v2.3.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -5,20 +5,40 @@ import (
 	"bytes"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pad4"
 	"github.com/surma/gocpio"
 )
 
+// Compression is the algorithm used to compress an initrd
+type Compression string
+
+const (
+	// Gzip compresses the initrd with gzip, supported by all kernels
+	Gzip Compression = "gzip"
+	// Zstd compresses the initrd with zstd, which needs a kernel built
+	// with CONFIG_RD_ZSTD and the zstd executable to be installed
+	Zstd Compression = "zstd"
+
+	// DefaultZstdLevel is the zstd compression level used by default
+	DefaultZstdLevel = 3
+	// MaxZstdLevel is the highest level which does not need a larger
+	// window than the kernel decompressor supports
+	MaxZstdLevel = 19
+)
+
 // Writer is an io.WriteCloser that writes to an initrd
 // This is a compressed cpio archive, zero padded to 4 bytes
 type Writer struct {
 	pw *pad4.Writer
-	gw *gzip.Writer
+	zw io.WriteCloser
 	cw *cpio.Writer
 }
 
@@ -151,16 +171,80 @@ func CopySplitTar(w *Writer, r *tar.Reader) (kernel []byte, cmdline string, ucod
 	}
 }
 
-// NewWriter creates a writer that will output an initrd stream
+// NewWriter creates a writer that will output a gzip compressed initrd stream
 func NewWriter(w io.Writer) *Writer {
 	initrd := new(Writer)
 	initrd.pw = pad4.NewWriter(w)
-	initrd.gw = gzip.NewWriter(initrd.pw)
-	initrd.cw = cpio.NewWriter(initrd.gw)
+	initrd.zw = gzip.NewWriter(initrd.pw)
+	initrd.cw = cpio.NewWriter(initrd.zw)
 
 	return initrd
 }
 
+// NewCompressedWriter creates a writer that will output an initrd stream
+// compressed with c. The level is only used for zstd, where it must be
+// between 1 and MaxZstdLevel.
+func NewCompressedWriter(w io.Writer, c Compression, level int) (*Writer, error) {
+	switch c {
+	case Gzip:
+		return NewWriter(w), nil
+	case Zstd:
+		initrd := new(Writer)
+		initrd.pw = pad4.NewWriter(w)
+		zw, err := newZstdWriter(initrd.pw, level)
+		if err != nil {
+			return nil, err
+		}
+		initrd.zw = zw
+		initrd.cw = cpio.NewWriter(initrd.zw)
+		return initrd, nil
+	}
+	return nil, fmt.Errorf("unknown initrd compression %q", c)
+}
+
+// zstdWriter streams its input through the zstd executable, there being
+// no zstd encoder in the standard library
+type zstdWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+}
+
+func newZstdWriter(w io.Writer, level int) (*zstdWriter, error) {
+	if level < 1 || level > MaxZstdLevel {
+		return nil, fmt.Errorf("zstd compression level must be between 1 and %d, not %d", MaxZstdLevel, level)
+	}
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("zstd executable not found in PATH, it is needed to compress the initrd with zstd")
+	}
+
+	z := &zstdWriter{}
+	z.cmd = exec.Command(path, "-q", "-c", "-T0", "-"+strconv.Itoa(level))
+	z.cmd.Stdout = w
+	z.cmd.Stderr = &z.stderr
+	if z.stdin, err = z.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := z.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *zstdWriter) Write(b []byte) (int, error) {
+	return z.stdin.Write(b)
+}
+
+// Close flushes the compressed stream and waits for zstd to exit
+func (z *zstdWriter) Close() error {
+	err := z.stdin.Close()
+	if werr := z.cmd.Wait(); werr != nil {
+		return fmt.Errorf("zstd failed: %v: %s", werr, strings.TrimSpace(z.stderr.String()))
+	}
+	return err
+}
+
 // WriteHeader writes a cpio header into an initrd
 func (w *Writer) WriteHeader(hdr *cpio.Header) error {
 	return w.cw.WriteHeader(hdr)
@@ -174,7 +258,7 @@ func (w *Writer) Write(b []byte) (n int, e error) {
 // Close closes the writer
 func (w *Writer) Close() error {
 	err1 := w.cw.Close()
-	err2 := w.gw.Close()
+	err2 := w.zw.Close()
 	err3 := w.pw.Close()
 	if err1 != nil {
 		return err1
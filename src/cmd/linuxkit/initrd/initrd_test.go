@@ -0,0 +1,87 @@
+package initrd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/surma/gocpio"
+)
+
+func testTar(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, f := range []struct{ name, content string }{
+		{"boot/kernel", "kernel"},
+		{"boot/cmdline", "console=ttyS0"},
+		{"etc/hostname", "linuxkit\n"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// checkInitrd checks the decompressed cpio archive holds only the non-boot files
+func checkInitrd(t *testing.T, r io.Reader) {
+	cr := cpio.NewReader(r)
+	hdr, err := cr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "etc/hostname", hdr.Name)
+	b, err := ioutil.ReadAll(cr)
+	require.NoError(t, err)
+	assert.Equal(t, "linuxkit\n", string(b))
+	hdr, err = cr.Next()
+	require.NoError(t, err)
+	assert.True(t, hdr.IsTrailer())
+}
+
+func writeInitrd(t *testing.T, c Compression, level int) []byte {
+	buf := new(bytes.Buffer)
+	w, err := NewCompressedWriter(buf, c, level)
+	require.NoError(t, err)
+	kernel, cmdline, _, err := CopySplitTar(w, tar.NewReader(bytes.NewReader(testTar(t))))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "kernel", string(kernel))
+	assert.Equal(t, "console=ttyS0", cmdline)
+	return buf.Bytes()
+}
+
+func TestGzipInitrd(t *testing.T) {
+	zr, err := gzip.NewReader(bytes.NewReader(writeInitrd(t, Gzip, 0)))
+	require.NoError(t, err)
+	checkInitrd(t, zr)
+}
+
+func TestZstdInitrd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd executable not found")
+	}
+
+	b := writeInitrd(t, Zstd, DefaultZstdLevel)
+	assert.Equal(t, []byte{0x28, 0xb5, 0x2f, 0xfd}, b[:4], "missing zstd frame magic")
+
+	cmd := exec.Command("zstd", "-d", "-c")
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	checkInitrd(t, bytes.NewReader(out))
+}
+
+func TestCompressedWriterErrors(t *testing.T) {
+	_, err := NewCompressedWriter(ioutil.Discard, Zstd, 0)
+	assert.Error(t, err)
+	_, err = NewCompressedWriter(ioutil.Discard, Zstd, MaxZstdLevel+1)
+	assert.Error(t, err)
+	_, err = NewCompressedWriter(ioutil.Discard, "xz", 0)
+	assert.Error(t, err)
+}
@@ -9,7 +9,6 @@ import (
 	"path/filepath"
 
 	ggcrlog "github.com/google/go-containerregistry/pkg/logs"
-	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -43,14 +42,6 @@ func (f *infoFormatter) Format(entry *log.Entry) ([]byte, error) {
 	return defaultLogFormatter.Format(entry)
 }
 
-func printVersion() {
-	fmt.Printf("%s version %s\n", filepath.Base(os.Args[0]), version.Version)
-	if version.GitCommit != "" {
-		fmt.Printf("commit: %s\n", version.GitCommit)
-	}
-	os.Exit(0)
-}
-
 func readConfig() {
 	cfgPath := filepath.Join(os.Getenv("HOME"), ".moby", "linuxkit", "config.yml")
 	cfgBytes, err := ioutil.ReadFile(cfgPath)
@@ -135,7 +126,7 @@ func main() {
 	case "serve":
 		serve(args[1:])
 	case "version":
-		printVersion()
+		printVersion(args[1:])
 	case "help":
 		flag.Usage()
 	default:
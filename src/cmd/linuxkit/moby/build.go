@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"debug/elf"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"sort"
@@ -108,7 +110,7 @@ func outputImage(image *Image, section string, prefix string, m Moby, idMap map[
 	}
 	path := path.Join("containers", section, prefix+image.Name)
 	readonly := oci.Root.Readonly
-	err = ImageBundle(path, image.ref, config, runtime, iw, pull, readonly, dupMap, cacheDir, dockerCache, m.Architecture)
+	err = ImageBundle(path, image.ref, image.Exclude, config, runtime, iw, pull, readonly, dupMap, cacheDir, dockerCache, m.Architecture)
 	if err != nil {
 		return fmt.Errorf("Failed to extract root filesystem for %s: %v", image.Image, err)
 	}
@@ -126,6 +128,11 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 		return err
 	}
 
+	m, err := withModules(m)
+	if err != nil {
+		return err
+	}
+
 	iw := tar.NewWriter(w)
 
 	// add additions
@@ -153,7 +160,7 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 	if m.Kernel.ref != nil {
 		// get kernel and initrd tarball and ucode cpio archive from container
 		log.Infof("Extract kernel image: %s", m.Kernel.ref)
-		kf := newKernelFilter(iw, m.Kernel.Cmdline, m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode, decompressKernel)
+		kf := newKernelFilter(iw, m.OutputCmdline(tp), m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode, decompressKernel)
 		err := ImageTar(m.Kernel.ref, "", kf, pull, "", cacheDir, dockerCache, m.Architecture)
 		if err != nil {
 			return fmt.Errorf("Failed to extract kernel image and tarball: %v", err)
@@ -205,12 +212,19 @@ func Build(m Moby, w io.Writer, pull bool, tp string, decompressKernel bool, cac
 		}
 	}
 
-	// add files
-	err := filesystem(m, iw, idMap)
+	// add files, and the rootfs config for init
+	if m.Rootfs != nil {
+		m.Files = append(append([]File{}, m.Files...), m.Rootfs.file())
+	}
+	err = filesystem(m, iw, idMap, cacheDir)
 	if err != nil {
 		return fmt.Errorf("failed to add filesystem parts: %v", err)
 	}
 
+	if err := inputTars(iw, m.InputTars); err != nil {
+		return err
+	}
+
 	// add anything additional for this output type
 	if addition != nil {
 		err = addition(iw)
@@ -430,16 +444,57 @@ func tarAppend(iw *tar.Writer, tr *tar.Reader) error {
 	return nil
 }
 
+// bzImagePayloads are the compressions of the vmlinux in a bzImage which
+// are supported, with the tool decompressing those not gzip'ed, as
+// extract-vmlinux does
+var bzImagePayloads = []struct {
+	name  string
+	magic string
+	tool  []string
+}{
+	{"gzip", "\037\213", nil},
+	{"xz", "\3757zXZ\000", []string{"xz", "-dc"}},
+	{"lzma", "\135\000\000", []string{"xz", "--format=lzma", "-dc"}},
+	{"bzip2", "BZh", []string{"bzip2", "-dc"}},
+	{"lz4", "\002!L\030", []string{"lz4", "-dc"}},
+	{"lzo", "\211LZO", []string{"lzop", "-dc"}},
+	{"zstd", "(\265/\375", []string{"zstd", "-dc"}},
+}
+
+// decompressWith decompresses payload with the external tool
+func decompressWith(name string, tool []string, payload []byte) (*bytes.Buffer, error) {
+	path, err := exec.LookPath(tool[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s executable not found in PATH, it is needed to decompress the %s bzImage payload", tool[0], name)
+	}
+	dst := new(bytes.Buffer)
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, tool[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = dst
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s of the bzImage payload failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	log.Debugf("decompressed %d bytes with %s", dst.Len(), tool[0])
+	return dst, nil
+}
+
 // Attempt to decompress a Linux kernel image
 // The kernel image can be a plain gzip'ed image (e.g., the LinuxKit arm64 kernel) or a bzImage (x86)
 // or not compressed at all (e.g., s390x). This function tries to detect the image type and decompress
 // the kernel. If no supported compressed kernel is found it returns an error.
-// For bzImages it performs some sanity checks on the header and currently only supports gzip'ed bzImages.
+// For bzImages it performs some sanity checks on the header, decompresses the payload with one of
+// bzImagePayloads and checks that the result is an ELF vmlinux.
 func decompressKernel(src *bytes.Buffer) (*bytes.Buffer, error) {
 	const gzipMagic = "\037\213"
 
 	s := src.Bytes()
 
+	if bytes.HasPrefix(s, []byte(elf.ELFMAG)) {
+		return nil, fmt.Errorf("The kernel is not compressed, it is already an ELF vmlinux")
+	}
+
 	if bytes.HasPrefix(s, []byte(gzipMagic)) {
 		log.Debugf("Found gzip signature at offset: 0")
 		return gunzip(src)
@@ -481,15 +536,33 @@ func decompressKernel(src *bytes.Buffer) (*bytes.Buffer, error) {
 			return nil, fmt.Errorf("Compressed bzImage payload exceeds size of image")
 		}
 
-		if bytes.HasPrefix(s[payloadOff:], []byte(gzipMagic)) {
-			log.Debugf("bzImage: gzip signature at offset: %d", payloadOff)
-			return gunzip(bytes.NewBuffer(s[payloadOff : payloadOff+payloadLen]))
+		payload := s[payloadOff : payloadOff+payloadLen]
+		for _, f := range bzImagePayloads {
+			if !bytes.HasPrefix(payload, []byte(f.magic)) {
+				continue
+			}
+			log.Debugf("bzImage: %s signature at offset: %d", f.name, payloadOff)
+			var (
+				vmlinux *bytes.Buffer
+				err     error
+			)
+			if f.tool == nil {
+				vmlinux, err = gunzip(bytes.NewBuffer(payload))
+			} else {
+				vmlinux, err = decompressWith(f.name, f.tool, payload)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if _, err := elf.NewFile(bytes.NewReader(vmlinux.Bytes())); err != nil {
+				return nil, fmt.Errorf("The decompressed %s bzImage payload is not an ELF vmlinux: %v", f.name, err)
+			}
+			return vmlinux, nil
 		}
-		// TODO(rn): Add more supported formats
 		return nil, fmt.Errorf("Unsupported bzImage payload format at offset %d", payloadOff)
 	}
 
-	return nil, fmt.Errorf("No compressed kernel or no supported format found")
+	return nil, fmt.Errorf("No compressed kernel or no supported format found, the kernel is neither gzip'ed nor a bzImage")
 }
 
 func gunzip(src *bytes.Buffer) (*bytes.Buffer, error) {
@@ -523,7 +596,7 @@ func metadata(m Moby, md string) ([]byte, error) {
 	}
 }
 
-func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
+func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32, cacheDir string) error {
 	// TODO also include the files added in other parts of the build
 	var addedFiles = map[string]bool{}
 
@@ -539,6 +612,12 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 		if f.Path[0] == '/' {
 			f.Path = f.Path[1:]
 		}
+		if f.Directory && f.Symlink != "" {
+			return fmt.Errorf("Specified Directory and Symlink for file: %s", f.Path)
+		}
+		if f.Symlink != "" && f.Contents != nil {
+			return errors.New("Symlink with contents not allowed")
+		}
 		mode := int64(0600)
 		if f.Directory {
 			mode = 0700
@@ -549,6 +628,9 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if err != nil {
 				return fmt.Errorf("Cannot parse file mode as octal value: %v", err)
 			}
+			if mode < 0 || mode&^07777 != 0 {
+				return fmt.Errorf("File mode %s of %s is not a permission mode, at most 07777", f.Mode, f.Path)
+			}
 		}
 		dirMode := mode
 		if dirMode&0700 != 0 {
@@ -574,14 +656,25 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 		if f.Contents != nil {
 			contents = []byte(*f.Contents)
 		}
+		if f.SHA256 != "" && f.URL == "" {
+			return fmt.Errorf("Specified sha256 without URL for file: %s", f.Path)
+		}
 		if !f.Directory && f.Symlink == "" && f.Contents == nil {
-			if f.Source == "" && f.Metadata == "" {
+			if f.Source == "" && f.Metadata == "" && f.URL == "" {
 				return fmt.Errorf("Contents of file (%s) not specified", f.Path)
 			}
 			if f.Source != "" && f.Metadata != "" {
 				return fmt.Errorf("Specified Source and Metadata for file: %s", f.Path)
 			}
-			if f.Source != "" {
+			if f.URL != "" && (f.Source != "" || f.Metadata != "") {
+				return fmt.Errorf("Specified URL and Source or Metadata for file: %s", f.Path)
+			}
+			if f.URL != "" {
+				contents, err = fetchFile(f.URL, f.SHA256, cacheDir)
+				if err != nil {
+					return fmt.Errorf("Cannot fetch file %s: %v", f.Path, err)
+				}
+			} else if f.Source != "" {
 				source := f.Source
 				if len(source) > 2 && source[:2] == "~/" {
 					source = util.HomeDir() + source[1:]
@@ -612,6 +705,9 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			if f.Source != "" {
 				return fmt.Errorf("Specified Contents and Source for file: %s", f.Path)
 			}
+			if f.URL != "" {
+				return fmt.Errorf("Specified Contents and URL for file: %s", f.Path)
+			}
 		}
 		// we need all the leading directories
 		parts := strings.Split(path.Dir(f.Path), "/")
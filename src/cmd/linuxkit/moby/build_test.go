@@ -0,0 +1,115 @@
+package moby
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/binary"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testVmlinux is a minimal x86_64 ELF executable
+func testVmlinux(t *testing.T) []byte {
+	var b bytes.Buffer
+	h := elf.Header64{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(elf.EM_X86_64),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(h.Ident[:], elf.ELFMAG)
+	h.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	require.NoError(t, binary.Write(&b, binary.LittleEndian, h))
+	b.Write(bytes.Repeat([]byte("vmlinux"), 64))
+	return b.Bytes()
+}
+
+// testBzImage is a bzImage with payload, after one setup sector
+func testBzImage(payload []byte) []byte {
+	const setupSectors = 1
+	s := make([]byte, (setupSectors+1)*512)
+	s[0x1f1] = setupSectors
+	binary.LittleEndian.PutUint16(s[0x1fe:], 0xaa55)
+	copy(s[0x202:], "HdrS")
+	s[0x206], s[0x207] = 2, 8
+	binary.LittleEndian.PutUint32(s[0x248:], 0)
+	binary.LittleEndian.PutUint32(s[0x24c:], uint32(len(payload)))
+	return append(s, payload...)
+}
+
+func gzipped(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// compressedWith compresses b with the external tool, skipping the test
+// if it is not installed
+func compressedWith(t *testing.T, b []byte, tool ...string) []byte {
+	if _, err := exec.LookPath(tool[0]); err != nil {
+		t.Skipf("%s is not available", tool[0])
+	}
+	cmd := exec.Command(tool[0], tool[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return out
+}
+
+func TestDecompressKernelBzImage(t *testing.T) {
+	vmlinux := testVmlinux(t)
+	for _, tc := range []struct {
+		name    string
+		payload func() []byte
+	}{
+		{"gzip", func() []byte { return gzipped(t, vmlinux) }},
+		{"xz", func() []byte { return compressedWith(t, vmlinux, "xz", "-c", "--check=crc32") }},
+		{"zstd", func() []byte { return compressedWith(t, vmlinux, "zstd", "-c", "-q") }},
+		{"bzip2", func() []byte { return compressedWith(t, vmlinux, "bzip2", "-c") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := decompressKernel(bytes.NewBuffer(testBzImage(tc.payload())))
+			require.NoError(t, err)
+			f, err := elf.NewFile(bytes.NewReader(out.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, elf.EM_X86_64, f.Machine)
+			assert.Equal(t, vmlinux, out.Bytes())
+		})
+	}
+}
+
+func TestDecompressKernelGzip(t *testing.T) {
+	// the arm64 kernel is a gzip'ed Image, which is not an ELF
+	image := bytes.Repeat([]byte("Image"), 100)
+	out, err := decompressKernel(bytes.NewBuffer(gzipped(t, image)))
+	require.NoError(t, err)
+	assert.Equal(t, image, out.Bytes())
+}
+
+func TestDecompressKernelErrors(t *testing.T) {
+	_, err := decompressKernel(bytes.NewBuffer(testVmlinux(t)))
+	assert.EqualError(t, err, "The kernel is not compressed, it is already an ELF vmlinux")
+
+	_, err = decompressKernel(bytes.NewBufferString("not a kernel"))
+	assert.EqualError(t, err, "No compressed kernel or no supported format found, the kernel is neither gzip'ed nor a bzImage")
+
+	_, err = decompressKernel(bytes.NewBuffer(testBzImage(gzipped(t, []byte("not an ELF")))))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "The decompressed gzip bzImage payload is not an ELF vmlinux")
+
+	_, err = decompressKernel(bytes.NewBuffer(testBzImage([]byte("unknown compression"))))
+	assert.EqualError(t, err, "Unsupported bzImage payload format at offset 1024")
+
+	bz := testBzImage(gzipped(t, testVmlinux(t)))
+	_, err = decompressKernel(bytes.NewBuffer(bz[:len(bz)-10]))
+	assert.EqualError(t, err, "Compressed bzImage payload exceeds size of image")
+}
@@ -2,6 +2,7 @@ package moby
 
 import (
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,13 +18,19 @@ import (
 
 // Moby is the type of a Moby config file
 type Moby struct {
-	Kernel       KernelConfig `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
-	Init         []string     `init:"cmdline" json:"init"`
-	Onboot       []*Image     `yaml:"onboot" json:"onboot"`
-	Onshutdown   []*Image     `yaml:"onshutdown" json:"onshutdown"`
-	Services     []*Image     `yaml:"services" json:"services"`
-	Files        []File       `yaml:"files" json:"files"`
+	Include      []string                `yaml:"include,omitempty" json:"include,omitempty"`
+	Kernel       KernelConfig            `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
+	Init         []string                `init:"cmdline" json:"init"`
+	Onboot       []*Image                `yaml:"onboot" json:"onboot"`
+	Onshutdown   []*Image                `yaml:"onshutdown" json:"onshutdown"`
+	Services     []*Image                `yaml:"services" json:"services"`
+	Files        []File                  `yaml:"files" json:"files"`
+	Outputs      map[string]OutputConfig `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+	Rootfs       *RootfsConfig           `yaml:"rootfs,omitempty" json:"rootfs,omitempty"`
 	Architecture string
+	// InputTars are tarballs extracted over the rootfs after everything
+	// else, later ones over earlier ones
+	InputTars []string `yaml:"-" json:"-"`
 
 	initRefs []*reference.Spec
 }
@@ -35,17 +42,123 @@ type KernelConfig struct {
 	Binary  string  `yaml:"binary,omitempty" json:"binary,omitempty"`
 	Tar     *string `yaml:"tar,omitempty" json:"tar,omitempty"`
 	UCode   *string `yaml:"ucode,omitempty" json:"ucode,omitempty"`
+	// Modules are loaded by an onboot container before the others
+	Modules []KernelModule `yaml:"modules,omitempty" json:"modules,omitempty"`
 
 	ref *reference.Spec
 }
 
+// KernelModule is the type of a kernel module to load at boot
+type KernelModule struct {
+	Name       string   `yaml:"name" json:"name"`
+	Parameters []string `yaml:"parameters,omitempty" json:"parameters,omitempty"`
+	// Required makes the onboot container fail if the module cannot be
+	// loaded, rather than warn
+	Required bool `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// OutputConfig is the type of the config for an output format
+type OutputConfig struct {
+	// Cmdline replaces the kernel cmdline, and CmdlineAdd is appended to it
+	Cmdline    string `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+	CmdlineAdd string `yaml:"cmdline.add,omitempty" json:"cmdline.add,omitempty"`
+	// Partitions is the layout of the disk of a raw-efi or gcp output
+	Partitions []Partition `yaml:"partitions,omitempty" json:"partitions,omitempty"`
+	// ESP is the EFI system partition linuxkit makes for a raw-efi output,
+	// instead of the grub one of the output tool
+	ESP *ESPConfig `yaml:"esp,omitempty" json:"esp,omitempty"`
+}
+
+// ESPConfig is an EFI system partition with the kernel and initrd, booted by
+// the systemd-boot or stub Bootloader. Title is the title of the boot entry,
+// and Files are added to the partition, replacing those linuxkit writes.
+type ESPConfig struct {
+	Bootloader string    `yaml:"bootloader" json:"bootloader"`
+	Title      string    `yaml:"title,omitempty" json:"title,omitempty"`
+	Files      []ESPFile `yaml:"files,omitempty" json:"files,omitempty"`
+}
+
+// ESPFile is a file of an EFI system partition, with its contents or the
+// file on the host to copy
+type ESPFile struct {
+	Path     string  `yaml:"path" json:"path"`
+	Contents *string `yaml:"contents,omitempty" json:"contents,omitempty" interpolate:"-"`
+	Source   string  `yaml:"source,omitempty" json:"source,omitempty"`
+}
+
+// Partition is a GPT partition of the disk of an output. Size is in M or G,
+// and may only be left out for the last partition, which then fills the disk.
+// The Boot partition holds the kernel and initrd.
+type Partition struct {
+	Label      string `yaml:"label,omitempty" json:"label,omitempty"`
+	Size       string `yaml:"size,omitempty" json:"size,omitempty"`
+	Filesystem string `yaml:"filesystem,omitempty" json:"filesystem,omitempty"`
+	Boot       bool   `yaml:"boot,omitempty" json:"boot,omitempty"`
+}
+
+// OutputCmdline is the kernel cmdline of the output format: the cmdline of
+// the kernel, unless the output replaces it, with what the output adds
+// appended
+func (m Moby) OutputCmdline(format string) string {
+	cmdline := m.Kernel.Cmdline
+	o, ok := m.Outputs[format]
+	if !ok {
+		return cmdline
+	}
+	if o.Cmdline != "" {
+		cmdline = o.Cmdline
+	}
+	if o.CmdlineAdd != "" {
+		cmdline = strings.TrimSpace(cmdline + " " + o.CmdlineAdd)
+	}
+	return cmdline
+}
+
+// RootfsConfig is the type of the config for the root filesystem
+type RootfsConfig struct {
+	// Type is overlay, for a writable overlay on the root filesystem
+	Type string `yaml:"type" json:"type"`
+	// Upper is where the writes to the overlay go, tmpfs or a disk device
+	Upper string `yaml:"upper,omitempty" json:"upper,omitempty"`
+}
+
+const (
+	rootfsOverlay    = "overlay"
+	rootfsUpperTmpfs = "tmpfs"
+	// rootfsPath is where init reads the rootfs config from
+	rootfsPath = "etc/linuxkit/rootfs"
+)
+
+func (r RootfsConfig) validate() error {
+	if r.Type != rootfsOverlay {
+		return fmt.Errorf("Unknown rootfs type %q, must be %s", r.Type, rootfsOverlay)
+	}
+	if r.Upper != "" && r.Upper != rootfsUpperTmpfs && !strings.HasPrefix(r.Upper, "/dev/") {
+		return fmt.Errorf("Invalid rootfs upper %q, must be %s or a disk device in /dev", r.Upper, rootfsUpperTmpfs)
+	}
+	return nil
+}
+
+// file is the file of the config that init reads, with a key=value line
+// for each field
+func (r RootfsConfig) file() File {
+	upper := r.Upper
+	if upper == "" {
+		upper = rootfsUpperTmpfs
+	}
+	contents := fmt.Sprintf("type=%s\nupper=%s\n", r.Type, upper)
+	return File{Path: rootfsPath, Contents: &contents, Mode: "0644"}
+}
+
 // File is the type of a file specification
 type File struct {
 	Path      string      `yaml:"path" json:"path"`
 	Directory bool        `yaml:"directory" json:"directory"`
 	Symlink   string      `yaml:"symlink,omitempty" json:"symlink,omitempty"`
-	Contents  *string     `yaml:"contents,omitempty" json:"contents,omitempty"`
+	Contents  *string     `yaml:"contents,omitempty" json:"contents,omitempty" interpolate:"-"`
 	Source    string      `yaml:"source,omitempty" json:"source,omitempty"`
+	URL       string      `yaml:"url,omitempty" json:"url,omitempty"`
+	SHA256    string      `yaml:"sha256,omitempty" json:"sha256,omitempty"`
 	Metadata  string      `yaml:"metadata,omitempty" json:"metadata,omitempty"`
 	Optional  bool        `yaml:"optional" json:"optional"`
 	Mode      string      `yaml:"mode,omitempty" json:"mode,omitempty"`
@@ -55,8 +168,9 @@ type File struct {
 
 // Image is the type of an image config
 type Image struct {
-	Name        string `yaml:"name" json:"name"`
-	Image       string `yaml:"image" json:"image"`
+	Name        string   `yaml:"name" json:"name"`
+	Image       string   `yaml:"image" json:"image"`
+	Exclude     []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
 	ImageConfig `yaml:",inline"`
 }
 
@@ -71,7 +185,7 @@ type ImageConfig struct {
 	Binds             *[]string               `yaml:"binds,omitempty" json:"binds,omitempty"`
 	BindsAdd          *[]string               `yaml:"binds.add,omitempty" json:"binds.add,omitempty"`
 	Tmpfs             *[]string               `yaml:"tmpfs,omitempty" json:"tmpfs,omitempty"`
-	Command           *[]string               `yaml:"command,omitempty" json:"command,omitempty"`
+	Command           *[]string               `yaml:"command,omitempty" json:"command,omitempty" interpolate:"-"`
 	Env               *[]string               `yaml:"env,omitempty" json:"env,omitempty"`
 	Cwd               string                  `yaml:"cwd,omitempty" json:"cwd,omitempty"`
 	Net               string                  `yaml:"net,omitempty" json:"net,omitempty"`
@@ -227,7 +341,43 @@ func updateImages(m *Moby) {
 	}
 }
 
-// NewConfig parses a config file
+// imageRefs are the references of the kernel, init and container images
+// of m, updateImages updating m with changes to them
+func imageRefs(m *Moby) []*reference.Spec {
+	var refs []*reference.Spec
+	if m.Kernel.ref != nil {
+		refs = append(refs, m.Kernel.ref)
+	}
+	refs = append(refs, m.initRefs...)
+	for _, section := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range section {
+			if image.ref != nil {
+				refs = append(refs, image.ref)
+			}
+		}
+	}
+	return refs
+}
+
+// PrefixImages renames every image of m to its name under the namespace
+// prefix of a registry mirroring them, as util.PrefixReference does
+func PrefixImages(m *Moby, prefix string) error {
+	if err := util.ValidateRegistryPrefix(prefix); err != nil {
+		return err
+	}
+	for _, ref := range imageRefs(m) {
+		prefixed, err := reference.Parse(util.PrefixReference(ref.String(), prefix))
+		if err != nil {
+			return fmt.Errorf("Invalid image name with registry prefix %s: %v", prefix, err)
+		}
+		*ref = prefixed
+	}
+	updateImages(m)
+	return nil
+}
+
+// NewConfig parses a config file, replacing the variables in its strings
+// with their values from the environment
 func NewConfig(config []byte) (Moby, error) {
 	m := Moby{}
 
@@ -262,10 +412,38 @@ func NewConfig(config []byte) (Moby, error) {
 		return m, err
 	}
 
+	if err := interpolateConfig(&m); err != nil {
+		return m, err
+	}
+
 	if err := uniqueServices(m); err != nil {
 		return m, err
 	}
 
+	if m.Rootfs != nil {
+		if err := m.Rootfs.validate(); err != nil {
+			return m, err
+		}
+	}
+
+	if err := validateModules(m.Kernel.Modules); err != nil {
+		return m, err
+	}
+
+	for format := range m.Outputs {
+		if !Streamable(format) && outFuns[format] == nil {
+			return m, fmt.Errorf("Unknown format type %s in outputs", format)
+		}
+	}
+	for format, o := range m.Outputs {
+		if err := validatePartitions(format, o.Partitions); err != nil {
+			return m, err
+		}
+		if err := validateESP(format, o.ESP); err != nil {
+			return m, err
+		}
+	}
+
 	if err := extractReferences(&m); err != nil {
 		return m, err
 	}
@@ -294,11 +472,38 @@ func AppendConfig(m0, m1 Moby) (Moby, error) {
 	if m1.Kernel.ref != nil {
 		moby.Kernel.ref = m1.Kernel.ref
 	}
+	moby.Kernel.Modules = append(append([]KernelModule{}, m0.Kernel.Modules...), m1.Kernel.Modules...)
 	moby.Init = append(moby.Init, m1.Init...)
 	moby.Onboot = append(moby.Onboot, m1.Onboot...)
 	moby.Onshutdown = append(moby.Onshutdown, m1.Onshutdown...)
 	moby.Services = append(moby.Services, m1.Services...)
 	moby.Files = append(moby.Files, m1.Files...)
+	if m1.Rootfs != nil {
+		moby.Rootfs = m1.Rootfs
+	}
+	if len(m1.Outputs) != 0 {
+		outputs := map[string]OutputConfig{}
+		for format, o := range m0.Outputs {
+			outputs[format] = o
+		}
+		for format, o1 := range m1.Outputs {
+			o := outputs[format]
+			if o1.Cmdline != "" {
+				o.Cmdline = o1.Cmdline
+			}
+			if o1.CmdlineAdd != "" {
+				o.CmdlineAdd = o1.CmdlineAdd
+			}
+			if len(o1.Partitions) != 0 {
+				o.Partitions = o1.Partitions
+			}
+			if o1.ESP != nil {
+				o.ESP = o1.ESP
+			}
+			outputs[format] = o
+		}
+		moby.Outputs = outputs
+	}
 	moby.initRefs = append(moby.initRefs, m1.initRefs...)
 	moby.Architecture = m1.Architecture
 
@@ -675,11 +880,17 @@ func idNumeric(v interface{}, idMap map[string]uint32) (uint32, error) {
 	case nil:
 		return uint32(0), nil
 	case int:
+		if id < 0 || int64(id) > math.MaxUint32 {
+			return 0, fmt.Errorf("Bad uid or gid: %d", id)
+		}
 		return uint32(id), nil
 	case string:
 		if id == "" || id == "root" {
 			return uint32(0), nil
 		}
+		if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+			return uint32(n), nil
+		}
 		for k, v := range idMap {
 			if id == k {
 				return v, nil
@@ -107,3 +107,76 @@ func TestIdMap(t *testing.T) {
 		t.Error("Expected numerical gid to work")
 	}
 }
+
+func TestRootfs(t *testing.T) {
+	for _, c := range []struct {
+		config, file string
+	}{
+		{"rootfs:\n  type: overlay\n", "type=overlay\nupper=tmpfs\n"},
+		{"rootfs:\n  type: overlay\n  upper: tmpfs\n", "type=overlay\nupper=tmpfs\n"},
+		{"rootfs:\n  type: overlay\n  upper: /dev/sda\n", "type=overlay\nupper=/dev/sda\n"},
+	} {
+		m, err := NewConfig([]byte(c.config))
+		if err != nil {
+			t.Fatalf("%q: %v", c.config, err)
+		}
+		f := m.Rootfs.file()
+		if f.Path != rootfsPath || f.Mode != "0644" || *f.Contents != c.file {
+			t.Errorf("%q: rootfs file is %s, %s, %q", c.config, f.Path, f.Mode, *f.Contents)
+		}
+	}
+
+	for _, config := range []string{
+		"rootfs:\n  type: overlayfs\n",
+		"rootfs:\n  type: overlay\n  upper: sda\n",
+		"rootfs:\n  type: overlay\n  lower: tmpfs\n",
+	} {
+		if _, err := NewConfig([]byte(config)); err == nil {
+			t.Errorf("%q: no error", config)
+		}
+	}
+}
+
+func TestPrefixImages(t *testing.T) {
+	const digest = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	m, err := NewConfig([]byte(`kernel:
+  image: linuxkit/kernel:5.10
+init:
+  - linuxkit/init:v0.8
+  - alpine:3.18
+onboot:
+  - name: sysctl
+    image: docker.io/linuxkit/sysctl:v0.8@` + digest + `
+onshutdown:
+  - name: down
+    image: quay.io/org/down:v1
+services:
+  - name: local
+    image: localhost:5000/local/svc:v2
+  - name: mirrored
+    image: registry.example.com/mirror/linuxkit/getty:v0.8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PrefixImages(&m, "registry.example.com/mirror/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ image, want string }{
+		{m.Kernel.Image, "registry.example.com/mirror/linuxkit/kernel:5.10"},
+		{m.Init[0], "registry.example.com/mirror/linuxkit/init:v0.8"},
+		{m.Init[1], "registry.example.com/mirror/library/alpine:3.18"},
+		{m.Onboot[0].Image, "registry.example.com/mirror/linuxkit/sysctl:v0.8@" + digest},
+		{m.Onshutdown[0].Image, "registry.example.com/mirror/quay.io/org/down:v1"},
+		{m.Services[0].Image, "registry.example.com/mirror/localhost:5000/local/svc:v2"},
+		{m.Services[1].Image, "registry.example.com/mirror/linuxkit/getty:v0.8"},
+	} {
+		if c.image != c.want {
+			t.Errorf("image is %s, not %s", c.image, c.want)
+		}
+	}
+
+	if err := PrefixImages(&m, "mirror"); err == nil {
+		t.Error("no error for a prefix without a registry")
+	}
+}
@@ -0,0 +1,793 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sectorSize = 512
+	// a GPT has 128 entries of 128 bytes after its header, at the start
+	// and at the end of the disk
+	gptEntries    = 128
+	gptEntrySize  = 128
+	gptSectors    = 1 + gptEntries*gptEntrySize/sectorSize
+	gptLabelChars = 36
+	// partitions start on 1M boundaries, as some firmwares expect
+	partitionAlign = 2048
+
+	espType       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	linuxDataType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	// legacyBootable is the GPT attribute for a partition BIOSes boot
+	legacyBootable = 1 << 2
+
+	// defaultDiskSizeMB is the size of the disk outputs with a fixed size
+	// when there is no -size
+	defaultDiskSizeMB = 1024
+)
+
+// bootPartition is the boot partition of an output whose disk may be laid
+// out with partitions: the output tool makes it as the first partition of
+// its disk, and it is copied to the boot partition of the layout
+type bootPartition struct {
+	typ        string
+	filesystem string
+	label      string
+	// hybrid is set when the partition is booted by the MBR boot code, so
+	// it is also in the MBR
+	hybrid bool
+}
+
+var partitionedOutputs = map[string]bootPartition{
+	"raw-efi": {typ: espType, filesystem: "vfat", label: "EFI System"},
+	"gcp":     {typ: linuxDataType, filesystem: "ext4", hybrid: true},
+}
+
+// mkfsCommands are the commands making the filesystems of the partitions
+// other than the boot partition, with their label flag
+var mkfsCommands = map[string]struct {
+	cmd   string
+	label string
+	args  []string
+}{
+	"ext4": {"mkfs.ext4", "-L", []string{"-F", "-q"}},
+	"vfat": {"mkfs.vfat", "-n", nil},
+	"xfs":  {"mkfs.xfs", "-L", []string{"-f", "-q"}},
+}
+
+// diskPartition is a partition of a disk image, in sectors. Type is a GPT
+// partition type GUID, or the type of an MBR partition such as 0x83.
+type diskPartition struct {
+	Type       string
+	GUID       string
+	Name       string
+	First      int64
+	Last       int64
+	Attributes uint64
+}
+
+func (d diskPartition) sectors() int64 {
+	return d.Last - d.First + 1
+}
+
+// partitionSize is the size in bytes of a partition size such as 512M or 2G
+func partitionSize(s string) (int64, error) {
+	unit := int64(1 << 20)
+	switch {
+	case strings.HasSuffix(s, "M"):
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	default:
+		return 0, errors.New("it must be in M or G, such as 512M")
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("it must be a positive number of M or G")
+	}
+	return n * unit, nil
+}
+
+// validatePartitions checks the partitions of the disk of an output, which
+// must support them
+func validatePartitions(format string, parts []Partition) error {
+	if len(parts) == 0 {
+		return nil
+	}
+	boot, ok := partitionedOutputs[format]
+	if !ok {
+		return fmt.Errorf("Output %s does not support partitions, only raw-efi and gcp do", format)
+	}
+	boots := 0
+	for i, p := range parts {
+		if p.Boot {
+			boots++
+			if p.Filesystem != "" && p.Filesystem != boot.filesystem {
+				return fmt.Errorf("The boot partition of %s must have a %s filesystem, not %s", format, boot.filesystem, p.Filesystem)
+			}
+		} else if _, ok := mkfsCommands[p.Filesystem]; p.Filesystem != "" && !ok {
+			return fmt.Errorf("Unknown filesystem %s for partition %d of %s, it must be ext4, vfat or xfs", p.Filesystem, i+1, format)
+		}
+		if p.Size == "" {
+			if i != len(parts)-1 {
+				return fmt.Errorf("Partition %d of %s has no size, only the last partition may leave it out", i+1, format)
+			}
+		} else if _, err := partitionSize(p.Size); err != nil {
+			return fmt.Errorf("Invalid size %s for partition %d of %s: %v", p.Size, i+1, format, err)
+		}
+		if len(utf16.Encode([]rune(p.Label))) > gptLabelChars {
+			return fmt.Errorf("The label of partition %d of %s is longer than %d characters", i+1, format, gptLabelChars)
+		}
+	}
+	if boots != 1 {
+		return fmt.Errorf("Exactly one partition of %s must be the boot partition, not %d", format, boots)
+	}
+	return nil
+}
+
+func alignPartition(sector int64) int64 {
+	return (sector + partitionAlign - 1) / partitionAlign * partitionAlign
+}
+
+// layoutPartitions places the partitions of an output on a disk of sizeMB,
+// or defaultDiskSizeMB if it is 0, returning them and the number of sectors of the disk
+func layoutPartitions(format string, parts []Partition, sizeMB int) ([]diskPartition, int64, error) {
+	if err := validatePartitions(format, parts); err != nil {
+		return nil, 0, err
+	}
+	boot := partitionedOutputs[format]
+	if sizeMB == 0 {
+		sizeMB = defaultDiskSizeMB
+	}
+	total := int64(sizeMB) << 20 / sectorSize
+	sizes := make([]int64, len(parts))
+	need := int64(partitionAlign)
+	for i, p := range parts {
+		sizes[i] = 1 << 20 / sectorSize
+		if p.Size != "" {
+			b, _ := partitionSize(p.Size)
+			sizes[i] = b / sectorSize
+		}
+		need = alignPartition(need + sizes[i])
+	}
+	if need += gptSectors; need > total {
+		return nil, 0, fmt.Errorf("The partitions of %s need %dM but the disk is %dM, use a larger -size", format, (need*sectorSize+1<<20-1)>>20, sizeMB)
+	}
+
+	lastUsable := total - gptSectors - 1
+	disk := make([]diskPartition, len(parts))
+	start := int64(partitionAlign)
+	for i, p := range parts {
+		d := diskPartition{Type: linuxDataType, Name: p.Label, First: start, Last: start + sizes[i] - 1}
+		if p.Size == "" {
+			d.Last = lastUsable
+		}
+		if p.Boot {
+			d.Type = boot.typ
+			d.Attributes = legacyBootable
+			if d.Name == "" {
+				d.Name = boot.label
+			}
+		}
+		disk[i] = d
+		start = alignPartition(d.Last + 1)
+	}
+	return disk, total, nil
+}
+
+// parseGUID is the on disk form of a GUID, whose first three fields are
+// little endian
+func parseGUID(s string) ([16]byte, error) {
+	var g [16]byte
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return g, fmt.Errorf("Invalid GUID %s", s)
+	}
+	copy(g[:], b)
+	g[0], g[1], g[2], g[3] = g[3], g[2], g[1], g[0]
+	g[4], g[5] = g[5], g[4]
+	g[6], g[7] = g[7], g[6]
+	return g, nil
+}
+
+func formatGUID(g [16]byte) string {
+	g[0], g[1], g[2], g[3] = g[3], g[2], g[1], g[0]
+	g[4], g[5] = g[5], g[4]
+	g[6], g[7] = g[7], g[6]
+	return fmt.Sprintf("%X-%X-%X-%X-%X", g[0:4], g[4:6], g[6:8], g[8:10], g[10:])
+}
+
+// randomGUID is a random version 4 GUID
+func randomGUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// mbrEntry fills the MBR partition entry e, addressed by LBA only
+func mbrEntry(e []byte, active bool, typ byte, first, sectors int64) {
+	if active {
+		e[0] = 0x80
+	}
+	copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+	if first == 1 {
+		copy(e[1:4], []byte{0x00, 0x02, 0x00})
+	}
+	e[4] = typ
+	copy(e[5:8], []byte{0xff, 0xff, 0xff})
+	if sectors > 0xffffffff {
+		sectors = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(e[8:], uint32(first))
+	binary.LittleEndian.PutUint32(e[12:], uint32(sectors))
+}
+
+// writeGPT writes the GPT of a disk of total sectors with parts, and its
+// protective MBR with bootCode. With hybrid, the MBR also has the partition
+// hybrid, as the active partition for the boot code to boot.
+func writeGPT(w io.WriterAt, total int64, parts []diskPartition, bootCode []byte, hybrid *diskPartition) error {
+	if len(parts) > gptEntries {
+		return fmt.Errorf("A GPT has at most %d partitions", gptEntries)
+	}
+	mbr := make([]byte, sectorSize)
+	copy(mbr[:440], bootCode)
+	if hybrid != nil {
+		mbrEntry(mbr[446:], false, 0xee, 1, hybrid.First-1)
+		mbrEntry(mbr[462:], true, 0x83, hybrid.First, hybrid.sectors())
+	} else {
+		mbrEntry(mbr[446:], false, 0xee, 1, total-1)
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := w.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range parts {
+		e := entries[i*gptEntrySize:]
+		typ, err := parseGUID(p.Type)
+		if err != nil {
+			return err
+		}
+		if p.GUID == "" {
+			if p.GUID, err = randomGUID(); err != nil {
+				return err
+			}
+		}
+		guid, err := parseGUID(p.GUID)
+		if err != nil {
+			return err
+		}
+		copy(e[0:], typ[:])
+		copy(e[16:], guid[:])
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.First))
+		binary.LittleEndian.PutUint64(e[40:], uint64(p.Last))
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for j, c := range utf16.Encode([]rune(p.Name)) {
+			if j == gptLabelChars {
+				break
+			}
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+
+	diskGUID, err := randomGUID()
+	if err != nil {
+		return err
+	}
+	g, _ := parseGUID(diskGUID)
+	header := func(current, backup, entriesLBA int64) []byte {
+		h := make([]byte, sectorSize)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(current))
+		binary.LittleEndian.PutUint64(h[32:], uint64(backup))
+		binary.LittleEndian.PutUint64(h[40:], 2+gptSectors-1)
+		binary.LittleEndian.PutUint64(h[48:], uint64(total-gptSectors-1))
+		copy(h[56:], g[:])
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+	for _, s := range []struct {
+		lba int64
+		b   []byte
+	}{
+		{1, header(1, total-1, 2)},
+		{2, entries},
+		{total - gptSectors, entries},
+		{total - 1, header(total-1, 1, total-gptSectors)},
+	} {
+		if _, err := w.WriteAt(s.b, s.lba*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPartitions reads the partitions of the GPT of a disk, or of its MBR
+// if it has no GPT. The partitions of a hybrid MBR are those of the GPT.
+func readPartitions(r io.ReaderAt) ([]diskPartition, error) {
+	mbr := make([]byte, sectorSize)
+	if _, err := r.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("Cannot read the MBR: %v", err)
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, errors.New("The disk has no partition table")
+	}
+	var parts []diskPartition
+	gpt := false
+	for i := 0; i < 4; i++ {
+		e := mbr[446+16*i : 446+16*(i+1)]
+		switch e[4] {
+		case 0:
+		case 0xee:
+			gpt = true
+		default:
+			first := int64(binary.LittleEndian.Uint32(e[8:]))
+			p := diskPartition{Type: fmt.Sprintf("0x%02x", e[4]), First: first, Last: first + int64(binary.LittleEndian.Uint32(e[12:])) - 1}
+			if e[0] == 0x80 {
+				p.Attributes = legacyBootable
+			}
+			parts = append(parts, p)
+		}
+	}
+	if !gpt {
+		return parts, nil
+	}
+	parts = nil
+
+	h := make([]byte, sectorSize)
+	if _, err := r.ReadAt(h, sectorSize); err != nil {
+		return nil, fmt.Errorf("Cannot read the GPT header: %v", err)
+	}
+	size := binary.LittleEndian.Uint32(h[12:])
+	if string(h[:8]) != "EFI PART" || size < 92 || size > sectorSize {
+		return nil, errors.New("The disk has a protective MBR but no GPT")
+	}
+	crc := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	if crc32.ChecksumIEEE(h[:size]) != crc {
+		return nil, errors.New("The GPT header does not match its checksum")
+	}
+	n := int64(binary.LittleEndian.Uint32(h[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(h[84:]))
+	if entrySize < gptEntrySize || n > 1024 {
+		return nil, fmt.Errorf("The GPT has an invalid number of entries %d or entry size %d", n, entrySize)
+	}
+	entries := make([]byte, n*entrySize)
+	if _, err := r.ReadAt(entries, int64(binary.LittleEndian.Uint64(h[72:]))*sectorSize); err != nil {
+		return nil, fmt.Errorf("Cannot read the GPT entries: %v", err)
+	}
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:]) {
+		return nil, errors.New("The GPT entries do not match their checksum")
+	}
+	for i := int64(0); i < n; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		var typ, guid [16]byte
+		copy(typ[:], e[0:16])
+		copy(guid[:], e[16:32])
+		if typ == ([16]byte{}) {
+			continue
+		}
+		var name []uint16
+		for j := 56; j+1 < 56+2*gptLabelChars; j += 2 {
+			c := binary.LittleEndian.Uint16(e[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		parts = append(parts, diskPartition{
+			Type:       formatGUID(typ),
+			GUID:       formatGUID(guid),
+			Name:       string(utf16.Decode(name)),
+			First:      int64(binary.LittleEndian.Uint64(e[32:])),
+			Last:       int64(binary.LittleEndian.Uint64(e[40:])),
+			Attributes: binary.LittleEndian.Uint64(e[48:]),
+		})
+	}
+	return parts, nil
+}
+
+// copyToDisk copies r to w at off, skipping the blocks of zeros so that the
+// disk stays sparse
+func copyToDisk(w io.WriterAt, off int64, r io.Reader) error {
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := w.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mkfsPartition makes the filesystem of p in the partition d of w
+func mkfsPartition(w io.WriterAt, d diskPartition, p Partition) error {
+	c := mkfsCommands[p.Filesystem]
+	mkfs, err := exec.LookPath(c.cmd)
+	if err != nil {
+		return fmt.Errorf("%s executable not found in PATH, needed for the %s partition %s", c.cmd, p.Filesystem, p.Label)
+	}
+	f, err := ioutil.TempFile("", "partition")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(d.sectors() * sectorSize); err != nil {
+		return err
+	}
+	args := c.args
+	if p.Label != "" {
+		args = append(args, c.label, p.Label)
+	}
+	args = append(args, f.Name())
+	log.Debugf("run %s: %v", mkfs, args)
+	if out, err := exec.Command(mkfs, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v output:\n%s", c.cmd, err, out)
+	}
+	return copyToDisk(w, d.First*sectorSize, f)
+}
+
+// toolBootPartition is the boot partition of the disk an output tool makes,
+// its first partition, and the boot code of its MBR
+func toolBootPartition(disk io.ReaderAt, format string) (*io.SectionReader, []byte, error) {
+	src, err := readPartitions(disk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read the %s disk: %v", format, err)
+	}
+	if len(src) == 0 {
+		return nil, nil, fmt.Errorf("The %s disk has no boot partition", format)
+	}
+	bootCode := make([]byte, 440)
+	if _, err := disk.ReadAt(bootCode, 0); err != nil {
+		return nil, nil, err
+	}
+	return io.NewSectionReader(disk, src[0].First*sectorSize, src[0].sectors()*sectorSize), bootCode, nil
+}
+
+// writeDisk writes the disk image filename of an output with the layout of
+// parts on sizeMB, and bootCode in its MBR. The boot partition has the
+// filesystem boot, and the other partitions get their filesystem.
+func writeDisk(filename string, boot *io.SectionReader, bootCode []byte, format string, parts []Partition, sizeMB int) error {
+	layout, total, err := layoutPartitions(format, parts, sizeMB)
+	if err != nil {
+		return err
+	}
+	var b int
+	for i, p := range parts {
+		if p.Boot {
+			b = i
+		}
+	}
+	if boot.Size() > layout[b].sectors()*sectorSize {
+		return fmt.Errorf("The boot partition of %s is %dM but the kernel and initrd need %dM", format, layout[b].sectors()*sectorSize>>20, (boot.Size()+1<<20-1)>>20)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(total * sectorSize); err != nil {
+		return err
+	}
+	var hybrid *diskPartition
+	if partitionedOutputs[format].hybrid {
+		hybrid = &layout[b]
+	}
+	if err := writeGPT(f, total, layout, bootCode, hybrid); err != nil {
+		return err
+	}
+	if err := copyToDisk(f, layout[b].First*sectorSize, boot); err != nil {
+		return err
+	}
+	for i, p := range parts {
+		if !p.Boot && p.Filesystem != "" {
+			if err := mkfsPartition(f, layout[i], p); err != nil {
+				return err
+			}
+		}
+	}
+	return f.Close()
+}
+
+// outputPartitions writes the disk image of a raw-efi or gcp output with
+// the layout of parts, on a disk of size in MB
+func outputPartitions(format, base string, image io.Reader, size int, parts []Partition) error {
+	kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	if err != nil {
+		return fmt.Errorf("Error converting to initrd: %v", err)
+	}
+	filename := base + "-efi.img"
+	if format == "gcp" {
+		filename = base + ".img.tar.gz"
+	}
+	log.Infof("  %s", filename)
+
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, ".disk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
+	if err != nil {
+		return err
+	}
+	if err := dockerRun(buf, tmp, outputImages[format], cmdline); err != nil {
+		return fmt.Errorf("Error writing %s output: %v", format, err)
+	}
+
+	if format != "gcp" {
+		boot, bootCode, err := toolBootPartition(tmp, format)
+		if err != nil {
+			return fmt.Errorf("Error writing %s output: %v", format, err)
+		}
+		if err := writeDisk(filename, boot, bootCode, format, parts, size); err != nil {
+			return fmt.Errorf("Error writing %s output: %v", format, err)
+		}
+		return nil
+	}
+
+	// the gcp disk is the disk.raw of a compressed tarball
+	raw, err := ioutil.TempFile(dir, ".disk")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(raw.Name())
+	defer raw.Close()
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := untarFile(raw, tmp, "disk.raw"); err != nil {
+		return fmt.Errorf("Error reading gcp output: %v", err)
+	}
+	boot, bootCode, err := toolBootPartition(raw, format)
+	if err != nil {
+		return fmt.Errorf("Error writing gcp output: %v", err)
+	}
+	if err := writeDisk(tmp.Name(), boot, bootCode, format, parts, size); err != nil {
+		return fmt.Errorf("Error writing gcp output: %v", err)
+	}
+	disk, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	if err := tarGzFile(filename, disk, "disk.raw"); err != nil {
+		return fmt.Errorf("Error writing gcp output: %v", err)
+	}
+	return nil
+}
+
+// untarFile copies the file name of the compressed tarball r to w
+func untarFile(w io.Writer, r io.Reader, name string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("No %s in the tarball", name)
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == name {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// tarGzFile writes the compressed tarball filename with f as name
+func tarGzFile(filename string, f *os.File, name string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: defaultModTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, f); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// paddedOutputs are the disk image outputs made by their output tool at the
+// size of their contents, which a -size pads, with the suffix of their file
+// and their qemu-img format
+var paddedOutputs = map[string]struct {
+	suffix string
+	format string
+}{
+	"raw-bios":             {"-bios.img", "raw"},
+	"raw-efi":              {"-efi.img", "raw"},
+	"qcow2-efi":            {"-efi.qcow2", "qcow2"},
+	"vmdk":                 {".vmdk", "vmdk"},
+	"vmdk-streamoptimized": {".vmdk", "vmdk"},
+}
+
+// padOutput pads the disk image of the output format of base to sizeMB
+func padOutput(format, base string, sizeMB int) error {
+	out := paddedOutputs[format]
+	filename := base + out.suffix
+	if out.format == "raw" {
+		if err := padRawDisk(filename, sizeMB); err != nil {
+			return fmt.Errorf("Error padding %s output: %v", format, err)
+		}
+		return nil
+	}
+
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("Cannot find qemu-img executable, needed to pad %s output to -size: %v", format, err)
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(MobyDir, "tmp"), "moby")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	run := func(args ...string) error {
+		log.Debugf("run %s: %v", qemuImg, args)
+		cmd := exec.Command(qemuImg, args...)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	raw := filepath.Join(tmp, "disk.raw")
+	if err := run("convert", "-O", "raw", filename, raw); err != nil {
+		return fmt.Errorf("Error padding %s output: %v", format, err)
+	}
+	if err := padRawDisk(raw, sizeMB); err != nil {
+		return fmt.Errorf("Error padding %s output: %v", format, err)
+	}
+	args := []string{"convert", "-O", out.format}
+	if out.format == "vmdk" {
+		args = append(args, "-o", "subformat=streamOptimized")
+	}
+	if err := run(append(args, raw, filename)...); err != nil {
+		return fmt.Errorf("Error padding %s output: %v", format, err)
+	}
+	return nil
+}
+
+// padRawDisk grows the raw disk image filename to sizeMB, extending its
+// last partition to the end of the disk. The filesystem of the partition
+// is left as it is.
+func padRawDisk(filename string, sizeMB int) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	total := int64(sizeMB) << 20 / sectorSize
+	if fi.Size() > total*sectorSize {
+		return fmt.Errorf("The disk needs %dM but -size is %dM", (fi.Size()+1<<20-1)>>20, sizeMB)
+	}
+	parts, err := readPartitions(f)
+	if err != nil || len(parts) == 0 {
+		// with no partitions there is nothing to extend
+		if err := f.Truncate(total * sectorSize); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+	mbr := make([]byte, sectorSize)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+	last := 0
+	for i, p := range parts {
+		if p.Last > parts[last].Last {
+			last = i
+		}
+	}
+
+	if parts[0].GUID == "" {
+		// an MBR, whose last partition is the one in the entry at the
+		// highest sector
+		for i := 0; i < 4; i++ {
+			e := mbr[446+16*i : 446+16*(i+1)]
+			if e[4] != 0 && int64(binary.LittleEndian.Uint32(e[8:])) == parts[last].First {
+				mbrEntry(e, e[0] == 0x80, e[4], parts[last].First, total-parts[last].First)
+			}
+		}
+		if err := f.Truncate(total * sectorSize); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(mbr, 0); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	// a GPT, keeping the partition in a hybrid MBR in it
+	var hybrid *diskPartition
+	for i := 0; i < 4; i++ {
+		e := mbr[446+16*i : 446+16*(i+1)]
+		if e[4] == 0 || e[4] == 0xee {
+			continue
+		}
+		for j := range parts {
+			if parts[j].First == int64(binary.LittleEndian.Uint32(e[8:])) {
+				hybrid = &parts[j]
+			}
+		}
+	}
+	old := fi.Size() / sectorSize
+	if old >= gptSectors {
+		// the backup GPT at the old end of the disk
+		if _, err := f.WriteAt(make([]byte, gptSectors*sectorSize), (old-gptSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(total * sectorSize); err != nil {
+		return err
+	}
+	parts[last].Last = total - gptSectors - 1
+	if err := writeGPT(f, total, parts, mbr[:440], hybrid); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,368 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const partitionsConfig = `outputs:
+  raw-efi:
+    partitions:
+      - label: boot
+        size: 16M
+        boot: true
+      - label: data
+        size: 8M
+        filesystem: ext4
+      - label: scratch
+`
+
+func TestPartitionsConfig(t *testing.T) {
+	m, err := NewConfig([]byte(partitionsConfig))
+	require.NoError(t, err)
+	assert.Equal(t, []Partition{
+		{Label: "boot", Size: "16M", Boot: true},
+		{Label: "data", Size: "8M", Filesystem: "ext4"},
+		{Label: "scratch"},
+	}, m.Outputs["raw-efi"].Partitions)
+
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`outputs: {raw-efi: {partitions: [{size: 16M}]}}`, "Exactly one partition of raw-efi must be the boot partition, not 0"},
+		{`outputs: {raw-efi: {partitions: [{size: 16M, boot: true}, {boot: true}]}}`, "Exactly one partition of raw-efi must be the boot partition, not 2"},
+		{`outputs: {raw-efi: {partitions: [{boot: true}, {size: 16M}]}}`, "Partition 1 of raw-efi has no size, only the last partition may leave it out"},
+		{`outputs: {raw-efi: {partitions: [{size: 16K, boot: true}]}}`, "Invalid size 16K for partition 1 of raw-efi: it must be in M or G, such as 512M"},
+		{`outputs: {raw-efi: {partitions: [{size: 0M, boot: true}]}}`, "Invalid size 0M for partition 1 of raw-efi: it must be a positive number of M or G"},
+		{`outputs: {raw-efi: {partitions: [{boot: true, filesystem: ext4}]}}`, "The boot partition of raw-efi must have a vfat filesystem, not ext4"},
+		{`outputs: {gcp: {partitions: [{boot: true, size: 1G}, {filesystem: zfs}]}}`, "Unknown filesystem zfs for partition 2 of gcp, it must be ext4, vfat or xfs"},
+		{`outputs: {iso-efi: {partitions: [{boot: true}]}}`, "Output iso-efi does not support partitions, only raw-efi and gcp do"},
+		{`outputs: {raw-efi: {partitions: [{boot: true, label: ` + strings.Repeat("x", 37) + `}]}}`, "The label of partition 1 of raw-efi is longer than 36 characters"},
+	} {
+		_, err := NewConfig([]byte(tc.config))
+		assert.EqualError(t, err, tc.err, tc.config)
+	}
+}
+
+func TestLayoutPartitions(t *testing.T) {
+	m, err := NewConfig([]byte(partitionsConfig))
+	require.NoError(t, err)
+	parts := m.Outputs["raw-efi"].Partitions
+
+	layout, total, err := layoutPartitions("raw-efi", parts, 64)
+	require.NoError(t, err)
+	assert.Equal(t, int64(64*2048), total)
+	assert.Equal(t, []diskPartition{
+		{Type: espType, Name: "boot", First: 2048, Last: 2048 + 16*2048 - 1, Attributes: legacyBootable},
+		{Type: linuxDataType, Name: "data", First: 17 * 2048, Last: 25*2048 - 1},
+		{Type: linuxDataType, Name: "scratch", First: 25 * 2048, Last: total - gptSectors - 1},
+	}, layout)
+
+	// the first 1M, the partitions with at least 1M for the last one, and
+	// the backup GPT do not fit in 26M
+	_, _, err = layoutPartitions("raw-efi", parts, 27)
+	assert.NoError(t, err)
+	_, _, err = layoutPartitions("raw-efi", parts, 26)
+	assert.EqualError(t, err, "The partitions of raw-efi need 27M but the disk is 26M, use a larger -size")
+}
+
+// testSourceDisk writes a disk such as the output tool makes, whose first
+// partition of 1M is the boot filesystem, filled with a pattern
+func testSourceDisk(t *testing.T, path string, gpt bool) []byte {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(8<<20))
+	boot := diskPartition{Type: espType, Name: "EFI System", First: 2048, Last: 4095}
+	bootCode := bytes.Repeat([]byte{0xeb}, 440)
+	if gpt {
+		require.NoError(t, writeGPT(f, 8<<20/sectorSize, []diskPartition{boot}, nil, nil))
+	} else {
+		mbr := make([]byte, sectorSize)
+		copy(mbr, bootCode)
+		mbrEntry(mbr[446:], true, 0x83, boot.First, boot.sectors())
+		mbr[510], mbr[511] = 0x55, 0xaa
+		_, err := f.WriteAt(mbr, 0)
+		require.NoError(t, err)
+	}
+	fs := bytes.Repeat([]byte("bootfs!\n"), 1<<20/8)
+	_, err = f.WriteAt(fs, boot.First*sectorSize)
+	require.NoError(t, err)
+	return fs
+}
+
+// checkBackupGPT checks the backup GPT header at the end of the disk
+func checkBackupGPT(t *testing.T, disk []byte) {
+	total := int64(len(disk)) / sectorSize
+	h := append([]byte{}, disk[(total-1)*sectorSize:(total-1)*sectorSize+92]...)
+	require.Equal(t, "EFI PART", string(h[:8]))
+	crc := binary.LittleEndian.Uint32(h[16:])
+	binary.LittleEndian.PutUint32(h[16:], 0)
+	assert.Equal(t, crc, crc32.ChecksumIEEE(h))
+	assert.Equal(t, uint64(total-1), binary.LittleEndian.Uint64(h[24:]))
+	assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(h[32:]))
+	entriesLBA := int64(binary.LittleEndian.Uint64(h[72:]))
+	assert.Equal(t, total-gptSectors, entriesLBA)
+	assert.Equal(t, disk[2*sectorSize:(2+gptSectors-1)*sectorSize], disk[entriesLBA*sectorSize:(total-1)*sectorSize])
+}
+
+// checkSfdisk reads the GPT of the disk with sfdisk, if it is installed
+func checkSfdisk(t *testing.T, path string, layout []diskPartition) {
+	if _, err := exec.LookPath("sfdisk"); err != nil {
+		t.Logf("sfdisk is not available, not checking the GPT with it")
+		return
+	}
+	out, err := exec.Command("sfdisk", "--json", path).Output()
+	require.NoError(t, err)
+	var table struct {
+		Partitiontable struct {
+			Label      string
+			Partitions []struct {
+				Start int64
+				Size  int64
+				Type  string
+				Name  string
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(out, &table))
+	assert.Equal(t, "gpt", table.Partitiontable.Label)
+	require.Len(t, table.Partitiontable.Partitions, len(layout))
+	for i, p := range table.Partitiontable.Partitions {
+		assert.Equal(t, layout[i].First, p.Start)
+		assert.Equal(t, layout[i].sectors(), p.Size)
+		assert.Equal(t, layout[i].Type, p.Type)
+		assert.Equal(t, layout[i].Name, p.Name)
+	}
+}
+
+func TestWriteDiskRawEFI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := testSourceDisk(t, filepath.Join(dir, "source.img"), true)
+	src, err := os.Open(filepath.Join(dir, "source.img"))
+	require.NoError(t, err)
+	defer src.Close()
+
+	parts := []Partition{
+		{Label: "boot", Size: "16M", Boot: true},
+		{Label: "data", Size: "8M", Filesystem: "ext4"},
+		{Label: "scratch"},
+	}
+	_, mkfsErr := exec.LookPath("mkfs.ext4")
+	if mkfsErr != nil {
+		parts[1].Filesystem = ""
+	}
+	out := filepath.Join(dir, "linuxkit-efi.img")
+	boot, bootCode, err := toolBootPartition(src, "raw-efi")
+	require.NoError(t, err)
+	require.NoError(t, writeDisk(out, boot, bootCode, "raw-efi", parts, 64))
+
+	disk, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, 64<<20, len(disk))
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	layout, err := readPartitions(f)
+	require.NoError(t, err)
+	require.Len(t, layout, 3)
+	for i, p := range layout {
+		assert.Len(t, p.GUID, 36)
+		layout[i].GUID = ""
+	}
+	total := int64(64 << 20 / sectorSize)
+	assert.Equal(t, []diskPartition{
+		{Type: espType, Name: "boot", First: 2048, Last: 17*2048 - 1, Attributes: legacyBootable},
+		{Type: linuxDataType, Name: "data", First: 17 * 2048, Last: 25*2048 - 1},
+		{Type: linuxDataType, Name: "scratch", First: 25 * 2048, Last: total - gptSectors - 1},
+	}, layout)
+	checkBackupGPT(t, disk)
+	checkSfdisk(t, out, layout)
+
+	// a protective MBR only, without boot code
+	assert.Equal(t, make([]byte, 440), disk[:440])
+	assert.Equal(t, byte(0xee), disk[446+4])
+	assert.Equal(t, make([]byte, 16), disk[462:478])
+
+	// the boot filesystem is copied to the boot partition
+	assert.Equal(t, fs, disk[2048*sectorSize:2048*sectorSize+len(fs)])
+	if mkfsErr == nil {
+		sb := disk[17*2048*sectorSize+1024:]
+		assert.Equal(t, uint16(0xef53), binary.LittleEndian.Uint16(sb[0x38:]), "ext4 superblock of data")
+		assert.Equal(t, "data", string(bytes.TrimRight(sb[0x78:0x78+16], "\x00")))
+	}
+}
+
+func TestWriteDiskGCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := testSourceDisk(t, filepath.Join(dir, "disk.raw"), false)
+	src, err := os.Open(filepath.Join(dir, "disk.raw"))
+	require.NoError(t, err)
+	defer src.Close()
+
+	out := filepath.Join(dir, "out.raw")
+	parts := []Partition{{Label: "swap", Size: "4M"}, {Label: "root", Boot: true}}
+	boot, bootCode, err := toolBootPartition(src, "gcp")
+	require.NoError(t, err)
+	require.NoError(t, writeDisk(out, boot, bootCode, "gcp", parts, 16))
+	disk, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+
+	// the boot code boots the boot partition from the hybrid MBR
+	assert.Equal(t, bytes.Repeat([]byte{0xeb}, 440), disk[:440])
+	assert.Equal(t, byte(0xee), disk[446+4])
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(disk[446+8:]))
+	assert.Equal(t, uint32(5*2048-1), binary.LittleEndian.Uint32(disk[446+12:]))
+	assert.Equal(t, byte(0x80), disk[462])
+	assert.Equal(t, byte(0x83), disk[462+4])
+	assert.Equal(t, uint32(5*2048), binary.LittleEndian.Uint32(disk[462+8:]))
+	assert.Equal(t, uint32(16*2048-gptSectors-5*2048), binary.LittleEndian.Uint32(disk[462+12:]))
+
+	layout, err := readPartitions(bytes.NewReader(disk))
+	require.NoError(t, err)
+	require.Len(t, layout, 2)
+	assert.Equal(t, diskPartition{Type: linuxDataType, GUID: layout[0].GUID, Name: "swap", First: 2048, Last: 5*2048 - 1}, layout[0])
+	assert.Equal(t, diskPartition{Type: linuxDataType, GUID: layout[1].GUID, Name: "root", First: 5 * 2048, Last: 16*2048 - gptSectors - 1, Attributes: legacyBootable}, layout[1])
+	assert.Equal(t, fs, disk[5*2048*sectorSize:5*2048*sectorSize+len(fs)])
+	checkBackupGPT(t, disk)
+
+	// the boot partition must hold the boot filesystem
+	e := make([]byte, 16)
+	mbrEntry(e, true, 0x83, 2048, 4096)
+	big, err := os.OpenFile(filepath.Join(dir, "disk.raw"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer big.Close()
+	_, err = big.WriteAt(e, 446)
+	require.NoError(t, err)
+	boot, bootCode, err = toolBootPartition(big, "gcp")
+	require.NoError(t, err)
+	err = writeDisk(out, boot, bootCode, "gcp", []Partition{{Boot: true, Size: "1M"}, {Size: "13M"}}, 16)
+	assert.EqualError(t, err, "The boot partition of gcp is 1M but the kernel and initrd need 2M")
+}
+
+func TestTarGzFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	raw := filepath.Join(dir, "disk.raw")
+	require.NoError(t, ioutil.WriteFile(raw, []byte("disk"), 0644))
+	f, err := os.Open(raw)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, tarGzFile(filepath.Join(dir, "linuxkit.img.tar.gz"), f, "disk.raw"))
+
+	tgz, err := os.Open(filepath.Join(dir, "linuxkit.img.tar.gz"))
+	require.NoError(t, err)
+	defer tgz.Close()
+	var b bytes.Buffer
+	require.NoError(t, untarFile(&b, tgz, "disk.raw"))
+	assert.Equal(t, "disk", b.String())
+	_, err = tgz.Seek(0, 0)
+	require.NoError(t, err)
+	assert.EqualError(t, untarFile(&b, tgz, "boot.raw"), "No boot.raw in the tarball")
+}
+
+func TestPadRawDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	total := int64(32 << 20 / sectorSize)
+
+	// the last GPT partition fills the padded disk
+	gpt := filepath.Join(dir, "gpt.img")
+	fs := testSourceDisk(t, gpt, true)
+	require.NoError(t, padRawDisk(gpt, 32))
+	disk, err := ioutil.ReadFile(gpt)
+	require.NoError(t, err)
+	assert.Equal(t, 32<<20, len(disk))
+	layout, err := readPartitions(bytes.NewReader(disk))
+	require.NoError(t, err)
+	require.Len(t, layout, 1)
+	assert.Equal(t, diskPartition{Type: espType, GUID: layout[0].GUID, Name: "EFI System", First: 2048, Last: total - gptSectors - 1}, layout[0])
+	assert.Equal(t, fs, disk[2048*sectorSize:2048*sectorSize+len(fs)])
+	checkBackupGPT(t, disk)
+	assert.Equal(t, make([]byte, gptSectors*sectorSize), disk[(8<<20/sectorSize-gptSectors)*sectorSize:8<<20], "the old backup GPT")
+	checkSfdisk(t, gpt, layout)
+
+	// and so does the last MBR partition
+	mbr := filepath.Join(dir, "mbr.img")
+	testSourceDisk(t, mbr, false)
+	require.NoError(t, padRawDisk(mbr, 32))
+	disk, err = ioutil.ReadFile(mbr)
+	require.NoError(t, err)
+	assert.Equal(t, 32<<20, len(disk))
+	assert.Equal(t, bytes.Repeat([]byte{0xeb}, 440), disk[:440])
+	assert.Equal(t, byte(0x80), disk[446])
+	assert.Equal(t, byte(0x83), disk[446+4])
+	assert.Equal(t, uint32(2048), binary.LittleEndian.Uint32(disk[446+8:]))
+	assert.Equal(t, uint32(total-2048), binary.LittleEndian.Uint32(disk[446+12:]))
+
+	// the partition of a hybrid MBR stays in it
+	testSourceDisk(t, mbr, false)
+	src, err := os.Open(mbr)
+	require.NoError(t, err)
+	defer src.Close()
+	hybrid := filepath.Join(dir, "hybrid.img")
+	boot, bootCode, err := toolBootPartition(src, "gcp")
+	require.NoError(t, err)
+	require.NoError(t, writeDisk(hybrid, boot, bootCode, "gcp", []Partition{{Label: "swap", Size: "4M"}, {Label: "root", Boot: true}}, 16))
+	require.NoError(t, padRawDisk(hybrid, 32))
+	disk, err = ioutil.ReadFile(hybrid)
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0xeb}, 440), disk[:440])
+	assert.Equal(t, byte(0x83), disk[462+4])
+	assert.Equal(t, uint32(total-gptSectors-5*2048), binary.LittleEndian.Uint32(disk[462+12:]))
+	layout, err = readPartitions(bytes.NewReader(disk))
+	require.NoError(t, err)
+	require.Len(t, layout, 2)
+	assert.Equal(t, int64(5*2048-1), layout[0].Last)
+	assert.Equal(t, total-gptSectors-1, layout[1].Last)
+	checkBackupGPT(t, disk)
+
+	assert.EqualError(t, padRawDisk(hybrid, 16), "The disk needs 32M but -size is 16M")
+}
+
+// TestPadOutputQcow2 checks that qemu-img sees the size of a padded qcow2
+func TestPadOutputQcow2(t *testing.T) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img is not available")
+	}
+	dir, err := ioutil.TempDir("", "disk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { MobyDir = d }(MobyDir)
+	MobyDir = dir
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "tmp"), 0755))
+
+	base := filepath.Join(dir, "linuxkit")
+	testSourceDisk(t, filepath.Join(dir, "source.img"), true)
+	require.NoError(t, exec.Command(qemuImg, "convert", "-O", "qcow2", filepath.Join(dir, "source.img"), base+"-efi.qcow2").Run())
+	require.NoError(t, padOutput("qcow2-efi", base, 4096))
+
+	out, err := exec.Command(qemuImg, "info", "--output=json", base+"-efi.qcow2").Output()
+	require.NoError(t, err)
+	var info struct {
+		Format      string
+		VirtualSize int64 `json:"virtual-size"`
+	}
+	require.NoError(t, json.Unmarshal(out, &info))
+	assert.Equal(t, "qcow2", info.Format)
+	assert.Equal(t, int64(4<<30), info.VirtualSize)
+}
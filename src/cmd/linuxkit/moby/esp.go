@@ -0,0 +1,161 @@
+package moby
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// espLoaders are the removable media paths firmwares boot systemd-boot from
+var espLoaders = []string{"EFI/BOOT/BOOTX64.EFI", "EFI/BOOT/BOOTAA64.EFI"}
+
+// validateESP checks the EFI system partition of an output
+func validateESP(format string, esp *ESPConfig) error {
+	if esp == nil {
+		return nil
+	}
+	if format != "raw-efi" {
+		return fmt.Errorf("Output %s does not support esp, only raw-efi does", format)
+	}
+	switch esp.Bootloader {
+	case "systemd-boot", "stub":
+	default:
+		return fmt.Errorf("Unknown esp bootloader %q of %s, it must be systemd-boot or stub", esp.Bootloader, format)
+	}
+	loader := false
+	for _, f := range esp.Files {
+		if strings.Trim(f.Path, "/") == "" {
+			return fmt.Errorf("An esp file of %s has no path", format)
+		}
+		if (f.Contents == nil) == (f.Source == "") {
+			return fmt.Errorf("The esp file %s of %s must have one of contents or source", f.Path, format)
+		}
+		for _, l := range espLoaders {
+			loader = loader || strings.EqualFold(strings.Trim(f.Path, "/"), l)
+		}
+	}
+	if esp.Bootloader == "systemd-boot" && !loader {
+		return fmt.Errorf("The systemd-boot esp of %s needs the systemd-boot EFI binary as the file %s", format, strings.Join(espLoaders, " or "))
+	}
+	return nil
+}
+
+// espFiles are the files of the EFI system partition esp, booting kernel
+// and initrd with cmdline
+func espFiles(esp ESPConfig, kernel, initrd []byte, cmdline string) ([]fatFile, error) {
+	title := esp.Title
+	if title == "" {
+		title = "LinuxKit"
+	}
+	var files []fatFile
+	switch esp.Bootloader {
+	case "systemd-boot":
+		files = []fatFile{
+			{"kernel", kernel},
+			{"initrd.img", initrd},
+			{"loader/loader.conf", []byte("default linuxkit.conf\ntimeout 0\n")},
+			{"loader/entries/linuxkit.conf", []byte(fmt.Sprintf("title %s\nlinux /kernel\ninitrd /initrd.img\noptions %s\n", title, cmdline))},
+		}
+	case "stub":
+		// the kernel boots itself with its EFI stub, from the startup.nsh
+		// the UEFI shell runs when there is nothing else to boot
+		files = []fatFile{
+			{"kernel.efi", kernel},
+			{"initrd.img", initrd},
+			{"startup.nsh", []byte(fmt.Sprintf("@echo -off\r\necho %s\r\nfor %%i in 0 1 2 3 4 5 6 7 8 9\r\n  if exist fs%%i:\\kernel.efi then\r\n    fs%%i:\r\n    \\kernel.efi initrd=\\initrd.img %s\r\n  endif\r\nendfor\r\n", title, cmdline))},
+		}
+	}
+	for _, f := range esp.Files {
+		contents := []byte{}
+		if f.Contents != nil {
+			contents = []byte(*f.Contents)
+		} else {
+			source := f.Source
+			if len(source) > 2 && source[:2] == "~/" {
+				source = util.HomeDir() + source[1:]
+			}
+			var err error
+			if contents, err = ioutil.ReadFile(source); err != nil {
+				return nil, err
+			}
+		}
+		path := strings.Trim(f.Path, "/")
+		replaced := false
+		for i := range files {
+			if strings.EqualFold(files[i].path, path) {
+				files[i].data = contents
+				replaced = true
+			}
+		}
+		if !replaced {
+			files = append(files, fatFile{path, contents})
+		}
+	}
+	return files, nil
+}
+
+// outputESP writes the raw-efi disk image of base whose EFI system partition
+// linuxkit makes for esp, laid out with parts if there are any, on a disk of
+// size in MB, or of just the partition if there are no parts and size is 0
+func outputESP(base string, image io.Reader, size int, esp *ESPConfig, parts []Partition) error {
+	kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	if err != nil {
+		return fmt.Errorf("Error converting to initrd: %v", err)
+	}
+	files, err := espFiles(*esp, kernel, initrd, cmdline)
+	if err != nil {
+		return fmt.Errorf("Error writing raw-efi output: %v", err)
+	}
+	filename := base + "-efi.img"
+	log.Infof("  %s", filename)
+
+	// without partitions, the disk is just big enough for the partition,
+	// unless it has a size
+	if len(parts) == 0 {
+		sectors, err := fatMinSectors(files)
+		if err != nil {
+			return fmt.Errorf("Error writing raw-efi output: %v", err)
+		}
+		parts = []Partition{{Boot: true}}
+		need := int(sectors*sectorSize>>20) + 2
+		if size != 0 && size < need {
+			return fmt.Errorf("The EFI system partition of raw-efi needs %dM but the disk is %dM, use a larger -size", need, size)
+		}
+		if size == 0 {
+			size = need
+		}
+	}
+	layout, _, err := layoutPartitions("raw-efi", parts, size)
+	if err != nil {
+		return err
+	}
+	var boot diskPartition
+	for i, p := range parts {
+		if p.Boot {
+			boot = layout[i]
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".esp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(boot.sectors() * sectorSize); err != nil {
+		return err
+	}
+	if err := writeFAT32(f, boot.sectors(), "EFI", files); err != nil {
+		return fmt.Errorf("Error writing the EFI system partition of raw-efi output: %v", err)
+	}
+	if err := writeDisk(filename, io.NewSectionReader(f, 0, boot.sectors()*sectorSize), nil, "raw-efi", parts, size); err != nil {
+		return fmt.Errorf("Error writing raw-efi output: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readFAT32 reads the files of a FAT32 filesystem by their long names,
+// with its volume label as the file "LABEL"
+func readFAT32(t *testing.T, r io.ReaderAt) map[string]string {
+	boot := make([]byte, sectorSize)
+	_, err := r.ReadAt(boot, 0)
+	require.NoError(t, err)
+	require.Equal(t, "FAT32   ", string(boot[82:90]))
+	require.Equal(t, []byte{0x55, 0xaa}, boot[510:])
+	clusterSize := int64(boot[13]) * sectorSize
+	reserved := int64(binary.LittleEndian.Uint16(boot[14:]))
+	fatSectors := int64(binary.LittleEndian.Uint32(boot[36:]))
+	dataStart := (reserved + int64(boot[16])*fatSectors) * sectorSize
+	fat := make([]byte, fatSectors*sectorSize)
+	_, err = r.ReadAt(fat, reserved*sectorSize)
+	require.NoError(t, err)
+
+	read := func(cluster uint32, size int64) []byte {
+		var b []byte
+		for cluster >= 2 && cluster < 0x0ffffff8 {
+			c := make([]byte, clusterSize)
+			_, err := r.ReadAt(c, dataStart+int64(cluster-2)*clusterSize)
+			require.NoError(t, err)
+			b = append(b, c...)
+			cluster = binary.LittleEndian.Uint32(fat[4*cluster:]) & 0x0fffffff
+		}
+		if size >= 0 {
+			require.True(t, int64(len(b)) >= size)
+			b = b[:size]
+		}
+		return b
+	}
+	files := map[string]string{}
+	var walk func(dir []byte, prefix string)
+	walk = func(dir []byte, prefix string) {
+		var long []uint16
+		for i := 0; i+32 <= len(dir) && dir[i] != 0; i += 32 {
+			e := dir[i : i+32]
+			if e[11] == fatAttrLFN {
+				var chars []uint16
+				for _, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					if c := binary.LittleEndian.Uint16(e[off:]); c != 0 && c != 0xffff {
+						chars = append(chars, c)
+					}
+				}
+				long = append(chars, long...)
+				continue
+			}
+			name := strings.TrimSpace(string(e[:8]))
+			if ext := strings.TrimSpace(string(e[8:11])); ext != "" {
+				name += "." + ext
+			}
+			if long != nil {
+				name = string(utf16.Decode(long))
+				long = nil
+			}
+			if e[11]&fatAttrVolume != 0 {
+				files["LABEL"] = strings.TrimSpace(string(e[:11]))
+				continue
+			}
+			if name == "." || name == ".." {
+				continue
+			}
+			cluster := uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+			if e[11]&fatAttrDir != 0 {
+				walk(read(cluster, -1), prefix+name+"/")
+			} else {
+				files[prefix+name] = string(read(cluster, int64(binary.LittleEndian.Uint32(e[28:]))))
+			}
+		}
+	}
+	walk(read(binary.LittleEndian.Uint32(boot[44:]), -1), "")
+	return files
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// fsckFAT checks the filesystem with fsck.vfat, if it is installed
+func fsckFAT(t *testing.T, path string) {
+	if _, err := exec.LookPath("fsck.vfat"); err != nil {
+		t.Logf("fsck.vfat is not available, not checking the filesystem with it")
+		return
+	}
+	out, err := exec.Command("fsck.vfat", "-n", path).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+func TestWriteFAT32(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fat")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 70000)
+	files := []fatFile{
+		{"EFI/BOOT/BOOTX64.EFI", []byte("loader")},
+		{"kernel", big},
+		{"empty", nil},
+		{"loader/entries/a rather long file name.conf", []byte("long")},
+		{"loader/entries/a rather long file name.txt", []byte("other")},
+		{"README", []byte("readme")},
+	}
+	sectors, err := fatMinSectors(files)
+	require.NoError(t, err)
+	assert.Equal(t, int64(33<<20/sectorSize), sectors)
+
+	path := filepath.Join(dir, "esp.img")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(sectors*sectorSize))
+	require.NoError(t, writeFAT32(f, sectors, "efi", files))
+
+	assert.Equal(t, map[string]string{
+		"LABEL":                "EFI",
+		"EFI/BOOT/BOOTX64.EFI": "loader",
+		"kernel":               string(big),
+		"empty":                "",
+		"loader/entries/a rather long file name.conf": "long",
+		"loader/entries/a rather long file name.txt":  "other",
+		"README": "readme",
+	}, readFAT32(t, f))
+	fsckFAT(t, path)
+
+	assert.Error(t, writeFAT32(f, 32<<20/sectorSize, "", files), "too small for FAT32")
+	_, err = fatMinSectors([]fatFile{{"a", nil}, {"A", nil}})
+	assert.EqualError(t, err, "A is in the filesystem more than once")
+	_, err = fatMinSectors([]fatFile{{"a/../b", nil}})
+	assert.Error(t, err)
+}
+
+func TestFATShortName(t *testing.T) {
+	used := map[[11]byte]bool{}
+	for _, tc := range []struct {
+		name  string
+		short string
+		long  bool
+	}{
+		{"BOOTX64.EFI", "BOOTX64 EFI", false},
+		{"kernel", "KERNEL~1   ", true},
+		{"initrd.img", "INITRD~1IMG", true},
+		{"initrd.IMG", "INITRD~2IMG", true},
+		{"linuxkit.conf", "LINUXK~1CON", true},
+		{".hidden", "HIDDEN~1   ", true},
+	} {
+		short, long := fatShortName(tc.name, used)
+		used[short] = true
+		assert.Equal(t, tc.short, string(short[:]), tc.name)
+		assert.Equal(t, tc.long, long, tc.name)
+	}
+}
+
+func TestESPConfig(t *testing.T) {
+	m, err := NewConfig([]byte(`outputs:
+  raw-efi:
+    esp:
+      bootloader: systemd-boot
+      title: Appliance
+      files:
+        - path: EFI/BOOT/BOOTX64.EFI
+          source: /usr/lib/systemd/boot/efi/systemd-bootx64.efi
+`))
+	require.NoError(t, err)
+	assert.Equal(t, &ESPConfig{
+		Bootloader: "systemd-boot",
+		Title:      "Appliance",
+		Files:      []ESPFile{{Path: "EFI/BOOT/BOOTX64.EFI", Source: "/usr/lib/systemd/boot/efi/systemd-bootx64.efi"}},
+	}, m.Outputs["raw-efi"].ESP)
+
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`outputs: {iso-efi: {esp: {bootloader: stub}}}`, "Output iso-efi does not support esp, only raw-efi does"},
+		{`outputs: {raw-efi: {esp: {bootloader: grub}}}`, `Unknown esp bootloader "grub" of raw-efi, it must be systemd-boot or stub`},
+		{`outputs: {raw-efi: {esp: {bootloader: systemd-boot}}}`, "The systemd-boot esp of raw-efi needs the systemd-boot EFI binary as the file EFI/BOOT/BOOTX64.EFI or EFI/BOOT/BOOTAA64.EFI"},
+		{`outputs: {raw-efi: {esp: {bootloader: stub, files: [{path: a}]}}}`, "The esp file a of raw-efi must have one of contents or source"},
+		{`outputs: {raw-efi: {esp: {bootloader: stub, files: [{path: a, contents: a, source: a}]}}}`, "The esp file a of raw-efi must have one of contents or source"},
+		{`outputs: {raw-efi: {esp: {bootloader: stub, files: [{path: /, contents: a}]}}}`, "An esp file of raw-efi has no path"},
+	} {
+		_, err := NewConfig([]byte(tc.config))
+		assert.EqualError(t, err, tc.err, tc.config)
+	}
+}
+
+func TestESPFiles(t *testing.T) {
+	files, err := espFiles(ESPConfig{Bootloader: "systemd-boot", Title: "Appliance", Files: []ESPFile{
+		{Path: "/EFI/BOOT/BOOTX64.EFI", Contents: strPtr("systemd-boot")},
+		{Path: "loader/loader.conf", Contents: strPtr("default linuxkit.conf\ntimeout 5\n")},
+	}}, []byte("kernel"), []byte("initrd"), "console=ttyS0")
+	require.NoError(t, err)
+	assert.Equal(t, []fatFile{
+		{"kernel", []byte("kernel")},
+		{"initrd.img", []byte("initrd")},
+		{"loader/loader.conf", []byte("default linuxkit.conf\ntimeout 5\n")},
+		{"loader/entries/linuxkit.conf", []byte("title Appliance\nlinux /kernel\ninitrd /initrd.img\noptions console=ttyS0\n")},
+		{"EFI/BOOT/BOOTX64.EFI", []byte("systemd-boot")},
+	}, files)
+}
+
+// TestOutputESP checks the EFI system partition of a raw-efi disk with the
+// stub bootloader
+func TestOutputESP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "linuxkit")
+
+	esp := &ESPConfig{Bootloader: "stub", Files: []ESPFile{{Path: "EFI/linuxkit/version", Contents: strPtr("v1")}}}
+	require.NoError(t, outputESP(base, bytes.NewReader(squashfsTestImage(t)), 0, esp, nil))
+	disk, err := os.Open(base + "-efi.img")
+	require.NoError(t, err)
+	defer disk.Close()
+	fi, err := disk.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, int64(35<<20), fi.Size(), "the ESP, 1M before it and the backup GPT")
+
+	parts, err := readPartitions(disk)
+	require.NoError(t, err)
+	require.Len(t, parts, 1)
+	assert.Equal(t, espType, parts[0].Type)
+	assert.Equal(t, "EFI System", parts[0].Name)
+	files := readFAT32(t, io.NewSectionReader(disk, parts[0].First*sectorSize, parts[0].sectors()*sectorSize))
+	require.Contains(t, files, "initrd.img")
+	delete(files, "initrd.img")
+	assert.Equal(t, map[string]string{
+		"LABEL":                "EFI",
+		"kernel.efi":           "kernel",
+		"EFI/linuxkit/version": "v1",
+		"startup.nsh":          "@echo -off\r\necho LinuxKit\r\nfor %i in 0 1 2 3 4 5 6 7 8 9\r\n  if exist fs%i:\\kernel.efi then\r\n    fs%i:\r\n    \\kernel.efi initrd=\\initrd.img console=ttyS0\r\n  endif\r\nendfor\r\n",
+	}, files)
+
+	// with partitions, the ESP fills the boot partition
+	parts2 := []Partition{{Size: "64M", Boot: true}, {Label: "data"}}
+	require.NoError(t, outputESP(base, bytes.NewReader(squashfsTestImage(t)), 128, esp, parts2))
+	disk2, err := os.Open(base + "-efi.img")
+	require.NoError(t, err)
+	defer disk2.Close()
+	layout, err := readPartitions(disk2)
+	require.NoError(t, err)
+	require.Len(t, layout, 2)
+	assert.Equal(t, int64(64<<20/sectorSize), layout[0].sectors())
+	boot := make([]byte, sectorSize)
+	_, err = disk2.ReadAt(boot, layout[0].First*sectorSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(64<<20/sectorSize), binary.LittleEndian.Uint32(boot[32:]))
+
+	// with a size, the ESP fills the disk
+	require.NoError(t, outputESP(base, bytes.NewReader(squashfsTestImage(t)), 64, esp, nil))
+	fi, err = os.Stat(base + "-efi.img")
+	require.NoError(t, err)
+	assert.Equal(t, int64(64<<20), fi.Size())
+	err = outputESP(base, bytes.NewReader(squashfsTestImage(t)), 34, esp, nil)
+	assert.EqualError(t, err, "The EFI system partition of raw-efi needs 35M but the disk is 34M, use a larger -size")
+
+	err = outputESP(base, bytes.NewReader(squashfsTestImage(t)), 128, esp, []Partition{{Size: "16M", Boot: true}})
+	assert.EqualError(t, err, "Error writing the EFI system partition of raw-efi output: A FAT32 filesystem of 16M is too small")
+}
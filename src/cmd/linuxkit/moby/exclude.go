@@ -0,0 +1,85 @@
+package moby
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// excludeFilter is a tarWriter leaving out the entries of an image
+// extracted below prefix which match the exclude patterns of its config,
+// and everything below the directories they match. The paths linuxkit
+// requires in every image, those in touch, are kept.
+type excludeFilter struct {
+	tarWriter
+	prefix   string
+	patterns []string
+	// excluded are the paths left out, relative to prefix
+	excluded map[string]bool
+	skip     bool
+}
+
+// newExcludeFilter returns tw filtering out the patterns, as path.Match
+// patterns relative to the root of the image, of an image extracted below
+// prefix
+func newExcludeFilter(tw tarWriter, prefix string, patterns []string) (*excludeFilter, error) {
+	f := &excludeFilter{tarWriter: tw, prefix: prefix, excluded: map[string]bool{}}
+	for _, pattern := range patterns {
+		pattern = path.Clean("/" + pattern)[1:]
+		if pattern == "" {
+			return nil, fmt.Errorf("Cannot exclude the root of an image")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid exclude pattern %q: %v", pattern, err)
+		}
+		f.patterns = append(f.patterns, pattern)
+	}
+	return f, nil
+}
+
+// matches is whether name, or a directory it is in, matches a pattern
+func (f *excludeFilter) matches(name string) bool {
+	for p := name; p != "." && p != ""; p = path.Dir(p) {
+		for _, pattern := range f.patterns {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *excludeFilter) WriteHeader(hdr *tar.Header) error {
+	f.skip = false
+	if !strings.HasPrefix(hdr.Name, f.prefix) {
+		return f.tarWriter.WriteHeader(hdr)
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, f.prefix), "/")
+	_, required := touch[name]
+	if !required {
+		_, required = touch[name+"/"]
+	}
+	if !required && f.matches(name) {
+		log.Debugf("image tar: %s exclude %s", f.prefix, name)
+		f.excluded[name] = true
+		f.skip = true
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		target := strings.TrimPrefix(hdr.Linkname, f.prefix)
+		if f.excluded[target] {
+			return fmt.Errorf("Cannot exclude %s, %s is a hard link to it", target, name)
+		}
+	}
+	return f.tarWriter.WriteHeader(hdr)
+}
+
+func (f *excludeFilter) Write(b []byte) (int, error) {
+	if f.skip {
+		return len(b), nil
+	}
+	return f.tarWriter.Write(b)
+}
@@ -0,0 +1,137 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// excludeEntries writes the entries of an image below prefix, as ImageTar
+// does, through an excludeFilter of patterns, returning the names written
+// with their contents
+func excludeEntries(t *testing.T, patterns []string, hdrs ...tar.Header) (map[string]string, error) {
+	const prefix = "containers/services/sshd/lower/"
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	f, err := newExcludeFilter(tw, prefix, patterns)
+	if err != nil {
+		return nil, err
+	}
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "containers/services/sshd/config.json", Typeflag: tar.TypeReg}))
+	for _, hdr := range hdrs {
+		contents := []byte(hdr.Name)
+		hdr.Name = prefix + hdr.Name
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = prefix + hdr.Linkname
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(contents))
+		}
+		if err := f.WriteHeader(&hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := f.Write(contents)
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	entries := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		require.NoError(t, err)
+		var b bytes.Buffer
+		_, err = io.Copy(&b, tr)
+		require.NoError(t, err)
+		entries[hdr.Name] = b.String()
+	}
+}
+
+func TestExcludeFilter(t *testing.T) {
+	image := []tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir},
+		{Name: "bin/sh", Typeflag: tar.TypeReg},
+		{Name: "bin/busybox", Typeflag: tar.TypeReg},
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg},
+		{Name: "etc/ssh/", Typeflag: tar.TypeDir},
+		{Name: "etc/ssh/ssh_host_rsa_key", Typeflag: tar.TypeReg},
+		{Name: "etc/ssh/ssh_host_rsa_key.pub", Typeflag: tar.TypeReg},
+		{Name: "etc/ssh/sshd_config", Typeflag: tar.TypeReg},
+		{Name: "usr/", Typeflag: tar.TypeDir},
+		{Name: "usr/share/", Typeflag: tar.TypeDir},
+		{Name: "usr/share/man/", Typeflag: tar.TypeDir},
+		{Name: "usr/share/man/man1/", Typeflag: tar.TypeDir},
+		{Name: "usr/share/man/man1/ssh.1", Typeflag: tar.TypeReg},
+		{Name: "usr/share/doc", Typeflag: tar.TypeSymlink, Linkname: "man"},
+	}
+	names := func(entries map[string]string) []string {
+		var names []string
+		for name := range entries {
+			if name != "containers/services/sshd/config.json" {
+				names = append(names, name[len("containers/services/sshd/lower/"):])
+			}
+		}
+		return names
+	}
+
+	for _, c := range []struct {
+		patterns []string
+		excluded []string
+	}{
+		// a path and everything below it
+		{[]string{"usr/share/man"}, []string{"usr/share/man/", "usr/share/man/man1/", "usr/share/man/man1/ssh.1"}},
+		// a leading / is the root of the image
+		{[]string{"/bin/busybox"}, []string{"bin/busybox"}},
+		// * does not match a /
+		{[]string{"etc/ssh/ssh_host_*"}, []string{"etc/ssh/ssh_host_rsa_key", "etc/ssh/ssh_host_rsa_key.pub"}},
+		{[]string{"*/ssh_host_*"}, nil},
+		{[]string{"etc/ssh/*.pub", "usr/share/d?c"}, []string{"etc/ssh/ssh_host_rsa_key.pub", "usr/share/doc"}},
+		// paths required in every image are kept
+		{[]string{"etc"}, []string{"etc/ssh/", "etc/ssh/ssh_host_rsa_key", "etc/ssh/ssh_host_rsa_key.pub", "etc/ssh/sshd_config"}},
+	} {
+		entries, err := excludeEntries(t, c.patterns, image...)
+		require.NoError(t, err)
+		assert.Contains(t, entries, "containers/services/sshd/config.json", "%v", c.patterns)
+		var kept []string
+		for _, hdr := range image {
+			excluded := false
+			for _, e := range c.excluded {
+				excluded = excluded || e == hdr.Name
+			}
+			if !excluded {
+				kept = append(kept, hdr.Name)
+			}
+		}
+		assert.ElementsMatch(t, kept, names(entries), "%v", c.patterns)
+		for name, contents := range entries {
+			if contents != "" {
+				assert.True(t, len(name) > len(contents) && name[len(name)-len(contents):] == contents, "contents of %s", name)
+			}
+		}
+	}
+
+	_, err := excludeEntries(t, []string{"bin/busybox"}, tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg}, tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"})
+	assert.EqualError(t, err, "Cannot exclude bin/busybox, bin/sh is a hard link to it")
+	_, err = excludeEntries(t, []string{"bin/[a"})
+	assert.EqualError(t, err, `Invalid exclude pattern "bin/[a": syntax error in pattern`)
+	_, err = excludeEntries(t, []string{"/"})
+	assert.EqualError(t, err, "Cannot exclude the root of an image")
+}
+
+func TestExcludeConfig(t *testing.T) {
+	config := []byte("services:\n  - name: sshd\n    image: linuxkit/sshd:v1\n    exclude:\n      - usr/share/man\n      - etc/ssh/ssh_host_*\n")
+	m, err := NewConfig(config)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"usr/share/man", "etc/ssh/ssh_host_*"}, m.Services[0].Exclude)
+	assert.NoError(t, CheckStrict("test.yml", config))
+}
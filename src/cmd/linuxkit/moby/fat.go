@@ -0,0 +1,408 @@
+package moby
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	fatReservedSectors = 32
+	// FAT32 has at least 65525 clusters, and linuxkit uses 512 byte
+	// clusters for filesystems smaller than fatLargeSectors, 4K otherwise
+	fatMinClusters  = 65525
+	fatLargeSectors = 1 << 20
+	fatEOC          = 0x0fffffff
+
+	fatAttrVolume  = 0x08
+	fatAttrDir     = 0x10
+	fatAttrArchive = 0x20
+	fatAttrLFN     = 0x0f
+)
+
+// fatFile is a file of a FAT filesystem, by its path from the root
+type fatFile struct {
+	path string
+	data []byte
+}
+
+// fatNode is a file or directory of a FAT filesystem, with its short name
+// and whether it needs a long name for its name
+type fatNode struct {
+	name     string
+	short    [11]byte
+	long     bool
+	dir      bool
+	data     []byte
+	children []*fatNode
+	cluster  uint32
+	clusters uint32
+}
+
+// entries is the number of directory entries of a directory
+func (n *fatNode) entries(root bool, label string) int {
+	count := 2
+	if root {
+		count = 0
+		if label != "" {
+			count = 1
+		}
+	}
+	for _, c := range n.children {
+		count++
+		if c.long {
+			count += (len(utf16.Encode([]rune(c.name))) + 12) / 13
+		}
+	}
+	return count
+}
+
+func fatShortChar(r rune) bool {
+	return r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("$%'-_@~`!(){}^#&", r)
+}
+
+func fatShortPart(s string, max int) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == max {
+			break
+		}
+		if fatShortChar(r) {
+			b.WriteRune(r)
+		} else if r != ' ' && r != '.' {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// fatShortName is the 8.3 name of name in a directory with the short names
+// used, and whether name also needs a long name
+func fatShortName(name string, used map[[11]byte]bool) ([11]byte, bool) {
+	var short [11]byte
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	set := func(b, e string) [11]byte {
+		var s [11]byte
+		copy(s[:], fmt.Sprintf("%-8s%-3s", b, e))
+		return s
+	}
+	if b, e := fatShortPart(base, 8), fatShortPart(ext, 3); b == base && e == ext && b != "" {
+		if short = set(b, e); !used[short] {
+			return short, false
+		}
+	}
+	b, e := fatShortPart(base, 6), fatShortPart(ext, 3)
+	if b == "" {
+		b = "_"
+	}
+	for i := 1; ; i++ {
+		tail := fmt.Sprintf("~%d", i)
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		if short = set(b+tail, e); !used[short] {
+			return short, true
+		}
+	}
+}
+
+// fatTree is the tree of directories and files of files
+func fatTree(files []fatFile) (*fatNode, error) {
+	root := &fatNode{dir: true}
+	used := map[*fatNode]map[[11]byte]bool{}
+	for _, f := range files {
+		parts := strings.Split(strings.Trim(f.path, "/"), "/")
+		dir := root
+		for i, name := range parts {
+			if name == "" || name == "." || name == ".." {
+				return nil, fmt.Errorf("Invalid path %s", f.path)
+			}
+			var node *fatNode
+			for _, c := range dir.children {
+				if strings.EqualFold(c.name, name) {
+					node = c
+				}
+			}
+			last := i == len(parts)-1
+			if node != nil && (last || !node.dir) {
+				return nil, fmt.Errorf("%s is in the filesystem more than once", f.path)
+			}
+			if node == nil {
+				if used[dir] == nil {
+					used[dir] = map[[11]byte]bool{}
+				}
+				node = &fatNode{name: name, dir: !last}
+				node.short, node.long = fatShortName(name, used[dir])
+				used[dir][node.short] = true
+				if last {
+					node.data = f.data
+				}
+				dir.children = append(dir.children, node)
+			}
+			dir = node
+		}
+	}
+	return root, nil
+}
+
+// allocate gives the clusters from next to the node and what it has, and
+// returns the next free cluster
+func (n *fatNode) allocate(next uint32, clusterSize int, root bool, label string) uint32 {
+	size := len(n.data)
+	if n.dir {
+		size = n.entries(root, label) * 32
+		if size == 0 {
+			size = 1
+		}
+	}
+	n.clusters = uint32((size + clusterSize - 1) / clusterSize)
+	if n.clusters != 0 {
+		n.cluster = next
+		next += n.clusters
+	}
+	for _, c := range n.children {
+		next = c.allocate(next, clusterSize, false, "")
+	}
+	return next
+}
+
+func fatClusterSectors(sectors int64) int64 {
+	if sectors < fatLargeSectors {
+		return 1
+	}
+	return 8
+}
+
+// fatLayout is the size in sectors of each FAT and the number of clusters
+// of a FAT32 filesystem of sectors
+func fatLayout(sectors int64) (int64, int64) {
+	spc := fatClusterSectors(sectors)
+	fatSectors := ((sectors-fatReservedSectors)/spc + 2) * 4 / sectorSize
+	fatSectors++
+	return fatSectors, (sectors - fatReservedSectors - 2*fatSectors) / spc
+}
+
+// fatMinSectors is the size in sectors, in whole megabytes, of the smallest
+// FAT32 filesystem for files, leaving 1M free
+func fatMinSectors(files []fatFile) (int64, error) {
+	root, err := fatTree(files)
+	if err != nil {
+		return 0, err
+	}
+	for _, spc := range []int64{1, 8} {
+		clusters := int64(root.allocate(2, int(spc*sectorSize), true, "EFI")-2) + (1<<20)/(spc*sectorSize)
+		if clusters < fatMinClusters+64 {
+			clusters = fatMinClusters + 64
+		}
+		sectors := fatReservedSectors + 2*((clusters+2)*4/sectorSize+1) + clusters*spc
+		sectors = alignPartition(sectors)
+		if spc == 8 && sectors < fatLargeSectors {
+			sectors = fatLargeSectors
+		}
+		if fatClusterSectors(sectors) == spc {
+			return sectors, nil
+		}
+	}
+	return 0, nil
+}
+
+func fatDateTime(b []byte) {
+	t := defaultModTime
+	binary.LittleEndian.PutUint16(b[0:], uint16(t.Hour()<<11|t.Minute()<<5|t.Second()/2))
+	binary.LittleEndian.PutUint16(b[2:], uint16((t.Year()-1980)<<9|int(t.Month())<<5|t.Day()))
+}
+
+// fatEntry is a directory entry for a file or directory at cluster
+func fatEntry(name [11]byte, attr byte, cluster uint32, size int) []byte {
+	e := make([]byte, 32)
+	copy(e, name[:])
+	e[11] = attr
+	fatDateTime(e[14:])
+	copy(e[18:20], e[16:18])
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	copy(e[22:26], e[14:18])
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+	return e
+}
+
+// fatLongEntries are the long name entries of name before the entry of its
+// short name
+func fatLongEntries(name string, short [11]byte) []byte {
+	var sum byte
+	for _, b := range short {
+		sum = (sum&1)<<7 + sum>>1 + b
+	}
+	chars := utf16.Encode([]rune(name))
+	n := (len(chars) + 12) / 13
+	if len(chars) < n*13 {
+		chars = append(chars, 0)
+	}
+	for len(chars) < n*13 {
+		chars = append(chars, 0xffff)
+	}
+	var entries []byte
+	for seq := n; seq >= 1; seq-- {
+		e := make([]byte, 32)
+		e[0] = byte(seq)
+		if seq == n {
+			e[0] |= 0x40
+		}
+		e[11] = fatAttrLFN
+		e[13] = sum
+		for i, c := range chars[(seq-1)*13 : seq*13] {
+			off := 1 + 2*i
+			if i >= 5 {
+				off = 14 + 2*(i-5)
+			}
+			if i >= 11 {
+				off = 28 + 2*(i-11)
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		entries = append(entries, e...)
+	}
+	return entries
+}
+
+// writeFAT32 writes a FAT32 filesystem of sectors with label and files to w
+func writeFAT32(w io.WriterAt, sectors int64, label string, files []fatFile) error {
+	root, err := fatTree(files)
+	if err != nil {
+		return err
+	}
+	spc := fatClusterSectors(sectors)
+	clusterSize := int(spc * sectorSize)
+	fatSectors, clusters := fatLayout(sectors)
+	if clusters < fatMinClusters {
+		return fmt.Errorf("A FAT32 filesystem of %dM is too small", sectors*sectorSize>>20)
+	}
+	label = strings.ToUpper(label)
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	next := root.allocate(2, clusterSize, true, label)
+	if int64(next-2) > clusters {
+		return fmt.Errorf("The files need more than the %dM of the FAT32 filesystem", sectors*sectorSize>>20)
+	}
+
+	dataStart := (fatReservedSectors + 2*fatSectors) * sectorSize
+	offset := func(cluster uint32) int64 {
+		return dataStart + int64(cluster-2)*int64(clusterSize)
+	}
+	fat := make([]byte, fatSectors*sectorSize)
+	binary.LittleEndian.PutUint32(fat[0:], 0x0ffffff8)
+	binary.LittleEndian.PutUint32(fat[4:], fatEOC)
+	var write func(n, parent *fatNode) error
+	write = func(n, parent *fatNode) error {
+		for i := uint32(0); i < n.clusters; i++ {
+			c := n.cluster + i
+			link := c + 1
+			if i == n.clusters-1 {
+				link = fatEOC
+			}
+			binary.LittleEndian.PutUint32(fat[4*c:], link)
+		}
+		data := n.data
+		if n.dir {
+			data = nil
+			if parent == nil {
+				if label != "" {
+					var l [11]byte
+					copy(l[:], fmt.Sprintf("%-11s", label))
+					data = append(data, fatEntry(l, fatAttrVolume, 0, 0)...)
+				}
+			} else {
+				var dot, dotdot [11]byte
+				copy(dot[:], ".          ")
+				copy(dotdot[:], "..         ")
+				data = append(data, fatEntry(dot, fatAttrDir, n.cluster, 0)...)
+				parentCluster := parent.cluster
+				if parent == root {
+					parentCluster = 0
+				}
+				data = append(data, fatEntry(dotdot, fatAttrDir, parentCluster, 0)...)
+			}
+			for _, c := range n.children {
+				if c.long {
+					data = append(data, fatLongEntries(c.name, c.short)...)
+				}
+				if c.dir {
+					data = append(data, fatEntry(c.short, fatAttrDir, c.cluster, 0)...)
+				} else {
+					data = append(data, fatEntry(c.short, fatAttrArchive, c.cluster, len(c.data))...)
+				}
+			}
+		}
+		if len(data) != 0 {
+			if _, err := w.WriteAt(data, offset(n.cluster)); err != nil {
+				return err
+			}
+		}
+		for _, c := range n.children {
+			if err := write(c, n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(root, nil); err != nil {
+		return err
+	}
+	for i := int64(0); i < 2; i++ {
+		if _, err := w.WriteAt(fat, (fatReservedSectors+i*fatSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	boot := make([]byte, sectorSize)
+	copy(boot, []byte{0xeb, 0x58, 0x90})
+	copy(boot[3:], "LINUXKIT")
+	binary.LittleEndian.PutUint16(boot[11:], sectorSize)
+	boot[13] = byte(spc)
+	binary.LittleEndian.PutUint16(boot[14:], fatReservedSectors)
+	boot[16] = 2
+	boot[21] = 0xf8
+	binary.LittleEndian.PutUint16(boot[24:], 32)
+	binary.LittleEndian.PutUint16(boot[26:], 64)
+	binary.LittleEndian.PutUint32(boot[32:], uint32(sectors))
+	binary.LittleEndian.PutUint32(boot[36:], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(boot[44:], root.cluster)
+	binary.LittleEndian.PutUint16(boot[48:], 1)
+	binary.LittleEndian.PutUint16(boot[50:], 6)
+	boot[64] = 0x80
+	boot[66] = 0x29
+	copy(boot[67:], id[:])
+	copy(boot[71:], fmt.Sprintf("%-11s", label))
+	if label == "" {
+		copy(boot[71:], "NO NAME    ")
+	}
+	copy(boot[82:], "FAT32   ")
+	boot[510], boot[511] = 0x55, 0xaa
+
+	info := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:], uint32(clusters-int64(next-2)))
+	binary.LittleEndian.PutUint32(info[492:], next)
+	binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+	for _, s := range []int64{0, 6} {
+		if _, err := w.WriteAt(boot, s*sectorSize); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(info, (s+1)*sectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package moby
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sha256Regexp matches a sha256 hash in hex
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// fetchFile returns the contents of the file at rawurl, which must have the
+// sha256 hash if it is given. Files with a hash are cached in the files
+// directory of cacheDir, by URL and hash, so they are only downloaded once.
+func fetchFile(rawurl, hash, cacheDir string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("URL %s is not http or https", rawurl)
+	}
+	hash = strings.ToLower(hash)
+	if hash != "" && !sha256Regexp.MatchString(hash) {
+		return nil, fmt.Errorf("sha256 %q is not a sha256 hash in hex", hash)
+	}
+
+	var cached string
+	if hash != "" && cacheDir != "" {
+		cached = filepath.Join(cacheDir, "files", fmt.Sprintf("%x", sha256.Sum256([]byte(rawurl+"\n"+hash))))
+		if b, err := ioutil.ReadFile(cached); err == nil {
+			if fmt.Sprintf("%x", sha256.Sum256(b)) == hash {
+				log.Debugf("Using %s cached as %s", rawurl, cached)
+				return b, nil
+			}
+			log.Warnf("Cached %s does not match its sha256, fetching it again", cached)
+		}
+	}
+
+	log.Debugf("Fetching %s", rawurl)
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", rawurl, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", rawurl, err)
+	}
+	if hash != "" {
+		if got := fmt.Sprintf("%x", sha256.Sum256(b)); got != hash {
+			return nil, fmt.Errorf("sha256 of %s is %s, not %s", rawurl, got, hash)
+		}
+	}
+
+	if cached != "" {
+		if err := writeCached(cached, b); err != nil {
+			log.Warnf("Cannot cache %s: %v", rawurl, err)
+		}
+	}
+	return b, nil
+}
+
+// writeCached writes b to path, through a temporary file so that an
+// interrupted write is not taken for the file
+func writeCached(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
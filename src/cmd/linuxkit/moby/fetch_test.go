@@ -0,0 +1,145 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fetchContents = "#!/bin/sh\necho fetched\n"
+
+var fetchHash = fmt.Sprintf("%x", sha256.Sum256([]byte(fetchContents)))
+
+// fetchServer serves fetchContents at /tool, counting the requests
+func fetchServer(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.URL.Path != "/tool" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, fetchContents)
+	}))
+}
+
+func fetchCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fetch")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestFetchFileCached(t *testing.T) {
+	var requests int32
+	s := fetchServer(&requests)
+	defer s.Close()
+	cacheDir := fetchCacheDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	for i := 0; i < 2; i++ {
+		b, err := fetchFile(s.URL+"/tool", fetchHash, cacheDir)
+		require.NoError(t, err)
+		assert.Equal(t, fetchContents, string(b))
+	}
+	assert.Equal(t, int32(1), requests, "the second fetch is from the cache")
+
+	// a corrupted cache entry is fetched again
+	entries, err := ioutil.ReadDir(filepath.Join(cacheDir, "files"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, "files", entries[0].Name()), []byte("corrupted"), 0644))
+	b, err := fetchFile(s.URL+"/tool", fetchHash, cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, fetchContents, string(b))
+	assert.Equal(t, int32(2), requests)
+
+	// without a hash it is fetched every time
+	for i := 0; i < 2; i++ {
+		b, err := fetchFile(s.URL+"/tool", "", cacheDir)
+		require.NoError(t, err)
+		assert.Equal(t, fetchContents, string(b))
+	}
+	assert.Equal(t, int32(4), requests)
+}
+
+func TestFetchFileErrors(t *testing.T) {
+	var requests int32
+	s := fetchServer(&requests)
+	defer s.Close()
+	cacheDir := fetchCacheDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	wrong := fmt.Sprintf("%x", sha256.Sum256([]byte("something else")))
+	_, err := fetchFile(s.URL+"/tool", wrong, cacheDir)
+	require.Error(t, err)
+	assert.Equal(t, "sha256 of "+s.URL+"/tool is "+fetchHash+", not "+wrong, err.Error())
+	// what does not match is not cached
+	_, err = os.Stat(filepath.Join(cacheDir, "files"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = fetchFile(s.URL+"/missing", "", cacheDir)
+	assert.EqualError(t, err, "GET "+s.URL+"/missing: 404 Not Found")
+	_, err = fetchFile("file:///etc/passwd", "", cacheDir)
+	assert.Error(t, err)
+	_, err = fetchFile(s.URL+"/tool", "abc", cacheDir)
+	assert.Error(t, err)
+}
+
+func TestFilesystemURL(t *testing.T) {
+	var requests int32
+	s := fetchServer(&requests)
+	defer s.Close()
+	cacheDir := fetchCacheDir(t)
+	defer os.RemoveAll(cacheDir)
+
+	m, err := NewConfig([]byte(fmt.Sprintf(`files:
+  - path: usr/bin/tool
+    url: %s/tool
+    sha256: %s
+    mode: "0755"
+`, s.URL, fetchHash)))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, filesystem(m, tw, map[string]uint32{}, cacheDir))
+	require.NoError(t, tw.Close())
+
+	files := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(b)
+		if h.Name == "usr/bin/tool" {
+			assert.Equal(t, int64(0755), h.Mode)
+		}
+	}
+	assert.Equal(t, map[string]string{"usr": "", "usr/bin": "", "usr/bin/tool": fetchContents}, files)
+
+	for _, f := range []File{
+		{Path: "a", URL: s.URL + "/tool", Source: "tool"},
+		{Path: "a", URL: s.URL + "/tool", Metadata: "yaml"},
+		{Path: "a", URL: s.URL + "/tool", Directory: true},
+		{Path: "a", Source: "tool", SHA256: fetchHash},
+		{Path: "a", URL: s.URL + "/tool", SHA256: fmt.Sprintf("%x", sha256.Sum256(nil))},
+	} {
+		err := filesystem(Moby{Files: []File{f}}, tar.NewWriter(ioutil.Discard), map[string]uint32{}, cacheDir)
+		assert.Error(t, err, "%+v", f)
+	}
+}
@@ -0,0 +1,110 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/initrd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/surma/gocpio"
+)
+
+// cpioEntry is the metadata of an initrd entry
+type cpioEntry struct {
+	mode     int64
+	uid, gid int
+	typ      int64
+	contents string
+}
+
+// filesInitrd adds the files of the config to an initrd, as the
+// kernel+initrd outputs do, and returns its entries
+func filesInitrd(t *testing.T, config string, idMap map[string]uint32) map[string]cpioEntry {
+	m, err := NewConfig([]byte(config))
+	require.NoError(t, err)
+	var tb bytes.Buffer
+	tw := tar.NewWriter(&tb)
+	require.NoError(t, filesystem(m, tw, idMap, ""))
+	require.NoError(t, tw.Close())
+
+	var cb bytes.Buffer
+	w := initrd.NewWriter(&cb)
+	_, err = initrd.CopyTar(w, tar.NewReader(&tb))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	entries := map[string]cpioEntry{}
+	zr, err := gzip.NewReader(&cb)
+	require.NoError(t, err)
+	cr := cpio.NewReader(zr)
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.IsTrailer() {
+			break
+		}
+		b, err := ioutil.ReadAll(cr)
+		require.NoError(t, err)
+		entries[hdr.Name] = cpioEntry{mode: hdr.Mode, uid: hdr.Uid, gid: hdr.Gid, typ: hdr.Type, contents: string(b)}
+	}
+	return entries
+}
+
+func TestFilesOwnershipAndMode(t *testing.T) {
+	entries := filesInitrd(t, `files:
+  - path: etc/app/config
+    contents: "key: value"
+    mode: "0640"
+    uid: app
+    gid: "1001"
+  - path: etc/app/run
+    directory: true
+    mode: "0750"
+    uid: 100
+    gid: 101
+  - path: usr/bin/setuid
+    contents: ""
+    mode: "4755"
+  - path: etc/app/current
+    symlink: /etc/app/config
+  - path: etc/default
+    contents: "unset"
+`, map[string]uint32{"app": 1000})
+
+	assert.Equal(t, map[string]cpioEntry{
+		// leading directories get the ownership of the file, and
+		// search permission where it is readable
+		"etc":             {mode: 0750, uid: 1000, gid: 1001, typ: cpio.TYPE_DIR},
+		"etc/app":         {mode: 0750, uid: 1000, gid: 1001, typ: cpio.TYPE_DIR},
+		"etc/app/config":  {mode: 0640, uid: 1000, gid: 1001, typ: cpio.TYPE_REG, contents: "key: value"},
+		"etc/app/run":     {mode: 0750, uid: 100, gid: 101, typ: cpio.TYPE_DIR},
+		"usr":             {mode: 04755, typ: cpio.TYPE_DIR},
+		"usr/bin":         {mode: 04755, typ: cpio.TYPE_DIR},
+		"usr/bin/setuid":  {mode: 04755, typ: cpio.TYPE_REG},
+		"etc/app/current": {mode: 0600, typ: cpio.TYPE_SYMLINK, contents: "/etc/app/config"},
+		"etc/default":     {mode: 0600, typ: cpio.TYPE_REG, contents: "unset"},
+	}, entries)
+}
+
+func TestFilesInvalid(t *testing.T) {
+	for _, f := range []File{
+		{Path: "a", Directory: true, Symlink: "b"},
+		{Path: "a", Symlink: "b", Contents: new(string)},
+		{Path: "a", Directory: true, Contents: new(string)},
+		{Path: "a", Contents: new(string), Mode: "10644"},
+		{Path: "a", Contents: new(string), Mode: "rw"},
+		{Path: "a", Contents: new(string), UID: "nobody"},
+		{Path: "a", Contents: new(string), GID: -1},
+	} {
+		err := filesystem(Moby{Files: []File{f}}, tar.NewWriter(ioutil.Discard), map[string]uint32{}, "")
+		assert.Error(t, err, "%+v", f)
+	}
+}
@@ -317,27 +317,41 @@ func ImageTar(ref *reference.Spec, prefix string, tw tarWriter, pull bool, resol
 	return nil
 }
 
-// ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json
-func ImageBundle(prefix string, ref *reference.Spec, config []byte, runtime Runtime, tw tarWriter, pull bool, readonly bool, dupMap map[string]string, cacheDir string, dockerCache bool, architecture string) error { // nolint: lll
+// ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json,
+// leaving out the paths of the image matching exclude
+func ImageBundle(prefix string, ref *reference.Spec, exclude []string, config []byte, runtime Runtime, tw tarWriter, pull bool, readonly bool, dupMap map[string]string, cacheDir string, dockerCache bool, architecture string) error { // nolint: lll
 	// if read only, just unpack in rootfs/ but otherwise set up for overlay
 	rootExtract := "rootfs"
 	if !readonly {
 		rootExtract = "lower"
 	}
 
-	// See if we have extracted this image previously
+	// See if we have extracted this image previously, with the same
+	// paths left out
 	root := path.Join(prefix, rootExtract)
-	var foundElsewhere = dupMap[ref.String()] != ""
+	dupKey := ref.String()
+	if len(exclude) > 0 {
+		dupKey += " exclude " + strings.Join(exclude, " ")
+	}
+	var foundElsewhere = dupMap[dupKey] != ""
 	if !foundElsewhere {
-		if err := ImageTar(ref, root+"/", tw, pull, "", cacheDir, dockerCache, architecture); err != nil {
+		itw := tw
+		if len(exclude) > 0 {
+			f, err := newExcludeFilter(tw, root+"/", exclude)
+			if err != nil {
+				return err
+			}
+			itw = f
+		}
+		if err := ImageTar(ref, root+"/", itw, pull, "", cacheDir, dockerCache, architecture); err != nil {
 			return err
 		}
-		dupMap[ref.String()] = root
+		dupMap[dupKey] = root
 	} else {
 		if err := tarPrefix(prefix+"/", tw); err != nil {
 			return err
 		}
-		root = dupMap[ref.String()]
+		root = dupMap[dupKey]
 	}
 
 	hdr := &tar.Header{
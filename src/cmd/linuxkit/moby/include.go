@@ -0,0 +1,155 @@
+package moby
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+)
+
+// ConfigReader reads the config at location, a file or an http(s) URL
+type ConfigReader func(location string) ([]byte, error)
+
+// ResolveIncludes merges the configs listed in the include section of m,
+// read from location, into it. Each include is merged over the ones
+// before it and m over all of them, so a later include overrides an
+// earlier one and m overrides its includes, see MergeConfig. Includes may
+// include other configs, but not one which includes them. A relative
+// include is relative to the config that includes it, or to the current
+// directory if location is "", such as for stdin.
+func ResolveIncludes(m Moby, location string, read ConfigReader) (Moby, error) {
+	return resolveIncludes(m, location, read, nil)
+}
+
+func resolveIncludes(m Moby, location string, read ConfigReader, stack []string) (Moby, error) {
+	if location != "" {
+		stack = append(stack, location)
+	}
+	var merged Moby
+	for _, include := range m.Include {
+		inc, err := includeLocation(location, include)
+		if err != nil {
+			return m, err
+		}
+		for _, l := range stack {
+			if l == inc {
+				return m, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), inc)
+			}
+		}
+		config, err := read(inc)
+		if err != nil {
+			return m, fmt.Errorf("Cannot include %s: %v", inc, err)
+		}
+		c, err := NewConfig(config)
+		if err != nil {
+			return m, fmt.Errorf("Invalid config %s: %v", inc, err)
+		}
+		if c, err = resolveIncludes(c, inc, read, stack); err != nil {
+			return m, err
+		}
+		merged = MergeConfig(merged, c)
+	}
+	m.Include = nil
+	return MergeConfig(merged, m), nil
+}
+
+// includeLocation is the location of include, included from location
+func includeLocation(location, include string) (string, error) {
+	if strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://") {
+		return include, nil
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		base, err := url.Parse(location)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(filepath.ToSlash(include))
+		if err != nil {
+			return "", fmt.Errorf("invalid include %s: %v", include, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	if !filepath.IsAbs(include) && location != "" {
+		include = filepath.Join(filepath.Dir(location), include)
+	}
+	return filepath.Abs(include)
+}
+
+// MergeConfig merges m1 over m0. Unlike AppendConfig, an onboot,
+// onshutdown or service image of m1 replaces the one of m0 with the same
+// name, and a file the one with the same path, in place. Other images and
+// files of m1 are added after those of m0, and the init images of m1
+// which m0 does not have already. Kernel settings of m1 override those of
+// m0.
+func MergeConfig(m0, m1 Moby) Moby {
+	moby := m0
+	if m1.Kernel.Image != "" {
+		moby.Kernel.Image = m1.Kernel.Image
+		moby.Kernel.ref = m1.Kernel.ref
+	}
+	if m1.Kernel.Cmdline != "" {
+		moby.Kernel.Cmdline = m1.Kernel.Cmdline
+	}
+	if m1.Kernel.Binary != "" {
+		moby.Kernel.Binary = m1.Kernel.Binary
+	}
+	if m1.Kernel.Tar != nil {
+		moby.Kernel.Tar = m1.Kernel.Tar
+	}
+	if m1.Kernel.UCode != nil {
+		moby.Kernel.UCode = m1.Kernel.UCode
+	}
+	moby.Init, moby.initRefs = append([]string{}, m0.Init...), append([]*reference.Spec{}, m0.initRefs...)
+	for i, ii := range m1.Init {
+		if !contains(moby.Init, ii) {
+			moby.Init = append(moby.Init, ii)
+			moby.initRefs = append(moby.initRefs, m1.initRefs[i])
+		}
+	}
+	moby.Onboot = mergeImages(m0.Onboot, m1.Onboot)
+	moby.Onshutdown = mergeImages(m0.Onshutdown, m1.Onshutdown)
+	moby.Services = mergeImages(m0.Services, m1.Services)
+	moby.Files = append([]File{}, m0.Files...)
+	for _, f := range m1.Files {
+		replaced := false
+		for i := range moby.Files {
+			if moby.Files[i].Path == f.Path {
+				moby.Files[i], replaced = f, true
+			}
+		}
+		if !replaced {
+			moby.Files = append(moby.Files, f)
+		}
+	}
+	if m1.Architecture != "" {
+		moby.Architecture = m1.Architecture
+	}
+	return moby
+}
+
+func mergeImages(images0, images1 []*Image) []*Image {
+	images := append([]*Image{}, images0...)
+	for _, image := range images1 {
+		replaced := false
+		for i := range images {
+			if images[i].Name == image.Name {
+				images[i], replaced = image, true
+			}
+		}
+		if !replaced {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package moby
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConfigs is a ConfigReader of the configs it holds
+type testConfigs map[string]string
+
+func (c testConfigs) read(location string) ([]byte, error) {
+	config, ok := c[location]
+	if !ok {
+		return nil, fmt.Errorf("no such config %s", location)
+	}
+	return []byte(config), nil
+}
+
+func resolveTestConfig(t *testing.T, configs testConfigs, location string) (Moby, error) {
+	m, err := NewConfig([]byte(configs[location]))
+	require.NoError(t, err)
+	return ResolveIncludes(m, location, configs.read)
+}
+
+func serviceImages(m Moby) map[string]string {
+	images := map[string]string{}
+	for _, s := range m.Services {
+		images[s.Name] = s.Image
+	}
+	return images
+}
+
+func TestIncludePrecedence(t *testing.T) {
+	root, err := filepath.Abs(string(os.PathSeparator))
+	require.NoError(t, err)
+	dir := filepath.Join(root, "configs")
+	configs := testConfigs{
+		filepath.Join(dir, "main.yml"): `
+include:
+  - common/base.yml
+  - ` + filepath.Join(root, "site.yml") + `
+kernel:
+  cmdline: "console=ttyS0"
+services:
+  - name: sshd
+    image: linuxkit/sshd:main
+`,
+		filepath.Join(dir, "common", "base.yml"): `
+include:
+  - ../../kernel.yml
+kernel:
+  image: linuxkit/kernel:base
+init:
+  - linuxkit/init:v1
+services:
+  - name: getty
+    image: linuxkit/getty:base
+  - name: sshd
+    image: linuxkit/sshd:base
+  - name: rngd
+    image: linuxkit/rngd:base
+files:
+  - path: etc/motd
+    contents: base
+`,
+		filepath.Join(root, "kernel.yml"): `
+kernel:
+  image: linuxkit/kernel:included
+  cmdline: "console=tty0"
+`,
+		filepath.Join(root, "site.yml"): `
+init:
+  - linuxkit/init:v1
+  - linuxkit/runc:v1
+services:
+  - name: getty
+    image: linuxkit/getty:site
+files:
+  - path: etc/motd
+    contents: site
+  - path: etc/issue
+    contents: site
+`,
+	}
+
+	m, err := resolveTestConfig(t, configs, filepath.Join(dir, "main.yml"))
+	require.NoError(t, err)
+	assert.Empty(t, m.Include)
+	// base overrides the kernel it includes, main the cmdline
+	assert.Equal(t, "linuxkit/kernel:base", m.Kernel.Image)
+	assert.Equal(t, "docker.io/linuxkit/kernel:base", m.Kernel.ref.String())
+	assert.Equal(t, "console=ttyS0", m.Kernel.Cmdline)
+	assert.Equal(t, []string{"linuxkit/init:v1", "linuxkit/runc:v1"}, m.Init)
+	assert.Len(t, m.initRefs, 2)
+	// site overrides base, main overrides both, in the order of base
+	assert.Equal(t, map[string]string{
+		"getty": "linuxkit/getty:site",
+		"sshd":  "linuxkit/sshd:main",
+		"rngd":  "linuxkit/rngd:base",
+	}, serviceImages(m))
+	assert.Equal(t, "getty", m.Services[0].Name)
+	assert.Equal(t, "sshd", m.Services[1].Name)
+	require.Len(t, m.Files, 2)
+	assert.Equal(t, "etc/motd", m.Files[0].Path)
+	assert.Equal(t, "site", *m.Files[0].Contents)
+	assert.Equal(t, "etc/issue", m.Files[1].Path)
+}
+
+func TestIncludeURL(t *testing.T) {
+	configs := testConfigs{
+		"https://example.com/linuxkit/main.yml": `
+include:
+  - services/getty.yml
+services:
+  - name: sshd
+    image: linuxkit/sshd:v1
+`,
+		"https://example.com/linuxkit/services/getty.yml": `
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+`,
+	}
+	m, err := resolveTestConfig(t, configs, "https://example.com/linuxkit/main.yml")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"getty": "linuxkit/getty:v1", "sshd": "linuxkit/sshd:v1"}, serviceImages(m))
+}
+
+func TestIncludeCycle(t *testing.T) {
+	root, err := filepath.Abs(string(os.PathSeparator))
+	require.NoError(t, err)
+	a, b, c, shared := filepath.Join(root, "a.yml"), filepath.Join(root, "b.yml"), filepath.Join(root, "c.yml"), filepath.Join(root, "shared.yml")
+	configs := testConfigs{
+		a:      "include: [b.yml]\n",
+		b:      "include: [c.yml]\n",
+		c:      "include: [a.yml]\n",
+		shared: "services:\n  - name: getty\n    image: linuxkit/getty:v1\n",
+	}
+	_, err = resolveTestConfig(t, configs, a)
+	assert.EqualError(t, err, fmt.Sprintf("include cycle: %s -> %s -> %s -> %s", a, b, c, a))
+
+	configs[a] = "include: [a.yml]\n"
+	_, err = resolveTestConfig(t, configs, a)
+	assert.EqualError(t, err, fmt.Sprintf("include cycle: %s -> %s", a, a))
+
+	// including the same config twice is not a cycle
+	configs[a] = "include: [shared.yml, b.yml]\n"
+	configs[b] = "include: [shared.yml]\n"
+	m, err := resolveTestConfig(t, configs, a)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"getty": "linuxkit/getty:v1"}, serviceImages(m))
+}
+
+func TestAnchors(t *testing.T) {
+	m, err := NewConfig([]byte(`
+x-service: &service
+  image: linuxkit/getty:v1
+  net: host
+services:
+  - <<: *service
+    name: getty
+  - <<: *service
+    name: getty-serial
+    image: linuxkit/getty:serial
+`))
+	require.NoError(t, err)
+	require.Len(t, m.Services, 2)
+	assert.Equal(t, "linuxkit/getty:v1", m.Services[0].Image)
+	assert.Equal(t, "host", m.Services[0].Net)
+	assert.Equal(t, "linuxkit/getty:serial", m.Services[1].Image)
+	assert.Equal(t, "host", m.Services[1].Net)
+
+	_, err = NewConfig([]byte("common: {}\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package moby
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// inputTars adds the contents of the tarballs paths, which may be gzip
+// compressed, to tw, in the order given, so that a later one replaces what
+// the rootfs or an earlier one has at the same path when it is extracted.
+// Modes, ownership and timestamps are kept as they are in the tarballs.
+func inputTars(tw *tar.Writer, paths []string) error {
+	if len(paths) != 0 {
+		log.Infof("Add input tarballs:")
+	}
+	for _, p := range paths {
+		log.Infof("  %s", p)
+		if err := inputTar(tw, p); err != nil {
+			return fmt.Errorf("Cannot add input tarball %s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func inputTar(tw *tar.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+
+	// symlinks of the tarball, which entries must not be written through
+	symlinks := map[string]bool{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := inputTarPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			// the root of the tarball
+			continue
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if symlinks[dir] {
+				return fmt.Errorf("%s is under the symlink %s", hdr.Name, dir)
+			}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		case tar.TypeSymlink:
+			symlinks[name] = true
+		case tar.TypeLink:
+			if hdr.Linkname, err = inputTarPath(hdr.Linkname); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s is of unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			delete(symlinks, name)
+		}
+		hdr.Name = name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// inputTarPath is the path of an entry of an input tarball in the rootfs,
+// without a leading / or ./, "" for its root. Entries with a .. in their
+// path could be extracted outside of the rootfs, and are rejected.
+func inputTarPath(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s is outside of the rootfs", name)
+		}
+	}
+	name = path.Clean("/" + name)[1:]
+	return name, nil
+}
@@ -0,0 +1,160 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeInputTar writes the tarball file with the entries hdrs, regular
+// files having the contents of their Linkname
+func writeInputTar(t *testing.T, file string, compress bool, hdrs ...tar.Header) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		var contents string
+		if hdr.Typeflag == tar.TypeReg {
+			contents, hdr.Linkname = hdr.Linkname, ""
+			hdr.Size = int64(len(contents))
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	b := buf.Bytes()
+	if compress {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		_, err := zw.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		b = zbuf.Bytes()
+	}
+	require.NoError(t, ioutil.WriteFile(file, b, 0644))
+}
+
+// extracted is what extracting the tarball b leaves at each path, the last
+// entry for it
+func extracted(t *testing.T, b []byte) map[string]tar.Header {
+	entries := map[string]tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			contents, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			hdr.Linkname = string(contents)
+		}
+		entries[hdr.Name] = *hdr
+	}
+}
+
+func TestBuildInputTars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "input-tar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { MobyDir = d }(MobyDir)
+	MobyDir = dir
+
+	first := filepath.Join(dir, "first.tar")
+	writeInputTar(t, first, false,
+		tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "./etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Linkname: "first\n"},
+		tar.Header{Name: "./etc/secret", Typeflag: tar.TypeReg, Mode: 0600, Uid: 100, Gid: 101, Linkname: "key"},
+		tar.Header{Name: "./usr/bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Linkname: "#!/bin/sh\n"},
+	)
+	second := filepath.Join(dir, "second.tar.gz")
+	writeInputTar(t, second, true,
+		tar.Header{Name: "/etc/motd", Typeflag: tar.TypeReg, Mode: 0444, Linkname: "second\n"},
+		tar.Header{Name: "etc/hostname", Typeflag: tar.TypeSymlink, Linkname: "/run/hostname"},
+		tar.Header{Name: "usr/bin/tool2", Typeflag: tar.TypeLink, Linkname: "./usr/bin/tool"},
+	)
+
+	m, err := NewConfig([]byte("files:\n  - path: etc/motd\n    contents: config\n  - path: etc/issue\n    contents: issue\n"))
+	require.NoError(t, err)
+	m.InputTars = []string{first, second}
+	var buf bytes.Buffer
+	require.NoError(t, Build(m, &buf, false, "", false, filepath.Join(dir, "cache"), false))
+	entries := extracted(t, buf.Bytes())
+
+	// the files of the config are replaced by the first tarball, and those
+	// of the first by the second
+	assert.Equal(t, "second\n", entries["etc/motd"].Linkname)
+	assert.Equal(t, int64(0444), entries["etc/motd"].Mode)
+	assert.Equal(t, "issue", entries["etc/issue"].Linkname)
+	assert.Equal(t, "key", entries["etc/secret"].Linkname)
+	assert.Equal(t, int64(0600), entries["etc/secret"].Mode)
+	assert.Equal(t, 100, entries["etc/secret"].Uid)
+	assert.Equal(t, 101, entries["etc/secret"].Gid)
+	assert.Equal(t, int64(04755), entries["usr/bin/tool"].Mode)
+	assert.Equal(t, byte(tar.TypeSymlink), entries["etc/hostname"].Typeflag)
+	assert.Equal(t, "/run/hostname", entries["etc/hostname"].Linkname)
+	assert.Equal(t, byte(tar.TypeLink), entries["usr/bin/tool2"].Typeflag)
+	assert.Equal(t, "usr/bin/tool", entries["usr/bin/tool2"].Linkname)
+	assert.NotContains(t, entries, "")
+	assert.NotContains(t, entries, ".")
+}
+
+func TestInputTarTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "input-tar")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		hdrs []tar.Header
+		err  string
+	}{
+		{
+			[]tar.Header{{Name: "../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			"../etc/passwd is outside of the rootfs",
+		},
+		{
+			[]tar.Header{{Name: "etc/../../passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			"etc/../../passwd is outside of the rootfs",
+		},
+		{
+			// even when it stays inside
+			[]tar.Header{{Name: "etc/../passwd", Typeflag: tar.TypeReg, Mode: 0644}},
+			"etc/../passwd is outside of the rootfs",
+		},
+		{
+			[]tar.Header{{Name: "etc/shadow", Typeflag: tar.TypeLink, Linkname: "../../etc/shadow"}},
+			"../../etc/shadow is outside of the rootfs",
+		},
+		{
+			[]tar.Header{
+				{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			"etc/passwd is under the symlink etc",
+		},
+	} {
+		file := filepath.Join(dir, "input.tar")
+		writeInputTar(t, file, false, c.hdrs...)
+		err := inputTars(tar.NewWriter(ioutil.Discard), []string{file})
+		assert.EqualError(t, err, "Cannot add input tarball "+file+": "+c.err)
+	}
+
+	// a symlink replaced by a directory can have entries under it
+	file := filepath.Join(dir, "replaced.tar")
+	writeInputTar(t, file, false,
+		tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	assert.NoError(t, inputTars(tar.NewWriter(ioutil.Discard), []string{file}))
+}
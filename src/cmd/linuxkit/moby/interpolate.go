@@ -0,0 +1,142 @@
+package moby
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lookupEnv looks up the values of the variables in a config
+var lookupEnv = os.LookupEnv
+
+// allowUnset is whether a variable may be unset with no default
+var allowUnset bool
+
+// SetAllowUnset sets whether a config may refer to an unset variable with
+// no default, which is then replaced by an empty string, rather than being
+// rejected
+func SetAllowUnset(allow bool) {
+	allowUnset = allow
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// interpolate replaces ${VAR} in s with the value of the environment
+// variable VAR, and ${VAR:-default} with default if VAR is unset or empty.
+// $$ is a literal $, as is a $ followed by anything else.
+func interpolate(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in %q", s)
+			}
+			value, err := expand(s[i+2:i+end], s)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// expand returns the value of the variable reference ref, VAR or
+// VAR:-default, found in s
+func expand(ref, s string) (string, error) {
+	name, def, hasDefault := ref, "", false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		name, def, hasDefault = ref[:i], ref[i+2:], true
+	}
+	if !variableName.MatchString(name) {
+		return "", fmt.Errorf("invalid variable ${%s} in %q", ref, s)
+	}
+	value, ok := lookupEnv(name)
+	switch {
+	case hasDefault && value == "":
+		return def, nil
+	case !ok && allowUnset:
+		log.Warnf("Variable %s is not set, using an empty string", name)
+	case !ok:
+		return "", fmt.Errorf("variable %s is not set, in %q", name, s)
+	}
+	return value, nil
+}
+
+// interpolateConfig interpolates the variables in the strings of m. Fields
+// tagged interpolate:"-", such as file contents and commands, are often
+// shell scripts, with variables of their own, so they are left as they are.
+func interpolateConfig(m *Moby) error {
+	return interpolateValue(reflect.ValueOf(m).Elem())
+}
+
+func interpolateValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := interpolate(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return interpolateValue(v.Elem())
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// the value in an interface cannot be set, so replace it
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		if err := interpolateValue(e); err != nil {
+			return err
+		}
+		v.Set(e)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" || f.Tag.Get("interpolate") == "-" {
+				continue
+			}
+			if err := interpolateValue(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := interpolateValue(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			if err := interpolateValue(e); err != nil {
+				return err
+			}
+			v.SetMapIndex(k, e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package moby
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestEnv makes env the environment of the configs for the test
+func setTestEnv(t *testing.T, env map[string]string, allow bool) {
+	oldLookupEnv, oldAllowUnset := lookupEnv, allowUnset
+	t.Cleanup(func() { lookupEnv, allowUnset = oldLookupEnv, oldAllowUnset })
+	lookupEnv = func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	allowUnset = allow
+}
+
+func TestInterpolate(t *testing.T) {
+	setTestEnv(t, map[string]string{"TAG": "v1.2", "EMPTY": ""}, false)
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"linuxkit/sshd:${TAG}", "linuxkit/sshd:v1.2"},
+		{"${TAG}-${TAG}", "v1.2-v1.2"},
+		{"linuxkit/sshd:${UNSET:-latest}", "linuxkit/sshd:latest"},
+		{"${TAG:-latest}", "v1.2"},
+		{"${EMPTY:-default}", "default"},
+		{"${EMPTY}", ""},
+		{"${UNSET:-}", ""},
+		{"costs $$5, not $${TAG}", "costs $5, not ${TAG}"},
+		{"root:$6$salt$hash $(date) $", "root:$6$salt$hash $(date) $"},
+	} {
+		out, err := interpolate(tc.in)
+		require.NoError(t, err, tc.in)
+		assert.Equal(t, tc.out, out, tc.in)
+	}
+
+	_, err := interpolate("linuxkit/sshd:${UNSET}")
+	assert.EqualError(t, err, `variable UNSET is not set, in "linuxkit/sshd:${UNSET}"`)
+	_, err = interpolate("${TAG")
+	assert.EqualError(t, err, `unterminated variable in "${TAG"`)
+	_, err = interpolate("${1TAG}")
+	assert.EqualError(t, err, `invalid variable ${1TAG} in "${1TAG}"`)
+}
+
+func TestInterpolateAllowUnset(t *testing.T) {
+	setTestEnv(t, map[string]string{}, true)
+	out, err := interpolate("linuxkit/sshd:${UNSET}x")
+	require.NoError(t, err)
+	assert.Equal(t, "linuxkit/sshd:x", out)
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	setTestEnv(t, map[string]string{"VERSION": "v0.8", "USER": "redis"}, false)
+	m, err := NewConfig([]byte(`
+kernel:
+  image: linuxkit/kernel:${KERNEL:-5.10.104}
+init:
+  - linuxkit/init:${VERSION}
+services:
+  - name: redis
+    image: redis:${VERSION}
+    command: ["/bin/sh", "-c", "echo $$HOME ${USER}"]
+    env:
+      - USER=${USER}
+    sysctl:
+      net.core.somaxconn: "${SOMAXCONN:-1024}"
+files:
+  - path: etc/motd
+    contents: "built at ${VERSION}"
+    uid: ${USER}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "linuxkit/kernel:5.10.104", m.Kernel.Image)
+	assert.Equal(t, "docker.io/linuxkit/kernel:5.10.104", m.Kernel.ref.String())
+	assert.Equal(t, []string{"linuxkit/init:v0.8"}, m.Init)
+	assert.Equal(t, "docker.io/linuxkit/init:v0.8", m.initRefs[0].String())
+	assert.Equal(t, "redis:v0.8", m.Services[0].Image)
+	assert.Equal(t, []string{"/bin/sh", "-c", "echo $$HOME ${USER}"}, *m.Services[0].Command)
+	assert.Equal(t, []string{"USER=redis"}, *m.Services[0].Env)
+	assert.Equal(t, map[string]string{"net.core.somaxconn": "1024"}, *m.Services[0].Sysctl)
+	assert.Equal(t, "built at ${VERSION}", *m.Files[0].Contents)
+	assert.Equal(t, "redis", m.Files[0].UID)
+
+	_, err = NewConfig([]byte("init:\n  - linuxkit/init:${UNSET}\n"))
+	assert.EqualError(t, err, `variable UNSET is not set, in "linuxkit/init:${UNSET}"`)
+}
+
+func TestInterpolateConfigScripts(t *testing.T) {
+	// HOME is unset, so any interpolation of the scripts fails
+	setTestEnv(t, map[string]string{"VERSION": "v0.8"}, false)
+	script := `#!/bin/sh
+set -e
+name=${1}
+echo "$name of ${HOME:-/root} in $$" > /tmp/${NAME:-out}
+`
+	m, err := NewConfig([]byte(`
+onboot:
+  - name: setup
+    image: linuxkit/alpine:${VERSION}
+    command: ["/bin/sh", "-c", "echo ${HOME} $$"]
+files:
+  - path: usr/bin/setup
+    mode: "0755"
+    contents: |
+      #!/bin/sh
+      set -e
+      name=${1}
+      echo "$name of ${HOME:-/root} in $$" > /tmp/${NAME:-out}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "linuxkit/alpine:v0.8", m.Onboot[0].Image)
+	assert.Equal(t, []string{"/bin/sh", "-c", "echo ${HOME} $$"}, *m.Onboot[0].Command)
+	assert.Equal(t, script, *m.Files[0].Contents)
+}
@@ -0,0 +1,96 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// elToritoPlatforms are the platform IDs of the bootable El Torito entries
+// of an ISO, 0 for BIOS and 0xef for UEFI
+func elToritoPlatforms(t *testing.T, r io.ReaderAt) []byte {
+	const isoSector = 2048
+	brvd := make([]byte, isoSector)
+	_, err := r.ReadAt(brvd, 17*isoSector)
+	require.NoError(t, err)
+	require.Equal(t, "\x00CD001", string(brvd[:6]), "the boot record volume descriptor")
+	require.Equal(t, "EL TORITO SPECIFICATION", string(bytes.TrimRight(brvd[7:39], "\x00")))
+	catalog := make([]byte, isoSector)
+	_, err = r.ReadAt(catalog, int64(binary.LittleEndian.Uint32(brvd[0x47:]))*isoSector)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), catalog[0], "the validation entry")
+	require.Equal(t, []byte{0x55, 0xaa}, catalog[30:32])
+
+	var platforms []byte
+	if catalog[32] == 0x88 {
+		platforms = append(platforms, catalog[1])
+	}
+	for off := 64; off+32 <= len(catalog); {
+		header := catalog[off : off+32]
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		off += 32
+		for n := binary.LittleEndian.Uint16(header[2:]); n > 0 && off+32 <= len(catalog); n-- {
+			if catalog[off] == 0x88 {
+				platforms = append(platforms, header[1])
+			}
+			off += 32
+		}
+		if header[0] == 0x91 {
+			break
+		}
+	}
+	return platforms
+}
+
+// TestOutputIsoEFI builds an iso-efi with the mkimage-iso-efi image, and
+// checks it boots on UEFI, and on BIOS as a hybrid ISO on x86_64, with
+// xorriso reporting its El Torito entries
+func TestOutputIsoEFI(t *testing.T) {
+	for _, tool := range []string{"docker", "xorriso"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not available", tool)
+		}
+	}
+	dir, err := ioutil.TempDir("", "iso")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "linuxkit")
+	require.NoError(t, outFuns["iso-efi"](base, bytes.NewReader(squashfsTestImage(t)), 0))
+
+	iso, err := os.Open(base + "-efi.iso")
+	require.NoError(t, err)
+	defer iso.Close()
+	platforms := elToritoPlatforms(t, iso)
+	out, err := exec.Command("xorriso", "-indev", base+"-efi.iso", "-report_el_torito", "plain").CombinedOutput()
+	require.NoError(t, err, string(out))
+	if runtime.GOARCH != "amd64" {
+		assert.Equal(t, []byte{0xef}, platforms)
+		assert.Contains(t, string(out), "UEFI")
+		return
+	}
+	assert.Equal(t, []byte{0, 0xef}, platforms)
+	assert.Regexp(t, `El Torito boot img :\s+1\s+BIOS\s+y`, string(out))
+	assert.Regexp(t, `El Torito boot img :\s+2\s+UEFI\s+y`, string(out))
+
+	// isohybrid makes the ISO a disk too, with boot code in its MBR and
+	// the EFI boot image as a partition
+	mbr := make([]byte, sectorSize)
+	_, err = iso.ReadAt(mbr, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x55, 0xaa}, mbr[510:])
+	assert.NotEqual(t, make([]byte, 440), mbr[:440], "the isohybrid boot code")
+	parts, err := readPartitions(iso)
+	require.NoError(t, err)
+	assert.NotEmpty(t, parts)
+}
@@ -0,0 +1,93 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExtractKernel extracts the kernel of the kernel image as the file kernel
+// of a directory of dir named by the digest of the image, which it returns.
+// An image extracted already is not extracted again.
+func ExtractKernel(image, dir string, pull bool, cacheDir string, dockerCache bool, arch string) (string, error) {
+	ref, err := reference.Parse(util.ReferenceExpand(image))
+	if err != nil {
+		return "", fmt.Errorf("Invalid kernel image name %s: %v", image, err)
+	}
+	src, err := imagePull(&ref, pull, cacheDir, dockerCache, arch)
+	if err != nil {
+		return "", fmt.Errorf("Could not pull image %s: %v", image, err)
+	}
+	desc := src.Descriptor()
+	if desc == nil {
+		return "", fmt.Errorf("Image %s has no digest", image)
+	}
+	out := filepath.Join(dir, desc.Digest.Algorithm+"-"+desc.Digest.Hex)
+	if _, err := os.Stat(filepath.Join(out, "kernel")); err == nil {
+		log.Debugf("kernel of %s is extracted already in %s", image, out)
+		return out, nil
+	}
+
+	log.Infof("Extract kernel image: %s", ref.String())
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// only the kernel, without the tarball of its modules
+	none := "none"
+	kf := newKernelFilter(tw, "", "", &none, nil, false)
+	if err := ImageTar(&ref, "", kf, false, "", cacheDir, dockerCache, arch); err != nil {
+		return "", fmt.Errorf("Failed to extract kernel image: %v", err)
+	}
+	if err := kf.Close(); err != nil {
+		return "", fmt.Errorf("Failed to extract kernel image: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+
+	// extract to a temporary directory renamed when complete, so that a
+	// failed extraction is not taken as cached
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempDir(dir, ".kernel")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Name != "boot/kernel" {
+			continue
+		}
+		f, err := os.Create(filepath.Join(tmp, "kernel"))
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
@@ -125,6 +125,13 @@ func outputLinuxKit(format string, filename string, kernel []byte, initrd []byte
 		return err
 	}
 
+	if size == 0 {
+		size = defaultDiskSizeMB
+	}
+	// the kernel and initrd are copied to the disk after its first 1M
+	if need := (len(kernel)+len(initrd)+1<<20-1)>>20 + 1; need > size {
+		return fmt.Errorf("The kernel and initrd need %dM but the disk is %dM, use a larger -size", need, size)
+	}
 	sizeString := fmt.Sprintf("%dM", size)
 	_ = os.Remove(filename)
 	_, err = os.Stat(filename)
@@ -0,0 +1,105 @@
+package moby
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/containerd/containerd/reference"
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	lktregistry "github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Lock is the type of a lockfile, recording the digest each image tag
+// pointed to when it was locked, so that later builds get the same images
+type Lock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+// LoadLock reads the lockfile path, a missing one is an empty lock
+func LoadLock(path string) (*Lock, error) {
+	l := &Lock{Images: map[string]string{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(b, l); err != nil {
+		return nil, fmt.Errorf("Invalid lockfile %s: %v", path, err)
+	}
+	if l.Images == nil {
+		l.Images = map[string]string{}
+	}
+	return l, nil
+}
+
+// Save writes the lock to path
+func (l *Lock) Save(path string) error {
+	b, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// DigestResolver returns the digest the image tag currently points to
+type DigestResolver func(image string) (string, error)
+
+// RegistryDigest is the DigestResolver looking up tags in their registry
+func RegistryDigest(image string) (string, error) {
+	ref, err := namepkg.ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(lktregistry.Keychain))
+	if err != nil {
+		return "", fmt.Errorf("unable to find %s in registry: %v", image, err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// LockImages pins each image of m given by tag to the digest locked for it,
+// checking with resolve that the tag still points to it, and locks those
+// not in lock yet to the digest they point to now. With update, a tag
+// pointing to another digest than the locked one is locked to it, rather
+// than an error. Images given by digest are already pinned, and left as
+// they are. It returns whether lock was changed.
+func LockImages(m *Moby, lock *Lock, resolve DigestResolver, update bool) (bool, error) {
+	changed := false
+	for _, ref := range imageRefs(m) {
+		if ref.Digest() != "" {
+			continue
+		}
+		image := ref.String()
+		digest, err := resolve(image)
+		if err != nil {
+			return changed, err
+		}
+		locked, ok := lock.Images[image]
+		switch {
+		case !ok:
+			log.Infof("Locking %s to %s", image, digest)
+		case locked == digest:
+		case update:
+			log.Infof("Updating lock of %s from %s to %s", image, locked, digest)
+		default:
+			return changed, fmt.Errorf("Image %s is locked to %s but now points to %s, use -update-lock to accept it", image, locked, digest)
+		}
+		if locked != digest {
+			lock.Images[image] = digest
+			changed = true
+		}
+		pinned, err := reference.Parse(image + "@" + digest)
+		if err != nil {
+			return changed, err
+		}
+		*ref = pinned
+	}
+	updateImages(m)
+	return changed, nil
+}
@@ -0,0 +1,135 @@
+package moby
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	digestA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	digestB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+// fakeRegistry resolves every tag to digest, but those in tags
+type fakeRegistry struct {
+	digest   string
+	tags     map[string]string
+	resolved []string
+}
+
+func (r *fakeRegistry) resolve(image string) (string, error) {
+	r.resolved = append(r.resolved, image)
+	if d, ok := r.tags[image]; ok {
+		return d, nil
+	}
+	if r.digest == "" {
+		return "", fmt.Errorf("unable to find %s in registry", image)
+	}
+	return r.digest, nil
+}
+
+func lockConfig(t *testing.T) Moby {
+	m, err := NewConfig([]byte(signaturesConfigYAML + "  - name: pinned\n    image: linuxkit/pinned:v0.8@" + digestB + "\n"))
+	require.NoError(t, err)
+	return m
+}
+
+func TestLockImagesCreate(t *testing.T) {
+	m := lockConfig(t)
+	lock := &Lock{Images: map[string]string{}}
+	r := &fakeRegistry{digest: digestA}
+	changed, err := LockImages(&m, lock, r.resolve, false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	// the image given by digest is not looked up
+	assert.Equal(t, signaturesImages, r.resolved)
+	locked := map[string]string{}
+	for _, image := range signaturesImages {
+		locked[image] = digestA
+	}
+	assert.Equal(t, locked, lock.Images)
+
+	assert.Equal(t, "docker.io/linuxkit/kernel:5.10@"+digestA, m.Kernel.Image)
+	assert.Equal(t, []string{"docker.io/linuxkit/init:v0.8@" + digestA}, m.Init)
+	assert.Equal(t, "docker.io/linuxkit/sysctl:v0.8@"+digestA, m.Onboot[0].Image)
+	assert.Equal(t, "docker.io/linuxkit/getty:v0.8@"+digestA, m.Services[0].Image)
+	assert.Equal(t, "docker.io/linuxkit/pinned:v0.8@"+digestB, m.Services[2].Image)
+}
+
+func TestLockImagesVerify(t *testing.T) {
+	lock := &Lock{Images: map[string]string{}}
+	m := lockConfig(t)
+	_, err := LockImages(&m, lock, (&fakeRegistry{digest: digestA}).resolve, false)
+	require.NoError(t, err)
+
+	m = lockConfig(t)
+	changed, err := LockImages(&m, lock, (&fakeRegistry{digest: digestA}).resolve, false)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "docker.io/linuxkit/getty:v0.8@"+digestA, m.Services[0].Image)
+
+	// an image added to the config is added to the lock
+	delete(lock.Images, "docker.io/linuxkit/rngd:v0.8")
+	m = lockConfig(t)
+	changed, err = LockImages(&m, lock, (&fakeRegistry{digest: digestA}).resolve, false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, digestA, lock.Images["docker.io/linuxkit/rngd:v0.8"])
+
+	m = lockConfig(t)
+	_, err = LockImages(&m, lock, (&fakeRegistry{}).resolve, false)
+	assert.EqualError(t, err, "unable to find docker.io/linuxkit/kernel:5.10 in registry")
+}
+
+func TestLockImagesDrift(t *testing.T) {
+	lock := &Lock{Images: map[string]string{}}
+	m := lockConfig(t)
+	_, err := LockImages(&m, lock, (&fakeRegistry{digest: digestA}).resolve, false)
+	require.NoError(t, err)
+
+	moved := &fakeRegistry{digest: digestA, tags: map[string]string{"docker.io/linuxkit/getty:v0.8": digestB}}
+	m = lockConfig(t)
+	_, err = LockImages(&m, lock, moved.resolve, false)
+	require.Error(t, err)
+	assert.Equal(t, "Image docker.io/linuxkit/getty:v0.8 is locked to "+digestA+" but now points to "+digestB+", use -update-lock to accept it", err.Error())
+	assert.Equal(t, digestA, lock.Images["docker.io/linuxkit/getty:v0.8"])
+
+	m = lockConfig(t)
+	changed, err := LockImages(&m, lock, moved.resolve, true)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, digestB, lock.Images["docker.io/linuxkit/getty:v0.8"])
+	assert.Equal(t, "docker.io/linuxkit/getty:v0.8@"+digestB, m.Services[0].Image)
+	assert.Equal(t, "docker.io/linuxkit/rngd:v0.8@"+digestA, m.Services[1].Image)
+}
+
+func TestLoadLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "linuxkit.lock")
+
+	lock, err := LoadLock(path)
+	require.NoError(t, err)
+	assert.Empty(t, lock.Images)
+
+	lock.Images["docker.io/linuxkit/init:v0.8"] = digestA
+	lock.Images["docker.io/linuxkit/getty:v0.8"] = digestB
+	require.NoError(t, lock.Save(path))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "images:\n  docker.io/linuxkit/getty:v0.8: "+digestB+"\n  docker.io/linuxkit/init:v0.8: "+digestA+"\n", string(b))
+	loaded, err := LoadLock(path)
+	require.NoError(t, err)
+	assert.Equal(t, lock, loaded)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("digests: {}\n"), 0644))
+	_, err = LoadLock(path)
+	assert.Error(t, err)
+}
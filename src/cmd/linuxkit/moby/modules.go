@@ -0,0 +1,86 @@
+package moby
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
+)
+
+const (
+	// modulesOnboot is the name of the onboot container loading the modules
+	// of the kernel section
+	modulesOnboot = "kernel-modules"
+	// modprobeImage is the image it runs modprobe from
+	modprobeImage = "linuxkit/modprobe:e2045c96cd2d3ef08eaf452396462d9205667690"
+)
+
+var moduleNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// validateModules checks the names of the kernel modules to load
+func validateModules(modules []KernelModule) error {
+	for _, mod := range modules {
+		if !moduleNameRegexp.MatchString(mod.Name) {
+			return fmt.Errorf("Invalid kernel module name %q", mod.Name)
+		}
+	}
+	return nil
+}
+
+// modulesScript is the sh script that loads modules in order, with their
+// parameters. A module that cannot be loaded is reported, and makes the
+// script fail once the other modules are loaded if it is required.
+func modulesScript(modules []KernelModule) string {
+	var b strings.Builder
+	b.WriteString("status=0\n")
+	for _, mod := range modules {
+		args := []string{"modprobe", shellQuote(mod.Name)}
+		for _, p := range mod.Parameters {
+			args = append(args, shellQuote(p))
+		}
+		if mod.Required {
+			fmt.Fprintf(&b, "%s || { echo 'Cannot load required kernel module %s' >&2; status=1; }\n", strings.Join(args, " "), mod.Name)
+		} else {
+			fmt.Fprintf(&b, "%s || echo 'Cannot load kernel module %s, continuing' >&2\n", strings.Join(args, " "), mod.Name)
+		}
+	}
+	b.WriteString("exit $status\n")
+	return b.String()
+}
+
+// withModules is m with an onboot container loading the modules of its
+// kernel section, if any, before the other onboot containers, so before
+// networking is set up
+func withModules(m Moby) (Moby, error) {
+	if len(m.Kernel.Modules) == 0 {
+		return m, nil
+	}
+	for _, image := range m.Onboot {
+		if image.Name == modulesOnboot {
+			return m, fmt.Errorf("The onboot container %s loading the kernel modules has the same name as another", modulesOnboot)
+		}
+	}
+	if err := validateModules(m.Kernel.Modules); err != nil {
+		return m, err
+	}
+	r, err := reference.Parse(util.ReferenceExpand(modprobeImage))
+	if err != nil {
+		return m, err
+	}
+	command := []string{"/bin/sh", "-c", modulesScript(m.Kernel.Modules)}
+	image := &Image{
+		Name:        modulesOnboot,
+		Image:       modprobeImage,
+		ImageConfig: ImageConfig{Command: &command},
+	}
+	image.ref = &r
+	m.Onboot = append([]*Image{image}, m.Onboot...)
+	return m, nil
+}
@@ -0,0 +1,118 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const modulesConfigYAML = `kernel:
+  image: linuxkit/kernel:5.10
+  modules:
+    - name: wireguard
+    - name: br_netfilter
+      required: true
+    - name: bonding
+      parameters:
+        - mode=802.3ad
+        - miimon=100
+onboot:
+  - name: dhcpcd
+    image: linuxkit/dhcpcd:v0.8
+`
+
+// runModulesScript runs the script of modules with a modprobe logging its
+// arguments, and failing for the modules named "missing"
+func runModulesScript(t *testing.T, modules []KernelModule) (string, error) {
+	dir, err := ioutil.TempDir("", "modules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	modprobe := `#!/bin/sh
+echo "$@" >> ` + log + `
+[ "$1" != missing ]
+`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "modprobe"), []byte(modprobe), 0755))
+
+	cmd := exec.Command("/bin/sh", "-c", modulesScript(modules))
+	cmd.Env = []string{"PATH=" + dir + ":/bin:/usr/bin"}
+	runErr := cmd.Run()
+	calls, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	return string(calls), runErr
+}
+
+func TestModulesConfig(t *testing.T) {
+	m, err := NewConfig([]byte(modulesConfigYAML))
+	require.NoError(t, err)
+	assert.Equal(t, []KernelModule{
+		{Name: "wireguard"},
+		{Name: "br_netfilter", Required: true},
+		{Name: "bonding", Parameters: []string{"mode=802.3ad", "miimon=100"}},
+	}, m.Kernel.Modules)
+
+	m, err = withModules(m)
+	require.NoError(t, err)
+	require.Len(t, m.Onboot, 2)
+	assert.Equal(t, modulesOnboot, m.Onboot[0].Name)
+	assert.Equal(t, modprobeImage, m.Onboot[0].Image)
+	require.NotNil(t, m.Onboot[0].ref)
+	assert.Equal(t, "dhcpcd", m.Onboot[1].Name)
+}
+
+func TestModulesInvalidName(t *testing.T) {
+	for _, name := range []string{"", "a b", "x;reboot"} {
+		_, err := NewConfig([]byte("kernel:\n  modules:\n    - name: \"" + name + "\"\n"))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestModulesNameConflict(t *testing.T) {
+	m := Moby{
+		Kernel: KernelConfig{Modules: []KernelModule{{Name: "wireguard"}}},
+		Onboot: []*Image{{Name: modulesOnboot, Image: "alpine"}},
+	}
+	_, err := withModules(m)
+	assert.Error(t, err)
+}
+
+func TestModulesNone(t *testing.T) {
+	m := Moby{Onboot: []*Image{{Name: "dhcpcd", Image: "linuxkit/dhcpcd:v0.8"}}}
+	m, err := withModules(m)
+	require.NoError(t, err)
+	assert.Len(t, m.Onboot, 1)
+}
+
+func TestModulesScript(t *testing.T) {
+	calls, err := runModulesScript(t, []KernelModule{
+		{Name: "wireguard"},
+		{Name: "bonding", Parameters: []string{"mode=802.3ad", "miimon=100"}},
+		{Name: "dummy", Parameters: []string{"numdummies=2 it's"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "wireguard\nbonding mode=802.3ad miimon=100\ndummy numdummies=2 it's\n", calls)
+}
+
+func TestModulesScriptOptionalFailure(t *testing.T) {
+	calls, err := runModulesScript(t, []KernelModule{
+		{Name: "missing"},
+		{Name: "wireguard"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "missing\nwireguard\n", calls)
+}
+
+func TestModulesScriptRequiredFailure(t *testing.T) {
+	calls, err := runModulesScript(t, []KernelModule{
+		{Name: "missing", Required: true},
+		{Name: "wireguard"},
+	})
+	assert.Error(t, err)
+	// the modules after the required one are still loaded
+	assert.Equal(t, "missing\nwireguard\n", calls)
+}
@@ -0,0 +1,220 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// OCIConfig is the image configuration given to the oci output format
+type OCIConfig struct {
+	Architecture string
+	Entrypoint   []string
+	Env          []string
+	// Created is the creation time of the image, defaults to the timestamp
+	// of the other files of the build
+	Created *time.Time
+}
+
+var ociConfig = OCIConfig{
+	Architecture: runtime.GOARCH,
+	Entrypoint:   []string{"/bin/rc.init"},
+}
+
+// SetOCIConfig sets the image configuration used for the oci output format
+func SetOCIConfig(c OCIConfig) {
+	ociConfig = c
+}
+
+// the image-spec version vendored predates the mediaType fields
+type ociManifest struct {
+	imagespec.Manifest
+	MediaType string `json:"mediaType"`
+}
+
+type ociIndex struct {
+	imagespec.Index
+	MediaType string `json:"mediaType"`
+}
+
+// dockerManifest is an entry of the manifest.json docker load reads
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type ociBlob struct {
+	desc imagespec.Descriptor
+	data []byte
+}
+
+func newOCIBlob(mediaType string, data []byte) ociBlob {
+	return ociBlob{
+		desc: imagespec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		},
+		data: data,
+	}
+}
+
+func (b ociBlob) path() string {
+	return "blobs/" + b.desc.Digest.Algorithm().String() + "/" + b.desc.Digest.Encoded()
+}
+
+// outputOCI writes the filesystem as a single layer image in an OCI
+// image layout tarball. It also has the manifest.json docker load needs,
+// as docker save writes, naming the image <imageName>:latest.
+func outputOCI(filename, imageName string, filesystem io.Reader, c OCIConfig) error {
+	log.Debugf("output OCI: %s %s", imageName, filename)
+	log.Infof("  %s", filename)
+
+	ref, err := reference.ParseNormalizedNamed(strings.ToLower(imageName) + ":latest")
+	if err != nil {
+		return fmt.Errorf("cannot use %q as an image name: %v", imageName, err)
+	}
+
+	layer, diffID, err := ociLayer(filesystem)
+	if err != nil {
+		return err
+	}
+
+	created := defaultModTime
+	if c.Created != nil {
+		created = c.Created.UTC()
+	}
+	config, err := json.Marshal(imagespec.Image{
+		Created:      &created,
+		Architecture: c.Architecture,
+		OS:           "linux",
+		Config: imagespec.ImageConfig{
+			Entrypoint: c.Entrypoint,
+			Env:        c.Env,
+		},
+		RootFS: imagespec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	configBlob := newOCIBlob(imagespec.MediaTypeImageConfig, config)
+
+	manifest, err := json.Marshal(ociManifest{
+		Manifest: imagespec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config:    configBlob.desc,
+			Layers:    []imagespec.Descriptor{layer.desc},
+		},
+		MediaType: imagespec.MediaTypeImageManifest,
+	})
+	if err != nil {
+		return err
+	}
+	manifestBlob := newOCIBlob(imagespec.MediaTypeImageManifest, manifest)
+
+	desc := manifestBlob.desc
+	desc.Annotations = map[string]string{
+		"io.containerd.image.name":  ref.String(),
+		imagespec.AnnotationRefName: "latest",
+	}
+	desc.Platform = &imagespec.Platform{OS: "linux", Architecture: c.Architecture}
+	index, err := json.Marshal(ociIndex{
+		Index: imagespec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: []imagespec.Descriptor{desc},
+		},
+		MediaType: imagespec.MediaTypeImageIndex,
+	})
+	if err != nil {
+		return err
+	}
+
+	layout, err := json.Marshal(imagespec.ImageLayout{Version: imagespec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+
+	dockerManifests, err := json.Marshal([]dockerManifest{{
+		Config:   configBlob.path(),
+		RepoTags: []string{ref.String()},
+		Layers:   []string{layer.path()},
+	}})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range []struct {
+		name string
+		data []byte
+	}{
+		{imagespec.ImageLayoutFile, layout},
+		{"index.json", index},
+		{"manifest.json", dockerManifests},
+		{layer.path(), layer.data},
+		{configBlob.path(), configBlob.data},
+		{manifestBlob.path(), manifestBlob.data},
+	} {
+		if err := writeOCIFile(tw, e.name, e.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ociLayer returns the gzip compressed layer of the filesystem
+// tarball and the digest of the uncompressed tarball
+func ociLayer(filesystem io.Reader) (ociBlob, digest.Digest, error) {
+	var buf bytes.Buffer
+	uncompressed := sha256.New()
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(io.MultiWriter(zw, uncompressed), filesystem); err != nil {
+		return ociBlob{}, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return ociBlob{}, "", err
+	}
+	diffID := digest.NewDigest(digest.SHA256, uncompressed)
+	return newOCIBlob(imagespec.MediaTypeImageLayerGzip, buf.Bytes()), diffID, nil
+}
+
+func writeOCIFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: defaultModTime,
+		Format:  tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
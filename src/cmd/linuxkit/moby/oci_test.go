@@ -0,0 +1,136 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFilesystem(t *testing.T) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	content := "linuxkit\n"
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "etc/hostname", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func readTar(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	files := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = b
+	}
+}
+
+func TestOutputOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby-oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test-oci.tar")
+	fs := testFilesystem(t)
+	c := OCIConfig{Architecture: "arm64", Entrypoint: []string{"/bin/sh", "-c"}, Env: []string{"FOO=bar"}}
+	require.NoError(t, outputOCI(filename, "Test", bytes.NewReader(fs), c))
+
+	files := readTar(t, filename)
+	assert.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(files["oci-layout"]))
+
+	var index ociIndex
+	require.NoError(t, json.Unmarshal(files["index.json"], &index))
+	assert.Equal(t, imagespec.MediaTypeImageIndex, index.MediaType)
+	require.Len(t, index.Manifests, 1)
+	assert.Equal(t, "latest", index.Manifests[0].Annotations[imagespec.AnnotationRefName])
+	assert.Equal(t, "docker.io/library/test:latest", index.Manifests[0].Annotations["io.containerd.image.name"])
+
+	var manifest ociManifest
+	require.NoError(t, json.Unmarshal(files["blobs/sha256/"+index.Manifests[0].Digest.Encoded()], &manifest))
+	assert.Equal(t, imagespec.MediaTypeImageManifest, manifest.MediaType)
+	require.Len(t, manifest.Layers, 1)
+	assert.Equal(t, imagespec.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	assert.Contains(t, files, "blobs/sha256/"+manifest.Layers[0].Digest.Encoded())
+
+	// the manifest.json docker load uses
+	img, err := tarball.ImageFromPath(filename, nil)
+	require.NoError(t, err)
+	cf, err := img.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, "arm64", cf.Architecture)
+	assert.Equal(t, "linux", cf.OS)
+	assert.Equal(t, c.Entrypoint, cf.Config.Entrypoint)
+	assert.Equal(t, c.Env, cf.Config.Env)
+	assert.True(t, cf.Created.Time.Equal(defaultModTime))
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	rc, err := layers[0].Uncompressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, fs, b)
+	diffID, err := layers[0].DiffID()
+	require.NoError(t, err)
+	assert.Equal(t, cf.RootFS.DiffIDs[0], diffID)
+
+	// the output is reproducible
+	again := filepath.Join(dir, "again.tar")
+	require.NoError(t, outputOCI(again, "Test", bytes.NewReader(fs), c))
+	assert.Equal(t, files, readTar(t, again))
+
+	// as it is with a creation time
+	created := time.Date(2021, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	c.Created = &created
+	for _, name := range []string{"created.tar", "created-again.tar"} {
+		require.NoError(t, outputOCI(filepath.Join(dir, name), "Test", bytes.NewReader(fs), c))
+	}
+	img, err = tarball.ImageFromPath(filepath.Join(dir, "created.tar"), nil)
+	require.NoError(t, err)
+	cf, err = img.ConfigFile()
+	require.NoError(t, err)
+	assert.Equal(t, "2021-06-01T10:00:00Z", cf.Created.Time.UTC().Format(time.RFC3339))
+	assert.Equal(t, readTar(t, filepath.Join(dir, "created.tar")), readTar(t, filepath.Join(dir, "created-again.tar")))
+
+	assert.Error(t, outputOCI(filepath.Join(dir, "bad.tar"), "no spaces", bytes.NewReader(fs), c))
+}
+
+func TestOutputOCIDockerLoad(t *testing.T) {
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not available")
+	}
+	dir, err := ioutil.TempDir("", "moby-oci")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "linuxkit-oci-test.tar")
+	require.NoError(t, outputOCI(filename, "linuxkit-oci-test", bytes.NewReader(testFilesystem(t)), ociConfig))
+	out, err := exec.Command("docker", "load", "-i", filename).CombinedOutput()
+	require.NoError(t, err, "%s", out)
+	defer exec.Command("docker", "rmi", "linuxkit-oci-test:latest").Run()
+	assert.True(t, strings.Contains(string(out), "linuxkit-oci-test:latest"), "%s", out)
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -18,10 +20,10 @@ var (
 	outputImages = map[string]string{
 		"iso":         "linuxkit/mkimage-iso:f0ba58e54282f481a87a2b487a70568c702f001b",
 		"iso-bios":    "linuxkit/mkimage-iso-bios:2fb7eea032a8f8ec76d9ca69592046875c50683c",
-		"iso-efi":     "linuxkit/mkimage-iso-efi:71c9dfc7de921e4521adbce03c01ce8282c0a9a5",
+		"iso-efi":     "linuxkit/mkimage-iso-efi:fab80105f691be0f6421f378d0d77e90030a1cf7",
 		"raw-bios":    "linuxkit/mkimage-raw-bios:a0f4f6af871f9388639f2939a5e7bee5c467b736",
 		"raw-efi":     "linuxkit/mkimage-raw-efi:bc5d55daccfe1e75bc7373b4f45fc08e3b9adea9",
-		"squashfs":    "linuxkit/mkimage-squashfs:078f292e085fe31f508ff55a05eab958aec25e25",
+		"squashfs":    "linuxkit/mkimage-squashfs:b0e4547b895fe8acdb5fa85fd4f4c309776b62cf",
 		"gcp":         "linuxkit/mkimage-gcp:a7416d21d4ef642bb2ba560c8f7651250823546d",
 		"qcow2-efi":   "linuxkit/mkimage-qcow2-efi:2a835e4ce894070268e5fa6f53be67007452095e",
 		"vhd":         "linuxkit/mkimage-vhd:4cc60c4f46b07e11c64ba618e46b81fa0096c91f",
@@ -31,6 +33,45 @@ var (
 	}
 )
 
+// initrdZstdLevel is the compression level of the kernel+initrd-zstd format
+var initrdZstdLevel = initrd.DefaultZstdLevel
+
+// SetInitrdZstdLevel sets the zstd compression level used for the kernel+initrd-zstd format
+func SetInitrdZstdLevel(level int) error {
+	if level < 1 || level > initrd.MaxZstdLevel {
+		return fmt.Errorf("zstd compression level must be between 1 and %d", initrd.MaxZstdLevel)
+	}
+	initrdZstdLevel = level
+	return nil
+}
+
+// qcow2ClusterSize is the cluster size of the qcow2-compressed format, or 0
+// for the qemu-img default
+var qcow2ClusterSize int
+
+// SetQcow2ClusterSize sets the cluster size used for the qcow2-compressed format
+func SetQcow2ClusterSize(size int) error {
+	if size != 0 && (size < 512 || size > 2*1024*1024 || size&(size-1) != 0) {
+		return fmt.Errorf("qcow2 cluster size must be a power of two between 512 and 2M")
+	}
+	qcow2ClusterSize = size
+	return nil
+}
+
+// squashfsCompression is the compression of the squashfs formats, or ""
+// for the mksquashfs default of gzip
+var squashfsCompression string
+
+// SetSquashfsCompression sets the compression used for the squashfs formats
+func SetSquashfsCompression(c string) error {
+	switch c {
+	case "", "gzip", "xz", "zstd":
+		squashfsCompression = c
+		return nil
+	}
+	return fmt.Errorf("squashfs compression must be gzip, xz or zstd")
+}
+
 // UpdateOutputImages overwrite the docker images used to build the outputs
 // 'update' is a map where the key is the output format and the value is a LinuxKit 'mkimage' image.
 func UpdateOutputImages(update map[string]string) error {
@@ -55,6 +96,23 @@ var outFuns = map[string]func(string, io.Reader, int) error{
 		}
 		return nil
 	},
+	"kernel+initrd-zstd": func(base string, image io.Reader, size int) error {
+		kernel, initrd, cmdline, ucode, err := tarToCompressedInitrd(image, initrd.Zstd, initrdZstdLevel)
+		if err != nil {
+			return fmt.Errorf("Error converting to initrd: %v", err)
+		}
+		err = outputKernelInitrdFile(base, base+"-initrd.img.zst", kernel, initrd, cmdline, ucode)
+		if err != nil {
+			return fmt.Errorf("Error writing kernel+initrd-zstd output: %v", err)
+		}
+		return nil
+	},
+	"oci": func(base string, image io.Reader, size int) error {
+		if err := outputOCI(base+"-oci.tar", filepath.Base(base), image, ociConfig); err != nil {
+			return fmt.Errorf("Error writing oci output: %v", err)
+		}
+		return nil
+	},
 	"tar-kernel-initrd": func(base string, image io.Reader, size int) error {
 		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
 		if err != nil {
@@ -109,6 +167,14 @@ var outFuns = map[string]func(string, io.Reader, int) error{
 		}
 		return nil
 	},
+	"squashfs": func(base string, image io.Reader, size int) error {
+		log.Infof("  %s.squashfs", base)
+		err := outputSquashFS(outputImages["squashfs"], base+".squashfs", image)
+		if err != nil {
+			return fmt.Errorf("Error writing squashfs output: %v", err)
+		}
+		return nil
+	},
 	"kernel+iso": func(base string, image io.Reader, size int) error {
 		err := outputKernelISO(outputImages["iso"], base, image)
 		if err != nil {
@@ -165,6 +231,28 @@ var outFuns = map[string]func(string, io.Reader, int) error{
 		}
 		return nil
 	},
+	"qcow2-compressed": func(base string, image io.Reader, size int) error {
+		filename := base + ".qcow2"
+		log.Infof("  %s", filename)
+		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+		if err != nil {
+			return fmt.Errorf("Error converting to initrd: %v", err)
+		}
+		tmp, err := ioutil.TempDir(filepath.Join(MobyDir, "tmp"), "moby")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		flat := filepath.Join(tmp, "flat.qcow2")
+		// TODO: Handle ucode
+		if err := outputLinuxKit("qcow2", flat, kernel, initrd, cmdline, size); err != nil {
+			return fmt.Errorf("Error writing qcow2 output: %v", err)
+		}
+		if err := compressQcow2(flat, filename, qcow2ClusterSize); err != nil {
+			return fmt.Errorf("Error writing qcow2-compressed output: %v", err)
+		}
+		return nil
+	},
 	"vhd": func(base string, image io.Reader, size int) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
@@ -187,15 +275,26 @@ var outFuns = map[string]func(string, io.Reader, int) error{
 		}
 		return nil
 	},
-	"vmdk": func(base string, image io.Reader, size int) error {
+	"vmdk": outputVMDKFormat,
+	// vmdk is stream-optimized already, this is the explicit name
+	"vmdk-streamoptimized": outputVMDKFormat,
+	"ova": func(base string, image io.Reader, size int) error {
 		kernel, initrd, cmdline, _, err := tarToInitrd(image)
 		if err != nil {
 			return fmt.Errorf("Error converting to initrd: %v", err)
 		}
-		err = outputImg(outputImages["vmdk"], base+".vmdk", kernel, initrd, cmdline)
+		tmp, err := ioutil.TempDir(filepath.Join(MobyDir, "tmp"), "moby")
 		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		vmdk := filepath.Join(tmp, "disk.vmdk")
+		if err := outputImg(outputImages["vmdk"], vmdk, kernel, initrd, cmdline); err != nil {
 			return fmt.Errorf("Error writing vmdk output: %v", err)
 		}
+		if err := outputOVA(base+".ova", filepath.Base(base), vmdk); err != nil {
+			return fmt.Errorf("Error writing ova output: %v", err)
+		}
 		return nil
 	},
 	"rpi3": func(base string, image io.Reader, size int) error {
@@ -210,9 +309,22 @@ var outFuns = map[string]func(string, io.Reader, int) error{
 	},
 }
 
+func outputVMDKFormat(base string, image io.Reader, size int) error {
+	kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	if err != nil {
+		return fmt.Errorf("Error converting to initrd: %v", err)
+	}
+	err = outputImg(outputImages["vmdk"], base+".vmdk", kernel, initrd, cmdline)
+	if err != nil {
+		return fmt.Errorf("Error writing vmdk output: %v", err)
+	}
+	return nil
+}
+
 var prereq = map[string]string{
-	"aws":        "mkimage",
-	"qcow2-bios": "mkimage",
+	"aws":              "mkimage",
+	"qcow2-bios":       "mkimage",
+	"qcow2-compressed": "mkimage",
 }
 
 func ensurePrereq(out, cache string) error {
@@ -242,38 +354,119 @@ func ValidateFormats(formats []string, cache string) error {
 	return nil
 }
 
-// Formats generates all the specified output formats
-func Formats(base string, image string, formats []string, size int, cache string) error {
+// Formats generates all the specified output formats of the image built
+// from m, with the kernel cmdline of each output
+func Formats(base string, image string, formats []string, size int, cache string, m Moby) error {
 	log.Debugf("format: %v %s", formats, base)
 
 	err := ValidateFormats(formats, cache)
 	if err != nil {
 		return err
 	}
+	for _, o := range formats {
+		if parts := m.Outputs[o].Partitions; len(parts) != 0 {
+			if _, _, err := layoutPartitions(o, parts, size); err != nil {
+				return err
+			}
+		}
+	}
 	for _, o := range formats {
 		ir, err := os.Open(image)
 		if err != nil {
 			return err
 		}
 		defer ir.Close()
+		var r io.Reader = ir
+		if cmdline := m.OutputCmdline(o); cmdline != m.Kernel.Cmdline {
+			cr := withCmdline(ir, cmdline)
+			defer cr.Close()
+			r = cr
+		}
 		f := outFuns[o]
-		if err := f(base, ir, size); err != nil {
+		oc := m.Outputs[o]
+		if oc.ESP != nil {
+			f = func(base string, image io.Reader, size int) error {
+				return outputESP(base, image, size, oc.ESP, oc.Partitions)
+			}
+		} else if len(oc.Partitions) != 0 {
+			format := o
+			f = func(base string, image io.Reader, size int) error {
+				return outputPartitions(format, base, image, size, oc.Partitions)
+			}
+		}
+		if err := f(base, r, size); err != nil {
 			return err
 		}
+		// the disks of the other outputs are made at the -size already
+		if _, ok := paddedOutputs[o]; ok && size != 0 && oc.ESP == nil && len(oc.Partitions) == 0 {
+			if err := padOutput(o, base, size); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// withCmdline is the image tarball r with boot/cmdline replaced by cmdline
+func withCmdline(r io.Reader, cmdline string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyWithCmdline(pw, r, cmdline))
+	}()
+	return pr
+}
+
+func copyWithCmdline(w io.Writer, r io.Reader, cmdline string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "boot/cmdline" {
+			hdr.Size = int64(len(cmdline))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(tw, cmdline); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
 func tarToInitrd(r io.Reader) ([]byte, []byte, string, []byte, error) {
+	return tarToCompressedInitrd(r, initrd.Gzip, 0)
+}
+
+func tarToCompressedInitrd(r io.Reader, c initrd.Compression, level int) ([]byte, []byte, string, []byte, error) {
 	w := new(bytes.Buffer)
-	iw := initrd.NewWriter(w)
+	iw, err := initrd.NewCompressedWriter(w, c, level)
+	if err != nil {
+		return []byte{}, []byte{}, "", []byte{}, err
+	}
 	tr := tar.NewReader(r)
 	kernel, cmdline, ucode, err := initrd.CopySplitTar(iw, tr)
 	if err != nil {
+		iw.Close()
+		return []byte{}, []byte{}, "", []byte{}, err
+	}
+	if err := iw.Close(); err != nil {
 		return []byte{}, []byte{}, "", []byte{}, err
 	}
-	iw.Close()
 	return kernel, w.Bytes(), cmdline, ucode, nil
 }
 
@@ -343,6 +536,26 @@ func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline str
 	return dockerRun(buf, output, image, cmdline)
 }
 
+// compressQcow2 converts the disk image src to the compressed qcow2 dst, with
+// clusterSize, or the default cluster size if it is 0. The clusters of src are
+// compressed one by one, so the image is smaller to distribute but slower to
+// build and to read, while the clusters a VM writes are stored uncompressed.
+func compressQcow2(src, dst string, clusterSize int) error {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("Cannot find qemu-img executable, needed to compress qcow2 images: %v", err)
+	}
+	args := []string{"convert", "-c", "-O", "qcow2"}
+	if clusterSize != 0 {
+		args = append(args, "-o", fmt.Sprintf("cluster_size=%d", clusterSize))
+	}
+	args = append(args, src, dst)
+	log.Debugf("run %s: %v", qemuImg, args)
+	cmd := exec.Command(qemuImg, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func outputIso(image, filename string, filesystem io.Reader) error {
 	log.Debugf("output ISO: %s %s", image, filename)
 	log.Infof("  %s", filename)
@@ -366,15 +579,19 @@ func outputRPi3(image, filename string, filesystem io.Reader) error {
 }
 
 func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
+	return outputKernelInitrdFile(base, base+"-initrd.img", kernel, initrd, cmdline, ucode)
+}
+
+func outputKernelInitrdFile(base, initrdFile string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
 	log.Debugf("output kernel/initrd: %s %s", base, cmdline)
 
 	if len(ucode) != 0 {
-		log.Infof("  %s ucode+%s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-		if err := ioutil.WriteFile(base+"-initrd.img", ucode, os.FileMode(0644)); err != nil {
+		log.Infof("  %s ucode+%s %s", base+"-kernel", initrdFile, base+"-cmdline")
+		if err := ioutil.WriteFile(initrdFile, ucode, os.FileMode(0644)); err != nil {
 			return err
 		}
 		if len(initrd) != 0 {
-			f, err := os.OpenFile(base+"-initrd.img", os.O_APPEND|os.O_WRONLY, 0644)
+			f, err := os.OpenFile(initrdFile, os.O_APPEND|os.O_WRONLY, 0644)
 			if err != nil {
 				return err
 			}
@@ -385,8 +602,8 @@ func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline strin
 		}
 	} else {
 		if len(initrd) != 0 {
-			log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-			if err := ioutil.WriteFile(base+"-initrd.img", initrd, os.FileMode(0644)); err != nil {
+			log.Infof("  %s %s %s", base+"-kernel", initrdFile, base+"-cmdline")
+			if err := ioutil.WriteFile(initrdFile, initrd, os.FileMode(0644)); err != nil {
 				return err
 			}
 		}
@@ -478,6 +695,29 @@ func outputKernelSquashFS(image, base string, filesystem io.Reader) error {
 	log.Debugf("output kernel/squashfs: %s %s", image, base)
 	log.Infof("  %s-squashfs.img", base)
 
+	rootfs, err := squashfsRootfs(filesystem, base)
+	if err != nil {
+		return err
+	}
+	return mksquashfs(image, base+"-squashfs.img", rootfs)
+}
+
+// outputSquashFS writes the root filesystem, without boot/, as a squashfs
+// to filename
+func outputSquashFS(image, filename string, filesystem io.Reader) error {
+	log.Debugf("output squashfs: %s %s", image, filename)
+
+	rootfs, err := squashfsRootfs(filesystem, "")
+	if err != nil {
+		return err
+	}
+	return mksquashfs(image, filename, rootfs)
+}
+
+// squashfsRootfs returns the tarball of the root filesystem, without
+// boot/. If base is not empty the kernel and cmdline are written next to
+// it, as base-kernel and base-cmdline.
+func squashfsRootfs(filesystem io.Reader, base string) (*bytes.Buffer, error) {
 	tr := tar.NewReader(filesystem)
 	buf := new(bytes.Buffer)
 	rootfs := tar.NewWriter(buf)
@@ -489,44 +729,57 @@ func outputKernelSquashFS(image, base string, filesystem io.Reader) error {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		thdr.Format = tar.FormatPAX
 		switch {
-		case thdr.Name == "boot/kernel":
+		case thdr.Name == "boot/kernel" && base != "":
 			kernel, err := ioutil.ReadAll(tr)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if err := ioutil.WriteFile(base+"-kernel", kernel, os.FileMode(0644)); err != nil {
-				return err
+				return nil, err
 			}
-		case thdr.Name == "boot/cmdline":
+		case thdr.Name == "boot/cmdline" && base != "":
 			cmdline, err := ioutil.ReadAll(tr)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if err := ioutil.WriteFile(base+"-cmdline", cmdline, os.FileMode(0644)); err != nil {
-				return err
+				return nil, err
 			}
 		case strings.HasPrefix(thdr.Name, "boot/"):
 			// skip the rest of boot/
 		default:
-			rootfs.WriteHeader(thdr)
+			if err := rootfs.WriteHeader(thdr); err != nil {
+				return nil, err
+			}
 			if _, err := io.Copy(rootfs, tr); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
-	rootfs.Close()
+	if err := rootfs.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
 
-	output, err := os.Create(base + "-squashfs.img")
+// mksquashfs makes a squashfs of the rootfs tarball in filename, with the
+// squashfs image, compressed with squashfsCompression
+func mksquashfs(image, filename string, rootfs io.Reader) error {
+	output, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer output.Close()
 
-	return dockerRun(buf, output, image)
+	var args []string
+	if squashfsCompression != "" {
+		args = append(args, squashfsCompression)
+	}
+	return dockerRun(rootfs, output, image, args...)
 }
 
 func outputKernelISO(image, base string, filesystem io.Reader) error {
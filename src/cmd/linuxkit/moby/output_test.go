@@ -0,0 +1,65 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetQcow2ClusterSize(t *testing.T) {
+	defer func() { qcow2ClusterSize = 0 }()
+	for _, size := range []int{0, 512, 65536, 2 * 1024 * 1024} {
+		assert.NoError(t, SetQcow2ClusterSize(size), size)
+		assert.Equal(t, size, qcow2ClusterSize)
+	}
+	for _, size := range []int{-1, 256, 65537, 4 * 1024 * 1024} {
+		assert.Error(t, SetQcow2ClusterSize(size), size)
+	}
+}
+
+func TestCompressQcow2(t *testing.T) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img is not available")
+	}
+	dir, err := ioutil.TempDir("", "qcow2")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	raw := filepath.Join(dir, "disk.img")
+	data := append(bytes.Repeat([]byte("linuxkit"), 1024*1024), make([]byte, 8*1024*1024)...)
+	require.NoError(t, ioutil.WriteFile(raw, data, 0644))
+
+	qcow2 := filepath.Join(dir, "disk.qcow2")
+	require.NoError(t, compressQcow2(raw, qcow2, 128*1024))
+
+	out, err := exec.Command(qemuImg, "check", qcow2).CombinedOutput()
+	require.NoError(t, err, string(out))
+	out, err = exec.Command(qemuImg, "info", "--output=json", qcow2).Output()
+	require.NoError(t, err)
+	var info struct {
+		Format      string `json:"format"`
+		ClusterSize int    `json:"cluster-size"`
+		VirtualSize int    `json:"virtual-size"`
+		ActualSize  int    `json:"actual-size"`
+	}
+	require.NoError(t, json.Unmarshal(out, &info))
+	assert.Equal(t, "qcow2", info.Format)
+	assert.Equal(t, 128*1024, info.ClusterSize)
+	assert.Equal(t, len(data), info.VirtualSize)
+	assert.Less(t, info.ActualSize, len(data)/10)
+
+	// the compressed image has the contents of the raw one
+	back := filepath.Join(dir, "back.img")
+	out, err = exec.Command(qemuImg, "convert", "-O", "raw", qcow2, back).CombinedOutput()
+	require.NoError(t, err, string(out))
+	b, err := ioutil.ReadFile(back)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b))
+}
@@ -0,0 +1,114 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const outputsConfigYAML = `kernel:
+  image: linuxkit/kernel:5.10
+  cmdline: console=ttyS0
+outputs:
+  iso-efi:
+    cmdline.add: console=tty0
+  raw-bios:
+    cmdline: console=ttyS1 root=/dev/sda1
+  tar-kernel-initrd:
+    cmdline: console=hvc0
+    cmdline.add: quiet
+`
+
+func TestOutputCmdline(t *testing.T) {
+	m, err := NewConfig([]byte(outputsConfigYAML))
+	require.NoError(t, err)
+	assert.Equal(t, "console=ttyS0", m.OutputCmdline("kernel+initrd"))
+	assert.Equal(t, "console=ttyS0", m.OutputCmdline(""))
+	assert.Equal(t, "console=ttyS0 console=tty0", m.OutputCmdline("iso-efi"))
+	assert.Equal(t, "console=ttyS1 root=/dev/sda1", m.OutputCmdline("raw-bios"))
+	assert.Equal(t, "console=hvc0 quiet", m.OutputCmdline("tar-kernel-initrd"))
+
+	assert.NoError(t, CheckStrict("linuxkit.yml", []byte(outputsConfigYAML)))
+
+	_, err = NewConfig([]byte("outputs:\n  raw-bois:\n    cmdline: console=ttyS0\n"))
+	assert.EqualError(t, err, "Unknown format type raw-bois in outputs")
+	_, err = NewConfig([]byte("outputs:\n  raw-bios:\n    cmdlin: console=ttyS0\n"))
+	assert.Error(t, err)
+}
+
+func TestAppendConfigOutputs(t *testing.T) {
+	m0, err := NewConfig([]byte(outputsConfigYAML))
+	require.NoError(t, err)
+	m1, err := NewConfig([]byte("outputs:\n  iso-efi:\n    cmdline: console=ttyS0 earlyprintk\n  raw-efi:\n    cmdline.add: quiet\n"))
+	require.NoError(t, err)
+	m, err := AppendConfig(m0, m1)
+	require.NoError(t, err)
+
+	// later configs set each field of an output in turn
+	assert.Equal(t, "console=ttyS0 earlyprintk console=tty0", m.OutputCmdline("iso-efi"))
+	assert.Equal(t, "console=ttyS0 quiet", m.OutputCmdline("raw-efi"))
+	assert.Equal(t, "console=ttyS1 root=/dev/sda1", m.OutputCmdline("raw-bios"))
+	// and the first config is left as it is
+	assert.Equal(t, "console=ttyS0 console=tty0", m0.OutputCmdline("iso-efi"))
+}
+
+// writeTestImage writes an image tarball, as Build writes it, with cmdline
+func writeTestImage(t *testing.T, path, cmdline string) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, f := range []struct{ name, contents string }{
+		{"boot/cmdline", cmdline},
+		{"boot/kernel", "kernel"},
+		{"etc/motd", "hello"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, ioutil.WriteFile(path, b.Bytes(), 0644))
+}
+
+func TestFormatsCmdline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m, err := NewConfig([]byte(outputsConfigYAML))
+	require.NoError(t, err)
+	image := filepath.Join(dir, "image.tar")
+	writeTestImage(t, image, m.Kernel.Cmdline)
+	base := filepath.Join(dir, "linuxkit")
+
+	require.NoError(t, Formats(base, image, []string{"kernel+initrd", "tar-kernel-initrd"}, 1024, dir, m))
+
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	require.NoError(t, err)
+	assert.Equal(t, "console=ttyS0", string(cmdline))
+
+	f, err := os.Open(base + "-initrd.tar")
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Name == "cmdline" {
+			b, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			assert.Equal(t, "console=hvc0 quiet", string(b))
+			found = true
+		}
+	}
+	assert.True(t, found, "no cmdline in the tar-kernel-initrd output")
+}
@@ -0,0 +1,244 @@
+package moby
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vmdkMagic             = 0x564d444b
+	vmdkSectorSize        = 512
+	vmdkStreamOptimized   = "streamOptimized"
+	vmdkStreamOptimizedID = "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"
+)
+
+// vmdkInfo is what an OVF descriptor needs to know of a VMDK
+type vmdkInfo struct {
+	// Capacity is the virtual size of the disk in bytes
+	Capacity int64
+	// Cylinders, Heads and Sectors are the geometry of the descriptor
+	Cylinders, Heads, Sectors int64
+}
+
+// readVMDKInfo reads the header and descriptor of the stream-optimized VMDK
+// r, and checks that its geometry covers its capacity
+func readVMDKInfo(r io.ReaderAt) (vmdkInfo, error) {
+	var info vmdkInfo
+	header := make([]byte, vmdkSectorSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return info, fmt.Errorf("Cannot read VMDK header: %v", err)
+	}
+	if binary.LittleEndian.Uint32(header) != vmdkMagic {
+		return info, fmt.Errorf("Not a sparse VMDK")
+	}
+	info.Capacity = int64(binary.LittleEndian.Uint64(header[12:])) * vmdkSectorSize
+	descriptorOffset := int64(binary.LittleEndian.Uint64(header[28:]))
+	descriptorSize := int64(binary.LittleEndian.Uint64(header[36:]))
+	if descriptorSize == 0 {
+		return info, fmt.Errorf("VMDK has no embedded descriptor")
+	}
+	descriptor := make([]byte, descriptorSize*vmdkSectorSize)
+	if _, err := r.ReadAt(descriptor, descriptorOffset*vmdkSectorSize); err != nil {
+		return info, fmt.Errorf("Cannot read VMDK descriptor: %v", err)
+	}
+
+	values := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(descriptor, "\x00")))
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		}
+	}
+	if t := values["createType"]; t != vmdkStreamOptimized {
+		return info, fmt.Errorf("VMDK is %s, not %s", t, vmdkStreamOptimized)
+	}
+	for _, g := range []struct {
+		key   string
+		value *int64
+	}{
+		{"ddb.geometry.cylinders", &info.Cylinders},
+		{"ddb.geometry.heads", &info.Heads},
+		{"ddb.geometry.sectors", &info.Sectors},
+	} {
+		v, err := strconv.ParseInt(values[g.key], 10, 64)
+		if err != nil {
+			return info, fmt.Errorf("Invalid %s in VMDK descriptor: %q", g.key, values[g.key])
+		}
+		*g.value = v
+	}
+	if info.Heads < 1 || info.Heads > 255 || info.Sectors < 1 || info.Sectors > 63 {
+		return info, fmt.Errorf("Invalid VMDK geometry of %d heads and %d sectors", info.Heads, info.Sectors)
+	}
+	// the cylinders are rounded up to cover the capacity
+	track := info.Heads * info.Sectors * vmdkSectorSize
+	if cylinders := (info.Capacity + track - 1) / track; info.Cylinders != cylinders {
+		return info, fmt.Errorf("VMDK geometry has %d cylinders, not the %d of its capacity", info.Cylinders, cylinders)
+	}
+	return info, nil
+}
+
+var ovfTemplate = template.Must(template.New("ovf").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="{{xml .Disk}}" ovf:id="file1" ovf:size="{{.DiskSize}}"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="{{.Capacity}}" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="{{.Format}}"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="VM Network">
+      <Description>The VM Network network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="{{xml .Name}}">
+    <Info>A LinuxKit virtual machine</Info>
+    <Name>{{xml .Name}}</Name>
+    <OperatingSystemSection ovf:id="101" vmw:osType="other3xLinux64Guest">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>{{xml .Name}}</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-10</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:Description>Number of Virtual CPUs</rasd:Description>
+        <rasd:ElementName>1 virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>1</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:Description>Memory Size</rasd:Description>
+        <rasd:ElementName>1024MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>1024</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:Description>SCSI Controller</rasd:Description>
+        <rasd:ElementName>SCSI controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>VM Network</rasd:Connection>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`))
+
+func xmlEscape(s string) (string, error) {
+	var b strings.Builder
+	err := xml.EscapeText(&b, []byte(s))
+	return b.String(), err
+}
+
+// ovfDescriptor is the OVF descriptor of the VM name, booting the
+// stream-optimized VMDK disk of diskSize bytes
+func ovfDescriptor(name, disk string, diskSize int64, info vmdkInfo) ([]byte, error) {
+	var b bytes.Buffer
+	err := ovfTemplate.Execute(&b, struct {
+		Name, Disk, Format string
+		DiskSize, Capacity int64
+	}{name, disk, vmdkStreamOptimizedID, diskSize, info.Capacity})
+	return b.Bytes(), err
+}
+
+// outputOVA writes the OVA filename of the VM name, with the
+// stream-optimized VMDK vmdk, an OVF descriptor and their manifest, in the
+// order the OVF specification needs
+func outputOVA(filename, name, vmdk string) error {
+	log.Debugf("output OVA: %s %s", filename, vmdk)
+	log.Infof("  %s", filename)
+	disk, err := os.Open(vmdk)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	fi, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	info, err := readVMDKInfo(disk)
+	if err != nil {
+		return fmt.Errorf("Cannot read %s: %v", vmdk, err)
+	}
+	diskName := name + ".vmdk"
+	ovf, err := ovfDescriptor(name, diskName, fi.Size(), info)
+	if err != nil {
+		return err
+	}
+	diskHash := sha256.New()
+	if _, err := io.Copy(diskHash, disk); err != nil {
+		return err
+	}
+	manifest := fmt.Sprintf("SHA256(%s.ovf)= %x\nSHA256(%s)= %x\n", name, sha256.Sum256(ovf), diskName, diskHash.Sum(nil))
+
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	tw := tar.NewWriter(output)
+	for _, f := range []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{name + ".ovf", int64(len(ovf)), bytes.NewReader(ovf)},
+		{name + ".mf", int64(len(manifest)), strings.NewReader(manifest)},
+		{diskName, fi.Size(), io.NewSectionReader(disk, 0, fi.Size())},
+	} {
+		hdr := &tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    f.size,
+			ModTime: defaultModTime,
+			Format:  tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f.r); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
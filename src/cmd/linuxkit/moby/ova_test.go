@@ -0,0 +1,163 @@
+package moby
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testVMDK is the start of a stream-optimized VMDK of capacity sectors, as
+// qemu-img writes it for an lsilogic adapter, with cylinders
+func testVMDK(capacity, cylinders int64) []byte {
+	b := make([]byte, 2*vmdkSectorSize)
+	binary.LittleEndian.PutUint32(b, vmdkMagic)
+	binary.LittleEndian.PutUint32(b[4:], 3)
+	binary.LittleEndian.PutUint64(b[12:], uint64(capacity))
+	binary.LittleEndian.PutUint64(b[20:], 128)
+	binary.LittleEndian.PutUint64(b[28:], 1)
+	binary.LittleEndian.PutUint64(b[36:], 1)
+	descriptor := fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=12345678
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RDONLY %d SPARSE "disk.vmdk"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "6"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "lsilogic"
+`, capacity, cylinders)
+	copy(b[vmdkSectorSize:], descriptor)
+	return b
+}
+
+func TestReadVMDKInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmdk")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 1GiB is 130.5 cylinders of 255 heads and 63 sectors
+	path := filepath.Join(dir, "disk.vmdk")
+	require.NoError(t, ioutil.WriteFile(path, testVMDK(2097152, 131), 0644))
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	info, err := readVMDKInfo(f)
+	require.NoError(t, err)
+	assert.Equal(t, vmdkInfo{Capacity: 1 << 30, Cylinders: 131, Heads: 255, Sectors: 63}, info)
+
+	path = filepath.Join(dir, "bad.vmdk")
+	require.NoError(t, ioutil.WriteFile(path, testVMDK(2097152, 130), 0644))
+	f, err = os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = readVMDKInfo(f)
+	assert.Error(t, err)
+}
+
+// ovfEnvelope is the part of an OVF envelope that refers to the disk
+type ovfEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.dmtf.org/ovf/envelope/1 Envelope"`
+	Files   []struct {
+		Href string `xml:"http://schemas.dmtf.org/ovf/envelope/1 href,attr"`
+		ID   string `xml:"http://schemas.dmtf.org/ovf/envelope/1 id,attr"`
+		Size int64  `xml:"http://schemas.dmtf.org/ovf/envelope/1 size,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		Capacity int64  `xml:"http://schemas.dmtf.org/ovf/envelope/1 capacity,attr"`
+		DiskID   string `xml:"http://schemas.dmtf.org/ovf/envelope/1 diskId,attr"`
+		FileRef  string `xml:"http://schemas.dmtf.org/ovf/envelope/1 fileRef,attr"`
+		Format   string `xml:"http://schemas.dmtf.org/ovf/envelope/1 format,attr"`
+	} `xml:"DiskSection>Disk"`
+	VirtualSystem struct {
+		ID    string `xml:"http://schemas.dmtf.org/ovf/envelope/1 id,attr"`
+		Name  string `xml:"Name"`
+		Items []struct {
+			InstanceID   string `xml:"http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData InstanceID"`
+			ResourceType int    `xml:"http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData ResourceType"`
+			HostResource string `xml:"http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData HostResource"`
+			Parent       string `xml:"http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData Parent"`
+		} `xml:"VirtualHardwareSection>Item"`
+	}
+}
+
+func TestOutputOVA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ova")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	vmdk := testVMDK(2097152, 131)
+	vmdkPath := filepath.Join(dir, "disk.vmdk")
+	require.NoError(t, ioutil.WriteFile(vmdkPath, vmdk, 0644))
+
+	ova := filepath.Join(dir, "linux&kit.ova")
+	require.NoError(t, outputOVA(ova, "linux&kit", vmdkPath))
+
+	f, err := os.Open(ova)
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var names []string
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tar.FormatUSTAR, hdr.Format)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		files[hdr.Name] = b
+	}
+	// the descriptor comes first, then the manifest
+	assert.Equal(t, []string{"linux&kit.ovf", "linux&kit.mf", "linux&kit.vmdk"}, names)
+	assert.Equal(t, vmdk, files["linux&kit.vmdk"])
+	assert.Equal(t, fmt.Sprintf("SHA256(linux&kit.ovf)= %x\nSHA256(linux&kit.vmdk)= %x\n", sha256.Sum256(files["linux&kit.ovf"]), sha256.Sum256(vmdk)), string(files["linux&kit.mf"]))
+
+	var envelope ovfEnvelope
+	require.NoError(t, xml.Unmarshal(files["linux&kit.ovf"], &envelope))
+	require.Len(t, envelope.Files, 1)
+	assert.Equal(t, "linux&kit.vmdk", envelope.Files[0].Href)
+	assert.Equal(t, int64(len(vmdk)), envelope.Files[0].Size)
+	require.Len(t, envelope.Disks, 1)
+	disk := envelope.Disks[0]
+	assert.Equal(t, envelope.Files[0].ID, disk.FileRef)
+	assert.Equal(t, int64(1<<30), disk.Capacity)
+	assert.Equal(t, vmdkStreamOptimizedID, disk.Format)
+	assert.Equal(t, "linux&kit", envelope.VirtualSystem.ID)
+	assert.Equal(t, "linux&kit", envelope.VirtualSystem.Name)
+
+	// the disk is on the SCSI controller
+	items := map[int]string{}
+	var diskParent string
+	for _, i := range envelope.VirtualSystem.Items {
+		items[i.ResourceType] = i.InstanceID
+		if i.ResourceType == 17 {
+			assert.Equal(t, "ovf:/disk/"+disk.DiskID, i.HostResource)
+			diskParent = i.Parent
+		}
+	}
+	assert.Equal(t, items[6], diskParent)
+	for _, r := range []int{3, 4, 6, 10, 17} {
+		assert.Contains(t, items, r)
+	}
+	assert.Contains(t, string(files["linux&kit.ovf"]), "<Name>linux&amp;kit</Name>")
+}
@@ -14,7 +14,21 @@ var schema = string(`
         "cmdline": {"type": "string"},
         "binary": {"type": "string"},
         "tar": {"type": "string"},
-        "ucode": {"type": "string"}
+        "ucode": {"type": "string"},
+        "modules": {
+          "type": "array",
+          "items": { "$ref": "#/definitions/module" }
+        }
+      }
+    },
+    "module": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string"},
+        "parameters": { "$ref": "#/definitions/strings" },
+        "required": {"type": "boolean"}
       }
     },
     "file": {
@@ -26,6 +40,8 @@ var schema = string(`
           "symlink": {"type": "string"},
           "contents": {"type": "string"},
           "source": {"type": "string"},
+          "url": {"type": "string"},
+          "sha256": {"type": "string"},
           "metadata": {"type": "string"},
           "optional": {"type": "boolean"},
           "mode": {"type": "string"},
@@ -259,6 +275,7 @@ var schema = string(`
       "properties": {
         "name": {"type": "string"},
         "image": {"type": "string"},
+        "exclude": { "$ref": "#/definitions/strings" },
         "capabilities": { "$ref": "#/definitions/strings" },
         "capabilities.add": { "$ref": "#/definitions/strings" },
         "ambient": { "$ref": "#/definitions/strings" },
@@ -300,16 +317,77 @@ var schema = string(`
     "images": {
         "type": "array",
         "items": { "$ref": "#/definitions/image" }
+    },
+    "output": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "cmdline": {"type": "string"},
+        "cmdline.add": {"type": "string"},
+        "partitions": {
+          "type": "array",
+          "items": { "$ref": "#/definitions/partition" }
+        },
+        "esp": { "$ref": "#/definitions/esp" }
+      }
+    },
+    "esp": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "bootloader": {"type": "string"},
+        "title": {"type": "string"},
+        "files": {
+          "type": "array",
+          "items": {
+            "type": "object",
+            "additionalProperties": false,
+            "properties": {
+              "path": {"type": "string"},
+              "contents": {"type": "string"},
+              "source": {"type": "string"}
+            }
+          }
+        }
+      }
+    },
+    "partition": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "label": {"type": "string"},
+        "size": {"type": "string"},
+        "filesystem": {"type": "string"},
+        "boot": {"type": "boolean"}
+      }
+    },
+    "rootfs": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "type": {"type": "string"},
+        "upper": {"type": "string"}
+      }
+    },
+    "outputs": {
+      "type": "object",
+      "additionalProperties": { "$ref": "#/definitions/output" }
     }
   },
   "properties": {
+    "include": { "$ref": "#/definitions/strings" },
     "kernel": { "$ref": "#/definitions/kernel" },
     "init": { "$ref": "#/definitions/strings" },
     "onboot": { "$ref": "#/definitions/images" },
     "onshutdown": { "$ref": "#/definitions/images" },
     "services": { "$ref": "#/definitions/images" },
     "trust": { "$ref": "#/definitions/trust" },
-    "files": { "$ref": "#/definitions/files" }
+    "files": { "$ref": "#/definitions/files" },
+    "outputs": { "$ref": "#/definitions/outputs" },
+    "rootfs": { "$ref": "#/definitions/rootfs" }
+  },
+  "patternProperties": {
+    "^x-": {}
   }
 }
 `)
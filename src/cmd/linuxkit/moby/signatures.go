@@ -0,0 +1,184 @@
+package moby
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	lktregistry "github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrUnsigned is returned by a SignatureVerifier for an image without any
+// signature
+var ErrUnsigned = errors.New("image is not signed")
+
+// SignatureVerifier checks that images are signed by a trusted key or
+// identity
+type SignatureVerifier interface {
+	// Verify returns nil if image has a trusted signature, ErrUnsigned if
+	// it has no signature, or else an error saying why none is trusted
+	Verify(image string) error
+}
+
+// TrustPolicy is the type of a trust policy file, listing the keys and
+// keyless identities whose signatures are trusted
+type TrustPolicy struct {
+	// Keys are cosign public key files, or KMS URIs
+	Keys []string `yaml:"keys,omitempty"`
+	// Identities are the certificate identities of keyless signatures
+	Identities []TrustedIdentity `yaml:"identities,omitempty"`
+}
+
+// TrustedIdentity is a keyless signing identity, the OIDC issuer and a
+// regular expression matching the subject of the certificate
+type TrustedIdentity struct {
+	Issuer  string `yaml:"issuer"`
+	Subject string `yaml:"subject"`
+}
+
+// LoadTrustPolicy reads the trust policy file path. Key files are relative
+// to the directory it is in.
+func LoadTrustPolicy(path string) (TrustPolicy, error) {
+	var p TrustPolicy
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return p, fmt.Errorf("Invalid trust policy %s: %v", path, err)
+	}
+	if len(p.Keys) == 0 && len(p.Identities) == 0 {
+		return p, fmt.Errorf("Trust policy %s trusts no keys or identities", path)
+	}
+	for i, k := range p.Keys {
+		if !strings.Contains(k, "://") && !filepath.IsAbs(k) {
+			p.Keys[i] = filepath.Join(filepath.Dir(path), k)
+		}
+	}
+	for _, id := range p.Identities {
+		if id.Issuer == "" || id.Subject == "" {
+			return p, fmt.Errorf("Trust policy %s has an identity without an issuer or subject", path)
+		}
+		if _, err := regexp.Compile(id.Subject); err != nil {
+			return p, fmt.Errorf("Invalid subject %q in trust policy %s: %v", id.Subject, path, err)
+		}
+	}
+	return p, nil
+}
+
+// VerifySignatures checks with v that every image m is built from is
+// signed, by a key or identity v trusts
+func VerifySignatures(m Moby, v SignatureVerifier) error {
+	m, err := withModules(m)
+	if err != nil {
+		return err
+	}
+	var images []string
+	if m.Kernel.ref != nil {
+		images = append(images, m.Kernel.ref.String())
+	}
+	for _, ref := range m.initRefs {
+		images = append(images, ref.String())
+	}
+	for _, section := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range section {
+			if image.ref != nil {
+				images = append(images, image.ref.String())
+			}
+		}
+	}
+
+	verified := map[string]bool{}
+	for _, image := range images {
+		if verified[image] {
+			continue
+		}
+		log.Infof("Verify signatures of %s", image)
+		switch err := v.Verify(image); {
+		case err == ErrUnsigned:
+			return fmt.Errorf("Image %s is not signed", image)
+		case err != nil:
+			return fmt.Errorf("Image %s is not signed by a trusted key or identity: %v", image, err)
+		}
+		verified[image] = true
+	}
+	return nil
+}
+
+// cosignVerifier verifies signatures with cosign
+type cosignVerifier struct {
+	policy TrustPolicy
+}
+
+// NewCosignVerifier returns a SignatureVerifier checking with cosign the
+// signatures of images against policy
+func NewCosignVerifier(policy TrustPolicy) SignatureVerifier {
+	return cosignVerifier{policy: policy}
+}
+
+func (v cosignVerifier) Verify(image string) error {
+	var args [][]string
+	for _, key := range v.policy.Keys {
+		args = append(args, []string{"--key", key})
+	}
+	for _, id := range v.policy.Identities {
+		args = append(args, []string{"--certificate-oidc-issuer", id.Issuer, "--certificate-identity-regexp", id.Subject})
+	}
+	var failures []string
+	for _, a := range args {
+		var out bytes.Buffer
+		cmd := exec.Command("cosign", append(append([]string{"verify"}, a...), image)...)
+		cmd.Stdout = ioutil.Discard
+		cmd.Stderr = &out
+		cmd.Env = os.Environ()
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return fmt.Errorf("cannot run cosign: %v", err)
+		}
+		log.Debugf("cosign verify %s: %s", strings.Join(a, " "), out.String())
+		failures = append(failures, strings.Join(a, " "))
+	}
+
+	signed, err := hasSignatures(image)
+	if err != nil {
+		return err
+	}
+	if !signed {
+		return ErrUnsigned
+	}
+	return fmt.Errorf("no signature verified with %s", strings.Join(failures, ", or "))
+}
+
+// hasSignatures reports whether cosign has pushed signatures of image, to
+// the tag it gives them next to it
+func hasSignatures(image string) (bool, error) {
+	ref, err := namepkg.ParseReference(image)
+	if err != nil {
+		return false, err
+	}
+	options := []remote.Option{remote.WithAuthFromKeychain(lktregistry.Keychain)}
+	desc, err := remote.Head(ref, options...)
+	if err != nil {
+		return false, fmt.Errorf("unable to find %s in registry: %v", image, err)
+	}
+	tag := ref.Context().Tag(strings.Replace(desc.Digest.String(), ":", "-", 1) + ".sig")
+	_, err = remote.Head(tag, options...)
+	if terr, ok := err.(*transport.Error); ok && terr.StatusCode == 404 {
+		return false, nil
+	}
+	return err == nil, err
+}
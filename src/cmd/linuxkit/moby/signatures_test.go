@@ -0,0 +1,132 @@
+package moby
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const signaturesConfigYAML = `kernel:
+  image: linuxkit/kernel:5.10
+init:
+  - linuxkit/init:v0.8
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v0.8
+services:
+  - name: getty
+    image: linuxkit/getty:v0.8
+  - name: rngd
+    image: linuxkit/rngd:v0.8
+`
+
+// fakeVerifier trusts the images in trusted, and finds no signatures on
+// those in unsigned
+type fakeVerifier struct {
+	trusted  map[string]bool
+	unsigned map[string]bool
+	verified []string
+}
+
+func (v *fakeVerifier) Verify(image string) error {
+	v.verified = append(v.verified, image)
+	switch {
+	case v.trusted[image]:
+		return nil
+	case v.unsigned[image]:
+		return ErrUnsigned
+	}
+	return errors.New("no signature verified with --key cosign.pub")
+}
+
+func signaturesConfig(t *testing.T) Moby {
+	m, err := NewConfig([]byte(signaturesConfigYAML))
+	require.NoError(t, err)
+	return m
+}
+
+var signaturesImages = []string{
+	"docker.io/linuxkit/kernel:5.10",
+	"docker.io/linuxkit/init:v0.8",
+	"docker.io/linuxkit/sysctl:v0.8",
+	"docker.io/linuxkit/getty:v0.8",
+	"docker.io/linuxkit/rngd:v0.8",
+}
+
+func trustAll() map[string]bool {
+	trusted := map[string]bool{}
+	for _, image := range signaturesImages {
+		trusted[image] = true
+	}
+	return trusted
+}
+
+func TestVerifySignaturesTrusted(t *testing.T) {
+	v := &fakeVerifier{trusted: trustAll()}
+	require.NoError(t, VerifySignatures(signaturesConfig(t), v))
+	assert.Equal(t, signaturesImages, v.verified)
+}
+
+func TestVerifySignaturesUntrusted(t *testing.T) {
+	trusted := trustAll()
+	delete(trusted, "docker.io/linuxkit/getty:v0.8")
+	err := VerifySignatures(signaturesConfig(t), &fakeVerifier{trusted: trusted})
+	require.Error(t, err)
+	assert.Equal(t, "Image docker.io/linuxkit/getty:v0.8 is not signed by a trusted key or identity: no signature verified with --key cosign.pub", err.Error())
+}
+
+func TestVerifySignaturesUnsigned(t *testing.T) {
+	trusted := trustAll()
+	delete(trusted, "docker.io/linuxkit/sysctl:v0.8")
+	v := &fakeVerifier{trusted: trusted, unsigned: map[string]bool{"docker.io/linuxkit/sysctl:v0.8": true}}
+	err := VerifySignatures(signaturesConfig(t), v)
+	require.Error(t, err)
+	assert.Equal(t, "Image docker.io/linuxkit/sysctl:v0.8 is not signed", err.Error())
+	// nothing after it is verified
+	assert.Equal(t, signaturesImages[:3], v.verified)
+}
+
+func TestVerifySignaturesModules(t *testing.T) {
+	m := signaturesConfig(t)
+	m.Kernel.Modules = []KernelModule{{Name: "wireguard"}}
+	v := &fakeVerifier{trusted: trustAll()}
+	err := VerifySignatures(m, v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "linuxkit/modprobe")
+}
+
+func TestLoadTrustPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trust")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.yml")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`keys:
+  - cosign.pub
+  - awskms:///alias/linuxkit
+identities:
+  - issuer: https://token.actions.githubusercontent.com
+    subject: ^https://github.com/linuxkit/linuxkit/
+`), 0644))
+	p, err := LoadTrustPolicy(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "cosign.pub"), "awskms:///alias/linuxkit"}, p.Keys)
+	assert.Equal(t, []TrustedIdentity{{Issuer: "https://token.actions.githubusercontent.com", Subject: "^https://github.com/linuxkit/linuxkit/"}}, p.Identities)
+
+	for _, policy := range []string{
+		"",
+		"keys: []\n",
+		"identities:\n  - issuer: https://accounts.google.com\n",
+		"identities:\n  - issuer: https://accounts.google.com\n    subject: \"(\"\n",
+		"trusted: [cosign.pub]\n",
+	} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(policy), 0644))
+		_, err := LoadTrustPolicy(path)
+		assert.Error(t, err, policy)
+	}
+}
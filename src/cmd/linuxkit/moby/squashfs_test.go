@@ -0,0 +1,130 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetSquashfsCompression(t *testing.T) {
+	defer func() { squashfsCompression = "" }()
+	for _, c := range []string{"", "gzip", "xz", "zstd"} {
+		assert.NoError(t, SetSquashfsCompression(c), c)
+		assert.Equal(t, c, squashfsCompression)
+	}
+	for _, c := range []string{"lz4", "bzip2", "-comp"} {
+		assert.Error(t, SetSquashfsCompression(c), c)
+	}
+}
+
+// squashfsTestImage is the output of a build, with the boot files, a
+// directory, a symlink, a device node and an executable
+func squashfsTestImage(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "boot/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 04755, Uid: 100, Gid: 101, Size: 4},
+		{Name: "bin/link", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "tool"},
+		{Name: "dev/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	} {
+		require.NoError(t, tw.WriteHeader(h))
+		switch h.Name {
+		case "boot/kernel":
+			tw.Write([]byte("kernel"))
+		case "boot/cmdline":
+			tw.Write([]byte("console=ttyS0"))
+		case "bin/tool":
+			tw.Write([]byte("tool"))
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestSquashfsRootfs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squashfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "linuxkit")
+
+	for _, b := range []string{base, ""} {
+		rootfs, err := squashfsRootfs(bytes.NewReader(squashfsTestImage(t)), b)
+		require.NoError(t, err)
+		var names []string
+		tr := tar.NewReader(rootfs)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, h.Name)
+			if h.Name == "dev/null" {
+				assert.Equal(t, byte(tar.TypeChar), h.Typeflag)
+				assert.Equal(t, int64(1), h.Devmajor)
+				assert.Equal(t, int64(3), h.Devminor)
+			}
+		}
+		assert.Equal(t, []string{"bin/", "bin/tool", "bin/link", "dev/", "dev/null"}, names)
+	}
+
+	kernel, err := ioutil.ReadFile(base + "-kernel")
+	require.NoError(t, err)
+	assert.Equal(t, "kernel", string(kernel))
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	require.NoError(t, err)
+	assert.Equal(t, "console=ttyS0", string(cmdline))
+}
+
+// TestOutputSquashFS builds a squashfs with the mkimage-squashfs image and
+// checks its listing with unsquashfs
+func TestOutputSquashFS(t *testing.T) {
+	for _, tool := range []string{"docker", "unsquashfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not available", tool)
+		}
+	}
+	dir, err := ioutil.TempDir("", "squashfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	img := filepath.Join(dir, "linuxkit.squashfs")
+
+	defer func() { squashfsCompression = "" }()
+	require.NoError(t, SetSquashfsCompression("zstd"))
+	require.NoError(t, outputSquashFS(outputImages["squashfs"], img, bytes.NewReader(squashfsTestImage(t))))
+
+	out, err := exec.Command("unsquashfs", "-s", img).CombinedOutput()
+	require.NoError(t, err, string(out))
+	assert.Contains(t, string(out), "Compression zstd")
+
+	out, err = exec.Command("unsquashfs", "-lln", img).CombinedOutput()
+	require.NoError(t, err, string(out))
+	listing := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		for _, f := range fields {
+			if strings.HasPrefix(f, "squashfs-root/") {
+				listing[strings.TrimPrefix(f, "squashfs-root/")] = fields[0] + " " + fields[1]
+			}
+		}
+	}
+	assert.Equal(t, "-rwsr-xr-x 100/101", listing["bin/tool"])
+	assert.Equal(t, "lrwxrwxrwx 0/0", listing["bin/link"])
+	assert.Equal(t, "crw-rw-rw- 0/0", listing["dev/null"])
+	_, ok := listing["boot/kernel"]
+	assert.False(t, ok, "the kernel is not in the squashfs")
+}
@@ -0,0 +1,102 @@
+package moby
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// strictTypeNames are how the types of the config are named in the errors
+// of CheckStrict
+var strictTypeNames = map[string]string{
+	"moby.KernelConfig": "kernel",
+	"moby.KernelModule": "module",
+	"moby.Image":        "image",
+	"moby.File":         "file",
+	"moby.Runtime":      "runtime",
+	"moby.Namespaces":   "bindNS",
+	"moby.Interface":    "interface",
+	"moby.OutputConfig": "output",
+	"moby.Partition":    "partition",
+	"moby.ESPConfig":    "esp",
+	"moby.ESPFile":      "esp file",
+	"moby.RootfsConfig": "rootfs",
+}
+
+// strictTopLevel are the top level keys of a config
+var strictTopLevel = map[string]bool{"include": true, "kernel": true, "init": true, "onboot": true, "onshutdown": true, "services": true, "files": true, "trust": true, "outputs": true, "rootfs": true}
+
+// strictConfig is a config with its top level keys left to CheckStrict,
+// which allows the x- ones
+type strictConfig struct {
+	Moby  `yaml:",inline"`
+	Other map[string]interface{} `yaml:",inline"`
+}
+
+var strictErrorRegexp = regexp.MustCompile(`^line (\d+): (.*?)(?: in type ([\w.]+))?$`)
+
+// CheckStrict checks a config more strictly than NewConfig, rejecting
+// keys that are not part of the config even where the schema allows them,
+// and describes each problem with the line of name, the file or URL of the
+// config, it is on. Top level keys starting with x- are allowed, for
+// anchors.
+func CheckStrict(name string, config []byte) error {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(config, &root); err != nil {
+		return strictError(name, err)
+	}
+	var problems []string
+	if len(root.Content) == 1 && root.Content[0].Kind == yamlv3.MappingNode {
+		doc := root.Content[0]
+		for i := 0; i < len(doc.Content); i += 2 {
+			key := doc.Content[i]
+			if !strictTopLevel[key.Value] && !strings.HasPrefix(key.Value, "x-") {
+				problems = append(problems, fmt.Sprintf("%s:%d: unknown top level key %s", name, key.Line, key.Value))
+			}
+		}
+	}
+
+	dec := yamlv3.NewDecoder(bytes.NewReader(config))
+	dec.KnownFields(true)
+	var c strictConfig
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		var terr *yamlv3.TypeError
+		if !errors.As(err, &terr) {
+			return strictError(name, err)
+		}
+		for _, e := range terr.Errors {
+			problems = append(problems, strictMessage(name, e))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func strictError(name string, err error) error {
+	return errors.New(strictMessage(name, strings.TrimPrefix(err.Error(), "yaml: ")))
+}
+
+// strictMessage turns "line 4: field comamnd not found in type moby.Image"
+// into "name:4: field comamnd not found in image"
+func strictMessage(name, e string) string {
+	parts := strictErrorRegexp.FindStringSubmatch(e)
+	if parts == nil {
+		return name + ": " + e
+	}
+	msg := fmt.Sprintf("%s:%s: %s", name, parts[1], parts[2])
+	if parts[3] != "" {
+		t, ok := strictTypeNames[parts[3]]
+		if !ok {
+			t = parts[3]
+		}
+		msg += " in " + t
+	}
+	return msg
+}
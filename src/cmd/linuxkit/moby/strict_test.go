@@ -0,0 +1,40 @@
+package moby
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const strictConfigYAML = `kernel:
+  image: linuxkit/kernel:5.10
+init:
+  - linuxkit/init:v1
+x-getty: &getty
+  image: linuxkit/getty:v1
+services:
+  - <<: *getty
+    name: getty
+  - name: rngd
+    image: linuxkit/rngd:v1
+    command: ["/sbin/rngd", "-f"]
+files:
+  - path: etc/motd
+    contents: hello
+`
+
+func TestCheckStrict(t *testing.T) {
+	assert.NoError(t, CheckStrict("linuxkit.yml", []byte(strictConfigYAML)))
+
+	config := strings.Replace(strictConfigYAML, "command:", "comamnd:", 1)
+	assert.EqualError(t, CheckStrict("linuxkit.yml", []byte(config)), "linuxkit.yml:12: field comamnd not found in image")
+
+	assert.EqualError(t, CheckStrict("<stdin>", []byte("kernel:\n  image: linuxkit/kernel:5.10\n  cmdlin: console=ttyS0\nservces: []\n")),
+		"<stdin>:4: unknown top level key servces\n<stdin>:3: field cmdlin not found in kernel")
+
+	err := CheckStrict("linuxkit.yml", []byte("services:\n  - name: getty\n  image: linuxkit/getty:v1\n"))
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "linuxkit.yml:"), err.Error())
+}
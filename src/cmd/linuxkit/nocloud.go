@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// noCloudLabel is the volume label of a cloud-init NoCloud seed
+	noCloudLabel = "cidata"
+
+	isoSectorSize = 2048
+	// the primary volume descriptor, terminator, little and big endian
+	// path tables and root directory follow the 16 reserved sectors
+	isoPVDSector       = 16
+	isoLPathSector     = 18
+	isoMPathSector     = 19
+	isoRootSector      = 20
+	isoFirstFileSector = 21
+	// isoPadSectors are the empty sectors at the end of the image, as
+	// mkisofs adds, as some readers read past the last file
+	isoPadSectors = 150
+)
+
+// WriteNoCloudISO writes a cloud-init NoCloud seed ISO to path, with the
+// user-data userdata and meta-data metadata, which the metadata package and
+// cloud-init find by its cidata label
+func WriteNoCloudISO(path string, userdata, metadata []byte) error {
+	var b bytes.Buffer
+	if err := writeISO(&b, noCloudLabel, map[string][]byte{"user-data": userdata, "meta-data": metadata}); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b.Bytes(), 0644)
+}
+
+// noCloudMetadata is the meta-data of a NoCloud seed for the VM name
+func noCloudMetadata(name string) []byte {
+	return []byte(fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", name, name))
+}
+
+// CreateNoCloudISO writes a NoCloud seed ISO, with the user data read from
+// userdataPath, to the state directory, and returns its path
+func CreateNoCloudISO(state, name, userdataPath string) (string, error) {
+	userdata, err := ioutil.ReadFile(userdataPath)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read user data from path %s: %v", userdataPath, err)
+	}
+	isoPath := filepath.Join(state, "seed.iso")
+	if err := WriteNoCloudISO(isoPath, userdata, noCloudMetadata(name)); err != nil {
+		return "", fmt.Errorf("Cannot write NoCloud seed ISO: %v", err)
+	}
+	return isoPath, nil
+}
+
+// writeISO writes an ISO 9660 image labelled label, with files in its root
+// directory. The image only depends on its contents, as all its times are
+// left unspecified or the epoch.
+func writeISO(w io.Writer, label string, files map[string][]byte) error {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var root []byte
+	root = append(root, isoDirRecord("\x00", isoRootSector, isoSectorSize, true)...)
+	root = append(root, isoDirRecord("\x01", isoRootSector, isoSectorSize, true)...)
+	sector := uint32(isoFirstFileSector)
+	for _, name := range names {
+		root = append(root, isoDirRecord(name, sector, uint32(len(files[name])), false)...)
+		sector += isoSectors(len(files[name]))
+	}
+	if len(root) > isoSectorSize {
+		return fmt.Errorf("too many files for an ISO root directory")
+	}
+	sectors := sector + isoPadSectors
+
+	image := make([]byte, int(sectors)*isoSectorSize)
+	copy(image[isoPVDSector*isoSectorSize:], isoPrimaryVolumeDescriptor(label, sectors))
+	copy(image[(isoPVDSector+1)*isoSectorSize:], []byte("\xffCD001\x01"))
+	copy(image[isoLPathSector*isoSectorSize:], isoPathTable(binary.LittleEndian))
+	copy(image[isoMPathSector*isoSectorSize:], isoPathTable(binary.BigEndian))
+	copy(image[isoRootSector*isoSectorSize:], root)
+	sector = isoFirstFileSector
+	for _, name := range names {
+		copy(image[int(sector)*isoSectorSize:], files[name])
+		sector += isoSectors(len(files[name]))
+	}
+	_, err := w.Write(image)
+	return err
+}
+
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func isoBothEndian32(v uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+	return b
+}
+
+func isoBothEndian16(v uint16) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+	return b
+}
+
+// isoPadded is s padded with spaces to n bytes
+func isoPadded(s string, n int) []byte {
+	return []byte(fmt.Sprintf("%-*s", n, s)[:n])
+}
+
+// isoDirRecord is the directory record of the file or directory name, of
+// size bytes from sector, recorded at the epoch
+func isoDirRecord(name string, sector, size uint32, dir bool) []byte {
+	r := []byte{byte(33 + len(name)), 0}
+	r = append(r, isoBothEndian32(sector)...)
+	r = append(r, isoBothEndian32(size)...)
+	r = append(r, 70, 1, 1, 0, 0, 0, 0)
+	var flags byte
+	if dir {
+		flags = 2
+	}
+	r = append(r, flags, 0, 0)
+	r = append(r, isoBothEndian16(1)...)
+	r = append(r, byte(len(name)))
+	r = append(r, name...)
+	if len(r)%2 == 1 {
+		r = append(r, 0)
+	}
+	return r
+}
+
+func isoPrimaryVolumeDescriptor(label string, sectors uint32) []byte {
+	unspecified := append(bytes.Repeat([]byte("0"), 16), 0)
+	d := []byte("\x01CD001\x01\x00")
+	d = append(d, isoPadded("", 32)...)
+	d = append(d, isoPadded(label, 32)...)
+	d = append(d, make([]byte, 8)...)
+	d = append(d, isoBothEndian32(sectors)...)
+	d = append(d, make([]byte, 32)...)
+	d = append(d, isoBothEndian16(1)...)
+	d = append(d, isoBothEndian16(1)...)
+	d = append(d, isoBothEndian16(isoSectorSize)...)
+	// the path table has the root directory only
+	d = append(d, isoBothEndian32(10)...)
+	l, m := make([]byte, 8), make([]byte, 8)
+	binary.LittleEndian.PutUint32(l, isoLPathSector)
+	binary.BigEndian.PutUint32(m, isoMPathSector)
+	d = append(d, l...)
+	d = append(d, m...)
+	d = append(d, isoDirRecord("\x00", isoRootSector, isoSectorSize, true)...)
+	d = append(d, isoPadded("", 128*4+37*3)...)
+	for i := 0; i < 4; i++ {
+		d = append(d, unspecified...)
+	}
+	return append(d, 1)
+}
+
+func isoPathTable(bo binary.ByteOrder) []byte {
+	t := make([]byte, 10)
+	t[0] = 1
+	bo.PutUint32(t[2:], isoRootSector)
+	bo.PutUint16(t[6:], 1)
+	return t
+}
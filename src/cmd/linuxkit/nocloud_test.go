@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readISO returns the label and the files in the root directory of the ISO
+// 9660 image iso
+func readISO(t *testing.T, iso []byte) (string, map[string][]byte) {
+	require.True(t, len(iso) > 17*isoSectorSize)
+	pvd := iso[16*isoSectorSize:]
+	require.Equal(t, []byte("\x01CD001\x01"), pvd[:7])
+	label := strings.TrimSpace(string(pvd[40:72]))
+	require.Equal(t, uint32(len(iso)/isoSectorSize), binary.LittleEndian.Uint32(pvd[80:]))
+
+	rootRecord := pvd[156:]
+	root := iso[binary.LittleEndian.Uint32(rootRecord[2:])*isoSectorSize:]
+	root = root[:binary.LittleEndian.Uint32(rootRecord[10:])]
+	files := map[string][]byte{}
+	for len(root) > 0 && root[0] != 0 {
+		record := root[:root[0]]
+		name := string(record[33 : 33+record[32]])
+		if record[25]&2 == 0 {
+			start := binary.LittleEndian.Uint32(record[2:]) * isoSectorSize
+			files[name] = iso[start : start+binary.LittleEndian.Uint32(record[10:])]
+		}
+		root = root[record[0]:]
+	}
+	return label, files
+}
+
+func TestWriteNoCloudISO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-nocloud")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	userdata := filepath.Join(dir, "user-data")
+	require.NoError(t, ioutil.WriteFile(userdata, []byte("#cloud-config\nhostname: linuxkit\n"), 0644))
+
+	seed, err := CreateNoCloudISO(dir, "image", userdata)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "seed.iso"), seed)
+	iso, err := ioutil.ReadFile(seed)
+	require.NoError(t, err)
+
+	label, files := readISO(t, iso)
+	assert.Equal(t, "cidata", label)
+	assert.Equal(t, map[string][]byte{
+		"meta-data": []byte("instance-id: image\nlocal-hostname: image\n"),
+		"user-data": []byte("#cloud-config\nhostname: linuxkit\n"),
+	}, files)
+
+	// the same contents make the same image
+	again, err := CreateNoCloudISO(dir, "image", userdata)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(again)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(iso, b))
+
+	_, err = CreateNoCloudISO(dir, "image", filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestWriteISOLargeFile(t *testing.T) {
+	var b bytes.Buffer
+	big := bytes.Repeat([]byte("linuxkit"), 1000)
+	require.NoError(t, writeISO(&b, "cidata", map[string][]byte{"user-data": big, "meta-data": nil}))
+	_, files := readISO(t, b.Bytes())
+	assert.Equal(t, big, files["user-data"])
+	assert.Empty(t, files["meta-data"])
+}
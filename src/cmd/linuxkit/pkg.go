@@ -14,6 +14,7 @@ func pkgUsage() {
 	fmt.Printf("  build\n")
 	fmt.Printf("  push\n")
 	fmt.Printf("  show-tag\n")
+	fmt.Printf("  status\n")
 	fmt.Printf("\n")
 	fmt.Printf("'options' are the command specific options.\n")
 	fmt.Printf("See '%s pkg [command] --help' for details.\n\n", invoked)
@@ -32,6 +33,8 @@ func pkg(args []string) {
 		pkgPush(args[1:])
 	case "show-tag":
 		pkgShowTag(args[1:])
+	case "status":
+		pkgStatus(args[1:])
 	default:
 		fmt.Printf("Unknown subcommand %q\n\n", args[0])
 		pkgUsage()
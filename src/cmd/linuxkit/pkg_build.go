@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -34,11 +41,33 @@ func pkgBuildPush(args []string, withPush bool) {
 	}
 
 	force := flags.Bool("force", false, "Force rebuild even if image is in local cache")
+	noCache := flags.Bool("no-cache", false, "Rebuild without the BuildKit layer cache, as with -disable-cache, implies -force. The tag, from the source, is the same")
 	docker := flags.Bool("docker", false, "Store the built image in the docker image cache instead of the default linuxkit cache")
 	platforms := flags.String("platforms", "", "Which platforms to build for, defaults to all of those for which the package can be built")
 	skipPlatforms := flags.String("skip-platforms", "", "Platforms that should be skipped, even if present in build.yml")
 	builders := flags.String("builders", "", "Which builders to use for which platforms, e.g. linux/arm64=docker-context-arm64, overrides defaults and environment variables, see https://github.com/linuxkit/linuxkit/blob/master/docs/packages.md#Providing-native-builder-nodes")
 	buildCacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for storing built image, incompatible with --docker")
+	requireSigned := flags.Bool("require-signed", false, "Refuse to build unless the commit, or tag, being built has a valid GPG or SSH signature")
+	var cacheFrom multipleFlag
+	flags.Var(&cacheFrom, "cache-from", "Import BuildKit layer cache from a registry ref, or a type=registry buildx cache spec, the platform is appended to its tag. May be repeated")
+	var secrets multipleFlag
+	flags.Var(&secrets, "secret", "Expose a secret to the build, as id=foo,src=path or id=foo,env=VAR, for RUN --mount=type=secret,id=foo. It is not part of the hash or the image. May be repeated")
+	registerBinfmt := flags.Bool("register-binfmt", false, "Register the qemu-user-static binfmt_misc handlers, with a privileged docker container, if a platform built without a native builder cannot be emulated")
+	sbom := flags.Bool("sbom", false, "Attach an SBOM of the build context to the pushed manifest as an OCI referrer, skipped when not pushing")
+	sbomFormat := flags.String("sbom-format", pkglib.SBOMFormatSPDX, "Format of the SBOM, "+pkglib.SBOMFormatSPDX+" or "+pkglib.SBOMFormatCycloneDX)
+	provenance := flags.Bool("provenance", false, "Attach the SLSA provenance of the build, with the git repository, commit and tree hash it is built from and its parameters, to the pushed manifest as an OCI referrer, skipped when not pushing")
+	provenanceMode := flags.String("provenance-mode", pkglib.ProvenanceModeMin, "Provenance detail, "+pkglib.ProvenanceModeMin+" for the source and the parameters which change the tag, or "+pkglib.ProvenanceModeMax+" for every build parameter and file of the build context too")
+	sign := flags.Bool("sign", false, "Sign the pushed manifest with cosign, attaching the signature as an OCI artifact, skipped when not pushing")
+	signKey := flags.String("sign-key", os.Getenv("COSIGN_KEY"), "Key to sign with, a cosign key file or KMS URI, defaults to $COSIGN_KEY, or if that is not set signs keyless. The key password is read from $COSIGN_PASSWORD by cosign")
+	var sourceDateEpoch sourceDateEpochFlag
+	flags.Var(&sourceDateEpoch, "source-date-epoch", "Give the image config and layer contents the commit date of the package, or with -source-date-epoch=<unix time> that timestamp, for reproducible images. $SOURCE_DATE_EPOCH sets the timestamp too. Needs BuildKit v0.13 or later")
+	cacheTo := flags.String("cache-to", "", "Export BuildKit layer cache to a registry ref, or a type=registry buildx cache spec such as type=registry,ref=<ref>,mode=max, the platform is appended to its tag")
+	skipExisting := flags.Bool("skip-existing", false, "Skip building, and pushing, each package whose tag is already in the registry. A package which cannot be looked up, is dirty or is released is built")
+	progress := flags.String("progress", pkglib.ProgressAuto, "BuildKit progress output, "+pkglib.ProgressAuto+", "+pkglib.ProgressPlain+" for CI logs, with a timestamp on every line, "+pkglib.ProgressTTY+" or "+pkglib.ProgressQuiet+", which only prints errors and the tag of each package built")
+	parallel := flags.Int("parallel", 1, "Number of packages to build at once. A package is built after those it lists in depends.packages, and the output of each is printed when it is done")
+	dryRun := flags.Bool("dry-run", false, "Print the tag and platforms of each package instead of building it")
+	printHashes := flags.Bool("print-hashes", false, "With -dry-run, also print the source hash of each package and whether its tree is dirty")
+	dryRunFormat := flags.String("format", "text", "Output format of -dry-run, text or json, which always has the hashes")
 
 	// some logic clarification:
 	// pkg build                   - always builds unless is in cache
@@ -52,12 +81,18 @@ func pkgBuildPush(args []string, withPush bool) {
 		release           *string
 		nobuild, manifest *bool
 		nobuildRef        = false
+		onlyPlatform      = new(string)
+		pushRetries       *int
 	)
 	nobuild = &nobuildRef
+	if !withPush {
+		onlyPlatform = flags.String("only-platform", "", "Build only for the given platforms, comma separated, which must be declared in build.yml. A single platform is built without a multi-arch index and loaded into docker")
+	}
 	if withPush {
 		release = flags.String("release", "", "Release the given version")
 		nobuild = flags.Bool("nobuild", false, "Skip building the image before pushing, conflicts with -force")
 		manifest = flags.Bool("manifest", true, "Create and push multi-arch manifest")
+		pushRetries = flags.Int("push-retries", registry.DefaultPushRetries, "Number of times to retry a push failing with a transient error, such as a 5xx response or a reset connection")
 	}
 
 	pkgs, err := pkglib.NewFromCLI(flags, args...)
@@ -70,14 +105,88 @@ func pkgBuildPush(args []string, withPush bool) {
 		fmt.Fprint(os.Stderr, "flags -force and -nobuild conflict")
 		os.Exit(1)
 	}
+	if *skipExisting && *force {
+		fmt.Fprintln(os.Stderr, "flags -force and -skip-existing conflict")
+		os.Exit(1)
+	}
+	if *noCache && (*nobuild || *skipExisting) {
+		fmt.Fprintln(os.Stderr, "flag -no-cache conflicts with -nobuild and -skip-existing")
+		os.Exit(1)
+	}
+	if *parallel < 1 {
+		fmt.Fprintln(os.Stderr, "-parallel must be at least 1")
+		os.Exit(1)
+	}
+	if *printHashes && !*dryRun {
+		fmt.Fprintln(os.Stderr, "-print-hashes requires -dry-run")
+		os.Exit(1)
+	}
+	if *dryRunFormat != "text" && *dryRunFormat != "json" {
+		fmt.Fprintf(os.Stderr, "unknown -format %q, must be text or json\n", *dryRunFormat)
+		os.Exit(1)
+	}
 
 	var opts []pkglib.BuildOpt
 	if *force {
 		opts = append(opts, pkglib.WithBuildForce())
 	}
+	if *noCache {
+		opts = append(opts, pkglib.WithBuildNoCache())
+	}
 	opts = append(opts, pkglib.WithBuildCacheDir(*buildCacheDir))
+	if *requireSigned {
+		opts = append(opts, pkglib.WithBuildRequireSigned())
+	}
+	if len(cacheFrom) > 0 {
+		opts = append(opts, pkglib.WithBuildCacheFrom(cacheFrom...))
+	}
+	if *cacheTo != "" {
+		opts = append(opts, pkglib.WithBuildCacheTo(*cacheTo))
+	}
+	if *skipExisting {
+		opts = append(opts, pkglib.WithBuildSkipExisting())
+	}
+	if *progress != pkglib.ProgressAuto {
+		opts = append(opts, pkglib.WithBuildProgress(*progress))
+	}
+	if len(secrets) > 0 {
+		opts = append(opts, pkglib.WithBuildSecrets(secrets...))
+	}
+	if *registerBinfmt {
+		opts = append(opts, pkglib.WithBuildRegisterBinfmt())
+	}
+	if *sbom {
+		opts = append(opts, pkglib.WithBuildSBOM(*sbomFormat))
+	}
+	if *provenance {
+		opts = append(opts, pkglib.WithBuildProvenance(*provenanceMode))
+	}
+	if *sign {
+		opts = append(opts, pkglib.WithBuildSign(*signKey))
+	}
+	if epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok && sourceDateEpoch == "" {
+		if _, err := strconv.ParseUint(epoch, 10, 63); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid SOURCE_DATE_EPOCH %q\n", epoch)
+			os.Exit(1)
+		}
+		sourceDateEpoch = sourceDateEpochFlag(epoch)
+	}
+	switch sourceDateEpoch {
+	case "":
+	case sourceDateEpochCommit:
+		opts = append(opts, pkglib.WithBuildCommitDateEpoch())
+	default:
+		// validated by Set
+		epoch, _ := strconv.ParseInt(string(sourceDateEpoch), 10, 64)
+		opts = append(opts, pkglib.WithBuildSourceDateEpoch(time.Unix(epoch, 0).UTC()))
+	}
 
 	if withPush {
+		if *pushRetries < 0 {
+			fmt.Fprintln(os.Stderr, "-push-retries must not be negative")
+			os.Exit(1)
+		}
+		registry.SetPushRetries(*pushRetries)
 		opts = append(opts, pkglib.WithBuildPush())
 		if *nobuild {
 			opts = append(opts, pkglib.WithBuildSkip())
@@ -113,6 +222,21 @@ func pkgBuildPush(args []string, withPush bool) {
 		fmt.Fprintln(os.Stderr, "--skip-platforms and --platforms may not be used together")
 		os.Exit(1)
 	}
+	if *onlyPlatform != "" && (*platforms != "" || *skipPlatforms != "") {
+		fmt.Fprintln(os.Stderr, "--only-platform may not be used with --platforms or --skip-platforms")
+		os.Exit(1)
+	}
+	var only []string
+	if *onlyPlatform != "" {
+		for _, p := range strings.Split(*onlyPlatform, ",") {
+			parts := strings.SplitN(p, "/", 2)
+			if len(parts) != 2 || parts[0] != "linux" || parts[1] == "" {
+				fmt.Fprintf(os.Stderr, "invalid target platform specification '%s'\n", p)
+				os.Exit(1)
+			}
+			only = append(only, parts[1])
+		}
+	}
 	// process the platforms if provided
 	if *platforms != "" {
 		for _, p := range strings.Split(*platforms, ",") {
@@ -141,6 +265,10 @@ func pkgBuildPush(args []string, withPush bool) {
 	}
 	opts = append(opts, pkglib.WithBuildBuilders(buildersMap))
 
+	var (
+		planned []dryRunPkg
+		jobs    []pkgJob
+	)
 	for _, p := range pkgs {
 		// things we need our own copies of
 		var (
@@ -150,6 +278,18 @@ func pkgBuildPush(args []string, withPush bool) {
 		copy(pkgOpts, opts)
 		copy(pkgPlats, plats)
 		// unless overridden, platforms are specific to a package, so this needs to be inside the for loop
+		if len(only) > 0 {
+			for _, a := range only {
+				if !archDeclared(p, a) {
+					fmt.Fprintf(os.Stderr, "platform linux/%s is not declared in the build.yml of %q\n", a, p.Tag())
+					os.Exit(1)
+				}
+				pkgPlats = append(pkgPlats, imagespec.Platform{OS: "linux", Architecture: a})
+			}
+			if len(pkgPlats) == 1 {
+				pkgOpts = append(pkgOpts, pkglib.WithBuildSinglePlatform())
+			}
+		}
 		if len(pkgPlats) == 0 {
 			for _, a := range p.Arches() {
 				if _, ok := skipPlatformsMap[a]; ok {
@@ -160,6 +300,11 @@ func pkgBuildPush(args []string, withPush bool) {
 		}
 		pkgOpts = append(pkgOpts, pkglib.WithBuildPlatforms(pkgPlats...))
 
+		if *dryRun {
+			planned = append(planned, newDryRunPkg(p, pkgPlats))
+			continue
+		}
+
 		var msg, action string
 		switch {
 		case !withPush:
@@ -173,13 +318,160 @@ func pkgBuildPush(args []string, withPush bool) {
 			action = "building and pushing"
 		}
 
-		fmt.Println(msg)
+		jobs = append(jobs, pkgJob{pkg: p, opts: pkgOpts, msg: msg, action: action})
+	}
 
-		if err := p.Build(pkgOpts...); err != nil {
-			fmt.Fprintf(os.Stderr, "Error %s %q: %v\n", action, p.Tag(), err)
+	if *dryRun {
+		if err := printDryRun(os.Stdout, planned, *dryRunFormat, *printHashes); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
+		return
+	}
+
+	var (
+		paths   = make([]string, len(jobs))
+		depends = make([][]string, len(jobs))
+	)
+	for i, j := range jobs {
+		paths[i] = j.pkg.Path()
+		depends[i] = j.pkg.Depends()
+	}
+	deps, err := pkgDependencies(paths, depends)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	// with more than one build at once the output of each is kept until
+	// it is done, so that it is not interleaved with that of the others
+	var outMu sync.Mutex
+	errs := runPkgBuilds(deps, *parallel, func(i int) error {
+		job := jobs[i]
+		var (
+			out  io.Writer = os.Stdout
+			buf  bytes.Buffer
+			opts = job.opts
+		)
+		if *parallel > 1 {
+			out = &buf
+			opts = append(opts, pkglib.WithBuildOutputWriter(&buf))
+		}
+		if *progress != pkglib.ProgressQuiet {
+			fmt.Fprintln(out, job.msg)
+		}
+		err := job.pkg.Build(opts...)
+		if err != nil {
+			err = fmt.Errorf("Error %s %q: %v", job.action, job.pkg.Tag(), err)
+		}
+		if *parallel > 1 {
+			outMu.Lock()
+			defer outMu.Unlock()
+			if err != nil {
+				os.Stderr.Write(buf.Bytes())
+			} else {
+				os.Stdout.Write(buf.Bytes())
+			}
+		}
+		return err
+	})
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
+
+// pkgJob is the build of a package by pkg build
+type pkgJob struct {
+	pkg         pkglib.Pkg
+	opts        []pkglib.BuildOpt
+	msg, action string
+}
+
+// dryRunPkg is what -dry-run reports about a package
+type dryRunPkg struct {
+	Tag       string   `json:"tag"`
+	Hash      string   `json:"hash"`
+	Dirty     bool     `json:"dirty"`
+	Platforms []string `json:"platforms"`
+}
+
+func newDryRunPkg(p pkglib.Pkg, plats []imagespec.Platform) dryRunPkg {
+	d := dryRunPkg{Tag: p.Tag(), Hash: p.Hash(), Dirty: p.Dirty(), Platforms: []string{}}
+	for _, plat := range plats {
+		d.Platforms = append(d.Platforms, plat.OS+"/"+plat.Architecture)
+	}
+	return d
+}
+
+// printDryRun writes pkgs to w as a JSON array, or as a line per package
+// of its tag, optionally its hash and "dirty" or "clean", and platforms
+func printDryRun(w io.Writer, pkgs []dryRunPkg, format string, hashes bool) error {
+	if format == "json" {
+		if pkgs == nil {
+			pkgs = []dryRunPkg{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(pkgs)
+	}
+	for _, p := range pkgs {
+		fields := []string{p.Tag}
+		if hashes {
+			state := "clean"
+			if p.Dirty {
+				state = "dirty"
+			}
+			fields = append(fields, p.Hash, state)
+		}
+		fields = append(fields, strings.Join(p.Platforms, ","))
+		if _, err := fmt.Fprintln(w, strings.Join(fields, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceDateEpochCommit is the -source-date-epoch of a bare -source-date-epoch
+const sourceDateEpochCommit = "commit"
+
+// sourceDateEpochFlag is the -source-date-epoch flag. It is a boolean flag,
+// so that a bare -source-date-epoch uses the commit date, which can also be
+// given a Unix timestamp to use instead.
+type sourceDateEpochFlag string
+
+func (f *sourceDateEpochFlag) String() string {
+	return string(*f)
+}
+
+func (f *sourceDateEpochFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *sourceDateEpochFlag) Set(value string) error {
+	switch value {
+	case "true", sourceDateEpochCommit:
+		*f = sourceDateEpochCommit
+	case "false":
+		*f = ""
+	default:
+		if _, err := strconv.ParseUint(value, 10, 63); err != nil {
+			return fmt.Errorf("invalid timestamp %q, must be a Unix time or %s", value, sourceDateEpochCommit)
+		}
+		*f = sourceDateEpochFlag(value)
+	}
+	return nil
+}
+
+// archDeclared reports whether arch is one of those the package can be built for
+func archDeclared(p pkglib.Pkg, arch string) bool {
+	for _, a := range p.Arches() {
+		if a == arch {
+			return true
+		}
 	}
+	return false
 }
 
 func buildPlatformBuildersMap(inputs string, existing map[string]string) (map[string]string, error) {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintDryRun(t *testing.T) {
+	pkgs := []dryRunPkg{
+		{Tag: "linuxkit/a:1234", Hash: "1234", Platforms: []string{"linux/amd64", "linux/arm64"}},
+		{Tag: "linuxkit/b:5678-dirty", Hash: "5678-dirty", Dirty: true, Platforms: []string{"linux/amd64"}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, printDryRun(&buf, pkgs, "text", false))
+	assert.Equal(t, "linuxkit/a:1234\tlinux/amd64,linux/arm64\nlinuxkit/b:5678-dirty\tlinux/amd64\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, printDryRun(&buf, pkgs, "text", true))
+	assert.Equal(t, "linuxkit/a:1234\t1234\tclean\tlinux/amd64,linux/arm64\nlinuxkit/b:5678-dirty\t5678-dirty\tdirty\tlinux/amd64\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, printDryRun(&buf, pkgs, "json", false))
+	var got []dryRunPkg
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, pkgs, got)
+	assert.Contains(t, buf.String(), `"dirty": true`)
+
+	buf.Reset()
+	require.NoError(t, printDryRun(&buf, nil, "json", false))
+	assert.Equal(t, "[]\n", buf.String())
+}
+
+func TestSourceDateEpochFlag(t *testing.T) {
+	parse := func(args ...string) (sourceDateEpochFlag, error) {
+		var f sourceDateEpochFlag
+		flags := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		flags.Var(&f, "source-date-epoch", "")
+		err := flags.Parse(args)
+		return f, err
+	}
+
+	f, err := parse()
+	require.NoError(t, err)
+	assert.Equal(t, sourceDateEpochFlag(""), f)
+	f, err = parse("-source-date-epoch")
+	require.NoError(t, err)
+	assert.Equal(t, sourceDateEpochFlag(sourceDateEpochCommit), f)
+	f, err = parse("-source-date-epoch=commit")
+	require.NoError(t, err)
+	assert.Equal(t, sourceDateEpochFlag(sourceDateEpochCommit), f)
+	f, err = parse("-source-date-epoch=1234")
+	require.NoError(t, err)
+	assert.Equal(t, sourceDateEpochFlag("1234"), f)
+	_, err = parse("-source-date-epoch=-1")
+	assert.Error(t, err)
+	_, err = parse("-source-date-epoch=yesterday")
+	assert.Error(t, err)
+}
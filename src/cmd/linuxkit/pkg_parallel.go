@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pkgDependencies returns, for the packages at paths, the indexes of those
+// each one depends on. Dependencies on packages not being built are ignored,
+// they are expected to be built, or pulled, already.
+func pkgDependencies(paths []string, depends [][]string) ([][]int, error) {
+	index := map[string]int{}
+	for i, p := range paths {
+		index[p] = i
+	}
+	deps := make([][]int, len(paths))
+	for i := range paths {
+		for _, d := range depends[i] {
+			if j, ok := index[d]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	// look for a cycle, so as not to wait forever for one
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(paths))
+	var visit func(i int, chain []string) error
+	visit = func(i int, chain []string) error {
+		chain = append(chain, paths[i])
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("packages depend on each other: %s", strings.Join(chain, " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		for _, j := range deps[i] {
+			if err := visit(j, chain); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range paths {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return deps, nil
+}
+
+// runPkgBuilds calls build for each package, running up to parallel at a
+// time, each once those it depends on have been built. Packages are started
+// in order, so with parallel of 1 they are built one after the other as
+// given, bar dependencies. After a build fails no more are started, and the
+// errors of those running are returned once they have finished.
+func runPkgBuilds(deps [][]int, parallel int, build func(i int) error) []error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	type result struct {
+		i   int
+		err error
+	}
+	var (
+		results = make(chan result)
+		started = make([]bool, len(deps))
+		done    = make([]bool, len(deps))
+		running int
+		errs    []error
+	)
+	ready := func(i int) bool {
+		for _, j := range deps[i] {
+			if !done[j] {
+				return false
+			}
+		}
+		return true
+	}
+	for {
+		for i := range deps {
+			if len(errs) > 0 || running >= parallel {
+				break
+			}
+			if started[i] || !ready(i) {
+				continue
+			}
+			started[i] = true
+			running++
+			go func(i int) {
+				results <- result{i: i, err: build(i)}
+			}(i)
+		}
+		if running == 0 {
+			return errs
+		}
+		r := <-results
+		running--
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		done[r.i] = true
+	}
+}
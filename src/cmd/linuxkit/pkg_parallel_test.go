@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPkgDependencies(t *testing.T) {
+	paths := []string{"/pkg/a", "/pkg/b", "/pkg/c"}
+	deps, err := pkgDependencies(paths, [][]string{nil, {"/pkg/a", "/pkg/other"}, {"/pkg/b", "/pkg/a", "/pkg/c"}})
+	require.NoError(t, err)
+	assert.Equal(t, [][]int{nil, {0}, {1, 0}}, deps)
+
+	_, err = pkgDependencies(paths, [][]string{{"/pkg/c"}, nil, {"/pkg/a"}})
+	require.Error(t, err)
+	assert.Equal(t, "packages depend on each other: /pkg/a -> /pkg/c -> /pkg/a", err.Error())
+}
+
+// buildLog records the order packages are started and finished in
+type buildLog struct {
+	sync.Mutex
+	events []string
+}
+
+func (l *buildLog) add(event string) {
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *buildLog) index(event string) int {
+	for i, e := range l.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestRunPkgBuildsOrder(t *testing.T) {
+	names := []string{"a", "b", "c", "d", "e"}
+	// c needs a and b, e needs c, d is independent
+	deps := [][]int{nil, nil, {0, 1}, nil, {2}}
+	for _, parallel := range []int{1, 2, 4} {
+		var (
+			log     buildLog
+			mu      sync.Mutex
+			running int
+			most    int
+		)
+		errs := runPkgBuilds(deps, parallel, func(i int) error {
+			mu.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			log.add("start " + names[i])
+			time.Sleep(10 * time.Millisecond)
+			log.add("finish " + names[i])
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+		assert.Empty(t, errs)
+		assert.Len(t, log.events, 2*len(names))
+		for i, d := range deps {
+			for _, j := range d {
+				assert.True(t, log.index("finish "+names[j]) < log.index("start "+names[i]), "parallel %d: %s started before %s finished: %v", parallel, names[i], names[j], log.events)
+			}
+		}
+		assert.True(t, most <= parallel, "parallel %d: %d built at once", parallel, most)
+		if parallel == 1 {
+			assert.Equal(t, []string{"start a", "finish a", "start b", "finish b", "start c", "finish c", "start d", "finish d", "start e", "finish e"}, log.events)
+		} else {
+			assert.True(t, most > 1, "parallel %d: nothing built at once", parallel)
+		}
+	}
+}
+
+func TestRunPkgBuildsFailure(t *testing.T) {
+	// b needs a which fails, c is independent
+	deps := [][]int{nil, {0}, nil}
+	var log buildLog
+	errs := runPkgBuilds(deps, 2, func(i int) error {
+		log.add(string(rune('a' + i)))
+		if i == 0 {
+			return errors.New("a failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	assert.Equal(t, []error{errors.New("a failed")}, errs)
+	assert.Equal(t, -1, log.index("b"))
+	// c was started alongside a, and finished
+	assert.NotEqual(t, -1, log.index("c"))
+}
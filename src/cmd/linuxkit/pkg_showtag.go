@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -18,13 +19,32 @@ func pkgShowTag(args []string) {
 		fmt.Fprintf(os.Stderr, "\n")
 		flags.PrintDefaults()
 	}
+	hashOnly := flags.Bool("hash-only", false, "Print only the hash of the package, the tag of its image without the org and name")
+	canonical := flags.Bool("canonical", false, "Print the fully-qualified tag, with the registry, the package is pushed as")
 
 	pkgs, err := pkglib.NewFromCLI(flags, args...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
+	if *hashOnly && *canonical {
+		fmt.Fprintf(os.Stderr, "-hash-only and -canonical cannot be used together\n")
+		os.Exit(1)
+	}
+	printTags(os.Stdout, pkgs, *hashOnly, *canonical)
+}
+
+// printTags writes a line per package to w of its tag, its hash with
+// hashOnly, or its reference expanded tag with canonical
+func printTags(w io.Writer, pkgs []pkglib.Pkg, hashOnly, canonical bool) {
 	for _, p := range pkgs {
-		fmt.Println(p.Tag())
+		switch {
+		case hashOnly:
+			fmt.Fprintln(w, p.Hash())
+		case canonical:
+			fmt.Fprintln(w, p.FullTag())
+		default:
+			fmt.Fprintln(w, p.Tag())
+		}
 	}
 }
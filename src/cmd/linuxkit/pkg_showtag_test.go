@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gitCommand(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "git %v: %s", args, out)
+	return strings.TrimSpace(string(out))
+}
+
+func TestPrintTags(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	repo, err := ioutil.TempDir("", "linuxkit-show-tag")
+	require.NoError(t, err)
+	defer os.RemoveAll(repo)
+	pkgDir := filepath.Join(repo, "pkg")
+	require.NoError(t, os.MkdirAll(pkgDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pkgDir, "build.yml"), []byte("image: dummy\norg: test\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(pkgDir, "Dockerfile"), []byte("FROM scratch\n"), 0644))
+	gitCommand(t, repo, "init", "-q")
+	gitCommand(t, repo, "add", ".")
+	gitCommand(t, repo, "commit", "-q", "-m", "pkg")
+	treeHash := gitCommand(t, repo, "rev-parse", "HEAD:pkg")
+
+	pkgs, err := pkglib.NewFromCLI(flag.NewFlagSet("pkg show-tag", flag.ContinueOnError), pkgDir)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	// the tag pkg build -dry-run reports, which is the one it builds
+	built := newDryRunPkg(pkgs[0], nil)
+
+	var buf bytes.Buffer
+	printTags(&buf, pkgs, false, false)
+	assert.Equal(t, "test/dummy:"+treeHash+"\n", buf.String())
+	assert.Equal(t, built.Tag+"\n", buf.String())
+
+	buf.Reset()
+	printTags(&buf, pkgs, true, false)
+	assert.Equal(t, treeHash+"\n", buf.String())
+	assert.Equal(t, built.Hash+"\n", buf.String())
+
+	buf.Reset()
+	printTags(&buf, pkgs, false, true)
+	assert.Equal(t, "docker.io/test/dummy:"+treeHash+"\n", buf.String())
+}
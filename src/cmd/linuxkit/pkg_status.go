@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+)
+
+func pkgStatus(args []string) {
+	flags := flag.NewFlagSet("pkg status", flag.ExitOnError)
+	flags.Usage = func() {
+		invoked := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "USAGE: %s pkg status [options] [dir]...\n\n", invoked)
+		fmt.Fprintf(os.Stderr, "'dir' specifies a directory to search for packages, a directory with a build.yml, defaults to the current directory.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "text", "Output format, text for a table or json")
+	offline := flags.Bool("offline", false, "Do not look the packages up in the registry")
+
+	pkgs, err := pkglib.FindFromCLI(flags, args...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown -format %q, must be text or json\n", *format)
+		os.Exit(1)
+	}
+
+	exists := func(p pkglib.Pkg) (bool, error) { return p.Exists() }
+	if *offline {
+		exists = nil
+	}
+	if err := printPkgStatus(os.Stdout, pkgStatuses(pkgs, exists), *format); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// the registry states of a package in pkg status
+const (
+	registryPresent = "present"
+	registryMissing = "missing"
+	// registryUnknown is a package which could not be looked up
+	registryUnknown = "unknown"
+	// registryUnchecked is a dirty package, or any with -offline
+	registryUnchecked = "unchecked"
+)
+
+// statusPkg is what pkg status reports about a package
+type statusPkg struct {
+	Path     string `json:"path"`
+	Tag      string `json:"tag"`
+	Hash     string `json:"hash"`
+	Dirty    bool   `json:"dirty"`
+	Registry string `json:"registry"`
+	// Error is why the registry state is unknown
+	Error string `json:"error,omitempty"`
+	// Build is true if the package needs building, as it is dirty or
+	// is not in the registry
+	Build bool `json:"build"`
+}
+
+// pkgStatuses returns the status of each of pkgs, looking those which are
+// clean up in the registry with exists, unless it is nil. A dirty package
+// always needs building, as a build of it is never pushed.
+func pkgStatuses(pkgs []pkglib.Pkg, exists func(pkglib.Pkg) (bool, error)) []statusPkg {
+	cwd, _ := os.Getwd()
+	statuses := []statusPkg{}
+	for _, p := range pkgs {
+		s := statusPkg{Path: p.Path(), Tag: p.Tag(), Hash: p.Hash(), Dirty: p.Dirty(), Registry: registryUnchecked}
+		if rel, err := filepath.Rel(cwd, p.Path()); err == nil && cwd != "" && !strings.HasPrefix(rel, "..") {
+			s.Path = rel
+		}
+		switch {
+		case p.Dirty():
+			s.Build = true
+		case exists == nil:
+		default:
+			found, err := exists(p)
+			switch {
+			case err != nil:
+				s.Registry, s.Error = registryUnknown, err.Error()
+			case found:
+				s.Registry = registryPresent
+			default:
+				s.Registry = registryMissing
+				s.Build = true
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// printPkgStatus writes statuses to w as a JSON array, or as a table of a
+// line per package of its path, tag, whether it is dirty, whether it is in
+// the registry and whether it needs building
+func printPkgStatus(w io.Writer, statuses []statusPkg, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tTAG\tTREE\tREGISTRY\tBUILD")
+	for _, s := range statuses {
+		tree := "clean"
+		if s.Dirty {
+			tree = "dirty"
+		}
+		build := "no"
+		switch {
+		case s.Build:
+			build = "yes"
+		case s.Registry == registryUnknown || s.Registry == registryUnchecked:
+			build = "unknown"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.Path, s.Tag, tree, s.Registry, build)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		if s.Error != "" {
+			fmt.Fprintf(w, "%s: %s\n", s.Path, s.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/pkglib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPkgStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	repo, err := ioutil.TempDir("", "linuxkit-pkg-status")
+	require.NoError(t, err)
+	defer os.RemoveAll(repo)
+	repo, err = filepath.EvalSymlinks(repo)
+	require.NoError(t, err)
+	for _, name := range []string{"pushed", "unpushed", "dirty", "broken", "nested/inner", ".hidden/skipped"} {
+		dir := filepath.Join(repo, "pkg", name)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "build.yml"), []byte("image: "+filepath.Base(name)+"\norg: test\n"), 0644))
+	}
+	gitCommand(t, repo, "init", "-q")
+	gitCommand(t, repo, "add", ".")
+	gitCommand(t, repo, "commit", "-q", "-m", "pkgs")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(repo, "pkg", "dirty", "build.yml"), []byte("image: dirty\norg: test\nnetwork: true\n"), 0644))
+
+	pkgs, err := pkglib.FindFromCLI(flag.NewFlagSet("pkg status", flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	var paths []string
+	for _, p := range pkgs {
+		rel, err := filepath.Rel(repo, p.Path())
+		require.NoError(t, err)
+		paths = append(paths, rel)
+	}
+	assert.Equal(t, []string{"pkg/broken", "pkg/dirty", "pkg/nested/inner", "pkg/pushed", "pkg/unpushed"}, paths)
+
+	// the registry has pushed and nested/inner, and fails for broken
+	var looked []string
+	exists := func(p pkglib.Pkg) (bool, error) {
+		looked = append(looked, filepath.Base(p.Path()))
+		switch filepath.Base(p.Path()) {
+		case "broken":
+			return false, errors.New("registry unavailable")
+		case "pushed", "inner":
+			return true, nil
+		}
+		return false, nil
+	}
+	statuses := pkgStatuses(pkgs, exists)
+	assert.Equal(t, []string{"broken", "inner", "pushed", "unpushed"}, looked, "dirty packages are not looked up")
+	require.Len(t, statuses, 5)
+	byName := map[string]statusPkg{}
+	for i, s := range statuses {
+		assert.Equal(t, pkgs[i].Tag(), s.Tag)
+		assert.Equal(t, pkgs[i].Hash(), s.Hash)
+		byName[filepath.Base(s.Path)] = s
+	}
+	assert.Equal(t, statusPkg{Path: byName["broken"].Path, Tag: pkgs[0].Tag(), Hash: pkgs[0].Hash(), Registry: registryUnknown, Error: "registry unavailable"}, byName["broken"])
+	assert.True(t, byName["dirty"].Dirty)
+	assert.True(t, byName["dirty"].Build)
+	assert.Equal(t, registryUnchecked, byName["dirty"].Registry)
+	assert.Regexp(t, `-dirty$`, byName["dirty"].Tag)
+	assert.Equal(t, registryPresent, byName["pushed"].Registry)
+	assert.False(t, byName["pushed"].Build)
+	assert.Equal(t, registryMissing, byName["unpushed"].Registry)
+	assert.True(t, byName["unpushed"].Build)
+
+	var buf bytes.Buffer
+	require.NoError(t, printPkgStatus(&buf, statuses, "json"))
+	var got []statusPkg
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, statuses, got)
+
+	buf.Reset()
+	require.NoError(t, printPkgStatus(&buf, statuses, "text"))
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 7)
+	assert.Regexp(t, `^PACKAGE\s+TAG\s+TREE\s+REGISTRY\s+BUILD$`, string(lines[0]))
+	assert.Regexp(t, `pkg/dirty\s+test/dirty:\S+-dirty\s+dirty\s+unchecked\s+yes$`, string(lines[2]))
+	assert.Regexp(t, `pkg/pushed\s+test/pushed:\S+\s+clean\s+present\s+no$`, string(lines[4]))
+	assert.Regexp(t, `pkg/unpushed\s+test/unpushed:\S+\s+clean\s+missing\s+yes$`, string(lines[5]))
+	assert.Regexp(t, `pkg/broken: registry unavailable$`, string(lines[6]))
+
+	// without a registry nothing clean is known to need building
+	for _, s := range pkgStatuses(pkgs, nil) {
+		assert.Equal(t, registryUnchecked, s.Registry)
+		assert.Equal(t, s.Dirty, s.Build)
+	}
+}
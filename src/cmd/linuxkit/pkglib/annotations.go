@@ -0,0 +1,114 @@
+package pkglib
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// scpLikeURL is the scp-like syntax git accepts for ssh, [user@]host:path
+var scpLikeURL = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// normalizeSourceURL returns the https URL of a git remote, suitable for
+// the org.opencontainers.image.source of an image: without credentials, an
+// ssh or git remote as https, and without a .git suffix. It is "" for a
+// remote which is not on a network, such as a local path.
+func normalizeSourceURL(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if remote == "" {
+		return ""
+	}
+	var u *url.URL
+	if m := scpLikeURL.FindStringSubmatch(remote); m != nil && !strings.Contains(remote, "://") {
+		u = &url.URL{Scheme: "https", Host: m[1], Path: "/" + strings.TrimPrefix(m[2], "/")}
+	} else {
+		var err error
+		if u, err = url.Parse(remote); err != nil {
+			return ""
+		}
+		switch u.Scheme {
+		case "https", "http":
+		case "ssh", "git", "git+ssh", "ssh+git":
+			// the port is that of the ssh or git daemon
+			u.Scheme = "https"
+			u.Host = u.Hostname()
+		default:
+			return ""
+		}
+	}
+	if u.Host == "" {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery, u.Fragment = "", ""
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+	u.RawPath = ""
+	return u.String()
+}
+
+// sourceURL is the repository the source of p is kept in: the gitrepo of
+// its build.yml as it is, or otherwise the normalized remote of its git
+// repository, "" if neither is known
+func (p Pkg) sourceURL() string {
+	if p.gitRepo != "" {
+		return p.gitRepo
+	}
+	if p.git == nil {
+		return ""
+	}
+	remote, err := p.git.remoteURL()
+	if err != nil {
+		log.Debugf("remote of %s unknown: %v", p.path, err)
+		return ""
+	}
+	return normalizeSourceURL(remote)
+}
+
+// imageAnnotations are the standard OCI annotations of the images built
+// from p: the source repository, and for a clean package the commit, its
+// date and the go module version of it
+func (p Pkg) imageAnnotations() (map[string]string, error) {
+	annotations := map[string]string{}
+	if source := p.sourceURL(); source != "" {
+		annotations[imagespec.AnnotationSource] = source
+	}
+	if p.git == nil || p.dirty {
+		return annotations, nil
+	}
+	commit, err := p.git.commitHash(p.commitHash)
+	if err != nil {
+		return nil, err
+	}
+	annotations[imagespec.AnnotationRevision] = commit
+	created, err := p.git.commitTime(commit)
+	if err != nil {
+		return nil, err
+	}
+	annotations[imagespec.AnnotationCreated] = created.Format(time.RFC3339)
+	modVersion, err := p.git.goPkgVersion(commit)
+	if err != nil {
+		return nil, err
+	}
+	annotations[imagespec.AnnotationVersion] = modVersion
+	return annotations, nil
+}
+
+// annotationArgs are the buildx arguments adding annotations to the
+// manifest of an image, in the order of their keys
+func annotationArgs(annotations map[string]string) []string {
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		args = append(args, "--annotation", "manifest:"+k+"="+annotations[k])
+	}
+	return args
+}
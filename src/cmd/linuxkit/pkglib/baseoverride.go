@@ -0,0 +1,107 @@
+package pkglib
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fromRegexp matches a FROM instruction of a Dockerfile, capturing what is
+// before the image, the image, and what is after it
+var fromRegexp = regexp.MustCompile(`(?i)^(\s*FROM\s+(?:--\S+\s+)*)(\S+)(.*)$`)
+
+// parseBaseOverrides parses the OLD=NEW base image overrides
+func parseBaseOverrides(overrides []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, o := range overrides {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("%q must be OLD=NEW", o)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// baseOverridesHash returns hash, of the source, mixed with the base image
+// overrides, so that the image built with them gets a tag of its own.
+// Without any it is hash.
+func baseOverridesHash(hash string, overrides map[string]string) string {
+	if len(overrides) == 0 {
+		return hash
+	}
+	var lines []string
+	for k, v := range overrides {
+		lines = append(lines, "FROM "+k+"="+v)
+	}
+	sort.Strings(lines)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(hash+"\n"+strings.Join(lines, "\n"))))
+}
+
+// rewriteDockerfile replaces the images of the FROM instructions of
+// dockerfile which are overridden
+func rewriteDockerfile(dockerfile []byte, overrides map[string]string) []byte {
+	lines := bytes.Split(dockerfile, []byte("\n"))
+	for i, line := range lines {
+		m := fromRegexp.FindSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if image, ok := overrides[string(m[2])]; ok {
+			lines[i] = []byte(string(m[1]) + image + string(m[3]))
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// rewriteBaseImages returns the build context r, a tar stream, with the
+// base images of its Dockerfile overridden
+func rewriteBaseImages(r io.Reader, overrides map[string]string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyRewritingBaseImages(pw, r, overrides))
+	}()
+	return pr
+}
+
+func copyRewritingBaseImages(w io.Writer, r io.Reader, overrides map[string]string) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("ctx: Reading build context: %v", err)
+		}
+		if path.Clean(strings.TrimPrefix(h.Name, "/")) != "Dockerfile" || h.Typeflag != tar.TypeReg {
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("ctx: Reading %s: %v", h.Name, err)
+		}
+		b = rewriteDockerfile(b, overrides)
+		h.Size = int64(len(b))
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pkglib
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testBaseOverrides = map[string]string{
+	"linuxkit/alpine:0123": "linuxkit/alpine:4567",
+	"scratch":              "busybox",
+}
+
+func TestRewriteDockerfile(t *testing.T) {
+	dockerfile := `FROM linuxkit/alpine:0123 AS build
+RUN echo FROM linuxkit/alpine:0123
+from --platform=$TARGETPLATFORM linuxkit/alpine:0123
+FROM linuxkit/alpine:0123-extra AS other
+FROM build AS mirror
+FROM scratch
+COPY --from=build / /
+`
+	assert.Equal(t, `FROM linuxkit/alpine:4567 AS build
+RUN echo FROM linuxkit/alpine:0123
+from --platform=$TARGETPLATFORM linuxkit/alpine:4567
+FROM linuxkit/alpine:0123-extra AS other
+FROM build AS mirror
+FROM busybox
+COPY --from=build / /
+`, string(rewriteDockerfile([]byte(dockerfile), testBaseOverrides)))
+}
+
+func TestRewriteBaseImages(t *testing.T) {
+	var in bytes.Buffer
+	tw := tar.NewWriter(&in)
+	for _, f := range []struct{ name, content string }{
+		{"/Dockerfile", "FROM linuxkit/alpine:0123\nCOPY . /\n"},
+		{"/src/Dockerfile", "FROM scratch\n"},
+		{"/build.yml", "image: foo\n"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(f.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	tr := tar.NewReader(rewriteBaseImages(&in, testBaseOverrides))
+	files := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"/Dockerfile":     "FROM linuxkit/alpine:4567\nCOPY . /\n",
+		"/src/Dockerfile": "FROM scratch\n",
+		"/build.yml":      "image: foo\n",
+	}, files)
+
+	_, err := ioutil.ReadAll(rewriteBaseImages(bytes.NewBufferString("not a tarball"), testBaseOverrides))
+	assert.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package pkglib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// binfmtImage registers the qemu-user-static binfmt_misc handlers of
+	// every architecture qemu emulates, the usual way of enabling
+	// emulation for docker
+	binfmtImage = "multiarch/qemu-user-static"
+)
+
+// binfmtDir is where the kernel lists the binfmt_misc handlers
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuArches are the names qemu-user-static gives the architectures which
+// are not named as in Go
+var qemuArches = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+	"386":   "i386",
+}
+
+// binfmtMu serializes the registration of binfmt_misc handlers by
+// packages built in parallel
+var binfmtMu sync.Mutex
+
+// needsEmulation reports whether building for arch on a host of hostArch
+// needs a binfmt_misc handler to run the binaries of arch
+func needsEmulation(hostArch, arch string) bool {
+	return arch != hostArch && !(hostArch == "amd64" && arch == "386")
+}
+
+// binfmtRegistered reports whether the qemu handler of arch is registered
+// and enabled in dir
+func binfmtRegistered(dir, arch string) (bool, error) {
+	name := arch
+	if n, ok := qemuArches[arch]; ok {
+		name = n
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "qemu-"+name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.HasPrefix(string(b), "enabled"), nil
+}
+
+// emulationError explains how to build for platform on a host of
+// hostArch without a binfmt_misc handler for it
+func emulationError(platform, hostArch string) error {
+	return fmt.Errorf("building for %s on this linux/%s host needs emulation, but there is no binfmt_misc handler for it in %s. "+
+		"Register the qemu-user-static handlers with 'docker run --rm --privileged %s --reset -p yes', or build with -register-binfmt to have linuxkit do so, "+
+		"or build on a native builder with -builders %s=<docker context>", platform, hostArch, binfmtDir, binfmtImage, platform)
+}
+
+// localDaemon reports whether docker runs on this host, so that the
+// binfmt_misc handlers of its builder are those of this kernel
+func localDaemon() bool {
+	if c := os.Getenv("DOCKER_CONTEXT"); c != "" && c != "default" {
+		return false
+	}
+	host := os.Getenv("DOCKER_HOST")
+	return host == "" || strings.HasPrefix(host, "unix://")
+}
+
+// ensureEmulation checks that the local builder can emulate platform, if
+// it is not the platform of the host, registering the qemu-user-static
+// handlers for it if allowed. It returns true if it cannot, which only
+// fails a build which runs binaries of platform, and not one which cross
+// builds, so it is left to the build to fail.
+func (dr *dockerRunnerImpl) ensureEmulation(platform string) (bool, error) {
+	// Docker Desktop comes with emulation in its VM
+	if runtime.GOOS != "linux" || !localDaemon() {
+		return false, nil
+	}
+	arch := strings.TrimPrefix(platform, "linux/")
+	if !needsEmulation(runtime.GOARCH, arch) {
+		return false, nil
+	}
+
+	binfmtMu.Lock()
+	defer binfmtMu.Unlock()
+	ok, err := binfmtRegistered(binfmtDir, arch)
+	if err != nil || ok {
+		return false, err
+	}
+	if !dr.registerBinfmt {
+		return true, nil
+	}
+	dr.printf("registering qemu-user-static binfmt_misc handlers to emulate %s\n", platform)
+	if err := dr.command(nil, nil, nil, "run", "--rm", "--privileged", binfmtImage, "--reset", "-p", "yes"); err != nil {
+		return false, fmt.Errorf("unable to register binfmt_misc handlers with %s: %v", binfmtImage, err)
+	}
+	if ok, err = binfmtRegistered(binfmtDir, arch); err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("%s did not register a binfmt_misc handler for %s", binfmtImage, platform)
+	}
+	return false, nil
+}
@@ -0,0 +1,92 @@
+package pkglib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeedsEmulation(t *testing.T) {
+	assert.False(t, needsEmulation("amd64", "amd64"))
+	assert.False(t, needsEmulation("amd64", "386"))
+	assert.True(t, needsEmulation("amd64", "arm64"))
+	assert.True(t, needsEmulation("arm64", "amd64"))
+	assert.True(t, needsEmulation("arm64", "s390x"))
+}
+
+func TestBinfmtRegistered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binfmt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ok, err := binfmtRegistered(dir, "arm64")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte("disabled\ninterpreter /usr/bin/qemu-aarch64-static\n"), 0644))
+	ok, err = binfmtRegistered(dir, "arm64")
+	require.NoError(t, err)
+	assert.False(t, ok, "a disabled handler")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "qemu-aarch64"), []byte("enabled\ninterpreter /usr/bin/qemu-aarch64-static\n"), 0644))
+	ok, err = binfmtRegistered(dir, "arm64")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "qemu-s390x"), []byte("enabled\n"), 0644))
+	ok, err = binfmtRegistered(dir, "s390x")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestEnsureEmulation(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("emulation is only checked on linux")
+	}
+	dir, err := ioutil.TempDir("", "binfmt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { binfmtDir = d }(binfmtDir)
+	binfmtDir = dir
+	for _, env := range []string{"DOCKER_HOST", "DOCKER_CONTEXT"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	arch, qemu := "s390x", "qemu-s390x"
+	if runtime.GOARCH == "s390x" {
+		arch, qemu = "arm64", "qemu-aarch64"
+	}
+	platform := "linux/" + arch
+	dr := &dockerRunnerImpl{}
+
+	unemulated, err := dr.ensureEmulation("linux/" + runtime.GOARCH)
+	require.NoError(t, err)
+	assert.False(t, unemulated, "the platform of the host")
+	unemulated, err = dr.ensureEmulation(platform)
+	require.NoError(t, err)
+	assert.True(t, unemulated)
+
+	err = emulationError(platform, runtime.GOARCH)
+	assert.Contains(t, err.Error(), "building for "+platform+" on this linux/"+runtime.GOARCH+" host needs emulation")
+	assert.Contains(t, err.Error(), "docker run --rm --privileged multiarch/qemu-user-static --reset -p yes")
+	assert.Contains(t, err.Error(), "-register-binfmt")
+	assert.Contains(t, err.Error(), "-builders "+platform+"=<docker context>")
+
+	// a remote daemon has the binfmt_misc handlers of another kernel
+	os.Setenv("DOCKER_HOST", "tcp://builder.example.com:2376")
+	unemulated, err = dr.ensureEmulation(platform)
+	require.NoError(t, err)
+	assert.False(t, unemulated)
+	os.Unsetenv("DOCKER_HOST")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, qemu), []byte("enabled\n"), 0644))
+	unemulated, err = dr.ensureEmulation(platform)
+	require.NoError(t, err)
+	assert.False(t, unemulated)
+}
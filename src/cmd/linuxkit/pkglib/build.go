@@ -6,14 +6,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/reference"
+	namepkg "github.com/google/go-containerregistry/pkg/name"
 	registry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
+	lktregistry "github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
 	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/util"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
@@ -34,12 +42,33 @@ type buildOpts struct {
 	manifest      bool
 	image         bool
 	targetDocker  bool
-	cacheDir      string
-	cacheProvider lktspec.CacheProvider
-	platforms     []imagespec.Platform
-	builders      map[string]string
-	runner        dockerRunner
-	writer        io.Writer
+	requireSigned bool
+	sbom          string
+	sign          bool
+	skipExisting  bool
+	progress      string
+	signKey       string
+	single        bool
+	// sourceDateEpoch, if set, is the timestamp of everything in the
+	// image, commitDateEpoch uses the commit date of the package instead
+	sourceDateEpoch *time.Time
+	commitDateEpoch bool
+	cacheDir        string
+	cacheFrom       []string
+	cacheTo         string
+	secrets         []string
+	registerBinfmt  bool
+	noCache         bool
+	provenance      string
+	cacheProvider   lktspec.CacheProvider
+	platforms       []imagespec.Platform
+	builders        map[string]string
+	runner          dockerRunner
+	writer          io.Writer
+	// buildStarted and buildFinished are the times the image was
+	// built, zero if it was found in the cache instead
+	buildStarted  time.Time
+	buildFinished time.Time
 }
 
 // BuildOpt allows callers to specify options to Build
@@ -93,6 +122,80 @@ func WithBuildTargetDockerCache() BuildOpt {
 	}
 }
 
+// WithBuildRequireSigned refuses to build unless the package's commit, or tag, has a valid signature
+func WithBuildRequireSigned() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.requireSigned = true
+		return nil
+	}
+}
+
+// WithBuildSinglePlatform builds the only platform requested without a multi-arch index, and loads it into docker
+func WithBuildSinglePlatform() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.single = true
+		return nil
+	}
+}
+
+// WithBuildSBOM attaches an SBOM of the build context, in format, to the pushed manifest
+func WithBuildSBOM(format string) BuildOpt {
+	return func(bo *buildOpts) error {
+		if _, err := sbomMediaType(format); err != nil {
+			return err
+		}
+		bo.sbom = format
+		return nil
+	}
+}
+
+// WithBuildProgress sets the BuildKit progress mode, auto, plain, tty or
+// quiet, in which nothing but errors and the built tag is written
+func WithBuildProgress(mode string) BuildOpt {
+	return func(bo *buildOpts) error {
+		if err := validateProgress(mode); err != nil {
+			return err
+		}
+		bo.progress = mode
+		return nil
+	}
+}
+
+// WithBuildSkipExisting skips the build, and push, of a package whose tag
+// is already in the registry
+func WithBuildSkipExisting() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.skipExisting = true
+		return nil
+	}
+}
+
+// WithBuildSign signs the pushed manifest with cosign, using key, or
+// keyless if it is empty
+func WithBuildSign(key string) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.sign = true
+		bo.signKey = key
+		return nil
+	}
+}
+
+// WithBuildSourceDateEpoch sets the timestamp of the image config and layer contents
+func WithBuildSourceDateEpoch(t time.Time) BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.sourceDateEpoch = &t
+		return nil
+	}
+}
+
+// WithBuildCommitDateEpoch sets the timestamp of the image config and layer contents to the commit date of the package, unless it is dirty
+func WithBuildCommitDateEpoch() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.commitDateEpoch = true
+		return nil
+	}
+}
+
 // WithBuildCacheDir provide a build cache directory to use
 func WithBuildCacheDir(dir string) BuildOpt {
 	return func(bo *buildOpts) error {
@@ -101,6 +204,115 @@ func WithBuildCacheDir(dir string) BuildOpt {
 	}
 }
 
+// WithBuildCacheFrom imports BuildKit layer cache from the given registry
+// references, or type=registry buildx cache specs, per platform
+func WithBuildCacheFrom(specs ...string) BuildOpt {
+	return func(bo *buildOpts) error {
+		for _, spec := range specs {
+			if _, err := platformCacheSpec(spec, runtime.GOARCH); err != nil {
+				return fmt.Errorf("invalid cache-from %q: %v", spec, err)
+			}
+		}
+		bo.cacheFrom = specs
+		return nil
+	}
+}
+
+// WithBuildCacheTo exports BuildKit layer cache to the given registry
+// reference, or type=registry buildx cache spec, per platform
+func WithBuildCacheTo(spec string) BuildOpt {
+	return func(bo *buildOpts) error {
+		if _, err := platformCacheSpec(spec, runtime.GOARCH); err != nil {
+			return fmt.Errorf("invalid cache-to %q: %v", spec, err)
+		}
+		bo.cacheTo = spec
+		return nil
+	}
+}
+
+// WithBuildProvenance attaches the SLSA provenance of the build, in mode,
+// to the pushed manifest as an OCI referrer
+func WithBuildProvenance(mode string) BuildOpt {
+	return func(bo *buildOpts) error {
+		if err := validProvenanceMode(mode); err != nil {
+			return err
+		}
+		bo.provenance = mode
+		return nil
+	}
+}
+
+// WithBuildNoCache rebuilds the package, even if it is in the cache,
+// without the BuildKit layer cache. The tag is unchanged, it depends on
+// the source alone.
+func WithBuildNoCache() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.noCache = true
+		bo.force = true
+		return nil
+	}
+}
+
+// WithBuildRegisterBinfmt registers the qemu-user-static binfmt_misc
+// handlers, with docker, when a platform is emulated without them
+func WithBuildRegisterBinfmt() BuildOpt {
+	return func(bo *buildOpts) error {
+		bo.registerBinfmt = true
+		return nil
+	}
+}
+
+// WithBuildSecrets makes the given BuildKit secrets, as id=foo,src=path or
+// id=foo,env=VAR, available to RUN --mount=type=secret. They are not part of
+// the hash, nor of the image.
+func WithBuildSecrets(specs ...string) BuildOpt {
+	return func(bo *buildOpts) error {
+		for _, spec := range specs {
+			if err := validateSecret(spec); err != nil {
+				return fmt.Errorf("invalid secret %q: %v", spec, err)
+			}
+		}
+		bo.secrets = specs
+		return nil
+	}
+}
+
+// validateSecret checks the buildx secret spec
+func validateSecret(spec string) error {
+	var id, typ, src, env bool
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("%q must be key=value", field)
+		}
+		switch kv[0] {
+		case "id":
+			id = true
+		case "type":
+			if kv[1] != "file" && kv[1] != "env" {
+				return fmt.Errorf("unknown type %q, must be file or env", kv[1])
+			}
+			typ = true
+		case "src", "source":
+			src = true
+		case "env":
+			env = true
+		default:
+			return fmt.Errorf("unknown key %q, must be id, type, src or env", kv[0])
+		}
+	}
+	if !id {
+		return errors.New("no id")
+	}
+	if src && env {
+		return errors.New("src and env are mutually exclusive")
+	}
+	if !src && !env && !typ {
+		return errors.New("no src or env")
+	}
+	return nil
+}
+
 // WithBuildPlatforms which platforms to build for
 func WithBuildPlatforms(platforms ...imagespec.Platform) BuildOpt {
 	return func(bo *buildOpts) error {
@@ -142,7 +354,7 @@ func WithBuildOutputWriter(w io.Writer) BuildOpt {
 }
 
 // Build builds the package
-func (p Pkg) Build(bos ...BuildOpt) error {
+func (p Pkg) Build(bos ...BuildOpt) (err error) {
 	var bo buildOpts
 	for _, fn := range bos {
 		if err := fn(&bo); err != nil {
@@ -154,6 +366,15 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	if writer == nil {
 		writer = os.Stdout
 	}
+	if bo.progress == ProgressQuiet {
+		out := writer
+		writer = ioutil.Discard
+		defer func() {
+			if err == nil {
+				fmt.Fprintln(out, p.FullTag())
+			}
+		}()
+	}
 
 	arch := runtime.GOARCH
 	ref, err := reference.Parse(p.FullTag())
@@ -161,10 +382,38 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		return fmt.Errorf("could not resolve references for image %s: %v", p.Tag(), err)
 	}
 
+	if bo.single {
+		if len(bo.platforms) != 1 {
+			return fmt.Errorf("single platform build requires exactly one platform, not %d", len(bo.platforms))
+		}
+		if bo.push {
+			return errors.New("cannot push a single platform build")
+		}
+		// docker can hold images for any platform, not just the local one
+		arch = bo.platforms[0].Architecture
+		bo.targetDocker = true
+	}
+
 	if err := p.cleanForBuild(); err != nil {
 		return err
 	}
 
+	if p.dirty {
+		fmt.Fprintf(writer, "%s is dirty\n", p.Tag())
+		if details := p.dirtyStatus.String(); details != "" {
+			fmt.Fprintf(writer, "%s\n", details)
+		}
+	}
+
+	if bo.requireSigned {
+		if p.git == nil {
+			return fmt.Errorf("cannot verify signature of %s, it is not in a git repository", p.path)
+		}
+		if err := p.git.verifySignature(p.commitHash); err != nil {
+			return err
+		}
+	}
+
 	// did we have the build cache dir provided?
 	if bo.cacheDir == "" {
 		return errors.New("must provide linuxkit build cache directory")
@@ -185,7 +434,7 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	}
 
 	if p.git != nil && bo.push && bo.release == "" {
-		r, err := p.git.commitTag("HEAD")
+		r, err := p.git.commitTag(p.commitHash)
 		if err != nil {
 			return err
 		}
@@ -196,9 +445,26 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		return fmt.Errorf("Cannot release %q if not pushing", bo.release)
 	}
 
+	if bo.skipExisting {
+		switch {
+		case p.dirty:
+			// a dirty package is never pushed
+		case bo.release != "":
+			fmt.Fprintf(writer, "Not skipping %s, releasing it as %s\n", p.Tag(), bo.release)
+		default:
+			exists, err := imageExists(p.FullTag())
+			if err != nil {
+				fmt.Fprintf(writer, "Unable to tell whether %s is in the registry, building it: %v\n", p.Tag(), err)
+			} else if exists {
+				fmt.Fprintf(writer, "%s is already in the registry, skipping\n", p.Tag())
+				return nil
+			}
+		}
+	}
+
 	d := bo.runner
 	if d == nil {
-		d = newDockerRunner(p.cache)
+		d = newDockerRunner(bo.progress, bo.writer, bo.registerBinfmt)
 	}
 
 	c := bo.cacheProvider
@@ -224,6 +490,10 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		}
 	}
 
+	var (
+		desc    *registry.Descriptor
+		loadRef = ref
+	)
 	if !skipBuild {
 		fmt.Fprintf(writer, "building %s\n", ref)
 		var (
@@ -231,19 +501,34 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 			descs []registry.Descriptor
 		)
 
-		if p.git != nil && p.gitRepo != "" {
-			args = append(args, "--label", "org.opencontainers.image.source="+p.gitRepo)
+		annotations, err := p.imageAnnotations()
+		if err != nil {
+			return err
+		}
+		// the configs of the images are labelled with the same as their
+		// manifests are annotated with, but their own creation time
+		for _, label := range []string{imagespec.AnnotationSource, imagespec.AnnotationRevision, imagespec.AnnotationVersion} {
+			if v, ok := annotations[label]; ok {
+				args = append(args, "--label", label+"="+v)
+			}
 		}
 		if p.git != nil && !p.dirty {
-			commit, err := p.git.commitHash("HEAD")
+			ref, err := p.git.commitRef(p.commitHash)
 			if err != nil {
 				return err
 			}
-			args = append(args, "--label", "org.opencontainers.image.revision="+commit)
+			if ref != "" {
+				args = append(args, "--label", imagespec.AnnotationRefName+"="+ref)
+			}
 		}
+		args = append(args, annotationArgs(annotations)...)
 
-		if !p.network {
+		switch p.network {
+		case networkNone:
 			args = append(args, "--network=none")
+		case networkHost:
+			// the builder is created allowing this entitlement
+			args = append(args, "--network=host", "--allow=network.host")
 		}
 
 		if p.config != nil {
@@ -254,10 +539,31 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 			args = append(args, "--label=org.mobyproject.config="+string(b))
 		}
 
+		for _, a := range p.buildArgs {
+			args = append(args, "--build-arg", a)
+		}
+		for _, secret := range bo.secrets {
+			args = append(args, "--secret", secret)
+		}
+		if !p.cache || bo.noCache {
+			args = append(args, "--no-cache")
+		}
+
 		args = append(args, "--label=org.mobyproject.linuxkit.version="+version.Version)
 		args = append(args, "--label=org.mobyproject.linuxkit.revision="+version.GitCommit)
 
+		epoch, err := p.sourceDateEpoch(bo)
+		if err != nil {
+			return err
+		}
+		if epoch != nil {
+			fmt.Fprintf(writer, "using timestamp %s for %s\n", epoch.Format(time.RFC3339), ref)
+			bo.sourceDateEpoch = epoch
+			args = append(args, "--build-arg", fmt.Sprintf("SOURCE_DATE_EPOCH=%d", epoch.Unix()))
+		}
+
 		// build for each arch and save in the linuxkit cache
+		bo.buildStarted = time.Now()
 		for _, platform := range bo.platforms {
 			desc, err := p.buildArch(d, c, platform.Architecture, args, writer, bo)
 			if err != nil {
@@ -268,6 +574,7 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 			}
 			descs = append(descs, *desc)
 		}
+		bo.buildFinished = time.Now()
 
 		// after build is done:
 		// - create multi-arch manifest
@@ -275,21 +582,28 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		// - potentially load into docker
 		// - potentially create a release, including push and load into docker
 
-		// create a multi-arch index
-		if _, err := c.IndexWrite(&ref, descs...); err != nil {
+		// create a multi-arch index, unless there is only the one
+		// platform, which is then used directly
+		if bo.single {
+			if loadRef, err = reference.Parse(p.FullTag() + "-" + arch); err != nil {
+				return err
+			}
+			desc = &descs[0]
+		} else if _, err := c.IndexWrite(&ref, descs...); err != nil {
 			return err
 		}
 	}
 
 	// get descriptor for root of manifest
-	desc, err := c.FindDescriptor(p.FullTag())
-	if err != nil {
-		return err
+	if desc == nil {
+		if desc, err = c.FindDescriptor(p.FullTag()); err != nil {
+			return err
+		}
 	}
 
 	// if requested docker, load the image up
 	if bo.targetDocker {
-		cacheSource := c.NewSource(&ref, arch, desc)
+		cacheSource := c.NewSource(&loadRef, arch, desc)
 		reader, err := cacheSource.V1TarReader()
 		if err != nil {
 			return fmt.Errorf("unable to get reader from cache: %v", err)
@@ -300,6 +614,15 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	}
 
 	if !bo.push {
+		if bo.sbom != "" {
+			fmt.Fprintf(writer, "Not pushing, skipping SBOM.\n")
+		}
+		if bo.provenance != "" {
+			fmt.Fprintf(writer, "Not pushing, skipping provenance.\n")
+		}
+		if bo.sign {
+			fmt.Fprintf(writer, "Not pushing, skipping signing.\n")
+		}
 		fmt.Fprintf(writer, "Build complete, not pushing, all done.\n")
 		return nil
 	}
@@ -313,6 +636,24 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 		return err
 	}
 
+	if bo.sbom != "" {
+		if err := p.attachSBOM(bo.sbom, writer); err != nil {
+			return err
+		}
+	}
+
+	if bo.provenance != "" {
+		if err := p.attachProvenance(bo.provenance, bo, writer); err != nil {
+			return err
+		}
+	}
+
+	if bo.sign {
+		if err := p.sign(bo.signKey, writer); err != nil {
+			return err
+		}
+	}
+
 	if bo.release == "" {
 		fmt.Fprintf(writer, "Build and push complete, not releasing, all done.\n")
 		return nil
@@ -347,6 +688,44 @@ func (p Pkg) Build(bos ...BuildOpt) error {
 	return nil
 }
 
+// sourceDateEpoch returns the timestamp to give everything in the image,
+// or nil to leave it as the build time. Rewriting the timestamps needs
+// BuildKit v0.13, so it is only done when asked for. With the date of the
+// commit being built, rebuilding it produces the same image. A dirty
+// package is not that commit, so it keeps the build time.
+func (p Pkg) sourceDateEpoch(bo buildOpts) (*time.Time, error) {
+	if bo.sourceDateEpoch != nil {
+		return bo.sourceDateEpoch, nil
+	}
+	if !bo.commitDateEpoch || p.git == nil || p.dirty {
+		return nil, nil
+	}
+	t, err := p.git.commitTime(p.commitHash)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// imageExists reports whether name is in the registry, with a HEAD of its
+// manifest, or a GET for registries which do not support HEAD
+func imageExists(name string) (bool, error) {
+	ref, err := namepkg.ParseReference(name)
+	if err != nil {
+		return false, err
+	}
+	options := []remote.Option{remote.WithAuthFromKeychain(lktregistry.Keychain)}
+	_, err = remote.Head(ref, options...)
+	if terr, ok := err.(*transport.Error); ok && terr.StatusCode != http.StatusNotFound {
+		log.Debugf("HEAD of %s failed, trying GET: %v", name, err)
+		_, err = remote.Get(ref, options...)
+	}
+	if terr, ok := err.(*transport.Error); ok && terr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // buildArch builds the package for a single arch
 func (p Pkg) buildArch(d dockerRunner, c lktspec.CacheProvider, arch string, args []string, writer io.Writer, bo buildOpts) (*registry.Descriptor, error) {
 	var (
@@ -398,6 +777,10 @@ func (p Pkg) buildArch(d dockerRunner, c lktspec.CacheProvider, arch string, arg
 
 	// we are writing to local, so we need to catch the tar output stream and place the right files in the right place
 	buildxOutput = "type=oci"
+	if bo.sourceDateEpoch != nil {
+		// clamp the timestamps of the layer contents too, not just the config
+		buildxOutput += ",rewrite-timestamp=true"
+	}
 	piper, pipew := io.Pipe()
 	stdout = pipew
 
@@ -414,15 +797,36 @@ func (p Pkg) buildArch(d dockerRunner, c lktspec.CacheProvider, arch string, arg
 	})
 	args = append(args, fmt.Sprintf("--output=%s", buildxOutput))
 
-	buildCtx := &buildCtx{sources: p.sources}
+	buildCtx := &buildCtx{sources: p.sources, commit: p.commitHash}
 	platform := fmt.Sprintf("linux/%s", arch)
 	archArgs := append(args, "--platform")
 	archArgs = append(archArgs, platform)
-	if err := d.build(tagArch, p.path, builderName, platform, buildCtx.Reader(), stdout, archArgs...); err != nil {
+	for _, spec := range bo.cacheFrom {
+		cacheFrom, err := platformCacheSpec(spec, arch)
+		if err != nil {
+			return nil, err
+		}
+		archArgs = append(archArgs, "--cache-from="+cacheFrom)
+	}
+	if bo.cacheTo != "" {
+		cacheTo, err := platformCacheSpec(bo.cacheTo, arch)
+		if err != nil {
+			return nil, err
+		}
+		archArgs = append(archArgs, "--cache-to="+cacheTo)
+	}
+	var ctxReader io.Reader = buildCtx.Reader()
+	if len(p.baseOverrides) > 0 {
+		ctxReader = rewriteBaseImages(ctxReader, p.baseOverrides)
+	}
+	if err := d.build(tagArch, p.path, builderName, platform, ctxReader, stdout, archArgs...); err != nil {
 		stdoutCloser()
 		if strings.Contains(err.Error(), "executor failed running [/dev/.buildkit_qemu_emulator") {
 			return nil, fmt.Errorf("buildkit was unable to emulate %s. check binfmt has been set up and works for this platform: %v", platform, err)
 		}
+		if p.network == networkNone && isNetworkFailure(err) {
+			return nil, fmt.Errorf("%v (the build has no network access, if a step needs it set \"network: true\" in build.yml or build with -network)", err)
+		}
 		return nil, err
 	}
 	stdoutCloser()
@@ -435,10 +839,87 @@ func (p Pkg) buildArch(d dockerRunner, c lktspec.CacheProvider, arch string, arg
 	return desc, nil
 }
 
+// networkFailures are signs in the output of a failed build that a
+// step tried to reach the network, lower cased
+var networkFailures = []string{
+	"temporary failure in name resolution",
+	"could not resolve",
+	"name or service not known",
+	"no such host",
+	"bad address",
+	"dns lookup error",
+	"network is unreachable",
+}
+
+// isNetworkFailure reports whether the build failed with err because
+// of a lack of network access
+func isNetworkFailure(err error) bool {
+	output := err.Error()
+	var berr *buildError
+	if errors.As(err, &berr) {
+		output = berr.output
+	}
+	output = strings.ToLower(output)
+	for _, f := range networkFailures {
+		if strings.Contains(output, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// platformCacheSpec returns the buildx cache spec to use for arch. spec
+// is either a registry reference or a type=registry buildx cache spec,
+// e.g. type=registry,ref=<ref>,mode=max. The arch is appended to the
+// tag of the reference, or used as the tag if it has none, so that
+// each platform has its own cache.
+func platformCacheSpec(spec, arch string) (string, error) {
+	if !strings.Contains(spec, "=") {
+		spec = "type=registry,ref=" + spec
+	}
+
+	var (
+		fields = strings.Split(spec, ",")
+		ref    = -1
+	)
+	for i, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("bad cache spec attribute %q", f)
+		}
+		switch kv[0] {
+		case "type":
+			if kv[1] != "registry" {
+				return "", fmt.Errorf("unsupported cache type %q, only registry is supported", kv[1])
+			}
+		case "ref":
+			ref = i
+		}
+	}
+	if ref < 0 || fields[ref] == "ref=" {
+		return "", errors.New("no registry ref provided")
+	}
+
+	name := strings.TrimPrefix(fields[ref], "ref=")
+	if strings.Contains(name, "@") {
+		return "", fmt.Errorf("cache ref %s must not have a digest", name)
+	}
+	// a tag follows the last :, unless that is part of a registry host:port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name + "-" + arch
+	} else {
+		name = name + ":" + arch
+	}
+	fields[ref] = "ref=" + name
+	return strings.Join(fields, ","), nil
+}
+
 type buildCtx struct {
 	sources []pkgSource
-	err     error
-	r       io.ReadCloser
+	// commit to read the sources from, the working tree is used if empty or HEAD
+	commit string
+	err    error
+	r      io.ReadCloser
 }
 
 // Reader gets an io.Reader by iterating over the sources, tarring up the content after rewriting the paths.
@@ -454,6 +935,23 @@ func (c *buildCtx) Reader() io.ReadCloser {
 			w.Close()
 		}()
 		for _, s := range c.sources {
+			if s.tar {
+				log.Debugf("Adding to build context: tarball %s -> %s", s.src, s.dst)
+				if err := c.addTar(tw, s); err != nil {
+					c.err = err
+					return
+				}
+				continue
+			}
+			if c.commit != "" && c.commit != "HEAD" {
+				log.Debugf("Adding to build context: %s at %s -> %s", s.src, c.commit, s.dst)
+				if err := c.addCommit(tw, s); err != nil {
+					c.err = err
+					return
+				}
+				continue
+			}
+
 			log.Debugf("Adding to build context: %s -> %s", s.src, s.dst)
 
 			f := func(p string, i os.FileInfo, err error) error {
@@ -510,10 +1008,45 @@ func (c *buildCtx) Reader() io.ReadCloser {
 	return c
 }
 
+// addCommit copies the contents of source s at c.commit into tw, rewriting the paths
+func (c *buildCtx) addCommit(tw *tar.Writer, s pkgSource) error {
+	if s.git == nil {
+		return fmt.Errorf("ctx: %s is not in a git repository, cannot read it at commit %s", s.src, c.commit)
+	}
+	rc, err := s.git.archive(c.commit)
+	if err != nil {
+		return fmt.Errorf("ctx: Archiving %s at %s: %v", s.src, c.commit, err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("ctx: Reading archive of %s: %v", s.src, err)
+		}
+		// git archive records the commit id in a global header
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		h.Name = path.Join(s.dst, h.Name)
+		if err := tw.WriteHeader(h); err != nil {
+			return fmt.Errorf("ctx: Writing header for %s: %v", h.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("ctx: Writing %s: %v", h.Name, err)
+		}
+	}
+	return nil
+}
+
 // Read wraps the usual read, but allows us to include an error
 func (c *buildCtx) Read(data []byte) (n int, err error) {
 	if c.err != nil {
-		return 0, err
+		return 0, c.err
 	}
 	return c.r.Read(data)
 }
@@ -1,22 +1,32 @@
 package pkglib
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	registry "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/cache"
 	lktspec "github.com/linuxkit/linuxkit/src/cmd/linuxkit/spec"
 	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type dockerMocker struct {
@@ -26,6 +36,7 @@ type dockerMocker struct {
 	enableBuild     bool
 	enablePull      bool
 	fixedReadName   string
+	buildOutput     string
 	builds          []buildLog
 }
 
@@ -35,6 +46,8 @@ type buildLog struct {
 	dockerContext string
 	platform      string
 	opts          []string
+	// context is the build context read from stdin
+	context []byte
 }
 
 func (d *dockerMocker) buildkitCheck() error {
@@ -52,9 +65,13 @@ func (d *dockerMocker) tag(ref, tag string) error {
 }
 func (d *dockerMocker) build(tag, pkg, dockerContext, platform string, stdin io.Reader, stdout io.Writer, opts ...string) error {
 	if !d.enableBuild {
-		return errors.New("build disabled")
+		return &buildError{err: errors.New("build disabled"), output: d.buildOutput}
 	}
-	d.builds = append(d.builds, buildLog{tag, pkg, dockerContext, platform, opts})
+	var context []byte
+	if stdin != nil {
+		context, _ = ioutil.ReadAll(stdin)
+	}
+	d.builds = append(d.builds, buildLog{tag, pkg, dockerContext, platform, opts, context})
 	return nil
 }
 func (d *dockerMocker) save(tgt string, refs ...string) error {
@@ -271,7 +288,8 @@ func (c cacheMockerSource) TarReader() (io.ReadCloser, error) {
 	return nil, errors.New("unsupported")
 }
 func (c cacheMockerSource) V1TarReader() (io.ReadCloser, error) {
-	return nil, errors.New("unsupported")
+	// the name of the image stands in for its contents
+	return ioutil.NopCloser(strings.NewReader(c.ref.String())), nil
 }
 func (c cacheMockerSource) Descriptor() *registry.Descriptor {
 	return c.descriptor
@@ -361,3 +379,546 @@ func testCheckBuildRun(build buildLog, platforms map[string]bool) error {
 	}
 	return errors.New("missing platform argument")
 }
+
+func TestBuildCtxCommit(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	pkg := filepath.Join(repo, "pkg")
+	// uncommitted changes must not end up in the context
+	writeFile(t, filepath.Join(pkg, "build.yml"), "image: modified\n")
+
+	g, err := newGit(pkg)
+	require.NoError(t, err)
+
+	readCtx := func(commit string) map[string]string {
+		c := &buildCtx{sources: []pkgSource{{src: pkg, dst: "/", git: g}}, commit: commit}
+		r := c.Reader()
+		defer r.Close()
+		files := map[string]string{}
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			if h.Typeflag != tar.TypeReg {
+				continue
+			}
+			b, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			files[h.Name] = string(b)
+		}
+		return files
+	}
+
+	assert.Equal(t, map[string]string{"/build.yml": "image: dummy\n"}, readCtx("HEAD~1"))
+	assert.Equal(t, map[string]string{"/build.yml": "image: dummy\n", "/Dockerfile": "FROM scratch\n"}, readCtx("HEAD~0"))
+	assert.Equal(t, map[string]string{"/build.yml": "image: modified\n", "/Dockerfile": "FROM scratch\n"}, readCtx("HEAD"))
+}
+
+func TestPlatformCacheSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		out  string
+		err  string
+	}{
+		{"foo/cache", "type=registry,ref=foo/cache:amd64", ""},
+		{"foo/cache:main", "type=registry,ref=foo/cache:main-amd64", ""},
+		{"localhost:5000/cache", "type=registry,ref=localhost:5000/cache:amd64", ""},
+		{"type=registry,ref=foo/cache:main,mode=max", "type=registry,ref=foo/cache:main-amd64,mode=max", ""},
+		{"mode=max,ref=foo/cache", "mode=max,ref=foo/cache:amd64", ""},
+		{"type=local,src=/tmp/cache", "", "unsupported cache type"},
+		{"type=registry", "", "no registry ref provided"},
+		{"type=registry,ref=", "", "no registry ref provided"},
+		{"type=registry,ref=foo@sha256:abc", "", "cache ref foo@sha256:abc must not have a digest"},
+		{"type=registry,max", "", "bad cache spec attribute"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			out, err := platformCacheSpec(tt.spec, "amd64")
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.out, out)
+		})
+	}
+}
+
+func TestBuildCacheFromTo(t *testing.T) {
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+	cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64", "arm64"}, commitHash: "HEAD"}
+	err := p.Build(
+		WithBuildCacheDir("somecachedir"),
+		WithBuildCacheFrom("foo/cache", "foo/cache:main"),
+		WithBuildCacheTo("type=registry,ref=foo/cache,mode=max"),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}, imagespec.Platform{OS: "linux", Architecture: "arm64"}),
+		WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+	)
+	require.NoError(t, err)
+	require.Len(t, runner.builds, 2)
+	for _, b := range runner.builds {
+		arch := strings.TrimPrefix(b.platform, "linux/")
+		assert.Contains(t, b.opts, "--cache-from=type=registry,ref=foo/cache:"+arch)
+		assert.Contains(t, b.opts, "--cache-from=type=registry,ref=foo/cache:main-"+arch)
+		assert.Contains(t, b.opts, "--cache-to=type=registry,ref=foo/cache:"+arch+",mode=max")
+	}
+
+	err = p.Build(WithBuildCacheTo("type=gha"))
+	require.Error(t, err)
+}
+
+func TestBuildSourceDateEpoch(t *testing.T) {
+	build := func(t *testing.T, p Pkg, opts ...BuildOpt) []string {
+		runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+		cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+		opts = append(opts,
+			WithBuildCacheDir("somecachedir"),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+		)
+		require.NoError(t, p.Build(opts...))
+		require.Len(t, runner.builds, 1)
+		return runner.builds[0].opts
+	}
+
+	t.Run("Explicit", func(t *testing.T) {
+		p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD"}
+		opts := build(t, p, WithBuildSourceDateEpoch(time.Unix(1234, 0)))
+		assert.Contains(t, opts, "SOURCE_DATE_EPOCH=1234")
+		assert.Contains(t, opts, "--output=type=oci,rewrite-timestamp=true")
+	})
+
+	t.Run("NotGit", func(t *testing.T) {
+		p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD"}
+		opts := build(t, p)
+		assert.Contains(t, opts, "--output=type=oci")
+		for _, o := range opts {
+			assert.False(t, strings.HasPrefix(o, "SOURCE_DATE_EPOCH="), "unexpected %s", o)
+		}
+	})
+
+	t.Run("CommitDate", func(t *testing.T) {
+		tmpDir := testTmpDir(t)
+		defer os.RemoveAll(tmpDir)
+		repo := testRepo(t, tmpDir)
+
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+
+		// only when asked for, as older BuildKit cannot rewrite them
+		opts := build(t, pkgs[0])
+		assert.Contains(t, opts, "--output=type=oci")
+		for _, o := range opts {
+			assert.False(t, strings.HasPrefix(o, "SOURCE_DATE_EPOCH="), "unexpected %s", o)
+		}
+
+		ct := strings.TrimSpace(runGit(t, repo, "show", "-s", "--format=%ct", "HEAD"))
+		first := build(t, pkgs[0], WithBuildCommitDateEpoch())
+		assert.Contains(t, first, "SOURCE_DATE_EPOCH="+ct)
+		assert.Contains(t, first, "--output=type=oci,rewrite-timestamp=true")
+
+		// rebuilding the same commit asks for an identical image
+		assert.Equal(t, first, build(t, pkgs[0], WithBuildCommitDateEpoch()))
+	})
+
+	t.Run("Dirty", func(t *testing.T) {
+		tmpDir := testTmpDir(t)
+		defer os.RemoveAll(tmpDir)
+		repo := testRepo(t, tmpDir)
+		writeFile(t, filepath.Join(repo, "pkg", "Dockerfile"), "FROM alpine\n")
+
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+
+		opts := build(t, pkgs[0], WithBuildCommitDateEpoch())
+		assert.Contains(t, opts, "--output=type=oci")
+		for _, o := range opts {
+			assert.False(t, strings.HasPrefix(o, "SOURCE_DATE_EPOCH="), "unexpected %s", o)
+		}
+	})
+}
+
+// TestBuildReproducibleDigest builds the same commit twice from scratch
+// with BuildKit and checks the images are identical
+func TestBuildReproducibleDigest(t *testing.T) {
+	if err := exec.Command("docker", "buildx", "inspect", "--bootstrap").Run(); err != nil {
+		t.Skip("docker buildx is not available")
+	}
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	writeFile(t, filepath.Join(repo, "pkg", "Dockerfile"), "FROM scratch\nCOPY build.yml /\n")
+	runGit(t, repo, "commit", "-q", "-a", "-m", "copy a file")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+
+	digest := func(name string) string {
+		cacheDir := filepath.Join(tmpDir, name)
+		require.NoError(t, pkgs[0].Build(
+			WithBuildCacheDir(cacheDir),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: runtime.GOARCH}),
+			WithBuildOutputWriter(ioutil.Discard),
+			WithBuildCommitDateEpoch(),
+		))
+		c, err := cache.NewProvider(cacheDir)
+		require.NoError(t, err)
+		desc, err := c.FindDescriptor(pkgs[0].FullTag())
+		require.NoError(t, err)
+		return desc.Digest.String()
+	}
+	assert.Equal(t, digest("first"), digest("second"))
+}
+
+func TestBuildVersionLabel(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	runGit(t, repo, "tag", "v1.2.0")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+	cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+	require.NoError(t, pkgs[0].Build(
+		WithBuildCacheDir("somecachedir"),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+		WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+	))
+	require.Len(t, runner.builds, 1)
+	assert.Contains(t, runner.builds[0].opts, "org.opencontainers.image.version=v1.2.0")
+	assert.Contains(t, runner.builds[0].opts, "org.opencontainers.image.ref.name=v1.2.0")
+}
+
+func TestBuildSinglePlatform(t *testing.T) {
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64", "arm64"}, commitHash: "HEAD"}
+	build := func(runner *dockerMocker, opts ...BuildOpt) error {
+		// IndexWrite is disabled, so fails the build if a multi-arch index is created
+		cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: false}
+		opts = append(opts,
+			WithBuildCacheDir("somecachedir"),
+			WithBuildSinglePlatform(),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+		)
+		return p.Build(opts...)
+	}
+
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true, images: map[string][]byte{}, fixedReadName: "loaded"}
+	err := build(runner, WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "arm64"}))
+	require.NoError(t, err)
+	require.Len(t, runner.builds, 1)
+	assert.Equal(t, "linux/arm64", runner.builds[0].platform)
+	assert.Equal(t, "docker.io/foo/bar:abc-arm64", string(runner.images["loaded"]))
+
+	err = build(&dockerMocker{supportBuildKit: true, enableBuild: true}, WithBuildPlatforms(
+		imagespec.Platform{OS: "linux", Architecture: "amd64"},
+		imagespec.Platform{OS: "linux", Architecture: "arm64"},
+	))
+	assert.EqualError(t, err, "single platform build requires exactly one platform, not 2")
+
+	err = build(&dockerMocker{supportBuildKit: true, enableBuild: true}, WithBuildPush(), WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "arm64"}))
+	assert.EqualError(t, err, "cannot push a single platform build")
+}
+
+func TestBuildNetwork(t *testing.T) {
+	build := func(network string, enableBuild bool, output string) ([]string, error) {
+		runner := &dockerMocker{supportBuildKit: true, enableBuild: enableBuild, buildOutput: output}
+		cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+		p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD", network: network}
+		err := p.Build(
+			WithBuildCacheDir("somecachedir"),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+		)
+		if len(runner.builds) == 0 {
+			return nil, err
+		}
+		return runner.builds[0].opts, err
+	}
+
+	opts, err := build(networkNone, true, "")
+	require.NoError(t, err)
+	assert.Contains(t, opts, "--network=none")
+
+	opts, err = build(networkHost, true, "")
+	require.NoError(t, err)
+	assert.Contains(t, opts, "--network=host")
+	assert.Contains(t, opts, "--allow=network.host")
+
+	opts, err = build(networkDefault, true, "")
+	require.NoError(t, err)
+	for _, o := range opts {
+		assert.False(t, strings.HasPrefix(o, "--network"), "unexpected %s", o)
+	}
+
+	resolve := "#5 0.3 wget: bad address 'dl-cdn.alpinelinux.org'\n"
+	_, err = build(networkNone, false, resolve)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the build has no network access")
+	_, err = build(networkNone, false, "#5 0.3 curl: (6) Could not resolve host: example.com\n")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the build has no network access")
+	_, err = build(networkDefault, false, resolve)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "network")
+
+	// other failures are not blamed on the network
+	_, err = build(networkNone, false, "#5 0.1 /bin/sh: make: not found\n")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "network")
+}
+
+func TestBuildArgsPassthrough(t *testing.T) {
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+	cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD", buildArgs: []string{"ALPINE_VERSION=3.17", "PROXY="}}
+	require.NoError(t, p.Build(
+		WithBuildCacheDir("somecachedir"),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+		WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+	))
+	require.Len(t, runner.builds, 1)
+	opts := strings.Join(runner.builds[0].opts, " ")
+	assert.Contains(t, opts, "--build-arg ALPINE_VERSION=3.17 --build-arg PROXY=")
+}
+
+func TestBuildBaseOverride(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	writeFile(t, filepath.Join(tmpDir, "Dockerfile"), "FROM linuxkit/alpine:0123\n")
+
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+	cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD",
+		sources:       []pkgSource{{src: tmpDir, dst: "/"}},
+		baseOverrides: map[string]string{"linuxkit/alpine:0123": "linuxkit/alpine:4567"},
+	}
+	require.NoError(t, p.Build(
+		WithBuildCacheDir("somecachedir"),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+		WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+	))
+	require.Len(t, runner.builds, 1)
+	tr := tar.NewReader(bytes.NewReader(runner.builds[0].context))
+	for {
+		h, err := tr.Next()
+		require.NoError(t, err, "no Dockerfile in the build context")
+		if h.Name == "/Dockerfile" {
+			b, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			assert.Equal(t, "FROM linuxkit/alpine:4567\n", string(b))
+			break
+		}
+	}
+}
+
+func TestBuildSecrets(t *testing.T) {
+	runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+	cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD"}
+	require.NoError(t, p.Build(
+		WithBuildCacheDir("somecachedir"),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+		WithBuildSecrets("id=token,src=/run/token", "id=npm,env=NPM_TOKEN"),
+		WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+	))
+	require.Len(t, runner.builds, 1)
+	opts := strings.Join(runner.builds[0].opts, " ")
+	assert.Contains(t, opts, "--secret id=token,src=/run/token --secret id=npm,env=NPM_TOKEN")
+	// the tag is that of the source alone
+	assert.Equal(t, "foo/bar:abc", p.Tag())
+
+	for _, spec := range []string{
+		"src=/run/token",
+		"id=token",
+		"id=token,src=/run/token,env=TOKEN",
+		"id=token,type=ssh",
+		"id=token,path=/run/token",
+		"id=token,src=",
+	} {
+		assert.Error(t, WithBuildSecrets(spec)(&buildOpts{}), spec)
+	}
+	assert.NoError(t, WithBuildSecrets("id=TOKEN,type=env")(&buildOpts{}))
+}
+
+func TestBuildNoCache(t *testing.T) {
+	build := func(p Pkg, opts ...BuildOpt) *dockerMocker {
+		runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+		// the image is in the cache already
+		cache := &cacheMocker{enableImagePull: true, enableImageLoad: true, enableIndexWrite: true}
+		require.NoError(t, p.Build(append([]BuildOpt{
+			WithBuildCacheDir("somecachedir"),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(ioutil.Discard),
+		}, opts...)...))
+		return runner
+	}
+	p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD", cache: true}
+
+	runner := build(p, WithBuildForce())
+	require.Len(t, runner.builds, 1)
+	assert.NotContains(t, runner.builds[0].opts, "--no-cache")
+
+	// the image in the cache is rebuilt
+	runner = build(p, WithBuildNoCache())
+	require.Len(t, runner.builds, 1)
+	assert.Contains(t, runner.builds[0].opts, "--no-cache")
+	assert.Equal(t, "foo/bar:abc", p.Tag(), "the tag is that of the source alone")
+
+	// as with disable-cache in build.yml
+	p.cache = false
+	runner = build(p, WithBuildForce())
+	require.Len(t, runner.builds, 1)
+	assert.Contains(t, runner.builds[0].opts, "--no-cache")
+}
+
+// TestBuildSecretNotInImage builds a package reading a secret with
+// BuildKit, and checks it is not in the image
+func TestBuildSecretNotInImage(t *testing.T) {
+	if err := exec.Command("docker", "buildx", "inspect", "--bootstrap").Run(); err != nil {
+		t.Skip("docker buildx is not available")
+	}
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	const secret = "s3cr3t-f0r-t3st"
+	writeFile(t, filepath.Join(tmpDir, "token"), secret)
+	writeFile(t, filepath.Join(repo, "pkg", "Dockerfile"), `FROM alpine:3.18
+RUN --mount=type=secret,id=token test "$(cat /run/secrets/token)" = `+secret+` && touch /seen
+`)
+	runGit(t, repo, "commit", "-q", "-a", "-m", "use a secret")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-network", filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	cacheDir := filepath.Join(tmpDir, "cache")
+	require.NoError(t, pkgs[0].Build(
+		WithBuildCacheDir(cacheDir),
+		WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: runtime.GOARCH}),
+		WithBuildSecrets("id=token,src="+filepath.Join(tmpDir, "token")),
+		WithBuildOutputWriter(ioutil.Discard),
+	))
+
+	c, err := cache.NewProvider(cacheDir)
+	require.NoError(t, err)
+	ref, err := reference.Parse(pkgs[0].FullTag())
+	require.NoError(t, err)
+	src, err := c.ImagePull(&ref, "", runtime.GOARCH, false)
+	require.NoError(t, err)
+	r, err := src.TarReader()
+	require.NoError(t, err)
+	defer r.Close()
+	var seen bool
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		name := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		seen = seen || name == "seen"
+		assert.NotEqual(t, "run/secrets/token", name)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		assert.False(t, bytes.Contains(b, []byte(secret)), "secret found in %s", hdr.Name)
+	}
+	assert.True(t, seen, "the secret was not available to the build")
+}
+
+func TestBuildSkipExisting(t *testing.T) {
+	s, host := newTestRegistry()
+	defer s.Close()
+	pushTestImage(t, host+"/linuxkit/foo:abc")
+
+	build := func(p Pkg, handler http.Handler) (int, string) {
+		s.Config.Handler = handler
+		runner := &dockerMocker{supportBuildKit: true, enableBuild: true}
+		cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+		var out bytes.Buffer
+		require.NoError(t, p.Build(
+			WithBuildCacheDir("somecachedir"),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}),
+			WithBuildSkipExisting(),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(&out),
+		))
+		return len(runner.builds), out.String()
+	}
+	registry := s.Config.Handler
+	existing := Pkg{org: host + "/linuxkit", image: "foo", hash: "abc", arches: []string{"amd64"}, commitHash: "HEAD"}
+	missing := Pkg{org: host + "/linuxkit", image: "foo", hash: "def", arches: []string{"amd64"}, commitHash: "HEAD"}
+
+	n, out := build(existing, registry)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, out, "already in the registry, skipping")
+
+	n, _ = build(missing, registry)
+	assert.Equal(t, 1, n)
+
+	// a registry without HEAD is asked with GET
+	noHead := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && strings.Contains(r.URL.Path, "/manifests/") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	})
+	n, _ = build(existing, noHead)
+	assert.Equal(t, 0, n)
+	n, _ = build(missing, noHead)
+	assert.Equal(t, 1, n)
+
+	// a registry which cannot be asked is built for
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		registry.ServeHTTP(w, r)
+	})
+	n, out = build(existing, failing)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, out, "Unable to tell whether")
+
+	// a dirty package is never in the registry
+	dirty := existing
+	dirty.dirty = true
+	n, _ = build(dirty, registry)
+	assert.Equal(t, 1, n)
+}
+
+func TestBuildProgressQuiet(t *testing.T) {
+	build := func(enableBuild bool) (string, error) {
+		runner := &dockerMocker{supportBuildKit: true, enableBuild: enableBuild}
+		cache := &cacheMocker{enableImagePull: false, enableImageLoad: true, enableIndexWrite: true}
+		p := Pkg{org: "foo", image: "bar", hash: "abc", arches: []string{"amd64", "arm64"}, commitHash: "HEAD"}
+		var out bytes.Buffer
+		err := p.Build(
+			WithBuildCacheDir("somecachedir"),
+			WithBuildPlatforms(imagespec.Platform{OS: "linux", Architecture: "amd64"}, imagespec.Platform{OS: "linux", Architecture: "arm64"}),
+			WithBuildProgress(ProgressQuiet),
+			WithBuildDocker(runner), WithBuildCacheProvider(cache), WithBuildOutputWriter(&out),
+		)
+		return out.String(), err
+	}
+
+	out, err := build(true)
+	require.NoError(t, err)
+	assert.Equal(t, "docker.io/foo/bar:abc\n", out)
+
+	out, err = build(false)
+	assert.Error(t, err)
+	assert.Empty(t, out)
+}
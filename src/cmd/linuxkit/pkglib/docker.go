@@ -14,7 +14,9 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
 
 	versioncompare "github.com/hashicorp/go-version"
 	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
@@ -36,7 +38,25 @@ type dockerRunner interface {
 }
 
 type dockerRunnerImpl struct {
-	cache bool
+	// progress is the BuildKit progress mode, in quiet mode the output
+	// of docker is only shown if it fails
+	progress string
+	// out, if set, gets all the output, rather than stdout and stderr
+	out io.Writer
+	// registerBinfmt allows the binfmt_misc handlers needed to emulate
+	// a platform to be registered
+	registerBinfmt bool
+}
+
+// buildError is returned by build when buildx fails, output is what it
+// wrote to stderr, where the cause of the failure can be looked for
+type buildError struct {
+	err    error
+	output string
+}
+
+func (e *buildError) Error() string {
+	return e.err.Error()
 }
 
 type buildContext interface {
@@ -44,8 +64,31 @@ type buildContext interface {
 	Copy(io.WriteCloser) error
 }
 
-func newDockerRunner(cache bool) dockerRunner {
-	return &dockerRunnerImpl{cache: cache}
+func newDockerRunner(progress string, out io.Writer, registerBinfmt bool) dockerRunner {
+	return &dockerRunnerImpl{progress: progress, out: out, registerBinfmt: registerBinfmt}
+}
+
+// stdout is where the output of docker goes
+func (dr *dockerRunnerImpl) stdout() io.Writer {
+	if dr.out != nil {
+		return dr.out
+	}
+	return os.Stdout
+}
+
+// stderr is where the errors and progress of docker go
+func (dr *dockerRunnerImpl) stderr() io.Writer {
+	if dr.out != nil {
+		return dr.out
+	}
+	return os.Stderr
+}
+
+// printf prints what is being done, unless in quiet mode
+func (dr *dockerRunnerImpl) printf(format string, a ...interface{}) {
+	if dr.progress != ProgressQuiet {
+		fmt.Fprintf(dr.stdout(), format, a...)
+	}
 }
 
 func isExecErrNotFound(err error) bool {
@@ -73,14 +116,22 @@ var proxyEnvVars = []string{
 
 func (dr *dockerRunnerImpl) command(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
 	cmd := exec.Command("docker", args...)
+	quiet := dr.progress == ProgressQuiet
+	var quietStderr bytes.Buffer
 	if stdin == nil {
 		stdin = os.Stdin
 	}
 	if stdout == nil {
-		stdout = os.Stdout
+		stdout = dr.stdout()
+		if quiet {
+			stdout = ioutil.Discard
+		}
 	}
 	if stderr == nil {
-		stderr = os.Stderr
+		stderr = dr.stderr()
+		if quiet {
+			stderr = &quietStderr
+		}
 	}
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
@@ -91,6 +142,7 @@ func (dr *dockerRunnerImpl) command(stdin io.Reader, stdout, stderr io.Writer, a
 
 	err := cmd.Run()
 	if err != nil {
+		dr.stderr().Write(quietStderr.Bytes())
 		if isExecErrNotFound(err) {
 			return fmt.Errorf("linuxkit pkg requires docker to be installed")
 		}
@@ -208,9 +260,15 @@ func (dr *dockerRunnerImpl) builder(dockerContext, platform string) (string, err
 	return builderName, nil
 }
 
+// builderMu serializes the creation of builders by packages built in
+// parallel
+var builderMu sync.Mutex
+
 // builderEnsureContainer provided a name of a builder, ensure that the builder exists, and if not, create it
 // based on the provided docker context, for the target platform.. Assumes the dockerContext already exists.
 func (dr *dockerRunnerImpl) builderEnsureContainer(name, platform, dockerContext string, args ...string) error {
+	builderMu.Lock()
+	defer builderMu.Unlock()
 	// if no error, then we have a builder already
 	// inspect it to make sure it is of the right type
 	var b bytes.Buffer
@@ -228,7 +286,7 @@ func (dr *dockerRunnerImpl) builderEnsureContainer(name, platform, dockerContext
 			args = append(args, dockerContext)
 			msg = fmt.Sprintf("%s based on docker context '%s'", msg, dockerContext)
 		}
-		fmt.Println(msg)
+		dr.printf("%s\n", msg)
 		return dr.command(nil, ioutil.Discard, ioutil.Discard, args...)
 	}
 	// if we got here, we found a builder already, so let us check its type
@@ -286,14 +344,17 @@ func (dr *dockerRunnerImpl) pushWithManifest(img, suffix string, pushImage, push
 		fmt.Print("Image push disabled, skipping...\n")
 	}
 
-	auth, err := registry.GetDockerAuth()
+	auth, err := registry.GetDockerAuth(img)
 	if err != nil {
 		return fmt.Errorf("failed to get auth: %v", err)
 	}
 
 	if pushManifest {
 		fmt.Printf("Pushing %s to manifest %s\n", img+suffix, img)
-		_, _, err = registry.PushManifest(img, auth)
+		err = registry.RetryPush(img, func() error {
+			_, _, err := registry.PushManifest(img, auth)
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -304,7 +365,7 @@ func (dr *dockerRunnerImpl) pushWithManifest(img, suffix string, pushImage, push
 }
 
 func (dr *dockerRunnerImpl) tag(ref, tag string) error {
-	fmt.Printf("Tagging %s as %s\n", ref, tag)
+	dr.printf("Tagging %s as %s\n", ref, tag)
 	return dr.command(nil, nil, nil, "image", "tag", ref, tag)
 }
 
@@ -314,6 +375,13 @@ func (dr *dockerRunnerImpl) build(tag, pkg, dockerContext, platform string, stdi
 	if err != nil {
 		return fmt.Errorf("unable to ensure proper buildx builder: %v", err)
 	}
+	// the generic builder runs on this host, others are native
+	var unemulated bool
+	if builderName == buildkitBuilderName {
+		if unemulated, err = dr.ensureEmulation(platform); err != nil {
+			return err
+		}
+	}
 
 	args := []string{"buildx", "build"}
 
@@ -323,8 +391,8 @@ func (dr *dockerRunnerImpl) build(tag, pkg, dockerContext, platform string, stdi
 				[]string{"--build-arg", fmt.Sprintf("%s=%s", proxyVarName, value)}...)
 		}
 	}
-	if !dr.cache {
-		args = append(args, "--no-cache")
+	if dr.progress != "" {
+		args = append(args, "--progress="+dr.progress)
 	}
 	args = append(args, opts...)
 	args = append(args, fmt.Sprintf("--builder=%s", builderName))
@@ -337,8 +405,29 @@ func (dr *dockerRunnerImpl) build(tag, pkg, dockerContext, platform string, stdi
 	}
 	args = append(args, buildPath)
 
-	fmt.Printf("building for platform %s using builder %s\n", platform, builderName)
-	return dr.command(stdin, stdout, nil, args...)
+	dr.printf("building for platform %s using builder %s\n", platform, builderName)
+	var (
+		stderr   bytes.Buffer
+		progress = dr.stderr()
+	)
+	switch dr.progress {
+	case ProgressQuiet:
+		progress = ioutil.Discard
+	case ProgressPlain:
+		tw := newTimestampWriter(progress)
+		defer tw.Flush()
+		progress = tw
+	}
+	if err := dr.command(stdin, stdout, io.MultiWriter(progress, &stderr), args...); err != nil {
+		if dr.progress == ProgressQuiet {
+			dr.stderr().Write(stderr.Bytes())
+		}
+		if unemulated {
+			err = fmt.Errorf("%v: %v", err, emulationError(platform, runtime.GOARCH))
+		}
+		return &buildError{err: err, output: stderr.String()}
+	}
+	return nil
 }
 
 func (dr *dockerRunnerImpl) save(tgt string, refs ...string) error {
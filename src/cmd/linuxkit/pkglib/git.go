@@ -3,30 +3,143 @@ package pkglib
 // Thin wrappers around git CLI invocations
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 // 040000 tree 7804129bd06218b72c298139a25698a748d253c6\tpkg/init
 var treeHashRe *regexp.Regexp
 
+// v1.10.2, v2.0.0-rc1, v1.0.0+build.5
+var semverTagRe *regexp.Regexp
+
 func init() {
 	treeHashRe = regexp.MustCompile("^[0-7]{6} [^ ]+ ([0-9a-f]{40})\t.+\n$")
+	semverTagRe = regexp.MustCompile(`^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+}
+
+var (
+	// gitPath is the git executable used for all invocations
+	gitPath = "git"
+	// gitEnv is added to the inherited environment of all invocations
+	gitEnv []string
+	// gitRunner creates the command for every invocation
+	gitRunner runner = execRunner{}
+	// gitDryRun skips invocations which would modify the repository
+	gitDryRun bool
+)
+
+// runner creates the commands used to invoke git, allowing them to be
+// recorded or replaced, e.g. in tests
+type runner interface {
+	// Command returns a command running the git executable with args,
+	// env is added to the environment it inherits
+	Command(env []string, args ...string) *exec.Cmd
+}
+
+// execRunner runs gitPath with gitEnv
+type execRunner struct{}
+
+func (execRunner) Command(env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command(gitPath, args...)
+	if len(gitEnv) > 0 || len(env) > 0 {
+		cmd.Env = append(append(os.Environ(), gitEnv...), env...)
+	}
+	return cmd
+}
+
+// recordingRunner writes the full argv of every command to w before
+// it is run
+type recordingRunner struct {
+	w io.Writer
+	execRunner
+}
+
+func (r recordingRunner) Command(env []string, args ...string) *exec.Cmd {
+	cmd := r.execRunner.Command(env, args...)
+	suffix := ""
+	if gitDryRun && modifiesRepo(env, args) {
+		suffix = " (dry-run, not executed)"
+	}
+	fmt.Fprintf(r.w, "+ %s%s\n", strings.Join(append(append([]string{}, env...), cmd.Args...), " "), suffix)
+	return cmd
+}
+
+// modifiesRepo reports whether the git command line, as passed to a
+// runner, writes to the repository. These are only run by command.
+// Refreshing an index other than the repository's own is harmless.
+func modifiesRepo(env, args []string) bool {
+	// skip the leading -C <dir>
+	if len(args) > 2 && args[0] == "-C" {
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "fetch":
+		return true
+	case "update-index":
+		for _, e := range env {
+			if strings.HasPrefix(e, "GIT_INDEX_FILE=") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
 type git struct {
 	dir string
+	// top is the top level of the work tree containing dir, which
+	// may be a linked worktree rather than the main checkout
+	top string
+	// fetchUnshallow allows the history of a shallow clone to be
+	// fetched when a requested commit is not available locally
+	fetchUnshallow bool
+	// hashWorkers is the number of files contentHash hashes
+	// concurrently, defaults to GOMAXPROCS if not positive
+	hashWorkers int
+	// bare is set when there is no work tree, e.g. a bare mirror used
+	// via GIT_DIR. Package paths are then taken relative to top, the
+	// current directory, as git itself does for GIT_DIR without a work
+	// tree, and only operations on commits are possible.
+	bare bool
+	// indexFile replaces the repository's index when set, see
+	// scratchIndex
+	indexFile string
 }
 
 // Returns git==nil and no error if the path is not within a git repository
 func newGit(dir string) (*git, error) {
-	g := &git{dir}
+	g := &git{dir: dir}
+
+	if top, ok := workTrees.lookup(dir); ok {
+		g.top = top
+		return g, nil
+	}
 
 	// Check if dir really is within a git directory
 	ok, err := g.isWorkTree(dir)
@@ -34,13 +147,89 @@ func newGit(dir string) (*git, error) {
 		return nil, err
 	}
 	if !ok {
-		return nil, nil
+		bare, err := g.isBare()
+		if err != nil || !bare {
+			return nil, err
+		}
+		g.bare = true
+		if g.top, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+		return g, nil
+	}
+
+	top, err := g.commandStdout(nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
 	}
+	g.top = strings.TrimSpace(top)
+	workTrees.add(g.top)
 	return g, nil
 }
 
+// workTreeCache records the top level of the work trees newGit has
+// found, so that other directories inside them are resolved without
+// running git again
+type workTreeCache struct {
+	sync.Mutex
+	tops map[string]bool
+}
+
+var workTrees = workTreeCache{tops: map[string]bool{}}
+
+func (c *workTreeCache) add(top string) {
+	c.Lock()
+	defer c.Unlock()
+	c.tops[filepath.Clean(top)] = true
+}
+
+// lookup returns the top level of the cached work tree containing dir.
+// A .git in any directory on the way up to it means dir is in another
+// repository nested within, e.g. a submodule, so it is not a match.
+func (c *workTreeCache) lookup(dir string) (string, bool) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for d := dir; ; d = filepath.Dir(d) {
+		if c.tops[d] {
+			return d, true
+		}
+		if _, err := os.Lstat(filepath.Join(d, ".git")); err == nil {
+			return "", false
+		}
+		if d == filepath.Dir(d) {
+			return "", false
+		}
+	}
+}
+
 func (g git) mkCmd(args ...string) *exec.Cmd {
-	return exec.Command("git", append([]string{"-C", g.dir}, args...)...)
+	return gitRunner.Command(g.env(), append([]string{"-C", g.dir}, args...)...)
+}
+
+// env is the environment specific to g added to every invocation
+func (g git) env() []string {
+	if g.indexFile == "" {
+		return nil
+	}
+	return []string{"GIT_INDEX_FILE=" + g.indexFile}
+}
+
+// gitError replaces the error from failing to run a missing git
+// executable with one explaining how to fix it
+func gitError(err error) error {
+	var pathErr *os.PathError
+	if !isExecErrNotFound(err) && !(errors.As(err, &pathErr) && os.IsNotExist(pathErr.Err)) {
+		return err
+	}
+	if gitPath == "git" {
+		return fmt.Errorf("git executable not found in PATH; install git or set -git-path")
+	}
+	return fmt.Errorf("git executable %s not found; install git or fix -git-path", gitPath)
 }
 
 func (g git) commandStdout(stderr io.Writer, args ...string) (string, error) {
@@ -50,7 +239,20 @@ func (g git) commandStdout(stderr io.Writer, args ...string) (string, error) {
 
 	out, err := cmd.Output()
 	if err != nil {
-		return "", err
+		return "", gitError(err)
+	}
+	return string(out), nil
+}
+
+func (g git) commandStdin(stdin string, args ...string) (string, error) {
+	cmd := g.mkCmd(args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	log.Debugf("Executing: %v", cmd.Args)
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", gitError(err)
 	}
 	return string(out), nil
 }
@@ -61,7 +263,11 @@ func (g git) command(args ...string) error {
 	cmd.Stderr = os.Stderr
 	log.Debugf("Executing: %v", cmd.Args)
 
-	return cmd.Run()
+	if gitDryRun && modifiesRepo(g.env(), cmd.Args[1:]) {
+		return nil
+	}
+
+	return gitError(cmd.Run())
 }
 
 func (g git) isWorkTree(pkg string) (bool, error) {
@@ -76,14 +282,119 @@ func (g git) isWorkTree(pkg string) (bool, error) {
 
 	tf = strings.TrimSpace(tf)
 
-	if tf == "true" {
+	switch tf {
+	case "true":
 		return true, nil
+	case "false":
+		return false, nil
 	}
 
 	return false, fmt.Errorf("unexpected output from git rev-parse --is-inside-work-tree: %s", tf)
 }
 
+// isBare reports whether the repository has no work tree, either
+// because it is a bare repository or because GIT_DIR names one. It is
+// an error to be inside the git directory of a repository which does
+// have a work tree.
+func (g git) isBare() (bool, error) {
+	tf, err := g.commandStdout(nil, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return false, err
+	}
+
+	tf = strings.TrimSpace(tf)
+
+	switch tf {
+	case "true":
+		return true, nil
+	case "false":
+		return false, fmt.Errorf("%s is inside a git directory, not a work tree", g.dir)
+	}
+
+	return false, fmt.Errorf("unexpected output from git rev-parse --is-bare-repository: %s", tf)
+}
+
+// requireWorkTree returns an error explaining that op cannot be done
+// in a bare repository
+func (g git) requireWorkTree(op string) error {
+	if !g.bare {
+		return nil
+	}
+	return fmt.Errorf("%s needs a work tree, but %s is in a bare repository, specify a commit with -hash-commit instead", op, g.dir)
+}
+
+// repoPath returns pkg relative to the top of the repository, "." for
+// the top itself
+func (g git) repoPath(pkg string) (string, error) {
+	abs, err := filepath.Abs(pkg)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(g.top, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Package %s is outside of %s", pkg, g.top)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (g git) isShallow() (bool, error) {
+	tf, err := g.commandStdout(nil, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+
+	tf = strings.TrimSpace(tf)
+
+	switch tf {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unexpected output from git rev-parse --is-shallow-repository: %s", tf)
+}
+
+// ensureCommit makes sure commit can be resolved locally. If it cannot
+// and the repository is a shallow clone then the missing history is
+// fetched, if allowed, otherwise an error explaining the problem is
+// returned. Any other failure is left for the caller to report.
+func (g git) ensureCommit(commit string) error {
+	if _, err := g.commandStdout(nil, "rev-parse", "--verify", "--quiet", commit+"^{commit}"); err == nil {
+		return nil
+	}
+
+	shallow, err := g.isShallow()
+	if err != nil {
+		return err
+	}
+	if !shallow {
+		return nil
+	}
+
+	if !g.fetchUnshallow {
+		return fmt.Errorf("commit %s is not available in shallow clone %s, fetch the full history with 'git fetch --unshallow' or allow it with -unshallow", commit, g.dir)
+	}
+
+	log.Infof("Commit %s not available in shallow clone %s, fetching full history", commit, g.dir)
+	if err := g.command("fetch", "--unshallow"); err != nil {
+		return fmt.Errorf("unable to unshallow %s: %v", g.dir, err)
+	}
+	return nil
+}
+
 func (g git) treeHash(pkg, commit string) (string, error) {
+	if err := g.ensureCommit(commit); err != nil {
+		return "", err
+	}
+
+	if g.bare {
+		return g.bareTreeHash(pkg, commit)
+	}
+
 	// we have to check if pkg is at the top level of the git tree,
 	// if that's the case we need to use tree hash from the commit itself
 	out, err := g.commandStdout(nil, "rev-parse", "--prefix", pkg, "--show-toplevel")
@@ -91,18 +402,58 @@ func (g git) treeHash(pkg, commit string) (string, error) {
 		return "", err
 	}
 	if strings.TrimSpace(out) == pkg {
-		out, err = g.commandStdout(nil, "show", "--format=%T", "-s", commit)
+		return g.rootTreeHash(commit)
+	}
+
+	out, err = g.commandStdout(os.Stderr, "ls-tree", "--full-tree", commit, "--", pkg)
+	if err != nil {
+		return "", err
+	}
+
+	if out == "" {
+		// ls-tree does not descend into submodules
+		h, ok, err := g.submoduleTreeHash(pkg, commit)
 		if err != nil {
 			return "", err
 		}
-		return strings.TrimSpace(out), nil
+		if !ok {
+			return "", fmt.Errorf("Package %s is not in git", pkg)
+		}
+		return h, nil
 	}
 
-	out, err = g.commandStdout(os.Stderr, "ls-tree", "--full-tree", commit, "--", pkg)
+	matches := treeHashRe.FindStringSubmatch(out)
+	if len(matches) != 2 {
+		return "", fmt.Errorf("Unable to parse ls-tree output: %q", out)
+	}
+
+	// if pkg is itself a submodule this is the commit it is at
+	return matches[1], nil
+}
+
+func (g git) rootTreeHash(commit string) (string, error) {
+	out, err := g.commandStdout(nil, "show", "--format=%T", "-s", commit)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// bareTreeHash is treeHash for a repository without a work tree, where
+// pkg is looked up in commit by its path relative to g.top
+func (g git) bareTreeHash(pkg, commit string) (string, error) {
+	rel, err := g.repoPath(pkg)
 	if err != nil {
 		return "", err
 	}
+	if rel == "." {
+		return g.rootTreeHash(commit)
+	}
 
+	out, err := g.commandStdout(os.Stderr, "ls-tree", "--full-tree", commit, "--", rel)
+	if err != nil {
+		return "", err
+	}
 	if out == "" {
 		return "", fmt.Errorf("Package %s is not in git", pkg)
 	}
@@ -111,10 +462,55 @@ func (g git) treeHash(pkg, commit string) (string, error) {
 	if len(matches) != 2 {
 		return "", fmt.Errorf("Unable to parse ls-tree output: %q", out)
 	}
-
 	return matches[1], nil
 }
 
+// submoduleTreeHash returns a hash of pkg and true if pkg is inside a
+// submodule at commit. It combines the commit the superproject records
+// for the submodule with the tree hash of pkg at that commit, computed
+// in the submodule's own repository.
+func (g git) submoduleTreeHash(pkg, commit string) (string, bool, error) {
+	for dir := filepath.Dir(pkg); dir != g.top && strings.HasPrefix(dir, g.top); dir = filepath.Dir(dir) {
+		out, err := g.commandStdout(os.Stderr, "ls-tree", "--full-tree", commit, "--", dir)
+		if err != nil {
+			return "", false, err
+		}
+		if out == "" {
+			continue
+		}
+		// <mode> <type> <object>\t<file>, the nearest parent in the
+		// tree must be the submodule for pkg to be inside it
+		fields := strings.Fields(out)
+		if len(fields) < 3 || fields[0] != gitlinkMode {
+			return "", false, nil
+		}
+		sub, err := g.initializedSubmodule(dir)
+		if err != nil {
+			return "", false, err
+		}
+		h, err := sub.treeHash(pkg, fields[2])
+		if err != nil {
+			return "", true, err
+		}
+		return fmt.Sprintf("%x", sha1.Sum([]byte(fields[2]+h))), true, nil
+	}
+	return "", false, nil
+}
+
+// submodule returns a git for the submodule checked out at dir
+func (g git) submodule(dir string) git {
+	return git{dir: dir, top: dir, fetchUnshallow: g.fetchUnshallow, hashWorkers: g.hashWorkers}
+}
+
+// initializedSubmodule is submodule, but fails if the submodule has not
+// been checked out, as git would otherwise run in the superproject
+func (g git) initializedSubmodule(dir string) (git, error) {
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err != nil {
+		return git{}, fmt.Errorf("submodule %s is not initialized, run 'git submodule update --init'", dir)
+	}
+	return g.submodule(dir), nil
+}
+
 func (g git) commitHash(commit string) (string, error) {
 	out, err := g.commandStdout(os.Stderr, "rev-parse", commit)
 	if err != nil {
@@ -133,10 +529,763 @@ func (g git) commitTag(commit string) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
+// commitBranch returns the name of the branch commit refers to, HEAD being
+// the branch checked out, or "" for a detached HEAD or a commit by hash
+func (g git) commitBranch(commit string) (string, error) {
+	out, err := g.commandStdout(nil, "rev-parse", "--abbrev-ref", commit)
+	if err != nil {
+		return "", err
+	}
+	branch := strings.TrimSpace(out)
+	if branch == "HEAD" {
+		return "", nil
+	}
+	return branch, nil
+}
+
+// commitRef returns the symbolic ref commit is built from: the tag of the
+// commit, the first of them by name if it has several, or otherwise its
+// branch, "" if it has neither
+func (g git) commitRef(commit string) (string, error) {
+	tags, err := g.commitTag(commit)
+	if err != nil {
+		return "", err
+	}
+	if tags != "" {
+		return strings.SplitN(tags, "\n", 2)[0], nil
+	}
+	return g.commitBranch(commit)
+}
+
+// remoteURL returns the URL of the remote of the branch checked out, or
+// of origin, or of the only remote, "" if the repository has no remote
+func (g git) remoteURL() (string, error) {
+	remotes, err := g.commandStdout(nil, "remote")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(remotes) == "" {
+		return "", nil
+	}
+	out, err := g.commandStdout(nil, "ls-remote", "--get-url")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// commitTime returns the committer date of commit
+func (g git) commitTime(commit string) (time.Time, error) {
+	out, err := g.commandStdout(nil, "show", "-s", "--format=%ct", commit)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse commit time %q: %v", out, err)
+	}
+	return time.Unix(ts, 0).UTC(), nil
+}
+
+// goPkgVersion returns a version for commit compliant with go module
+// versioning, based on the closest semver tag, lightweight or annotated:
+//
+//   - <tag> if commit is tagged
+//   - vX.Y.(Z+1)-0.<date>-<commit> if the closest tag is a release vX.Y.Z
+//   - vX.Y.Z-<pre>.0.<date>-<commit> if it is a pre-release vX.Y.Z-<pre>
+//   - v0.0.0-<date>-<commit> if there is no such tag
+//
+// Build metadata (+...) is not part of a go module version and is dropped.
+func (g git) goPkgVersion(commit string) (string, error) {
+	out, err := g.commandStdout(nil, "show", "-s", "--format=%ct %H", commit)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 || len(fields[1]) < 12 {
+		return "", fmt.Errorf("unexpected output from git show: %q", out)
+	}
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse commit time %q: %v", fields[0], err)
+	}
+	pseudo := time.Unix(ts, 0).UTC().Format("20060102150405") + "-" + fields[1][:12]
+
+	// <tag>-<commits since tag>-g<abbreviated commit>
+	out, err = g.commandStdout(nil, "describe", "--tags", "--long", "--match=v[0-9]*.[0-9]*.[0-9]*", commit)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// no matching tag in the history of commit
+			return "v0.0.0-" + pseudo, nil
+		}
+		return "", err
+	}
+	desc := strings.TrimSpace(out)
+	parts := strings.Split(desc, "-")
+	if len(parts) < 3 {
+		return "", fmt.Errorf("unexpected output from git describe: %q", desc)
+	}
+	tag := strings.Join(parts[:len(parts)-2], "-")
+	count := parts[len(parts)-2]
+
+	m := semverTagRe.FindStringSubmatch(tag)
+	if m == nil {
+		log.Debugf("closest tag %q is not a semver version, ignoring it", tag)
+		return "v0.0.0-" + pseudo, nil
+	}
+	major, minor, patch, pre := m[1], m[2], m[3], m[4]
+
+	if count == "0" {
+		return "v" + major + "." + minor + "." + patch + pre, nil
+	}
+	if pre != "" {
+		return "v" + major + "." + minor + "." + patch + pre + ".0." + pseudo, nil
+	}
+	p, err := strconv.Atoi(patch)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("v%s.%s.%d-0.%s", major, minor, p+1, pseudo), nil
+}
+
+// gitlinkMode is the mode git records for a submodule entry in the index
+const (
+	regularMode    = "100644"
+	executableMode = "100755"
+	symlinkMode    = "120000"
+	gitlinkMode    = "160000"
+)
+
+// contentHashCache memoizes content hashes for the lifetime of the
+// process. The key is a snapshot of the index entries under a package
+// and the stat information of their working tree files, so a tree which
+// has not changed since it was last hashed, whether clean or dirty, is
+// only read once however many packages share it.
+var contentHashCache = struct {
+	sync.Mutex
+	hashes map[string]string
+}{hashes: map[string]string{}}
+
+// contentHash returns a hash of the working tree contents of the files
+// git tracks under pkg, including the state of any submodules. Unlike
+// treeHash this reflects uncommitted changes, so it can distinguish
+// between different dirty states of the same package.
+func (g git) contentHash(pkg string) (string, error) {
+	if err := g.requireWorkTree("hashing the contents of " + pkg); err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	entries, err := g.hashedFiles(pkg)
+	if err != nil {
+		return "", err
+	}
+
+	key, cacheable := g.contentKey(pkg, entries, start)
+	if cacheable {
+		contentHashCache.Lock()
+		hash, ok := contentHashCache.hashes[key]
+		contentHashCache.Unlock()
+		if ok {
+			return hash, nil
+		}
+	}
+
+	hash, err := g.hashEntries(entries)
+	if err != nil {
+		return "", err
+	}
+
+	if cacheable {
+		contentHashCache.Lock()
+		contentHashCache.hashes[key] = hash
+		contentHashCache.Unlock()
+	}
+	return hash, nil
+}
+
+// contentKey returns the contentHashCache key for entries, deciding as
+// git does from the stat information whether a file may have changed.
+// It returns false when that cannot be told: for a submodule, whose own
+// files are not listed, and for a file modified so recently that a later
+// change could leave its mtime as it is.
+func (g git) contentKey(pkg string, entries []lsFilesEntry, start time.Time) (string, bool) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", g.top, pkg)
+	for _, e := range entries {
+		if e.mode == gitlinkMode {
+			return "", false
+		}
+		fmt.Fprintf(h, "%s\x00%s %s %t\x00", e.name, e.mode, e.object, e.skipWorktree)
+		if e.skipWorktree {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(g.top, e.name))
+		if err != nil {
+			fmt.Fprintf(h, "missing\x00")
+			continue
+		}
+		if !fi.ModTime().Before(start.Add(-time.Second)) {
+			return "", false
+		}
+		fmt.Fprintf(h, "%v %d %d\x00", fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), true
+}
+
+// lsFilesEntry is a single entry of `git ls-files -s -t` output, name is
+// relative to the top level of the work tree
+type lsFilesEntry struct {
+	mode   string
+	object string
+	name   string
+	// skipWorktree is set for entries sparse-checkout has not materialized
+	skipWorktree bool
+}
+
+func (g git) lsFiles(pkg string) ([]lsFilesEntry, error) {
+	out, err := g.commandStdout(nil, "ls-files", "-s", "-t", "-z", "--full-name", "--", pkg)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []lsFilesEntry
+	for _, entry := range strings.Split(out, "\x00") {
+		if entry == "" {
+			continue
+		}
+		// <tag> <mode> <object> <stage>\t<file>
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("Unable to parse ls-files output: %q", entry)
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Unable to parse ls-files output: %q", entry)
+		}
+		entries = append(entries, lsFilesEntry{
+			mode:         fields[1],
+			object:       fields[2],
+			name:         entry[tab+1:],
+			skipWorktree: fields[0] == "S",
+		})
+	}
+	return entries, nil
+}
+
+// linuxkitIgnore is the name of the files, in gitignore syntax, of the
+// patterns of the files under a package which are not hashed
+const linuxkitIgnore = ".linuxkitignore"
+
+// hashedFiles returns the entries lsFiles returns for pkg except those
+// its .linuxkitignore files match, as .gitignore files match untracked
+// files. Only a .linuxkitignore git tracks has any effect, and it is
+// itself always hashed, so changing the rules changes the hash.
+func (g git) hashedFiles(pkg string) ([]lsFilesEntry, error) {
+	entries, err := g.lsFiles(pkg)
+	if err != nil {
+		return nil, err
+	}
+	ignored, err := g.linuxkitIgnored(pkg, entries)
+	if err != nil || len(ignored) == 0 {
+		return entries, err
+	}
+	var hashed []lsFilesEntry
+	for _, e := range entries {
+		if !ignored[e.name] {
+			hashed = append(hashed, e)
+		}
+	}
+	return hashed, nil
+}
+
+// linuxkitIgnored returns the set of the names of entries, the tracked
+// files under pkg, the .linuxkitignore files among them match. The
+// common case of no .linuxkitignore costs nothing.
+func (g git) linuxkitIgnored(pkg string, entries []lsFilesEntry) (map[string]bool, error) {
+	found := false
+	for _, e := range entries {
+		if path.Base(e.name) == linuxkitIgnore {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	out, err := g.commandStdout(nil, "ls-files", "--cached", "--ignored", "--exclude-per-directory="+linuxkitIgnore, "-z", "--full-name", "--", pkg)
+	if err != nil {
+		return nil, err
+	}
+	ignored := map[string]bool{}
+	for _, name := range splitNul(out) {
+		if path.Base(name) != linuxkitIgnore {
+			ignored[name] = true
+		}
+	}
+	return ignored, nil
+}
+
+// hashContents combines the mode and a digest of each entry under pkg,
+// in sorted filename order, into a single digest. Regular files are
+// hashed by their contents and symlinks by their target, so changing
+// either or toggling the executable bit changes the result. The per
+// entry digests are computed concurrently by up to g.hashWorkers
+// goroutines, but the result does not depend on the order in which they
+// complete.
+func (g git) hashContents(pkg string) (string, error) {
+	entries, err := g.hashedFiles(pkg)
+	if err != nil {
+		return "", err
+	}
+	return g.hashEntries(entries)
+}
+
+// hashEntries is hashContents for the entries lsFiles returned
+func (g git) hashEntries(entries []lsFilesEntry) (string, error) {
+	var (
+		work   []lsFilesEntry
+		files  []string
+		sparse []lsFilesEntry
+	)
+	for _, e := range entries {
+		if e.mode == gitlinkMode {
+			work = append(work, e)
+			continue
+		}
+		if e.skipWorktree {
+			// not materialized by sparse-checkout, so hash it from
+			// the object store to get the same result as a full
+			// checkout rather than skipping it
+			switch e.mode {
+			case regularMode, executableMode, symlinkMode:
+			default:
+				log.Debugf("%s is not a regular file or symlink, skipping", e.name)
+				continue
+			}
+			work = append(work, e)
+			sparse = append(sparse, e)
+			continue
+		}
+		path := filepath.Join(g.top, e.name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			log.Debugf("cannot stat %s, skipping: %v", path, err)
+			continue
+		}
+		// use the mode of the working tree copy, like the contents,
+		// so a chmod is picked up before it is staged
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			e.mode = symlinkMode
+			work = append(work, e)
+		case fi.Mode().IsRegular():
+			e.mode = regularMode
+			if fi.Mode()&0111 != 0 {
+				e.mode = executableMode
+			}
+			work = append(work, e)
+			files = append(files, e.name)
+		default:
+			log.Debugf("%s is not a regular file or symlink, skipping", path)
+		}
+	}
+	sort.Slice(work, func(i, j int) bool { return work[i].name < work[j].name })
+
+	// files are relative to the top level, so query from there
+	known, err := git{dir: g.top, top: g.top}.indexedDigests(files, sparse)
+	if err != nil {
+		return "", err
+	}
+
+	workers := g.hashWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		digests = make([]string, len(work))
+		jobs    = make(chan int)
+	)
+	eg, ctx := errgroup.WithContext(context.Background())
+	eg.Go(func() error {
+		defer close(jobs)
+		for i := range work {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+	for w := 0; w < workers; w++ {
+		eg.Go(func() error {
+			for i := range jobs {
+				d, err := g.entryDigest(work[i], known)
+				if err != nil {
+					return err
+				}
+				digests[i] = d
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for i, e := range work {
+		fmt.Fprintf(h, "%s\x00%s %s\x00", e.name, e.mode, digests[i])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// entryDigest returns the digest of a single file or submodule, known
+// are digests which have already been determined by git, by filename
+func (g git) entryDigest(e lsFilesEntry, known map[string]string) (string, error) {
+	path := filepath.Join(g.top, e.name)
+
+	if e.mode == gitlinkMode {
+		return g.submoduleDigest(e.name, path, e.object)
+	}
+
+	if d, ok := known[e.name]; ok {
+		return d, nil
+	}
+
+	// the contents of a symlink, as git records it, is its target
+	if e.mode == symlinkMode {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(target))), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("unable to hash %s: %v", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// indexedDigests returns the digests of those entries which must be
+// determined by git rather than read from the working tree, by filename:
+//
+//   - files, which exist in the working tree, that have a clean/smudge
+//     filter configured via gitattributes (e.g. Git LFS). Their working
+//     tree copy depends on which filters are installed locally, so the
+//     canonical blob git would store for them is used instead.
+//   - sparse entries not materialized by sparse-checkout. Filtered ones
+//     use the blob recorded in the index, others the digest of its
+//     contents, matching what a full checkout would produce.
+//
+// In the common case of no attributes and no sparse-checkout this costs
+// only a single check-attr.
+func (g git) indexedDigests(files []string, sparse []lsFilesEntry) (map[string]string, error) {
+	digests := map[string]string{}
+
+	// filters do not apply to symlinks
+	names := append([]string{}, files...)
+	for _, e := range sparse {
+		if e.mode != symlinkMode {
+			names = append(names, e.name)
+		}
+	}
+	filtered, err := g.filterAttrs(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var toHash []string
+	for _, f := range files {
+		if filtered[f] {
+			toHash = append(toHash, f)
+		}
+	}
+	ids, err := g.hashObjects(toHash)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range toHash {
+		digests[f] = "blob " + ids[i]
+	}
+
+	var blobs []string
+	for _, e := range sparse {
+		if filtered[e.name] {
+			digests[e.name] = "blob " + e.object
+			continue
+		}
+		blobs = append(blobs, e.object)
+	}
+	contents, err := g.blobDigests(blobs)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range sparse {
+		if !filtered[e.name] {
+			digests[e.name] = contents[e.object]
+		}
+	}
+	return digests, nil
+}
+
+// filterAttrs returns the subset of files which have a filter attribute
+func (g git) filterAttrs(files []string) (map[string]bool, error) {
+	filtered := map[string]bool{}
+	if len(files) == 0 {
+		return filtered, nil
+	}
+
+	out, err := g.commandStdin(strings.Join(files, "\x00"), "check-attr", "-z", "--stdin", "filter")
+	if err != nil {
+		return nil, err
+	}
+
+	// <path> NUL <attribute> NUL <info> NUL
+	fields := strings.Split(out, "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		switch fields[i+2] {
+		case "unspecified", "unset":
+		default:
+			filtered[fields[i]] = true
+		}
+	}
+	return filtered, nil
+}
+
+// hashObjects returns the blob id git would record for each of files.
+// hash-object applies any clean filter, producing the blob that would
+// be committed regardless of the working tree form.
+func (g git) hashObjects(files []string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	out, err := g.commandStdin(strings.Join(files, "\n")+"\n", "hash-object", "--stdin-paths")
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(out)
+	if len(ids) != len(files) {
+		return nil, fmt.Errorf("unexpected output from git hash-object, got %d ids for %d paths", len(ids), len(files))
+	}
+	return ids, nil
+}
+
+// blobDigests returns the sha256 digest of the contents of each blob, by id
+func (g git) blobDigests(blobs []string) (map[string]string, error) {
+	digests := map[string]string{}
+	if len(blobs) == 0 {
+		return digests, nil
+	}
+
+	cmd := g.mkCmd("cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	log.Debugf("Executing: %v", cmd.Args)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, gitError(err)
+	}
+	fail := func(err error) (map[string]string, error) {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	r := bufio.NewReader(stdout)
+	for range blobs {
+		// <object> <type> <size> LF <contents> LF
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return fail(fmt.Errorf("unable to read git cat-file output: %v", err))
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return fail(fmt.Errorf("unexpected output from git cat-file: %q", header))
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fail(fmt.Errorf("unexpected output from git cat-file: %q", header))
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, size); err != nil {
+			return fail(fmt.Errorf("unable to read blob %s: %v", fields[0], err))
+		}
+		if _, err := r.Discard(1); err != nil {
+			return fail(fmt.Errorf("unable to read blob %s: %v", fields[0], err))
+		}
+		digests[fields[0]] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// submoduleDigest returns the digest of the submodule at path. An
+// initialized submodule contributes its checked out commit and the
+// contents of its own working tree, so local modifications and nested
+// submodules are taken into account. An uninitialized submodule has no
+// working tree and contributes the commit recorded in the index.
+func (g git) submoduleDigest(name, path, recorded string) (string, error) {
+	if _, err := os.Lstat(filepath.Join(path, ".git")); err != nil {
+		log.Debugf("submodule %s is not initialized, using recorded commit %s", name, recorded)
+		return "commit " + recorded, nil
+	}
+
+	sub := g.submodule(path)
+	commit, err := sub.commitHash("HEAD")
+	if err != nil {
+		return "", fmt.Errorf("unable to get commit of submodule %s: %v", name, err)
+	}
+	contents, err := sub.hashContents(path)
+	if err != nil {
+		return "", err
+	}
+	return "commit " + commit + " " + contents, nil
+}
+
+// archive returns a tar stream of the tree at commit for the directory
+// the git wrapper was created for, with paths relative to that directory
+func (g git) archive(commit string) (io.ReadCloser, error) {
+	if err := g.ensureCommit(commit); err != nil {
+		return nil, err
+	}
+
+	cmd := g.mkCmd("archive", "--format=tar", commit)
+	cmd.Stderr = os.Stderr
+	log.Debugf("Executing: %v", cmd.Args)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, gitError(err)
+	}
+	return &cmdReadCloser{ReadCloser: stdout, cmd: cmd}, nil
+}
+
+// cmdReadCloser waits for the command producing the stream on Close
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (c *cmdReadCloser) Close() error {
+	// drain anything left so the command is not blocked writing
+	_, _ = io.Copy(ioutil.Discard, c.ReadCloser)
+	return c.cmd.Wait()
+}
+
+// verifySignature checks that commit carries a valid GPG or SSH
+// signature. If commit names an annotated tag the tag's signature is
+// verified, otherwise that of the commit itself.
+func (g git) verifySignature(commit string) error {
+	verify := "verify-commit"
+	if _, err := g.commandStdout(nil, "rev-parse", "--verify", "--quiet", commit+"^{tag}"); err == nil {
+		verify = "verify-tag"
+	}
+
+	var stderr bytes.Buffer
+	if _, err := g.commandStdout(&stderr, verify, commit); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s does not have a valid signature: %s", commit, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
+
+// dirtyStatus describes why a package's working tree differs from a commit
+type dirtyStatus struct {
+	// modified are tracked files with uncommitted changes
+	modified []string
+	// untracked are files not known to git, which do not make a package
+	// dirty since they are not part of its tree hash
+	untracked []string
+}
+
+// dirty is true if there are changes to tracked files
+func (d dirtyStatus) dirty() bool {
+	return len(d.modified) > 0
+}
+
+func (d dirtyStatus) String() string {
+	var lines []string
+	for _, f := range d.modified {
+		lines = append(lines, "modified:  "+f)
+	}
+	for _, f := range d.untracked {
+		lines = append(lines, "untracked: "+f+" (not part of the hash)")
+	}
+	return strings.Join(lines, "\n")
+}
+
 func (g git) isDirty(pkg, commit string) (bool, error) {
+	modified, err := g.modifiedFiles(pkg, commit)
+	if err != nil {
+		return false, err
+	}
+	return len(modified) > 0, nil
+}
+
+// dirtyDetails returns the files under pkg which differ from commit,
+// paths are relative to the top level of the work tree
+func (g git) dirtyDetails(pkg, commit string) (dirtyStatus, error) {
+	var status dirtyStatus
+
+	modified, err := g.modifiedFiles(pkg, commit)
+	if err != nil || commit != "HEAD" {
+		return status, err
+	}
+	status.modified = modified
+
+	out, err := g.commandStdout(os.Stderr, "ls-files", "--others", "--exclude-standard", "--full-name", "-z", "--", pkg)
+	if err != nil {
+		return status, err
+	}
+	status.untracked = splitNul(out)
+
+	return status, nil
+}
+
+// modifiedFiles returns the tracked files under pkg which differ from
+// commit, paths are relative to the top level of the work tree
+func (g git) modifiedFiles(pkg, commit string) ([]string, error) {
+	if err := g.requireWorkTree("checking whether " + pkg + " is dirty"); err != nil {
+		return nil, err
+	}
+
 	// If it isn't HEAD it can't be dirty
 	if commit != "HEAD" {
-		return false, nil
+		return nil, nil
+	}
+
+	// A dry run must not write the index, but must still refresh it
+	// to give the same answer, so it refreshes a copy instead
+	if gitDryRun {
+		scratch, cleanup, err := g.scratchIndex()
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		g = scratch
 	}
 
 	// Update cache, otherwise files which have an updated
@@ -145,18 +1294,58 @@ func (g git) isDirty(pkg, commit string) (bool, error) {
 	// not the actual file contents. Running `git update-index
 	// --refresh` updates the cache.
 	if err := g.command("update-index", "-q", "--refresh"); err != nil {
-		return false, err
+		return nil, err
 	}
 
-	err := g.command("diff-index", "--quiet", commit, "--", pkg)
+	out, err := g.commandStdout(os.Stderr, "diff-index", "--name-only", "-z", commit, "--", pkg)
+	if err != nil {
+		return nil, err
+	}
+	return splitNul(out), nil
+}
+
+// scratchIndex returns a copy of g using a temporary copy of the
+// repository's index, and a function removing it
+func (g git) scratchIndex() (git, func(), error) {
+	out, err := g.commandStdout(nil, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return g, nil, err
+	}
+	index := strings.TrimSpace(out)
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(g.dir, index)
+	}
+
+	dir, err := ioutil.TempDir("", "linuxkit-index")
+	if err != nil {
+		return g, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	// a repository without an index has nothing staged, which a
+	// missing scratch index also means
+	g.indexFile = filepath.Join(dir, "index")
+	b, err := ioutil.ReadFile(index)
+	if err != nil && !os.IsNotExist(err) {
+		cleanup()
+		return g, nil, err
+	}
 	if err == nil {
-		return false, nil
+		if err := ioutil.WriteFile(g.indexFile, b, 0600); err != nil {
+			cleanup()
+			return g, nil, err
+		}
 	}
-	switch err.(type) {
-	case *exec.ExitError:
-		// diff-index exits with an error if there are differences
-		return true, nil
-	default:
-		return false, err
+	return g, cleanup, nil
+}
+
+// splitNul splits NUL terminated git output
+func splitNul(out string) []string {
+	var fields []string
+	for _, f := range strings.Split(out, "\x00") {
+		if f != "" {
+			fields = append(fields, f)
+		}
 	}
+	return fields
 }
@@ -0,0 +1,1024 @@
+package pkglib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testGitEnv isolates the test repositories from any user or system git configuration
+var testGitEnv = []string{
+	"GIT_CONFIG_NOSYSTEM=1",
+	"GIT_AUTHOR_NAME=test",
+	"GIT_AUTHOR_EMAIL=test@example.com",
+	"GIT_COMMITTER_NAME=test",
+	"GIT_COMMITTER_EMAIL=test@example.com",
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), testGitEnv...)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "git %v: %s", args, out)
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(path, []byte(content), 0644)
+	require.NoError(t, err)
+}
+
+// testRepo creates a git repository with a single pkg directory and
+// returns its path. The repository has two commits.
+func testRepo(t *testing.T, tmpDir string) string {
+	repo := filepath.Join(tmpDir, "repo")
+	err := os.MkdirAll(repo, 0755)
+	require.NoError(t, err)
+
+	runGit(t, repo, "init", "-q")
+	writeFile(t, filepath.Join(repo, "pkg", "build.yml"), "image: dummy\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "first")
+	writeFile(t, filepath.Join(repo, "pkg", "Dockerfile"), "FROM scratch\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "second")
+
+	return repo
+}
+
+func testTmpDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "pkglib-git")
+	require.NoError(t, err)
+	// resolve any symlinks so paths compare equal to those reported by git
+	tmpDir, err = filepath.EvalSymlinks(tmpDir)
+	require.NoError(t, err)
+	return tmpDir
+}
+
+func TestTreeHashShallow(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	full, err := newGit(repo)
+	require.NoError(t, err)
+	want, err := full.treeHash(filepath.Join(repo, "pkg"), "HEAD~1")
+	require.NoError(t, err)
+
+	clone := filepath.Join(tmpDir, "clone")
+	runGit(t, tmpDir, "clone", "-q", "--depth", "1", "file://"+repo, clone)
+
+	g, err := newGit(clone)
+	require.NoError(t, err)
+	shallow, err := g.isShallow()
+	require.NoError(t, err)
+	assert.True(t, shallow)
+
+	// HEAD is always available in a shallow clone
+	_, err = g.treeHash(filepath.Join(clone, "pkg"), "HEAD")
+	require.NoError(t, err)
+
+	_, err = g.treeHash(filepath.Join(clone, "pkg"), "HEAD~1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "shallow clone")
+
+	g.fetchUnshallow = true
+	got, err := g.treeHash(filepath.Join(clone, "pkg"), "HEAD~1")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+func TestContentHashSubmodule(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	sub := testRepo(t, filepath.Join(tmpDir, "sub"))
+	repo := testRepo(t, tmpDir)
+	runGit(t, repo, "-c", "protocol.file.allow=always", "submodule", "add", "-q", "file://"+sub, "pkg/vendor")
+	runGit(t, repo, "commit", "-q", "-m", "add submodule")
+
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	pkg := filepath.Join(repo, "pkg")
+
+	clean, err := g.contentHash(pkg)
+	require.NoError(t, err)
+
+	// local modifications within the submodule
+	writeFile(t, filepath.Join(pkg, "vendor", "pkg", "build.yml"), "image: modified\n")
+	modified, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, clean, modified)
+	runGit(t, filepath.Join(pkg, "vendor"), "checkout", "-q", "--", ".")
+
+	again, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.Equal(t, clean, again)
+
+	// a different commit checked out in the submodule
+	runGit(t, filepath.Join(pkg, "vendor"), "checkout", "-q", "HEAD~1")
+	moved, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, clean, moved)
+
+	// an uninitialized submodule falls back to the recorded commit
+	clone := filepath.Join(tmpDir, "clone")
+	runGit(t, tmpDir, "clone", "-q", "file://"+repo, clone)
+	cg, err := newGit(clone)
+	require.NoError(t, err)
+	_, err = cg.contentHash(filepath.Join(clone, "pkg"))
+	require.NoError(t, err)
+}
+
+func TestContentHashLinuxKitIgnore(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	pkg := filepath.Join(repo, "pkg")
+	writeFile(t, filepath.Join(pkg, "generated.txt"), "generated\n")
+	writeFile(t, filepath.Join(pkg, "out", "artifact"), "artifact\n")
+	writeFile(t, filepath.Join(pkg, "out", "keep"), "keep\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "generated files")
+
+	g, err := newGit(repo)
+	require.NoError(t, err)
+
+	// without a .linuxkitignore every tracked file is hashed
+	before, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(pkg, "generated.txt"), "regenerated\n")
+	changed, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, changed)
+	runGit(t, repo, "checkout", "-q", "--", ".")
+
+	writeFile(t, filepath.Join(pkg, ".linuxkitignore"), "*.txt\nout/*\n!out/keep\n.linuxkitignore\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "ignore generated files")
+	ignoring, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, before, ignoring, "the .linuxkitignore is hashed")
+
+	// changes to the ignored files do not change the hash, but they
+	// are in the build context, so they still make the package dirty
+	writeFile(t, filepath.Join(pkg, "generated.txt"), "regenerated\n")
+	writeFile(t, filepath.Join(pkg, "out", "artifact"), "rebuilt\n")
+	got, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.Equal(t, ignoring, got)
+	status, err := g.dirtyDetails(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg/generated.txt", "pkg/out/artifact"}, status.modified)
+	tag := func() string {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), pkg)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		return pkgs[0].Hash()
+	}
+	dirty := tag()
+	assert.Regexp(t, "-dirty$", dirty)
+	writeFile(t, filepath.Join(pkg, "generated.txt"), "regenerated again\n")
+	assert.Equal(t, dirty, tag())
+	runGit(t, repo, "checkout", "-q", "--", ".")
+
+	// a file negated back in still is hashed
+	writeFile(t, filepath.Join(pkg, "out", "keep"), "changed\n")
+	got, err = g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, ignoring, got)
+	status, err = g.dirtyDetails(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"pkg/out/keep"}, status.modified)
+	runGit(t, repo, "checkout", "-q", "--", "pkg/out/keep")
+
+	// changing the rules changes the hash, even to ignore nothing more
+	writeFile(t, filepath.Join(pkg, ".linuxkitignore"), "*.txt\nout/*\n!out/keep\n.linuxkitignore\n# generated\n")
+	got, err = g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, ignoring, got)
+}
+
+func TestContentHashFilters(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	rot13 := "tr a-z n-za-m"
+	repo := testRepo(t, tmpDir)
+	writeFile(t, filepath.Join(repo, ".gitattributes"), "*.bin filter=rot13\n")
+	writeFile(t, filepath.Join(repo, "pkg", "data.bin"), "uryyb\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "add filtered file")
+
+	// one clone with the filter installed, which smudges the working
+	// tree copy, and one without it
+	filteredClone := filepath.Join(tmpDir, "filtered")
+	runGit(t, tmpDir, "clone", "-q", "-c", "filter.rot13.clean="+rot13, "-c", "filter.rot13.smudge="+rot13, "file://"+repo, filteredClone)
+	plainClone := filepath.Join(tmpDir, "plain")
+	runGit(t, tmpDir, "clone", "-q", "file://"+repo, plainClone)
+
+	b, err := ioutil.ReadFile(filepath.Join(filteredClone, "pkg", "data.bin"))
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", string(b))
+
+	fg, err := newGit(filteredClone)
+	require.NoError(t, err)
+	filteredHash, err := fg.contentHash(filepath.Join(filteredClone, "pkg"))
+	require.NoError(t, err)
+
+	pg, err := newGit(plainClone)
+	require.NoError(t, err)
+	plainHash, err := pg.contentHash(filepath.Join(plainClone, "pkg"))
+	require.NoError(t, err)
+
+	assert.Equal(t, plainHash, filteredHash)
+
+	// changes to the filtered file are still detected
+	writeFile(t, filepath.Join(filteredClone, "pkg", "data.bin"), "goodbye\n")
+	changedHash, err := fg.contentHash(filepath.Join(filteredClone, "pkg"))
+	require.NoError(t, err)
+	assert.NotEqual(t, filteredHash, changedHash)
+}
+
+func TestVerifySignature(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+
+	err = g.verifySignature("HEAD")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "HEAD does not have a valid signature")
+
+	key := filepath.Join(tmpDir, "key")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", key).CombinedOutput()
+	require.NoError(t, err, "ssh-keygen: %s", out)
+	pub, err := ioutil.ReadFile(key + ".pub")
+	require.NoError(t, err)
+	writeFile(t, filepath.Join(tmpDir, "allowed_signers"), "test@example.com "+string(pub))
+
+	runGit(t, repo, "config", "gpg.format", "ssh")
+	runGit(t, repo, "config", "user.signingkey", key)
+	runGit(t, repo, "config", "gpg.ssh.allowedSignersFile", filepath.Join(tmpDir, "allowed_signers"))
+
+	runGit(t, repo, "commit", "-q", "-S", "--allow-empty", "-m", "signed")
+	require.NoError(t, g.verifySignature("HEAD"))
+
+	// a lightweight tag is verified by the commit it points at
+	runGit(t, repo, "tag", "v1.0.0")
+	require.NoError(t, g.verifySignature("v1.0.0"))
+
+	// an annotated tag must be signed itself
+	runGit(t, repo, "tag", "-a", "-m", "unsigned", "v1.0.1")
+	err = g.verifySignature("v1.0.1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "v1.0.1 does not have a valid signature")
+
+	runGit(t, repo, "tag", "-s", "-m", "signed", "v1.0.2")
+	require.NoError(t, g.verifySignature("v1.0.2"))
+}
+
+func TestContentHashCache(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	pkg := filepath.Join(repo, "pkg")
+	dockerfile := filepath.Join(pkg, "Dockerfile")
+	past := time.Now().Add(-time.Hour)
+	backdate := func() {
+		for _, f := range []string{dockerfile, filepath.Join(pkg, "build.yml")} {
+			require.NoError(t, os.Chtimes(f, past, past))
+		}
+	}
+
+	writeFile(t, dockerfile, "FROM alpine\n")
+	backdate()
+	dirty, err := g.contentHash(pkg)
+	require.NoError(t, err)
+
+	// the same dirty state is served from the cache, which trusts the
+	// stat information as git does: contents of the same size and mtime
+	// are not read again
+	writeFile(t, dockerfile, "FROM ubuntu\n")
+	backdate()
+	again, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.Equal(t, dirty, again)
+
+	// a change to the contents is picked up through the stat information
+	past = past.Add(time.Second)
+	writeFile(t, dockerfile, "FROM busybox\n")
+	backdate()
+	changed, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, dirty, changed)
+
+	// files modified in the last second are always hashed
+	writeFile(t, dockerfile, "FROM alpine\n")
+	h, err := g.contentHash(pkg)
+	require.NoError(t, err)
+	writeFile(t, dockerfile, "FROM ubuntu\n")
+	again, err = g.contentHash(pkg)
+	require.NoError(t, err)
+	assert.NotEqual(t, h, again)
+}
+
+// benchTime is the mtime of the benchmark files, old enough for
+// contentHash to trust their stat information
+var benchTime = time.Now().Add(-time.Hour)
+
+// benchRepo creates a repository with n files under pkg and returns a git wrapper for it
+func benchRepo(b *testing.B, tmpDir string, n int) *git {
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", tmpDir}, args...)...)
+		cmd.Env = append(os.Environ(), testGitEnv...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			b.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	git("init", "-q")
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(tmpDir, "pkg", fmt.Sprintf("%02d", i%50))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(path, bytes.Repeat([]byte{byte(i)}, 4096), 0644); err != nil {
+			b.Fatal(err)
+		}
+		if err := os.Chtimes(path, benchTime, benchTime); err != nil {
+			b.Fatal(err)
+		}
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "files")
+
+	g, err := newGit(tmpDir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return g
+}
+
+func BenchmarkContentHash(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "pkglib-git")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	g := benchRepo(b, tmpDir, 5000)
+	pkg := filepath.Join(tmpDir, "pkg")
+
+	// builds only hash the contents of dirty packages
+	dirty := filepath.Join(pkg, "00", "file0")
+	if err := ioutil.WriteFile(dirty, []byte("modified"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.Chtimes(dirty, benchTime, benchTime); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			contentHashCache.Lock()
+			contentHashCache.hashes = map[string]string{}
+			contentHashCache.Unlock()
+			if _, err := g.contentHash(pkg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := g.contentHash(pkg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkHashContents(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "pkglib-git")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	g := benchRepo(b, tmpDir, 5000)
+	pkg := filepath.Join(tmpDir, "pkg")
+
+	for _, bm := range []struct {
+		name    string
+		workers int
+	}{
+		{"Sequential", 1},
+		{"Parallel", runtime.GOMAXPROCS(0)},
+	} {
+		g.hashWorkers = bm.workers
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := g.hashContents(pkg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// referenceHashContents is a straightforward sequential implementation of
+// hashContents for a tree of regular files without filters or submodules
+func referenceHashContents(t *testing.T, top string, names []string) string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, name := range sorted {
+		b, err := ioutil.ReadFile(filepath.Join(top, name))
+		require.NoError(t, err)
+		fmt.Fprintf(h, "%s\x00100644 %x\x00", name, sha256.Sum256(b))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func TestHashContentsParallel(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := filepath.Join(tmpDir, "repo")
+	runGit(t, tmpDir, "init", "-q", repo)
+	var names []string
+	for i := 0; i < 200; i++ {
+		// names which sort differently as strings and numbers
+		name := fmt.Sprintf("pkg/dir%d/file%d", i%7, i)
+		writeFile(t, filepath.Join(repo, name), strings.Repeat(name, i))
+		names = append(names, name)
+	}
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "files")
+
+	g, err := newGit(repo)
+	require.NoError(t, err)
+
+	want := referenceHashContents(t, repo, names)
+	for _, workers := range []int{1, 2, 7, 64} {
+		g.hashWorkers = workers
+		got, err := g.hashContents(filepath.Join(repo, "pkg"))
+		require.NoError(t, err)
+		assert.Equal(t, want, got, "with %d workers", workers)
+	}
+}
+
+func TestContentHashWorktree(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	worktree := filepath.Join(tmpDir, "worktree")
+	runGit(t, repo, "worktree", "add", "-q", "--detach", worktree)
+
+	hash := func(dir string) string {
+		// use the pkg subdirectory so paths relative to it differ from those relative to the top level
+		g, err := newGit(filepath.Join(dir, "pkg"))
+		require.NoError(t, err)
+		assert.Equal(t, dir, g.top)
+		h, err := g.contentHash(filepath.Join(dir, "pkg"))
+		require.NoError(t, err)
+		return h
+	}
+
+	main := hash(repo)
+	linked := hash(worktree)
+	assert.Equal(t, main, linked)
+
+	// the files are really being hashed in the linked worktree
+	writeFile(t, filepath.Join(worktree, "pkg", "Dockerfile"), "FROM alpine\n")
+	assert.NotEqual(t, main, hash(worktree))
+}
+
+func TestGoPkgVersion(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := filepath.Join(tmpDir, "repo")
+	runGit(t, tmpDir, "init", "-q", repo)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+
+	commit := func(msg string) string {
+		runGit(t, repo, "commit", "-q", "--allow-empty", "-m", msg)
+		out := strings.Fields(runGit(t, repo, "show", "-s", "--format=%ct %H"))
+		ts, err := strconv.ParseInt(out[0], 10, 64)
+		require.NoError(t, err)
+		return time.Unix(ts, 0).UTC().Format("20060102150405") + "-" + out[1][:12]
+	}
+	check := func(want string) {
+		got, err := g.goPkgVersion("HEAD")
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	pseudo := commit("untagged")
+	check("v0.0.0-" + pseudo)
+
+	// tags which are not versions are ignored
+	runGit(t, repo, "tag", "v1.2")
+	check("v0.0.0-" + pseudo)
+
+	commit("first release")
+	runGit(t, repo, "tag", "v0.1.0")
+	check("v0.1.0")
+
+	commit("annotated release")
+	runGit(t, repo, "tag", "-a", "-m", "annotated", "v1.10.2")
+	check("v1.10.2")
+
+	pseudo = commit("after release")
+	check("v1.10.3-0." + pseudo)
+
+	commit("release candidate")
+	runGit(t, repo, "tag", "v2.0.0-rc1")
+	check("v2.0.0-rc1")
+
+	pseudo = commit("after release candidate")
+	check("v2.0.0-rc1.0." + pseudo)
+
+	commit("build metadata")
+	runGit(t, repo, "tag", "v2.0.0+build.5")
+	check("v2.0.0")
+
+	pseudo = commit("after build metadata")
+	check("v2.0.1-0." + pseudo)
+}
+
+func TestCommitRef(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	check := func(commit, wantBranch, wantRef string) {
+		branch, err := g.commitBranch(commit)
+		require.NoError(t, err)
+		assert.Equal(t, wantBranch, branch, "branch of %s", commit)
+		ref, err := g.commitRef(commit)
+		require.NoError(t, err)
+		assert.Equal(t, wantRef, ref, "ref of %s", commit)
+	}
+
+	runGit(t, repo, "checkout", "-q", "-b", "feature")
+	check("HEAD", "feature", "feature")
+	check("feature", "feature", "feature")
+
+	// a tag takes precedence over the branch
+	runGit(t, repo, "tag", "v1.0.0")
+	runGit(t, repo, "tag", "-a", "-m", "annotated", "v1.0.1")
+	check("HEAD", "feature", "v1.0.0")
+
+	// a detached HEAD has no branch
+	runGit(t, repo, "checkout", "-q", "--detach", "HEAD~1")
+	check("HEAD", "", "")
+	head := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	check(head, "", "")
+	runGit(t, repo, "tag", "v0.9.0")
+	check("HEAD", "", "v0.9.0")
+}
+
+func TestDirtyDetails(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	pkg := filepath.Join(repo, "pkg")
+
+	status, err := g.dirtyDetails(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.False(t, status.dirty())
+	assert.Empty(t, status.modified)
+	assert.Empty(t, status.untracked)
+
+	// untracked files are reported but do not make the package dirty
+	writeFile(t, filepath.Join(pkg, "new"), "new\n")
+	writeFile(t, filepath.Join(repo, "outside"), "outside\n")
+	status, err = g.dirtyDetails(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.False(t, status.dirty())
+	assert.Equal(t, []string{"pkg/new"}, status.untracked)
+
+	writeFile(t, filepath.Join(pkg, "Dockerfile"), "FROM alpine\n")
+	status, err = g.dirtyDetails(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.True(t, status.dirty())
+	assert.Equal(t, []string{"pkg/Dockerfile"}, status.modified)
+	assert.Equal(t, "modified:  pkg/Dockerfile\nuntracked: pkg/new (not part of the hash)", status.String())
+
+	dirty, err := g.isDirty(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.True(t, dirty)
+
+	// only HEAD can be dirty
+	status, err = g.dirtyDetails(pkg, "HEAD~1")
+	require.NoError(t, err)
+	assert.False(t, status.dirty())
+}
+
+func TestDirtyTag(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	pkg := filepath.Join(repo, "pkg")
+	tag := func(args ...string) string {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), append(args, pkg)...)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		return pkgs[0].Hash()
+	}
+	clean := tag()
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD:pkg"), clean)
+	// a clean tree forced dirty is tagged by its tree hash
+	assert.Equal(t, clean+"-dirty", tag("-force-dirty"))
+
+	writeFile(t, filepath.Join(pkg, "Dockerfile"), "FROM alpine\n")
+	dirty := tag()
+	assert.Regexp(t, "^[0-9a-f]{40}-dirty$", dirty)
+	assert.NotEqual(t, clean+"-dirty", dirty)
+	assert.Equal(t, dirty, tag())
+
+	// another change gets another tag, and undoing it the first again
+	writeFile(t, filepath.Join(pkg, "Dockerfile"), "FROM busybox\n")
+	other := tag()
+	assert.Regexp(t, "^[0-9a-f]{40}-dirty$", other)
+	assert.NotEqual(t, dirty, other)
+	writeFile(t, filepath.Join(pkg, "Dockerfile"), "FROM alpine\n")
+	assert.Equal(t, dirty, tag())
+
+	// -hash is used as it is
+	assert.Equal(t, "foo", tag("-hash=foo"))
+}
+
+func TestGitPathAndEnv(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	defer func() {
+		gitPath = "git"
+		gitEnv = nil
+	}()
+
+	repo := testRepo(t, tmpDir)
+	log := filepath.Join(tmpDir, "log")
+	wrapper := filepath.Join(tmpDir, "git-wrapper")
+	err := ioutil.WriteFile(wrapper, []byte("#!/bin/sh\necho \"$LINUXKIT_TEST_VAR $1 $2\" >> "+log+"\nexec git \"$@\"\n"), 0755)
+	require.NoError(t, err)
+
+	flags := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	pkgs, err := NewFromCLI(flags, "-git-path="+wrapper, "-git-env=LINUXKIT_TEST_VAR=hello", filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+
+	b, err := ioutil.ReadFile(log)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.NotEmpty(t, lines)
+	for _, l := range lines {
+		assert.True(t, strings.HasPrefix(l, "hello -C "), "unexpected invocation %q", l)
+	}
+
+	_, err = NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-git-env=NOVALUE", filepath.Join(repo, "pkg"))
+	require.Error(t, err)
+}
+
+func TestGitNotFound(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", tmpDir)
+
+	_, err := newGit(tmpDir)
+	require.Error(t, err)
+	assert.Equal(t, "git executable not found in PATH; install git or set -git-path", err.Error())
+
+	defer func() { gitPath = "git" }()
+	gitPath = filepath.Join(tmpDir, "no-such-git")
+	_, err = newGit(tmpDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no-such-git not found")
+}
+
+func TestHashContentsSparse(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	pkg := filepath.Join(repo, "pkg")
+
+	full, err := g.hashContents(pkg)
+	require.NoError(t, err)
+
+	runGit(t, repo, "sparse-checkout", "set", "--no-cone", "/*", "!/pkg/Dockerfile")
+	_, err = os.Stat(filepath.Join(pkg, "Dockerfile"))
+	require.True(t, os.IsNotExist(err), "Dockerfile should not be checked out")
+
+	sparse, err := g.hashContents(pkg)
+	require.NoError(t, err)
+	assert.Equal(t, full, sparse)
+}
+
+// stubRunner answers git commands from out, by their final argument,
+// recording the argv
+type stubRunner struct {
+	out  map[string]string
+	args [][]string
+}
+
+func (r *stubRunner) Command(env []string, args ...string) *exec.Cmd {
+	r.args = append(r.args, args)
+	return exec.Command("echo", r.out[args[len(args)-1]])
+}
+
+func TestGitRunner(t *testing.T) {
+	defer func() { gitRunner = execRunner{} }()
+
+	r := &stubRunner{out: map[string]string{
+		"--is-inside-work-tree": "true",
+		"--show-toplevel":       "/not/a/repo",
+	}}
+	gitRunner = r
+	g, err := newGit("/not/a/repo/pkg")
+	require.NoError(t, err)
+	require.NotNil(t, g)
+	assert.Equal(t, "/not/a/repo", g.top)
+	require.Len(t, r.args, 2)
+	assert.Equal(t, []string{"-C", "/not/a/repo/pkg", "rev-parse", "--show-toplevel"}, r.args[1])
+}
+
+func TestGitDryRun(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	defer func() {
+		gitRunner = execRunner{}
+		gitDryRun = false
+	}()
+
+	repo := testRepo(t, tmpDir)
+	g, err := newGit(repo)
+	require.NoError(t, err)
+
+	var trace bytes.Buffer
+	// only the timestamp changes, which a refresh tells apart from a
+	// modification
+	dockerfile := filepath.Join(repo, "pkg", "Dockerfile")
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(dockerfile, future, future))
+	index := filepath.Join(repo, ".git", "index")
+	before, err := ioutil.ReadFile(index)
+	require.NoError(t, err)
+
+	gitRunner = recordingRunner{w: &trace}
+	gitDryRun = true
+	status, err := g.dirtyDetails(filepath.Join(repo, "pkg"), "HEAD")
+	require.NoError(t, err)
+	assert.False(t, status.dirty(), "%s", status)
+
+	after, err := ioutil.ReadFile(index)
+	require.NoError(t, err)
+	assert.Equal(t, before, after, "the index should not be written")
+
+	out := trace.String()
+	assert.Regexp(t, "\\+ GIT_INDEX_FILE=[^ ]+ git -C "+regexp.QuoteMeta(repo)+" update-index -q --refresh\n", out)
+	assert.NotContains(t, out, "not executed")
+	assert.Contains(t, out, " git -C "+repo+" diff-index --name-only -z HEAD -- "+filepath.Join(repo, "pkg")+"\n")
+}
+
+func TestHashContentsModes(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	repo := testRepo(t, tmpDir)
+	pkg := filepath.Join(repo, "pkg")
+	writeFile(t, filepath.Join(pkg, "run.sh"), "#!/bin/sh\n")
+	require.NoError(t, os.Symlink("Dockerfile", filepath.Join(pkg, "link")))
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "script and link")
+
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	hash := func() string {
+		h, err := g.hashContents(pkg)
+		require.NoError(t, err)
+		return h
+	}
+	orig := hash()
+
+	require.NoError(t, os.Chmod(filepath.Join(pkg, "run.sh"), 0755))
+	assert.NotEqual(t, orig, hash(), "executable bit should change the hash")
+	require.NoError(t, os.Chmod(filepath.Join(pkg, "run.sh"), 0644))
+	assert.Equal(t, orig, hash())
+
+	require.NoError(t, os.Remove(filepath.Join(pkg, "link")))
+	require.NoError(t, os.Symlink("build.yml", filepath.Join(pkg, "link")))
+	assert.NotEqual(t, orig, hash(), "symlink target should change the hash")
+
+	// a sparse symlink is hashed the same as a materialized one
+	require.NoError(t, os.Remove(filepath.Join(pkg, "link")))
+	require.NoError(t, os.Symlink("Dockerfile", filepath.Join(pkg, "link")))
+	// sparse-checkout leaves entries whose stat info is stale in place
+	runGit(t, repo, "update-index", "-q", "--refresh")
+	runGit(t, repo, "sparse-checkout", "set", "--no-cone", "/*", "!/pkg/link")
+	_, err = os.Lstat(filepath.Join(pkg, "link"))
+	require.True(t, os.IsNotExist(err), "link should not be checked out")
+	assert.Equal(t, orig, hash())
+}
+
+func TestTreeHashSubmodule(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	sub := testRepo(t, filepath.Join(tmpDir, "sub"))
+	repo := testRepo(t, tmpDir)
+	runGit(t, repo, "-c", "protocol.file.allow=always", "submodule", "add", "-q", "file://"+sub, "vendor/sub")
+	runGit(t, repo, "commit", "-q", "-m", "add submodule")
+
+	checkout := filepath.Join(repo, "vendor", "sub")
+	pkg := filepath.Join(checkout, "pkg")
+	// the recorded submodule commit and the tree of pkg within it
+	expected := func(rev string) string {
+		commit := strings.TrimSpace(runGit(t, checkout, "rev-parse", rev))
+		tree := strings.TrimSpace(runGit(t, checkout, "rev-parse", rev+":pkg"))
+		return fmt.Sprintf("%x", sha1.Sum([]byte(commit+tree)))
+	}
+	gitlink := func(dir, rev string) string {
+		return strings.TrimSpace(runGit(t, dir, "rev-parse", rev+":vendor/sub"))
+	}
+
+	g, err := newGit(repo)
+	require.NoError(t, err)
+	h, err := g.treeHash(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, expected("HEAD"), h)
+
+	// the submodule itself is hashed by the commit it is at
+	h, err = g.treeHash(checkout, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, gitlink(repo, "HEAD"), h)
+
+	// the hash follows the commit the superproject records, not the checkout
+	orig := strings.TrimSpace(runGit(t, checkout, "rev-parse", "HEAD"))
+	prev := strings.TrimSpace(runGit(t, checkout, "rev-parse", "HEAD~1"))
+	runGit(t, checkout, "checkout", "-q", prev)
+	runGit(t, repo, "commit", "-q", "-a", "-m", "move submodule back")
+	runGit(t, checkout, "checkout", "-q", orig)
+	h, err = g.treeHash(pkg, "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, expected(prev), h)
+	h, err = g.treeHash(pkg, "HEAD~1")
+	require.NoError(t, err)
+	assert.Equal(t, expected(orig), h)
+
+	// missing from the submodule at that commit
+	_, err = g.treeHash(filepath.Join(checkout, "missing"), "HEAD")
+	assert.EqualError(t, err, "Package "+filepath.Join(checkout, "missing")+" is not in git")
+
+	// not checked out
+	clone := filepath.Join(tmpDir, "clone")
+	runGit(t, tmpDir, "clone", "-q", "file://"+repo, clone)
+	cg, err := newGit(clone)
+	require.NoError(t, err)
+	_, err = cg.treeHash(filepath.Join(clone, "vendor", "sub", "pkg"), "HEAD")
+	assert.EqualError(t, err, "submodule "+filepath.Join(clone, "vendor", "sub")+" is not initialized, run 'git submodule update --init'")
+	// which does not matter when it is the package
+	h, err = cg.treeHash(filepath.Join(clone, "vendor", "sub"), "HEAD")
+	require.NoError(t, err)
+	assert.Equal(t, gitlink(clone, "HEAD"), h)
+}
+
+func TestNewGitCache(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	defer func() { gitRunner = execRunner{} }()
+
+	repo := testRepo(t, tmpDir)
+	var pkgs []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		pkg := filepath.Join(repo, "pkgs", name)
+		writeFile(t, filepath.Join(pkg, "build.yml"), "image: "+name+"\n")
+		pkgs = append(pkgs, pkg)
+	}
+	// an unrelated repository nested inside the first
+	nested := testRepo(t, filepath.Join(repo, "nested"))
+
+	var trace bytes.Buffer
+	gitRunner = recordingRunner{w: &trace}
+	for _, pkg := range pkgs {
+		g, err := newGit(pkg)
+		require.NoError(t, err)
+		require.NotNil(t, g)
+		assert.Equal(t, repo, g.top)
+	}
+	assert.Equal(t, 1, strings.Count(trace.String(), "--is-inside-work-tree"))
+
+	for i := 0; i < 2; i++ {
+		g, err := newGit(filepath.Join(nested, "pkg"))
+		require.NoError(t, err)
+		require.NotNil(t, g)
+		assert.Equal(t, nested, g.top)
+	}
+	assert.Equal(t, 2, strings.Count(trace.String(), "--is-inside-work-tree"))
+}
+
+func TestBareRepo(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	defer func() { gitEnv = nil }()
+
+	repo := testRepo(t, tmpDir)
+	mirror := filepath.Join(tmpDir, "mirror.git")
+	runGit(t, tmpDir, "clone", "-q", "--bare", repo, mirror)
+
+	// a CI checkout exported from the mirror, with no work tree of its own
+	export := filepath.Join(tmpDir, "export")
+	pkg := filepath.Join(export, "pkg")
+	writeFile(t, filepath.Join(pkg, "build.yml"), "image: dummy\n")
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(cwd)
+	require.NoError(t, os.Chdir(export))
+
+	gitEnv = []string{"GIT_DIR=" + mirror}
+	g, err := newGit(pkg)
+	require.NoError(t, err)
+	require.NotNil(t, g)
+	assert.True(t, g.bare)
+	assert.Equal(t, export, g.top)
+
+	head := runGit(t, repo, "rev-parse", "HEAD")
+	tree, err := g.treeHash(pkg, head)
+	require.NoError(t, err)
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD:pkg"), tree)
+	tree, err = g.treeHash(export, head)
+	require.NoError(t, err)
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD^{tree}"), tree)
+	_, err = g.treeHash(filepath.Join(export, "missing"), head)
+	assert.Error(t, err)
+	_, err = g.treeHash(tmpDir, head)
+	assert.Error(t, err)
+
+	commit, err := g.commitHash("HEAD~1")
+	require.NoError(t, err)
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD~1"), commit)
+
+	_, err = g.contentHash(pkg)
+	assert.EqualError(t, err, "hashing the contents of "+pkg+" needs a work tree, but "+pkg+" is in a bare repository, specify a commit with -hash-commit instead")
+	_, err = g.isDirty(pkg, "HEAD")
+	assert.Error(t, err)
+	gitEnv = nil
+
+	// the bare repository itself
+	g, err = newGit(mirror)
+	require.NoError(t, err)
+	require.NotNil(t, g)
+	assert.True(t, g.bare)
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-git-env=GIT_DIR="+mirror, "-hash-commit="+head, pkg)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD:pkg"), pkgs[0].Hash())
+	assert.False(t, pkgs[0].dirty)
+
+	_, err = NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-git-env=GIT_DIR="+mirror, pkg)
+	assert.Error(t, err)
+}
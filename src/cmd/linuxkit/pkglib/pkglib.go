@@ -8,7 +8,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -22,10 +24,11 @@ type pkgInfo struct {
 	Org          string            `yaml:"org"`
 	Arches       []string          `yaml:"arches"`
 	ExtraSources []string          `yaml:"extra-sources"`
-	GitRepo      string            `yaml:"gitrepo"` // ??
+	GitRepo      string            `yaml:"gitrepo"` // defaults to the git remote
 	Network      bool              `yaml:"network"`
 	DisableCache bool              `yaml:"disable-cache"`
 	Config       *moby.ImageConfig `yaml:"config"`
+	BuildArgs    []string          `yaml:"build-args"`
 	Depends      struct {
 		DockerImages struct {
 			TargetDir string   `yaml:"target-dir"`
@@ -33,6 +36,7 @@ type pkgInfo struct {
 			FromFile  string   `yaml:"from-file"`
 			List      []string `yaml:"list"`
 		} `yaml:"docker-images"`
+		Packages []string `yaml:"packages"`
 	} `yaml:"depends"`
 }
 
@@ -40,6 +44,10 @@ type pkgInfo struct {
 type pkgSource struct {
 	src string
 	dst string
+	// git is used to read the source at a commit other than HEAD, nil if src is not in git
+	git *git
+	// tar is set when src is a tarball of the source rather than a directory
+	tar bool
 }
 
 // Pkg encapsulates information about a package's source
@@ -50,27 +58,44 @@ type Pkg struct {
 	arches        []string
 	sources       []pkgSource
 	gitRepo       string
-	network       bool
+	registry      string
+	network       string
 	trust         bool
 	cache         bool
 	config        *moby.ImageConfig
+	buildArgs     []string
+	baseOverrides map[string]string
 	dockerDepends dockerDepends
+	depends       []string
 
 	// Internal state
-	path       string
-	hash       string
-	dirty      bool
-	commitHash string
-	git        *git
+	path        string
+	hashPath    string
+	hash        string
+	treeHash    string
+	dirty       bool
+	dirtyStatus dirtyStatus
+	commitHash  string
+	git         *git
 }
 
 // NewFromCLI creates a range of Pkg from a set of CLI arguments. Calls fs.Parse()
 func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
+	return newFromCLI(fs, false, args)
+}
+
+// FindFromCLI is NewFromCLI for every package, a directory with a
+// build.yml, found under the directories of the CLI arguments, or the
+// current directory if there are none. Calls fs.Parse()
+func FindFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
+	return newFromCLI(fs, true, args)
+}
+
+func newFromCLI(fs *flag.FlagSet, find bool, args []string) ([]Pkg, error) {
 	// Defaults
 	piBase := pkgInfo{
 		Org:          "linuxkit",
 		Arches:       []string{"amd64", "arm64", "s390x"},
-		GitRepo:      "https://github.com/linuxkit/linuxkit",
 		Network:      false,
 		DisableCache: false,
 	}
@@ -85,29 +110,91 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 	argDisableCache := fs.Bool("disable-cache", piBase.DisableCache, "Disable build cache")
 	argEnableCache := fs.Bool("enable-cache", !piBase.DisableCache, "Enable build cache")
 	argNoNetwork := fs.Bool("nonetwork", !piBase.Network, "Disallow network use during build")
-	argNetwork := fs.Bool("network", piBase.Network, "Allow network use during build")
+	var argNetwork networkFlag
+	fs.Var(&argNetwork, "network", "Allow network use during build, optionally the network mode to use: default, none or host")
 
 	argOrg := fs.String("org", piBase.Org, "Override the hub org")
 
 	// Other arguments
-	var buildYML, hash, hashCommit, hashPath string
-	var dirty, devMode bool
+	var buildYML, hash, hashCommit, hashPath, context, registryPrefix string
+	var dirty, devMode, unshallow, gitTrace bool
+	var gitEnvs, buildArgs, baseOverrides stringsFlag
 
 	fs.StringVar(&buildYML, "build-yml", "build.yml", "Override the name of the yml file")
 	fs.StringVar(&hash, "hash", "", "Override the image hash (default is to query git for the package's tree-sh)")
-	fs.StringVar(&hashCommit, "hash-commit", "HEAD", "Override the git commit to use for the hash")
+	fs.StringVar(&hashCommit, "hash-commit", "HEAD", "Override the git commit to use for the hash, any other commit than HEAD is also used as the build source instead of the working tree")
 	fs.StringVar(&hashPath, "hash-path", "", "Override the directory to use for the image hash, must be a parent of the package dir (default is to use the package dir)")
+	fs.StringVar(&context, "context", "", "Build a single package from a tarball of its source, as tar:<path>, instead of a directory. The hash is derived from the contents of the tarball rather than git")
+	fs.StringVar(&registryPrefix, "registry-prefix", "", "Namespace of a registry mirroring the packages, such as registry.example.com/mirror, to tag them under, as <prefix>/linuxkit/init:<hash> for linuxkit/init")
 	fs.BoolVar(&dirty, "force-dirty", false, "Force the pkg(s) to be considered dirty")
 	fs.BoolVar(&devMode, "dev", false, "Force org and hash to $USER and \"dev\" respectively")
+	fs.StringVar(&gitPath, "git-path", gitPath, "Path of the git executable to use")
+	fs.Var(&gitEnvs, "git-env", "Set an environment variable, as KEY=VALUE, for all git commands, may be repeated")
+	fs.BoolVar(&unshallow, "unshallow", true, "Fetch the full history of a shallow clone if the commit to hash is not available, set to false to fail instead")
+	fs.BoolVar(&gitTrace, "git-trace", false, "Print every git command run to stderr")
+	fs.BoolVar(&gitDryRun, "git-dry-run", false, "Print every git command run to stderr and skip those which would modify the repository, implies -git-trace")
+	fs.Var(&buildArgs, "build-arg", "Set a build argument, as KEY=VALUE, of every package, overriding the default in its build.yml, may be repeated. A value other than the default changes the hash")
+	fs.Var(&baseOverrides, "base-override", "Replace the base image OLD, in the FROM instructions of the Dockerfile of every package, with NEW, as OLD=NEW, may be repeated. Changes the hash")
 
 	_ = fs.Parse(args)
 
-	if fs.NArg() < 1 {
+	if err := util.ValidateRegistryPrefix(registryPrefix); err != nil {
+		return nil, err
+	}
+
+	pkgArgs := fs.Args()
+	var fromTar bool
+	if context != "" {
+		tarPath, err := parseContext(context)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() > 0 {
+			return nil, fmt.Errorf("-context builds the package in the tarball, no pkg directory can be given")
+		}
+		if hashPath != "" {
+			return nil, fmt.Errorf("-hash-path cannot be used with -context")
+		}
+		pkgArgs, fromTar = []string{tarPath}, true
+	}
+
+	if find {
+		if fromTar {
+			return nil, fmt.Errorf("-context cannot be used to find packages")
+		}
+		var err error
+		if pkgArgs, err = findPackages(pkgArgs, buildYML); err != nil {
+			return nil, err
+		}
+		if len(pkgArgs) < 1 {
+			return nil, fmt.Errorf("No package with a %s found", buildYML)
+		}
+	}
+	if len(pkgArgs) < 1 {
 		return nil, fmt.Errorf("At least one pkg directory is required")
 	}
 
+	for _, e := range gitEnvs {
+		if !strings.Contains(e, "=") {
+			return nil, fmt.Errorf("Bad -git-env %q, must be KEY=VALUE", e)
+		}
+	}
+	argOverrides, err := parseBuildArgs(buildArgs)
+	if err != nil {
+		return nil, fmt.Errorf("Bad -build-arg: %v", err)
+	}
+	bases, err := parseBaseOverrides(baseOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("Bad -base-override: %v", err)
+	}
+	gitEnv = gitEnvs
+	gitRunner = execRunner{}
+	if gitTrace || gitDryRun {
+		gitRunner = recordingRunner{w: os.Stderr}
+	}
+
 	var pkgs []Pkg
-	for _, pkg := range fs.Args() {
+	for _, pkg := range pkgArgs {
 		var (
 			pkgHashPath string
 			pkgHash     = hash
@@ -142,7 +229,12 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 			return nil, err
 		}
 
-		b, err := ioutil.ReadFile(filepath.Join(pkgPath, buildYML))
+		var b []byte
+		if fromTar {
+			b, err = tarReadFile(pkgPath, path.Clean(filepath.ToSlash(buildYML)))
+		} else {
+			b, err = ioutil.ReadFile(filepath.Join(pkgPath, buildYML))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -154,12 +246,38 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 		if pi.Image == "" {
 			return nil, fmt.Errorf("Image field is required")
 		}
+		if fromTar {
+			// these refer to files next to the package source
+			if len(pi.ExtraSources) > 0 {
+				return nil, fmt.Errorf("extra-sources cannot be used with -context")
+			}
+			if pi.Depends.DockerImages.Target != "" || pi.Depends.DockerImages.TargetDir != "" || pi.Depends.DockerImages.FromFile != "" {
+				return nil, fmt.Errorf("depends.docker-images cannot be used with -context")
+			}
+			if len(pi.Depends.Packages) > 0 {
+				return nil, fmt.Errorf("depends.packages cannot be used with -context")
+			}
+		}
 
 		dockerDepends, err := newDockerDepends(pkgPath, &pi)
 		if err != nil {
 			return nil, err
 		}
 
+		var depends []string
+		for _, d := range pi.Depends.Packages {
+			if !filepath.IsAbs(d) {
+				d = filepath.Join(pkgPath, d)
+			}
+			depends = append(depends, filepath.Clean(d))
+		}
+
+		defaultArgs, err := parseBuildArgs(pi.BuildArgs)
+		if err != nil {
+			return nil, fmt.Errorf("Bad build-args in %s: %v", buildYML, err)
+		}
+		pkgBuildArgs, overridden := mergeBuildArgs(defaultArgs, argOverrides)
+
 		if devMode {
 			// If --org is also used then this will be overwritten
 			// by argOrg when we iterate over the provided options
@@ -174,6 +292,10 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 		// apart from Visit which iterates over only those which were
 		// set. This must be run here, rather than earlier, because we need to
 		// have read it from the build.yml file first, then override based on CLI.
+		network := networkNone
+		if pi.Network {
+			network = networkDefault
+		}
 		fs.Visit(func(f *flag.Flag) {
 			switch f.Name {
 			case "disable-cache":
@@ -181,16 +303,20 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 			case "enable-cache":
 				pi.DisableCache = !*argEnableCache
 			case "network":
-				pi.Network = *argNetwork
+				network = string(argNetwork)
 			case "nonetwork":
-				pi.Network = !*argNoNetwork
+				if *argNoNetwork {
+					network = networkNone
+				} else {
+					network = networkDefault
+				}
 			case "org":
 				pi.Org = *argOrg
 			}
 		})
 
 		var srcHashes string
-		sources := []pkgSource{{src: pkgPath, dst: "/"}}
+		sources := []pkgSource{{src: pkgPath, dst: "/", tar: fromTar}}
 
 		for _, source := range pi.ExtraSources {
 			tmp := strings.Split(source, ":")
@@ -211,39 +337,76 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 			if g == nil {
 				return nil, fmt.Errorf("Source %s not in a git repository", srcPath)
 			}
+			g.fetchUnshallow = unshallow
 			h, err := g.treeHash(srcPath, hashCommit)
 			if err != nil {
 				return nil, err
 			}
 
 			srcHashes += h
-			sources = append(sources, pkgSource{src: srcPath, dst: dstPath})
+			sources = append(sources, pkgSource{src: srcPath, dst: dstPath, git: g})
 		}
 
-		git, err := newGit(pkgPath)
-		if err != nil {
+		var git *git
+		if fromTar {
+			if pkgHash == "" {
+				if pkgHash, err = tarContentHash(pkgPath); err != nil {
+					return nil, err
+				}
+				pkgHash = buildArgsHash(pkgHash, overridden)
+				pkgHash = baseOverridesHash(pkgHash, bases)
+			}
+		} else if git, err = newGit(pkgPath); err != nil {
 			return nil, err
 		}
 
+		var (
+			status   dirtyStatus
+			treeHash string
+			// a dirty package does not make the next ones dirty
+			pkgDirty = dirty
+		)
 		if git != nil {
-			gitDirty, err := git.isDirty(pkgHashPath, hashCommit)
-			if err != nil {
-				return nil, err
+			git.fetchUnshallow = unshallow
+			sources[0].git = git
+
+			if git.bare && hashCommit == "HEAD" {
+				return nil, git.requireWorkTree("building " + pkgPath + " from HEAD")
+			}
+			if !git.bare {
+				status, err = git.dirtyDetails(pkgHashPath, hashCommit)
+				if err != nil {
+					return nil, err
+				}
 			}
 
-			dirty = dirty || gitDirty
+			pkgDirty = pkgDirty || status.dirty()
 
+			// with -hash the tree hash is only wanted for the SBOM,
+			// which looks it up itself
 			if pkgHash == "" {
-				if pkgHash, err = git.treeHash(pkgHashPath, hashCommit); err != nil {
+				if treeHash, err = git.treeHash(pkgHashPath, hashCommit); err != nil {
 					return nil, err
 				}
+				pkgHash = treeHash
 
 				if srcHashes != "" {
 					pkgHash += srcHashes
 					pkgHash = fmt.Sprintf("%x", sha1.Sum([]byte(pkgHash)))
 				}
-
-				if dirty {
+				pkgHash = buildArgsHash(pkgHash, overridden)
+				pkgHash = baseOverridesHash(pkgHash, bases)
+
+				// the contents of the uncommitted changes are mixed in,
+				// so each dirty state of a package gets a tag of its own
+				if status.dirty() {
+					content, err := git.contentHash(pkgHashPath)
+					if err != nil {
+						return nil, err
+					}
+					pkgHash = fmt.Sprintf("%x", sha1.Sum([]byte(pkgHash+content)))
+				}
+				if pkgDirty {
 					pkgHash += "-dirty"
 				}
 			}
@@ -253,27 +416,161 @@ func NewFromCLI(fs *flag.FlagSet, args ...string) ([]Pkg, error) {
 			image:         pi.Image,
 			org:           pi.Org,
 			hash:          pkgHash,
+			treeHash:      treeHash,
 			commitHash:    hashCommit,
 			arches:        pi.Arches,
 			sources:       sources,
 			gitRepo:       pi.GitRepo,
-			network:       pi.Network,
+			registry:      registryPrefix,
+			network:       network,
 			cache:         !pi.DisableCache,
 			config:        pi.Config,
+			buildArgs:     pkgBuildArgs,
+			baseOverrides: bases,
 			dockerDepends: dockerDepends,
-			dirty:         dirty,
+			depends:       depends,
+			dirty:         pkgDirty,
+			dirtyStatus:   status,
 			path:          pkgPath,
+			hashPath:      pkgHashPath,
 			git:           git,
 		})
 	}
 	return pkgs, nil
 }
 
+// Network modes a package may be built with
+const (
+	networkDefault = "default"
+	networkNone    = "none"
+	networkHost    = "host"
+)
+
+// networkFlag is the -network flag. It is a boolean flag, so that a bare
+// -network allows network use as it always has, which can also be given
+// the network mode to use.
+type networkFlag string
+
+func (f *networkFlag) String() string {
+	return string(*f)
+}
+
+func (f *networkFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *networkFlag) Set(value string) error {
+	switch value {
+	case "true", networkDefault:
+		*f = networkDefault
+	case "false", networkNone:
+		*f = networkNone
+	case networkHost:
+		*f = networkHost
+	default:
+		return fmt.Errorf("unknown network mode %q, must be %s, %s or %s", value, networkDefault, networkNone, networkHost)
+	}
+	return nil
+}
+
+// stringsFlag is a flag which may be repeated, collecting each value
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseBuildArgs parses the KEY=VALUE build arguments args
+func parseBuildArgs(args []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, a := range args {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q must be KEY=VALUE", a)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// mergeBuildArgs returns the build arguments of a package as KEY=VALUE,
+// sorted, the defaults with the overrides, and the overrides which are
+// not the same as the default
+func mergeBuildArgs(defaults, overrides map[string]string) ([]string, []string) {
+	merged := map[string]string{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	var overridden []string
+	for k, v := range overrides {
+		if d, ok := defaults[k]; !ok || d != v {
+			overridden = append(overridden, k+"="+v)
+		}
+		merged[k] = v
+	}
+	var args []string
+	for k, v := range merged {
+		args = append(args, k+"="+v)
+	}
+	sort.Strings(args)
+	sort.Strings(overridden)
+	return args, overridden
+}
+
+// buildArgsHash returns hash, of the source, mixed with the build
+// arguments overridden from their defaults, so that the image built with
+// them gets a tag of its own. Without any it is hash, so packages keep
+// their tags.
+func buildArgsHash(hash string, overridden []string) string {
+	if len(overridden) == 0 {
+		return hash
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(hash+"\n"+strings.Join(overridden, "\n"))))
+}
+
 // Hash returns the hash of the package
 func (p Pkg) Hash() string {
 	return p.hash
 }
 
+// Dirty returns true if the package has uncommitted changes, which are
+// reflected in its hash
+func (p Pkg) Dirty() bool {
+	return p.dirty
+}
+
+// CommitTime returns the committer date of the commit the package is built
+// from, which a build gives its image, and false if it is not in git or is
+// dirty
+func (p Pkg) CommitTime() (time.Time, bool, error) {
+	if p.git == nil || p.dirty {
+		return time.Time{}, false, nil
+	}
+	t, err := p.git.commitTime(p.commitHash)
+	return t, true, err
+}
+
+// LatestCommitTime returns the latest CommitTime of pkgs, and false if one
+// of them has none
+func LatestCommitTime(pkgs []Pkg) (time.Time, bool, error) {
+	var latest time.Time
+	for _, p := range pkgs {
+		t, ok, err := p.CommitTime()
+		if err != nil || !ok {
+			return time.Time{}, ok, err
+		}
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, len(pkgs) != 0, nil
+}
+
 // ReleaseTag returns the tag to use for a particular release of the package
 func (p Pkg) ReleaseTag(release string) (string, error) {
 	if release == "" {
@@ -283,7 +580,7 @@ func (p Pkg) ReleaseTag(release string) (string, error) {
 		return "", fmt.Errorf("Cannot release a dirty package")
 	}
 	tag := p.org + "/" + p.image + ":" + release
-	return tag, nil
+	return util.PrefixReference(tag, p.registry), nil
 }
 
 // Tag returns the tag to use for the package
@@ -292,7 +589,7 @@ func (p Pkg) Tag() string {
 	if t == "" {
 		t = "latest"
 	}
-	return p.org + "/" + p.image + ":" + t
+	return util.PrefixReference(p.org+"/"+p.image+":"+t, p.registry)
 }
 
 // FullTag returns a reference expanded tag
@@ -305,6 +602,53 @@ func (p Pkg) TrustEnabled() bool {
 	return p.trust
 }
 
+// findPackages returns the directories, in lexical order, with a file
+// buildYML under dirs, or the current directory if there are none.
+// Hidden directories, such as .git, are not searched.
+func findPackages(dirs []string, buildYML string) ([]string, error) {
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+	}
+	var pkgs []string
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(path, buildYML)); err == nil {
+				pkgs = append(pkgs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pkgs, nil
+}
+
+// Exists reports whether the image of the package is in the registry
+func (p Pkg) Exists() (bool, error) {
+	return imageExists(p.FullTag())
+}
+
+// Path returns the absolute path of the package source directory
+func (p Pkg) Path() string {
+	return p.path
+}
+
+// Depends returns the absolute paths of the packages which must be built
+// before this one, as declared in depends.packages
+func (p Pkg) Depends() []string {
+	return p.depends
+}
+
 // Arches which arches this can be built for
 func (p Pkg) Arches() []string {
 	return p.arches
@@ -320,8 +664,8 @@ func (p Pkg) archSupported(want string) bool {
 }
 
 func (p Pkg) cleanForBuild() error {
-	if p.commitHash != "HEAD" {
-		return fmt.Errorf("Cannot build from commit hash != HEAD")
+	if p.commitHash != "HEAD" && p.git == nil {
+		return fmt.Errorf("Cannot build from commit hash != HEAD outside of a git repository")
 	}
 	return nil
 }
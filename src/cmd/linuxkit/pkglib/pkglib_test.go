@@ -6,7 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -77,7 +80,45 @@ image: dummy
 }
 
 func TestNetwork(t *testing.T) {
-	testBool(t, "network", false, "-network", "-nonetwork", func(p Pkg) bool { return p.network })
+	testBool(t, "network", false, "-network", "-nonetwork", func(p Pkg) bool { return p.network != networkNone })
+}
+
+func TestNetworkMode(t *testing.T) {
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	tmpDir := filepath.Join(cwd, t.Name())
+	err = os.Mkdir(tmpDir, 0755)
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	pkgDir := dummyPackage(t, tmpDir, `
+image: dummy
+`)
+	for _, tt := range []struct {
+		arg     string
+		network string
+	}{
+		{"", networkNone},
+		{"-network", networkDefault},
+		{"-network=default", networkDefault},
+		{"-network=none", networkNone},
+		{"-network=host", networkHost},
+		{"-network=false", networkNone},
+	} {
+		t.Run(tt.arg, func(t *testing.T) {
+			args := []string{"-hash-path=" + cwd}
+			if tt.arg != "" {
+				args = append(args, tt.arg)
+			}
+			pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), append(args, pkgDir)...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.network, pkgs[0].network)
+		})
+	}
+
+	var f networkFlag
+	assert.Error(t, f.Set("bridge"))
 }
 
 func TestCache(t *testing.T) {
@@ -143,3 +184,151 @@ depends:
       - one
 `, `"depends.images.list" and "depends.images.from-file" are mutually exclusive`)
 }
+
+func TestDependsPackages(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	writeFile(t, filepath.Join(repo, "pkg", "build.yml"), "image: dummy\ndepends:\n  packages:\n    - ../base\n    - /src/tools/\n")
+	runGit(t, repo, "commit", "-q", "-a", "-m", "depends")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, filepath.Join(repo, "pkg"), pkgs[0].Path())
+	assert.Equal(t, []string{filepath.Join(repo, "base"), "/src/tools"}, pkgs[0].Depends())
+}
+
+func TestRegistryPrefix(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	pkgDir := filepath.Join(repo, "pkg")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), pkgDir)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	hash := pkgs[0].Hash()
+
+	for _, prefix := range []string{"registry.example.com/mirror", "registry.example.com/mirror/", "localhost:5000/mirror"} {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-registry-prefix="+prefix, pkgDir)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		// the hash is the same as without the prefix
+		want := strings.TrimSuffix(prefix, "/") + "/linuxkit/dummy:" + hash
+		assert.Equal(t, want, pkgs[0].Tag())
+		assert.Equal(t, want, pkgs[0].FullTag())
+		release, err := pkgs[0].ReleaseTag("v1.0")
+		require.NoError(t, err)
+		assert.Equal(t, strings.TrimSuffix(prefix, "/")+"/linuxkit/dummy:v1.0", release)
+	}
+
+	// the prefix must name the registry
+	_, err = NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-registry-prefix=mirror", pkgDir)
+	assert.EqualError(t, err, `registry prefix "mirror" must start with a registry, such as registry.example.com/mirror`)
+}
+
+func TestLatestCommitTime(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	pkgDir := filepath.Join(repo, "pkg")
+	commitTime := func(commit string) time.Time {
+		ts, err := strconv.ParseInt(runGit(t, repo, "show", "-s", "--format=%ct", commit), 10, 64)
+		require.NoError(t, err)
+		return time.Unix(ts, 0).UTC()
+	}
+
+	for _, commit := range []string{"HEAD", "HEAD~1"} {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-hash-commit="+commit, pkgDir)
+		require.NoError(t, err)
+		latest, ok, err := LatestCommitTime(pkgs)
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, commitTime(commit), latest, commit)
+	}
+
+	// none for a dirty package
+	writeFile(t, filepath.Join(pkgDir, "build.yml"), "image: dummy\nnetwork: true\n")
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), pkgDir)
+	require.NoError(t, err)
+	_, ok, err := LatestCommitTime(pkgs)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestBuildArgs(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	writeFile(t, filepath.Join(repo, "pkg", "build.yml"), "image: dummy\nbuild-args:\n  - ALPINE_VERSION=3.16\n  - PROXY=\n")
+	runGit(t, repo, "commit", "-q", "-a", "-m", "build args")
+
+	pkg := func(args ...string) Pkg {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), append(args, filepath.Join(repo, "pkg"))...)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		return pkgs[0]
+	}
+
+	defaults := pkg()
+	assert.Equal(t, []string{"ALPINE_VERSION=3.16", "PROXY="}, defaults.buildArgs)
+	treeHash := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD:pkg"))
+	assert.Equal(t, treeHash, defaults.Hash(), "the defaults keep the tree hash")
+
+	// overriding with the default is the same image
+	same := pkg("-build-arg", "ALPINE_VERSION=3.16")
+	assert.Equal(t, defaults.Hash(), same.Hash())
+
+	changed := pkg("-build-arg", "ALPINE_VERSION=3.17")
+	assert.Equal(t, []string{"ALPINE_VERSION=3.17", "PROXY="}, changed.buildArgs)
+	assert.NotEqual(t, defaults.Hash(), changed.Hash())
+	assert.Equal(t, changed.Hash(), pkg("-build-arg", "ALPINE_VERSION=3.17").Hash(), "the hash is stable")
+
+	added := pkg("-build-arg", "EXTRA=1", "-build-arg", "ALPINE_VERSION=3.17")
+	assert.Equal(t, []string{"ALPINE_VERSION=3.17", "EXTRA=1", "PROXY="}, added.buildArgs)
+	assert.NotEqual(t, changed.Hash(), added.Hash())
+
+	// -hash is used as it is
+	assert.Equal(t, "abc", pkg("-hash", "abc", "-build-arg", "ALPINE_VERSION=3.17").Hash())
+
+	_, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-build-arg", "NOVALUE", filepath.Join(repo, "pkg"))
+	assert.Error(t, err)
+}
+
+func TestBaseOverride(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+
+	pkg := func(args ...string) Pkg {
+		pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), append(args, filepath.Join(repo, "pkg"))...)
+		require.NoError(t, err)
+		require.Len(t, pkgs, 1)
+		return pkgs[0]
+	}
+
+	plain := pkg()
+	assert.Empty(t, plain.baseOverrides)
+	overridden := pkg("-base-override", "linuxkit/alpine:0123=linuxkit/alpine:4567")
+	assert.Equal(t, map[string]string{"linuxkit/alpine:0123": "linuxkit/alpine:4567"}, overridden.baseOverrides)
+	assert.NotEqual(t, plain.Hash(), overridden.Hash())
+	assert.Equal(t, overridden.Hash(), pkg("-base-override", "linuxkit/alpine:0123=linuxkit/alpine:4567").Hash(), "the hash is stable")
+	assert.NotEqual(t, overridden.Hash(), pkg("-base-override", "linuxkit/alpine:0123=linuxkit/alpine:89ab").Hash())
+
+	// -hash is used as it is
+	assert.Equal(t, "abc", pkg("-hash", "abc", "-base-override", "linuxkit/alpine:0123=linuxkit/alpine:4567").Hash())
+
+	for _, o := range []string{"linuxkit/alpine:0123", "=linuxkit/alpine:4567", "linuxkit/alpine:0123="} {
+		_, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), "-base-override", o, filepath.Join(repo, "pkg"))
+		assert.Error(t, err, o)
+	}
+}
+
+func TestBuildArgsBadBuildYML(t *testing.T) {
+	testBadBuildYML(t, `
+image: dummy
+build-args:
+  - =foo
+`, `Bad build-args in build.yml: "=foo" must be KEY=VALUE`)
+}
@@ -0,0 +1,72 @@
+package pkglib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress modes of WithBuildProgress, those of BuildKit
+const (
+	ProgressAuto  = "auto"
+	ProgressPlain = "plain"
+	ProgressTTY   = "tty"
+	ProgressQuiet = "quiet"
+)
+
+// validateProgress checks the progress mode
+func validateProgress(mode string) error {
+	switch mode {
+	case ProgressAuto, ProgressPlain, ProgressTTY, ProgressQuiet:
+		return nil
+	}
+	return fmt.Errorf("unknown progress mode %q, must be %s, %s, %s or %s", mode, ProgressAuto, ProgressPlain, ProgressTTY, ProgressQuiet)
+}
+
+// timestampWriter writes each line to w prefixed with the time it is
+// completed at, so that build output in CI logs can be correlated. Empty
+// lines are left as they are.
+type timestampWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	line []byte
+	now  func() time.Time
+}
+
+func newTimestampWriter(w io.Writer) *timestampWriter {
+	return &timestampWriter{w: w, now: time.Now}
+}
+
+func (t *timestampWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.line = append(t.line, b...)
+	for {
+		i := bytes.IndexByte(t.line, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := t.line[:i+1]
+		if i > 0 {
+			line = []byte(fmt.Sprintf("%s %s", t.now().UTC().Format(time.RFC3339), line))
+		}
+		if _, err := t.w.Write(line); err != nil {
+			return 0, err
+		}
+		t.line = t.line[i+1:]
+	}
+}
+
+// Flush writes out an incomplete last line
+func (t *timestampWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.line) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(t.w, "%s %s\n", t.now().UTC().Format(time.RFC3339), t.line)
+	t.line = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package pkglib
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	var out bytes.Buffer
+	tw := newTimestampWriter(&out)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tw.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	fmt.Fprint(tw, "#1 [internal] load build definition\n#1 DONE")
+	fmt.Fprint(tw, " 0.1s\n\n#2 partial")
+	require.NoError(t, tw.Flush())
+	assert.Equal(t, `2020-01-02T03:04:06Z #1 [internal] load build definition
+2020-01-02T03:04:07Z #1 DONE 0.1s
+
+2020-01-02T03:04:08Z #2 partial
+`, out.String())
+}
+
+func TestValidateProgress(t *testing.T) {
+	for _, mode := range []string{ProgressAuto, ProgressPlain, ProgressTTY, ProgressQuiet} {
+		assert.NoError(t, validateProgress(mode))
+	}
+	assert.Error(t, validateProgress("rawjson"))
+}
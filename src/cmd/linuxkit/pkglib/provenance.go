@@ -0,0 +1,240 @@
+package pkglib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	registry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+)
+
+// Provenance modes supported by WithBuildProvenance, as those of BuildKit
+const (
+	// ProvenanceModeMin records the source and the parameters which
+	// change the tag
+	ProvenanceModeMin = "min"
+	// ProvenanceModeMax also records the other build parameters and
+	// every file of the build context
+	ProvenanceModeMax = "max"
+)
+
+const (
+	inTotoMediaType         = "application/vnd.in-toto+json"
+	inTotoStatementType     = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType      = "https://slsa.dev/provenance/v0.2"
+	provenanceBuildType     = "https://mobyproject.org/linuxkit/pkg-build@v1"
+	provenanceBuilderID     = "https://github.com/linuxkit/linuxkit/src/cmd/linuxkit"
+	annotationPredicateType = "in-toto.io/predicate-type"
+)
+
+// validProvenanceMode returns an error if mode is not a provenance mode
+func validProvenanceMode(mode string) error {
+	switch mode {
+	case ProvenanceModeMin, ProvenanceModeMax:
+		return nil
+	}
+	return fmt.Errorf("unknown provenance mode %q, must be %s or %s", mode, ProvenanceModeMin, ProvenanceModeMax)
+}
+
+// provenanceSource describes the build of a package provenance is
+// generated for
+type provenanceSource struct {
+	sbomSource
+	platforms     []string
+	buildArgs     []string
+	baseOverrides map[string]string
+	network       string
+	noCache       bool
+	// sourceDateEpoch is the timestamp of the image, if it has one
+	sourceDateEpoch *time.Time
+	// started and finished are the times of the build, zero if the
+	// image was not built but found in the cache
+	started, finished time.Time
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type slsaConfigSource struct {
+	URI        string            `json:"uri,omitempty"`
+	Digest     map[string]string `json:"digest,omitempty"`
+	EntryPoint string            `json:"entryPoint"`
+}
+
+// slsaParameters are the parameters of the build of a package, those up
+// to TreeHash in both modes, the others only in max mode
+type slsaParameters struct {
+	Tag           string            `json:"tag"`
+	Commit        string            `json:"commit,omitempty"`
+	TreeHash      string            `json:"treeHash,omitempty"`
+	Platforms     []string          `json:"platforms"`
+	BuildArgs     []string          `json:"buildArgs,omitempty"`
+	BaseOverrides map[string]string `json:"baseOverrides,omitempty"`
+	Network       string            `json:"network,omitempty"`
+	NoCache       bool              `json:"noCache,omitempty"`
+	// SourceDateEpoch is the Unix timestamp of the image
+	SourceDateEpoch *int64 `json:"sourceDateEpoch,omitempty"`
+}
+
+type slsaProvenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		ConfigSource slsaConfigSource `json:"configSource"`
+		Parameters   slsaParameters   `json:"parameters"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildStartedOn  string `json:"buildStartedOn,omitempty"`
+		BuildFinishedOn string `json:"buildFinishedOn,omitempty"`
+		Completeness    struct {
+			Parameters  bool `json:"parameters"`
+			Environment bool `json:"environment"`
+			Materials   bool `json:"materials"`
+		} `json:"completeness"`
+		Reproducible bool `json:"reproducible"`
+	} `json:"metadata"`
+	Materials []slsaMaterial `json:"materials"`
+}
+
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	PredicateType string          `json:"predicateType"`
+	Subject       []inTotoSubject `json:"subject"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+// generateProvenance returns an in-toto statement of the SLSA provenance
+// of subject, the pushed manifest of src, in mode
+func generateProvenance(mode string, src provenanceSource, subject registry.Descriptor) ([]byte, error) {
+	if err := validProvenanceMode(mode); err != nil {
+		return nil, err
+	}
+	max := mode == ProvenanceModeMax
+
+	var pred slsaProvenance
+	pred.Builder.ID = provenanceBuilderID + "@" + version.Version
+	pred.BuildType = provenanceBuildType
+
+	source := slsaConfigSource{EntryPoint: "Dockerfile"}
+	source.URI = gitURI(src.repo, src.commit)
+	if src.commit != "" {
+		source.Digest = map[string]string{"sha1": src.commit}
+	}
+	pred.Invocation.ConfigSource = source
+
+	params := slsaParameters{
+		Tag:       src.tag,
+		Commit:    src.commit,
+		TreeHash:  src.treeHash,
+		Platforms: append([]string{}, src.platforms...),
+		// build args and base overrides change the tag, so are
+		// recorded in both modes
+		BuildArgs:     src.buildArgs,
+		BaseOverrides: src.baseOverrides,
+	}
+	sort.Strings(params.Platforms)
+	if max {
+		params.Network = src.network
+		params.NoCache = src.noCache
+		if src.sourceDateEpoch != nil {
+			epoch := src.sourceDateEpoch.Unix()
+			params.SourceDateEpoch = &epoch
+		}
+	}
+	pred.Invocation.Parameters = params
+
+	if !src.started.IsZero() {
+		pred.Metadata.BuildStartedOn = src.started.UTC().Format(time.RFC3339)
+		pred.Metadata.BuildFinishedOn = src.finished.UTC().Format(time.RFC3339)
+	}
+	pred.Metadata.Completeness.Parameters = max
+	pred.Metadata.Completeness.Materials = max
+	pred.Metadata.Reproducible = src.sourceDateEpoch != nil
+
+	pred.Materials = []slsaMaterial{}
+	if source.URI != "" {
+		pred.Materials = append(pred.Materials, slsaMaterial{URI: source.URI, Digest: source.Digest})
+	}
+	if max {
+		for _, f := range src.files {
+			pred.Materials = append(pred.Materials, slsaMaterial{URI: "file:" + f.name, Digest: map[string]string{"sha256": f.digest}})
+		}
+	}
+
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaProvenanceType,
+		Subject: []inTotoSubject{{
+			Name:   src.tag,
+			Digest: map[string]string{subject.Digest.Algorithm: subject.Digest.Hex},
+		}},
+		Predicate: pred,
+	}
+	return json.MarshalIndent(statement, "", "  ")
+}
+
+// gitURI is the SLSA URI of a git repository at commit, empty if the
+// repository is not known
+func gitURI(repo, commit string) string {
+	if repo == "" {
+		return ""
+	}
+	uri := repo
+	if !strings.HasPrefix(uri, "git+") {
+		uri = "git+" + uri
+	}
+	if commit != "" {
+		uri += "@" + commit
+	}
+	return uri
+}
+
+// provenanceSource describes the build of p with bo for its provenance
+func (p Pkg) provenanceSource(bo buildOpts) (provenanceSource, error) {
+	src := provenanceSource{
+		buildArgs:       p.buildArgs,
+		baseOverrides:   p.baseOverrides,
+		network:         p.network,
+		noCache:         !p.cache || bo.noCache,
+		sourceDateEpoch: bo.sourceDateEpoch,
+		started:         bo.buildStarted,
+		finished:        bo.buildFinished,
+	}
+	for _, plat := range bo.platforms {
+		src.platforms = append(src.platforms, plat.OS+"/"+plat.Architecture)
+	}
+	s, err := p.sbomSource()
+	if err != nil {
+		return src, err
+	}
+	src.sbomSource = s
+	return src, nil
+}
+
+// attachProvenance generates the provenance of the build of p with bo,
+// in mode, and attaches it to its pushed manifest, reporting progress to
+// writer
+func (p Pkg) attachProvenance(mode string, bo buildOpts, writer io.Writer) error {
+	src, err := p.provenanceSource(bo)
+	if err != nil {
+		return err
+	}
+	annotations := revisionAnnotations(src.commit, src.treeHash)
+	annotations[annotationPredicateType] = slsaProvenanceType
+	return pushReferrer(writer, "provenance", p.FullTag(), inTotoMediaType, annotations, func(subject registry.Descriptor) ([]byte, error) {
+		return generateProvenance(mode, src, subject)
+	})
+}
@@ -0,0 +1,147 @@
+package pkglib
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	registry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testProvenanceSource() provenanceSource {
+	epoch := time.Unix(1577934245, 0)
+	return provenanceSource{
+		sbomSource:      testSBOMSource(),
+		platforms:       []string{"linux/arm64", "linux/amd64"},
+		buildArgs:       []string{"ALPINE_VERSION=3.16"},
+		network:         networkNone,
+		noCache:         true,
+		sourceDateEpoch: &epoch,
+		started:         time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		finished:        time.Date(2020, 1, 2, 3, 5, 6, 0, time.UTC),
+	}
+}
+
+var testProvenanceSubject = registry.Descriptor{
+	MediaType: types.OCIImageIndex,
+	Size:      123,
+	Digest:    registry.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)},
+}
+
+func TestGenerateProvenance(t *testing.T) {
+	src := testProvenanceSource()
+	commit := "0123456789abcdef0123456789abcdef01234567"
+
+	b, err := generateProvenance(ProvenanceModeMin, src, testProvenanceSubject)
+	require.NoError(t, err)
+	var st inTotoStatement
+	require.NoError(t, json.Unmarshal(b, &st))
+	assert.Equal(t, inTotoStatementType, st.Type)
+	assert.Equal(t, slsaProvenanceType, st.PredicateType)
+	assert.Equal(t, []inTotoSubject{{Name: "docker.io/linuxkit/foo:abc", Digest: map[string]string{"sha256": strings.Repeat("a", 64)}}}, st.Subject)
+	pred := st.Predicate
+	assert.True(t, strings.HasPrefix(pred.Builder.ID, provenanceBuilderID+"@"))
+	assert.Equal(t, "git+https://github.com/linuxkit/linuxkit@"+commit, pred.Invocation.ConfigSource.URI)
+	assert.Equal(t, map[string]string{"sha1": commit}, pred.Invocation.ConfigSource.Digest)
+	assert.Equal(t, "Dockerfile", pred.Invocation.ConfigSource.EntryPoint)
+	params := pred.Invocation.Parameters
+	assert.Equal(t, commit, params.Commit)
+	assert.Equal(t, "abc", params.TreeHash)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, params.Platforms)
+	assert.Equal(t, []string{"ALPINE_VERSION=3.16"}, params.BuildArgs)
+	assert.Empty(t, params.Network, "only in max mode")
+	assert.Nil(t, params.SourceDateEpoch, "only in max mode")
+	assert.Equal(t, "2020-01-02T03:04:05Z", pred.Metadata.BuildStartedOn)
+	assert.Equal(t, "2020-01-02T03:05:06Z", pred.Metadata.BuildFinishedOn)
+	assert.False(t, pred.Metadata.Completeness.Materials)
+	assert.True(t, pred.Metadata.Reproducible)
+	assert.Equal(t, []slsaMaterial{{URI: "git+https://github.com/linuxkit/linuxkit@" + commit, Digest: map[string]string{"sha1": commit}}}, pred.Materials)
+
+	b, err = generateProvenance(ProvenanceModeMax, src, testProvenanceSubject)
+	require.NoError(t, err)
+	st = inTotoStatement{}
+	require.NoError(t, json.Unmarshal(b, &st))
+	params = st.Predicate.Invocation.Parameters
+	assert.Equal(t, networkNone, params.Network)
+	assert.True(t, params.NoCache)
+	require.NotNil(t, params.SourceDateEpoch)
+	assert.Equal(t, int64(1577934245), *params.SourceDateEpoch)
+	assert.True(t, st.Predicate.Metadata.Completeness.Materials)
+	require.Len(t, st.Predicate.Materials, 3)
+	assert.Equal(t, slsaMaterial{URI: "file:Dockerfile", Digest: map[string]string{"sha256": "1111"}}, st.Predicate.Materials[1])
+
+	// an image found in the cache was not built now
+	src.started, src.finished = time.Time{}, time.Time{}
+	b, err = generateProvenance(ProvenanceModeMin, src, testProvenanceSubject)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "buildStartedOn")
+
+	_, err = generateProvenance("full", src, testProvenanceSubject)
+	assert.Error(t, err)
+	assert.Error(t, WithBuildProvenance("full")(&buildOpts{}))
+}
+
+// TestProvenanceAttestation checks the provenance of a package in git is
+// attached as an in-toto referrer recording its repository, commit and
+// tree hash
+func TestProvenanceAttestation(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+	writeFile(t, filepath.Join(repo, "pkg", "build.yml"), "image: dummy\ngitrepo: https://example.com/repo.git\nbuild-args:\n  - VERSION=1\n")
+	runGit(t, repo, "commit", "-q", "-a", "-m", "gitrepo")
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	p := pkgs[0]
+	bo := buildOpts{platforms: []imagespec.Platform{{OS: "linux", Architecture: "amd64"}}}
+	src, err := p.provenanceSource(bo)
+	require.NoError(t, err)
+	commit := runGit(t, repo, "rev-parse", "HEAD")
+	assert.Equal(t, commit, src.commit)
+	assert.Equal(t, runGit(t, repo, "rev-parse", "HEAD:pkg"), src.treeHash)
+
+	b, err := generateProvenance(ProvenanceModeMax, src, testProvenanceSubject)
+	require.NoError(t, err)
+	annotations := revisionAnnotations(src.commit, src.treeHash)
+	annotations[annotationPredicateType] = slsaProvenanceType
+	a, err := newReferrer(testProvenanceSubject, inTotoMediaType, b, annotations)
+	require.NoError(t, err)
+
+	var m referrerManifest
+	require.NoError(t, json.Unmarshal(a.manifest, &m))
+	assert.Equal(t, inTotoMediaType, m.ArtifactType)
+	require.NotNil(t, m.Subject)
+	assert.Equal(t, testProvenanceSubject.Digest, m.Subject.Digest)
+	assert.Equal(t, slsaProvenanceType, m.Annotations[annotationPredicateType])
+	assert.Equal(t, commit, m.Annotations[annotationGitCommit])
+
+	img, err := partial.CompressedToImage(a)
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	var st inTotoStatement
+	require.NoError(t, json.Unmarshal(data, &st))
+	assert.Equal(t, "git+https://example.com/repo.git@"+commit, st.Predicate.Invocation.ConfigSource.URI)
+	assert.Equal(t, commit, st.Predicate.Invocation.Parameters.Commit)
+	assert.Equal(t, src.treeHash, st.Predicate.Invocation.Parameters.TreeHash)
+	assert.Equal(t, []string{"VERSION=1"}, st.Predicate.Invocation.Parameters.BuildArgs)
+	assert.Equal(t, []string{"linux/amd64"}, st.Predicate.Invocation.Parameters.Platforms)
+}
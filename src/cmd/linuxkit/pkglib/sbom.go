@@ -0,0 +1,587 @@
+package pkglib
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	registry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/google/uuid"
+	lktregistry "github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// SBOM formats supported by WithBuildSBOM
+const (
+	SBOMFormatSPDX      = "spdx"
+	SBOMFormatCycloneDX = "cyclonedx"
+)
+
+const (
+	sbomMediaTypeSPDX      = "application/spdx+json"
+	sbomMediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+	// emptyMediaType is the config media type of OCI artifacts without a config
+	emptyMediaType = "application/vnd.oci.empty.v1+json"
+
+	annotationGitCommit = "org.mobyproject.linuxkit.git.commit"
+	annotationTreeHash  = "org.mobyproject.linuxkit.git.tree-hash"
+)
+
+// sbomMediaType returns the media type of an SBOM in format
+func sbomMediaType(format string) (string, error) {
+	switch format {
+	case SBOMFormatSPDX:
+		return sbomMediaTypeSPDX, nil
+	case SBOMFormatCycloneDX:
+		return sbomMediaTypeCycloneDX, nil
+	}
+	return "", fmt.Errorf("unknown SBOM format %q, must be %s or %s", format, SBOMFormatSPDX, SBOMFormatCycloneDX)
+}
+
+// sbomFile is a regular file in the build context of a package
+type sbomFile struct {
+	name   string
+	digest string
+}
+
+// sbomSource describes the package an SBOM is generated for
+type sbomSource struct {
+	name     string
+	tag      string
+	repo     string
+	commit   string
+	treeHash string
+	created  time.Time
+	files    []sbomFile
+}
+
+// sbomSource scans the build context of p for the SBOM
+func (p Pkg) sbomSource() (sbomSource, error) {
+	src := sbomSource{
+		name:    p.org + "/" + p.image,
+		tag:     p.FullTag(),
+		repo:    p.sourceURL(),
+		created: time.Now().UTC(),
+	}
+	commit, treeHash, err := p.revision()
+	if err != nil {
+		return src, err
+	}
+	src.commit, src.treeHash = commit, treeHash
+
+	ctx := &buildCtx{sources: p.sources, commit: p.commitHash}
+	r := ctx.Reader()
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return src, fmt.Errorf("unable to scan build context: %v", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		d := sha256.New()
+		if _, err := io.Copy(d, tr); err != nil {
+			return src, fmt.Errorf("unable to scan build context: %v", err)
+		}
+		// the package itself is at the root of the build context
+		name := strings.TrimPrefix(path.Clean("/"+h.Name), "/")
+		src.files = append(src.files, sbomFile{name: name, digest: fmt.Sprintf("%x", d.Sum(nil))})
+	}
+	if ctx.err != nil {
+		return src, fmt.Errorf("unable to scan build context: %v", ctx.err)
+	}
+	sort.Slice(src.files, func(i, j int) bool { return src.files[i].name < src.files[j].name })
+	return src, nil
+}
+
+// revision returns the commit p is built from and the tree hash of its
+// source, either of which is empty when not known
+func (p Pkg) revision() (string, string, error) {
+	treeHash := p.treeHash
+	if p.git == nil {
+		return "", treeHash, nil
+	}
+	commit, err := p.git.commitHash(p.commitHash)
+	if err != nil {
+		return "", "", err
+	}
+	// not known when the hash was given with -hash, nor needed for
+	// anything but the annotations, which can do without it
+	if treeHash == "" {
+		h, err := p.git.treeHash(p.hashPath, p.commitHash)
+		if err != nil {
+			log.Debugf("tree hash of %s unknown: %v", p.hashPath, err)
+		}
+		treeHash = h
+	}
+	return commit, treeHash, nil
+}
+
+// revisionAnnotations are the annotations recording commit and treeHash,
+// leaving out those which are not known
+func revisionAnnotations(commit, treeHash string) map[string]string {
+	annotations := map[string]string{}
+	if commit != "" {
+		annotations[annotationGitCommit] = commit
+	}
+	if treeHash != "" {
+		annotations[annotationTreeHash] = treeHash
+	}
+	return annotations
+}
+
+// generateSBOM returns an SBOM for src in format
+func generateSBOM(format string, src sbomSource) ([]byte, error) {
+	var doc interface{}
+	switch format {
+	case SBOMFormatSPDX:
+		doc = spdxDocument(src)
+	case SBOMFormatCycloneDX:
+		doc = cycloneDXDocument(src)
+	default:
+		_, err := sbomMediaType(format)
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxFile struct {
+	SPDXID    string         `json:"SPDXID"`
+	FileName  string         `json:"fileName"`
+	Checksums []spdxChecksum `json:"checksums"`
+}
+
+type spdxPackage struct {
+	SPDXID           string   `json:"SPDXID"`
+	Name             string   `json:"name"`
+	VersionInfo      string   `json:"versionInfo"`
+	DownloadLocation string   `json:"downloadLocation"`
+	FilesAnalyzed    bool     `json:"filesAnalyzed"`
+	SourceInfo       string   `json:"sourceInfo,omitempty"`
+	HasFiles         []string `json:"hasFiles,omitempty"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+type spdxDoc struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Files         []spdxFile         `json:"files"`
+	Relationships []spdxRelationship `json:"relationships"`
+}
+
+func spdxDocument(src sbomSource) spdxDoc {
+	doc := spdxDoc{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              src.tag,
+		DocumentNamespace: "https://mobyproject.org/linuxkit/spdx/" + src.tag + "-" + uuid.New().String(),
+		Files:             []spdxFile{},
+	}
+	doc.CreationInfo.Created = src.created.Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: linuxkit-" + version.Version}
+
+	pkg := spdxPackage{
+		SPDXID:           "SPDXRef-Package",
+		Name:             src.name,
+		VersionInfo:      src.tag,
+		DownloadLocation: "NOASSERTION",
+		FilesAnalyzed:    true,
+		SourceInfo:       sourceInfo(src),
+	}
+	if src.repo != "" {
+		pkg.DownloadLocation = "git+" + src.repo
+		if src.commit != "" {
+			pkg.DownloadLocation += "@" + src.commit
+		}
+	}
+	doc.Relationships = append(doc.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", pkg.SPDXID})
+
+	for i, f := range src.files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i)
+		doc.Files = append(doc.Files, spdxFile{
+			SPDXID:    id,
+			FileName:  "./" + f.name,
+			Checksums: []spdxChecksum{{Algorithm: "SHA256", ChecksumValue: f.digest}},
+		})
+		pkg.HasFiles = append(pkg.HasFiles, id)
+	}
+	doc.Packages = []spdxPackage{pkg}
+	return doc
+}
+
+// sourceInfo describes the source an SBOM was generated from
+func sourceInfo(src sbomSource) string {
+	var info []string
+	if src.commit != "" {
+		info = append(info, "git commit "+src.commit)
+	}
+	if src.treeHash != "" {
+		info = append(info, "tree "+src.treeHash)
+	}
+	if len(info) == 0 {
+		return ""
+	}
+	return "built from " + strings.Join(info, ", ")
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Hashes     []cycloneDXHash     `json:"hashes,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXDoc struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string `json:"timestamp"`
+		Tools     []struct {
+			Vendor  string `json:"vendor"`
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"tools"`
+		Component cycloneDXComponent `json:"component"`
+	} `json:"metadata"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+func cycloneDXDocument(src sbomSource) cycloneDXDoc {
+	doc := cycloneDXDoc{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + uuid.New().String(),
+		Version:      1,
+		Components:   []cycloneDXComponent{},
+	}
+	doc.Metadata.Timestamp = src.created.Format(time.RFC3339)
+	doc.Metadata.Tools = append(doc.Metadata.Tools, struct {
+		Vendor  string `json:"vendor"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}{"LinuxKit", "linuxkit", version.Version})
+
+	component := cycloneDXComponent{Type: "container", Name: src.name, Version: src.tag}
+	if src.repo != "" {
+		component.Properties = append(component.Properties, cycloneDXProperty{"org.opencontainers.image.source", src.repo})
+	}
+	if src.commit != "" {
+		component.Properties = append(component.Properties, cycloneDXProperty{annotationGitCommit, src.commit})
+	}
+	if src.treeHash != "" {
+		component.Properties = append(component.Properties, cycloneDXProperty{annotationTreeHash, src.treeHash})
+	}
+	doc.Metadata.Component = component
+
+	for _, f := range src.files {
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type:   "file",
+			Name:   f.name,
+			Hashes: []cycloneDXHash{{Alg: "SHA-256", Content: f.digest}},
+		})
+	}
+	return doc
+}
+
+// attachSBOM generates an SBOM for p in format and attaches it to its
+// pushed manifest, reporting progress to writer
+func (p Pkg) attachSBOM(format string, writer io.Writer) error {
+	mediaType, err := sbomMediaType(format)
+	if err != nil {
+		return err
+	}
+	src, err := p.sbomSource()
+	if err != nil {
+		return err
+	}
+	sbom, err := generateSBOM(format, src)
+	if err != nil {
+		return err
+	}
+	return pushReferrer(writer, "SBOM", p.FullTag(), mediaType, revisionAnnotations(src.commit, src.treeHash), func(registry.Descriptor) ([]byte, error) {
+		return sbom, nil
+	})
+}
+
+// referrerManifest is an OCI image manifest for an artifact attached
+// to subject. The vendored go-containerregistry predates the subject
+// and artifactType fields, so this is serialized by hand.
+type referrerManifest struct {
+	SchemaVersion int64                 `json:"schemaVersion"`
+	MediaType     types.MediaType       `json:"mediaType"`
+	ArtifactType  string                `json:"artifactType"`
+	Config        registry.Descriptor   `json:"config"`
+	Layers        []registry.Descriptor `json:"layers"`
+	Subject       *registry.Descriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string     `json:"annotations,omitempty"`
+}
+
+// blob is a layer, or config, of an artifact
+type blob struct {
+	data      []byte
+	mediaType types.MediaType
+}
+
+func (b blob) Digest() (registry.Hash, error) {
+	h, _, err := registry.SHA256(bytes.NewReader(b.data))
+	return h, err
+}
+
+func (b blob) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(b.data)), nil
+}
+
+func (b blob) Size() (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func (b blob) MediaType() (types.MediaType, error) {
+	return b.mediaType, nil
+}
+
+func (b blob) descriptor() (registry.Descriptor, error) {
+	h, err := b.Digest()
+	if err != nil {
+		return registry.Descriptor{}, err
+	}
+	return registry.Descriptor{MediaType: b.mediaType, Size: int64(len(b.data)), Digest: h}, nil
+}
+
+// artifact is an OCI artifact with a single layer, which implements
+// partial.CompressedImageCore so it can be pushed with remote.Write
+type artifact struct {
+	manifest []byte
+	layer    blob
+}
+
+var emptyConfig = blob{data: []byte("{}"), mediaType: emptyMediaType}
+
+func (a artifact) RawConfigFile() ([]byte, error) {
+	return emptyConfig.data, nil
+}
+
+func (a artifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a artifact) RawManifest() ([]byte, error) {
+	return a.manifest, nil
+}
+
+func (a artifact) LayerByDigest(h registry.Hash) (partial.CompressedLayer, error) {
+	if d, err := a.layer.Digest(); err == nil && d == h {
+		return a.layer, nil
+	}
+	if d, err := emptyConfig.Digest(); err == nil && d == h {
+		return emptyConfig, nil
+	}
+	return nil, fmt.Errorf("unknown blob %s", h)
+}
+
+// newReferrer returns an artifact holding data, of artifactType, which refers to subject
+func newReferrer(subject registry.Descriptor, artifactType string, data []byte, annotations map[string]string) (artifact, error) {
+	a := artifact{layer: blob{data: data, mediaType: types.MediaType(artifactType)}}
+	config, err := emptyConfig.descriptor()
+	if err != nil {
+		return a, err
+	}
+	layer, err := a.layer.descriptor()
+	if err != nil {
+		return a, err
+	}
+	a.manifest, err = json.Marshal(referrerManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		ArtifactType:  artifactType,
+		Config:        config,
+		Layers:        []registry.Descriptor{layer},
+		Subject:       &subject,
+		Annotations:   annotations,
+	})
+	return a, err
+}
+
+// referrerDescriptor is an entry in a referrers index
+type referrerDescriptor struct {
+	registry.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type referrersIndex struct {
+	SchemaVersion int64                `json:"schemaVersion"`
+	MediaType     types.MediaType      `json:"mediaType"`
+	Manifests     []referrerDescriptor `json:"manifests"`
+}
+
+// addReferrer returns the referrers index existing, which may be nil,
+// with desc added to it
+func addReferrer(existing []byte, desc referrerDescriptor) ([]byte, error) {
+	index := referrersIndex{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	if existing != nil {
+		if err := json.Unmarshal(existing, &index); err != nil {
+			return nil, fmt.Errorf("unable to parse referrers index: %v", err)
+		}
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			return json.Marshal(index)
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+	return json.Marshal(index)
+}
+
+// rawIndex is a serialized image index whose children already exist in
+// the registry, so it can be pushed with remote.WriteIndex
+type rawIndex []byte
+
+func (r rawIndex) MediaType() (types.MediaType, error) {
+	return types.OCIImageIndex, nil
+}
+
+func (r rawIndex) Digest() (registry.Hash, error) {
+	h, _, err := registry.SHA256(bytes.NewReader(r))
+	return h, err
+}
+
+func (r rawIndex) Size() (int64, error) {
+	return int64(len(r)), nil
+}
+
+func (r rawIndex) IndexManifest() (*registry.IndexManifest, error) {
+	return registry.ParseIndexManifest(bytes.NewReader(r))
+}
+
+func (r rawIndex) RawManifest() ([]byte, error) {
+	return r, nil
+}
+
+func (r rawIndex) Image(h registry.Hash) (registry.Image, error) {
+	return nil, fmt.Errorf("referrer %s not found in registry", h)
+}
+
+func (r rawIndex) ImageIndex(h registry.Hash) (registry.ImageIndex, error) {
+	return nil, fmt.Errorf("referrer %s not found in registry", h)
+}
+
+// pushReferrer attaches an artifact of mediaType, an SBOM or provenance as
+// named by kind, to the manifest name points to in the registry as an OCI
+// referrer. Its content is generated for the manifest, its subject.
+// Registries which support the OCI referrers API index it by its subject,
+// for those which do not the referrers tag schema index, tagged
+// sha256-<digest>, is updated too.
+func pushReferrer(writer io.Writer, kind, name, mediaType string, annotations map[string]string, content func(subject registry.Descriptor) ([]byte, error)) error {
+	options := []remote.Option{remote.WithAuthFromKeychain(lktregistry.Keychain)}
+	ref, err := namepkg.ParseReference(name)
+	if err != nil {
+		return err
+	}
+
+	subject, err := remote.Head(ref, options...)
+	if err != nil {
+		return fmt.Errorf("unable to find %s in registry: %v", name, err)
+	}
+
+	desc := registry.Descriptor{MediaType: subject.MediaType, Size: subject.Size, Digest: subject.Digest}
+	data, err := content(desc)
+	if err != nil {
+		return err
+	}
+	a, err := newReferrer(desc, mediaType, data, annotations)
+	if err != nil {
+		return err
+	}
+	img, err := partial.CompressedToImage(a)
+	if err != nil {
+		return err
+	}
+	d, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	if err := lktregistry.RetryPush(kind+" for "+name, func() error { return remote.Write(ref.Context().Digest(d.String()), img, options...) }); err != nil {
+		return fmt.Errorf("unable to push %s for %s: %v", kind, name, err)
+	}
+
+	fallback, err := namepkg.NewTag(ref.Context().String() + ":" + strings.Replace(subject.Digest.String(), ":", "-", 1))
+	if err != nil {
+		return err
+	}
+	var existing []byte
+	switch desc, err := remote.Get(fallback, options...); {
+	case err == nil:
+		existing = desc.Manifest
+	case isNotFound(err):
+	default:
+		return fmt.Errorf("unable to read referrers of %s: %v", name, err)
+	}
+	index, err := addReferrer(existing, referrerDescriptor{
+		Descriptor:   registry.Descriptor{MediaType: types.OCIManifestSchema1, Size: int64(len(a.manifest)), Digest: d, Annotations: annotations},
+		ArtifactType: mediaType,
+	})
+	if err != nil {
+		return err
+	}
+	if err := lktregistry.RetryPush("referrers of "+name, func() error { return remote.WriteIndex(fallback, rawIndex(index), options...) }); err != nil {
+		return fmt.Errorf("unable to push referrers of %s: %v", name, err)
+	}
+	fmt.Fprintf(writer, "Pushed %s %s for %s\n", kind, d, name)
+	return nil
+}
+
+func isNotFound(err error) bool {
+	terr, ok := err.(*transport.Error)
+	return ok && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,165 @@
+package pkglib
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	registry "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSBOMSource() sbomSource {
+	return sbomSource{
+		name:     "linuxkit/foo",
+		tag:      "docker.io/linuxkit/foo:abc",
+		repo:     "https://github.com/linuxkit/linuxkit",
+		commit:   "0123456789abcdef0123456789abcdef01234567",
+		treeHash: "abc",
+		created:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		files: []sbomFile{
+			{name: "Dockerfile", digest: "1111"},
+			{name: "build.yml", digest: "2222"},
+		},
+	}
+}
+
+func TestGenerateSBOMSPDX(t *testing.T) {
+	b, err := generateSBOM(SBOMFormatSPDX, testSBOMSource())
+	require.NoError(t, err)
+
+	var doc spdxDoc
+	require.NoError(t, json.Unmarshal(b, &doc))
+	assert.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	assert.Equal(t, "2020-01-02T03:04:05Z", doc.CreationInfo.Created)
+	require.Len(t, doc.Packages, 1)
+	assert.Equal(t, "git+https://github.com/linuxkit/linuxkit@0123456789abcdef0123456789abcdef01234567", doc.Packages[0].DownloadLocation)
+	assert.Contains(t, doc.Packages[0].SourceInfo, "git commit 0123456789abcdef0123456789abcdef01234567")
+	assert.Contains(t, doc.Packages[0].SourceInfo, "tree abc")
+	require.Len(t, doc.Files, 2)
+	assert.Equal(t, "./Dockerfile", doc.Files[0].FileName)
+	assert.Equal(t, "1111", doc.Files[0].Checksums[0].ChecksumValue)
+	assert.Equal(t, []string{doc.Files[0].SPDXID, doc.Files[1].SPDXID}, doc.Packages[0].HasFiles)
+}
+
+func TestGenerateSBOMCycloneDX(t *testing.T) {
+	b, err := generateSBOM(SBOMFormatCycloneDX, testSBOMSource())
+	require.NoError(t, err)
+
+	var doc cycloneDXDoc
+	require.NoError(t, json.Unmarshal(b, &doc))
+	assert.Equal(t, "CycloneDX", doc.BOMFormat)
+	assert.True(t, strings.HasPrefix(doc.SerialNumber, "urn:uuid:"))
+	assert.Equal(t, "docker.io/linuxkit/foo:abc", doc.Metadata.Component.Version)
+	assert.Contains(t, doc.Metadata.Component.Properties, cycloneDXProperty{annotationGitCommit, "0123456789abcdef0123456789abcdef01234567"})
+	assert.Contains(t, doc.Metadata.Component.Properties, cycloneDXProperty{annotationTreeHash, "abc"})
+	require.Len(t, doc.Components, 2)
+	assert.Equal(t, "build.yml", doc.Components[1].Name)
+	assert.Equal(t, "2222", doc.Components[1].Hashes[0].Content)
+}
+
+func TestGenerateSBOMUnknownFormat(t *testing.T) {
+	_, err := generateSBOM("swid", testSBOMSource())
+	assert.Error(t, err)
+	assert.Error(t, WithBuildSBOM("swid")(&buildOpts{}))
+}
+
+func TestSBOMSource(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	repo := testRepo(t, tmpDir)
+
+	pkgs, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+
+	src, err := pkgs[0].sbomSource()
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD")), src.commit)
+	assert.Equal(t, pkgs[0].Hash(), src.treeHash)
+	require.Len(t, src.files, 2)
+	assert.Equal(t, "Dockerfile", src.files[0].name)
+	assert.Equal(t, "build.yml", src.files[1].name)
+
+	// with -hash the tree hash is looked up for the SBOM
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	pkgs, err = NewFromCLI(fs, "-hash", "foo", filepath.Join(repo, "pkg"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	src, err = pkgs[0].sbomSource()
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD:pkg")), src.treeHash)
+
+	// and is unknown for a package which is not committed
+	writeFile(t, filepath.Join(repo, "new", "build.yml"), "image: new\n")
+	fs = flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	pkgs, err = NewFromCLI(fs, "-hash", "foo", filepath.Join(repo, "new"))
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	assert.Equal(t, "linuxkit/new:foo", pkgs[0].Tag())
+	src, err = pkgs[0].sbomSource()
+	require.NoError(t, err)
+	assert.Empty(t, src.treeHash)
+}
+
+func TestNewReferrer(t *testing.T) {
+	subject := registry.Descriptor{
+		MediaType: types.OCIImageIndex,
+		Size:      123,
+		Digest:    registry.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)},
+	}
+	a, err := newReferrer(subject, sbomMediaTypeSPDX, []byte(`{"spdxVersion":"SPDX-2.3"}`), map[string]string{annotationTreeHash: "abc"})
+	require.NoError(t, err)
+
+	var m referrerManifest
+	require.NoError(t, json.Unmarshal(a.manifest, &m))
+	assert.Equal(t, sbomMediaTypeSPDX, m.ArtifactType)
+	assert.Equal(t, types.MediaType(emptyMediaType), m.Config.MediaType)
+	require.NotNil(t, m.Subject)
+	assert.Equal(t, subject.Digest, m.Subject.Digest)
+	assert.Equal(t, "abc", m.Annotations[annotationTreeHash])
+
+	img, err := partial.CompressedToImage(a)
+	require.NoError(t, err)
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	d, err := layers[0].Digest()
+	require.NoError(t, err)
+	assert.Equal(t, m.Layers[0].Digest, d)
+	_, err = partial.ConfigLayer(img)
+	require.NoError(t, err)
+}
+
+func TestAddReferrer(t *testing.T) {
+	desc := func(c string) referrerDescriptor {
+		return referrerDescriptor{
+			Descriptor:   registry.Descriptor{MediaType: types.OCIManifestSchema1, Size: 1, Digest: registry.Hash{Algorithm: "sha256", Hex: strings.Repeat(c, 64)}},
+			ArtifactType: sbomMediaTypeSPDX,
+		}
+	}
+
+	b, err := addReferrer(nil, desc("a"))
+	require.NoError(t, err)
+	b, err = addReferrer(b, desc("b"))
+	require.NoError(t, err)
+	b, err = addReferrer(b, desc("a"))
+	require.NoError(t, err)
+
+	var index referrersIndex
+	require.NoError(t, json.Unmarshal(b, &index))
+	assert.Equal(t, types.OCIImageIndex, index.MediaType)
+	require.Len(t, index.Manifests, 2)
+	assert.Equal(t, desc("a"), index.Manifests[0])
+	assert.Equal(t, desc("b"), index.Manifests[1])
+
+	_, err = addReferrer([]byte("not json"), desc("a"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package pkglib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	lktregistry "github.com/linuxkit/linuxkit/src/cmd/linuxkit/registry"
+)
+
+// cosignPath is the cosign executable used to sign pushed images
+var cosignPath = "cosign"
+
+// cosignSignArgs are the arguments of cosign signing ref with key,
+// keyless when it is empty, and the annotations
+func cosignSignArgs(ref, key string, annotations map[string]string) []string {
+	args := []string{"sign", "--yes"}
+	if key != "" {
+		args = append(args, "--key", key)
+	}
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-a", k+"="+annotations[k])
+	}
+	return append(args, ref)
+}
+
+// signImage signs the manifest name points to in the registry with cosign,
+// which pushes the signature next to it as an OCI artifact. key is any
+// cosign key reference, a file or a KMS URI, or empty to sign keyless with
+// the identity cosign gets from its usual environment and OIDC flow.
+func signImage(writer io.Writer, name, key string, annotations map[string]string) error {
+	ref, err := namepkg.ParseReference(name)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(lktregistry.Keychain))
+	if err != nil {
+		return fmt.Errorf("unable to find %s in registry: %v", name, err)
+	}
+	// sign the digest, a tag could be moved in between
+	digest := ref.Context().Digest(desc.Digest.String()).String()
+
+	fmt.Fprintf(writer, "Signing %s\n", digest)
+	cmd := exec.Command(cosignPath, cosignSignArgs(digest, key, annotations)...)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	cmd.Env = os.Environ()
+	if key == "" {
+		// cosign 1.x only signs keyless as an experimental feature
+		cmd.Env = append(cmd.Env, "COSIGN_EXPERIMENTAL=1")
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to sign %s with cosign: %v", digest, err)
+	}
+	return nil
+}
+
+// sign signs the pushed manifest of p with key, recording the commit and
+// tree hash it is built from as annotations of the signature
+func (p Pkg) sign(key string, writer io.Writer) error {
+	commit, treeHash, err := p.revision()
+	if err != nil {
+		return err
+	}
+	return signImage(writer, p.FullTag(), key, revisionAnnotations(commit, treeHash))
+}
@@ -0,0 +1,209 @@
+package pkglib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	namepkg "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is an in-memory registry, with just enough of the
+// distribution API to push and pull images
+type testRegistry struct {
+	sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte
+}
+
+func newTestRegistry() (*httptest.Server, string) {
+	r := &testRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}, types: map[string]string{}, uploads: map[string][]byte{}}
+	s := httptest.NewServer(r)
+	return s, strings.TrimPrefix(s.URL, "http://")
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if p == "" || p == "/v2" {
+		return
+	}
+	switch {
+	case strings.Contains(p, "/manifests/"):
+		parts := strings.SplitN(p, "/manifests/", 2)
+		key := parts[0] + "@" + parts[1]
+		switch req.Method {
+		case http.MethodPut:
+			b, _ := ioutil.ReadAll(req.Body)
+			d := fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+			for _, k := range []string{key, parts[0] + "@" + d} {
+				r.manifests[k] = b
+				r.types[k] = req.Header.Get("Content-Type")
+			}
+			w.Header().Set("Docker-Content-Digest", d)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet, http.MethodHead:
+			b, ok := r.manifests[key]
+			if !ok {
+				http.Error(w, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`, http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", r.types[key])
+			w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256(b)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+			if req.Method == http.MethodGet {
+				w.Write(b)
+			}
+		}
+	case strings.Contains(p, "/blobs/uploads/"):
+		id := p[strings.Index(p, "/blobs/uploads/")+len("/blobs/uploads/"):]
+		switch req.Method {
+		case http.MethodPost:
+			id = fmt.Sprint(len(r.uploads) + 1)
+			r.uploads[id] = nil
+			w.Header().Set("Location", req.URL.Path+id)
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch:
+			b, _ := ioutil.ReadAll(req.Body)
+			r.uploads[id] = append(r.uploads[id], b...)
+			w.Header().Set("Location", req.URL.Path)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.uploads[id])-1))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			b, _ := ioutil.ReadAll(req.Body)
+			r.blobs[req.URL.Query().Get("digest")] = append(r.uploads[id], b...)
+			delete(r.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.Contains(p, "/blobs/"):
+		b, ok := r.blobs[p[strings.Index(p, "/blobs/")+len("/blobs/"):]]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"BLOB_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// pushTestImage pushes an empty image to name
+func pushTestImage(t *testing.T, name string) string {
+	ref, err := namepkg.ParseReference(name)
+	require.NoError(t, err)
+	require.NoError(t, remote.Write(ref, empty.Image))
+	d, err := empty.Image.Digest()
+	require.NoError(t, err)
+	return d.String()
+}
+
+// withCosign runs f with cosignPath set to path
+func withCosign(path string, f func()) {
+	saved := cosignPath
+	defer func() { cosignPath = saved }()
+	cosignPath = path
+	f()
+}
+
+func TestCosignSignArgs(t *testing.T) {
+	assert.Equal(t, []string{"sign", "--yes", "example.com/foo@sha256:abc"}, cosignSignArgs("example.com/foo@sha256:abc", "", nil))
+	assert.Equal(t, []string{
+		"sign", "--yes", "--key", "cosign.key",
+		"-a", annotationGitCommit + "=0123",
+		"-a", annotationTreeHash + "=abc",
+		"example.com/foo@sha256:abc",
+	}, cosignSignArgs("example.com/foo@sha256:abc", "cosign.key", revisionAnnotations("0123", "abc")))
+}
+
+func TestSignImageByDigest(t *testing.T) {
+	s, host := newTestRegistry()
+	defer s.Close()
+	name := host + "/linuxkit/foo:abc"
+	digest := pushTestImage(t, name)
+
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	log := filepath.Join(tmpDir, "log")
+	cosign := filepath.Join(tmpDir, "cosign")
+	writeFile(t, cosign, "#!/bin/sh\necho \"$COSIGN_EXPERIMENTAL $*\" > "+log+"\n")
+	require.NoError(t, os.Chmod(cosign, 0755))
+
+	withCosign(cosign, func() {
+		var out bytes.Buffer
+		require.NoError(t, signImage(&out, name, "cosign.key", map[string]string{annotationTreeHash: "abc"}))
+		b, err := ioutil.ReadFile(log)
+		require.NoError(t, err)
+		assert.Equal(t, " sign --yes --key cosign.key -a "+annotationTreeHash+"=abc "+host+"/linuxkit/foo@"+digest+"\n", string(b))
+
+		// keyless
+		require.NoError(t, signImage(&out, name, "", nil))
+		b, err = ioutil.ReadFile(log)
+		require.NoError(t, err)
+		assert.Equal(t, "1 sign --yes "+host+"/linuxkit/foo@"+digest+"\n", string(b))
+	})
+
+	withCosign("false", func() {
+		assert.Error(t, signImage(ioutil.Discard, name, "cosign.key", nil))
+	})
+	assert.Error(t, signImage(ioutil.Discard, host+"/linuxkit/missing:abc", "cosign.key", nil))
+}
+
+// TestSignImageCosign signs an image with a local key pair using cosign,
+// and verifies the signature and its annotations
+func TestSignImageCosign(t *testing.T) {
+	if _, err := exec.LookPath("cosign"); err != nil {
+		t.Skip("cosign is not available")
+	}
+	s, host := newTestRegistry()
+	defer s.Close()
+	name := host + "/linuxkit/foo:abc"
+	pushTestImage(t, name)
+
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+	cosignEnv := append(os.Environ(), "COSIGN_PASSWORD=")
+	cmd := exec.Command("cosign", "generate-key-pair")
+	cmd.Dir = tmpDir
+	cmd.Env = cosignEnv
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	saved := os.Getenv("COSIGN_PASSWORD")
+	os.Setenv("COSIGN_PASSWORD", "")
+	defer os.Setenv("COSIGN_PASSWORD", saved)
+	// the transparency log is not reachable from tests, nor is the
+	// registry served over TLS
+	tlog := filepath.Join(tmpDir, "cosign-sign")
+	writeFile(t, tlog, "#!/bin/sh\nexec cosign \"$@\" --tlog-upload=false --allow-insecure-registry\n")
+	require.NoError(t, os.Chmod(tlog, 0755))
+
+	withCosign(tlog, func() {
+		require.NoError(t, signImage(ioutil.Discard, name, filepath.Join(tmpDir, "cosign.key"), revisionAnnotations("0123", "abc")))
+	})
+
+	cmd = exec.Command("cosign", "verify", "--insecure-ignore-tlog", "--allow-insecure-registry",
+		"--key", filepath.Join(tmpDir, "cosign.pub"),
+		"-a", annotationGitCommit+"=0123", "-a", annotationTreeHash+"=abc", name)
+	cmd.Env = cosignEnv
+	out, err = cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
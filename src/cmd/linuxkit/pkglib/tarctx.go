@@ -0,0 +1,193 @@
+package pkglib
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tarContextPrefix introduces a tarball given to -context
+const tarContextPrefix = "tar:"
+
+// parseContext returns the absolute path of the tarball named by the
+// -context spec tar:<path>
+func parseContext(spec string) (string, error) {
+	if !strings.HasPrefix(spec, tarContextPrefix) || spec == tarContextPrefix {
+		return "", fmt.Errorf("Bad -context %q, must be tar:<path>", spec)
+	}
+	return filepath.Abs(strings.TrimPrefix(spec, tarContextPrefix))
+}
+
+// tarFile is an open package source tarball, which may be gzip
+// compressed
+type tarFile struct {
+	*tar.Reader
+	f *os.File
+}
+
+func openTar(file string) (*tarFile, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("unable to read %s: %v", file, err)
+		}
+		r = zr
+	}
+	return &tarFile{Reader: tar.NewReader(r), f: f}, nil
+}
+
+func (t *tarFile) Close() error {
+	return t.f.Close()
+}
+
+// next returns the next entry with its name relative to the root of the
+// tarball, skipping the root itself
+func (t *tarFile) next(file string) (*tar.Header, error) {
+	for {
+		h, err := t.Next()
+		if err != nil {
+			if err != io.EOF {
+				err = fmt.Errorf("unable to read %s: %v", file, err)
+			}
+			return nil, err
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := path.Clean("/" + h.Name)[1:]
+		if name == "" {
+			continue
+		}
+		h.Name = name
+		return h, nil
+	}
+}
+
+// tarReadFile returns the contents of the regular file name in the tarball
+func tarReadFile(file, name string) ([]byte, error) {
+	t, err := openTar(file)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	for {
+		h, err := t.next(file)
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no %s", file, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Name == name && h.Typeflag == tar.TypeReg {
+			b := make([]byte, h.Size)
+			if _, err := io.ReadFull(t, b); err != nil {
+				return nil, fmt.Errorf("unable to read %s from %s: %v", name, file, err)
+			}
+			return b, nil
+		}
+	}
+}
+
+// tarContentHash is the equivalent of contentHash for a tarball. It
+// combines the mode and a digest of each regular file, symlink and hard
+// link, in sorted name order, into a single digest, like hashContents.
+// Only the paths, contents, link targets and executable bits of entries
+// count, so tarballs which differ only in the order of their entries,
+// their timestamps or ownership have the same hash. Directories and
+// other entries are not hashed, as git does not track them either.
+func tarContentHash(file string) (string, error) {
+	t, err := openTar(file)
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	type entry struct{ mode, digest string }
+	entries := map[string]entry{}
+	for {
+		h, err := t.next(file)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		var e entry
+		switch h.Typeflag {
+		case tar.TypeReg:
+			e.mode = regularMode
+			if h.Mode&0111 != 0 {
+				e.mode = executableMode
+			}
+			d := sha256.New()
+			if _, err := io.Copy(d, t); err != nil {
+				return "", fmt.Errorf("unable to hash %s in %s: %v", h.Name, file, err)
+			}
+			e.digest = fmt.Sprintf("%x", d.Sum(nil))
+		case tar.TypeSymlink:
+			e.mode = symlinkMode
+			e.digest = fmt.Sprintf("%x", sha256.Sum256([]byte(h.Linkname)))
+		case tar.TypeLink:
+			e.mode = "hardlink"
+			e.digest = fmt.Sprintf("%x", sha256.Sum256([]byte(path.Clean("/" + h.Linkname)[1:])))
+		default:
+			continue
+		}
+		// as when extracting, a later entry replaces an earlier one
+		entries[h.Name] = e
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s %s\x00", name, entries[name].mode, entries[name].digest)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// addTar adds the entries of the tarball s to the build context
+func (c *buildCtx) addTar(tw *tar.Writer, s pkgSource) error {
+	t, err := openTar(s.src)
+	if err != nil {
+		return fmt.Errorf("ctx: %v", err)
+	}
+	defer t.Close()
+	for {
+		h, err := t.next(s.src)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("ctx: %v", err)
+		}
+		h.Name = path.Join(s.dst, h.Name)
+		if h.Typeflag == tar.TypeLink {
+			h.Linkname = path.Join(s.dst, path.Clean("/" + h.Linkname)[1:])
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return fmt.Errorf("ctx: Writing header for %s: %v", h.Name, err)
+		}
+		if _, err := io.Copy(tw, t); err != nil {
+			return fmt.Errorf("ctx: Writing %s: %v", h.Name, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package pkglib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	name, content string
+	mode          int64
+	typeflag      byte
+}
+
+// writeTestTar writes entries to file, gzip compressed if compress is set,
+// with modTime as the timestamp of every entry
+func writeTestTar(t *testing.T, file string, compress bool, modTime time.Time, entries ...tarEntry) {
+	f, err := os.Create(file)
+	require.NoError(t, err)
+	defer f.Close()
+	var w io.Writer = f
+	if compress {
+		zw := gzip.NewWriter(f)
+		defer zw.Close()
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: e.mode, ModTime: modTime, Typeflag: e.typeflag}
+		switch e.typeflag {
+		case tar.TypeReg:
+			h.Size = int64(len(e.content))
+		case tar.TypeSymlink, tar.TypeLink:
+			h.Linkname = e.content
+		}
+		require.NoError(t, tw.WriteHeader(h))
+		if e.typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(e.content))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+}
+
+var testTarEntries = []tarEntry{
+	{"./", "", 0755, tar.TypeDir},
+	{"./build.yml", "image: tarred\n", 0644, tar.TypeReg},
+	{"./Dockerfile", "FROM scratch\nCOPY . /\n", 0644, tar.TypeReg},
+	{"./bin/", "", 0755, tar.TypeDir},
+	{"./bin/run", "#!/bin/sh\n", 0755, tar.TypeReg},
+	{"./bin/start", "run", 0777, tar.TypeSymlink},
+}
+
+func tarPkg(t *testing.T, file string) Pkg {
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	pkgs, err := NewFromCLI(fs, "-context", "tar:"+file)
+	require.NoError(t, err)
+	require.Len(t, pkgs, 1)
+	return pkgs[0]
+}
+
+func TestTarContext(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	a := filepath.Join(tmpDir, "a.tar")
+	writeTestTar(t, a, false, time.Unix(1000, 0), testTarEntries...)
+	p := tarPkg(t, a)
+	assert.Regexp(t, "^linuxkit/tarred:[0-9a-f]{64}$", p.Tag())
+	assert.False(t, p.Dirty())
+
+	// the same content, in another order, at another time, compressed
+	var reordered []tarEntry
+	for i := len(testTarEntries) - 1; i >= 0; i-- {
+		reordered = append(reordered, testTarEntries[i])
+	}
+	b := filepath.Join(tmpDir, "b.tar.gz")
+	writeTestTar(t, b, true, time.Unix(2000, 0), reordered...)
+	assert.Equal(t, p.Tag(), tarPkg(t, b).Tag())
+
+	// the executable bit, contents and link targets all count
+	for i, e := range testTarEntries {
+		changed := append([]tarEntry{}, testTarEntries...)
+		switch e.typeflag {
+		case tar.TypeReg:
+			if e.mode&0111 != 0 {
+				changed[i].mode = 0644
+			} else {
+				changed[i].content += "\n"
+			}
+		case tar.TypeSymlink:
+			changed[i].content = "other"
+		default:
+			continue
+		}
+		c := filepath.Join(tmpDir, "c.tar")
+		writeTestTar(t, c, false, time.Unix(1000, 0), changed...)
+		assert.NotEqual(t, p.Tag(), tarPkg(t, c).Tag(), "changing %s", e.name)
+	}
+
+	// the build context is the contents of the tarball
+	ctx := &buildCtx{sources: p.sources, commit: p.commitHash}
+	r := ctx.Reader()
+	defer r.Close()
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		files[h.Name] = string(b) + h.Linkname
+	}
+	assert.Equal(t, map[string]string{
+		"/build.yml":  "image: tarred\n",
+		"/Dockerfile": "FROM scratch\nCOPY . /\n",
+		"/bin":        "",
+		"/bin/run":    "#!/bin/sh\n",
+		"/bin/start":  "run",
+	}, files)
+}
+
+func TestTarContextErrors(t *testing.T) {
+	tmpDir := testTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	newFromCLI := func(args ...string) error {
+		_, err := NewFromCLI(flag.NewFlagSet(t.Name(), flag.ContinueOnError), args...)
+		return err
+	}
+
+	noYML := filepath.Join(tmpDir, "noyml.tar")
+	writeTestTar(t, noYML, false, time.Unix(0, 0), tarEntry{"Dockerfile", "FROM scratch\n", 0644, tar.TypeReg})
+	assert.EqualError(t, newFromCLI("-context", "tar:"+noYML), noYML+" has no build.yml")
+
+	extra := filepath.Join(tmpDir, "extra.tar")
+	writeTestTar(t, extra, false, time.Unix(0, 0), tarEntry{"build.yml", "image: x\nextra-sources:\n- ../src:/src\n", 0644, tar.TypeReg})
+	assert.EqualError(t, newFromCLI("-context", "tar:"+extra), "extra-sources cannot be used with -context")
+
+	depends := filepath.Join(tmpDir, "depends.tar")
+	writeTestTar(t, depends, false, time.Unix(0, 0), tarEntry{"build.yml", "image: x\ndepends:\n  packages:\n  - ../base\n", 0644, tar.TypeReg})
+	assert.EqualError(t, newFromCLI("-context", "tar:"+depends), "depends.packages cannot be used with -context")
+
+	assert.Error(t, newFromCLI("-context", "dir:"+tmpDir))
+	assert.Error(t, newFromCLI("-context", "tar:"+noYML, tmpDir))
+}
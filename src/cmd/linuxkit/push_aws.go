@@ -4,12 +4,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -24,6 +26,7 @@ func pushAWS(args []string) {
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push aws [options] path\n\n", invoked)
 		fmt.Printf("'path' specifies the full path of an AWS image. It will be uploaded to S3 and an AMI will be created from it.\n")
+		fmt.Printf("The ID of the AMI is printed on stdout.\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
@@ -32,6 +35,9 @@ func pushAWS(args []string) {
 	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in Amazon S3 and the VM image. Defaults to the base of 'path' with the file extension removed.")
 	enaFlag := flags.Bool("ena", false, "Enable ENA networking")
 	sriovNetFlag := flags.String("sriov", "", "SRIOV network support, set to 'simple' to enable 82599 VF networking")
+	regionFlag := flags.String("region", "", "AWS region to push to. Defaults to the region of the AWS configuration or $AWS_REGION")
+	archFlag := flags.String("arch", "x86_64", "Architecture of the image, x86_64 or arm64. arm64 images have ENA enabled")
+	cleanFlag := flags.Bool("clean", false, "Remove the image from S3 once it is imported")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -52,15 +58,18 @@ func pushAWS(args []string) {
 		sriovNetFlag = nil
 	}
 
-	sess := session.Must(session.NewSession())
-	storage := s3.New(sess)
-
-	ctx, cancelFn := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-	defer cancelFn()
-
 	if bucket == "" {
 		log.Fatalf("Please provide the bucket to use")
 	}
+	if *archFlag != "x86_64" && *archFlag != "arm64" {
+		log.Fatalf("Unsupported architecture %s, valid options are x86_64 and arm64", *archFlag)
+	}
+
+	config := aws.NewConfig()
+	if *regionFlag != "" {
+		config = config.WithRegion(*regionFlag)
+	}
+	sess := session.Must(session.NewSession(config))
 
 	f, err := os.Open(path)
 	if err != nil {
@@ -78,42 +87,140 @@ func pushAWS(args []string) {
 		log.Fatalf("Error reading file information: %v", err)
 	}
 
-	dst := name + filepath.Ext(path)
+	p := awsPush{
+		storage:       s3.New(sess),
+		compute:       ec2.New(sess),
+		pollInterval:  60 * time.Second,
+		uploadTimeout: time.Duration(timeout) * time.Second,
+		Bucket:        bucket,
+		Key:           name + filepath.Ext(path),
+		Name:          name,
+		Arch:          *archFlag,
+		// Graviton instances, all arm64 instances, need ENA
+		ENA:   *enaFlag || *archFlag == "arm64",
+		SRIOV: sriovNetFlag,
+		Clean: *cleanFlag,
+	}
+	imageID, err := p.push(context.Background(), f, fi.Size())
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Created AMI: %s", imageID)
+	fmt.Println(imageID)
+}
+
+// awsStorage is the part of the S3 API used to push an image
+type awsStorage interface {
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
+}
+
+// awsCompute is the part of the EC2 API used to push an image
+type awsCompute interface {
+	ImportSnapshotWithContext(ctx aws.Context, input *ec2.ImportSnapshotInput, opts ...request.Option) (*ec2.ImportSnapshotOutput, error)
+	DescribeImportSnapshotTasksWithContext(ctx aws.Context, input *ec2.DescribeImportSnapshotTasksInput, opts ...request.Option) (*ec2.DescribeImportSnapshotTasksOutput, error)
+	RegisterImageWithContext(ctx aws.Context, input *ec2.RegisterImageInput, opts ...request.Option) (*ec2.RegisterImageOutput, error)
+}
+
+// awsPush pushes a raw image to AWS as an AMI: it uploads the image to
+// S3, imports it as a snapshot, and registers an AMI of the snapshot
+type awsPush struct {
+	storage       awsStorage
+	compute       awsCompute
+	pollInterval  time.Duration
+	uploadTimeout time.Duration
+
+	// Bucket and Key are where the image is uploaded to in S3
+	Bucket, Key string
+	// Name is the name of the AMI
+	Name string
+	// Arch is the architecture of the AMI, x86_64 or arm64
+	Arch  string
+	ENA   bool
+	SRIOV *string
+	// Clean removes the image from S3 once it is imported
+	Clean bool
+}
+
+// push pushes the image of size bytes read from body, and returns the ID of
+// the AMI
+func (p *awsPush) push(ctx context.Context, body io.ReadSeeker, size int64) (string, error) {
 	putParams := &s3.PutObjectInput{
-		Bucket:        aws.String(bucket),
-		Key:           aws.String(dst),
-		Body:          f,
-		ContentLength: aws.Int64(fi.Size()),
+		Bucket:        aws.String(p.Bucket),
+		Key:           aws.String(p.Key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
 		ContentType:   aws.String("application/octet-stream"),
 	}
 	log.Debugf("PutObject:\n%v", putParams)
 
-	_, err = storage.PutObjectWithContext(ctx, putParams)
+	uploadCtx, cancelFn := context.WithTimeout(ctx, p.uploadTimeout)
+	defer cancelFn()
+	if _, err := p.storage.PutObjectWithContext(uploadCtx, putParams); err != nil {
+		return "", fmt.Errorf("Error uploading to S3: %v", err)
+	}
+
+	snapshotID, err := p.importSnapshot(ctx)
+	if p.Clean {
+		deleteParams := &s3.DeleteObjectInput{Bucket: aws.String(p.Bucket), Key: aws.String(p.Key)}
+		log.Debugf("DeleteObject:\n%v", deleteParams)
+		if _, err := p.storage.DeleteObjectWithContext(ctx, deleteParams); err != nil {
+			log.Errorf("Error removing s3://%s/%s: %v", p.Bucket, p.Key, err)
+		}
+	}
 	if err != nil {
-		log.Fatalf("Error uploading to S3: %v", err)
+		return "", err
 	}
+	log.Debugf("SnapshotID: %s", snapshotID)
 
-	compute := ec2.New(sess)
+	regParams := &ec2.RegisterImageInput{
+		Name:         aws.String(p.Name), // Required
+		Architecture: aws.String(p.Arch),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{
+				DeviceName: aws.String("/dev/sda1"),
+				Ebs: &ec2.EbsBlockDevice{
+					DeleteOnTermination: aws.Bool(true),
+					SnapshotId:          aws.String(snapshotID),
+					VolumeType:          aws.String("standard"),
+				},
+			},
+		},
+		Description:        aws.String(fmt.Sprintf("LinuxKit: %s image", p.Name)),
+		RootDeviceName:     aws.String("/dev/sda1"),
+		VirtualizationType: aws.String("hvm"),
+		EnaSupport:         aws.Bool(p.ENA),
+		SriovNetSupport:    p.SRIOV,
+	}
+	log.Debugf("RegisterImage:\n%v", regParams)
+	regResp, err := p.compute.RegisterImageWithContext(ctx, regParams)
+	if err != nil {
+		return "", fmt.Errorf("Error registering the image: %s; %v", p.Name, err)
+	}
+	return aws.StringValue(regResp.ImageId), nil
+}
 
+// importSnapshot imports the image uploaded to S3 as a snapshot, waiting
+// for the import to complete, and returns the ID of the snapshot
+func (p *awsPush) importSnapshot(ctx context.Context) (string, error) {
 	importParams := &ec2.ImportSnapshotInput{
-		Description: aws.String(fmt.Sprintf("LinuxKit: %s", name)),
+		Description: aws.String(fmt.Sprintf("LinuxKit: %s", p.Name)),
 		DiskContainer: &ec2.SnapshotDiskContainer{
-			Description: aws.String(fmt.Sprintf("LinuxKit: %s disk", name)),
+			Description: aws.String(fmt.Sprintf("LinuxKit: %s disk", p.Name)),
 			Format:      aws.String("raw"),
 			UserBucket: &ec2.UserBucket{
-				S3Bucket: aws.String(bucket),
-				S3Key:    aws.String(dst),
+				S3Bucket: aws.String(p.Bucket),
+				S3Key:    aws.String(p.Key),
 			},
 		},
 	}
 	log.Debugf("ImportSnapshot:\n%v", importParams)
 
-	resp, err := compute.ImportSnapshot(importParams)
+	resp, err := p.compute.ImportSnapshotWithContext(ctx, importParams)
 	if err != nil {
-		log.Fatalf("Error importing snapshot: %v", err)
+		return "", fmt.Errorf("Error importing snapshot: %v", err)
 	}
 
-	var snapshotID *string
 	for {
 		describeParams := &ec2.DescribeImportSnapshotTasksInput{
 			ImportTaskIds: []*string{
@@ -121,55 +228,32 @@ func pushAWS(args []string) {
 			},
 		}
 		log.Debugf("DescribeImportSnapshotTask:\n%v", describeParams)
-		status, err := compute.DescribeImportSnapshotTasks(describeParams)
+		status, err := p.compute.DescribeImportSnapshotTasksWithContext(ctx, describeParams)
 		if err != nil {
-			log.Fatalf("Error getting import snapshot status: %v", err)
+			return "", fmt.Errorf("Error getting import snapshot status: %v", err)
 		}
-		if len(status.ImportSnapshotTasks) == 0 {
-			log.Fatalf("Unable to get import snapshot task status")
+		if len(status.ImportSnapshotTasks) == 0 || status.ImportSnapshotTasks[0].SnapshotTaskDetail == nil {
+			return "", fmt.Errorf("Unable to get import snapshot task status")
 		}
-		if *status.ImportSnapshotTasks[0].SnapshotTaskDetail.Status != "completed" {
-			progress := "0"
-			if status.ImportSnapshotTasks[0].SnapshotTaskDetail.Progress != nil {
-				progress = *status.ImportSnapshotTasks[0].SnapshotTaskDetail.Progress
+		detail := status.ImportSnapshotTasks[0].SnapshotTaskDetail
+		switch aws.StringValue(detail.Status) {
+		case "completed":
+			if detail.SnapshotId == nil {
+				return "", fmt.Errorf("SnapshotID unavailable after import completed")
 			}
-			log.Debugf("Task %s is %s%% complete. Waiting 60 seconds...\n", *resp.ImportTaskId, progress)
-			time.Sleep(60 * time.Second)
-			continue
+			return *detail.SnapshotId, nil
+		case "deleting", "deleted":
+			return "", fmt.Errorf("Import snapshot task %s failed: %s", aws.StringValue(resp.ImportTaskId), aws.StringValue(detail.StatusMessage))
+		}
+		progress := "0"
+		if detail.Progress != nil {
+			progress = *detail.Progress
+		}
+		log.Debugf("Task %s is %s%% complete. Waiting %v...\n", aws.StringValue(resp.ImportTaskId), progress, p.pollInterval)
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("Timed out waiting for import snapshot task %s: %v", aws.StringValue(resp.ImportTaskId), ctx.Err())
+		case <-time.After(p.pollInterval):
 		}
-		snapshotID = status.ImportSnapshotTasks[0].SnapshotTaskDetail.SnapshotId
-		break
-	}
-
-	if snapshotID == nil {
-		log.Fatalf("SnapshotID unavailable after import completed")
-	} else {
-		log.Debugf("SnapshotID: %s", *snapshotID)
-	}
-
-	regParams := &ec2.RegisterImageInput{
-		Name:         aws.String(name), // Required
-		Architecture: aws.String("x86_64"),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/sda1"),
-				Ebs: &ec2.EbsBlockDevice{
-					DeleteOnTermination: aws.Bool(true),
-					SnapshotId:          snapshotID,
-					VolumeType:          aws.String("standard"),
-				},
-			},
-		},
-		Description:        aws.String(fmt.Sprintf("LinuxKit: %s image", name)),
-		RootDeviceName:     aws.String("/dev/sda1"),
-		VirtualizationType: aws.String("hvm"),
-		EnaSupport:         enaFlag,
-		SriovNetSupport:    sriovNetFlag,
-	}
-	log.Debugf("RegisterImage:\n%v", regParams)
-	regResp, err := compute.RegisterImage(regParams)
-	if err != nil {
-		log.Fatalf("Error registering the image: %s; %v", name, err)
 	}
-	log.Infof("Created AMI: %s", *regResp.ImageId)
 }
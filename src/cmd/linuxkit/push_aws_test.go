@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAWS records the calls made to S3 and EC2. Each describe call returns
+// the next status of statuses.
+type fakeAWS struct {
+	calls    []string
+	statuses []string
+	put      *s3.PutObjectInput
+	register *ec2.RegisterImageInput
+}
+
+func (f *fakeAWS) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.calls = append(f.calls, "PutObject "+*input.Bucket+"/"+*input.Key)
+	f.put = input
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeAWS) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.calls = append(f.calls, "DeleteObject "+*input.Bucket+"/"+*input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeAWS) ImportSnapshotWithContext(ctx aws.Context, input *ec2.ImportSnapshotInput, opts ...request.Option) (*ec2.ImportSnapshotOutput, error) {
+	f.calls = append(f.calls, "ImportSnapshot "+*input.DiskContainer.UserBucket.S3Bucket+"/"+*input.DiskContainer.UserBucket.S3Key)
+	return &ec2.ImportSnapshotOutput{ImportTaskId: aws.String("import-snap-1")}, nil
+}
+
+func (f *fakeAWS) DescribeImportSnapshotTasksWithContext(ctx aws.Context, input *ec2.DescribeImportSnapshotTasksInput, opts ...request.Option) (*ec2.DescribeImportSnapshotTasksOutput, error) {
+	f.calls = append(f.calls, "DescribeImportSnapshotTasks "+*input.ImportTaskIds[0])
+	if len(f.statuses) == 0 {
+		return &ec2.DescribeImportSnapshotTasksOutput{}, nil
+	}
+	status := f.statuses[0]
+	f.statuses = f.statuses[1:]
+	detail := &ec2.SnapshotTaskDetail{Status: aws.String(status), Progress: aws.String("50")}
+	switch status {
+	case "completed":
+		detail.SnapshotId = aws.String("snap-1")
+	case "deleted":
+		detail.StatusMessage = aws.String("ClientError: Disk validation failed")
+	}
+	return &ec2.DescribeImportSnapshotTasksOutput{ImportSnapshotTasks: []*ec2.ImportSnapshotTask{{SnapshotTaskDetail: detail}}}, nil
+}
+
+func (f *fakeAWS) RegisterImageWithContext(ctx aws.Context, input *ec2.RegisterImageInput, opts ...request.Option) (*ec2.RegisterImageOutput, error) {
+	f.calls = append(f.calls, "RegisterImage "+*input.Name)
+	f.register = input
+	return &ec2.RegisterImageOutput{ImageId: aws.String("ami-1")}, nil
+}
+
+func testAWSPush(f *fakeAWS) *awsPush {
+	return &awsPush{
+		storage:       f,
+		compute:       f,
+		pollInterval:  time.Millisecond,
+		uploadTimeout: time.Minute,
+		Bucket:        "bucket",
+		Key:           "linuxkit.raw",
+		Name:          "linuxkit",
+		Arch:          "arm64",
+		ENA:           true,
+	}
+}
+
+func TestAWSPush(t *testing.T) {
+	f := &fakeAWS{statuses: []string{"active", "active", "completed"}}
+	p := testAWSPush(f)
+	id, err := p.push(context.Background(), strings.NewReader("disk"), 4)
+	require.NoError(t, err)
+	assert.Equal(t, "ami-1", id)
+	assert.Equal(t, []string{
+		"PutObject bucket/linuxkit.raw",
+		"ImportSnapshot bucket/linuxkit.raw",
+		"DescribeImportSnapshotTasks import-snap-1",
+		"DescribeImportSnapshotTasks import-snap-1",
+		"DescribeImportSnapshotTasks import-snap-1",
+		"RegisterImage linuxkit",
+	}, f.calls)
+	assert.Equal(t, int64(4), *f.put.ContentLength)
+	assert.Equal(t, "arm64", *f.register.Architecture)
+	assert.True(t, *f.register.EnaSupport)
+	assert.Equal(t, "snap-1", *f.register.BlockDeviceMappings[0].Ebs.SnapshotId)
+}
+
+func TestAWSPushClean(t *testing.T) {
+	f := &fakeAWS{statuses: []string{"completed"}}
+	p := testAWSPush(f)
+	p.Clean = true
+	_, err := p.push(context.Background(), strings.NewReader("disk"), 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"PutObject bucket/linuxkit.raw",
+		"ImportSnapshot bucket/linuxkit.raw",
+		"DescribeImportSnapshotTasks import-snap-1",
+		"DeleteObject bucket/linuxkit.raw",
+		"RegisterImage linuxkit",
+	}, f.calls)
+
+	// the image is removed when the import fails too
+	f = &fakeAWS{statuses: []string{"active", "deleted"}}
+	p = testAWSPush(f)
+	p.Clean = true
+	_, err = p.push(context.Background(), strings.NewReader("disk"), 4)
+	assert.EqualError(t, err, "Import snapshot task import-snap-1 failed: ClientError: Disk validation failed")
+	assert.Equal(t, "DeleteObject bucket/linuxkit.raw", f.calls[len(f.calls)-1])
+}
+
+func TestAWSPushErrors(t *testing.T) {
+	// no status
+	f := &fakeAWS{}
+	_, err := testAWSPush(f).push(context.Background(), strings.NewReader("disk"), 4)
+	assert.EqualError(t, err, "Unable to get import snapshot task status")
+	assert.NotContains(t, f.calls, "RegisterImage linuxkit")
+
+	// the context ends while waiting
+	f = &fakeAWS{statuses: []string{"active", "active", "active"}}
+	p := testAWSPush(f)
+	p.pollInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = p.push(ctx, strings.NewReader("disk"), 4)
+	assert.EqualError(t, err, "Timed out waiting for import snapshot task import-snap-1: context canceled")
+}
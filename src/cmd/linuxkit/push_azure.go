@@ -1,13 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
+// azureImageAPI is the part of Azure used to push an image
+type azureImageAPI interface {
+	// groupLocation is the location of a resource group
+	groupLocation(ctx context.Context, resourceGroup string) (string, error)
+	// upload uploads a VHD to the page blob of a storage account, and
+	// returns the blob's URI
+	upload(resourceGroup, account, path string) (string, error)
+	// createImage creates a managed image from the VHD at blobURI, and
+	// returns its resource ID
+	createImage(ctx context.Context, resourceGroup, location, name, blobURI string) (string, error)
+}
+
+// azureClients is the azureImageAPI of the clients set up by
+// initializeAzureClients
+type azureClients struct{}
+
+func (azureClients) groupLocation(ctx context.Context, resourceGroup string) (string, error) {
+	return resourceGroupLocation(ctx, resourceGroup)
+}
+
+func (azureClients) upload(resourceGroup, account, path string) (string, error) {
+	uploadVMImage(resourceGroup, account, path)
+	return azureBlobURI(account), nil
+}
+
+func (azureClients) createImage(ctx context.Context, resourceGroup, location, name, blobURI string) (string, error) {
+	return createImage(ctx, resourceGroup, location, name, blobURI)
+}
+
 // Process the run arguments and execute run
 func pushAzure(args []string) {
 	flags := flag.NewFlagSet("azure", flag.ExitOnError)
@@ -15,13 +46,16 @@ func pushAzure(args []string) {
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push azure [options] path\n\n", invoked)
 		fmt.Printf("Push a disk image to Azure\n")
-		fmt.Printf("'path' specifies the path to a VHD. It will be uploaded to an Azure Storage Account.\n")
+		fmt.Printf("'path' specifies the path to a VHD, or a raw disk image. It will be uploaded to an Azure\n")
+		fmt.Printf("Storage Account and a managed image created from it, whose resource ID is printed.\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
 
 	resourceGroup := flags.String("resource-group", "", "Name of resource group to be used for VM")
 	accountName := flags.String("storage-account", "", "Name of the storage account")
+	location := flags.String("location", "", "Location of the image. Defaults to the location of the resource group")
+	nameFlag := flags.String("image-name", "", "Name of the image. Defaults to the name of the VHD without the .vhd extension")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -35,6 +69,11 @@ func pushAzure(args []string) {
 	}
 	path := remArgs[0]
 
+	name := *nameFlag
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), ".vhd")
+	}
+
 	subscriptionID := getEnvVarOrExit("AZURE_SUBSCRIPTION_ID")
 	tenantID := getEnvVarOrExit("AZURE_TENANT_ID")
 
@@ -43,5 +82,42 @@ func pushAzure(args []string) {
 
 	initializeAzureClients(subscriptionID, tenantID, clientID, clientSecret)
 
-	uploadVMImage(*resourceGroup, *accountName, path)
+	id, err := pushAzureImage(context.Background(), azureClients{}, path, *resourceGroup, *accountName, *location, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(id)
+}
+
+// pushAzureImage uploads the disk image path, converted to a fixed VHD with
+// a 1MiB aligned size if it is not one, to the storage account and creates
+// the managed image name from it, in location or else the location of the
+// resource group, and returns the image's resource ID
+func pushAzureImage(ctx context.Context, api azureImageAPI, path, resourceGroup, account, location, name string) (string, error) {
+	if resourceGroup == "" {
+		return "", fmt.Errorf("Please specify the resource group with -resource-group")
+	}
+	if account == "" {
+		return "", fmt.Errorf("Please specify the storage account with -storage-account")
+	}
+
+	vhd, converted, err := azureVHD(path)
+	if err != nil {
+		return "", err
+	}
+	if converted {
+		defer os.Remove(vhd)
+	}
+
+	if location == "" {
+		location, err = api.groupLocation(ctx, resourceGroup)
+		if err != nil {
+			return "", err
+		}
+	}
+	blobURI, err := api.upload(resourceGroup, account, vhd)
+	if err != nil {
+		return "", err
+	}
+	return api.createImage(ctx, resourceGroup, location, name, blobURI)
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAzure records what is pushed to it, with a resource group "linuxkit"
+// in westeurope
+type fakeAzure struct {
+	uploaded, uploadedFrom string
+	images                 map[string]string
+}
+
+func (f *fakeAzure) groupLocation(ctx context.Context, resourceGroup string) (string, error) {
+	if resourceGroup != "linuxkit" {
+		return "", fmt.Errorf("resource group %s not found", resourceGroup)
+	}
+	return "westeurope", nil
+}
+
+func (f *fakeAzure) upload(resourceGroup, account, path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f.uploaded, f.uploadedFrom = string(b), path
+	return azureBlobURI(account), nil
+}
+
+func (f *fakeAzure) createImage(ctx context.Context, resourceGroup, location, name, blobURI string) (string, error) {
+	id := fmt.Sprintf("/subscriptions/s/resourceGroups/%s/providers/Microsoft.Compute/images/%s", resourceGroup, name)
+	f.images[id] = location + " " + blobURI
+	return id, nil
+}
+
+func TestPushAzureImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "push-azure")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	raw := filepath.Join(dir, "linuxkit.img")
+	require.NoError(t, ioutil.WriteFile(raw, []byte("linuxkit"), 0644))
+
+	f := &fakeAzure{images: map[string]string{}}
+	id, err := pushAzureImage(context.Background(), f, raw, "linuxkit", "account", "", "linuxkit")
+	require.NoError(t, err)
+	assert.Equal(t, "/subscriptions/s/resourceGroups/linuxkit/providers/Microsoft.Compute/images/linuxkit", id)
+	assert.Equal(t, "westeurope https://account.blob.core.windows.net/linuxkitcontainer/linuxkitimage.vhd", f.images[id])
+
+	// the converted VHD is uploaded, and removed afterwards
+	assert.Len(t, f.uploaded, vhdAlignment+vhdFooterSize)
+	assert.NotEqual(t, raw, f.uploadedFrom)
+	_, err = os.Stat(f.uploadedFrom)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(raw)
+	assert.NoError(t, err)
+
+	// an aligned fixed VHD is uploaded as it is, and the location is used
+	// over the resource group's
+	vhd := writeAlignedVHD(t, dir)
+	id, err = pushAzureImage(context.Background(), f, vhd, "linuxkit", "account", "northeurope", "other")
+	require.NoError(t, err)
+	assert.Equal(t, vhd, f.uploadedFrom)
+	assert.Equal(t, "northeurope https://account.blob.core.windows.net/linuxkitcontainer/linuxkitimage.vhd", f.images[id])
+}
+
+// writeAlignedVHD writes a fixed VHD of 1MiB to dir, and returns its path
+func writeAlignedVHD(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "aligned.vhd")
+	footer, err := vhdFixedFooter(vhdAlignment)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, append(make([]byte, vhdAlignment), footer...), 0644))
+	return path
+}
+
+func TestPushAzureImageErrors(t *testing.T) {
+	f := &fakeAzure{images: map[string]string{}}
+	_, err := pushAzureImage(context.Background(), f, "disk.vhd", "", "account", "", "linuxkit")
+	assert.Error(t, err)
+	_, err = pushAzureImage(context.Background(), f, "disk.vhd", "linuxkit", "", "", "linuxkit")
+	assert.Error(t, err)
+	_, err = pushAzureImage(context.Background(), f, "does-not-exist.vhd", "linuxkit", "account", "", "linuxkit")
+	assert.Error(t, err)
+	assert.Empty(t, f.images)
+}
@@ -10,12 +10,17 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// gcpImageSuffix is the suffix of the gcp output of a build, and of the
+// images uploaded to GCS
+const gcpImageSuffix = ".img.tar.gz"
+
 func pushGcp(args []string) {
 	flags := flag.NewFlagSet("gcp", flag.ExitOnError)
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
 		fmt.Printf("USAGE: %s push gcp [options] path\n\n", invoked)
 		fmt.Printf("'path' is the full path to a GCP image. It will be uploaded to GCS and GCP VM image will be created from it.\n")
+		fmt.Printf("The self link of the image is printed on stdout.\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
@@ -26,6 +31,7 @@ func pushGcp(args []string) {
 	familyFlag := flags.String("family", "", "GCP Image Family. A group of images where the family name points to the most recent image. *Optional*")
 	nameFlag := flags.String("img-name", "", "Overrides the name used to identify the file in Google Storage and the VM image. Defaults to the base of 'path' with the '.img.tar.gz' suffix removed")
 	nestedVirt := flags.Bool("nested-virt", false, "Enabled nested virtualization for the image")
+	overwrite := flags.Bool("overwrite", false, "Replace the image if there is one of the same name already")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
@@ -46,9 +52,8 @@ func pushGcp(args []string) {
 	family := getStringValue(familyVar, *familyFlag, "")
 	name := getStringValue(nameVar, *nameFlag, "")
 
-	const suffix = ".img.tar.gz"
 	if name == "" {
-		name = strings.TrimSuffix(path, suffix)
+		name = strings.TrimSuffix(path, gcpImageSuffix)
 		name = filepath.Base(name)
 	}
 
@@ -61,12 +66,34 @@ func pushGcp(args []string) {
 		log.Fatalf("Please specify the bucket to use")
 	}
 
-	err = client.UploadFile(path, name+suffix, bucket, public)
+	selfLink, err := pushGcpImage(client, path, name, bucket, family, public, *nestedVirt, *overwrite)
 	if err != nil {
-		log.Fatalf("Error copying to Google Storage: %v", err)
+		log.Fatal(err)
+	}
+	fmt.Println(selfLink)
+}
+
+// pushGcpImage uploads the image at path to bucket as name, and creates an
+// image called name from it, replacing an image of the same name if
+// overwrite. It returns the self link of the image.
+func pushGcpImage(client *GCPClient, path, name, bucket, family string, public, nested, overwrite bool) (string, error) {
+	// check before uploading the image for nothing
+	if !overwrite {
+		exists, err := client.ImageExists(name)
+		if err != nil {
+			return "", fmt.Errorf("Error getting Google Compute Image %s: %v", name, err)
+		}
+		if exists {
+			return "", fmt.Errorf("Google Compute Image %s already exists, use -overwrite to replace it", name)
+		}
+	}
+
+	if err := client.UploadFile(path, name+gcpImageSuffix, bucket, public); err != nil {
+		return "", fmt.Errorf("Error copying to Google Storage: %v", err)
 	}
-	err = client.CreateImage(name, "https://storage.googleapis.com/"+bucket+"/"+name+suffix, family, *nestedVirt, true)
+	selfLink, err := client.CreateImage(name, "https://storage.googleapis.com/"+bucket+"/"+name+gcpImageSuffix, family, nested, overwrite)
 	if err != nil {
-		log.Fatalf("Error creating Google Compute Image: %v", err)
+		return "", fmt.Errorf("Error creating Google Compute Image: %v", err)
 	}
+	return selfLink, nil
 }
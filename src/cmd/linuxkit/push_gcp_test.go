@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+// fakeGCP is a GCP API with the images of a project, "linuxkit"
+type fakeGCP struct {
+	sync.Mutex
+	images   map[string]*compute.Image
+	requests []string
+	uploads  []string
+}
+
+func (f *fakeGCP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	const images = "/compute/v1/projects/linuxkit/global/images"
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/"):
+		b, _ := ioutil.ReadAll(r.Body)
+		f.uploads = append(f.uploads, strings.TrimPrefix(r.URL.Path, "/upload/storage/v1/b/")+" "+string(b))
+		json.NewEncoder(w).Encode(&storage.Object{Name: "uploaded"})
+	case r.Method == "POST" && r.URL.Path == images:
+		var image compute.Image
+		json.NewDecoder(r.Body).Decode(&image)
+		image.SelfLink = "https://www.googleapis.com/compute/v1/projects/linuxkit/global/images/" + image.Name
+		f.images[image.Name] = &image
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "insert-" + image.Name, TargetLink: image.SelfLink})
+	case strings.HasPrefix(r.URL.Path, images+"/"):
+		name := strings.TrimPrefix(r.URL.Path, images+"/")
+		image, ok := f.images[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "not found"}}`))
+			return
+		}
+		if r.Method == "DELETE" {
+			delete(f.images, name)
+			json.NewEncoder(w).Encode(&compute.Operation{Name: "delete-" + name})
+			return
+		}
+		json.NewEncoder(w).Encode(image)
+	case strings.HasPrefix(r.URL.Path, "/compute/v1/projects/linuxkit/global/operations/"):
+		json.NewEncoder(w).Encode(&compute.Operation{Status: "DONE"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func testGCPClient(t *testing.T, f *fakeGCP) *GCPClient {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	c, err := compute.New(server.Client())
+	require.NoError(t, err)
+	c.BasePath = server.URL + "/compute/v1/projects/"
+	s, err := storage.New(server.Client())
+	require.NoError(t, err)
+	s.BasePath = server.URL + "/storage/v1/"
+	return &GCPClient{client: server.Client(), compute: c, storage: s, projectName: "linuxkit"}
+}
+
+func testGCPImage(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "linuxkit-gcp")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "linuxkit.img.tar.gz")
+	require.NoError(t, ioutil.WriteFile(path, []byte("image"), 0644))
+	return path
+}
+
+func TestPushGcpImage(t *testing.T) {
+	f := &fakeGCP{images: map[string]*compute.Image{}}
+	client := testGCPClient(t, f)
+
+	selfLink, err := pushGcpImage(client, testGCPImage(t), "linuxkit", "bucket", "linuxkit-family", false, true, false)
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.googleapis.com/compute/v1/projects/linuxkit/global/images/linuxkit", selfLink)
+	require.Len(t, f.uploads, 1)
+	assert.True(t, strings.HasPrefix(f.uploads[0], "bucket/o "))
+	assert.Contains(t, f.uploads[0], "image")
+	image := f.images["linuxkit"]
+	require.NotNil(t, image)
+	assert.Equal(t, "linuxkit-family", image.Family)
+	assert.Equal(t, "https://storage.googleapis.com/bucket/linuxkit.img.tar.gz", image.RawDisk.Source)
+	assert.Equal(t, []string{"projects/vm-options/global/licenses/enable-vmx"}, image.Licenses)
+}
+
+func TestPushGcpImageExists(t *testing.T) {
+	f := &fakeGCP{images: map[string]*compute.Image{"linuxkit": {Name: "linuxkit", Family: "old"}}}
+	client := testGCPClient(t, f)
+	path := testGCPImage(t)
+
+	// without -overwrite nothing is uploaded
+	_, err := pushGcpImage(client, path, "linuxkit", "bucket", "", false, false, false)
+	assert.EqualError(t, err, "Google Compute Image linuxkit already exists, use -overwrite to replace it")
+	assert.Empty(t, f.uploads)
+	assert.Equal(t, "old", f.images["linuxkit"].Family)
+
+	_, err = pushGcpImage(client, path, "linuxkit", "bucket", "new", false, false, true)
+	require.NoError(t, err)
+	assert.Len(t, f.uploads, 1)
+	assert.Equal(t, "new", f.images["linuxkit"].Family)
+	assert.Contains(t, f.requests, "DELETE /compute/v1/projects/linuxkit/global/images/linuxkit")
+}
@@ -1,19 +1,98 @@
 package registry
 
 import (
+	"fmt"
 	"os"
+	"os/exec"
 
 	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/credentials"
+	"github.com/docker/distribution/reference"
 	dockertypes "github.com/docker/docker/api/types"
+	"github.com/google/go-containerregistry/pkg/authn"
 )
 
 const (
 	registryServer = "https://index.docker.io/v1/"
+	// credentialHelperPrefix is prepended to the name of a credential
+	// helper in the docker config to give its executable
+	credentialHelperPrefix = "docker-credential-"
 )
 
-// GetDockerAuth get an AuthConfig for the default registry server.
-func GetDockerAuth() (dockertypes.AuthConfig, error) {
-	cfgFile := config.LoadDefaultConfigFile(os.Stderr)
-	authconfig, err := cfgFile.GetAuthConfig(registryServer)
+// GetDockerAuth get an AuthConfig for the registry the image ref is in,
+// resolved as the docker CLI does, through the credential helper
+// configured for the registry in credHelpers, the credsStore, or the
+// auths stored in the docker config file itself.
+func GetDockerAuth(ref string) (dockertypes.AuthConfig, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return dockertypes.AuthConfig{}, err
+	}
+	authconfig, err := getAuthConfig(reference.Domain(named))
 	return dockertypes.AuthConfig(authconfig), err
 }
+
+// Keychain resolves registry credentials in the same way as
+// GetDockerAuth, for the go-containerregistry clients
+var Keychain authn.Keychain = keychain{}
+
+type keychain struct{}
+
+func (keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cfg, err := getAuthConfig(target.RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+func getAuthConfig(domain string) (dockertypes.AuthConfig, error) {
+	// docker hub credentials are stored under its v1 index server
+	key := domain
+	if domain == "docker.io" || domain == "index.docker.io" {
+		key = registryServer
+	}
+
+	cf, err := config.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		return dockertypes.AuthConfig{}, err
+	}
+	if !cf.ContainsAuth() {
+		cf.CredentialsStore = credentials.DetectDefaultStore(cf.CredentialsStore)
+	}
+	if err := checkCredentialHelper(cf, key); err != nil {
+		return dockertypes.AuthConfig{}, err
+	}
+	authconfig, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return dockertypes.AuthConfig{}, fmt.Errorf("unable to get credentials for %s: %v", domain, err)
+	}
+	return dockertypes.AuthConfig(authconfig), nil
+}
+
+// checkCredentialHelper returns an error explaining how to fix it if the
+// credential helper configured for key is not installed, rather than the
+// one from running it
+func checkCredentialHelper(cf *configfile.ConfigFile, key string) error {
+	helper, setting := cf.CredentialHelpers[key], "credHelpers"
+	if helper == "" {
+		helper, setting = cf.CredentialsStore, "credsStore"
+	}
+	if helper == "" {
+		return nil
+	}
+	if _, err := exec.LookPath(credentialHelperPrefix + helper); err != nil {
+		return fmt.Errorf("credential helper %s%s, set by %s in %s for %s, is not in PATH: install it or remove it from the docker config", credentialHelperPrefix, helper, setting, cf.Filename, key)
+	}
+	return nil
+}
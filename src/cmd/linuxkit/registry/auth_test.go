@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHelper answers get with a credential naming the server it was asked for
+const fakeHelper = `#!/bin/sh
+[ "$1" = get ] || exit 1
+read server
+echo "{\"ServerURL\":\"$server\",\"Username\":\"user-$server\",\"Secret\":\"secret\"}"
+`
+
+// testDockerConfig points DOCKER_CONFIG at a directory holding config,
+// with a fake credential helper on PATH, until the returned function is
+// called
+func testDockerConfig(t *testing.T, config string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential helper is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "registry-auth")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(fakeHelper), 0755))
+
+	oldConfig, hadConfig := os.LookupEnv("DOCKER_CONFIG")
+	oldPath := os.Getenv("PATH")
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() {
+		os.Setenv("PATH", oldPath)
+		if hadConfig {
+			os.Setenv("DOCKER_CONFIG", oldConfig)
+		} else {
+			os.Unsetenv("DOCKER_CONFIG")
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetDockerAuthCredHelpers(t *testing.T) {
+	defer testDockerConfig(t, `{"credHelpers": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": "fake"}}`)()
+
+	auth, err := GetDockerAuth("123456789012.dkr.ecr.us-east-1.amazonaws.com/linuxkit/init:v1")
+	require.NoError(t, err)
+	assert.Equal(t, "user-123456789012.dkr.ecr.us-east-1.amazonaws.com", auth.Username)
+	assert.Equal(t, "secret", auth.Password)
+
+	// other registries do not use the helper
+	auth, err = GetDockerAuth("linuxkit/init:v1")
+	require.NoError(t, err)
+	assert.Empty(t, auth.Username)
+}
+
+func TestGetDockerAuthCredsStore(t *testing.T) {
+	defer testDockerConfig(t, `{"credsStore": "fake"}`)()
+
+	auth, err := GetDockerAuth("linuxkit/init:v1")
+	require.NoError(t, err)
+	assert.Equal(t, "user-"+registryServer, auth.Username)
+
+	ref, err := name.ParseReference("gcr.io/project/init:v1")
+	require.NoError(t, err)
+	a, err := Keychain.Resolve(ref.Context())
+	require.NoError(t, err)
+	cfg, err := a.Authorization()
+	require.NoError(t, err)
+	assert.Equal(t, &authn.AuthConfig{Username: "user-gcr.io", Password: "secret"}, cfg)
+}
+
+func TestGetDockerAuthMissingHelper(t *testing.T) {
+	defer testDockerConfig(t, `{"credHelpers": {"myregistry.azurecr.io": "acr-env"}}`)()
+
+	_, err := GetDockerAuth("myregistry.azurecr.io/linuxkit/init:v1")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "credential helper docker-credential-acr-env, set by credHelpers in ")
+	assert.Contains(t, err.Error(), "is not in PATH")
+
+	ref, err := name.ParseReference("myregistry.azurecr.io/linuxkit/init:v1")
+	require.NoError(t, err)
+	_, err = Keychain.Resolve(ref.Context())
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPushRetries is the number of times a failed push is retried
+// unless SetPushRetries is called
+const DefaultPushRetries = 3
+
+var (
+	pushRetries = DefaultPushRetries
+	// retryDelay is the delay before the first retry, which doubles
+	// for each one after it up to maxRetryDelay
+	retryDelay    = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// SetPushRetries sets the number of times a push failing with a
+// transient error is retried, 0 disables retrying
+func SetPushRetries(n int) {
+	pushRetries = n
+}
+
+// RetryPush runs push, retrying it with a jittered exponential backoff
+// while it fails with a transient error, such as a 5xx response, a
+// reset connection or a timeout. Other errors, including authentication
+// failures, are returned straight away. what describes the push in the
+// log and the final error.
+func RetryPush(what string, push func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := push()
+		if err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		if attempt > pushRetries {
+			return fmt.Errorf("pushing %s failed on attempt %d of %d: %v", what, attempt, attempt, err)
+		}
+		// wait between half and all of delay, so that concurrent
+		// pushes do not retry in lockstep
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Warnf("pushing %s failed, retrying in %v: %v", what, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// isTransient reports whether err may go away if the request is repeated
+func isTransient(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode >= 500 || terr.StatusCode == http.StatusTooManyRequests
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// some clients only keep the message of the underlying error
+	msg := err.Error()
+	for _, s := range []string{"connection reset by peer", "broken pipe", "i/o timeout", "TLS handshake timeout", "unexpected EOF"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
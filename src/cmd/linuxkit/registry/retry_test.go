@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyRegistry serves a single manifest, failing the first failures
+// requests for it with status
+func flakyRegistry(failures int32, status int) (*httptest.Server, *int32) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if atomic.AddInt32(&requests, 1) <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", string(types.OCIManifestSchema1))
+		w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat("a", 64))
+		w.Header().Set("Content-Length", "123")
+	}))
+	return s, &requests
+}
+
+func headManifest(t *testing.T, s *httptest.Server) func() error {
+	ref, err := name.ParseReference(strings.TrimPrefix(s.URL, "http://")+"/linuxkit/init:v1", name.Insecure)
+	require.NoError(t, err)
+	return func() error {
+		_, err := remote.Head(ref)
+		return err
+	}
+}
+
+func TestRetryPush(t *testing.T) {
+	defer func(d time.Duration) { retryDelay = d }(retryDelay)
+	retryDelay = time.Millisecond
+
+	// fails then succeeds
+	s, requests := flakyRegistry(2, http.StatusServiceUnavailable)
+	defer s.Close()
+	require.NoError(t, RetryPush("init", headManifest(t, s)))
+	assert.Equal(t, int32(3), *requests)
+
+	// gives up
+	s, requests = flakyRegistry(10, http.StatusBadGateway)
+	defer s.Close()
+	err := RetryPush("init", headManifest(t, s))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pushing init failed on attempt 4 of 4: ")
+	assert.Equal(t, int32(DefaultPushRetries+1), *requests)
+
+	// authentication failures are not retried
+	s, requests = flakyRegistry(10, http.StatusUnauthorized)
+	defer s.Close()
+	err = RetryPush("init", headManifest(t, s))
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "attempt")
+	assert.Equal(t, int32(1), *requests)
+}
+
+func TestRetryPushDisabled(t *testing.T) {
+	defer SetPushRetries(DefaultPushRetries)
+	SetPushRetries(0)
+
+	var calls int
+	err := RetryPush("init", func() error {
+		calls++
+		return errors.New("read: connection reset by peer")
+	})
+	assert.EqualError(t, err, "pushing init failed on attempt 1 of 1: read: connection reset by peer")
+	assert.Equal(t, 1, calls)
+}
@@ -19,6 +19,7 @@ func runUsage() {
 	// Please keep these in alphabetical order
 	fmt.Printf("  aws\n")
 	fmt.Printf("  azure\n")
+	fmt.Printf("  clh (cloud-hypervisor)\n")
 	fmt.Printf("  gcp\n")
 	fmt.Printf("  hyperkit [macOS]\n")
 	fmt.Printf("  hyperv [Windows]\n")
@@ -28,6 +29,7 @@ func runUsage() {
 	fmt.Printf("  scaleway\n")
 	fmt.Printf("  vbox\n")
 	fmt.Printf("  vcenter\n")
+	fmt.Printf("  virtualization (or vz) [macOS 11 or later]\n")
 	fmt.Printf("  vmware\n")
 	fmt.Printf("\n")
 	fmt.Printf("'options' are the backend specific options.\n")
@@ -48,6 +50,8 @@ func run(args []string) {
 		runAWS(args[1:])
 	case "azure":
 		runAzure(args[1:])
+	case "clh":
+		runClh(args[1:])
 	case "gcp":
 		runGcp(args[1:])
 	case "help", "-h", "-help", "--help":
@@ -71,6 +75,8 @@ func run(args []string) {
 		runVbox(args[1:])
 	case "vcenter":
 		runVcenter(args[1:])
+	case "virtualization", "vz":
+		runVirtualization(args[1:])
 	default:
 		switch runtime.GOOS {
 		case "darwin":
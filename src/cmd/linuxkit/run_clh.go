@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	clhBinary = "cloud-hypervisor"
+
+	clhNetworkingTap     = "tap"
+	clhNetworkingNone    = "none"
+	clhNetworkingDefault = clhNetworkingTap
+)
+
+// ClhConfig contains the config for cloud-hypervisor
+type ClhConfig struct {
+	// Kernel, Initrd and Cmdline are set to boot a kernel+initrd
+	Kernel, Initrd, Cmdline string
+	// Firmware is set to boot the first disk
+	Firmware string
+	Disks    Disks
+	CPUs     int
+	// Memory is in MB
+	Memory int
+	// NetConfig is the value of --net, or "" for no network device
+	NetConfig  string
+	ClhBinPath string
+}
+
+func runClh(args []string) {
+	invoked := filepath.Base(os.Args[0])
+	flags := flag.NewFlagSet("clh", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run clh [options] path\n\n", invoked)
+		fmt.Printf("'path' specifies the path to the VM image.\n")
+		fmt.Printf("It boots 'path'-kernel/-initrd/-cmdline, or else the disk image 'path'\n")
+		fmt.Printf("with the firmware of -fw.\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+		fmt.Printf("\n")
+		fmt.Printf("cloud-hypervisor needs KVM. Unless a tap device is named, '-networking tap'\n")
+		fmt.Printf("creates one, which needs CAP_NET_ADMIN.\n")
+	}
+
+	state := flags.String("state", "", "Path to directory to keep VM state in")
+	snapshot := flags.Bool("snapshot", false, "Discard the writes to the disks when the VM stops, by running it with temporary copies of them")
+	var disks Disks
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=raw][,readonly]")
+	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
+	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	fw := flags.String("fw", "", "Path to the firmware to boot a disk image with, such as rust-hypervisor-fw or CLOUDHV.fd")
+
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+	clhPath := flags.String("clh", "", "Path to the cloud-hypervisor binary (otherwise look in $PATH)")
+	networking := flags.String("networking", clhNetworkingDefault, "Networking mode. Valid options are 'tap[,name]' and 'none'. 'tap' uses the tap device name, or creates one. 'none' disables networking.")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify the path to the image to boot")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+
+	if *data != "" && *dataPath != "" {
+		log.Fatal("Cannot specify both -data and -data-file")
+	}
+	if !haveKVM() {
+		log.Fatal("cloud-hypervisor needs KVM, and /dev/kvm does not exist")
+	}
+
+	if *state == "" {
+		*state = path + "-state"
+	}
+	if err := os.MkdirAll(*state, 0755); err != nil {
+		log.Fatalf("Could not create state directory: %v", err)
+	}
+
+	config := ClhConfig{CPUs: *cpus, Memory: *mem, ClhBinPath: *clhPath}
+	if _, err := os.Stat(path + "-kernel"); err == nil {
+		config.Kernel, config.Initrd = path+"-kernel", path+"-initrd.img"
+		if _, err := os.Stat(config.Initrd); err != nil {
+			log.Fatalf("Cannot find initrd file (%s): %v", config.Initrd, err)
+		}
+		cmdline, err := ioutil.ReadFile(path + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot open cmdline file: %v", err)
+		}
+		config.Cmdline = strings.TrimSpace(string(cmdline))
+	} else {
+		if _, err := os.Stat(path); err != nil {
+			log.Fatalf("Cannot find kernel file %s or disk image %s", path+"-kernel", path)
+		}
+		if *fw == "" {
+			log.Fatalf("Booting the disk image %s needs firmware, pass the path to rust-hypervisor-fw or CLOUDHV.fd with -fw", path)
+		}
+		config.Firmware = *fw
+		config.Disks = append(config.Disks, DiskConfig{Path: path})
+	}
+
+	for i, d := range disks {
+		if d.Size != 0 && d.Path == "" {
+			d.Path = filepath.Join(*state, "disk"+strconv.Itoa(i)+".raw")
+		}
+		if d.Path == "" {
+			log.Fatalf("disk specified with no size or name")
+		}
+		if _, err := os.Stat(d.Path); err != nil {
+			if d.ReadOnly {
+				log.Fatalf("Read-only disk [%s] does not exist", d.Path)
+			}
+			if d.Format != "" && d.Format != "raw" {
+				log.Fatalf("Cannot create disk %s: only raw disks can be created, not %s", d.Path, d.Format)
+			}
+		}
+		if err := createRawDisk(d); err != nil {
+			log.Fatalf("Cannot create disk %s: %v", d.Path, err)
+		}
+		config.Disks = append(config.Disks, d)
+	}
+
+	metadataPaths, err := CreateMetadataISO(*state, *data, *dataPath)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, p := range metadataPaths {
+		config.Disks = append(config.Disks, DiskConfig{Path: p, ReadOnly: true})
+	}
+
+	cleanup := func() {}
+	if *snapshot {
+		config.Disks, cleanup, err = snapshotDisks(config.Disks)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var mac net.HardwareAddr
+	if *networking != clhNetworkingNone {
+		mac = retrieveMAC(*state)
+	}
+	config.NetConfig, err = clhNetConfig(*networking, mac)
+	if err != nil {
+		cleanup()
+		log.Fatal(err)
+	}
+
+	config, err = clhDiscoverBinary(config)
+	if err != nil {
+		cleanup()
+		log.Fatal(err)
+	}
+
+	clhCmd := exec.Command(config.ClhBinPath, buildClhCmdline(config)...)
+	log.Debugf("%v\n", clhCmd.Args)
+	clhCmd.Stdin = os.Stdin
+	clhCmd.Stdout = os.Stdout
+	clhCmd.Stderr = os.Stderr
+	err = clhCmd.Run()
+	cleanup()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// clhNetConfig is the value of --net for the networking mode networking,
+// with mac, or "" for no network device
+func clhNetConfig(networking string, mac net.HardwareAddr) (string, error) {
+	netMode := strings.SplitN(networking, ",", 2)
+	switch netMode[0] {
+	case clhNetworkingTap:
+		// without a name cloud-hypervisor creates a tap device
+		if len(netMode) == 2 {
+			return fmt.Sprintf("tap=%s,mac=%s", netMode[1], mac), nil
+		}
+		return fmt.Sprintf("mac=%s", mac), nil
+	case clhNetworkingNone:
+		return "", nil
+	default:
+		return "", fmt.Errorf("Invalid networking mode: %s", netMode[0])
+	}
+}
+
+// clhDiscoverBinary finds the cloud-hypervisor binary of config, in $PATH
+// unless it is set
+func clhDiscoverBinary(config ClhConfig) (ClhConfig, error) {
+	bin := config.ClhBinPath
+	if bin == "" {
+		bin = clhBinary
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		if config.ClhBinPath != "" {
+			return config, fmt.Errorf("Unable to run %s: %v", config.ClhBinPath, err)
+		}
+		return config, fmt.Errorf("Unable to find %s within the $PATH, install it from https://github.com/cloud-hypervisor/cloud-hypervisor/releases or pass its path with -clh", clhBinary)
+	}
+	config.ClhBinPath = path
+	return config, nil
+}
+
+// buildClhCmdline returns the arguments to run cloud-hypervisor with config,
+// with the serial console on stdio
+func buildClhCmdline(config ClhConfig) []string {
+	var args []string
+	if config.Firmware != "" {
+		args = append(args, "--kernel", config.Firmware)
+	} else {
+		args = append(args, "--kernel", config.Kernel, "--initramfs", config.Initrd)
+		if config.Cmdline != "" {
+			args = append(args, "--cmdline", config.Cmdline)
+		}
+	}
+	args = append(args, "--cpus", fmt.Sprintf("boot=%d", config.CPUs))
+	args = append(args, "--memory", fmt.Sprintf("size=%dM", config.Memory))
+	if len(config.Disks) > 0 {
+		args = append(args, "--disk")
+		for _, d := range config.Disks {
+			disk := "path=" + d.Path
+			if d.ReadOnly {
+				disk += ",readonly=on"
+			}
+			args = append(args, disk)
+		}
+	}
+	if config.NetConfig != "" {
+		args = append(args, "--net", config.NetConfig)
+	}
+	args = append(args, "--serial", "tty", "--console", "off")
+	return args
+}
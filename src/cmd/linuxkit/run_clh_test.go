@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildClhCmdline(t *testing.T) {
+	config := ClhConfig{
+		Kernel:    "image-kernel",
+		Initrd:    "image-initrd.img",
+		Cmdline:   "console=ttyS0 page_poison=1",
+		CPUs:      2,
+		Memory:    2048,
+		Disks:     Disks{{Path: "disk0.raw"}, {Path: "data.iso", ReadOnly: true}},
+		NetConfig: "tap=tap0,mac=02:00:00:00:00:01",
+	}
+	assert.Equal(t, []string{
+		"--kernel", "image-kernel", "--initramfs", "image-initrd.img",
+		"--cmdline", "console=ttyS0 page_poison=1",
+		"--cpus", "boot=2", "--memory", "size=2048M",
+		"--disk", "path=disk0.raw", "path=data.iso,readonly=on",
+		"--net", "tap=tap0,mac=02:00:00:00:00:01",
+		"--serial", "tty", "--console", "off",
+	}, buildClhCmdline(config))
+
+	// a disk with firmware, and no network
+	config = ClhConfig{Firmware: "hypervisor-fw", CPUs: 1, Memory: 1024, Disks: Disks{{Path: "image.raw"}}}
+	assert.Equal(t, []string{
+		"--kernel", "hypervisor-fw",
+		"--cpus", "boot=1", "--memory", "size=1024M",
+		"--disk", "path=image.raw",
+		"--serial", "tty", "--console", "off",
+	}, buildClhCmdline(config))
+}
+
+func TestClhNetConfig(t *testing.T) {
+	mac, err := net.ParseMAC("02:00:00:00:00:01")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		networking, config string
+	}{
+		{"tap", "mac=02:00:00:00:00:01"},
+		{"tap,tap1", "tap=tap1,mac=02:00:00:00:00:01"},
+		{"none", ""},
+	} {
+		config, err := clhNetConfig(tc.networking, mac)
+		assert.NoError(t, err, tc.networking)
+		assert.Equal(t, tc.config, config, tc.networking)
+	}
+	_, err = clhNetConfig("user", mac)
+	assert.EqualError(t, err, "Invalid networking mode: user")
+}
+
+func TestClhDiscoverBinary(t *testing.T) {
+	_, err := clhDiscoverBinary(ClhConfig{ClhBinPath: "/nonexistent/cloud-hypervisor"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to run /nonexistent/cloud-hypervisor")
+}
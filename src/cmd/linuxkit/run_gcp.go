@@ -57,6 +57,9 @@ func runGcp(args []string) {
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	if err := disks.rejectReadOnly("gcp"); err != nil {
+		log.Fatal(err)
+	}
 
 	remArgs := flags.Args()
 	if len(remArgs) == 0 {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -59,6 +60,7 @@ func runHyperKit(args []string) {
 	vsockports := flags.String("vsock-ports", "", "List of vsock ports to forward from the guest on startup (comma separated). A unix domain socket for each port will be created in the state directory")
 	networking := flags.String("networking", hyperkitNetworkingDefault, "Networking mode. Valid options are 'default', 'docker-for-mac', 'vpnkit[,eth-socket-path[,port-socket-path]]', 'vmnet' and 'none'. 'docker-for-mac' connects to the network used by Docker for Mac. 'vpnkit' connects to the VPNKit socket(s) specified. If no socket path is provided a new VPNKit instance will be started and 'vpnkit_eth.sock' and 'vpnkit_port.sock' will be created in the state directory. 'port-socket-path' is only needed if you want to publish ports on localhost using an existing VPNKit instance. 'vmnet' uses the Apple vmnet framework, requires root/sudo. 'none' disables networking.`")
 
+	macFlag := flags.String("mac", "", "'"+macImage+"' for the MAC address of the VM to be derived from the image name, the same for every run of it, by deriving the VPNKit UUID and the UUID of the VM, which vpnkit and vmnet assign it from, from it. hyperkit cannot be given a MAC address")
 	vpnkitUUID := flags.String("vpnkit-uuid", "", "Optional UUID used to identify the VPNKit connection. Overrides 'vpnkit.uuid' in the state directory.")
 	vpnkitPath := flags.String("vpnkit", "", "Path to vpnkit binary")
 	publishFlags := multipleFlag{}
@@ -72,6 +74,7 @@ func runHyperKit(args []string) {
 
 	// Hyperkit settings
 	consoleToFile := flags.Bool("console-file", false, "Output the console to a tty file")
+	consoleLog := flags.String("console-log", "", "File to copy the serial console to, as well as to stdout")
 
 	// Paths and settings for UEFI firmware
 	// Note, the default uses the firmware shipped with Docker for Mac
@@ -80,6 +83,9 @@ func runHyperKit(args []string) {
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	if err := disks.rejectReadOnly("hyperkit"); err != nil {
+		log.Fatal(err)
+	}
 	remArgs := flags.Args()
 	if len(remArgs) == 0 {
 		fmt.Println("Please specify the prefix to the image to boot")
@@ -159,6 +165,21 @@ func runHyperKit(args []string) {
 	}
 	isoPaths = append(isoPaths, metadataPaths...)
 
+	var macUUID string
+	switch *macFlag {
+	case "":
+	case macImage:
+		macUUID = imageUUID(filepath.Base(prefix)).String()
+		if *vpnkitUUID == "" {
+			*vpnkitUUID = macUUID
+		}
+	default:
+		if _, err := parseMAC(*macFlag); err != nil {
+			log.Fatalf("Invalid -mac: %v", err)
+		}
+		log.Fatalf("The hyperkit backend cannot set the MAC address of the VM, which vpnkit or vmnet assign. Use -mac %s for a MAC address derived from the image name", macImage)
+	}
+
 	// Create UUID for VPNKit or reuse an existing one from state dir. IP addresses are
 	// assigned to the UUID, so to get the same IP we have to store the initial UUID. If
 	// has specified a VPNKit UUID the file is ignored.
@@ -185,6 +206,10 @@ func runHyperKit(args []string) {
 
 	// Generate new UUID, otherwise /sys/class/dmi/id/product_uuid is identical on all VMs
 	vmUUID := uuid.New().String()
+	if macUUID != "" {
+		// vmnet assigns the MAC address from it
+		vmUUID = macUUID
+	}
 
 	// Run
 	var cmdline string
@@ -202,7 +227,7 @@ func runHyperKit(args []string) {
 		log.Fatalln("Error creating hyperkit: ", err)
 	}
 
-	if *consoleToFile {
+	if *consoleToFile || *consoleLog != "" {
 		h.Console = hyperkit.ConsoleFile
 	}
 
@@ -341,12 +366,37 @@ func runHyperKit(args []string) {
 		}
 	}
 
-	err = h.Run(cmdline)
+	if *consoleLog != "" {
+		err = runHyperKitConsoleLog(h, cmdline, *consoleLog, !*consoleToFile)
+	} else {
+		err = h.Run(cmdline)
+	}
 	if err != nil {
 		log.Fatalf("Cannot run hyperkit: %v", err)
 	}
 }
 
+// runHyperKitConsoleLog runs h with its console on the tty in its state
+// directory, copied to the console log path, and relayed to stdio unless
+// the console is only for the tty
+func runHyperKitConsoleLog(h *hyperkit.HyperKit, cmdline, path string, stdio bool) error {
+	l, err := openConsoleLog(path)
+	if err != nil {
+		return fmt.Errorf("Cannot create the console log: %v", err)
+	}
+	defer l.Close()
+	exited, err := h.Start(cmdline)
+	if err != nil {
+		return err
+	}
+	var stdin io.Reader
+	var stdout io.Writer = ioutil.Discard
+	if stdio {
+		stdin, stdout = os.Stdin, os.Stdout
+	}
+	return relayConsole(filepath.Join(h.StateDir, "tty"), l, stdin, stdout, exited)
+}
+
 func shutdownVPNKit(process *os.Process) {
 	if process == nil {
 		return
@@ -418,6 +468,40 @@ func launchVPNKit(vpnkitPath, etherSock, vsockSock, portSock string) (*os.Proces
 	return cmd.Process, nil
 }
 
+// imageUUID is a UUID derived from the image name, for vpnkit and vmnet to
+// assign the same MAC address to every run of the image
+func imageUUID(name string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte("linuxkit/image/"+name))
+}
+
+// vpnkitPorts are the VPNKit ports of publishFlags, from their host address
+// or outIP on the host to inIP in the VM. The VM only has the IPv4 address
+// inIP, so ports cannot be published on an IPv6 address.
+func vpnkitPorts(publishFlags []string, outIP, inIP net.IP) ([]*vpnkit.Port, error) {
+	published, err := expandPublishedPorts(publishFlags)
+	if err != nil {
+		return nil, err
+	}
+	var ports []*vpnkit.Port
+	for _, p := range published {
+		out := outIP
+		if p.HostIP != nil {
+			if p.HostIP.To4() == nil {
+				return nil, fmt.Errorf("the hyperkit backend cannot publish port %d on the IPv6 address %s, only on an IPv4 address", p.Host, p.HostIP)
+			}
+			out = p.HostIP
+		}
+		ports = append(ports, &vpnkit.Port{
+			Proto:   vpnkit.Protocol(p.Protocol),
+			OutIP:   out,
+			OutPort: p.Host,
+			InIP:    inIP,
+			InPort:  p.Guest,
+		})
+	}
+	return ports, nil
+}
+
 // vpnkitPublishPorts instructs VPNKit to expose ports from the VM on localhost
 // Pre-register the VM with VPNKit using the UUID. This gives the IP
 // address (if not specified) allowing us to publish ports. It returns
@@ -470,23 +554,15 @@ func vpnkitPublishPorts(h *hyperkit.HyperKit, publishFlags multipleFlag, portSoc
 	}
 
 	// Publish ports
+	vps, err := vpnkitPorts(publishFlags, localhost, vif.IP)
+	if err != nil {
+		return nil, err
+	}
 	var ports []*vpnkit.Port
-	for _, publish := range publishFlags {
-		p, err := NewPublishedPort(publish)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to parse port publish %s: %v", publish, err)
-		}
-
-		log.Debugf("Publishing %s", publish)
-		vp := &vpnkit.Port{
-			Proto:   vpnkit.Protocol(p.Protocol),
-			OutIP:   localhost,
-			OutPort: p.Host,
-			InIP:    vif.IP,
-			InPort:  p.Guest,
-		}
+	for _, vp := range vps {
+		log.Debugf("Publishing %s:%d to %d", vp.Proto, vp.OutPort, vp.InPort)
 		if err = c.Expose(context.Background(), vp); err != nil {
-			return nil, fmt.Errorf("Failed to expose port %s: %v", publish, err)
+			return nil, fmt.Errorf("Failed to expose port %s:%d: %v", vp.Proto, vp.OutPort, err)
 		}
 		ports = append(ports, vp)
 	}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/moby/vpnkit/go/pkg/vpnkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVpnkitPorts(t *testing.T) {
+	out, in := net.ParseIP("127.0.0.1"), net.ParseIP("192.168.65.2")
+	ports, err := vpnkitPorts([]string{"8000-8001:80-81", "53:53/udp"}, out, in)
+	require.NoError(t, err)
+	assert.Equal(t, []*vpnkit.Port{
+		{Proto: vpnkit.TCP, OutIP: out, OutPort: 8000, InIP: in, InPort: 80},
+		{Proto: vpnkit.TCP, OutIP: out, OutPort: 8001, InIP: in, InPort: 81},
+		{Proto: vpnkit.UDP, OutIP: out, OutPort: 53, InIP: in, InPort: 53},
+	}, ports)
+
+	_, err = vpnkitPorts([]string{"8000-8001:80-85"}, out, in)
+	assert.Error(t, err)
+
+	// on an IPv4 address of the host, but not an IPv6 one
+	ports, err = vpnkitPorts([]string{"0.0.0.0:2222:22"}, out, in)
+	require.NoError(t, err)
+	assert.Equal(t, []*vpnkit.Port{{Proto: vpnkit.TCP, OutIP: net.IPv4zero.To4(), OutPort: 2222, InIP: in, InPort: 22}}, ports)
+	_, err = vpnkitPorts([]string{"2222:22", "[::1]:8080:80"}, out, in)
+	assert.EqualError(t, err, "the hyperkit backend cannot publish port 8080 on the IPv6 address ::1, only on an IPv4 address")
+}
+
+func TestImageUUID(t *testing.T) {
+	assert.Equal(t, "874b672b-078f-562c-819e-e8ccd73a2a09", imageUUID("linuxkit").String())
+	assert.Equal(t, imageUUID("linuxkit"), imageUUID("linuxkit"))
+	assert.NotEqual(t, imageUUID("linuxkit"), imageUUID("sshd"))
+}
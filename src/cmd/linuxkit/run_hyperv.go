@@ -36,6 +36,9 @@ func runHyperV(args []string) {
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	if err := disks.rejectReadOnly("hyperv"); err != nil {
+		log.Fatal(err)
+	}
 	remArgs := flags.Args()
 	if len(remArgs) == 0 {
 		fmt.Println("Please specify the path to the ISO image to boot")
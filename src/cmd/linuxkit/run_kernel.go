@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+)
+
+// kernelImageArch is the architecture of the images of a kernel for the
+// qemu architecture arch
+func kernelImageArch(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	}
+	return arch
+}
+
+// kernelImagePrefix makes the prefix kernel-image in state of a
+// kernel+initrd boot with the kernel of the kernel image, extracted once for
+// each digest to the kernels directory of the moby directory, and with
+// initrd and cmdline. It returns the prefix.
+func kernelImagePrefix(image, initrd, cmdline, state, cacheDir, arch string, pull bool) (string, error) {
+	dir, err := moby.ExtractKernel(image, filepath.Join(moby.MobyDir, "kernels"), pull, cacheDir, false, arch)
+	if err != nil {
+		return "", err
+	}
+	initrd, err = filepath.Abs(initrd)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(initrd); err != nil {
+		return "", fmt.Errorf("Cannot boot the kernel of %s: %v", image, err)
+	}
+	prefix := filepath.Join(state, "kernel-image")
+	for suffix, target := range map[string]string{"-kernel": filepath.Join(dir, "kernel"), "-initrd.img": initrd} {
+		_ = os.Remove(prefix + suffix)
+		if err := os.Symlink(target, prefix+suffix); err != nil {
+			return "", err
+		}
+	}
+	if err := ioutil.WriteFile(prefix+"-cmdline", []byte(cmdline), 0644); err != nil {
+		return "", err
+	}
+	return prefix, nil
+}
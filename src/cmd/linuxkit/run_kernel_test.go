@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKernelImage writes a kernel image, with a kernel and the tarball of
+// its modules, to the linuxkit cache in dir as name
+func writeKernelImage(t *testing.T, dir, name string) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, contents string }{
+		{"kernel", "bzImage"},
+		{"kernel.tar", "modules"},
+		{"System.map", "symbols"},
+	} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents))}))
+		_, err := tw.Write([]byte(f.contents))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	require.NoError(t, err)
+	p, err := layout.Write(dir, empty.Index)
+	require.NoError(t, err)
+	require.NoError(t, p.AppendImage(img, layout.WithAnnotations(map[string]string{imagespec.AnnotationRefName: name})))
+}
+
+func TestKernelImagePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-kernel")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d string) { moby.MobyDir = d }(moby.MobyDir)
+	moby.MobyDir = filepath.Join(dir, "moby")
+	cacheDir := filepath.Join(dir, "cache")
+	writeKernelImage(t, cacheDir, "docker.io/linuxkit/kernel:test")
+	initrd := filepath.Join(dir, "linuxkit-initrd.img")
+	require.NoError(t, ioutil.WriteFile(initrd, []byte("initrd"), 0644))
+	state := filepath.Join(dir, "state")
+	require.NoError(t, os.Mkdir(state, 0755))
+
+	prefix, err := kernelImagePrefix("linuxkit/kernel:test", initrd, "console=ttyS0 quiet", state, cacheDir, "amd64", false)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(state, "kernel-image"), prefix)
+	for suffix, contents := range map[string]string{"-kernel": "bzImage", "-initrd.img": "initrd", "-cmdline": "console=ttyS0 quiet"} {
+		b, err := ioutil.ReadFile(prefix + suffix)
+		require.NoError(t, err, suffix)
+		assert.Equal(t, contents, string(b), suffix)
+	}
+
+	// the kernel is extracted only once for its digest
+	kernels, err := filepath.Glob(filepath.Join(moby.MobyDir, "kernels", "sha256-*", "kernel"))
+	require.NoError(t, err)
+	require.Len(t, kernels, 1)
+	require.NoError(t, ioutil.WriteFile(kernels[0], []byte("cached"), 0644))
+	_, err = kernelImagePrefix("linuxkit/kernel:test", initrd, "console=ttyS0", state, cacheDir, "amd64", false)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(prefix + "-kernel")
+	require.NoError(t, err)
+	assert.Equal(t, "cached", string(b))
+
+	// qemu boots the files of the prefix
+	_, args := buildQemuCmdline(QemuConfig{Path: prefix, Kernel: true, StatePath: state, Arch: "x86_64", CPUs: "1", Memory: "512"})
+	containsArgs(t, args, "-kernel", prefix+"-kernel", "-initrd", prefix+"-initrd.img", "-append", "console=ttyS0")
+
+	_, err = kernelImagePrefix("linuxkit/kernel:test", filepath.Join(dir, "missing"), "", state, cacheDir, "amd64", false)
+	assert.Error(t, err)
+}
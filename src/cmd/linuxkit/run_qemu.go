@@ -1,17 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +23,13 @@ import (
 
 const (
 	defaultFWPath = "/usr/share/ovmf/bios.bin"
+	// defaultSecureBootFWPath and defaultSecureBootVarsPath are the OVMF
+	// firmware with secure boot, and its variables with the Microsoft keys
+	// enrolled, as packaged by Debian and Ubuntu
+	defaultSecureBootFWPath   = "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd"
+	defaultSecureBootVarsPath = "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"
+	// secureBootVars is the copy of the variables of a VM in its state
+	secureBootVars = "efi-vars.fd"
 )
 
 // QemuConfig contains the config for Qemu
@@ -26,6 +37,7 @@ type QemuConfig struct {
 	Path           string
 	ISOBoot        bool
 	UEFI           bool
+	SecureBoot     bool
 	SquashFS       bool
 	Kernel         bool
 	GUI            bool
@@ -33,11 +45,13 @@ type QemuConfig struct {
 	ISOImages      []string
 	StatePath      string
 	FWPath         string
+	FWVarsPath     string
 	Arch           string
 	CPUs           string
 	Memory         string
 	Accel          string
 	Detached       bool
+	Snapshot       bool
 	QemuBinPath    string
 	QemuImgPath    string
 	PublishedPorts []string
@@ -45,6 +59,66 @@ type QemuConfig struct {
 	UUID           uuid.UUID
 	USB            bool
 	Devices        []string
+	// GDB is the qemu chardev qemu waits on for gdb before starting the VM
+	GDB string
+	// ConsoleLog is the file the serial console is copied to
+	ConsoleLog string
+	// ExtraArgs are passed to qemu as they are, after the generated args
+	ExtraArgs []string
+	// Virtiofs are the host directories shared with the VM by a virtiofsd
+	Virtiofs []virtiofsShare
+	// VirtiofsdPath is the virtiofsd serving Virtiofs
+	VirtiofsdPath string
+	// Shares9P are the host directories shared with the VM over 9p
+	Shares9P []share9P
+	// MAC is the MAC address of the network interface, if it is not the
+	// one generated for the state directory
+	MAC net.HardwareAddr
+	// Bridge is the bridge of the host the VM is attached to
+	Bridge string
+	// ExitOnMatch stops the VM once a line of the console matches it
+	ExitOnMatch *regexp.Regexp
+	// ExitOnPoweroff stops the VM, as an error, when it reboots or panics
+	// rather than powering off
+	ExitOnPoweroff bool
+	// Timeout stops the VM, as an error, once it has run for it
+	Timeout time.Duration
+}
+
+// guestRestart matches the console lines of a guest rebooting or panicking
+var guestRestart = regexp.MustCompile(`Kernel panic - not syncing|reboot: Restarting system`)
+
+// defaultGDB is the qemu chardev of -gdb without a value, the port of -s
+const defaultGDB = "tcp::1234"
+
+// gdbFlag is the -gdb flag, which may be given without a value for the
+// default port, or with a chardev such as tcp::4321, or just a port
+type gdbFlag string
+
+func (g *gdbFlag) String() string {
+	return string(*g)
+}
+
+func (g *gdbFlag) Set(value string) error {
+	switch {
+	case value == "true":
+		value = defaultGDB
+	case value == "false":
+		value = ""
+	case value == "":
+		return fmt.Errorf("Empty -gdb, it must be a qemu chardev such as tcp::1234, or a port")
+	default:
+		if _, err := strconv.ParseUint(value, 10, 16); err == nil {
+			value = "tcp::" + value
+		}
+	}
+	*g = gdbFlag(value)
+	return nil
+}
+
+// IsBoolFlag lets -gdb be given without a value
+func (g *gdbFlag) IsBoolFlag() bool {
+	return true
 }
 
 const (
@@ -134,21 +208,36 @@ func runQemu(args []string) {
 
 	// Display flags
 	enableGUI := flags.Bool("gui", false, "Set qemu to use video output instead of stdio")
+	var gdb gdbFlag
+	flags.Var(&gdb, "gdb", "Wait for gdb to attach before starting the VM, on "+defaultGDB+" by default, or on the qemu chardev or port of -gdb=, such as -gdb=tcp::4321 or -gdb=4321")
+	consoleLog := flags.String("console-log", "", "File to copy the serial console to, as well as to stdout. With -gui, the serial console is only written to it")
+
+	// Smoke tests
+	exitOnMatch := flags.String("exit-on-match", "", "Stop the VM once a line of the serial console matches this regular expression. linuxkit exits with the status in its (?P<status>...) group if it has one, or 0, and fails if the VM stops before")
+	exitOnPoweroff := flags.Bool("exit-on-poweroff", false, "Exit when the VM powers off, with an error if it reboots or panics rather than rebooting it")
+	timeout := flags.Duration("timeout", 0, "Stop the VM and fail once it has run for this long, such as 5m")
 
 	// Boot type; we try to determine automatically
 	uefiBoot := flags.Bool("uefi", false, "Use UEFI boot")
+	secureBoot := flags.Bool("secure-boot", false, "Use UEFI boot with secure boot enforced, implies -uefi. x86_64 only")
 	isoBoot := flags.Bool("iso", false, "Boot image is an ISO")
 	squashFSBoot := flags.Bool("squashfs", false, "Boot image is a kernel+squashfs+cmdline")
 	kernelBoot := flags.Bool("kernel", false, "Boot image is kernel+initrd+cmdline 'path'-kernel/-initrd/-cmdline")
+	kernelImage := flags.String("kernel-image", "", "Kernel image, such as linuxkit/kernel:5.10.104, to boot the initrd 'path' with, pulled to the -cache and extracted once for each digest")
+	kernelCmdline := flags.String("cmdline", "console=ttyS0", "Kernel command line of a -kernel-image boot")
+	cacheDir := flags.String("cache", defaultLinuxkitCache(), "Directory for caching and finding the -kernel-image")
+	pull := flags.Bool("pull", false, "Always pull the -kernel-image")
 
 	// State flags
 	state := flags.String("state", "", "Path to directory to keep VM state in")
 
 	// Paths and settings for disks
+	snapshot := flags.Bool("snapshot", false, "Discard the writes to the disks when the VM stops, so that they are never modified")
 	var disks Disks
-	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=qcow2]")
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,format=qcow2][,readonly]")
 	data := flags.String("data", "", "String of metadata to pass to VM; error to specify both -data and -data-file")
 	dataPath := flags.String("data-file", "", "Path to file containing metadata to pass to VM; error to specify both -data and -data-file")
+	userData := flags.String("user-data", "", "Path to a cloud-init user-data file, attached with a meta-data file on a NoCloud seed ISO removed after the run")
 
 	if *data != "" && *dataPath != "" {
 		log.Fatal("Cannot specify both -data and -data-file")
@@ -157,6 +246,7 @@ func runQemu(args []string) {
 	// Paths and settings for UEFI firware
 	// Note, we do not use defaultFWPath here as we have a special case for containerised execution
 	fw := flags.String("fw", "", "Path to OVMF firmware for UEFI boot")
+	fwVars := flags.String("fw-vars", "", "Path to the OVMF variables with the secure boot keys enrolled, copied to the state directory, for -secure-boot")
 
 	// VM configuration
 	accel := flags.String("accel", defaultAccel, "Choose acceleration mode. Use 'tcg' to disable it.")
@@ -172,7 +262,8 @@ func runQemu(args []string) {
 	vmUUID := uuid.New()
 
 	// Networking
-	networking := flags.String("networking", qemuNetworkingDefault, "Networking mode. Valid options are 'default', 'user', 'bridge[,name]', tap[,name] and 'none'. 'user' uses QEMUs userspace networking. 'bridge' connects to a preexisting bridge. 'tap' uses a prexisting tap device. 'none' disables networking.`")
+	macFlag := flags.String("mac", "", "MAC address of the network interface of the VM, such as 52:54:00:12:34:56, or '"+macImage+"' for one derived from the image name, the same for every run of it. Defaults to one generated for the state directory")
+	networking := flags.String("networking", qemuNetworkingDefault, "Networking mode. Valid options are 'default', 'user', 'bridge,name' or 'bridge,br=name[,mac=MAC]', tap[,name] and 'none'. 'user' uses QEMUs userspace networking. 'bridge' connects to a preexisting bridge with a tap device created by qemu-bridge-helper, with the MAC generated for the state directory or mac. 'tap' uses a prexisting tap device. 'none' disables networking.`")
 
 	publishFlags := multipleFlag{}
 	flags.Var(&publishFlags, "publish", "Publish a vm's port(s) to the host (default [])")
@@ -180,13 +271,31 @@ func runQemu(args []string) {
 	// USB devices
 	usbEnabled := flags.Bool("usb", false, "Enable USB controller")
 	deviceFlags := multipleFlag{}
-	flags.Var(&deviceFlags, "device", "Add USB host device(s). Format driver[,prop=value][,...] -- add device, like -device on the qemu command line.")
+	flags.Var(&deviceFlags, "device", "Add device(s), such as USB host devices, or vfio-pci,host=0000:01:00.0 to pass through a PCI device. Format driver[,prop=value][,...] -- add device, like -device on the qemu command line.")
+
+	// Arguments passed to qemu as they are
+	qemuArgsFlags := multipleFlag{}
+	var virtiofsFlags multipleFlag
+	flags.Var(&virtiofsFlags, "virtiofs", "Host directory to share with the VM, as src=HOSTDIR,tag=TAG, served by a virtiofsd started for it, which the VM mounts with 'mount -t virtiofs TAG /mnt'. May be repeated")
+	virtiofsd := flags.String("virtiofsd", "", "Path to the virtiofsd of -virtiofs (otherwise look in $PATH, /usr/libexec and /usr/lib/qemu)")
+	var shares9PFlags multipleFlag
+	flags.Var(&shares9PFlags, "9p", "Host directory to share with the VM over 9p, as src=HOSTDIR,tag=TAG[,ro], which the VM mounts with 'mount -t 9p -o trans=virtio,version=9p2000.L TAG /mnt'. Slower than -virtiofs, but needs no daemon. May be repeated")
+	flags.Var(&qemuArgsFlags, "qemu-args", "Extra arguments for qemu, split as a shell does, such as '-device e1000,netdev=n1 -netdev user,id=n1'. They are appended to the generated arguments without being validated, so qemu may reject or misbehave with arguments conflicting with them. May be repeated")
 
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
 	remArgs := flags.Args()
 
+	var extraArgs []string
+	for _, a := range qemuArgsFlags {
+		split, err := splitArgs(a)
+		if err != nil {
+			log.Fatalf("Invalid -qemu-args: %v", err)
+		}
+		extraArgs = append(extraArgs, split...)
+	}
+
 	// These envvars override the corresponding command line
 	// options. So this must remain after the `flags.Parse` above.
 	*accel = getStringValue("LINUXKIT_QEMU_ACCEL", *accel, "")
@@ -199,6 +308,22 @@ func runQemu(args []string) {
 	path := remArgs[0]
 	prefix := path
 
+	// with a kernel image, path is the initrd to boot with its kernel
+	if *kernelImage != "" {
+		prefix = strings.TrimSuffix(strings.TrimSuffix(path, ".img"), "-initrd")
+		if *state == "" {
+			*state = prefix + "-state"
+		}
+		if err := os.MkdirAll(*state, 0755); err != nil {
+			log.Fatalf("Could not create state directory: %v", err)
+		}
+		kernelPrefix, err := kernelImagePrefix(*kernelImage, path, *kernelCmdline, *state, *cacheDir, kernelImageArch(*arch), *pull)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		path = kernelPrefix
+	}
+
 	_, err := os.Stat(path)
 	stat := err == nil
 
@@ -244,6 +369,19 @@ func runQemu(args []string) {
 	}
 	isoPaths = append(isoPaths, metadataPaths...)
 
+	cleanup := func() {}
+	if *userData != "" {
+		if len(metadataPaths) != 0 {
+			log.Fatal("Cannot specify both -user-data and -data or -data-file")
+		}
+		seed, err := CreateNoCloudISO(*state, filepath.Base(prefix), *userData)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		cleanup = cleanupOnSignal(func() { os.Remove(seed) })
+		isoPaths = append(isoPaths, seed)
+	}
+
 	for i, d := range disks {
 		id := ""
 		if i != 0 {
@@ -284,6 +422,7 @@ func runQemu(args []string) {
 	netMode := strings.SplitN(*networking, ",", 2)
 
 	var netdevConfig string
+	var bridge qemuBridge
 	switch netMode[0] {
 	case qemuNetworkingUser:
 		netdevConfig = "user,id=t0"
@@ -302,7 +441,15 @@ func runQemu(args []string) {
 		if len(publishFlags) != 0 {
 			log.Fatalf("Port publishing requires %q networking mode", qemuNetworkingUser)
 		}
-		netdevConfig = fmt.Sprintf("bridge,id=t0,br=%s", netMode[1])
+		if bridge, err = parseQemuBridge(netMode[1]); err != nil {
+			log.Fatalf("Invalid %q networking mode: %v", qemuNetworkingBridge, err)
+		}
+		if runtime.GOOS == "linux" {
+			if err := checkBridge("/", bridge.Name); err != nil {
+				log.Fatal(err)
+			}
+		}
+		netdevConfig = fmt.Sprintf("bridge,id=t0,br=%s", bridge.Name)
 	case qemuNetworkingNone:
 		if len(publishFlags) != 0 {
 			log.Fatalf("Port publishing requires %q networking mode", qemuNetworkingUser)
@@ -312,10 +459,77 @@ func runQemu(args []string) {
 		log.Fatalf("Invalid networking mode: %s", netMode[0])
 	}
 
+	mac := bridge.MAC
+	switch {
+	case *macFlag == "":
+	case mac != nil:
+		log.Fatalf("Cannot specify both -mac and the mac of the %q networking mode", qemuNetworkingBridge)
+	case *macFlag == macImage:
+		mac = imageMAC(filepath.Base(prefix))
+	default:
+		if mac, err = parseMAC(*macFlag); err != nil {
+			log.Fatalf("Invalid -mac: %v", err)
+		}
+	}
+
+	var vfioDevices []string
+	for i, d := range deviceFlags {
+		device, addr, err := parseVfioDevice(d)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if addr != "" {
+			deviceFlags[i] = device
+			vfioDevices = append(vfioDevices, addr)
+		}
+	}
+	if len(vfioDevices) > 0 {
+		if err := checkVfio("/", vfioDevices); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var shares []virtiofsShare
+	for _, v := range virtiofsFlags {
+		share, err := parseVirtiofs(v)
+		if err != nil {
+			log.Fatalf("Invalid -virtiofs: %v", err)
+		}
+		shares = append(shares, share)
+	}
+	var shares9P []share9P
+	for _, v := range shares9PFlags {
+		share, err := parse9P(v)
+		if err != nil {
+			log.Fatalf("Invalid -9p: %v", err)
+		}
+		shares9P = append(shares9P, share)
+	}
+	var exitOn *regexp.Regexp
+	if *exitOnMatch != "" {
+		if *enableGUI {
+			log.Fatal("Cannot specify both -exit-on-match and -gui, the serial console is not on stdout")
+		}
+		if exitOn, err = regexp.Compile(*exitOnMatch); err != nil {
+			log.Fatalf("Invalid -exit-on-match: %v", err)
+		}
+	}
+	if *timeout < 0 {
+		log.Fatalf("Invalid -timeout: %s is negative", *timeout)
+	}
+
+	var virtiofsdPath string
+	if len(shares) != 0 {
+		if virtiofsdPath, err = findVirtiofsd(*virtiofsd); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	config := QemuConfig{
 		Path:           path,
 		ISOBoot:        *isoBoot,
-		UEFI:           *uefiBoot,
+		UEFI:           *uefiBoot || *secureBoot,
+		SecureBoot:     *secureBoot,
 		SquashFS:       *squashFSBoot,
 		Kernel:         *kernelBoot,
 		GUI:            *enableGUI,
@@ -323,36 +537,66 @@ func runQemu(args []string) {
 		ISOImages:      isoPaths,
 		StatePath:      *state,
 		FWPath:         *fw,
+		FWVarsPath:     *fwVars,
 		Arch:           *arch,
 		CPUs:           *cpus,
 		Memory:         *mem,
 		Accel:          *accel,
 		Detached:       *qemuDetached,
+		Snapshot:       *snapshot,
 		QemuBinPath:    *qemuCmd,
 		PublishedPorts: publishFlags,
 		NetdevConfig:   netdevConfig,
 		UUID:           vmUUID,
 		USB:            *usbEnabled,
 		Devices:        deviceFlags,
+		GDB:            string(gdb),
+		ConsoleLog:     *consoleLog,
+		ExtraArgs:      extraArgs,
+		Virtiofs:       shares,
+		VirtiofsdPath:  virtiofsdPath,
+		Shares9P:       shares9P,
+		MAC:            mac,
+		Bridge:         bridge.Name,
+		ExitOnMatch:    exitOn,
+		ExitOnPoweroff: *exitOnPoweroff,
+		Timeout:        *timeout,
 	}
 
 	config, err = discoverBinaries(config)
 	if err != nil {
+		cleanup()
 		log.Fatal(err)
 	}
 
-	if err = runQemuLocal(config); err != nil {
+	err = runQemuLocal(config)
+	cleanup()
+	if status, ok := err.(exitStatusError); ok {
+		log.Error(err)
+		os.Exit(int(status))
+	}
+	if err != nil {
 		log.Fatal(err.Error())
 	}
 }
 
 func runQemuLocal(config QemuConfig) error {
+	shares, stopVirtiofs, err := startVirtiofs(config.VirtiofsdPath, config.Virtiofs)
+	if err != nil {
+		return err
+	}
+	defer stopVirtiofs()
+	config.Virtiofs = shares
+
 	var args []string
 	config, args = buildQemuCmdline(config)
 
 	for _, d := range config.Disks {
 		// If disk doesn't exist then create one
 		if _, err := os.Stat(d.Path); err != nil {
+			if os.IsNotExist(err) && d.ReadOnly {
+				return fmt.Errorf("Read-only disk [%s] does not exist", d.Path)
+			}
 			if os.IsNotExist(err) {
 				log.Debugf("Creating new qemu disk [%s] format %s", d.Path, d.Format)
 				qemuImgCmd := exec.Command(config.QemuImgPath, "create", "-f", d.Format, d.Path, fmt.Sprintf("%dM", d.Size))
@@ -369,7 +613,11 @@ func runQemuLocal(config QemuConfig) error {
 	}
 
 	// Check for OVMF firmware before running
-	if config.UEFI {
+	if config.SecureBoot {
+		if err := setupSecureBoot(config); err != nil {
+			return err
+		}
+	} else if config.UEFI {
 		if config.FWPath == "" {
 			// there is no default on mac
 			if runtime.GOOS == "darwin" {
@@ -390,6 +638,9 @@ func runQemuLocal(config QemuConfig) error {
 		return fmt.Errorf("Detached mode is only supported when running in a container, not locally")
 	}
 
+	for _, c := range qemuArgConflicts(args, config.ExtraArgs) {
+		log.Warnf("-qemu-args conflicts with the generated %s, qemu gets both", c)
+	}
 	qemuCmd := exec.Command(config.QemuBinPath, args...)
 	// If verbosity is enabled print out the full path/arguments
 	log.Debugf("%v\n", qemuCmd.Args)
@@ -399,9 +650,95 @@ func runQemuLocal(config QemuConfig) error {
 		qemuCmd.Stdin = os.Stdin
 		qemuCmd.Stdout = os.Stdout
 		qemuCmd.Stderr = os.Stderr
+		if config.ConsoleLog != "" {
+			l, err := openConsoleLog(config.ConsoleLog)
+			if err != nil {
+				return fmt.Errorf("Cannot create the console log: %v", err)
+			}
+			defer l.Close()
+			qemuCmd.Stdout = l.tee(os.Stdout)
+		}
+	}
+
+	// qemu-bridge-helper reports why it cannot attach to the bridge in the
+	// stderr of qemu
+	var stderr bytes.Buffer
+	if config.Bridge != "" {
+		if qemuCmd.Stderr == nil {
+			qemuCmd.Stderr = &stderr
+		} else {
+			qemuCmd.Stderr = io.MultiWriter(qemuCmd.Stderr, &stderr)
+		}
+	}
+
+	// the console is only watched for a match with -exit-on-match, while a
+	// restart is watched for whenever the console is on stdout
+	var matched, restarted *consoleMatch
+	if config.ExitOnMatch != nil {
+		matched = newConsoleMatch(config.ExitOnMatch)
+		qemuCmd.Stdout = io.MultiWriter(qemuCmd.Stdout, matched)
+	}
+	if config.ExitOnPoweroff && qemuCmd.Stdout != nil {
+		restarted = newConsoleMatch(guestRestart)
+		qemuCmd.Stdout = io.MultiWriter(qemuCmd.Stdout, restarted)
+	}
+	if err := qemuCmd.Start(); err != nil {
+		return err
+	}
+	err = waitQemu(qemuCmd, config, matched, restarted)
+	if err != nil && config.Bridge != "" {
+		if berr := bridgeError(stderr.String(), config.Bridge); berr != nil {
+			return berr
+		}
+	}
+	return err
+}
+
+// waitQemu waits for qemu, started with the console written to matched
+// and restarted, if they are set, to exit, stopping it when the console
+// matches -exit-on-match or at the -timeout
+func waitQemu(cmd *exec.Cmd, config QemuConfig, matched, restarted *consoleMatch) error {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	var match chan []string
+	if matched != nil {
+		match = matched.matched
+	}
+	var timeout <-chan time.Time
+	if config.Timeout > 0 {
+		t := time.NewTimer(config.Timeout)
+		defer t.Stop()
+		timeout = t.C
 	}
 
-	return qemuCmd.Run()
+	select {
+	case err := <-exited:
+		// the console is written before Wait returns, so a match of its
+		// last lines is sent
+		select {
+		case sub := <-match:
+			return matchStatus(config.ExitOnMatch, sub)
+		default:
+		}
+		if restarted != nil {
+			select {
+			case sub := <-restarted.matched:
+				return fmt.Errorf("The VM restarted rather than powering off: %s", sub[0])
+			default:
+			}
+		}
+		if err == nil && matched != nil {
+			return fmt.Errorf("The VM stopped before its console matched -exit-on-match %q", config.ExitOnMatch)
+		}
+		return err
+	case sub := <-match:
+		log.Debugf("Console matched -exit-on-match: %q", sub[0])
+		stopCmd(cmd, exited)
+		return matchStatus(config.ExitOnMatch, sub)
+	case <-timeout:
+		stopCmd(cmd, exited)
+		return fmt.Errorf("Timed out after %s", config.Timeout)
+	}
 }
 
 func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
@@ -440,6 +777,11 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		config.Accel = ""
 	}
 
+	// secure boot needs SMM
+	var smm string
+	if config.SecureBoot {
+		smm = ",smm=on"
+	}
 	if config.Accel != "" {
 		switch config.Arch {
 		case "s390x":
@@ -447,7 +789,7 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		case "aarch64":
 			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("virt,gic_version=host,accel=%s", config.Accel))
 		default:
-			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("q35,accel=%s", config.Accel))
+			qemuArgs = append(qemuArgs, "-machine", fmt.Sprintf("q35%s,accel=%s", smm, config.Accel))
 		}
 	} else {
 		switch config.Arch {
@@ -456,7 +798,7 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		case "aarch64":
 			qemuArgs = append(qemuArgs, "-machine", "virt")
 		default:
-			qemuArgs = append(qemuArgs, "-machine", "q35")
+			qemuArgs = append(qemuArgs, "-machine", "q35"+smm)
 		}
 	}
 
@@ -481,11 +823,15 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		if i >= 2 && config.ISOBoot {
 			index++
 		}
+		drive := "file=" + d.Path
 		if d.Format != "" {
-			qemuArgs = append(qemuArgs, "-drive", "file="+d.Path+",format="+d.Format+",index="+strconv.Itoa(index)+",media=disk")
-		} else {
-			qemuArgs = append(qemuArgs, "-drive", "file="+d.Path+",index="+strconv.Itoa(index)+",media=disk")
+			drive += ",format=" + d.Format
 		}
+		drive += ",index=" + strconv.Itoa(index) + ",media=disk"
+		if d.ReadOnly {
+			drive += ",readonly=on"
+		}
+		qemuArgs = append(qemuArgs, "-drive", drive)
 		lastDisk = index
 	}
 
@@ -493,6 +839,12 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		qemuArgs = append(qemuArgs, "-boot", "d")
 	}
 
+	// qemu writes to temporary files instead of the disks, and removes
+	// them when it exits
+	if config.Snapshot {
+		qemuArgs = append(qemuArgs, "-snapshot")
+	}
+
 	// Ensure CDROMs start from at least hdc
 	if lastDisk < 2 {
 		lastDisk = 2
@@ -513,7 +865,14 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		}
 	}
 
-	if config.UEFI {
+	switch {
+	case config.SecureBoot:
+		// OVMF enforces secure boot only if its variables are protected by
+		// SMM, so the guest cannot change them
+		qemuArgs = append(qemuArgs, "-global", "driver=cfi.pflash01,property=secure,value=on")
+		qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,unit=0,readonly=on,file="+secureBootFWPath(config))
+		qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,unit=1,file="+filepath.Join(config.StatePath, secureBootVars))
+	case config.UEFI:
 		qemuArgs = append(qemuArgs, "-drive", "if=pflash,format=raw,file="+config.FWPath)
 	}
 
@@ -546,7 +905,10 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 	if config.NetdevConfig == "" {
 		qemuArgs = append(qemuArgs, "-net", "none")
 	} else {
-		mac := retrieveMAC(config.StatePath)
+		mac := config.MAC
+		if mac == nil {
+			mac = retrieveMAC(config.StatePath)
+		}
 		if config.Arch == "s390x" {
 			qemuArgs = append(qemuArgs, "-device", "virtio-net-ccw,netdev=t0,mac="+mac.String())
 		} else {
@@ -561,6 +923,13 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 
 	if config.GUI != true {
 		qemuArgs = append(qemuArgs, "-nographic")
+	} else if config.ConsoleLog != "" {
+		qemuArgs = append(qemuArgs, "-serial", "file:"+config.ConsoleLog)
+	}
+
+	// qemu exits rather than restarting the VM
+	if config.ExitOnPoweroff {
+		qemuArgs = append(qemuArgs, "-no-reboot")
 	}
 
 	if config.USB == true {
@@ -570,9 +939,288 @@ func buildQemuCmdline(config QemuConfig) (QemuConfig, []string) {
 		qemuArgs = append(qemuArgs, "-device", d)
 	}
 
+	// vhost-user devices need the memory of the VM to be shared with the
+	// daemons serving them
+	if len(config.Virtiofs) != 0 {
+		size := config.Memory
+		if _, err := strconv.Atoi(size); err == nil {
+			size += "M"
+		}
+		qemuArgs = append(qemuArgs, "-object", "memory-backend-memfd,id=mem,size="+size+",share=on", "-numa", "node,memdev=mem")
+		device := "vhost-user-fs-pci"
+		if config.Arch == "s390x" {
+			device = "vhost-user-fs-ccw"
+		}
+		for i, share := range config.Virtiofs {
+			id := "virtiofs" + strconv.Itoa(i)
+			qemuArgs = append(qemuArgs, "-chardev", "socket,id="+id+",path="+share.Socket)
+			qemuArgs = append(qemuArgs, "-device", device+",queue-size=1024,chardev="+id+",tag="+share.Tag)
+		}
+	}
+
+	for i, share := range config.Shares9P {
+		virtfs := "local,path=" + share.Source + ",mount_tag=" + share.Tag + ",security_model=none,id=fs9p" + strconv.Itoa(i)
+		if share.ReadOnly {
+			virtfs += ",readonly=on"
+		}
+		qemuArgs = append(qemuArgs, "-virtfs", virtfs)
+	}
+
+	// the CPUs are frozen at startup until gdb continues them
+	if config.GDB != "" {
+		qemuArgs = append(qemuArgs, "-gdb", config.GDB, "-S")
+	}
+	qemuArgs = append(qemuArgs, config.ExtraArgs...)
+
 	return config, qemuArgs
 }
 
+// repeatableQemuArgs are the qemu options that may be given more than once,
+// so do not conflict when both linuxkit and -qemu-args give them
+var repeatableQemuArgs = map[string]bool{
+	"-device":  true,
+	"-drive":   true,
+	"-netdev":  true,
+	"-chardev": true,
+	"-object":  true,
+	"-global":  true,
+	"-fw_cfg":  true,
+	"-serial":  true,
+}
+
+// qemuArgConflicts are the generated args, with their value, of the options
+// extra has again, extra being the end of the qemu args
+func qemuArgConflicts(args, extra []string) []string {
+	generated := map[string]string{}
+	for i, a := range args[:len(args)-len(extra)] {
+		if strings.HasPrefix(a, "-") && !repeatableQemuArgs[a] {
+			value := ""
+			if i+1 < len(args)-len(extra) && !strings.HasPrefix(args[i+1], "-") {
+				value = " " + args[i+1]
+			}
+			generated[a] = value
+		}
+	}
+	var conflicts []string
+	for _, a := range extra {
+		if value, ok := generated[a]; ok {
+			conflicts = append(conflicts, a+value)
+			delete(generated, a)
+		}
+	}
+	return conflicts
+}
+
+// secureBootFWPath is the OVMF firmware of config for secure boot
+func secureBootFWPath(config QemuConfig) string {
+	if config.FWPath != "" {
+		return config.FWPath
+	}
+	return defaultSecureBootFWPath
+}
+
+// setupSecureBoot checks the firmware of config supports secure boot, and
+// copies its variables, with the keys enrolled, to the state directory
+// unless the VM already has them
+func setupSecureBoot(config QemuConfig) error {
+	if config.Arch != "x86_64" {
+		return fmt.Errorf("Secure boot is only supported for x86_64, not %s", config.Arch)
+	}
+	fw := secureBootFWPath(config)
+	if _, err := os.Stat(fw); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Secure boot firmware [%s] does not exist, please install OVMF with secure boot or specify it with `--fw <path>`", fw)
+		}
+		return err
+	}
+	vars := filepath.Join(config.StatePath, secureBootVars)
+	if _, err := os.Stat(vars); err == nil {
+		return nil
+	}
+	template := config.FWVarsPath
+	if template == "" {
+		template = defaultSecureBootVarsPath
+	}
+	b, err := ioutil.ReadFile(template)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("Secure boot variables [%s] do not exist, please specify OVMF variables with the keys enrolled with `--fw-vars <path>`", template)
+		}
+		return err
+	}
+	if err := checkSecureBootVars(b); err != nil {
+		return fmt.Errorf("Cannot secure boot with %s: %v", template, err)
+	}
+	return ioutil.WriteFile(vars, b, 0644)
+}
+
+// checkSecureBootVars checks that the OVMF variables vars have the platform
+// key and key exchange keys enrolled, without which OVMF does not enforce
+// secure boot. Variable names are UTF-16.
+func checkSecureBootVars(vars []byte) error {
+	for _, name := range []string{"PK", "KEK"} {
+		var utf16 []byte
+		for _, c := range name + "\x00" {
+			utf16 = append(utf16, byte(c), 0)
+		}
+		if !bytes.Contains(vars, utf16) {
+			return fmt.Errorf("the firmware variables have no %s enrolled, so secure boot would not be enforced. Use variables with the keys enrolled, such as OVMF_VARS.ms.fd", name)
+		}
+	}
+	return nil
+}
+
+// pciAddress matches a PCI address, [domain:]bus:device.function
+var pciAddress = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}):([01][0-9a-fA-F])\.([0-7])$`)
+
+// parseVfioDevice parses the -device d. If it is a vfio-pci device, it
+// returns d with the full PCI address of its host, and the address.
+func parseVfioDevice(d string) (string, string, error) {
+	props := strings.Split(d, ",")
+	if props[0] != "vfio-pci" {
+		return d, "", nil
+	}
+	var addr string
+	for i, p := range props[1:] {
+		if !strings.HasPrefix(p, "host=") {
+			continue
+		}
+		m := pciAddress.FindStringSubmatch(strings.TrimPrefix(p, "host="))
+		if m == nil {
+			return d, "", fmt.Errorf("Invalid PCI address %q for vfio-pci, expected [domain:]bus:device.function such as 0000:01:00.0", strings.TrimPrefix(p, "host="))
+		}
+		if m[1] == "" {
+			m[1] = "0000"
+		}
+		addr = strings.ToLower(fmt.Sprintf("%s:%s:%s.%s", m[1], m[2], m[3], m[4]))
+		props[i+1] = "host=" + addr
+	}
+	if addr == "" {
+		return d, "", fmt.Errorf("vfio-pci device %q needs the PCI address of the host device, such as host=0000:01:00.0", d)
+	}
+	return strings.Join(props, ","), addr, nil
+}
+
+// checkVfio checks that the host, with its file system at root, can pass
+// through the PCI devices at addrs: that it has an IOMMU and VFIO, and
+// the devices are bound to the vfio-pci driver
+func checkVfio(root string, addrs []string) error {
+	groups, err := ioutil.ReadDir(filepath.Join(root, "sys/kernel/iommu_groups"))
+	if err != nil || len(groups) == 0 {
+		return fmt.Errorf("PCI passthrough needs an IOMMU, and the host has none enabled. Enable VT-d or AMD-Vi in the firmware, and boot with intel_iommu=on or amd_iommu=on")
+	}
+	if _, err := os.Stat(filepath.Join(root, "dev/vfio/vfio")); err != nil {
+		return fmt.Errorf("PCI passthrough needs VFIO, and /dev/vfio/vfio does not exist. Load the vfio-pci module")
+	}
+	for _, addr := range addrs {
+		dev := filepath.Join(root, "sys/bus/pci/devices", addr)
+		if _, err := os.Stat(dev); err != nil {
+			return fmt.Errorf("PCI device %s does not exist", addr)
+		}
+		driver, err := os.Readlink(filepath.Join(dev, "driver"))
+		if err != nil || filepath.Base(driver) != "vfio-pci" {
+			return fmt.Errorf("PCI device %s is not bound to the vfio-pci driver", addr)
+		}
+	}
+	return nil
+}
+
+// qemuBridge is the bridge of the bridge networking mode
+type qemuBridge struct {
+	Name string
+	MAC  net.HardwareAddr
+}
+
+// parseQemuBridge parses the options of the bridge networking mode, the
+// name of the bridge, or br=name with mac=MAC for the MAC address of the VM
+func parseQemuBridge(opts string) (qemuBridge, error) {
+	var b qemuBridge
+	for i, opt := range strings.Split(opts, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		switch {
+		case len(kv) == 1 && i == 0:
+			b.Name = opt
+		case kv[0] == "br" && len(kv) == 2:
+			b.Name = kv[1]
+		case kv[0] == "mac" && len(kv) == 2:
+			mac, err := parseMAC(kv[1])
+			if err != nil {
+				return b, err
+			}
+			b.MAC = mac
+		default:
+			return b, fmt.Errorf("unknown option %q, the options are br=name and mac=MAC", opt)
+		}
+	}
+	if b.Name == "" {
+		return b, fmt.Errorf("no bridge in %q, give it as br=name", opts)
+	}
+	return b, nil
+}
+
+// checkBridge checks that the host, with its file system at root, has the
+// bridge name
+func checkBridge(root, name string) error {
+	if _, err := os.Stat(filepath.Join(root, "sys/class/net", name, "bridge")); err != nil {
+		if _, err := os.Stat(filepath.Join(root, "sys/class/net", name)); err == nil {
+			return fmt.Errorf("%s is not a bridge", name)
+		}
+		return fmt.Errorf("The bridge %s does not exist, create it with 'ip link add %s type bridge'", name, name)
+	}
+	return nil
+}
+
+// bridgeError is the error of qemu-bridge-helper in the stderr of qemu,
+// explained, or nil if it did not fail
+func bridgeError(stderr, bridge string) error {
+	switch {
+	case strings.Contains(stderr, "access denied by acl file"):
+		return fmt.Errorf("qemu-bridge-helper is not allowed to attach to %s. Add 'allow %s' to /etc/qemu/bridge.conf", bridge, bridge)
+	case strings.Contains(stderr, "Operation not permitted"):
+		return fmt.Errorf("Attaching to the bridge %s needs CAP_NET_ADMIN to create a tap device. Run linuxkit as root, or make qemu-bridge-helper setuid root, or give it the capability with 'setcap cap_net_admin+ep' on it", bridge)
+	case strings.Contains(stderr, "bridge helper failed"):
+		return fmt.Errorf("qemu-bridge-helper failed to attach a tap device to the bridge %s", bridge)
+	}
+	return nil
+}
+
+// share9P is a host directory shared with the VM over 9p, which the VM
+// mounts with mount -t 9p -o trans=virtio,version=9p2000.L <tag> <dir>
+type share9P struct {
+	Source   string
+	Tag      string
+	ReadOnly bool
+}
+
+// parse9P parses the -9p s, src=HOSTDIR,tag=TAG[,ro]
+func parse9P(s string) (share9P, error) {
+	var share share9P
+	for _, opt := range strings.Split(s, ",") {
+		if opt == "ro" || opt == "readonly" {
+			share.ReadOnly = true
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return share, fmt.Errorf("%q is not key=value or ro in %q", opt, s)
+		}
+		switch kv[0] {
+		case "src", "source":
+			share.Source = kv[1]
+		case "tag":
+			share.Tag = kv[1]
+		default:
+			return share, fmt.Errorf("unknown option %q in %q, the options are src, tag and ro", kv[0], s)
+		}
+	}
+	if share.Source == "" || share.Tag == "" {
+		return share, fmt.Errorf("%q needs both src=HOSTDIR and tag=TAG", s)
+	}
+	var err error
+	share.Source, err = shareDir(share.Source)
+	return share, err
+}
+
 func discoverBinaries(config QemuConfig) (QemuConfig, error) {
 	if config.QemuImgPath != "" {
 		return config, nil
@@ -599,17 +1247,23 @@ func buildQemuForwardings(publishFlags multipleFlag) (string, error) {
 	if len(publishFlags) == 0 {
 		return "", nil
 	}
+	ports, err := expandPublishedPorts(publishFlags)
+	if err != nil {
+		return "", err
+	}
 	var forwardings string
-	for _, publish := range publishFlags {
-		p, err := NewPublishedPort(publish)
-		if err != nil {
-			return "", err
-		}
-
+	ipv6 := false
+	for _, p := range ports {
 		hostPort := p.Host
 		guestPort := p.Guest
 
-		forwardings = fmt.Sprintf("%s,hostfwd=%s::%d-:%d", forwardings, p.Protocol, hostPort, guestPort)
+		forwardings = fmt.Sprintf("%s,hostfwd=%s:%s:%d-:%d", forwardings, p.Protocol, p.publishHost(), hostPort, guestPort)
+		ipv6 = ipv6 || (p.HostIP != nil && p.HostIP.To4() == nil)
+	}
+	// a port published on an IPv6 address of the host is forwarded to the
+	// IPv6 address of the VM, which it has with the ipv6 option
+	if ipv6 {
+		forwardings = ",ipv6=on" + forwardings
 	}
 
 	return forwardings, nil
@@ -617,12 +1271,16 @@ func buildQemuForwardings(publishFlags multipleFlag) (string, error) {
 
 func buildDockerForwardings(publishedPorts []string) ([]string, error) {
 	pmap := []string{}
-	for _, port := range publishedPorts {
-		s, err := NewPublishedPort(port)
-		if err != nil {
-			return nil, err
+	ports, err := expandPublishedPorts(publishedPorts)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ports {
+		publish := fmt.Sprintf("%d:%d/%s", s.Host, s.Guest, s.Protocol)
+		if host := s.publishHost(); host != "" {
+			publish = host + ":" + publish
 		}
-		pmap = append(pmap, "-p", fmt.Sprintf("%d:%d/%s", s.Host, s.Guest, s.Protocol))
+		pmap = append(pmap, "-p", publish)
 	}
 	return pmap, nil
 }
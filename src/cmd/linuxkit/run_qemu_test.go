@@ -0,0 +1,500 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/moby"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// utf16Vars returns OVMF variables with the variables of names
+func utf16Vars(names ...string) []byte {
+	var b []byte
+	for _, name := range names {
+		b = append(b, 0xaa, 0x55)
+		for _, c := range name + "\x00" {
+			b = append(b, byte(c), 0)
+		}
+	}
+	return b
+}
+
+// containsArgs checks that args has want, in order, as consecutive args
+func containsArgs(t *testing.T, args []string, want ...string) {
+	for i := range args {
+		if len(args)-i >= len(want) && assert.ObjectsAreEqual(want, args[i:i+len(want)]) {
+			return
+		}
+	}
+	t.Errorf("%q does not contain %q", args, want)
+}
+
+func TestBuildQemuCmdlineSecureBoot(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:       "image.iso",
+		ISOBoot:    true,
+		UEFI:       true,
+		SecureBoot: true,
+		FWPath:     "OVMF_CODE.secboot.fd",
+		StatePath:  state,
+		Arch:       "x86_64",
+		CPUs:       "1",
+		Memory:     "1024",
+	}
+	_, args := buildQemuCmdline(config)
+	containsArgs(t, args, "-machine", "q35,smm=on")
+	containsArgs(t, args, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	containsArgs(t, args, "-drive", "if=pflash,format=raw,unit=0,readonly=on,file=OVMF_CODE.secboot.fd")
+	containsArgs(t, args, "-drive", "if=pflash,format=raw,unit=1,file="+filepath.Join(state, "efi-vars.fd"))
+
+	// without secure boot, there is no SMM and a single firmware drive
+	config.SecureBoot, config.FWPath = false, "bios.bin"
+	_, args = buildQemuCmdline(config)
+	containsArgs(t, args, "-machine", "q35")
+	containsArgs(t, args, "-drive", "if=pflash,format=raw,file=bios.bin")
+	assert.NotContains(t, args, "-global")
+}
+
+func TestCheckSecureBootVars(t *testing.T) {
+	assert.NoError(t, checkSecureBootVars(utf16Vars("PK", "KEK", "db", "dbx")))
+	assert.EqualError(t, checkSecureBootVars(utf16Vars("Boot0000", "BootOrder")), "the firmware variables have no PK enrolled, so secure boot would not be enforced. Use variables with the keys enrolled, such as OVMF_VARS.ms.fd")
+	assert.Error(t, checkSecureBootVars(utf16Vars("PK")))
+}
+
+func TestSetupSecureBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fw := filepath.Join(dir, "OVMF_CODE.secboot.fd")
+	require.NoError(t, ioutil.WriteFile(fw, []byte("code"), 0644))
+	noKeys := filepath.Join(dir, "OVMF_VARS.fd")
+	require.NoError(t, ioutil.WriteFile(noKeys, utf16Vars("BootOrder"), 0644))
+	keys := filepath.Join(dir, "OVMF_VARS.ms.fd")
+	require.NoError(t, ioutil.WriteFile(keys, utf16Vars("PK", "KEK", "db"), 0644))
+
+	config := QemuConfig{Arch: "x86_64", StatePath: dir, FWPath: fw, FWVarsPath: noKeys}
+	err = setupSecureBoot(config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Cannot secure boot with "+noKeys)
+
+	config.FWVarsPath = keys
+	require.NoError(t, setupSecureBoot(config))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "efi-vars.fd"))
+	require.NoError(t, err)
+	assert.Equal(t, utf16Vars("PK", "KEK", "db"), b)
+
+	config.Arch = "aarch64"
+	assert.EqualError(t, setupSecureBoot(config), "Secure boot is only supported for x86_64, not aarch64")
+	config.Arch, config.FWPath = "x86_64", filepath.Join(dir, "missing.fd")
+	assert.Error(t, setupSecureBoot(config))
+}
+
+func TestParseVfioDevice(t *testing.T) {
+	for _, tc := range []struct {
+		device, want, addr string
+	}{
+		{"usb-host,hostbus=1,hostaddr=2", "usb-host,hostbus=1,hostaddr=2", ""},
+		{"vfio-pci,host=0000:01:00.0", "vfio-pci,host=0000:01:00.0", "0000:01:00.0"},
+		{"vfio-pci,host=01:00.1,x-vga=on", "vfio-pci,host=0000:01:00.1,x-vga=on", "0000:01:00.1"},
+		{"vfio-pci,host=0000:0A:1f.7", "vfio-pci,host=0000:0a:1f.7", "0000:0a:1f.7"},
+	} {
+		device, addr, err := parseVfioDevice(tc.device)
+		assert.NoError(t, err, tc.device)
+		assert.Equal(t, tc.want, device, tc.device)
+		assert.Equal(t, tc.addr, addr, tc.device)
+	}
+
+	for _, d := range []string{"vfio-pci,host=1:00.0", "vfio-pci,host=0000:01:20.0", "vfio-pci,host=0000:01:00.8", "vfio-pci,host=01:00"} {
+		_, _, err := parseVfioDevice(d)
+		assert.Error(t, err, d)
+		assert.Contains(t, err.Error(), "Invalid PCI address", d)
+	}
+	_, _, err := parseVfioDevice("vfio-pci")
+	assert.EqualError(t, err, `vfio-pci device "vfio-pci" needs the PCI address of the host device, such as host=0000:01:00.0`)
+}
+
+func TestBuildQemuCmdlineDevices(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:      "image",
+		StatePath: state,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "1024",
+		Devices:   []string{"vfio-pci,host=0000:01:00.0", "vfio-pci,host=0000:01:00.1"},
+	}
+	_, args := buildQemuCmdline(config)
+	containsArgs(t, args, "-device", "vfio-pci,host=0000:01:00.0", "-device", "vfio-pci,host=0000:01:00.1")
+}
+
+func TestCheckVfio(t *testing.T) {
+	root, err := ioutil.TempDir("", "linuxkit-vfio")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	addr := "0000:01:00.0"
+
+	err = checkVfio(root, []string{addr})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs an IOMMU")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sys/kernel/iommu_groups/1"), 0755))
+	err = checkVfio(root, []string{addr})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs VFIO")
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dev/vfio"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(root, "dev/vfio/vfio"), nil, 0644))
+	assert.EqualError(t, checkVfio(root, []string{addr}), "PCI device 0000:01:00.0 does not exist")
+
+	dev := filepath.Join(root, "sys/bus/pci/devices", addr)
+	require.NoError(t, os.MkdirAll(dev, 0755))
+	require.NoError(t, os.Symlink("../../../../bus/pci/drivers/nvidia", filepath.Join(dev, "driver")))
+	assert.EqualError(t, checkVfio(root, []string{addr}), "PCI device 0000:01:00.0 is not bound to the vfio-pci driver")
+
+	require.NoError(t, os.Remove(filepath.Join(dev, "driver")))
+	require.NoError(t, os.Symlink("../../../../bus/pci/drivers/vfio-pci", filepath.Join(dev, "driver")))
+	assert.NoError(t, checkVfio(root, []string{addr}))
+}
+
+func TestParse9P(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-9p")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	for _, tc := range []struct {
+		spec string
+		want share9P
+	}{
+		{"src=" + dir + ",tag=share", share9P{Source: dir, Tag: "share"}},
+		{"src=" + dir + ",tag=share,ro", share9P{Source: dir, Tag: "share", ReadOnly: true}},
+		{"ro,tag=share,source=" + dir, share9P{Source: dir, Tag: "share", ReadOnly: true}},
+		{"src=" + dir + "/,tag=share,readonly", share9P{Source: dir, Tag: "share", ReadOnly: true}},
+	} {
+		share, err := parse9P(tc.spec)
+		assert.NoError(t, err, tc.spec)
+		assert.Equal(t, tc.want, share, tc.spec)
+	}
+
+	for spec, e := range map[string]string{
+		"src=" + dir + ",ro":               `"src=` + dir + `,ro" needs both src=HOSTDIR and tag=TAG`,
+		"tag=share":                        `"tag=share" needs both src=HOSTDIR and tag=TAG`,
+		"src=" + dir + ",tag=share,rw":     `"rw" is not key=value or ro in "src=` + dir + `,tag=share,rw"`,
+		"src=" + dir + ",tag=share,cache=": `unknown option "cache" in "src=` + dir + `,tag=share,cache=", the options are src, tag and ro`,
+		"src=" + file + ",tag=share":       file + " is not a directory",
+	} {
+		_, err := parse9P(spec)
+		assert.EqualError(t, err, e, spec)
+	}
+}
+
+func TestBuildQemuCmdline9P(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:      "image",
+		StatePath: state,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "1024",
+		Shares9P:  []share9P{{Source: "/src", Tag: "share"}, {Source: "/data", Tag: "data", ReadOnly: true}},
+	}
+	_, args := buildQemuCmdline(config)
+	containsArgs(t, args, "-virtfs", "local,path=/src,mount_tag=share,security_model=none,id=fs9p0",
+		"-virtfs", "local,path=/data,mount_tag=data,security_model=none,id=fs9p1,readonly=on")
+}
+
+func TestParseQemuBridge(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	for opts, want := range map[string]qemuBridge{
+		"br0":                            {Name: "br0"},
+		"br=br0":                         {Name: "br0"},
+		"br=br0,mac=52:54:00:12:34:56":   {Name: "br0", MAC: mac},
+		"mac=52:54:00:12:34:56,br=virbr": {Name: "virbr", MAC: mac},
+		"br0,mac=52-54-00-12-34-56":      {Name: "br0", MAC: mac},
+	} {
+		b, err := parseQemuBridge(opts)
+		assert.NoError(t, err, opts)
+		assert.Equal(t, want, b, opts)
+	}
+
+	for opts, e := range map[string]string{
+		"mac=52:54:00:12:34:56":        `no bridge in "mac=52:54:00:12:34:56", give it as br=name`,
+		"br=br0,mac=52:54:00:12":       `"52:54:00:12" is not a MAC address, such as 52:54:00:12:34:56`,
+		"br=br0,mac=01:00:5e:00:00:01": "01:00:5e:00:00:01 is a multicast MAC address",
+		"br=br0,helper":                `unknown option "helper", the options are br=name and mac=MAC`,
+		"br0,br1":                      `unknown option "br1", the options are br=name and mac=MAC`,
+	} {
+		_, err := parseQemuBridge(opts)
+		assert.EqualError(t, err, e, opts)
+	}
+}
+
+func TestCheckBridge(t *testing.T) {
+	root, err := ioutil.TempDir("", "linuxkit-bridge")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	assert.EqualError(t, checkBridge(root, "br0"), "The bridge br0 does not exist, create it with 'ip link add br0 type bridge'")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sys/class/net/eth0"), 0755))
+	assert.EqualError(t, checkBridge(root, "eth0"), "eth0 is not a bridge")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sys/class/net/br0/bridge"), 0755))
+	assert.NoError(t, checkBridge(root, "br0"))
+}
+
+func TestBridgeError(t *testing.T) {
+	assert.NoError(t, bridgeError("qemu-system-x86_64: terminating on signal 2\n", "br0"))
+	err := bridgeError("failed to create tun device: Operation not permitted\nqemu-system-x86_64: -netdev bridge,id=t0,br=br0: bridge helper failed\n", "br0")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs CAP_NET_ADMIN")
+	assert.EqualError(t, bridgeError("access denied by acl file\nqemu-system-x86_64: -netdev bridge,id=t0,br=br0: bridge helper failed\n", "br0"),
+		"qemu-bridge-helper is not allowed to attach to br0. Add 'allow br0' to /etc/qemu/bridge.conf")
+	assert.EqualError(t, bridgeError("qemu-system-x86_64: -netdev bridge,id=t0,br=br0: bridge helper failed\n", "br0"),
+		"qemu-bridge-helper failed to attach a tap device to the bridge br0")
+}
+
+func TestBuildQemuCmdlineBridge(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:         "image",
+		StatePath:    state,
+		Arch:         "x86_64",
+		CPUs:         "1",
+		Memory:       "1024",
+		NetdevConfig: "bridge,id=t0,br=br0",
+		Bridge:       "br0",
+	}
+	// the MAC generated for the state directory is kept for every run
+	_, args := buildQemuCmdline(config)
+	mac := retrieveMAC(state)
+	assert.Equal(t, mac, retrieveMAC(state))
+	assert.Equal(t, byte(0x02), mac[0]&0x03, "%s is not a locally administered unicast address", mac)
+	containsArgs(t, args, "-device", "virtio-net-pci,netdev=t0,mac="+mac.String(), "-netdev", "bridge,id=t0,br=br0")
+	_, again := buildQemuCmdline(config)
+	assert.Equal(t, args, again)
+
+	// or the one given
+	config.MAC, _ = net.ParseMAC("52:54:00:12:34:56")
+	_, args = buildQemuCmdline(config)
+	containsArgs(t, args, "-device", "virtio-net-pci,netdev=t0,mac=52:54:00:12:34:56", "-netdev", "bridge,id=t0,br=br0")
+	assert.Equal(t, mac, retrieveMAC(state))
+}
+
+func TestBuildQemuForwardings(t *testing.T) {
+	forwardings, err := buildQemuForwardings(multipleFlag{"2222:22", "8000-8001:9000-9001/udp"})
+	require.NoError(t, err)
+	assert.Equal(t, ",hostfwd=tcp::2222-:22,hostfwd=udp::8000-:9000,hostfwd=udp::8001-:9001", forwardings)
+
+	// on the addresses of the host, with IPv6 enabled for an IPv6 address
+	forwardings, err = buildQemuForwardings(multipleFlag{"127.0.0.1:2222:22"})
+	require.NoError(t, err)
+	assert.Equal(t, ",hostfwd=tcp:127.0.0.1:2222-:22", forwardings)
+	forwardings, err = buildQemuForwardings(multipleFlag{"127.0.0.1:2222:22", "[::1]:2222:22", "[::]:53:53/udp"})
+	require.NoError(t, err)
+	assert.Equal(t, ",ipv6=on,hostfwd=tcp:127.0.0.1:2222-:22,hostfwd=tcp:[::1]:2222-:22,hostfwd=udp:[::]:53-:53", forwardings)
+
+	pmap, err := buildDockerForwardings([]string{"8080:80", "[::1]:8443:443/tcp", "127.0.0.1:53:53/udp"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-p", "8080:80/tcp", "-p", "[::1]:8443:443/tcp", "-p", "127.0.0.1:53:53/udp"}, pmap)
+
+	_, err = buildQemuForwardings(multipleFlag{"8000-8001:9000"})
+	assert.EqualError(t, err, "Failed to parse port publish 8000-8001:9000: The host port range 8000-8001 and guest port range 9000 are of different lengths")
+}
+
+func TestBuildQemuCmdlineSnapshot(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:      "disk.img",
+		Disks:     Disks{{Path: "disk.img"}},
+		StatePath: state,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "1024",
+	}
+	_, args := buildQemuCmdline(config)
+	assert.NotContains(t, args, "-snapshot")
+	config.Snapshot = true
+	_, args = buildQemuCmdline(config)
+	assert.Contains(t, args, "-snapshot")
+}
+
+// TestQemuBootESP boots a raw-efi disk with the stub bootloader under OVMF.
+// It needs qemu-system-x86_64, OVMF and a kernel with the EFI stub, given
+// by LINUXKIT_TEST_EFI_KERNEL, so it is skipped unless they are there.
+// efiTestImage is the image of a build with the EFI kernel of
+// LINUXKIT_TEST_EFI_KERNEL in dir, and the OVMF firmware to boot it with,
+// skipping the test without them or qemu
+func efiTestImage(t *testing.T, dir string) (string, string, string) {
+	kernelPath := os.Getenv("LINUXKIT_TEST_EFI_KERNEL")
+	if kernelPath == "" {
+		t.Skip("LINUXKIT_TEST_EFI_KERNEL is not set")
+	}
+	qemu, err := exec.LookPath("qemu-system-x86_64")
+	if err != nil {
+		t.Skip("qemu-system-x86_64 is not available")
+	}
+	fw := os.Getenv("LINUXKIT_TEST_OVMF")
+	if fw == "" {
+		fw = defaultFWPath
+	}
+	if _, err := os.Stat(fw); err != nil {
+		t.Skipf("OVMF is not available: %v", err)
+	}
+	kernel, err := ioutil.ReadFile(kernelPath)
+	require.NoError(t, err)
+
+	var image bytes.Buffer
+	tw := tar.NewWriter(&image)
+	cmdline := []byte("console=ttyS0 panic=-1")
+	for _, f := range []struct {
+		name string
+		b    []byte
+	}{{"boot/kernel", kernel}, {"boot/cmdline", cmdline}} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.b))}))
+		_, err := tw.Write(f.b)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	imagePath := filepath.Join(dir, "linuxkit.tar")
+	require.NoError(t, ioutil.WriteFile(imagePath, image.Bytes(), 0644))
+	return imagePath, qemu, fw
+}
+
+// bootEFI boots config under OVMF until the kernel panics without a root
+// filesystem, and qemu exits, returning its console output
+func bootEFI(t *testing.T, qemu string, config QemuConfig) string {
+	_, args := buildQemuCmdline(config)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, qemu, append(args, "-no-reboot")...).CombinedOutput()
+	return string(out)
+}
+
+func TestQemuBootESP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-esp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	imagePath, qemu, fw := efiTestImage(t, dir)
+
+	m, err := moby.NewConfig([]byte("outputs:\n  raw-efi:\n    esp:\n      bootloader: stub\n"))
+	require.NoError(t, err)
+	base := filepath.Join(dir, "linuxkit")
+	require.NoError(t, moby.Formats(base, imagePath, []string{"raw-efi"}, 0, "", m))
+
+	out := bootEFI(t, qemu, QemuConfig{
+		Path:      base + "-efi.img",
+		Disks:     Disks{{Path: base + "-efi.img", Format: "raw"}},
+		UEFI:      true,
+		FWPath:    fw,
+		StatePath: dir,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "512",
+	})
+	assert.Contains(t, out, "Kernel command line: initrd=\\initrd.img console=ttyS0 panic=-1")
+}
+
+// TestQemuBootIsoEFI boots an iso-efi under OVMF from its El Torito UEFI entry
+func TestQemuBootIsoEFI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-iso")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	imagePath, qemu, fw := efiTestImage(t, dir)
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not available")
+	}
+
+	base := filepath.Join(dir, "linuxkit")
+	require.NoError(t, moby.Formats(base, imagePath, []string{"iso-efi"}, 0, "", moby.Moby{}))
+
+	out := bootEFI(t, qemu, QemuConfig{
+		Path:      base + "-efi.iso",
+		ISOBoot:   true,
+		ISOImages: []string{base + "-efi.iso"},
+		UEFI:      true,
+		FWPath:    fw,
+		StatePath: dir,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "512",
+	})
+	assert.Regexp(t, `Kernel command line: .*console=ttyS0 panic=-1 root=/dev/sr0`, out)
+}
+
+func TestBuildQemuCmdlineExtraArgs(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	extra, err := splitArgs(`-device e1000,netdev=n1 -netdev user,id=n1 -m 2048 -smp '2'`)
+	require.NoError(t, err)
+	config := QemuConfig{
+		Path:      "image.iso",
+		ISOBoot:   true,
+		StatePath: state,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "1024",
+		Devices:   []string{"virtio-rng-pci"},
+		ExtraArgs: extra,
+	}
+	_, args := buildQemuCmdline(config)
+	// the extra args come last, as they are
+	assert.Equal(t, extra, args[len(args)-len(extra):])
+	containsArgs(t, args, "-device", "virtio-rng-pci", "-device", "e1000,netdev=n1")
+
+	// the conflicting options show with what linuxkit generated
+	assert.Equal(t, []string{"-m 1024", "-smp 1"}, qemuArgConflicts(args, extra))
+	assert.Empty(t, qemuArgConflicts(args[:len(args)-len(extra)], nil))
+}
+
+func TestBuildQemuCmdlineGDB(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{Path: "image.iso", ISOBoot: true, StatePath: state, Arch: "x86_64", CPUs: "1", Memory: "1024"}
+	_, args := buildQemuCmdline(config)
+	assert.NotContains(t, args, "-gdb")
+	assert.NotContains(t, args, "-S")
+
+	for value, chardev := range map[string]string{"": defaultGDB, "=tcp:127.0.0.1:4321": "tcp:127.0.0.1:4321", "=4321": "tcp::4321", "=unix:/tmp/gdb.sock,server,nowait": "unix:/tmp/gdb.sock,server,nowait"} {
+		flags := flag.NewFlagSet("qemu", flag.ContinueOnError)
+		var gdb gdbFlag
+		flags.Var(&gdb, "gdb", "")
+		require.NoError(t, flags.Parse([]string{"-gdb" + value, "image.iso"}), value)
+		assert.Equal(t, []string{"image.iso"}, flags.Args())
+		config.GDB = string(gdb)
+		_, args = buildQemuCmdline(config)
+		containsArgs(t, args, "-gdb", chardev, "-S")
+	}
+	var gdb gdbFlag
+	assert.Error(t, gdb.Set(""))
+}
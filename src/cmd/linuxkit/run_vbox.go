@@ -94,6 +94,9 @@ func runVbox(args []string) {
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	if err := disks.rejectReadOnly("vbox"); err != nil {
+		log.Fatal(err)
+	}
 	remArgs := flags.Args()
 
 	if runtime.GOOS == "windows" {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vzNetworkingNAT  = "nat"
+	vzNetworkingNone = "none"
+)
+
+// vzConfig is the configuration of a VM run with Apple's
+// Virtualization.framework
+type vzConfig struct {
+	CPUs int
+	// Memory is in MB
+	Memory int
+	// Kernel, Initrd and Cmdline are set to boot a kernel+initrd
+	Kernel, Initrd, Cmdline string
+	// EFIVariables is the EFI variable store, set to boot the first disk
+	// with EFI
+	EFIVariables string
+	Disks        []DiskConfig
+	Networking   string
+}
+
+// Process the run arguments and execute run
+func runVirtualization(args []string) {
+	flags := flag.NewFlagSet("virtualization", flag.ExitOnError)
+	invoked := filepath.Base(os.Args[0])
+	flags.Usage = func() {
+		fmt.Printf("USAGE: %s run virtualization [options] prefix\n\n", invoked)
+		fmt.Printf("'prefix' specifies the path to the VM image.\n")
+		fmt.Printf("It boots 'prefix'-kernel/-initrd/-cmdline, or else the raw EFI disk\n")
+		fmt.Printf("image 'prefix'.raw or 'prefix' with macOS 13 or later.\n")
+		fmt.Printf("\n")
+		fmt.Printf("Options:\n")
+		flags.PrintDefaults()
+	}
+	cpus := flags.Int("cpus", 1, "Number of CPUs")
+	mem := flags.Int("mem", 1024, "Amount of memory in MB")
+	var disks Disks
+	flags.Var(&disks, "disk", "Disk config, may be repeated. [file=]path[,size=1G][,readonly]")
+	state := flags.String("state", "", "Path to directory to keep VM state in")
+	snapshot := flags.Bool("snapshot", false, "Discard the writes to the disks when the VM stops, by running it with temporary copies of them")
+	networking := flags.String("networking", vzNetworkingNAT, "Networking mode. Valid options are 'nat', a virtio network device with NAT to the host network, and 'none'")
+
+	if err := flags.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if err := vzCheckHost(runtime.GOOS, runtime.GOARCH); err != nil {
+		log.Fatal(err)
+	}
+	remArgs := flags.Args()
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify the prefix to the image to boot")
+		flags.Usage()
+		os.Exit(1)
+	}
+	path := remArgs[0]
+	prefix := strings.TrimSuffix(path, ".raw")
+
+	if *networking != vzNetworkingNAT && *networking != vzNetworkingNone {
+		log.Fatalf("Invalid networking mode: %s", *networking)
+	}
+	if *state == "" {
+		*state = prefix + "-state"
+	}
+	if err := os.MkdirAll(*state, 0755); err != nil {
+		log.Fatalf("Could not create state directory: %v", err)
+	}
+
+	c := vzConfig{CPUs: *cpus, Memory: *mem, Networking: *networking}
+	if _, err := os.Stat(prefix + "-kernel"); err == nil {
+		c.Kernel, c.Initrd = prefix+"-kernel", prefix+"-initrd.img"
+		if _, err := os.Stat(c.Initrd); err != nil {
+			log.Fatalf("Cannot find initrd file (%s): %v", c.Initrd, err)
+		}
+		if err := vzCheckKernelFile(runtime.GOARCH, c.Kernel); err != nil {
+			log.Fatal(err)
+		}
+		cmdline, err := ioutil.ReadFile(prefix + "-cmdline")
+		if err != nil {
+			log.Fatalf("Cannot open cmdline file: %v", err)
+		}
+		c.Cmdline = vzCmdline(string(cmdline))
+	} else {
+		disk := prefix + ".raw"
+		if _, err := os.Stat(disk); err != nil {
+			if _, err := os.Stat(path); err != nil {
+				log.Fatalf("Cannot find kernel file %s or disk image %s", prefix+"-kernel", disk)
+			}
+			disk = path
+		}
+		c.EFIVariables = filepath.Join(*state, "efi-variables")
+		c.Disks = append(c.Disks, DiskConfig{Path: disk})
+	}
+
+	for i, d := range disks {
+		if d.Size != 0 && d.Path == "" {
+			d.Path = filepath.Join(*state, "disk"+strconv.Itoa(i)+".raw")
+		}
+		if d.Path == "" {
+			log.Fatalf("disk specified with no size or name")
+		}
+		if d.Format != "" && d.Format != "raw" {
+			log.Fatalf("Only raw disks are supported, not %s", d.Format)
+		}
+		if err := createRawDisk(d); err != nil {
+			log.Fatalf("Cannot create disk %s: %v", d.Path, err)
+		}
+		c.Disks = append(c.Disks, d)
+	}
+
+	cleanup := func() {}
+	if *snapshot {
+		var err error
+		c.Disks, cleanup, err = snapshotDisks(c.Disks)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := vzRun(&c)
+	cleanup()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// vzCheckHost checks that Virtualization.framework can be used on goos and
+// goarch
+func vzCheckHost(goos, goarch string) error {
+	if goos != "darwin" {
+		return fmt.Errorf("The virtualization backend needs macOS, not %s", goos)
+	}
+	if goarch != "arm64" && goarch != "amd64" {
+		return fmt.Errorf("The virtualization backend needs an arm64 or amd64 Mac, not %s", goarch)
+	}
+	return nil
+}
+
+// vzCheckKernelFile checks that kernel can be booted on goarch
+func vzCheckKernelFile(goarch, kernel string) error {
+	f, err := os.Open(kernel)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 0x206)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if err := vzCheckKernel(goarch, header[:n]); err != nil {
+		return fmt.Errorf("Cannot boot %s: %v", kernel, err)
+	}
+	return nil
+}
+
+// vzCheckKernel checks that the kernel starting with header can be booted
+// on goarch. Virtualization.framework boots an arm64 kernel only as an
+// uncompressed Image, and a bzImage on amd64.
+func vzCheckKernel(goarch string, header []byte) error {
+	switch goarch {
+	case "arm64":
+		if bytes.HasPrefix(header, []byte{0x1f, 0x8b}) {
+			return fmt.Errorf("it is compressed, build it with -decompress-kernel")
+		}
+		if len(header) < 60 || !bytes.Equal(header[56:60], []byte("ARM\x64")) {
+			return fmt.Errorf("it is not an arm64 kernel Image")
+		}
+	case "amd64":
+		if len(header) < 0x206 || !bytes.Equal(header[0x202:0x206], []byte("HdrS")) {
+			return fmt.Errorf("it is not an x86 kernel bzImage")
+		}
+	default:
+		return fmt.Errorf("unsupported architecture %s", goarch)
+	}
+	return nil
+}
+
+// vzCmdline is cmdline with the console on the virtio console, hvc0, as
+// there is nothing else to have a console on
+func vzCmdline(cmdline string) string {
+	cmdline = strings.TrimSpace(cmdline)
+	for _, f := range strings.Fields(cmdline) {
+		if f == "console=hvc0" {
+			return cmdline
+		}
+	}
+	return strings.TrimSpace(cmdline + " console=hvc0")
+}
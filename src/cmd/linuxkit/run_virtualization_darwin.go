@@ -0,0 +1,227 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package main
+
+/*
+#cgo CFLAGS: -x objective-c -fobjc-arc -mmacosx-version-min=11.0
+#cgo LDFLAGS: -framework Foundation -framework Virtualization
+
+#import <Foundation/Foundation.h>
+#import <Virtualization/Virtualization.h>
+#include <stdlib.h>
+#include <string.h>
+#include <unistd.h>
+
+typedef struct {
+	int cpus;
+	unsigned long long memory;
+	const char *kernel;
+	const char *initrd;
+	const char *cmdline;
+	const char *efi_variables;
+	const char **disks;
+	int *disks_readonly;
+	int ndisks;
+	int nat;
+} vz_config;
+
+static char *vz_error(NSString *msg, NSError *err) {
+	if (err != nil) {
+		msg = [NSString stringWithFormat:@"%@: %@", msg, err.localizedDescription];
+	}
+	return strdup(msg.UTF8String);
+}
+
+static char *vz_efi_boot(VZVirtualMachineConfiguration *config, const char *variables) {
+#if defined(__MAC_13_0)
+	if (@available(macOS 13, *)) {
+		NSURL *url = [NSURL fileURLWithPath:@(variables)];
+		VZEFIVariableStore *store;
+		if ([[NSFileManager defaultManager] fileExistsAtPath:url.path]) {
+			store = [[VZEFIVariableStore alloc] initWithURL:url];
+		} else {
+			NSError *err = nil;
+			store = [[VZEFIVariableStore alloc] initCreatingVariableStoreAtURL:url options:0 error:&err];
+			if (store == nil) {
+				return vz_error(@"Cannot create the EFI variable store", err);
+			}
+		}
+		VZEFIBootLoader *loader = [[VZEFIBootLoader alloc] init];
+		loader.variableStore = store;
+		config.bootLoader = loader;
+		return NULL;
+	}
+#endif
+	return strdup("Booting a disk image needs macOS 13 or later, boot a kernel+initrd instead");
+}
+
+// vz_run configures a VM and, unless validate_only, runs it until it stops.
+// It returns NULL or an error to free.
+static char *vz_run(vz_config *c, int validate_only) {
+	@autoreleasepool {
+		VZVirtualMachineConfiguration *config = [[VZVirtualMachineConfiguration alloc] init];
+		config.CPUCount = c->cpus;
+		config.memorySize = c->memory;
+
+		if (c->efi_variables != NULL) {
+			char *err = vz_efi_boot(config, c->efi_variables);
+			if (err != NULL) {
+				return err;
+			}
+		} else {
+			VZLinuxBootLoader *loader = [[VZLinuxBootLoader alloc] initWithKernelURL:[NSURL fileURLWithPath:@(c->kernel)]];
+			loader.initialRamdiskURL = [NSURL fileURLWithPath:@(c->initrd)];
+			loader.commandLine = @(c->cmdline);
+			config.bootLoader = loader;
+		}
+
+		NSMutableArray *storage = [NSMutableArray array];
+		for (int i = 0; i < c->ndisks; i++) {
+			NSError *err = nil;
+			VZDiskImageStorageDeviceAttachment *attachment = [[VZDiskImageStorageDeviceAttachment alloc]
+				initWithURL:[NSURL fileURLWithPath:@(c->disks[i])] readOnly:c->disks_readonly[i] error:&err];
+			if (attachment == nil) {
+				return vz_error([NSString stringWithFormat:@"Cannot attach disk %s", c->disks[i]], err);
+			}
+			[storage addObject:[[VZVirtioBlockDeviceConfiguration alloc] initWithAttachment:attachment]];
+		}
+		config.storageDevices = storage;
+
+		if (c->nat) {
+			VZVirtioNetworkDeviceConfiguration *network = [[VZVirtioNetworkDeviceConfiguration alloc] init];
+			network.attachment = [[VZNATNetworkDeviceAttachment alloc] init];
+			config.networkDevices = @[network];
+		}
+
+		VZVirtioConsoleDeviceSerialPortConfiguration *console = [[VZVirtioConsoleDeviceSerialPortConfiguration alloc] init];
+		console.attachment = [[VZFileHandleSerialPortAttachment alloc]
+			initWithFileHandleForReading:[NSFileHandle fileHandleWithStandardInput]
+			fileHandleForWriting:[NSFileHandle fileHandleWithStandardOutput]];
+		config.serialPorts = @[console];
+		config.entropyDevices = @[[[VZVirtioEntropyDeviceConfiguration alloc] init]];
+		config.memoryBalloonDevices = @[[[VZVirtioTraditionalMemoryBalloonDeviceConfiguration alloc] init]];
+
+		NSError *err = nil;
+		if (![config validateWithError:&err]) {
+			return vz_error(@"Invalid VM configuration", err);
+		}
+		if (validate_only) {
+			return NULL;
+		}
+
+		dispatch_queue_t queue = dispatch_queue_create("linuxkit.virtualization", DISPATCH_QUEUE_SERIAL);
+		VZVirtualMachine *vm = [[VZVirtualMachine alloc] initWithConfiguration:config queue:queue];
+		dispatch_semaphore_t started = dispatch_semaphore_create(0);
+		__block NSError *startErr = nil;
+		dispatch_async(queue, ^{
+			[vm startWithCompletionHandler:^(NSError *e) {
+				startErr = e;
+				dispatch_semaphore_signal(started);
+			}];
+		});
+		dispatch_semaphore_wait(started, DISPATCH_TIME_FOREVER);
+		if (startErr != nil) {
+			return vz_error(@"Cannot start the VM", startErr);
+		}
+		for (;;) {
+			__block VZVirtualMachineState state;
+			dispatch_sync(queue, ^{
+				state = vm.state;
+			});
+			switch (state) {
+			case VZVirtualMachineStateStopped:
+				return NULL;
+			case VZVirtualMachineStateError:
+				return strdup("The VM stopped with an error");
+			default:
+				usleep(100000);
+			}
+		}
+	}
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// vzRun runs the VM of c until it stops, with its console on the terminal
+func vzRun(c *vzConfig) error {
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(int(os.Stdin.Fd()), oldState)
+	}
+	return vzStart(c, false)
+}
+
+// vzValidate checks that Virtualization.framework accepts the VM of c
+func vzValidate(c *vzConfig) error {
+	return vzStart(c, true)
+}
+
+func vzStart(c *vzConfig, validateOnly bool) error {
+	var strs []*C.char
+	cstring := func(s string) *C.char {
+		if s == "" {
+			return nil
+		}
+		cs := C.CString(s)
+		strs = append(strs, cs)
+		return cs
+	}
+	defer func() {
+		for _, s := range strs {
+			C.free(unsafe.Pointer(s))
+		}
+	}()
+
+	config := C.vz_config{
+		cpus:          C.int(c.CPUs),
+		memory:        C.ulonglong(c.Memory) * 1024 * 1024,
+		kernel:        cstring(c.Kernel),
+		initrd:        cstring(c.Initrd),
+		cmdline:       cstring(c.Cmdline),
+		efi_variables: cstring(c.EFIVariables),
+		ndisks:        C.int(len(c.Disks)),
+	}
+	if c.Networking == vzNetworkingNAT {
+		config.nat = 1
+	}
+	if len(c.Disks) > 0 {
+		disks := C.malloc(C.size_t(len(c.Disks)) * C.size_t(unsafe.Sizeof(uintptr(0))))
+		defer C.free(disks)
+		readonly := C.malloc(C.size_t(len(c.Disks)) * C.size_t(unsafe.Sizeof(C.int(0))))
+		defer C.free(readonly)
+		diskSlice := (*[1 << 20]*C.char)(disks)[:len(c.Disks):len(c.Disks)]
+		readonlySlice := (*[1 << 20]C.int)(readonly)[:len(c.Disks):len(c.Disks)]
+		for i, d := range c.Disks {
+			diskSlice[i] = cstring(d.Path)
+			if d.ReadOnly {
+				readonlySlice[i] = 1
+			} else {
+				readonlySlice[i] = 0
+			}
+		}
+		config.disks = (**C.char)(disks)
+		config.disks_readonly = (*C.int)(readonly)
+	}
+
+	validate := C.int(0)
+	if validateOnly {
+		validate = 1
+	}
+	if err := C.vz_run(&config, validate); err != nil {
+		defer C.free(unsafe.Pointer(err))
+		return errors.New(C.GoString(err))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestVzValidate is a smoke test that Virtualization.framework accepts the
+// configuration of a kernel+initrd VM, which does not need the entitlement
+// running one does
+func TestVzValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-vz")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	kernel, initrd, disk := filepath.Join(dir, "kernel"), filepath.Join(dir, "initrd.img"), filepath.Join(dir, "disk.raw")
+	require.NoError(t, ioutil.WriteFile(kernel, testKernel(runtime.GOARCH), 0644))
+	require.NoError(t, ioutil.WriteFile(initrd, []byte("initrd"), 0644))
+	require.NoError(t, createRawDisk(DiskConfig{Path: disk, Size: 16}))
+
+	require.NoError(t, vzValidate(&vzConfig{
+		CPUs:       1,
+		Memory:     512,
+		Kernel:     kernel,
+		Initrd:     initrd,
+		Cmdline:    vzCmdline("console=ttyS0"),
+		Disks:      []DiskConfig{{Path: disk}, {Path: initrd, ReadOnly: true}},
+		Networking: vzNetworkingNAT,
+	}))
+}
@@ -0,0 +1,18 @@
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+package main
+
+import (
+	"errors"
+)
+
+var errNoVirtualization = errors.New("This linuxkit was built without the virtualization backend, which needs macOS and cgo")
+
+func vzRun(c *vzConfig) error {
+	return errNoVirtualization
+}
+
+func vzValidate(c *vzConfig) error {
+	return errNoVirtualization
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testKernel returns the start of a kernel for arch
+func testKernel(arch string) []byte {
+	header := make([]byte, 0x206)
+	switch arch {
+	case "arm64":
+		copy(header[56:], "ARM\x64")
+	case "amd64":
+		copy(header[0x202:], "HdrS")
+	}
+	return header
+}
+
+func TestVzCheckHost(t *testing.T) {
+	assert.NoError(t, vzCheckHost("darwin", "arm64"))
+	assert.NoError(t, vzCheckHost("darwin", "amd64"))
+	assert.EqualError(t, vzCheckHost("linux", "amd64"), "The virtualization backend needs macOS, not linux")
+	assert.EqualError(t, vzCheckHost("darwin", "ppc64"), "The virtualization backend needs an arm64 or amd64 Mac, not ppc64")
+}
+
+func TestVzCheckKernel(t *testing.T) {
+	assert.NoError(t, vzCheckKernel("arm64", testKernel("arm64")))
+	assert.NoError(t, vzCheckKernel("amd64", testKernel("amd64")))
+	assert.EqualError(t, vzCheckKernel("arm64", testKernel("amd64")), "it is not an arm64 kernel Image")
+	assert.EqualError(t, vzCheckKernel("amd64", testKernel("arm64")), "it is not an x86 kernel bzImage")
+	assert.EqualError(t, vzCheckKernel("arm64", []byte{0x1f, 0x8b, 8, 0}), "it is compressed, build it with -decompress-kernel")
+	assert.EqualError(t, vzCheckKernel("amd64", []byte("short")), "it is not an x86 kernel bzImage")
+}
+
+func TestVzCmdline(t *testing.T) {
+	assert.Equal(t, "console=ttyS0 console=hvc0", vzCmdline("console=ttyS0\n"))
+	assert.Equal(t, "console=hvc0 page_poison=1", vzCmdline("console=hvc0 page_poison=1"))
+	assert.Equal(t, "console=hvc0", vzCmdline(""))
+}
@@ -84,6 +84,9 @@ func runVMware(args []string) {
 	if err := flags.Parse(args); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	if err := disks.rejectReadOnly("vmware"); err != nil {
+		log.Fatal(err)
+	}
 	remArgs := flags.Args()
 
 	if len(remArgs) == 0 {
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/template"
 
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/tftp"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,14 +27,126 @@ func serve(args []string) {
 	flags := flag.NewFlagSet("serve", flag.ExitOnError)
 	invoked := filepath.Base(os.Args[0])
 	flags.Usage = func() {
-		fmt.Printf("USAGE: %s serve [options]\n\n", invoked)
+		fmt.Printf("USAGE: %s serve [options] [prefix]\n\n", invoked)
+		fmt.Printf("'prefix' is the prefix of the kernel+initrd output of a build, to boot\n")
+		fmt.Printf("over the network. Its kernel, initrd and cmdline are served, with a\n")
+		fmt.Printf("/boot.ipxe script to chain from iPXE. Without it, the directory is served.\n")
+		fmt.Printf("With -tftp, the directory of the prefix, or -tftp-root, is also served\n")
+		fmt.Printf("over TFTP, for legacy PXE clients.\n\n")
 		fmt.Printf("Options:\n\n")
 		flags.PrintDefaults()
 	}
-	portFlag := flags.String("port", ":8080", "Local port to serve on")
-	dirFlag := flags.String("directory", ".", "Directory to serve")
+	httpFlag := flags.String("http", ":8080", "Address to serve HTTP on, or \"\" not to")
+	portFlag := flags.String("port", "", "Deprecated, use -http")
+	dirFlag := flags.String("directory", ".", "Directory to serve, without a prefix")
+	tftpFlag := flags.String("tftp", "", "Address to serve TFTP on, such as :69, for PXE clients without HTTP")
+	tftpRootFlag := flags.String("tftp-root", "", "Directory to serve over TFTP, default the directory of the prefix, or -directory")
 	flags.Parse(args)
 
-	http.Handle("/", http.FileServer(http.Dir(*dirFlag)))
-	log.Fatal(http.ListenAndServe(*portFlag, logRequest(http.DefaultServeMux)))
+	addr := *httpFlag
+	if *portFlag != "" {
+		addr = *portFlag
+	}
+	if addr == "" && *tftpFlag == "" {
+		log.Fatal("Nothing to serve, -http and -tftp are both empty")
+	}
+
+	tftpRoot := *dirFlag
+	switch flags.NArg() {
+	case 0:
+		http.Handle("/", http.FileServer(http.Dir(*dirFlag)))
+	case 1:
+		nb, err := newNetboot(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("Cannot serve %s: %v", flags.Arg(0), err)
+		}
+		if addr != "" {
+			log.Infof("Serving %s for iPXE at http://<host>%s/boot.ipxe", flags.Arg(0), addr)
+		}
+		http.Handle("/", nb)
+		tftpRoot = nb.dir
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *tftpRootFlag != "" {
+		tftpRoot = *tftpRootFlag
+	}
+
+	if *tftpFlag != "" {
+		s := &tftp.Server{Root: tftpRoot}
+		log.Infof("Serving %s over TFTP on %s", tftpRoot, *tftpFlag)
+		if addr == "" {
+			log.Fatal(s.ListenAndServe(*tftpFlag))
+		}
+		go func() {
+			log.Fatal(s.ListenAndServe(*tftpFlag))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(addr, logRequest(http.DefaultServeMux)))
+}
+
+// netboot serves the output of a kernel+initrd build for netbooting
+type netboot struct {
+	// dir and name are the directory and name of the output, the prefix
+	// of its files
+	dir, name string
+	cmdline   string
+}
+
+// ipxeTemplate is the iPXE script which boots a netboot output, from
+// BaseURL. The initrd is named so that EFI kernels find it too.
+var ipxeTemplate = template.Must(template.New("boot.ipxe").Parse(`#!ipxe
+
+set base-url {{.BaseURL}}
+initrd --name initrd ${base-url}/{{.Name}}-initrd.img
+kernel ${base-url}/{{.Name}}-kernel initrd=initrd {{.Cmdline}}
+boot
+`))
+
+// newNetboot returns a netboot of the build output of prefix, which must
+// have a kernel and initrd
+func newNetboot(prefix string) (*netboot, error) {
+	nb := &netboot{dir: filepath.Dir(prefix), name: filepath.Base(prefix)}
+	for _, f := range []string{nb.name + "-kernel", nb.name + "-initrd.img"} {
+		if _, err := os.Stat(filepath.Join(nb.dir, f)); err != nil {
+			return nil, err
+		}
+	}
+	cmdline, err := ioutil.ReadFile(filepath.Join(nb.dir, nb.name+"-cmdline"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	nb.cmdline = strings.TrimSpace(string(cmdline))
+	return nb, nil
+}
+
+// ipxeScript is the iPXE script of nb, chaining to baseURL
+func (nb *netboot) ipxeScript(baseURL string) ([]byte, error) {
+	var b bytes.Buffer
+	err := ipxeTemplate.Execute(&b, struct {
+		BaseURL, Name, Cmdline string
+	}{baseURL, nb.name, nb.cmdline})
+	return b.Bytes(), err
+}
+
+func (nb *netboot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/boot.ipxe":
+		script, err := nb.ipxeScript("http://" + r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(script)
+	case "/" + nb.name + "-kernel", "/" + nb.name + "-initrd.img":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeFile(w, r, filepath.Join(nb.dir, r.URL.Path[1:]))
+	case "/" + nb.name + "-cmdline":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(nb.cmdline))
+	default:
+		http.NotFound(w, r)
+	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(b)
+}
+
+func TestServeNetboot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-serve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "linuxkit")
+	require.NoError(t, ioutil.WriteFile(prefix+"-kernel", []byte("kernel"), 0644))
+	require.NoError(t, ioutil.WriteFile(prefix+"-initrd.img", []byte("initrd"), 0644))
+	require.NoError(t, ioutil.WriteFile(prefix+"-cmdline", []byte("console=ttyS0 console=tty0\n"), 0644))
+
+	nb, err := newNetboot(prefix)
+	require.NoError(t, err)
+	server := httptest.NewServer(nb)
+	defer server.Close()
+
+	resp, script := get(t, server.URL+"/boot.ipxe")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `#!ipxe
+
+set base-url `+server.URL+`
+initrd --name initrd ${base-url}/linuxkit-initrd.img
+kernel ${base-url}/linuxkit-kernel initrd=initrd console=ttyS0 console=tty0
+boot
+`, script)
+
+	resp, kernel := get(t, server.URL+"/linuxkit-kernel")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "kernel", kernel)
+
+	resp, initrd := get(t, server.URL+"/linuxkit-initrd.img")
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "initrd", initrd)
+
+	resp, _ = get(t, server.URL+"/linuxkit-cmdline.txt")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServeNetbootMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-serve")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "linuxkit")
+	require.NoError(t, ioutil.WriteFile(prefix+"-kernel", []byte("kernel"), 0644))
+
+	_, err = newNetboot(prefix)
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "linuxkit-initrd.img"), err.Error())
+}
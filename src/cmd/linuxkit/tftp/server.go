@@ -0,0 +1,305 @@
+// Package tftp implements a read only TFTP server, RFC 1350, with the
+// blksize, tsize and timeout options of RFC 2348 and 2349, enough for PXE
+// clients to fetch a bootloader and kernel.
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+
+	errNotDefined     = 0
+	errFileNotFound   = 1
+	errAccessViolated = 2
+	errIllegalOp      = 4
+	errUnknownTID     = 5
+	errBadOption      = 8
+
+	// defaultBlockSize is the block size without the blksize option
+	defaultBlockSize = 512
+	minBlockSize     = 8
+	maxBlockSize     = 65464
+)
+
+// Server serves the files under Root over TFTP. Writes are refused.
+type Server struct {
+	// Root is the directory served
+	Root string
+	// Timeout is how long to wait for an acknowledgement before sending
+	// a packet again, unless the client asks for another. Default 1s
+	Timeout time.Duration
+	// Retries is how many times a packet is sent again before giving up.
+	// Default 5
+	Retries int
+}
+
+// ListenAndServe serves TFTP on the UDP address addr
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Serve serves the TFTP requests received on conn, each transfer from a
+// port of its own, as TFTP requires
+func (s *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req := append([]byte{}, buf[:n]...)
+		go s.handle(conn.LocalAddr(), addr, req)
+	}
+}
+
+// request is a read or write request
+type request struct {
+	op       uint16
+	filename string
+	mode     string
+	options  map[string]string
+	// order is the order of the options, for the reply
+	order []string
+}
+
+func parseRequest(b []byte) (*request, error) {
+	if len(b) < 2 {
+		return nil, errors.New("short packet")
+	}
+	r := &request{op: binary.BigEndian.Uint16(b), options: map[string]string{}}
+	if r.op != opRRQ && r.op != opWRQ {
+		return r, fmt.Errorf("unexpected opcode %d", r.op)
+	}
+	fields := bytes.Split(b[2:], []byte{0})
+	// the packet ends with a 0, so the last field is empty
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return r, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	r.filename, r.mode = string(fields[0]), strings.ToLower(string(fields[1]))
+	opts := fields[2:]
+	if len(opts)%2 != 0 {
+		return r, errors.New("malformed options")
+	}
+	for i := 0; i < len(opts); i += 2 {
+		name := strings.ToLower(string(opts[i]))
+		r.options[name] = string(opts[i+1])
+		r.order = append(r.order, name)
+	}
+	return r, nil
+}
+
+func (s *Server) handle(local, remote net.Addr, b []byte) {
+	// reply from the address the request was sent to, on a new port
+	laddr := &net.UDPAddr{}
+	if udp, ok := local.(*net.UDPAddr); ok {
+		laddr.IP = udp.IP
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		log.Errorf("tftp: cannot reply to %s: %v", remote, err)
+		return
+	}
+	defer conn.Close()
+
+	req, err := parseRequest(b)
+	if err != nil {
+		sendError(conn, remote, errIllegalOp, err.Error())
+		return
+	}
+	if req.op == opWRQ {
+		sendError(conn, remote, errAccessViolated, "read only server")
+		return
+	}
+	if req.mode != "octet" && req.mode != "netascii" {
+		sendError(conn, remote, errIllegalOp, "unsupported mode "+req.mode)
+		return
+	}
+	log.Infof("tftp: %s read %s", remote, req.filename)
+	if err := s.send(conn, remote, req); err != nil {
+		log.Errorf("tftp: %s read %s: %v", remote, req.filename, err)
+	}
+}
+
+// open opens the file of name under Root. name cannot refer to a file
+// outside Root.
+func (s *Server) open(name string) (*os.File, os.FileInfo, error) {
+	// PXE clients may use either separator
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	f, err := os.Open(filepath.Join(s.Root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, fi, nil
+}
+
+// send sends the file requested by req to remote
+func (s *Server) send(conn *net.UDPConn, remote net.Addr, req *request) error {
+	f, fi, err := s.open(req.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			sendError(conn, remote, errFileNotFound, "file not found")
+		} else {
+			sendError(conn, remote, errAccessViolated, "cannot read file")
+		}
+		return err
+	}
+	defer f.Close()
+
+	blockSize, timeout, retries := defaultBlockSize, s.Timeout, s.Retries
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	if retries == 0 {
+		retries = 5
+	}
+
+	// acknowledge the options we support, ignoring the others
+	var oack []byte
+	for _, name := range req.order {
+		value := req.options[name]
+		switch name {
+		case "blksize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < minBlockSize {
+				sendError(conn, remote, errBadOption, "invalid blksize "+value)
+				return fmt.Errorf("invalid blksize %s", value)
+			}
+			if n > maxBlockSize {
+				n = maxBlockSize
+			}
+			blockSize, value = n, strconv.Itoa(n)
+		case "tsize":
+			value = strconv.FormatInt(fi.Size(), 10)
+		case "timeout":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 255 {
+				sendError(conn, remote, errBadOption, "invalid timeout "+value)
+				return fmt.Errorf("invalid timeout %s", value)
+			}
+			timeout = time.Duration(n) * time.Second
+		default:
+			continue
+		}
+		oack = append(oack, name...)
+		oack = append(oack, 0)
+		oack = append(oack, value...)
+		oack = append(oack, 0)
+	}
+
+	t := &transfer{conn: conn, remote: remote, timeout: timeout, retries: retries}
+	if oack != nil {
+		if err := t.exchange(append([]byte{0, opOACK}, oack...), 0); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 4+blockSize)
+	for block := uint16(1); ; block++ {
+		binary.BigEndian.PutUint16(buf, opDATA)
+		binary.BigEndian.PutUint16(buf[2:], block)
+		n, err := io.ReadFull(f, buf[4:])
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			sendError(conn, remote, errNotDefined, "read error")
+			return err
+		}
+		if err := t.exchange(buf[:4+n], block); err != nil {
+			return err
+		}
+		// a short block ends the transfer
+		if n < blockSize {
+			return nil
+		}
+	}
+}
+
+// transfer is the exchange of packets with a client
+type transfer struct {
+	conn    *net.UDPConn
+	remote  net.Addr
+	timeout time.Duration
+	retries int
+}
+
+// exchange sends packet until remote acknowledges block
+func (t *transfer) exchange(packet []byte, block uint16) error {
+	buf := make([]byte, 516)
+	for try := 0; try <= t.retries; try++ {
+		if _, err := t.conn.WriteTo(packet, t.remote); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			if err := t.conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, addr, err := t.conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return err
+			}
+			if addr.String() != t.remote.String() {
+				sendError(t.conn, addr, errUnknownTID, "unknown transfer ID")
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case opACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+				// a duplicate acknowledgement of an earlier block
+			case opERROR:
+				return fmt.Errorf("client error %d: %s", binary.BigEndian.Uint16(buf[2:]), bytes.TrimRight(buf[4:n], "\x00"))
+			}
+		}
+	}
+	return fmt.Errorf("timed out waiting for the acknowledgement of block %d", block)
+}
+
+func sendError(conn net.PacketConn, remote net.Addr, code uint16, msg string) {
+	packet := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(packet, opERROR)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, msg...)
+	packet = append(packet, 0)
+	conn.WriteTo(packet, remote)
+}
@@ -0,0 +1,159 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer(t *testing.T, files map[string][]byte) *net.UDPAddr {
+	dir, err := ioutil.TempDir("", "linuxkit-tftp")
+	require.NoError(t, err)
+	for name, b := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b, 0644))
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &Server{Root: dir, Timeout: 200 * time.Millisecond}
+	go s.Serve(conn)
+	t.Cleanup(func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	})
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// client is a TFTP client, which reads a file
+type client struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server net.Addr
+}
+
+func newClient(t *testing.T) *client {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn}
+}
+
+func (c *client) rrq(server *net.UDPAddr, name string, options ...string) {
+	packet := []byte{0, opRRQ}
+	for _, f := range append([]string{name, "octet"}, options...) {
+		packet = append(append(packet, f...), 0)
+	}
+	_, err := c.conn.WriteTo(packet, server)
+	require.NoError(c.t, err)
+}
+
+func (c *client) receive() []byte {
+	buf := make([]byte, 65536)
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, addr, err := c.conn.ReadFrom(buf)
+	require.NoError(c.t, err)
+	// the transfer continues from the port of the reply
+	c.server = addr
+	return buf[:n]
+}
+
+func (c *client) ack(block uint16) {
+	packet := []byte{0, opACK, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:], block)
+	_, err := c.conn.WriteTo(packet, c.server)
+	require.NoError(c.t, err)
+}
+
+// readData reads the data blocks of size blockSize until the last one
+func (c *client) readData(blockSize int) []byte {
+	var data []byte
+	for block := uint16(1); ; block++ {
+		packet := c.receive()
+		require.Equal(c.t, uint16(opDATA), binary.BigEndian.Uint16(packet), "%q", packet)
+		require.Equal(c.t, block, binary.BigEndian.Uint16(packet[2:]))
+		data = append(data, packet[4:]...)
+		c.ack(block)
+		if len(packet)-4 < blockSize {
+			return data
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	kernel := bytes.Repeat([]byte("linuxkit kernel "), 160)
+	server := testServer(t, map[string][]byte{"linuxkit-kernel": kernel, "pxelinux.cfg/default": []byte("DEFAULT linuxkit\n")})
+
+	// default block size, so the last block is empty
+	c := newClient(t)
+	c.rrq(server, "linuxkit-kernel")
+	assert.Equal(t, kernel, c.readData(defaultBlockSize))
+
+	// directories, and either separator
+	c = newClient(t)
+	c.rrq(server, "/pxelinux.cfg\\default")
+	assert.Equal(t, []byte("DEFAULT linuxkit\n"), c.readData(defaultBlockSize))
+}
+
+func TestReadOptions(t *testing.T) {
+	kernel := bytes.Repeat([]byte("linuxkit kernel "), 200)
+	server := testServer(t, map[string][]byte{"linuxkit-kernel": kernel})
+
+	c := newClient(t)
+	c.rrq(server, "linuxkit-kernel", "tsize", "0", "blksize", "1024", "foo", "bar")
+	oack := c.receive()
+	assert.Equal(t, append([]byte{0, opOACK}, "tsize\x003200\x00blksize\x001024\x00"...), oack)
+	c.ack(0)
+	assert.Equal(t, kernel, c.readData(1024))
+}
+
+func TestReadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-tftp-outside")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644))
+	server := testServer(t, map[string][]byte{"linuxkit-kernel": []byte("kernel")})
+
+	for _, tc := range []struct {
+		name string
+		code uint16
+	}{
+		{"missing", errFileNotFound},
+		{"../" + filepath.Base(dir) + "/secret", errFileNotFound},
+		{"/", errFileNotFound},
+	} {
+		c := newClient(t)
+		c.rrq(server, tc.name)
+		packet := c.receive()
+		assert.Equal(t, uint16(opERROR), binary.BigEndian.Uint16(packet), tc.name)
+		assert.Equal(t, tc.code, binary.BigEndian.Uint16(packet[2:]), tc.name)
+	}
+
+	// writes are refused
+	c := newClient(t)
+	_, err = c.conn.WriteTo(append([]byte{0, opWRQ}, "linuxkit-kernel\x00octet\x00"...), server)
+	require.NoError(t, err)
+	packet := c.receive()
+	assert.Equal(t, []byte{0, opERROR, 0, errAccessViolated}, packet[:4])
+}
+
+func TestReadRetransmits(t *testing.T) {
+	server := testServer(t, map[string][]byte{"linuxkit-kernel": []byte("kernel")})
+
+	c := newClient(t)
+	c.rrq(server, "linuxkit-kernel")
+	first := c.receive()
+	// not acknowledging the block makes the server send it again
+	again := c.receive()
+	assert.Equal(t, first, again)
+	c.ack(1)
+	assert.Equal(t, []byte{0, opDATA, 0, 1}, first[:4])
+	assert.Equal(t, []byte("kernel"), first[4:])
+}
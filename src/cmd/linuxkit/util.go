@@ -2,12 +2,21 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Handle flags with multiple occurrences
@@ -126,27 +135,79 @@ func splitLines(in string) []string {
 	return res
 }
 
+// splitArgs splits a command line into its arguments on whitespace, as a
+// shell does without expansions: single quotes keep everything up to the
+// next one, double quotes keep everything but a backslash escaping a " or
+// backslash, and a backslash outside quotes escapes the next character
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated ' in %q", s)
+			}
+			arg.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				arg.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("Unterminated \" in %q", s)
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			arg.WriteByte(s[i])
+		default:
+			arg.WriteByte(c)
+		}
+		inArg = true
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// diskSizeUnits are the units of disk sizes, in MB
+var diskSizeUnits = map[string]float64{"K": 1.0 / 1024, "M": 1, "G": 1024, "T": 1024 * 1024}
+
 // This function parses the "size" parameter of a disk specification
-// and returns the size in MB. The "size" parameter defaults to GB, but
-// the unit can be explicitly set with either a G (for GB) or M (for
-// MB). It returns the disk size in MB.
+// and returns the size in MB, rounded up. The "size" parameter defaults
+// to GB, but the unit can be explicitly set with K, M, G or T, with or
+// without the iB or B of KiB or KB, all being powers of 1024, so 4G,
+// 4GB and 4GiB are all 4096 MB. The size may have decimals, such as 1.5G.
 func getDiskSizeMB(s string) (int, error) {
 	if s == "" {
 		return 0, nil
 	}
-	sz := len(s)
-	if strings.HasSuffix(s, "M") {
-		return strconv.Atoi(s[:sz-1])
+	num, unit := s, "G"
+	if i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		num, unit = s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+		unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
 	}
-	if strings.HasSuffix(s, "G") {
-		s = s[:sz-1]
+	n, err := strconv.ParseFloat(num, 64)
+	mb, ok := diskSizeUnits[unit]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("Invalid size %q, it must be a number with an optional unit K, M, G or T, such as 4G", s)
 	}
-
-	i, err := strconv.Atoi(s)
-	if err != nil {
-		return 0, err
-	}
-	return 1024 * i, nil
+	return int(math.Ceil(n * mb)), nil
 }
 
 func convertMBtoGB(i int) int {
@@ -163,9 +224,10 @@ func convertMBtoGB(i int) int {
 
 // DiskConfig is the config for a disk
 type DiskConfig struct {
-	Path   string
-	Size   int
-	Format string
+	Path     string
+	Size     int
+	Format   string
+	ReadOnly bool
 }
 
 // Disks is the type for a list of DiskConfig
@@ -183,6 +245,10 @@ func (l *Disks) Set(value string) error {
 		c := strings.SplitN(p, "=", 2)
 		switch len(c) {
 		case 1:
+			if c[0] == "readonly" {
+				d.ReadOnly = true
+				continue
+			}
 			// assume it is a filename even if no file=x
 			d.Path = c[0]
 		case 2:
@@ -197,6 +263,12 @@ func (l *Disks) Set(value string) error {
 				d.Size = size
 			case "format":
 				d.Format = c[1]
+			case "readonly":
+				ro, err := strconv.ParseBool(c[1])
+				if err != nil {
+					return fmt.Errorf("Invalid readonly value %q: %v", c[1], err)
+				}
+				d.ReadOnly = ro
 			default:
 				return fmt.Errorf("Unknown disk config: %s", c[0])
 			}
@@ -206,11 +278,151 @@ func (l *Disks) Set(value string) error {
 	return nil
 }
 
+// createRawDisk creates the raw disk d, of its size, if it does not exist,
+// for backends which cannot create disks themselves
+func createRawDisk(d DiskConfig) error {
+	if _, err := os.Stat(d.Path); err == nil || d.Size == 0 {
+		return err
+	}
+	f, err := os.Create(d.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(int64(d.Size) * 1024 * 1024)
+}
+
+// snapshotDisks returns disks with the writable disks replaced by copies
+// in a temporary directory, for backends which cannot discard the writes
+// to a disk themselves, so that the disks are never modified. The returned
+// cleanup removes the copies; it is also run if linuxkit is interrupted or
+// terminated.
+func snapshotDisks(disks Disks) (Disks, func(), error) {
+	dir, err := ioutil.TempDir("", "linuxkit-snapshot")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := cleanupOnSignal(func() { os.RemoveAll(dir) })
+
+	snapshot := make(Disks, len(disks))
+	for i, d := range disks {
+		snapshot[i] = d
+		if d.ReadOnly {
+			continue
+		}
+		snapshot[i].Path = filepath.Join(dir, strconv.Itoa(i)+"-"+filepath.Base(d.Path))
+		if err := copyDisk(snapshot[i].Path, d); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("Cannot snapshot disk %s: %v", d.Path, err)
+		}
+	}
+	return snapshot, cleanup, nil
+}
+
+// cleanupOnSignal runs cleanup if linuxkit is interrupted or terminated
+// before the returned function, which runs cleanup once, is called
+func cleanupOnSignal(cleanup func()) func() {
+	var once sync.Once
+	signals := make(chan os.Signal, 1)
+	done := func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			cleanup()
+		})
+	}
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		done()
+		os.Exit(1)
+	}()
+	return done
+}
+
+// stopCmd terminates cmd, which sends to exited when it exits, unless it
+// has exited, killing it if it is still running after 5 seconds, and waits
+// for it
+func stopCmd(cmd *exec.Cmd, exited chan error) {
+	select {
+	case <-exited:
+		return
+	default:
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// copyDisk copies the disk d to path, or creates it empty, of its size, if
+// d does not exist yet
+func copyDisk(path string, d DiskConfig) error {
+	src, err := os.Open(d.Path)
+	if os.IsNotExist(err) {
+		return createRawDisk(DiskConfig{Path: path, Size: d.Size})
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// rejectReadOnly returns an error naming the backend if any of the disks
+// are read-only, for backends which cannot attach a disk read-only
+func (l Disks) rejectReadOnly(backend string) error {
+	for _, d := range l {
+		if d.ReadOnly {
+			return fmt.Errorf("the %s backend cannot attach disk %s read-only", backend, d.Path)
+		}
+	}
+	return nil
+}
+
+// macImage is the -mac of the backends for a MAC address derived from the
+// image name
+const macImage = "image"
+
+// parseMAC parses the MAC address s of the network interface of a VM,
+// which must be unicast
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("%q is not a MAC address, such as 52:54:00:12:34:56", s)
+	}
+	if mac[0]&0x01 != 0 {
+		return nil, fmt.Errorf("%s is a multicast MAC address", s)
+	}
+	return mac, nil
+}
+
+// imageMAC is a MAC address derived from the hash of the image name, so
+// that it is the same for every run of the image. It has the locally
+// administered 52:54:00 prefix of the addresses qemu generates.
+func imageMAC(name string) net.HardwareAddr {
+	sum := sha256.Sum256([]byte(name))
+	return net.HardwareAddr{0x52, 0x54, 0x00, sum[0], sum[1], sum[2]}
+}
+
 // PublishedPort is used by some backends to expose a VMs port on the host
 type PublishedPort struct {
 	Guest    uint16
 	Host     uint16
 	Protocol string
+	// HostIP is the address of the host to publish the port on, nil for
+	// the default of the backend
+	HostIP net.IP
 }
 
 // NewPublishedPort parses a string of the form <host>:<guest>[/<tcp|udp>] and returns a PublishedPort structure
@@ -255,6 +467,142 @@ func NewPublishedPort(publish string) (PublishedPort, error) {
 	return p, nil
 }
 
+// NewPublishedPorts parses a string of the form
+// [<address>:]<host>:<guest>[/<tcp|udp>], where <host> and <guest> are
+// ports or ranges of ports of the same length, such as
+// 8000-8010:9000-9010/udp, and <address> the address of the host to publish
+// them on, an IPv6 address being in brackets, such as [::1]:8080:80, and
+// returns a PublishedPort for each port
+func NewPublishedPorts(publish string) ([]PublishedPort, error) {
+	hostIP, publish, err := splitPublishHostIP(publish)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := newPublishedPorts(publish)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ports {
+		ports[i].HostIP = hostIP
+	}
+	return ports, nil
+}
+
+// splitPublishHostIP splits the host address, if there is one, off a port
+// publish string, returning it and the ports
+func splitPublishHostIP(publish string) (net.IP, string, error) {
+	if strings.HasPrefix(publish, "[") {
+		end := strings.Index(publish, "]:")
+		if end < 0 {
+			return nil, "", fmt.Errorf("Unable to parse the host address to publish on, should be in format [<IPv6 address>]:<host>:<guest>")
+		}
+		ip := net.ParseIP(publish[1:end])
+		if ip == nil || ip.To4() != nil {
+			return nil, "", fmt.Errorf("%q is not an IPv6 address", publish[1:end])
+		}
+		return ip, publish[end+2:], nil
+	}
+	parts := strings.Split(strings.SplitN(publish, "/", 2)[0], ":")
+	switch {
+	case len(parts) < 3:
+		return nil, publish, nil
+	case len(parts) > 3:
+		return nil, "", fmt.Errorf("Unable to parse the host address to publish on, an IPv6 address should be in brackets, such as [::1]:8080:80")
+	}
+	ip := net.ParseIP(parts[0])
+	if ip == nil || ip.To4() == nil {
+		return nil, "", fmt.Errorf("%q is not an IPv4 address, an IPv6 address should be in brackets, such as [::1]:8080:80", parts[0])
+	}
+	return ip.To4(), strings.TrimPrefix(publish, parts[0]+":"), nil
+}
+
+// publishHost is the host address of p, as given to -publish, or "" if it
+// has none
+func (p PublishedPort) publishHost() string {
+	switch {
+	case p.HostIP == nil:
+		return ""
+	case p.HostIP.To4() == nil:
+		return "[" + p.HostIP.String() + "]"
+	}
+	return p.HostIP.String()
+}
+
+func newPublishedPorts(publish string) ([]PublishedPort, error) {
+	if !strings.Contains(publish, "-") {
+		p, err := NewPublishedPort(publish)
+		if err != nil {
+			return nil, err
+		}
+		return []PublishedPort{p}, nil
+	}
+
+	left := strings.Split(publish, "/")
+	protocol := "tcp"
+	if len(left) == 2 {
+		protocol = strings.TrimSpace(strings.ToLower(left[1]))
+	}
+	slice := strings.Split(left[0], ":")
+	if len(left) > 2 || len(slice) != 2 {
+		return nil, fmt.Errorf("Unable to parse the port ranges to be published, should be in format <host>-<host>:<guest>-<guest> or <host>-<host>:<guest>-<guest>/<tcp|udp>")
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("Provided protocol is not valid, valid options are: udp and tcp")
+	}
+	hostFirst, hostLast, err := parsePortRange(slice[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid host port range %s: %v", slice[0], err)
+	}
+	guestFirst, guestLast, err := parsePortRange(slice[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid guest port range %s: %v", slice[1], err)
+	}
+	if hostLast-hostFirst != guestLast-guestFirst {
+		return nil, fmt.Errorf("The host port range %s and guest port range %s are of different lengths", slice[0], slice[1])
+	}
+
+	var ports []PublishedPort
+	for i := 0; i <= int(hostLast-hostFirst); i++ {
+		ports = append(ports, PublishedPort{Host: hostFirst + uint16(i), Guest: guestFirst + uint16(i), Protocol: protocol})
+	}
+	return ports, nil
+}
+
+// parsePortRange parses a port, or a range of ports <first>-<last>
+func parsePortRange(s string) (uint16, uint16, error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) > 2 {
+		return 0, 0, fmt.Errorf("should be a port or <first>-<last>")
+	}
+	var ports []uint16
+	for _, b := range bounds {
+		port, err := strconv.ParseUint(b, 10, 16)
+		if err != nil || port < 1 {
+			return 0, 0, fmt.Errorf("%q is not a port", b)
+		}
+		ports = append(ports, uint16(port))
+	}
+	first, last := ports[0], ports[len(ports)-1]
+	if last < first {
+		return 0, 0, fmt.Errorf("the last port is before the first")
+	}
+	return first, last, nil
+}
+
+// expandPublishedPorts parses the port publish flags of a backend, with
+// their ranges expanded
+func expandPublishedPorts(publishFlags []string) ([]PublishedPort, error) {
+	var ports []PublishedPort
+	for _, publish := range publishFlags {
+		p, err := NewPublishedPorts(publish)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse port publish %s: %v", publish, err)
+		}
+		ports = append(ports, p...)
+	}
+	return ports, nil
+}
+
 // CreateMetadataISO writes the provided meta data to an iso file in the given state directory
 func CreateMetadataISO(state, data string, dataPath string) ([]string, error) {
 	var d []byte
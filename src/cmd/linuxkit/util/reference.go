@@ -1,6 +1,9 @@
 package util
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // ReferenceExpand expands "redis" to "docker.io/library/redis" so all images have a full domain
 func ReferenceExpand(ref string) string {
@@ -14,3 +17,54 @@ func ReferenceExpand(ref string) string {
 		return ref
 	}
 }
+
+// splitRegistry splits ref into its registry, docker.io if it has none, and
+// the rest of it, library/ being implied for an official image on the hub
+func splitRegistry(ref string) (string, string) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		if parts[0] == "index.docker.io" {
+			parts[0] = "docker.io"
+		}
+		if parts[0] == "docker.io" && !strings.Contains(parts[1], "/") {
+			parts[1] = "library/" + parts[1]
+		}
+		return parts[0], parts[1]
+	}
+	if len(parts) == 1 {
+		return "docker.io", "library/" + ref
+	}
+	return "docker.io", ref
+}
+
+// ValidateRegistryPrefix checks prefix, such as registry.example.com/mirror,
+// starts with the registry an image is given a name under with it
+func ValidateRegistryPrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+	registry, _ := splitRegistry(strings.TrimSuffix(prefix, "/") + "/image")
+	if registry == "docker.io" && !strings.HasPrefix(prefix, "docker.io/") && !strings.HasPrefix(prefix, "index.docker.io/") {
+		return fmt.Errorf("registry prefix %q must start with a registry, such as registry.example.com/%s", prefix, prefix)
+	}
+	return nil
+}
+
+// PrefixReference returns the name of the image ref under the namespace
+// prefix, such as registry.example.com/mirror, of a registry mirroring it:
+// prefix/linuxkit/init:v0.8 for linuxkit/init:v0.8 or
+// docker.io/linuxkit/init:v0.8 from the hub, and
+// prefix/quay.io/org/image:v1 for quay.io/org/image:v1 from another
+// registry. Its tag and digest are kept, and an image already under prefix
+// is returned as it is.
+func PrefixReference(ref, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" || strings.HasPrefix(ref, prefix+"/") {
+		return ref
+	}
+	registry, path := splitRegistry(ref)
+	if registry != "docker.io" {
+		path = registry + "/" + path
+	}
+	return prefix + "/" + path
+}
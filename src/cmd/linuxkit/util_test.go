@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisksSet(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		disk DiskConfig
+	}{
+		{"disk.img", DiskConfig{Path: "disk.img"}},
+		{"file=disk.img,size=1G,format=qcow2", DiskConfig{Path: "disk.img", Size: 1024, Format: "qcow2"}},
+		{"disk.img,readonly", DiskConfig{Path: "disk.img", ReadOnly: true}},
+		{"readonly,file=disk.img", DiskConfig{Path: "disk.img", ReadOnly: true}},
+		{"file=disk.img,readonly=true", DiskConfig{Path: "disk.img", ReadOnly: true}},
+		{"file=disk.img,readonly=false", DiskConfig{Path: "disk.img"}},
+		{"file=readonly", DiskConfig{Path: "readonly"}},
+	} {
+		var disks Disks
+		require.NoError(t, disks.Set(tc.spec), tc.spec)
+		require.Len(t, disks, 1)
+		assert.Equal(t, tc.disk, disks[0], tc.spec)
+	}
+
+	for _, spec := range []string{"disk.img,readonly=maybe", "disk.img,size=big"} {
+		var disks Disks
+		assert.Error(t, disks.Set(spec), spec)
+	}
+}
+
+func TestDisksRejectReadOnly(t *testing.T) {
+	disks := Disks{{Path: "a.img"}}
+	assert.NoError(t, disks.rejectReadOnly("vbox"))
+	disks = append(disks, DiskConfig{Path: "b.img", ReadOnly: true})
+	assert.EqualError(t, disks.rejectReadOnly("vbox"), "the vbox backend cannot attach disk b.img read-only")
+}
+
+func TestQemuReadOnlyDrive(t *testing.T) {
+	config := QemuConfig{
+		Arch:   "x86_64",
+		CPUs:   "1",
+		Memory: "1024",
+		Disks:  Disks{{Path: "a.img", Format: "raw", ReadOnly: true}, {Path: "b.qcow2"}},
+	}
+	_, args := buildQemuCmdline(config)
+	cmdline := strings.Join(args, " ")
+	assert.Contains(t, cmdline, "-drive file=a.img,format=raw,index=0,media=disk,readonly=on ")
+	assert.Contains(t, cmdline, "-drive file=b.qcow2,index=1,media=disk ")
+}
+
+func TestParseMAC(t *testing.T) {
+	for s, want := range map[string]net.HardwareAddr{
+		"52:54:00:12:34:56": {0x52, 0x54, 0x00, 0x12, 0x34, 0x56},
+		"52-54-00-12-34-56": {0x52, 0x54, 0x00, 0x12, 0x34, 0x56},
+		"02:00:00:00:00:01": {0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+	} {
+		mac, err := parseMAC(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, mac, s)
+	}
+	for s, e := range map[string]string{
+		"52:54:00:12:34":          `"52:54:00:12:34" is not a MAC address, such as 52:54:00:12:34:56`,
+		"52:54:00:12:34:5g":       `"52:54:00:12:34:5g" is not a MAC address, such as 52:54:00:12:34:56`,
+		"00:00:5e:00:53:01:02:03": `"00:00:5e:00:53:01:02:03" is not a MAC address, such as 52:54:00:12:34:56`,
+		"image":                   `"image" is not a MAC address, such as 52:54:00:12:34:56`,
+		"01:00:5e:00:00:fb":       "01:00:5e:00:00:fb is a multicast MAC address",
+	} {
+		_, err := parseMAC(s)
+		assert.EqualError(t, err, e, s)
+	}
+}
+
+func TestImageMAC(t *testing.T) {
+	mac := imageMAC("linuxkit")
+	assert.Equal(t, "52:54:00:8f:ef:75", mac.String())
+	assert.Equal(t, mac, imageMAC("linuxkit"))
+	assert.NotEqual(t, mac, imageMAC("sshd"))
+	_, err := parseMAC(imageMAC("sshd").String())
+	assert.NoError(t, err)
+}
+
+func TestNewPublishedPorts(t *testing.T) {
+	for _, tc := range []struct {
+		publish string
+		ports   []PublishedPort
+	}{
+		{"8080:80", []PublishedPort{{Host: 8080, Guest: 80, Protocol: "tcp"}}},
+		{"53:53/udp", []PublishedPort{{Host: 53, Guest: 53, Protocol: "udp"}}},
+		{"8000-8002:9000-9002/udp", []PublishedPort{
+			{Host: 8000, Guest: 9000, Protocol: "udp"},
+			{Host: 8001, Guest: 9001, Protocol: "udp"},
+			{Host: 8002, Guest: 9002, Protocol: "udp"},
+		}},
+		{"8000-8001:8000-8001/TCP", []PublishedPort{
+			{Host: 8000, Guest: 8000, Protocol: "tcp"},
+			{Host: 8001, Guest: 8001, Protocol: "tcp"},
+		}},
+		{"8000-8000:80", []PublishedPort{{Host: 8000, Guest: 80, Protocol: "tcp"}}},
+		{"127.0.0.1:8080:80", []PublishedPort{{Host: 8080, Guest: 80, Protocol: "tcp", HostIP: net.IPv4(127, 0, 0, 1).To4()}}},
+		{"[::1]:8080:80/tcp", []PublishedPort{{Host: 8080, Guest: 80, Protocol: "tcp", HostIP: net.IPv6loopback}}},
+		{"[fd00::1]:8000-8001:9000-9001/udp", []PublishedPort{
+			{Host: 8000, Guest: 9000, Protocol: "udp", HostIP: net.ParseIP("fd00::1")},
+			{Host: 8001, Guest: 9001, Protocol: "udp", HostIP: net.ParseIP("fd00::1")},
+		}},
+		{"0.0.0.0:53:53/udp", []PublishedPort{{Host: 53, Guest: 53, Protocol: "udp", HostIP: net.IPv4zero.To4()}}},
+	} {
+		ports, err := NewPublishedPorts(tc.publish)
+		require.NoError(t, err, tc.publish)
+		assert.Equal(t, tc.ports, ports, tc.publish)
+	}
+
+	for _, tc := range []struct {
+		publish, err string
+	}{
+		{"8000-8010:8000-8009", "The host port range 8000-8010 and guest port range 8000-8009 are of different lengths"},
+		{"8000-8010", "Unable to parse the port ranges to be published, should be in format <host>-<host>:<guest>-<guest> or <host>-<host>:<guest>-<guest>/<tcp|udp>"},
+		{"8000-8001:8000-8001/sctp", "Provided protocol is not valid, valid options are: udp and tcp"},
+		{"8010-8000:8010-8000", "Invalid host port range 8010-8000: the last port is before the first"},
+		{"8000-8001:0-1", `Invalid guest port range 0-1: "0" is not a port`},
+		{"8000-8001-8002:8000-8001", "Invalid host port range 8000-8001-8002: should be a port or <first>-<last>"},
+		{"8000-70000:8000-70000", `Invalid host port range 8000-70000: "70000" is not a port`},
+		{"::1:8080:80", "Unable to parse the host address to publish on, an IPv6 address should be in brackets, such as [::1]:8080:80"},
+		{"[::1:8080:80", "Unable to parse the host address to publish on, should be in format [<IPv6 address>]:<host>:<guest>"},
+		{"[127.0.0.1]:8080:80", `"127.0.0.1" is not an IPv6 address`},
+		{"[localhost]:8080:80", `"localhost" is not an IPv6 address`},
+		{"localhost:8080:80", `"localhost" is not an IPv4 address, an IPv6 address should be in brackets, such as [::1]:8080:80`},
+		{"[::1]:8080", "Unable to parse the ports to be published, should be in format <host>:<guest> or <host>:<guest>/<tcp|udp>"},
+		{"127.0.0.1:8000-8001:80", "The host port range 8000-8001 and guest port range 80 are of different lengths"},
+	} {
+		_, err := NewPublishedPorts(tc.publish)
+		assert.EqualError(t, err, tc.err, tc.publish)
+	}
+
+	// IPv4 and IPv6 specs mixed
+	ports, err := expandPublishedPorts([]string{"8080:80", "127.0.0.1:8443:443", "[::1]:8443:443", "[::]:53:53/udp"})
+	require.NoError(t, err)
+	var hosts []string
+	for _, p := range ports {
+		hosts = append(hosts, p.publishHost())
+	}
+	assert.Equal(t, []string{"", "127.0.0.1", "[::1]", "[::]"}, hosts)
+}
+
+func TestSnapshotDisks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-disks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	disk := filepath.Join(dir, "disk.raw")
+	require.NoError(t, ioutil.WriteFile(disk, []byte("original"), 0644))
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(disk, old, old))
+	data := filepath.Join(dir, "data.iso")
+
+	disks := Disks{{Path: disk}, {Path: data, ReadOnly: true}, {Path: filepath.Join(dir, "new.raw"), Size: 1}}
+	snapshot, cleanup, err := snapshotDisks(disks)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 3)
+	assert.NotEqual(t, disk, snapshot[0].Path)
+	assert.Equal(t, disks[1], snapshot[1])
+
+	// the VM writes to the copy
+	b, err := ioutil.ReadFile(snapshot[0].Path)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("original"), b)
+	require.NoError(t, ioutil.WriteFile(snapshot[0].Path, []byte("modified"), 0644))
+	fi, err := os.Stat(snapshot[2].Path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024), fi.Size())
+
+	cleanup()
+	cleanup()
+	for _, d := range []DiskConfig{snapshot[0], snapshot[2]} {
+		_, err := os.Stat(d.Path)
+		assert.True(t, os.IsNotExist(err), d.Path)
+	}
+	_, err = os.Stat(filepath.Join(dir, "new.raw"))
+	assert.True(t, os.IsNotExist(err))
+	b, err = ioutil.ReadFile(disk)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("original"), b)
+	fi, err = os.Stat(disk)
+	require.NoError(t, err)
+	assert.True(t, fi.ModTime().Equal(old), "%v != %v", fi.ModTime(), old)
+}
+
+func TestGetDiskSizeMB(t *testing.T) {
+	for s, mb := range map[string]int{
+		"":       0,
+		"4":      4096,
+		"4G":     4096,
+		"4GB":    4096,
+		"4GiB":   4096,
+		"4g":     4096,
+		"512M":   512,
+		"512MiB": 512,
+		"1.5G":   1536,
+		"1T":     1024 * 1024,
+		"2048K":  2,
+		"100K":   1,
+	} {
+		got, err := getDiskSizeMB(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, mb, got, s)
+	}
+	for _, s := range []string{"G", "4X", "4 GiBs", "-1G", "1.2.3G", "4iB"} {
+		_, err := getDiskSizeMB(s)
+		assert.EqualError(t, err, `Invalid size "`+s+`", it must be a number with an optional unit K, M, G or T, such as 4G`)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for s, args := range map[string][]string{
+		"":                                  nil,
+		"  ":                                nil,
+		"-m 1024":                           {"-m", "1024"},
+		" -device  e1000,netdev=n1\n":       {"-device", "e1000,netdev=n1"},
+		`-append 'console=ttyS0 quiet'`:     {"-append", "console=ttyS0 quiet"},
+		`-name "a \"b\" \\ \c"`:             {"-name", `a "b" \ \c`},
+		`a\ b c''d ""`:                      {"a b", "cd", ""},
+		`-drive file='my disk.img',if=none`: {"-drive", "file=my disk.img,if=none"},
+	} {
+		got, err := splitArgs(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, args, got, s)
+	}
+	_, err := splitArgs(`-append 'quiet`)
+	assert.EqualError(t, err, `Unterminated ' in "-append 'quiet"`)
+	_, err = splitArgs(`-name "a`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/linuxkit/linuxkit/src/cmd/linuxkit/version"
+)
+
+// versionInfo is what linuxkit version reports about the build of linuxkit
+type versionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	// GitTreeState is clean, or dirty if the build had uncommitted changes
+	GitTreeState string `json:"gitTreeState"`
+	BuildDate    string `json:"buildDate"`
+	GoVersion    string `json:"goVersion"`
+	Platform     string `json:"platform"`
+}
+
+func getVersionInfo() versionInfo {
+	return versionInfo{
+		Version:      version.Version,
+		GitCommit:    version.GitCommit,
+		GitTreeState: version.GitTreeState,
+		BuildDate:    version.BuildDate,
+		GoVersion:    runtime.Version(),
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+func printVersion(args []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Usage = func() {
+		invoked := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "USAGE: %s version [options]\n\n", invoked)
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flags.PrintDefaults()
+	}
+	short := flags.Bool("short", false, "Print only the version")
+	format := flags.String("format", "text", "Output format, text or json")
+	if err := flags.Parse(args); err != nil {
+		os.Exit(1)
+	}
+	if *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "unknown -format %q, must be text or json\n", *format)
+		os.Exit(1)
+	}
+	if err := writeVersion(os.Stdout, getVersionInfo(), *format, *short); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// writeVersion writes v to w as JSON, or as text, only the version of it
+// with short
+func writeVersion(w io.Writer, v versionInfo, format string, short bool) error {
+	if format == "json" {
+		if short {
+			return json.NewEncoder(w).Encode(struct {
+				Version string `json:"version"`
+			}{v.Version})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if short {
+		_, err := fmt.Fprintln(w, v.Version)
+		return err
+	}
+	state := ""
+	if v.GitTreeState == "dirty" {
+		state = " (dirty)"
+	}
+	_, err := fmt.Fprintf(w, "%s version %s\ncommit: %s%s\nbuilt: %s\ngo: %s %s\n",
+		filepath.Base(os.Args[0]), v.Version, v.GitCommit, state, v.BuildDate, v.GoVersion, v.Platform)
+	return err
+}
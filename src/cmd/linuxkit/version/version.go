@@ -6,4 +6,11 @@ var (
 
 	// GitCommit hash, set at compile time
 	GitCommit = "unknown"
+
+	// GitTreeState is "clean", or "dirty" if the work tree had
+	// uncommitted changes, set at compile time
+	GitTreeState = "unknown"
+
+	// BuildDate is the UTC time of the build in RFC 3339, set at compile time
+	BuildDate = "unknown"
 )
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteVersion(t *testing.T) {
+	v := versionInfo{
+		Version:      "v0.8.0-20201028150614-1a2b3c4d5e6f",
+		GitCommit:    "1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b",
+		GitTreeState: "dirty",
+		BuildDate:    "2020-10-28T15:06:14Z",
+		GoVersion:    "go1.15.3",
+		Platform:     "linux/amd64",
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeVersion(&buf, v, "json", false))
+	var got versionInfo
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, v, got)
+
+	buf.Reset()
+	require.NoError(t, writeVersion(&buf, v, "json", true))
+	var short map[string]string
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &short))
+	assert.Equal(t, map[string]string{"version": v.Version}, short)
+
+	buf.Reset()
+	require.NoError(t, writeVersion(&buf, v, "text", true))
+	assert.Equal(t, v.Version+"\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, writeVersion(&buf, v, "text", false))
+	assert.Contains(t, buf.String(), "version "+v.Version+"\n")
+	assert.Contains(t, buf.String(), "commit: "+v.GitCommit+" (dirty)\n")
+	assert.Contains(t, buf.String(), "built: "+v.BuildDate+"\n")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	vhdFooterSize = 512
+	vhdCookie     = "conectix"
+	// vhdAlignment is the alignment of the virtual size of the VHDs Azure
+	// creates images from
+	vhdAlignment = 1 << 20
+
+	vhdDiskTypeFixed = 2
+)
+
+// azureVHD returns the path of a fixed VHD, with a virtual size aligned to
+// 1MiB, of the disk image path, a VHD or a raw image, and whether it is a
+// converted copy, written next to path, that should be removed after use
+func azureVHD(path string) (string, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	size := fi.Size()
+
+	// without a VHD footer, the disk image is raw
+	if size >= vhdFooterSize {
+		footer := make([]byte, vhdFooterSize)
+		if _, err := f.ReadAt(footer, size-vhdFooterSize); err != nil {
+			return "", false, err
+		}
+		if bytes.HasPrefix(footer, []byte(vhdCookie)) {
+			if t := binary.BigEndian.Uint32(footer[60:]); t != vhdDiskTypeFixed {
+				return "", false, fmt.Errorf("%s is not a fixed VHD, convert it with: qemu-img convert -O vpc -o subformat=fixed,force_size", path)
+			}
+			size -= vhdFooterSize
+			if current := binary.BigEndian.Uint64(footer[48:]); current == uint64(size) && size%vhdAlignment == 0 {
+				return path, false, nil
+			}
+		}
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.vhd")
+	if err != nil {
+		return "", false, err
+	}
+	if err := writeFixedVHD(out, f, size); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", false, fmt.Errorf("Cannot convert %s to a VHD: %v", path, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", false, err
+	}
+	return out.Name(), true, nil
+}
+
+// writeFixedVHD writes the size bytes of the disk read from r to out as a
+// fixed VHD, leaving a hole where they are padded to vhdAlignment
+func writeFixedVHD(out *os.File, r io.Reader, size int64) error {
+	if _, err := io.CopyN(out, r, size); err != nil {
+		return err
+	}
+	aligned := (size + vhdAlignment - 1) / vhdAlignment * vhdAlignment
+	if err := out.Truncate(aligned); err != nil {
+		return err
+	}
+	footer, err := vhdFixedFooter(uint64(aligned))
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteAt(footer, aligned)
+	return err
+}
+
+// vhdFixedFooter is the footer of a fixed VHD of size bytes
+func vhdFixedFooter(size uint64) ([]byte, error) {
+	f := make([]byte, vhdFooterSize)
+	copy(f, vhdCookie)
+	// features, reserved, and file format version 1.0
+	binary.BigEndian.PutUint32(f[8:], 2)
+	binary.BigEndian.PutUint32(f[12:], 0x00010000)
+	// a fixed disk has no data offset
+	binary.BigEndian.PutUint64(f[16:], ^uint64(0))
+	copy(f[28:], "lkit")
+	binary.BigEndian.PutUint32(f[32:], 0x00010000)
+	copy(f[36:], "Wi2k")
+	binary.BigEndian.PutUint64(f[40:], size)
+	binary.BigEndian.PutUint64(f[48:], size)
+	binary.BigEndian.PutUint32(f[56:], vhdGeometry(size))
+	binary.BigEndian.PutUint32(f[60:], vhdDiskTypeFixed)
+	if _, err := rand.Read(f[68:84]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(f[64:], vhdChecksum(f))
+	return f, nil
+}
+
+// vhdGeometry is the cylinder, heads and sectors per track of a disk of size
+// bytes, calculated as in the VHD specification
+func vhdGeometry(size uint64) uint32 {
+	sectors := size / 512
+	if sectors > 65535*16*255 {
+		sectors = 65535 * 16 * 255
+	}
+	var spt, heads, cth uint64
+	if sectors >= 65535*16*63 {
+		spt, heads = 255, 16
+		cth = sectors / spt
+	} else {
+		spt = 17
+		cth = sectors / spt
+		heads = (cth + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cth >= heads*1024 || heads > 16 {
+			spt, heads = 31, 16
+			cth = sectors / spt
+		}
+		if cth >= heads*1024 {
+			spt, heads = 63, 16
+			cth = sectors / spt
+		}
+	}
+	return uint32(cth/heads)<<16 | uint32(heads)<<8 | uint32(spt)
+}
+
+// vhdChecksum is the one's complement of the sum of the bytes of footer,
+// leaving out its checksum
+func vhdChecksum(footer []byte) uint32 {
+	var sum uint32
+	for i, b := range footer {
+		if i < 64 || i >= 68 {
+			sum += uint32(b)
+		}
+	}
+	return ^sum
+}
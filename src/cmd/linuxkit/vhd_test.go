@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/radu-matei/azure-vhd-utils/vhdcore/validator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAzureVHDConvertsRaw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vhd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	raw := filepath.Join(dir, "disk.img")
+	data := bytes.Repeat([]byte("linuxkit"), 1000)
+	require.NoError(t, ioutil.WriteFile(raw, data, 0644))
+
+	vhd, converted, err := azureVHD(raw)
+	require.NoError(t, err)
+	assert.True(t, converted)
+	assert.Equal(t, dir, filepath.Dir(vhd))
+
+	b, err := ioutil.ReadFile(vhd)
+	require.NoError(t, err)
+	require.Len(t, b, vhdAlignment+vhdFooterSize)
+	assert.Equal(t, data, b[:len(data)])
+	assert.Equal(t, make([]byte, vhdAlignment-len(data)), b[len(data):vhdAlignment])
+	footer := b[vhdAlignment:]
+	assert.Equal(t, vhdCookie, string(footer[:8]))
+	assert.Equal(t, uint64(vhdAlignment), binary.BigEndian.Uint64(footer[48:]))
+	assert.Equal(t, uint32(vhdDiskTypeFixed), binary.BigEndian.Uint32(footer[60:]))
+	assert.Equal(t, vhdChecksum(footer), binary.BigEndian.Uint32(footer[64:]))
+
+	assert.NoError(t, validator.ValidateVhd(vhd))
+
+	// once converted, the VHD is used as it is
+	again, converted, err := azureVHD(vhd)
+	require.NoError(t, err)
+	assert.False(t, converted)
+	assert.Equal(t, vhd, again)
+}
+
+func TestAzureVHDAlignsFixedVHD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vhd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// a fixed VHD of 3MiB and a sector, as qemu-img makes with force_size
+	size := int64(3*vhdAlignment + 512)
+	footer, err := vhdFixedFooter(uint64(size))
+	require.NoError(t, err)
+	path := filepath.Join(dir, "disk.vhd")
+	b := append(bytes.Repeat([]byte{1}, int(size)), footer...)
+	require.NoError(t, ioutil.WriteFile(path, b, 0644))
+
+	vhd, converted, err := azureVHD(path)
+	require.NoError(t, err)
+	assert.True(t, converted)
+	c, err := ioutil.ReadFile(vhd)
+	require.NoError(t, err)
+	require.Len(t, c, 4*vhdAlignment+vhdFooterSize)
+	assert.Equal(t, b[:size], c[:size])
+	assert.Equal(t, uint64(4*vhdAlignment), binary.BigEndian.Uint64(c[4*vhdAlignment+48:]))
+	assert.NoError(t, validator.ValidateVhd(vhd))
+}
+
+func TestAzureVHDRefusesDynamicVHD(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vhd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	footer, err := vhdFixedFooter(vhdAlignment)
+	require.NoError(t, err)
+	binary.BigEndian.PutUint32(footer[60:], 3)
+	path := filepath.Join(dir, "disk.vhd")
+	require.NoError(t, ioutil.WriteFile(path, append(make([]byte, 1024), footer...), 0644))
+
+	_, _, err = azureVHD(path)
+	assert.Error(t, err)
+}
+
+func TestVHDGeometry(t *testing.T) {
+	// 1GiB is 2080 cylinders, 16 heads and 63 sectors per track, as
+	// qemu-img calculates
+	assert.Equal(t, uint32(2080<<16|16<<8|63), vhdGeometry(1<<30))
+	// 1MiB is 30 cylinders, 4 heads and 17 sectors per track
+	assert.Equal(t, uint32(30<<16|4<<8|17), vhdGeometry(1<<20))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// virtiofsShare is a host directory shared with the VM by a virtiofsd,
+// which the VM mounts with mount -t virtiofs <tag> <dir>
+type virtiofsShare struct {
+	Source string
+	Tag    string
+	// Socket is the vhost-user socket of its virtiofsd, which qemu connects to
+	Socket string
+}
+
+// parseVirtiofs parses the -virtiofs s, src=HOSTDIR,tag=TAG
+func parseVirtiofs(s string) (virtiofsShare, error) {
+	var share virtiofsShare
+	for _, opt := range strings.Split(s, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return share, fmt.Errorf("%q is not key=value in %q", opt, s)
+		}
+		switch kv[0] {
+		case "src", "source":
+			share.Source = kv[1]
+		case "tag":
+			share.Tag = kv[1]
+		default:
+			return share, fmt.Errorf("unknown option %q in %q, the options are src and tag", kv[0], s)
+		}
+	}
+	if share.Source == "" || share.Tag == "" {
+		return share, fmt.Errorf("%q needs both src=HOSTDIR and tag=TAG", s)
+	}
+	// the virtio-fs tag is at most 36 bytes
+	if len(share.Tag) > 36 {
+		return share, fmt.Errorf("tag %q is longer than 36 characters", share.Tag)
+	}
+	var err error
+	share.Source, err = shareDir(share.Source)
+	return share, err
+}
+
+// shareDir returns the absolute path of the host directory dir, to share
+// with a VM
+func shareDir(dir string) (string, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// virtiofsdPaths are where distributions install virtiofsd, outside of the $PATH
+var virtiofsdPaths = []string{"/usr/libexec/virtiofsd", "/usr/lib/qemu/virtiofsd", "/usr/lib/virtiofsd"}
+
+// findVirtiofsd returns the virtiofsd to run, path if it is set
+func findVirtiofsd(path string) (string, error) {
+	if path != "" {
+		return exec.LookPath(path)
+	}
+	if p, err := exec.LookPath("virtiofsd"); err == nil {
+		return p, nil
+	}
+	for _, p := range virtiofsdPaths {
+		if _, err := exec.LookPath(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("-virtiofs needs virtiofsd, which is not in the $PATH or in %s. Install it, such as with the virtiofsd package, or give its path with -virtiofsd", strings.Join(virtiofsdPaths, ", "))
+}
+
+// virtiofsdArgs are the arguments of the virtiofsd serving share
+func virtiofsdArgs(share virtiofsShare) []string {
+	args := []string{"--socket-path=" + share.Socket, "--shared-dir=" + share.Source, "--cache=auto"}
+	// the default sandbox needs to be root to set up its namespaces
+	if os.Geteuid() != 0 {
+		args = append(args, "--sandbox=none")
+	}
+	return args
+}
+
+// virtiofsdTimeout is how long a virtiofsd has to create its socket
+var virtiofsdTimeout = 10 * time.Second
+
+// startVirtiofs starts a virtiofsd for each of shares, with their sockets
+// in a temporary directory, returning the shares with their Socket set
+// once every virtiofsd is listening. The returned stop stops them and
+// removes the sockets; it is also run if linuxkit is interrupted or
+// terminated.
+func startVirtiofs(virtiofsd string, shares []virtiofsShare) ([]virtiofsShare, func(), error) {
+	if len(shares) == 0 {
+		return nil, func() {}, nil
+	}
+	// in a temporary directory rather than the state directory, as socket
+	// paths are limited to 108 bytes
+	dir, err := ioutil.TempDir("", "linuxkit-virtiofs")
+	if err != nil {
+		return nil, nil, err
+	}
+	var cmds []*exec.Cmd
+	var exited []chan error
+	stop := cleanupOnSignal(func() {
+		for i, cmd := range cmds {
+			// virtiofsd exits by itself when qemu disconnects
+			stopCmd(cmd, exited[i])
+		}
+		os.RemoveAll(dir)
+	})
+
+	started := make([]virtiofsShare, len(shares))
+	for i, share := range shares {
+		share.Socket = filepath.Join(dir, fmt.Sprintf("%d.sock", i))
+		cmd := exec.Command(virtiofsd, virtiofsdArgs(share)...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		log.Debugf("Starting virtiofsd: %v", cmd.Args)
+		if err := cmd.Start(); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("Cannot start virtiofsd for %s: %v", share.Source, err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		cmds = append(cmds, cmd)
+		exited = append(exited, done)
+		if err := waitVirtiofsd(share.Socket, done); err != nil {
+			stop()
+			return nil, nil, fmt.Errorf("virtiofsd for %s failed: %v", share.Source, err)
+		}
+		started[i] = share
+	}
+	return started, stop, nil
+}
+
+// waitVirtiofsd waits for the virtiofsd, which sends to exited when it
+// exits, to create its socket
+func waitVirtiofsd(socket string, exited chan error) error {
+	deadline := time.Now().Add(virtiofsdTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			// for stopCmd
+			exited <- err
+			if err == nil {
+				return fmt.Errorf("it exited before creating %s", socket)
+			}
+			return fmt.Errorf("it exited before creating %s: %v", socket, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("it did not create %s within %s", socket, virtiofsdTimeout)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVirtiofs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-virtiofs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	require.NoError(t, ioutil.WriteFile(file, nil, 0644))
+
+	share, err := parseVirtiofs("src=" + dir + ",tag=share")
+	require.NoError(t, err)
+	assert.Equal(t, virtiofsShare{Source: dir, Tag: "share"}, share)
+
+	// relative to the current directory
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(cwd)
+	require.NoError(t, os.Mkdir("src", 0755))
+	share, err = parseVirtiofs("tag=src,source=src")
+	require.NoError(t, err)
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, virtiofsShare{Source: filepath.Join(wd, "src"), Tag: "src"}, share)
+
+	for s, e := range map[string]string{
+		"src=" + dir:                                     `"src=` + dir + `" needs both src=HOSTDIR and tag=TAG`,
+		"tag=share":                                      `"tag=share" needs both src=HOSTDIR and tag=TAG`,
+		"src=" + dir + ",tag":                            `"tag" is not key=value in "src=` + dir + `,tag"`,
+		"src=" + dir + ",tag=share,cache=always":         `unknown option "cache" in "src=` + dir + `,tag=share,cache=always", the options are src and tag`,
+		"src=" + file + ",tag=share":                     file + " is not a directory",
+		"src=" + dir + ",tag=" + strings.Repeat("t", 37): `tag "` + strings.Repeat("t", 37) + `" is longer than 36 characters`,
+	} {
+		_, err := parseVirtiofs(s)
+		assert.EqualError(t, err, e, s)
+	}
+	_, err = parseVirtiofs("src=" + filepath.Join(dir, "missing") + ",tag=share")
+	assert.Error(t, err)
+}
+
+func TestBuildQemuCmdlineVirtiofs(t *testing.T) {
+	state, err := ioutil.TempDir("", "linuxkit-qemu")
+	require.NoError(t, err)
+	defer os.RemoveAll(state)
+
+	config := QemuConfig{
+		Path:      "image.iso",
+		ISOBoot:   true,
+		StatePath: state,
+		Arch:      "x86_64",
+		CPUs:      "1",
+		Memory:    "2048",
+		Virtiofs: []virtiofsShare{
+			{Source: "/src", Tag: "share", Socket: "/tmp/0.sock"},
+			{Source: "/data", Tag: "data", Socket: "/tmp/1.sock"},
+		},
+	}
+	_, args := buildQemuCmdline(config)
+	containsArgs(t, args, "-m", "2048")
+	containsArgs(t, args, "-object", "memory-backend-memfd,id=mem,size=2048M,share=on", "-numa", "node,memdev=mem")
+	containsArgs(t, args, "-chardev", "socket,id=virtiofs0,path=/tmp/0.sock", "-device", "vhost-user-fs-pci,queue-size=1024,chardev=virtiofs0,tag=share")
+	containsArgs(t, args, "-chardev", "socket,id=virtiofs1,path=/tmp/1.sock", "-device", "vhost-user-fs-pci,queue-size=1024,chardev=virtiofs1,tag=data")
+
+	config.Arch = "s390x"
+	config.Memory = "2G"
+	_, args = buildQemuCmdline(config)
+	containsArgs(t, args, "-object", "memory-backend-memfd,id=mem,size=2G,share=on", "-numa", "node,memdev=mem")
+	containsArgs(t, args, "-device", "vhost-user-fs-ccw,queue-size=1024,chardev=virtiofs0,tag=share")
+
+	// without shares the memory is not shared
+	config.Virtiofs = nil
+	_, args = buildQemuCmdline(config)
+	assert.NotContains(t, args, "-numa")
+}
+
+// fakeVirtiofsd writes a virtiofsd running script to dir, which records
+// its arguments next to its socket
+func fakeVirtiofsd(t *testing.T, dir, script string) string {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh is not available")
+	}
+	path := filepath.Join(dir, "virtiofsd")
+	require.NoError(t, ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755))
+	return path
+}
+
+const fakeVirtiofsdListen = `socket=${1#--socket-path=}
+echo "$@" > "$socket.args"
+touch "$socket"
+trap 'rm "$socket"; exit 0' TERM
+while :; do sleep 0.1; done
+`
+
+func TestFindVirtiofsd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-virtiofsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(p []string) { virtiofsdPaths = p }(virtiofsdPaths)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+
+	os.Setenv("PATH", dir)
+	virtiofsdPaths = []string{filepath.Join(dir, "libexec", "virtiofsd")}
+	_, err = findVirtiofsd("")
+	assert.EqualError(t, err, "-virtiofs needs virtiofsd, which is not in the $PATH or in "+virtiofsdPaths[0]+". Install it, such as with the virtiofsd package, or give its path with -virtiofsd")
+	_, err = findVirtiofsd(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "libexec"), 0755))
+	libexec := fakeVirtiofsd(t, filepath.Join(dir, "libexec"), "")
+	path, err := findVirtiofsd("")
+	require.NoError(t, err)
+	assert.Equal(t, libexec, path)
+
+	// the $PATH first
+	inPath := fakeVirtiofsd(t, dir, "")
+	path, err = findVirtiofsd("")
+	require.NoError(t, err)
+	assert.Equal(t, inPath, path)
+	path, err = findVirtiofsd(libexec)
+	require.NoError(t, err)
+	assert.Equal(t, libexec, path)
+}
+
+func TestStartVirtiofs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-virtiofsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	virtiofsd := fakeVirtiofsd(t, dir, fakeVirtiofsdListen)
+
+	shares, stop, err := startVirtiofs(virtiofsd, []virtiofsShare{{Source: "/src", Tag: "share"}, {Source: "/data", Tag: "data"}})
+	require.NoError(t, err)
+	require.Len(t, shares, 2)
+	sockets := filepath.Dir(shares[0].Socket)
+	for i, share := range shares {
+		assert.FileExists(t, share.Socket)
+		args, err := ioutil.ReadFile(share.Socket + ".args")
+		require.NoError(t, err)
+		assert.Equal(t, strings.Join(virtiofsdArgs(share), " ")+"\n", string(args))
+		assert.Equal(t, []string{"/src", "/data"}[i], share.Source)
+	}
+	assert.Contains(t, strings.Join(virtiofsdArgs(shares[0]), " "), "--shared-dir=/src")
+
+	// stopped, and the sockets removed, even if it is stopped twice
+	stop()
+	stop()
+	_, err = os.Stat(sockets)
+	assert.True(t, os.IsNotExist(err), "%s is not removed", sockets)
+
+	shares, stop, err = startVirtiofs(virtiofsd, nil)
+	require.NoError(t, err)
+	assert.Empty(t, shares)
+	stop()
+}
+
+func TestStartVirtiofsFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "linuxkit-virtiofsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { virtiofsdTimeout = d }(virtiofsdTimeout)
+	virtiofsdTimeout = 500 * time.Millisecond
+
+	_, _, err = startVirtiofs(fakeVirtiofsd(t, dir, "exit 1\n"), []virtiofsShare{{Source: "/src", Tag: "share"}})
+	require.Error(t, err)
+	assert.Regexp(t, `^virtiofsd for /src failed: it exited before creating .*/0.sock: exit status 1$`, err.Error())
+
+	// never listening, it is terminated
+	pidFile := filepath.Join(dir, "pid")
+	_, _, err = startVirtiofs(fakeVirtiofsd(t, dir, "echo $$ > "+pidFile+"\nwhile :; do sleep 0.1; done\n"), []virtiofsShare{{Source: "/src", Tag: "share"}})
+	require.Error(t, err)
+	assert.Regexp(t, `^virtiofsd for /src failed: it did not create .*/0.sock within 500ms$`, err.Error())
+	pid, err := ioutil.ReadFile(pidFile)
+	require.NoError(t, err)
+	assert.Error(t, exec.Command("kill", "-0", strings.TrimSpace(string(pid))).Run(), "virtiofsd is still running")
+
+	_, _, err = startVirtiofs(filepath.Join(dir, "missing"), []virtiofsShare{{Source: "/src", Tag: "share"}})
+	assert.Error(t, err)
+}
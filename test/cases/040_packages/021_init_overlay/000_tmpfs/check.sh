@@ -0,0 +1,13 @@
+#!/bin/sh
+
+function failed {
+	printf "init_overlay test suite FAILED\n" >&1
+	exit 1
+}
+
+grep -q " /hostroot overlay " /proc/mounts || failed
+# the write of a previous boot is lost with the tmpfs
+[ ! -e /hostroot/etc/overlay-test ] || failed
+touch /hostroot/etc/overlay-test || failed
+
+printf "init_overlay test suite PASSED\n" >&1
@@ -0,0 +1,26 @@
+#!/bin/sh
+# SUMMARY: Check that the root is a writable overlay on a tmpfs, which is lost on reboot
+# LABELS:
+# REPEAT:
+
+set -e
+
+# Source libraries. Uncomment if needed/defined
+#. "${RT_LIB}"
+. "${RT_PROJECT_ROOT}/_lib/lib.sh"
+
+NAME=test-init-overlay
+
+clean_up() {
+	rm -rf ${NAME}-*
+}
+trap clean_up EXIT
+
+linuxkit build -format kernel+initrd -name ${NAME} test.yml
+for i in 1 2; do
+	RESULT="$(linuxkit run ${NAME})"
+	echo "${RESULT}"
+	echo "${RESULT}" | grep -q "suite PASSED"
+done
+
+exit 0
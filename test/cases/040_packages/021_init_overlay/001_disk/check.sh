@@ -0,0 +1,16 @@
+#!/bin/sh
+
+function failed {
+	printf "init_overlay test suite FAILED\n" >&1
+	exit 1
+}
+
+grep -q " /hostroot overlay " /proc/mounts || failed
+# the write of the first boot is kept on the disk
+if [ -e /hostroot/etc/overlay-test ]; then
+	printf "init_overlay test suite PASSED\n" >&1
+	exit 0
+fi
+touch /hostroot/etc/overlay-test || failed
+
+printf "init_overlay test file created\n" >&1
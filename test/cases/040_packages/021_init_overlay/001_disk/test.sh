@@ -0,0 +1,40 @@
+#!/bin/sh
+# SUMMARY: Check that the root is a writable overlay on a disk, which is kept on reboot
+# LABELS:
+# REPEAT:
+
+set -e
+
+# Source libraries. Uncomment if needed/defined
+#. "${RT_LIB}"
+. "${RT_PROJECT_ROOT}/_lib/lib.sh"
+
+NAME=test-init-overlay
+FORMAT=test-init-overlay-format
+DISK=disk.img
+
+clean_up() {
+	rm -rf ${NAME}-* ${FORMAT}-* ${DISK} test.yml format.yml
+}
+trap clean_up EXIT
+
+if [ "${RT_OS}" = "osx" ]; then
+	DEVICE="/dev/vda"
+else
+	DEVICE="/dev/sda"
+fi
+
+sed -e "s,@DEVICE@,${DEVICE},g" format.yml.in > format.yml
+sed -e "s,@DEVICE@,${DEVICE},g" test.yml.in > test.yml
+linuxkit build -format kernel+initrd -name ${FORMAT} format.yml
+linuxkit build -format kernel+initrd -name ${NAME} test.yml
+linuxkit run -disk file=${DISK},size=512M ${FORMAT}
+
+RESULT="$(linuxkit run -disk file=${DISK} ${NAME})"
+echo "${RESULT}"
+echo "${RESULT}" | grep -q "test file created"
+RESULT="$(linuxkit run -disk file=${DISK} ${NAME})"
+echo "${RESULT}"
+echo "${RESULT}" | grep -q "suite PASSED"
+
+exit 0